@@ -0,0 +1,228 @@
+// Package agentpgtest provides helpers for testing agents without calling
+// the Claude API.
+//
+// It contains three pieces:
+//
+//   - FakeProvider: a scripted provider.Provider that returns a queue of
+//     canned responses (text, tool_use blocks, stop reasons, API errors) for
+//     both the streaming and batch paths.
+//   - NewPool and NewClient: spin up a migrated, isolated PostgreSQL schema
+//     and a Client with fast polling intervals. NewClient takes any driver,
+//     so tests that do not need PostgreSQL can use driver/memory instead.
+//   - Cassette: records real API exchanges to a file and replays them.
+//
+// A typical test:
+//
+//	func TestWeatherAgent(t *testing.T) {
+//	    pool := agentpgtest.NewPool(t)
+//	    fake := agentpgtest.NewFakeProvider(
+//	        agentpgtest.ToolUse(agentpgtest.Call("get_weather", map[string]any{"city": "Paris"})),
+//	        agentpgtest.Text("It is sunny in Paris."),
+//	    )
+//	    client := agentpgtest.NewClient(t, pgxv5.New(pool), fake, nil)
+//	    _ = client.RegisterTool(&WeatherTool{})
+//	    agentpgtest.Start(t, client)
+//	    // create agent, session and run as usual
+//	}
+package agentpgtest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/youssefsiam38/agentpg"
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/provider"
+	"github.com/youssefsiam38/agentpg/storage"
+)
+
+// DatabaseURLEnv is the environment variable holding the PostgreSQL
+// connection string used by NewPool. Tests are skipped when it is unset.
+const DatabaseURLEnv = "AGENTPG_TEST_DATABASE_URL"
+
+// Polling intervals used by NewClient so tests do not wait on the
+// production defaults.
+const (
+	TestPollInterval      = 50 * time.Millisecond
+	TestHeartbeatInterval = time.Second
+)
+
+// NewPool connects to the database named by AGENTPG_TEST_DATABASE_URL,
+// creates a uniquely named schema, applies all migrations to it and returns
+// a pool whose connections use that schema. The schema is dropped when the
+// test finishes. The test is skipped if the variable is unset.
+func NewPool(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+
+	pool, err := pgxpool.New(context.Background(), NewDatabaseURL(t))
+	if err != nil {
+		t.Fatalf("agentpgtest: failed to create pool: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// NewDatabaseURL is like NewPool but returns a connection string for the
+// migrated schema instead of a pool, for drivers that open their own
+// connections such as the database/sql driver.
+func NewDatabaseURL(t testing.TB) string {
+	t.Helper()
+
+	url := os.Getenv(DatabaseURLEnv)
+	if url == "" {
+		t.Skipf("%s is not set", DatabaseURLEnv)
+	}
+
+	ctx := context.Background()
+	schema := "agentpg_test_" + randomHex(6)
+
+	admin, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatalf("agentpgtest: failed to connect: %v", err)
+	}
+	defer func() { _ = admin.Close(ctx) }()
+
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("agentpgtest: failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(context.Background(), url)
+		if err != nil {
+			t.Logf("agentpgtest: failed to connect for cleanup: %v", err)
+			return
+		}
+		defer func() { _ = conn.Close(context.Background()) }()
+		if _, err := conn.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Logf("agentpgtest: failed to drop schema %s: %v", schema, err)
+		}
+	})
+
+	schemaURL, err := withSearchPath(url, schema)
+	if err != nil {
+		t.Fatalf("agentpgtest: invalid database URL: %v", err)
+	}
+
+	pool, err := pgxpool.New(ctx, schemaURL)
+	if err != nil {
+		t.Fatalf("agentpgtest: failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	if err := Migrate(ctx, pool); err != nil {
+		t.Fatalf("agentpgtest: %v", err)
+	}
+
+	return schemaURL
+}
+
+// withSearchPath returns the connection string with search_path set to
+// schema. Both URL and keyword/value connection strings are accepted.
+func withSearchPath(connString, schema string) (string, error) {
+	if !strings.HasPrefix(connString, "postgres://") && !strings.HasPrefix(connString, "postgresql://") {
+		return connString + " search_path=" + schema, nil
+	}
+	u, err := neturl.Parse(connString)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Migrate applies all up migrations, in order, using the pool's search path.
+func Migrate(ctx context.Context, pool *pgxpool.Pool) error {
+	files, err := fs.Glob(storage.Migrations, "migrations/*.up.sql")
+	if err != nil {
+		return fmt.Errorf("failed to list migrations: %w", err)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		sql, err := fs.ReadFile(storage.Migrations, file)
+		if err != nil {
+			return fmt.Errorf("failed to read migration %s: %w", file, err)
+		}
+		if _, err := pool.Exec(ctx, string(sql)); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", strings.TrimPrefix(file, "migrations/"), err)
+		}
+	}
+	return nil
+}
+
+// NewClient creates a client on the driver using the given provider
+// (typically a FakeProvider or Cassette). Polling intervals default to TestPollInterval
+// and batches are polled every TestPollInterval without a poll cap; fields set
+// in config are kept. The client is not started so tools can be
+// registered first; call Start. A started client is stopped when the test
+// finishes.
+func NewClient[TTx any](t testing.TB, drv driver.Driver[TTx], p provider.Provider, config *agentpg.ClientConfig) *agentpg.Client[TTx] {
+	t.Helper()
+
+	if config == nil {
+		config = &agentpg.ClientConfig{}
+	}
+	config.Provider = p
+	if config.Name == "" {
+		config.Name = t.Name()
+	}
+	if config.BatchPollInterval <= 0 {
+		config.BatchPollInterval = TestPollInterval
+	}
+	if config.BatchPollConfig == nil {
+		config.BatchPollConfig = &agentpg.BatchPollConfig{
+			InitialInterval:   TestPollInterval,
+			MaxInterval:       TestPollInterval,
+			MaxPollsPerMinute: -1,
+		}
+	}
+	if config.RunPollInterval <= 0 {
+		config.RunPollInterval = TestPollInterval
+	}
+	if config.ToolPollInterval <= 0 {
+		config.ToolPollInterval = TestPollInterval
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = TestHeartbeatInterval
+	}
+
+	client, err := agentpg.NewClient(drv, config)
+	if err != nil {
+		t.Fatalf("agentpgtest: failed to create client: %v", err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = client.Stop(ctx) // ErrClientNotStarted if the test never started it
+	})
+
+	return client
+}
+
+// Start starts the client, failing the test on error.
+func Start[TTx any](t testing.TB, client *agentpg.Client[TTx]) {
+	t.Helper()
+
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatalf("agentpgtest: failed to start client: %v", err)
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,311 @@
+package agentpgtest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg"
+	"github.com/youssefsiam38/agentpg/agentpgtest"
+	"github.com/youssefsiam38/agentpg/driver/memory"
+	"github.com/youssefsiam38/agentpg/provider"
+	"github.com/youssefsiam38/agentpg/tool"
+)
+
+// weatherTool answers get_weather calls with a fixed forecast.
+type weatherTool struct{}
+
+func (weatherTool) Name() string        { return "get_weather" }
+func (weatherTool) Description() string { return "Get the weather for a city" }
+func (weatherTool) InputSchema() tool.ToolSchema {
+	return tool.ToolSchema{
+		Type:       "object",
+		Properties: map[string]tool.PropertyDef{"city": {Type: "string"}},
+		Required:   []string{"city"},
+	}
+}
+
+func (weatherTool) Execute(ctx context.Context, input json.RawMessage) (string, error) {
+	var in struct {
+		City string `json:"city"`
+	}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return "", err
+	}
+	return "sunny in " + in.City, nil
+}
+
+// startClient starts a client on the memory driver with the weather tool and
+// returns it with a session and an agent that can use the tool. config may be
+// nil.
+func startClient(t *testing.T, p provider.Provider, config *agentpg.ClientConfig) (*agentpg.Client[*memory.Tx], uuid.UUID, uuid.UUID) {
+	t.Helper()
+	ctx := context.Background()
+
+	client := agentpgtest.NewClient(t, memory.New(), p, config)
+	if err := client.RegisterTool(weatherTool{}); err != nil {
+		t.Fatalf("RegisterTool: %v", err)
+	}
+	agentpgtest.Start(t, client)
+
+	agent, err := client.CreateAgent(ctx, &agentpg.AgentDefinition{
+		Name:  "weather",
+		Model: "claude-sonnet-4-5-20250929",
+		Tools: []string{"get_weather"},
+	})
+	if err != nil {
+		t.Fatalf("CreateAgent: %v", err)
+	}
+	sessionID, err := client.NewSession(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	return client, sessionID, agent.ID
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestStreamingRun(t *testing.T) {
+	fake := agentpgtest.NewFakeProvider(
+		agentpgtest.Text("Hello there.").WithUsage(10, 3),
+	)
+	client, sessionID, agentID := startClient(t, fake, nil)
+
+	resp, err := client.RunFastSync(testContext(t), sessionID, agentID, "Hi", nil)
+	if err != nil {
+		t.Fatalf("RunFastSync: %v", err)
+	}
+	if resp.Text != "Hello there." {
+		t.Errorf("Text = %q, want %q", resp.Text, "Hello there.")
+	}
+	if resp.StopReason != "end_turn" {
+		t.Errorf("StopReason = %q, want end_turn", resp.StopReason)
+	}
+
+	requests := fake.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	if requests[0].Mode != agentpgtest.ModeStream {
+		t.Errorf("Mode = %q, want %q", requests[0].Mode, agentpgtest.ModeStream)
+	}
+	if fake.Remaining() != 0 {
+		t.Errorf("Remaining = %d, want 0", fake.Remaining())
+	}
+}
+
+func TestBatchRunWithTool(t *testing.T) {
+	fake := agentpgtest.NewFakeProvider(
+		agentpgtest.ToolUse(agentpgtest.Call("get_weather", map[string]any{"city": "Paris"})),
+		agentpgtest.Text("It is sunny in Paris."),
+	)
+	client, sessionID, agentID := startClient(t, fake, nil)
+
+	resp, err := client.RunSync(testContext(t), sessionID, agentID, "Weather in Paris?", nil)
+	if err != nil {
+		t.Fatalf("RunSync: %v", err)
+	}
+	if resp.Text != "It is sunny in Paris." {
+		t.Errorf("Text = %q, want %q", resp.Text, "It is sunny in Paris.")
+	}
+	if resp.ToolIterations != 1 {
+		t.Errorf("ToolIterations = %d, want 1", resp.ToolIterations)
+	}
+
+	requests := fake.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	for i, req := range requests {
+		if req.Mode != agentpgtest.ModeBatch {
+			t.Errorf("request %d: Mode = %q, want %q", i, req.Mode, agentpgtest.ModeBatch)
+		}
+	}
+
+	// The second request carries the tool result back to the model
+	data, err := json.Marshal(requests[1].Params.Messages)
+	if err != nil {
+		t.Fatalf("marshal messages: %v", err)
+	}
+	var messages []struct {
+		Content []struct {
+			Type    string          `json:"type"`
+			Content json.RawMessage `json:"content"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(data, &messages); err != nil {
+		t.Fatalf("unmarshal messages: %v", err)
+	}
+	var found bool
+	for _, message := range messages {
+		for _, block := range message.Content {
+			if block.Type == "tool_result" && strings.Contains(string(block.Content), "sunny in Paris") {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("second request has no tool_result for get_weather: %s", data)
+	}
+}
+
+// failingResults fails the first failures downloads of batch results.
+type failingResults struct {
+	*agentpgtest.FakeProvider
+	failures  int
+	downloads atomic.Int32
+}
+
+func (p *failingResults) GetBatchResults(ctx context.Context, batchID string) ([]anthropic.MessageBatchIndividualResponse, error) {
+	if int(p.downloads.Add(1)) <= p.failures {
+		return nil, errors.New("connection reset by peer")
+	}
+	return p.FakeProvider.GetBatchResults(ctx, batchID)
+}
+
+func TestBatchResultsDownloadRetried(t *testing.T) {
+	retry := &agentpg.APIRetryConfig{MaxAttempts: 3, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	t.Run("recovers", func(t *testing.T) {
+		p := &failingResults{FakeProvider: agentpgtest.NewFakeProvider(agentpgtest.Text("Done.")), failures: 2}
+		client, sessionID, agentID := startClient(t, p, &agentpg.ClientConfig{APIRetryConfig: retry})
+
+		resp, err := client.RunSync(testContext(t), sessionID, agentID, "Hi", nil)
+		if err != nil {
+			t.Fatalf("RunSync: %v", err)
+		}
+		if resp.Text != "Done." {
+			t.Errorf("Text = %q, want %q", resp.Text, "Done.")
+		}
+		if n := p.downloads.Load(); n != 3 {
+			t.Errorf("downloaded results %d times, want 3", n)
+		}
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		p := &failingResults{FakeProvider: agentpgtest.NewFakeProvider(agentpgtest.Text("Done.")), failures: 3}
+		client, sessionID, agentID := startClient(t, p, &agentpg.ClientConfig{APIRetryConfig: retry})
+
+		_, err := client.RunSync(testContext(t), sessionID, agentID, "Hi", nil)
+		var agentErr *agentpg.AgentError
+		if !errors.As(err, &agentErr) || agentErr.Context["error_type"] != "batch_error" {
+			t.Fatalf("RunSync error = %v, want batch_error", err)
+		}
+		if n := p.downloads.Load(); n != 3 {
+			t.Errorf("downloaded results %d times, want 3", n)
+		}
+	})
+}
+
+func TestResubmitAsStreamingSwitchesOneIteration(t *testing.T) {
+	fake := agentpgtest.NewFakeProvider(
+		agentpgtest.BatchExpired(),
+		agentpgtest.ToolUse(agentpgtest.Call("get_weather", map[string]any{"city": "Rome"})),
+		agentpgtest.Text("It is sunny in Rome."),
+	)
+	client, sessionID, agentID := startClient(t, fake, &agentpg.ClientConfig{
+		BatchRecoveryConfig: &agentpg.BatchRecoveryConfig{ResubmitAsStreaming: true},
+	})
+	ctx := testContext(t)
+
+	runID, err := client.Run(ctx, sessionID, agentID, "Weather in Rome?", nil)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, err := client.WaitForRun(ctx, runID); err != nil {
+		t.Fatalf("WaitForRun: %v", err)
+	}
+
+	// The expired request is streamed; the iteration after it is batched again
+	want := []string{agentpgtest.ModeBatch, agentpgtest.ModeStream, agentpgtest.ModeBatch}
+	requests := fake.Requests()
+	if len(requests) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(requests), len(want))
+	}
+	for i, req := range requests {
+		if req.Mode != want[i] {
+			t.Errorf("request %d: Mode = %q, want %q", i, req.Mode, want[i])
+		}
+	}
+
+	run, err := client.GetRun(ctx, runID)
+	if err != nil {
+		t.Fatalf("GetRun: %v", err)
+	}
+	if run.RunMode != agentpg.RunModeBatch {
+		t.Errorf("RunMode = %q, want %q", run.RunMode, agentpg.RunModeBatch)
+	}
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	// Record through a fake provider standing in for the API
+	fake := agentpgtest.NewFakeProvider(
+		agentpgtest.ToolUse(agentpgtest.Call("get_weather", map[string]any{"city": "Oslo"})),
+		agentpgtest.Text("It is sunny in Oslo."),
+	)
+	recorder, err := agentpgtest.NewCassette(path, agentpgtest.CassetteRecord, fake)
+	if err != nil {
+		t.Fatalf("NewCassette(record): %v", err)
+	}
+	client, sessionID, agentID := startClient(t, recorder, nil)
+	recorded, err := client.RunFastSync(testContext(t), sessionID, agentID, "Weather in Oslo?", nil)
+	if err != nil {
+		t.Fatalf("RunFastSync while recording: %v", err)
+	}
+	if err := recorder.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Replay without the fake; every recorded interaction is used
+	player, err := agentpgtest.NewCassette(path, agentpgtest.CassetteReplay, nil)
+	if err != nil {
+		t.Fatalf("NewCassette(replay): %v", err)
+	}
+	client, sessionID, agentID = startClient(t, player, nil)
+	replayed, err := client.RunFastSync(testContext(t), sessionID, agentID, "Weather in Oslo?", nil)
+	if err != nil {
+		t.Fatalf("RunFastSync while replaying: %v", err)
+	}
+	if replayed.Text != recorded.Text {
+		t.Errorf("replayed Text = %q, recorded %q", replayed.Text, recorded.Text)
+	}
+	if replayed.ToolIterations != 1 {
+		t.Errorf("ToolIterations = %d, want 1", replayed.ToolIterations)
+	}
+	if n := player.Unused(); n != 0 {
+		t.Errorf("Unused = %d, want 0", n)
+	}
+
+	// A request that was never recorded is a miss
+	_, err = player.CountTokens(context.Background(), anthropic.MessageCountTokensParams{})
+	if !errors.Is(err, agentpgtest.ErrCassetteMiss) {
+		t.Errorf("CountTokens error = %v, want ErrCassetteMiss", err)
+	}
+}
+
+func TestScheduleUnknownAgent(t *testing.T) {
+	client, _, _ := startClient(t, agentpgtest.NewFakeProvider(), nil)
+
+	_, err := client.Schedule(testContext(t), agentpg.ScheduleSpec{
+		Name:    "nightly",
+		Cron:    "@daily",
+		AgentID: uuid.New(),
+		Prompt:  "Summarize the day",
+	})
+	if !errors.Is(err, agentpg.ErrAgentNotFound) {
+		t.Errorf("Schedule error = %v, want ErrAgentNotFound", err)
+	}
+}
@@ -0,0 +1,532 @@
+package agentpgtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/youssefsiam38/agentpg/provider"
+)
+
+// RecordEnv is the environment variable that switches OpenCassette to record
+// mode when set to "1".
+const RecordEnv = "AGENTPG_RECORD"
+
+// ErrCassetteMiss is returned in replay mode when no recorded interaction is
+// left for a request.
+var ErrCassetteMiss = errors.New("agentpgtest: no recorded interaction for request")
+
+// CassetteMode selects whether a Cassette records or replays.
+type CassetteMode int
+
+const (
+	// CassetteReplay answers requests from the cassette file without network
+	// access.
+	CassetteReplay CassetteMode = iota
+
+	// CassetteRecord forwards requests to the inner provider and records the
+	// exchanges.
+	CassetteRecord
+)
+
+// Cassette method names.
+const (
+	methodCreateMessage   = "create_message"
+	methodStreamMessage   = "stream_message"
+	methodCountTokens     = "count_tokens"
+	methodSubmitBatch     = "submit_batch"
+	methodGetBatch        = "get_batch"
+	methodGetBatchResults = "get_batch_results"
+)
+
+// Interaction is one recorded provider call.
+type Interaction struct {
+	Method   string            `json:"method"`
+	Request  json.RawMessage   `json:"request"`
+	Response json.RawMessage   `json:"response,omitempty"`
+	Events   []json.RawMessage `json:"events,omitempty"`
+	Error    *RecordedError    `json:"error,omitempty"`
+}
+
+// RecordedError is an error returned by the inner provider during recording.
+type RecordedError struct {
+	// StatusCode and Body are set for API errors (*anthropic.Error).
+	StatusCode int             `json:"status_code,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+
+	// Message is the error text.
+	Message string `json:"message"`
+}
+
+// cassetteFile is the on-disk format of a cassette.
+type cassetteFile struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Cassette is a provider.Provider that records real API exchanges to a JSON
+// file and replays them. In replay mode each request is answered by the first
+// unused interaction with the same method and request body, or failing that
+// the first unused interaction with the same method, so small differences
+// such as generated IDs do not break replay.
+type Cassette struct {
+	path  string
+	mode  CassetteMode
+	inner provider.Provider
+
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+
+	// customIDs maps custom IDs of replayed batch requests to the
+	// recorded ones. Custom IDs are iteration IDs and differ between runs.
+	customIDs map[string]string
+}
+
+// Compile-time check that Cassette implements provider.Provider.
+var _ provider.Provider = (*Cassette)(nil)
+
+// NewCassette creates a cassette backed by the file at path. In replay mode
+// the file is loaded and inner is not used. In record mode inner receives the
+// requests and the file is written by Save.
+func NewCassette(path string, mode CassetteMode, inner provider.Provider) (*Cassette, error) {
+	c := &Cassette{
+		path:      path,
+		mode:      mode,
+		inner:     inner,
+		customIDs: make(map[string]string),
+	}
+
+	switch mode {
+	case CassetteRecord:
+		if inner == nil {
+			return nil, errors.New("agentpgtest: record mode requires an inner provider")
+		}
+	case CassetteReplay:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cassette: %w", err)
+		}
+		var file cassetteFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse cassette %s: %w", path, err)
+		}
+		c.interactions = file.Interactions
+		c.used = make([]bool, len(file.Interactions))
+	default:
+		return nil, fmt.Errorf("agentpgtest: invalid cassette mode %d", mode)
+	}
+
+	return c, nil
+}
+
+// OpenCassette opens the cassette at path for a test. When AGENTPG_RECORD=1
+// it records through inner (provider.NewAnthropic() reading
+// ANTHROPIC_API_KEY if inner is nil) and saves the file when the test
+// finishes; otherwise it replays.
+func OpenCassette(t testing.TB, path string, inner provider.Provider) *Cassette {
+	t.Helper()
+
+	mode := CassetteReplay
+	if os.Getenv(RecordEnv) == "1" {
+		mode = CassetteRecord
+		if inner == nil {
+			inner = provider.NewAnthropic()
+		}
+	}
+
+	c, err := NewCassette(path, mode, inner)
+	if err != nil {
+		if mode == CassetteReplay && errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("agentpgtest: cassette %s not found; run with %s=1 to record it", path, RecordEnv)
+		}
+		t.Fatalf("agentpgtest: %v", err)
+	}
+
+	if mode == CassetteRecord {
+		t.Cleanup(func() {
+			if err := c.Save(); err != nil {
+				t.Errorf("agentpgtest: %v", err)
+			}
+		})
+	}
+
+	return c
+}
+
+// Mode returns the cassette's mode.
+func (c *Cassette) Mode() CassetteMode {
+	return c.mode
+}
+
+// Save writes the recorded interactions to the cassette file, creating
+// parent directories as needed.
+func (c *Cassette) Save() error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(cassetteFile{Interactions: c.interactions}, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cassette directory: %w", err)
+	}
+	if err := os.WriteFile(c.path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	return nil
+}
+
+// record appends an interaction.
+func (c *Cassette) record(method string, request any, response string, events []json.RawMessage, callErr error) {
+	reqJSON, err := json.Marshal(request)
+	if err != nil {
+		reqJSON = []byte("null")
+	}
+
+	interaction := Interaction{
+		Method:  method,
+		Request: reqJSON,
+		Events:  events,
+	}
+	if response != "" {
+		interaction.Response = json.RawMessage(response)
+	}
+	if callErr != nil {
+		interaction.Error = &RecordedError{Message: callErr.Error()}
+		var apiErr *anthropic.Error
+		if errors.As(callErr, &apiErr) {
+			interaction.Error.StatusCode = apiErr.StatusCode
+			if raw := apiErr.RawJSON(); json.Valid([]byte(raw)) {
+				interaction.Error.Body = json.RawMessage(raw)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.interactions = append(c.interactions, interaction)
+	c.mu.Unlock()
+}
+
+// replay returns the interaction answering a request and marks it used.
+func (c *Cassette) replay(method string, request any) (*Interaction, error) {
+	reqJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	match := -1
+	for i, in := range c.interactions {
+		if c.used[i] || in.Method != method {
+			continue
+		}
+		if jsonEqual(in.Request, reqJSON) {
+			match = i
+			break
+		}
+		if match == -1 {
+			match = i
+		}
+	}
+	if match == -1 {
+		return nil, fmt.Errorf("%w (method %s)", ErrCassetteMiss, method)
+	}
+	c.used[match] = true
+	return &c.interactions[match], nil
+}
+
+// replayError rebuilds a recorded error. API errors become *anthropic.Error
+// so they are classified as they were during recording.
+func replayError(recorded *RecordedError) error {
+	if recorded.StatusCode == 0 {
+		return errors.New(recorded.Message)
+	}
+	apiErr := &anthropic.Error{
+		StatusCode: recorded.StatusCode,
+		Request:    &http.Request{Method: http.MethodPost, URL: &url.URL{Scheme: "https", Host: "cassette.invalid"}},
+		Response:   &http.Response{StatusCode: recorded.StatusCode, Header: http.Header{}},
+	}
+	var body bytes.Buffer
+	if json.Compact(&body, recorded.Body) == nil {
+		_ = apiErr.UnmarshalJSON(body.Bytes())
+	}
+	return apiErr
+}
+
+func jsonEqual(a, b []byte) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// Unused returns the number of recorded interactions not yet replayed.
+func (c *Cassette) Unused() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, used := range c.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
+
+// CreateMessage implements provider.Provider.
+func (c *Cassette) CreateMessage(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+	if c.mode == CassetteRecord {
+		message, err := c.inner.CreateMessage(ctx, params)
+		var raw string
+		if message != nil {
+			raw = message.RawJSON()
+		}
+		c.record(methodCreateMessage, params, raw, nil, err)
+		return message, err
+	}
+
+	in, err := c.replay(methodCreateMessage, params)
+	if err != nil {
+		return nil, err
+	}
+	if in.Error != nil {
+		return nil, replayError(in.Error)
+	}
+	var message anthropic.Message
+	if err := json.Unmarshal(in.Response, &message); err != nil {
+		return nil, fmt.Errorf("agentpgtest: failed to decode recorded message: %w", err)
+	}
+	return &message, nil
+}
+
+// StreamMessage implements provider.Provider. Recorded stream events are
+// replayed through onEvent in order.
+func (c *Cassette) StreamMessage(ctx context.Context, params anthropic.MessageNewParams, onEvent func(anthropic.MessageStreamEventUnion)) (*anthropic.Message, error) {
+	if c.mode == CassetteRecord {
+		var events []json.RawMessage
+		message, err := c.inner.StreamMessage(ctx, params, func(event anthropic.MessageStreamEventUnion) {
+			events = append(events, json.RawMessage(event.RawJSON()))
+			if onEvent != nil {
+				onEvent(event)
+			}
+		})
+		c.record(methodStreamMessage, params, "", events, err)
+		return message, err
+	}
+
+	in, err := c.replay(methodStreamMessage, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var message anthropic.Message
+	for _, raw := range in.Events {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var event anthropic.MessageStreamEventUnion
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, fmt.Errorf("agentpgtest: failed to decode recorded event: %w", err)
+		}
+		if onEvent != nil {
+			onEvent(event)
+		}
+		if err := message.Accumulate(event); err != nil {
+			return nil, fmt.Errorf("failed to accumulate stream event: %w", err)
+		}
+	}
+	if in.Error != nil {
+		return nil, replayError(in.Error)
+	}
+	return &message, nil
+}
+
+// CountTokens implements provider.Provider.
+func (c *Cassette) CountTokens(ctx context.Context, params anthropic.MessageCountTokensParams) (int64, error) {
+	if c.mode == CassetteRecord {
+		tokens, err := c.inner.CountTokens(ctx, params)
+		var raw string
+		if err == nil {
+			raw = fmt.Sprintf(`{"input_tokens":%d}`, tokens)
+		}
+		c.record(methodCountTokens, params, raw, nil, err)
+		return tokens, err
+	}
+
+	in, err := c.replay(methodCountTokens, params)
+	if err != nil {
+		return 0, err
+	}
+	if in.Error != nil {
+		return 0, replayError(in.Error)
+	}
+	var result struct {
+		InputTokens int64 `json:"input_tokens"`
+	}
+	if err := json.Unmarshal(in.Response, &result); err != nil {
+		return 0, fmt.Errorf("agentpgtest: failed to decode recorded token count: %w", err)
+	}
+	return result.InputTokens, nil
+}
+
+// SubmitBatch implements provider.Provider. On replay the custom IDs of the
+// new requests are mapped, by position, to the recorded ones.
+func (c *Cassette) SubmitBatch(ctx context.Context, params anthropic.MessageBatchNewParams) (*anthropic.MessageBatch, error) {
+	if c.mode == CassetteRecord {
+		batch, err := c.inner.SubmitBatch(ctx, params)
+		var raw string
+		if batch != nil {
+			raw = batch.RawJSON()
+		}
+		c.record(methodSubmitBatch, params, raw, nil, err)
+		return batch, err
+	}
+
+	in, err := c.replay(methodSubmitBatch, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded anthropic.MessageBatchNewParams
+	if err := json.Unmarshal(in.Request, &recorded); err == nil {
+		c.mu.Lock()
+		for i, req := range params.Requests {
+			if i < len(recorded.Requests) {
+				c.customIDs[req.CustomID] = recorded.Requests[i].CustomID
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	if in.Error != nil {
+		return nil, replayError(in.Error)
+	}
+	var batch anthropic.MessageBatch
+	if err := json.Unmarshal(in.Response, &batch); err != nil {
+		return nil, fmt.Errorf("agentpgtest: failed to decode recorded batch: %w", err)
+	}
+	return &batch, nil
+}
+
+// batchRequest identifies a batch in recorded GetBatch and GetBatchResults
+// requests.
+type batchRequest struct {
+	BatchID string `json:"batch_id"`
+}
+
+// GetBatch implements provider.Provider. Once the recorded polls for a batch
+// are used up, the last recorded state is returned again.
+func (c *Cassette) GetBatch(ctx context.Context, batchID string) (*anthropic.MessageBatch, error) {
+	req := batchRequest{BatchID: batchID}
+	if c.mode == CassetteRecord {
+		batch, err := c.inner.GetBatch(ctx, batchID)
+		var raw string
+		if batch != nil {
+			raw = batch.RawJSON()
+		}
+		c.record(methodGetBatch, req, raw, nil, err)
+		return batch, err
+	}
+
+	in, err := c.replayBatch(req)
+	if err != nil {
+		return nil, err
+	}
+	if in.Error != nil {
+		return nil, replayError(in.Error)
+	}
+	var batch anthropic.MessageBatch
+	if err := json.Unmarshal(in.Response, &batch); err != nil {
+		return nil, fmt.Errorf("agentpgtest: failed to decode recorded batch: %w", err)
+	}
+	return &batch, nil
+}
+
+// replayBatch returns the next recorded poll of a batch, or the last one if
+// all have been used.
+func (c *Cassette) replayBatch(req batchRequest) (*Interaction, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last := -1
+	for i, in := range c.interactions {
+		if in.Method != methodGetBatch || !jsonEqual(in.Request, reqJSON) {
+			continue
+		}
+		if !c.used[i] {
+			c.used[i] = true
+			return &c.interactions[i], nil
+		}
+		last = i
+	}
+	if last == -1 {
+		return nil, fmt.Errorf("%w (method %s, batch %s)", ErrCassetteMiss, methodGetBatch, req.BatchID)
+	}
+	return &c.interactions[last], nil
+}
+
+// GetBatchResults implements provider.Provider. On replay the recorded
+// custom IDs are mapped back to the ones of the new requests.
+func (c *Cassette) GetBatchResults(ctx context.Context, batchID string) ([]anthropic.MessageBatchIndividualResponse, error) {
+	req := batchRequest{BatchID: batchID}
+	if c.mode == CassetteRecord {
+		results, err := c.inner.GetBatchResults(ctx, batchID)
+		var raw string
+		if err == nil {
+			items := make([]json.RawMessage, 0, len(results))
+			for _, result := range results {
+				items = append(items, json.RawMessage(result.RawJSON()))
+			}
+			if b, marshalErr := json.Marshal(items); marshalErr == nil {
+				raw = string(b)
+			}
+		}
+		c.record(methodGetBatchResults, req, raw, nil, err)
+		return results, err
+	}
+
+	in, err := c.replay(methodGetBatchResults, req)
+	if err != nil {
+		return nil, err
+	}
+	if in.Error != nil {
+		return nil, replayError(in.Error)
+	}
+	var results []anthropic.MessageBatchIndividualResponse
+	if len(in.Response) > 0 {
+		if err := json.Unmarshal(in.Response, &results); err != nil {
+			return nil, fmt.Errorf("agentpgtest: failed to decode recorded batch results: %w", err)
+		}
+	}
+
+	c.mu.Lock()
+	newIDs := make(map[string]string, len(c.customIDs))
+	for newID, recordedID := range c.customIDs {
+		newIDs[recordedID] = newID
+	}
+	c.mu.Unlock()
+	for i := range results {
+		if newID, ok := newIDs[results[i].CustomID]; ok {
+			results[i].CustomID = newID
+		}
+	}
+	return results, nil
+}
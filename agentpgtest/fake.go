@@ -0,0 +1,613 @@
+package agentpgtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/youssefsiam38/agentpg/provider"
+)
+
+// ErrNoScriptedResponse is returned when a FakeProvider receives a request
+// after its queue of turns is exhausted.
+var ErrNoScriptedResponse = errors.New("agentpgtest: no scripted response left")
+
+// Request modes recorded by FakeProvider.
+const (
+	ModeCreate = "create"
+	ModeStream = "stream"
+	ModeBatch  = "batch"
+)
+
+// Request is a Messages API request received by a FakeProvider.
+type Request struct {
+	// Mode is ModeCreate, ModeStream or ModeBatch.
+	Mode string
+
+	// CustomID is the batch request's custom ID (the iteration ID). Empty
+	// outside the batch path.
+	CustomID string
+
+	// Params are the request parameters as sent by AgentPG.
+	Params anthropic.MessageNewParams
+}
+
+// Turn is one scripted model response. Build turns with Text, ToolUse, Raw,
+// APIError, BatchErrored, BatchExpired or BatchCanceled.
+type Turn struct {
+	content      []map[string]any
+	stopReason   string
+	raw          string
+	inputTokens  int64
+	outputTokens int64
+	delay        time.Duration
+
+	// Error turns
+	statusCode  int
+	errorType   string
+	message     string
+	batchOnly   bool
+	batchResult string // "expired" or "canceled", "" for errored
+}
+
+// ToolCall is a tool_use block in a ToolUse turn.
+type ToolCall struct {
+	Name  string
+	Input any
+}
+
+// Call returns a ToolCall for the named tool. Input is marshaled to JSON.
+func Call(name string, input any) ToolCall {
+	return ToolCall{Name: name, Input: input}
+}
+
+// Text returns a turn answering with a single text block and stop reason
+// "end_turn".
+func Text(text string) Turn {
+	return Turn{
+		content:    []map[string]any{{"type": "text", "text": text}},
+		stopReason: string(anthropic.StopReasonEndTurn),
+	}
+}
+
+// ToolUse returns a turn requesting the given tool calls with stop reason
+// "tool_use". Tool use IDs are generated as toolu_fake_N.
+func ToolUse(calls ...ToolCall) Turn {
+	content := make([]map[string]any, 0, len(calls))
+	for _, call := range calls {
+		input := call.Input
+		if input == nil {
+			input = map[string]any{}
+		}
+		content = append(content, map[string]any{"type": "tool_use", "name": call.Name, "input": input})
+	}
+	return Turn{content: content, stopReason: string(anthropic.StopReasonToolUse)}
+}
+
+// Raw returns a turn answering with the given Messages API response JSON.
+// Fields "id" and "model" are filled in if missing.
+func Raw(messageJSON string) Turn {
+	return Turn{raw: messageJSON}
+}
+
+// APIError returns a turn failing with an *anthropic.Error carrying the HTTP
+// status and an {"type":"error","error":{...}} body. On the batch path the
+// whole batch submission fails.
+func APIError(statusCode int, errorType, message string) Turn {
+	return Turn{statusCode: statusCode, errorType: errorType, message: message}
+}
+
+// BatchErrored returns a turn whose batch request ends with an "errored"
+// result. Outside the batch path it behaves like APIError with status 500.
+func BatchErrored(errorType, message string) Turn {
+	return Turn{statusCode: http.StatusInternalServerError, errorType: errorType, message: message, batchOnly: true}
+}
+
+// BatchExpired returns a turn whose batch request ends with an "expired"
+// result, as if the batch was not processed within 24 hours. Outside the
+// batch path it behaves like APIError with status 500.
+func BatchExpired() Turn {
+	return Turn{statusCode: http.StatusInternalServerError, errorType: "api_error", message: "batch request expired", batchOnly: true, batchResult: "expired"}
+}
+
+// BatchCanceled returns a turn whose batch request ends with a "canceled"
+// result, as if the batch was cancelled through the API. Outside the batch
+// path it behaves like APIError with status 500.
+func BatchCanceled() Turn {
+	return Turn{statusCode: http.StatusInternalServerError, errorType: "api_error", message: "batch request canceled", batchOnly: true, batchResult: "canceled"}
+}
+
+// WithText prepends a text block to the turn's content.
+func (t Turn) WithText(text string) Turn {
+	t.content = append([]map[string]any{{"type": "text", "text": text}}, t.content...)
+	return t
+}
+
+// WithStopReason overrides the turn's stop reason (e.g. "max_tokens").
+func (t Turn) WithStopReason(reason string) Turn {
+	t.stopReason = reason
+	return t
+}
+
+// WithUsage sets the token usage reported for the turn.
+func (t Turn) WithUsage(inputTokens, outputTokens int64) Turn {
+	t.inputTokens = inputTokens
+	t.outputTokens = outputTokens
+	return t
+}
+
+// WithDelay delays the response. For streaming the delay happens before the
+// first event; for batches the batch stays in progress for the delay.
+func (t Turn) WithDelay(d time.Duration) Turn {
+	t.delay = d
+	return t
+}
+
+func (t Turn) isError() bool {
+	return t.statusCode != 0
+}
+
+func (t Turn) apiError() error {
+	body, _ := json.Marshal(map[string]any{
+		"type":  "error",
+		"error": map[string]any{"type": t.errorType, "message": t.message},
+	})
+	apiErr := &anthropic.Error{
+		StatusCode: t.statusCode,
+		Request:    &http.Request{Method: http.MethodPost, URL: &url.URL{Scheme: "https", Host: "fake.invalid", Path: "/v1/messages"}},
+		Response:   &http.Response{StatusCode: t.statusCode, Header: http.Header{}},
+	}
+	_ = apiErr.UnmarshalJSON(body)
+	return apiErr
+}
+
+// fakeBatch is a batch submitted to a FakeProvider.
+type fakeBatch struct {
+	id        string
+	createdAt time.Time
+	readyAt   time.Time
+	customIDs []string          // in submission order
+	results   map[string]string // custom ID -> result JSON
+	succeeded int
+	errored   int
+	expired   int
+	canceled  int
+}
+
+// FakeProvider is a deterministic provider.Provider that answers requests from
+// a queue of scripted turns. Every request, on any path, consumes the next
+// turn. It is safe for concurrent use.
+type FakeProvider struct {
+	mu       sync.Mutex
+	turns    []Turn
+	requests []Request
+	batches  map[string]*fakeBatch
+	nextID   int
+}
+
+// Compile-time check that FakeProvider implements provider.Provider.
+var _ provider.Provider = (*FakeProvider)(nil)
+
+// NewFakeProvider creates a fake provider with the given scripted turns.
+func NewFakeProvider(turns ...Turn) *FakeProvider {
+	return &FakeProvider{
+		turns:   turns,
+		batches: make(map[string]*fakeBatch),
+	}
+}
+
+// Enqueue appends turns to the script.
+func (p *FakeProvider) Enqueue(turns ...Turn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.turns = append(p.turns, turns...)
+}
+
+// Remaining returns the number of unconsumed turns.
+func (p *FakeProvider) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.turns)
+}
+
+// Requests returns the Messages API requests received so far, in order.
+func (p *FakeProvider) Requests() []Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Request(nil), p.requests...)
+}
+
+// next records the request and pops the next turn.
+func (p *FakeProvider) next(req Request) (Turn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, req)
+	if len(p.turns) == 0 {
+		return Turn{}, ErrNoScriptedResponse
+	}
+	turn := p.turns[0]
+	p.turns = p.turns[1:]
+	return turn, nil
+}
+
+func (p *FakeProvider) newID(prefix string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	return fmt.Sprintf("%s_fake_%d", prefix, p.nextID)
+}
+
+// messageJSON renders a turn as a Messages API response.
+func (p *FakeProvider) messageJSON(turn Turn, model string) (string, error) {
+	if turn.raw != "" {
+		var message map[string]any
+		if err := json.Unmarshal([]byte(turn.raw), &message); err != nil {
+			return "", fmt.Errorf("agentpgtest: invalid raw message: %w", err)
+		}
+		if _, ok := message["id"]; !ok {
+			message["id"] = p.newID("msg")
+		}
+		if _, ok := message["model"]; !ok {
+			message["model"] = model
+		}
+		b, err := json.Marshal(message)
+		return string(b), err
+	}
+
+	content := make([]map[string]any, len(turn.content))
+	for i, block := range turn.content {
+		c := make(map[string]any, len(block)+1)
+		for k, v := range block {
+			c[k] = v
+		}
+		if c["type"] == "tool_use" {
+			c["id"] = p.newID("toolu")
+		}
+		content[i] = c
+	}
+
+	inputTokens, outputTokens := turn.inputTokens, turn.outputTokens
+	if inputTokens == 0 && outputTokens == 0 {
+		inputTokens, outputTokens = 10, 10
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"id":            p.newID("msg"),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         model,
+		"content":       content,
+		"stop_reason":   turn.stopReason,
+		"stop_sequence": nil,
+		"usage": map[string]any{
+			"input_tokens":  inputTokens,
+			"output_tokens": outputTokens,
+		},
+	})
+	return string(b), err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CreateMessage implements provider.Provider.
+func (p *FakeProvider) CreateMessage(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+	turn, err := p.next(Request{Mode: ModeCreate, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	if err := sleepContext(ctx, turn.delay); err != nil {
+		return nil, err
+	}
+	if turn.isError() {
+		return nil, turn.apiError()
+	}
+
+	raw, err := p.messageJSON(turn, string(params.Model))
+	if err != nil {
+		return nil, err
+	}
+	var message anthropic.Message
+	if err := json.Unmarshal([]byte(raw), &message); err != nil {
+		return nil, fmt.Errorf("agentpgtest: failed to decode message: %w", err)
+	}
+	return &message, nil
+}
+
+// StreamMessage implements provider.Provider. The scripted message is
+// delivered as a sequence of stream events, as the API would send it.
+func (p *FakeProvider) StreamMessage(ctx context.Context, params anthropic.MessageNewParams, onEvent func(anthropic.MessageStreamEventUnion)) (*anthropic.Message, error) {
+	turn, err := p.next(Request{Mode: ModeStream, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	if err := sleepContext(ctx, turn.delay); err != nil {
+		return nil, err
+	}
+	if turn.isError() {
+		return nil, turn.apiError()
+	}
+
+	raw, err := p.messageJSON(turn, string(params.Model))
+	if err != nil {
+		return nil, err
+	}
+	events, err := streamEvents(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var message anthropic.Message
+	for _, e := range events {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var event anthropic.MessageStreamEventUnion
+		if err := json.Unmarshal([]byte(e), &event); err != nil {
+			return nil, fmt.Errorf("agentpgtest: failed to decode stream event: %w", err)
+		}
+		if onEvent != nil {
+			onEvent(event)
+		}
+		if err := message.Accumulate(event); err != nil {
+			return nil, fmt.Errorf("failed to accumulate stream event: %w", err)
+		}
+	}
+	return &message, nil
+}
+
+// streamEvents splits a complete message into the stream events producing it.
+func streamEvents(messageJSON string) ([]string, error) {
+	var message map[string]any
+	if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+		return nil, fmt.Errorf("agentpgtest: invalid message: %w", err)
+	}
+	content, _ := message["content"].([]any)
+	usage, _ := message["usage"].(map[string]any)
+
+	start := make(map[string]any, len(message))
+	for k, v := range message {
+		start[k] = v
+	}
+	start["content"] = []any{}
+	start["stop_reason"] = nil
+	start["stop_sequence"] = nil
+
+	var events []any
+	events = append(events, map[string]any{"type": "message_start", "message": start})
+
+	for i, c := range content {
+		block, _ := c.(map[string]any)
+		startBlock := make(map[string]any, len(block))
+		for k, v := range block {
+			startBlock[k] = v
+		}
+
+		var delta map[string]any
+		switch block["type"] {
+		case "text":
+			startBlock["text"] = ""
+			delta = map[string]any{"type": "text_delta", "text": block["text"]}
+		case "tool_use":
+			startBlock["input"] = map[string]any{}
+			input, err := json.Marshal(block["input"])
+			if err != nil {
+				return nil, err
+			}
+			delta = map[string]any{"type": "input_json_delta", "partial_json": string(input)}
+		case "thinking":
+			startBlock["thinking"] = ""
+			startBlock["signature"] = ""
+			delta = map[string]any{"type": "thinking_delta", "thinking": block["thinking"]}
+		}
+
+		events = append(events, map[string]any{"type": "content_block_start", "index": i, "content_block": startBlock})
+		if delta != nil {
+			events = append(events, map[string]any{"type": "content_block_delta", "index": i, "delta": delta})
+		}
+		if block["type"] == "thinking" {
+			events = append(events, map[string]any{
+				"type":  "content_block_delta",
+				"index": i,
+				"delta": map[string]any{"type": "signature_delta", "signature": block["signature"]},
+			})
+		}
+		events = append(events, map[string]any{"type": "content_block_stop", "index": i})
+	}
+
+	events = append(events,
+		map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": message["stop_reason"], "stop_sequence": message["stop_sequence"]},
+			"usage": map[string]any{"output_tokens": usage["output_tokens"]},
+		},
+		map[string]any{"type": "message_stop"},
+	)
+
+	out := make([]string, len(events))
+	for i, e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = string(b)
+	}
+	return out, nil
+}
+
+// CountTokens implements provider.Provider. It does not consume a turn and
+// estimates roughly four characters per token.
+func (p *FakeProvider) CountTokens(ctx context.Context, params anthropic.MessageCountTokensParams) (int64, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)/4) + 1, nil
+}
+
+// SubmitBatch implements provider.Provider. Each request in the batch
+// consumes one turn. If any of those turns is an APIError, the submission
+// itself fails with that error.
+func (p *FakeProvider) SubmitBatch(ctx context.Context, params anthropic.MessageBatchNewParams) (*anthropic.MessageBatch, error) {
+	now := time.Now()
+	batch := &fakeBatch{
+		id:        p.newID("msgbatch"),
+		createdAt: now,
+		readyAt:   now,
+		results:   make(map[string]string),
+	}
+
+	for _, req := range params.Requests {
+		turn, err := p.next(Request{Mode: ModeBatch, CustomID: req.CustomID, Params: batchRequestParams(req.Params)})
+		if err != nil {
+			return nil, err
+		}
+		if turn.isError() && !turn.batchOnly {
+			return nil, turn.apiError()
+		}
+		if ready := now.Add(turn.delay); ready.After(batch.readyAt) {
+			batch.readyAt = ready
+		}
+
+		var result map[string]any
+		switch {
+		case turn.batchResult == "expired":
+			batch.expired++
+			result = map[string]any{"type": "expired"}
+		case turn.batchResult == "canceled":
+			batch.canceled++
+			result = map[string]any{"type": "canceled"}
+		case turn.isError():
+			batch.errored++
+			result = map[string]any{
+				"type": "errored",
+				"error": map[string]any{
+					"type":  "error",
+					"error": map[string]any{"type": turn.errorType, "message": turn.message},
+				},
+			}
+		default:
+			raw, err := p.messageJSON(turn, string(req.Params.Model))
+			if err != nil {
+				return nil, err
+			}
+			batch.succeeded++
+			result = map[string]any{"type": "succeeded", "message": json.RawMessage(raw)}
+		}
+
+		b, err := json.Marshal(map[string]any{"custom_id": req.CustomID, "result": result})
+		if err != nil {
+			return nil, err
+		}
+		batch.customIDs = append(batch.customIDs, req.CustomID)
+		batch.results[req.CustomID] = string(b)
+	}
+
+	p.mu.Lock()
+	p.batches[batch.id] = batch
+	p.mu.Unlock()
+
+	return batchJSON(batch, now)
+}
+
+// GetBatch implements provider.Provider. A batch is in progress until the
+// longest delay among its turns has passed, then ended.
+func (p *FakeProvider) GetBatch(ctx context.Context, batchID string) (*anthropic.MessageBatch, error) {
+	p.mu.Lock()
+	batch, ok := p.batches[batchID]
+	p.mu.Unlock()
+	if !ok {
+		return nil, APIError(http.StatusNotFound, "not_found_error", "batch not found: "+batchID).apiError()
+	}
+	return batchJSON(batch, time.Now())
+}
+
+// GetBatchResults implements provider.Provider. Results are returned in
+// submission order.
+func (p *FakeProvider) GetBatchResults(ctx context.Context, batchID string) ([]anthropic.MessageBatchIndividualResponse, error) {
+	p.mu.Lock()
+	batch, ok := p.batches[batchID]
+	p.mu.Unlock()
+	if !ok {
+		return nil, APIError(http.StatusNotFound, "not_found_error", "batch not found: "+batchID).apiError()
+	}
+	results := make([]anthropic.MessageBatchIndividualResponse, 0, len(batch.customIDs))
+	for _, customID := range batch.customIDs {
+		var result anthropic.MessageBatchIndividualResponse
+		if err := json.Unmarshal([]byte(batch.results[customID]), &result); err != nil {
+			return nil, fmt.Errorf("agentpgtest: failed to decode batch result: %w", err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// batchJSON renders the state of a batch at the given time.
+func batchJSON(batch *fakeBatch, now time.Time) (*anthropic.MessageBatch, error) {
+	counts := map[string]any{
+		"processing": 0,
+		"succeeded":  batch.succeeded,
+		"errored":    batch.errored,
+		"canceled":   batch.canceled,
+		"expired":    batch.expired,
+	}
+	state := map[string]any{
+		"id":                  batch.id,
+		"type":                "message_batch",
+		"processing_status":   "ended",
+		"request_counts":      counts,
+		"created_at":          batch.createdAt.Format(time.RFC3339Nano),
+		"expires_at":          batch.createdAt.Add(24 * time.Hour).Format(time.RFC3339Nano),
+		"ended_at":            batch.readyAt.Format(time.RFC3339Nano),
+		"archived_at":         nil,
+		"cancel_initiated_at": nil,
+		"results_url":         "https://fake.invalid/v1/messages/batches/" + batch.id + "/results",
+	}
+	if now.Before(batch.readyAt) {
+		state["processing_status"] = "in_progress"
+		state["ended_at"] = nil
+		state["results_url"] = nil
+		counts["processing"] = batch.succeeded + batch.errored + batch.expired + batch.canceled
+		counts["succeeded"] = 0
+		counts["errored"] = 0
+		counts["expired"] = 0
+		counts["canceled"] = 0
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	var out anthropic.MessageBatch
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("agentpgtest: failed to decode batch: %w", err)
+	}
+	return &out, nil
+}
+
+// batchRequestParams converts batch request parameters to
+// MessageNewParams so batch requests are recorded like other requests.
+func batchRequestParams(params anthropic.MessageBatchNewParamsRequestParams) anthropic.MessageNewParams {
+	var out anthropic.MessageNewParams
+	if b, err := json.Marshal(params); err == nil {
+		_ = json.Unmarshal(b, &out)
+	}
+	return out
+}
@@ -0,0 +1,309 @@
+package agentpg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/provider"
+)
+
+// apiCallError wraps a failed Claude API call (batch submission or streaming
+// request) together with the iteration it was made for, so the worker can
+// decide whether to retry the iteration, fall back to another model, or fail
+// the run.
+type apiCallError struct {
+	iterationID uuid.UUID
+	model       string // Model the call was made with
+	nextModel   string // Next model in the agent's fallback chain, "" if none
+	err         error
+}
+
+func (e *apiCallError) Error() string { return e.err.Error() }
+func (e *apiCallError) Unwrap() error { return e.err }
+
+// apiErrorInfo is the classification of a failed API call.
+type apiErrorInfo struct {
+	errorType  string        // Anthropic error type, or "network_error"/"timeout_error"/"unknown_error"
+	statusCode int           // HTTP status code, 0 if no response was received
+	retryable  bool          // Whether the call may succeed if retried
+	retryAfter time.Duration // Server-requested delay before retrying, 0 if none
+}
+
+// streamErrorPrefix is the prefix used by the SDK for error events received mid-stream.
+const streamErrorPrefix = "received error while streaming: "
+
+// retryableAPIErrorTypes are Anthropic error types that indicate a transient failure.
+var retryableAPIErrorTypes = map[string]bool{
+	"rate_limit_error": true,
+	"overloaded_error": true,
+	"api_error":        true,
+	"timeout_error":    true,
+}
+
+// classifyAPIError determines whether a failed API call is worth retrying.
+// Rate limits (429), overloads (529), server errors (5xx), timeouts and
+// network resets are retryable; invalid requests, authentication and
+// permission errors are fatal.
+func classifyAPIError(err error) apiErrorInfo {
+	if errors.Is(err, errLatencyBudgetExceeded) {
+		return apiErrorInfo{errorType: "latency_budget_exceeded", retryable: true}
+	}
+
+	var batchErr *batchRequestError
+	if errors.As(err, &batchErr) {
+		return apiErrorInfo{errorType: batchErr.errorType, retryable: retryableAPIErrorTypes[batchErr.errorType]}
+	}
+
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		info := apiErrorInfo{
+			errorType:  parseAPIErrorType(apiErr.RawJSON()),
+			statusCode: apiErr.StatusCode,
+		}
+		if info.errorType == "" {
+			info.errorType = errorTypeForStatus(apiErr.StatusCode)
+		}
+		switch {
+		case apiErr.StatusCode == http.StatusRequestTimeout,
+			apiErr.StatusCode == http.StatusConflict,
+			apiErr.StatusCode == http.StatusTooManyRequests,
+			apiErr.StatusCode >= http.StatusInternalServerError:
+			info.retryable = true
+		}
+		if apiErr.Response != nil {
+			info.retryAfter = provider.ParseRetryAfter(apiErr.Response.Header)
+		}
+		return info
+	}
+
+	// Error events received mid-stream carry the error body as text
+	if msg := err.Error(); strings.Contains(msg, streamErrorPrefix) {
+		body := msg[strings.Index(msg, streamErrorPrefix)+len(streamErrorPrefix):]
+		errorType := parseAPIErrorType(body)
+		if errorType == "" {
+			errorType = "unknown_error"
+		}
+		return apiErrorInfo{errorType: errorType, retryable: retryableAPIErrorTypes[errorType]}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return apiErrorInfo{errorType: "timeout_error", retryable: true}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return apiErrorInfo{errorType: "network_error", retryable: true}
+	}
+
+	return apiErrorInfo{errorType: "unknown_error"}
+}
+
+// parseAPIErrorType extracts error.type from an Anthropic error body
+// ({"type":"error","error":{"type":"overloaded_error","message":"..."}}).
+func parseAPIErrorType(body string) string {
+	var payload struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return ""
+	}
+	return payload.Error.Type
+}
+
+// errorTypeForStatus maps an HTTP status code to an Anthropic error type
+// when the response body did not include one.
+func errorTypeForStatus(status int) string {
+	switch {
+	case status == http.StatusBadRequest:
+		return "invalid_request_error"
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusRequestTimeout:
+		return "timeout_error"
+	case status == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == 529:
+		return "overloaded_error"
+	case status >= http.StatusInternalServerError:
+		return "api_error"
+	default:
+		return "unknown_error"
+	}
+}
+
+// retryAPICall records a failed API call on its iteration and puts the run
+// back to pending when it can be retried: immediately with the next fallback
+// model for overloaded, not-found and latency budget errors, or with backoff
+// on the same model if the error is retryable and attempts remain. Returns
+// true if the retry was scheduled; otherwise the iteration is marked as
+// failed and the caller should fail the run.
+func (c *Client[TTx]) retryAPICall(ctx context.Context, run *driver.Run, callErr *apiCallError) bool {
+	store := c.driver.Store()
+	log := c.log()
+
+	config := c.config.APIRetryConfig
+	if config == nil {
+		config = DefaultAPIRetryConfig()
+	}
+
+	maxAttempts := config.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultAPIRetryMaxAttempts
+	}
+
+	info := classifyAPIError(callErr.err)
+
+	// Fallbacks switch models, and batch resubmissions and result downloads
+	// have their own budget; none counts toward the retry budget
+	attemptNumber, retryNumber := 1, 1
+	iter, err := store.GetIteration(ctx, callErr.iterationID)
+	if err != nil {
+		log.Error("failed to get iteration for api retry",
+			"run_id", run.ID,
+			"iteration_id", callErr.iterationID,
+			"error", err,
+		)
+	} else if iter != nil {
+		attemptNumber = len(iter.APIAttempts) + 1
+		for _, a := range iter.APIAttempts {
+			if a.FallbackModel == "" && a.BatchID == "" {
+				retryNumber++
+			}
+		}
+	}
+
+	now := time.Now()
+	attempt := driver.APIAttempt{
+		Attempt:    attemptNumber,
+		ErrorType:  info.errorType,
+		StatusCode: info.statusCode,
+		Message:    callErr.err.Error(),
+		Retryable:  info.retryable,
+		CreatedAt:  now,
+		Model:      callErr.model,
+	}
+
+	if fallbackErrorTypes[info.errorType] && callErr.nextModel != "" {
+		attempt.FallbackModel = callErr.nextModel
+		attempt.RetryAt = &now
+
+		if err := store.RetryRun(ctx, run.ID, callErr.iterationID, attempt, now); err != nil {
+			log.Error("failed to schedule model fallback",
+				"run_id", run.ID,
+				"iteration_id", callErr.iterationID,
+				"error", err,
+			)
+		} else {
+			log.Warn("api call failed, falling back to next model",
+				"run_id", run.ID,
+				"iteration_id", callErr.iterationID,
+				"model", callErr.model,
+				"fallback_model", callErr.nextModel,
+				"error_type", info.errorType,
+				"error", callErr.err,
+			)
+			c.triggerRunWorker(run.RunMode)
+			return true
+		}
+		attempt.FallbackModel = ""
+		attempt.RetryAt = nil
+	}
+
+	if info.retryable && retryNumber < maxAttempts {
+		retryAt := now.Add(config.NextRetryDelay(retryNumber, info.retryAfter))
+		attempt.RetryAt = &retryAt
+
+		if err := store.RetryRun(ctx, run.ID, callErr.iterationID, attempt, retryAt); err != nil {
+			log.Error("failed to schedule api retry",
+				"run_id", run.ID,
+				"iteration_id", callErr.iterationID,
+				"error", err,
+			)
+		} else {
+			log.Warn("api call failed, retry scheduled",
+				"run_id", run.ID,
+				"iteration_id", callErr.iterationID,
+				"attempt", retryNumber,
+				"max_attempts", maxAttempts,
+				"model", callErr.model,
+				"error_type", info.errorType,
+				"status_code", info.statusCode,
+				"retry_at", retryAt,
+				"error", callErr.err,
+			)
+			return true
+		}
+		attempt.RetryAt = nil
+	}
+
+	if err := store.AddIterationAPIAttempt(ctx, callErr.iterationID, attempt); err != nil {
+		log.Error("failed to record api attempt",
+			"iteration_id", callErr.iterationID,
+			"error", err,
+		)
+	}
+	if err := store.UpdateIteration(ctx, callErr.iterationID, map[string]any{
+		"error_message": callErr.err.Error(),
+		"error_type":    info.errorType,
+		"completed_at":  now,
+	}); err != nil {
+		log.Error("failed to mark iteration as failed",
+			"iteration_id", callErr.iterationID,
+			"error", err,
+		)
+	}
+
+	return false
+}
+
+// retryIteration returns the run's current iteration if it is waiting for a
+// retry of a failed API call, so the retry reuses it instead of creating a
+// new iteration. Returns nil if a new iteration should be created.
+func (c *Client[TTx]) retryIteration(ctx context.Context, run *driver.Run) (*driver.Iteration, error) {
+	if run.CurrentIterationID == nil {
+		return nil, nil
+	}
+
+	iter, err := c.driver.Store().GetIteration(ctx, *run.CurrentIterationID)
+	if err != nil {
+		return nil, err
+	}
+	if iter == nil || iter.CompletedAt != nil || iter.BatchID != nil || len(iter.APIAttempts) == 0 {
+		return nil, nil
+	}
+	return iter, nil
+}
+
+// triggerRunWorker wakes the worker that claims runs of the given mode.
+func (c *Client[TTx]) triggerRunWorker(runMode string) {
+	if runMode == string(RunModeStreaming) {
+		if c.streamingWorker != nil {
+			c.streamingWorker.trigger()
+		}
+		return
+	}
+	if c.runWorker != nil {
+		c.runWorker.trigger()
+	}
+}
@@ -1,12 +1,10 @@
 package agentpg
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"maps"
 	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
@@ -14,9 +12,23 @@ import (
 	"github.com/youssefsiam38/agentpg/driver"
 )
 
+// Batch poller limits.
+const (
+	batchPollFetchLimit      = 100             // due iterations fetched at a time
+	batchPollInstanceRefresh = 1 * time.Minute // how often the instance count for the poll cap is refreshed
+)
+
 // batchPoller polls Claude Batch API for status updates and processes results.
+// Each batch is polled on its own schedule (see BatchPollConfig), stored as
+// the next poll time of its iterations.
 type batchPoller[TTx any] struct {
 	client *Client[TTx]
+
+	// Share of the fleet-wide poll cap, only used by the poller goroutine
+	allowance   float64   // polls the instance may make now
+	allowanceAt time.Time // when the allowance was last refilled
+	instances   int       // registered instances
+	instancesAt time.Time // when instances was last refreshed
 }
 
 func newBatchPoller[TTx any](c *Client[TTx]) *batchPoller[TTx] {
@@ -42,66 +54,151 @@ func (p *batchPoller[TTx]) run(ctx context.Context) {
 func (p *batchPoller[TTx]) pollBatches(ctx context.Context) {
 	store := p.client.driver.Store()
 
-	// Get iterations ready for polling
-	iterations, err := store.GetIterationsForPoll(ctx, p.client.instanceID, p.client.config.BatchPollInterval, 10)
-	if err != nil {
-		p.client.log().Error("failed to get iterations for poll", "error", err)
-		return
+	budget := p.pollBudget(ctx, time.Now())
+
+	// Iterations submitted together share a batch, which is polled once.
+	// Batches with many iterations can fill a fetch, so fetch until no
+	// unpolled batch is due or the budget is spent.
+	polled := make(map[string]bool)
+	for budget != 0 {
+		iterations, err := store.GetIterationsForPoll(ctx, p.client.instanceID, batchPollFetchLimit)
+		if err != nil {
+			p.client.log().Error("failed to get iterations for poll", "error", err)
+			return
+		}
+
+		found := false
+		for _, iter := range iterations {
+			if iter.BatchID == nil {
+				p.client.log().Error("failed to poll iteration",
+					"iteration_id", iter.ID,
+					"error", "iteration has no batch_id",
+				)
+				continue
+			}
+			batchID := *iter.BatchID
+			if polled[batchID] {
+				continue
+			}
+			if budget == 0 {
+				p.client.log().Debug("batch poll cap reached, deferring polls",
+					"polled", len(polled),
+				)
+				return
+			}
+			polled[batchID] = true
+			found = true
+			if budget > 0 {
+				budget--
+				p.allowance--
+			}
+
+			if err := p.pollBatch(ctx, batchID); err != nil {
+				p.client.log().Error("failed to poll batch",
+					"batch_id", batchID,
+					"error", err,
+				)
+			}
+		}
+		if !found || len(iterations) < batchPollFetchLimit {
+			return
+		}
 	}
+}
 
-	for _, iter := range iterations {
-		if err := p.pollIteration(ctx, iter); err != nil {
-			p.client.log().Error("failed to poll iteration",
-				"iteration_id", iter.ID,
-				"batch_id", Deref(iter.BatchID),
-				"error", err,
-			)
+// pollBudget returns how many batches the instance may poll now, or -1 if
+// polls are not capped. Each instance gets an equal share of
+// MaxPollsPerMinute, refilled continuously; unused polls carry over for at
+// most one BatchPollInterval so the fleet stays under the cap.
+func (p *batchPoller[TTx]) pollBudget(ctx context.Context, now time.Time) int {
+	maxPolls := p.client.batchPollConfig().MaxPollsPerMinute
+	if maxPolls < 0 {
+		return -1
+	}
+	if maxPolls == 0 {
+		maxPolls = DefaultBatchMaxPollsPerMinute
+	}
+
+	if p.instancesAt.IsZero() || now.Sub(p.instancesAt) >= batchPollInstanceRefresh {
+		instances, err := p.client.driver.Store().ListInstances(ctx)
+		if err != nil {
+			p.client.log().Warn("failed to count instances for batch poll cap", "error", err)
+		} else {
+			p.instances = len(instances)
+			p.instancesAt = now
 		}
 	}
+
+	rate := float64(maxPolls) / float64(max(p.instances, 1)) / 60 // polls per second
+	burst := max(1, rate*p.client.config.BatchPollInterval.Seconds())
+	if p.allowanceAt.IsZero() {
+		p.allowance = burst
+	} else {
+		p.allowance = min(burst, p.allowance+rate*now.Sub(p.allowanceAt).Seconds())
+	}
+	p.allowanceAt = now
+
+	return int(p.allowance)
 }
 
-func (p *batchPoller[TTx]) pollIteration(ctx context.Context, iter *driver.Iteration) error {
+func (p *batchPoller[TTx]) pollBatch(ctx context.Context, batchID string) error {
 	store := p.client.driver.Store()
 	log := p.client.log()
 
-	if iter.BatchID == nil {
-		return fmt.Errorf("iteration has no batch_id")
+	members, err := p.polledIterations(ctx, batchID)
+	if err != nil {
+		return err
 	}
 
-	batchID := *iter.BatchID
+	// The interval grows with the polls of the batch
+	pollCount := 0
+	for _, iter := range members {
+		pollCount = max(pollCount, iter.BatchPollCount)
+	}
+	nextPollAt := time.Now().Add(p.client.batchPollConfig().NextPollInterval(pollCount + 1))
 
 	// Get batch status from Anthropic
-	batch, err := p.client.anthropic.Messages.Batches.Get(ctx, batchID)
+	batch, err := p.client.provider.GetBatch(ctx, batchID)
 	if err != nil {
+		// Back off as after a successful poll instead of retrying on every
+		// tick, which would make rate limiting worse
+		if err := store.ScheduleBatchPoll(ctx, batchID, nextPollAt); err != nil {
+			log.Error("failed to schedule batch poll",
+				"batch_id", batchID,
+				"error", err,
+			)
+		}
 		return fmt.Errorf("failed to get batch status: %w", err)
 	}
 
-	now := time.Now()
-
-	// Update poll count
-	if err := store.UpdateIteration(ctx, iter.ID, map[string]any{
-		"batch_poll_count":   iter.BatchPollCount + 1,
-		"batch_last_poll_at": now,
-	}); err != nil {
+	// Update poll count and schedule the next poll
+	if err := store.MarkBatchPolled(ctx, batchID, nextPollAt); err != nil {
 		return fmt.Errorf("failed to update poll count: %w", err)
 	}
 
 	log.Debug("polled batch",
 		"batch_id", batchID,
 		"status", batch.ProcessingStatus,
-		"poll_count", iter.BatchPollCount+1,
+		"iterations", len(members),
 	)
 
 	// Check if processing
 	if batch.ProcessingStatus == anthropic.MessageBatchProcessingStatusInProgress {
-		// Update run state to batch_processing if needed
-		run, err := store.GetRun(ctx, iter.RunID)
-		if err != nil {
-			return fmt.Errorf("failed to get run: %w", err)
-		}
-		if run.State == string(RunStateBatchPending) {
-			if err := store.UpdateRunState(ctx, iter.RunID, driver.RunState(RunStateBatchProcessing), nil); err != nil {
-				return fmt.Errorf("failed to update run state: %w", err)
+		p.checkExpiry(batch, members)
+
+		// Move the runs to batch_processing on the first poll
+		for _, iter := range members {
+			if iter.BatchPollCount > 0 {
+				continue
+			}
+			run, err := store.GetRun(ctx, iter.RunID)
+			if err != nil {
+				return fmt.Errorf("failed to get run: %w", err)
+			}
+			if run != nil && run.State == string(RunStateBatchPending) {
+				if err := store.UpdateRunState(ctx, iter.RunID, driver.RunState(RunStateBatchProcessing), nil); err != nil {
+					return fmt.Errorf("failed to update run state: %w", err)
+				}
 			}
 		}
 		return nil
@@ -109,28 +206,118 @@ func (p *batchPoller[TTx]) pollIteration(ctx context.Context, iter *driver.Itera
 
 	// Check if ended
 	if batch.ProcessingStatus == anthropic.MessageBatchProcessingStatusEnded {
-		return p.handleBatchComplete(ctx, iter, batch)
+		return p.handleBatchComplete(ctx, batch, members)
 	}
 
-	// Check if canceling
+	// Check if canceling. The batch was cancelled through the API; it keeps
+	// being polled until it ends with the results of the finished requests
 	if batch.ProcessingStatus == anthropic.MessageBatchProcessingStatusCanceling {
-		if err := store.UpdateIteration(ctx, iter.ID, map[string]any{
-			"batch_status": string(BatchStatusCanceling),
-		}); err != nil {
-			return fmt.Errorf("failed to update batch status: %w", err)
+		for _, iter := range members {
+			if Deref(iter.BatchStatus) == string(BatchStatusCanceling) {
+				continue
+			}
+			if err := store.UpdateIteration(ctx, iter.ID, map[string]any{
+				"batch_status": string(BatchStatusCanceling),
+			}); err != nil {
+				return fmt.Errorf("failed to update batch status: %w", err)
+			}
 		}
 	}
 
 	return nil
 }
 
-func (p *batchPoller[TTx]) handleBatchComplete(ctx context.Context, iter *driver.Iteration, batch *anthropic.MessageBatch) error {
+// polledIterations returns the iterations of a batch still waiting for its
+// results: those in progress or canceling.
+func (p *batchPoller[TTx]) polledIterations(ctx context.Context, batchID string) ([]*driver.Iteration, error) {
+	iterations, err := p.client.driver.Store().GetIterationsByBatch(ctx, batchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get batch iterations: %w", err)
+	}
+	members := iterations[:0]
+	for _, iter := range iterations {
+		switch Deref(iter.BatchStatus) {
+		case string(BatchStatusInProgress), string(BatchStatusCanceling):
+			members = append(members, iter)
+		}
+	}
+	return members, nil
+}
+
+// checkExpiry logs a warning when a batch that is still processing gets
+// within ExpiryWarning of its expiry. Requests not processed by then expire
+// and are resubmitted.
+func (p *batchPoller[TTx]) checkExpiry(batch *anthropic.MessageBatch, members []*driver.Iteration) {
+	if batch.ExpiresAt.IsZero() || len(members) == 0 {
+		return
+	}
+	warnAt := batch.ExpiresAt.Add(-p.recoveryConfig().ExpiryWarning)
+	if time.Now().Before(warnAt) {
+		return
+	}
+
+	// Warn once, on the first poll past the threshold
+	var lastPoll *time.Time
+	for _, iter := range members {
+		if iter.BatchLastPollAt != nil && (lastPoll == nil || iter.BatchLastPollAt.After(*lastPoll)) {
+			lastPoll = iter.BatchLastPollAt
+		}
+	}
+	if lastPoll != nil && !lastPoll.Before(warnAt) {
+		return
+	}
+
+	p.client.log().Warn("batch nearing expiry",
+		"batch_id", batch.ID,
+		"expires_at", batch.ExpiresAt,
+		"processing", batch.RequestCounts.Processing,
+		"iterations", len(members),
+	)
+}
+
+// batchPollConfig returns the batch poll configuration, or the default one if
+// none is set.
+func (c *Client[TTx]) batchPollConfig() *BatchPollConfig {
+	if c.config.BatchPollConfig != nil {
+		return c.config.BatchPollConfig
+	}
+	return DefaultBatchPollConfig()
+}
+
+// recoveryConfig returns the batch recovery configuration with defaults
+// applied.
+func (p *batchPoller[TTx]) recoveryConfig() BatchRecoveryConfig {
+	config := *DefaultBatchRecoveryConfig()
+	if c := p.client.config.BatchRecoveryConfig; c != nil {
+		config.ResubmitAsStreaming = c.ResubmitAsStreaming
+		if c.MaxResubmissions != 0 {
+			config.MaxResubmissions = c.MaxResubmissions
+		}
+		if c.ExpiryWarning > 0 {
+			config.ExpiryWarning = c.ExpiryWarning
+		}
+	}
+	return config
+}
+
+// handleBatchComplete downloads the results of an ended batch once and
+// routes each to its iteration by custom ID. The iterations stay in progress
+// until the results are downloaded; a failed download is retried on the next
+// poll with the backoff of APIRetryConfig.
+func (p *batchPoller[TTx]) handleBatchComplete(ctx context.Context, batch *anthropic.MessageBatch, members []*driver.Iteration) error {
 	store := p.client.driver.Store()
 	log := p.client.log()
 
+	// Download all results at once
+	results, err := p.client.provider.GetBatchResults(ctx, batch.ID)
+	if err != nil {
+		p.retryResults(ctx, batch.ID, members, err)
+		return fmt.Errorf("failed to fetch batch results: %w", err)
+	}
+
 	log.Info("batch completed",
 		"batch_id", batch.ID,
-		"iteration_id", iter.ID,
+		"iterations", len(members),
 		"succeeded", batch.RequestCounts.Succeeded,
 		"errored", batch.RequestCounts.Errored,
 	)
@@ -138,142 +325,386 @@ func (p *batchPoller[TTx]) handleBatchComplete(ctx context.Context, iter *driver
 	now := time.Now()
 
 	// Update iteration batch status
-	if err := store.UpdateIteration(ctx, iter.ID, map[string]any{
-		"batch_status":       string(BatchStatusEnded),
-		"batch_completed_at": now,
-	}); err != nil {
-		return fmt.Errorf("failed to update iteration batch status: %w", err)
+	for _, iter := range members {
+		if err := store.UpdateIteration(ctx, iter.ID, map[string]any{
+			"batch_status":       string(BatchStatusEnded),
+			"batch_completed_at": now,
+		}); err != nil {
+			return fmt.Errorf("failed to update iteration batch status: %w", err)
+		}
 	}
 
-	// Stream results to find our request
-	result, err := p.fetchBatchResult(ctx, batch.ID, iter.ID.String())
-	if err != nil {
-		// Mark run as failed
-		if updateErr := store.UpdateRunState(ctx, iter.RunID, driver.RunState(RunStateFailed), map[string]any{
-			"error_type":    "batch_error",
-			"error_message": err.Error(),
-			"finalized_at":  now,
-		}); updateErr != nil {
-			log.Error("failed to mark run as failed", "error", updateErr)
+	byCustomID := make(map[string]*anthropic.MessageBatchIndividualResponse, len(results))
+	for i := range results {
+		byCustomID[results[i].CustomID] = &results[i]
+	}
+
+	for _, iter := range members {
+		customID := Deref(iter.BatchRequestID)
+		if customID == "" {
+			customID = iter.ID.String()
+		}
+		if err := p.handleResult(ctx, iter, byCustomID[customID], now); err != nil {
+			log.Error("failed to process batch result",
+				"batch_id", batch.ID,
+				"iteration_id", iter.ID,
+				"run_id", iter.RunID,
+				"error", err,
+			)
 		}
-		return fmt.Errorf("failed to fetch batch result: %w", err)
 	}
 
-	if result == nil {
-		return fmt.Errorf("result not found for request_id %s", iter.ID.String())
+	return nil
+}
+
+// retryResults records a failed download of an ended batch's results on its
+// iterations and schedules the next attempt with backoff. Once
+// APIRetryConfig.MaxAttempts downloads failed, the iterations end and their
+// runs fail.
+func (p *batchPoller[TTx]) retryResults(ctx context.Context, batchID string, members []*driver.Iteration, downloadErr error) {
+	store := p.client.driver.Store()
+	log := p.client.log()
+
+	// Shutting down; the iterations are polled again after the restart
+	if ctx.Err() != nil {
+		return
 	}
 
-	// Check for error result
-	if result.Result.Type == "errored" {
-		errorMsg := "batch processing error"
-		if result.Result.Error != nil {
-			errorMsg = result.Result.Error.Message
+	config := p.client.config.APIRetryConfig
+	if config == nil {
+		config = DefaultAPIRetryConfig()
+	}
+	maxAttempts := config.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultAPIRetryMaxAttempts
+	}
+
+	failures := 0
+	for _, iter := range members {
+		n := 0
+		for _, a := range iter.APIAttempts {
+			if a.ResultsDownload && a.BatchID == batchID {
+				n++
+			}
 		}
-		if err := store.UpdateRunState(ctx, iter.RunID, driver.RunState(RunStateFailed), map[string]any{
-			"error_type":    "batch_error",
-			"error_message": errorMsg,
-			"finalized_at":  now,
+		failures = max(failures, n)
+	}
+	failures++
+
+	info := classifyAPIError(downloadErr)
+	now := time.Now()
+	var retryAt *time.Time
+	if failures < maxAttempts {
+		at := now.Add(config.NextRetryDelay(failures, info.retryAfter))
+		retryAt = &at
+	}
+
+	for _, iter := range members {
+		if err := store.AddIterationAPIAttempt(ctx, iter.ID, driver.APIAttempt{
+			Attempt:         len(iter.APIAttempts) + 1,
+			ErrorType:       info.errorType,
+			StatusCode:      info.statusCode,
+			Message:         downloadErr.Error(),
+			Retryable:       retryAt != nil,
+			RetryAt:         retryAt,
+			CreatedAt:       now,
+			Model:           Deref(iter.Model),
+			BatchID:         batchID,
+			ResultsDownload: true,
 		}); err != nil {
-			log.Error("failed to mark run as failed", "error", err)
+			log.Error("failed to record batch results download",
+				"iteration_id", iter.ID,
+				"error", err,
+			)
 		}
-		return nil
 	}
 
-	// Process successful result
-	return p.processResult(ctx, iter, result)
-}
+	if retryAt != nil {
+		if err := store.ScheduleBatchPoll(ctx, batchID, *retryAt); err != nil {
+			log.Error("failed to schedule batch results download",
+				"batch_id", batchID,
+				"error", err,
+			)
+		}
+		log.Warn("failed to download batch results, retry scheduled",
+			"batch_id", batchID,
+			"attempt", failures,
+			"max_attempts", maxAttempts,
+			"retry_at", *retryAt,
+			"error", downloadErr,
+		)
+		return
+	}
 
-// batchResultLine represents a single line from the batch results JSONL
-type batchResultLine struct {
-	CustomID string `json:"custom_id"`
-	Result   struct {
-		Type    string `json:"type"` // "succeeded" or "errored"
-		Message *struct {
-			ID      string `json:"id"`
-			Type    string `json:"type"`
-			Role    string `json:"role"`
-			Content []struct {
-				Type  string          `json:"type"`
-				Text  string          `json:"text,omitempty"`
-				ID    string          `json:"id,omitempty"`
-				Name  string          `json:"name,omitempty"`
-				Input json.RawMessage `json:"input,omitempty"`
-			} `json:"content"`
-			Model        string `json:"model"`
-			StopReason   string `json:"stop_reason"`
-			StopSequence string `json:"stop_sequence"`
-			Usage        struct {
-				InputTokens              int `json:"input_tokens"`
-				OutputTokens             int `json:"output_tokens"`
-				CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
-				CacheReadInputTokens     int `json:"cache_read_input_tokens"`
-			} `json:"usage"`
-		} `json:"message,omitempty"`
-		Error *struct {
-			Type    string `json:"type"`
-			Message string `json:"message"`
-		} `json:"error,omitempty"`
-	} `json:"result"`
+	log.Error("failed to download batch results, attempts exhausted",
+		"batch_id", batchID,
+		"attempts", failures,
+		"error", downloadErr,
+	)
+	for _, iter := range members {
+		if err := store.UpdateIteration(ctx, iter.ID, map[string]any{
+			"batch_status":       string(BatchStatusEnded),
+			"batch_completed_at": now,
+		}); err != nil {
+			log.Error("failed to update iteration batch status", "iteration_id", iter.ID, "error", err)
+		}
+		p.finalizeRun(ctx, iter.RunID, RunStateFailed, "batch_error", downloadErr.Error(), now)
+	}
 }
 
-func (p *batchPoller[TTx]) fetchBatchResult(ctx context.Context, batchID, requestID string) (*batchResultLine, error) {
-	// Use the streaming results endpoint
-	url := fmt.Sprintf("https://api.anthropic.com/v1/messages/batches/%s/results", batchID)
+// handleResult processes the result of one request of an ended batch.
+func (p *batchPoller[TTx]) handleResult(ctx context.Context, iter *driver.Iteration, result *anthropic.MessageBatchIndividualResponse, now time.Time) error {
+	store := p.client.driver.Store()
+	log := p.client.log()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	run, err := store.GetRun(ctx, iter.RunID)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to get run: %w", err)
+	}
+	if run == nil || RunState(run.State).IsTerminal() {
+		// Finalized while the batch was processing; the result is dropped
+		log.Debug("skipping batch result of finalized run",
+			"run_id", iter.RunID,
+			"iteration_id", iter.ID,
+		)
+		return nil
+	}
+
+	// The results of the batch do not include the request
+	if result == nil {
+		errorMsg := "batch results have no result for the request"
+		if p.resubmitRequest(ctx, iter, run, "missing_result", errorMsg) {
+			return nil
+		}
+		p.finalizeRun(ctx, iter.RunID, RunStateFailed, "batch_error", errorMsg, now)
+		return nil
+	}
+
+	switch result.Result.Type {
+	case "succeeded":
+		// Process successful result
+		return p.processResult(ctx, iter, &result.Result.Message)
+
+	case "errored":
+		errorType, errorMsg := result.Result.Error.Error.Type, result.Result.Error.Error.Message
+		if errorMsg == "" {
+			errorMsg = "batch processing error"
+		}
+		// Overloaded or unavailable models fall back to the next model
+		if p.fallbackRequest(ctx, iter, errorType, errorMsg) {
+			return nil
+		}
+		if retryableAPIErrorTypes[errorType] && p.resubmitRequest(ctx, iter, run, errorType, errorMsg) {
+			return nil
+		}
+		p.finalizeRun(ctx, iter.RunID, RunStateFailed, "batch_error", errorMsg, now)
+		return nil
+
+	case "expired":
+		// The batch was not processed within 24 hours
+		errorMsg := "batch request expired before it was processed"
+		if p.resubmitRequest(ctx, iter, run, "expired", errorMsg) {
+			return nil
+		}
+		p.finalizeRun(ctx, iter.RunID, RunStateFailed, "batch_expired", errorMsg, now)
+		return nil
+
+	case "canceled":
+		// The batch was cancelled through the API before the request was processed
+		log.Info("batch request canceled, cancelling run",
+			"run_id", iter.RunID,
+			"iteration_id", iter.ID,
+			"batch_id", Deref(iter.BatchID),
+		)
+		p.finalizeRun(ctx, iter.RunID, RunStateCancelled, "batch_canceled", "batch was cancelled before the request was processed", now)
+		return nil
+
+	default:
+		errorMsg := fmt.Sprintf("unknown batch result type %q", result.Result.Type)
+		p.finalizeRun(ctx, iter.RunID, RunStateFailed, "batch_error", errorMsg, now)
+		return nil
+	}
+}
+
+// fallbackRequest retries an errored batch request with the next model in the
+// agent's fallback chain, reusing the iteration. Returns true if the retry was
+// scheduled.
+func (p *batchPoller[TTx]) fallbackRequest(ctx context.Context, iter *driver.Iteration, errorType, message string) bool {
+	if !fallbackErrorTypes[errorType] {
+		return false
 	}
 
-	req.Header.Set("x-api-key", p.client.config.APIKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-	req.Header.Set("anthropic-beta", "message-batches-2024-09-24")
+	store := p.client.driver.Store()
+	log := p.client.log()
 
-	resp, err := http.DefaultClient.Do(req)
+	run, err := store.GetRun(ctx, iter.RunID)
+	if err != nil || run == nil {
+		return false
+	}
+	agent, err := p.client.GetAgentByID(ctx, run.AgentID)
 	if err != nil {
-		return nil, err
+		return false
 	}
-	defer func() { _ = resp.Body.Close() }()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("batch results request failed: %s - %s", resp.Status, string(body))
+	model := Deref(iter.Model)
+	if model == "" {
+		model = agent.Model
+	}
+	nextModel := nextFallbackModel(agent, model)
+	if nextModel == "" {
+		return false
 	}
 
-	// Parse JSONL response
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
+	// Detach the iteration from the ended batch so the run worker resubmits it
+	if err := p.detachIteration(ctx, iter, nil); err != nil {
+		log.Error("failed to reset iteration for model fallback",
+			"iteration_id", iter.ID,
+			"error", err,
+		)
+		return false
+	}
 
-		var result batchResultLine
-		if err := json.Unmarshal([]byte(line), &result); err != nil {
-			continue
+	return p.client.retryAPICall(ctx, run, &apiCallError{
+		iterationID: iter.ID,
+		model:       model,
+		nextModel:   nextModel,
+		err:         &batchRequestError{errorType: errorType, message: message},
+	})
+}
+
+// finalizeRun moves a run whose batch request did not succeed to a terminal
+// state.
+func (p *batchPoller[TTx]) finalizeRun(ctx context.Context, runID uuid.UUID, state RunState, errorType, errorMsg string, now time.Time) {
+	if err := p.client.driver.Store().UpdateRunState(ctx, runID, driver.RunState(state), map[string]any{
+		"error_type":    errorType,
+		"error_message": errorMsg,
+		"finalized_at":  now,
+	}); err != nil {
+		p.client.log().Error("failed to finalize run",
+			"run_id", runID,
+			"state", state,
+			"error", err,
+		)
+	}
+}
+
+// detachIteration detaches an iteration from its ended batch so the run
+// worker resubmits it.
+func (p *batchPoller[TTx]) detachIteration(ctx context.Context, iter *driver.Iteration, updates map[string]any) error {
+	detach := map[string]any{
+		"batch_id":           nil,
+		"batch_request_id":   nil,
+		"batch_status":       nil,
+		"batch_submitted_at": nil,
+		"batch_completed_at": nil,
+		"batch_expires_at":   nil,
+		"batch_next_poll_at": nil,
+	}
+	maps.Copy(detach, updates)
+	return p.client.driver.Store().UpdateIteration(ctx, iter.ID, detach)
+}
+
+// resubmitRequest puts the run of an expired or errored batch request back
+// to pending so the iteration is submitted again, in a new batch or over the
+// Streaming API (see BatchRecoveryConfig). Returns false if the iteration was
+// already resubmitted MaxResubmissions times or could not be rescheduled.
+func (p *batchPoller[TTx]) resubmitRequest(ctx context.Context, iter *driver.Iteration, run *driver.Run, errorType, message string) bool {
+	store := p.client.driver.Store()
+	log := p.client.log()
+	config := p.recoveryConfig()
+
+	resubmissions := 0
+	for _, a := range iter.APIAttempts {
+		if a.BatchID != "" && !a.ResultsDownload {
+			resubmissions++
 		}
+	}
+	if resubmissions >= config.MaxResubmissions {
+		log.Warn("batch request not resubmitted, resubmissions exhausted",
+			"run_id", run.ID,
+			"iteration_id", iter.ID,
+			"error_type", errorType,
+			"resubmissions", resubmissions,
+		)
+		return false
+	}
 
-		if result.CustomID == requestID {
-			return &result, nil
+	streaming := config.ResubmitAsStreaming && run.RunMode == string(RunModeBatch)
+	updates := map[string]any{}
+	if streaming {
+		updates["is_streaming"] = true
+	}
+	if err := p.detachIteration(ctx, iter, updates); err != nil {
+		log.Error("failed to reset iteration for resubmission",
+			"iteration_id", iter.ID,
+			"error", err,
+		)
+		return false
+	}
+	runMode := run.RunMode
+	if streaming {
+		runMode = string(RunModeStreaming)
+		if err := store.UpdateRun(ctx, run.ID, map[string]any{"run_mode": runMode}); err != nil {
+			log.Error("failed to switch run to streaming for resubmission",
+				"run_id", run.ID,
+				"error", err,
+			)
+			return false
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read results: %w", err)
+	now := time.Now()
+	attempt := driver.APIAttempt{
+		Attempt:   len(iter.APIAttempts) + 1,
+		ErrorType: errorType,
+		Message:   message,
+		Retryable: true,
+		RetryAt:   &now,
+		CreatedAt: now,
+		Model:     Deref(iter.Model),
+		BatchID:   Deref(iter.BatchID),
+	}
+	if err := store.RetryRun(ctx, run.ID, iter.ID, attempt, now); err != nil {
+		log.Error("failed to schedule batch resubmission",
+			"run_id", run.ID,
+			"iteration_id", iter.ID,
+			"error", err,
+		)
+		return false
 	}
 
-	return nil, nil
+	log.Warn("batch request resubmitted",
+		"run_id", run.ID,
+		"iteration_id", iter.ID,
+		"batch_id", Deref(iter.BatchID),
+		"error_type", errorType,
+		"resubmission", resubmissions+1,
+		"max_resubmissions", config.MaxResubmissions,
+		"run_mode", runMode,
+	)
+	p.client.triggerRunWorker(runMode)
+	return true
+}
+
+// resubmittedAsStreaming reports whether iter is a request of a batch run
+// that was resubmitted over the Streaming API, which switches the run to
+// streaming mode until the iteration completes.
+func resubmittedAsStreaming(run *driver.Run, iter *driver.Iteration) bool {
+	if run.RunMode != string(RunModeStreaming) {
+		return false
+	}
+	for _, a := range iter.APIAttempts {
+		if a.BatchID != "" && !a.ResultsDownload {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *batchPoller[TTx]) processResult(ctx context.Context, iter *driver.Iteration, result *batchResultLine) error {
+func (p *batchPoller[TTx]) processResult(ctx context.Context, iter *driver.Iteration, msg *anthropic.Message) error {
 	store := p.client.driver.Store()
 	log := p.client.log()
 
-	if result.Result.Message == nil {
-		return fmt.Errorf("no message in result")
-	}
-
-	msg := result.Result.Message
 	now := time.Now()
 
 	// Build content blocks
@@ -307,10 +738,10 @@ func (p *batchPoller[TTx]) processResult(ctx context.Context, iter *driver.Itera
 		Role:      driver.MessageRole(MessageRoleAssistant),
 		Content:   contentBlocks,
 		Usage: driver.Usage{
-			InputTokens:              msg.Usage.InputTokens,
-			OutputTokens:             msg.Usage.OutputTokens,
-			CacheCreationInputTokens: msg.Usage.CacheCreationInputTokens,
-			CacheReadInputTokens:     msg.Usage.CacheReadInputTokens,
+			InputTokens:              int(msg.Usage.InputTokens),
+			OutputTokens:             int(msg.Usage.OutputTokens),
+			CacheCreationInputTokens: int(msg.Usage.CacheCreationInputTokens),
+			CacheReadInputTokens:     int(msg.Usage.CacheReadInputTokens),
 		},
 	}
 
@@ -343,14 +774,14 @@ func (p *batchPoller[TTx]) processResult(ctx context.Context, iter *driver.Itera
 	}
 
 	if err := store.UpdateIteration(ctx, iter.ID, map[string]any{
-		"stop_reason":                 msg.StopReason,
+		"stop_reason":                 string(msg.StopReason),
 		"response_message_id":         message.ID,
 		"has_tool_use":                hasToolUse,
 		"tool_execution_count":        toolExecutionCount,
-		"input_tokens":                msg.Usage.InputTokens,
-		"output_tokens":               msg.Usage.OutputTokens,
-		"cache_creation_input_tokens": msg.Usage.CacheCreationInputTokens,
-		"cache_read_input_tokens":     msg.Usage.CacheReadInputTokens,
+		"input_tokens":                int(msg.Usage.InputTokens),
+		"output_tokens":               int(msg.Usage.OutputTokens),
+		"cache_creation_input_tokens": int(msg.Usage.CacheCreationInputTokens),
+		"cache_read_input_tokens":     int(msg.Usage.CacheReadInputTokens),
 		"completed_at":                now,
 	}); err != nil {
 		return fmt.Errorf("failed to update iteration: %w", err)
@@ -358,10 +789,10 @@ func (p *batchPoller[TTx]) processResult(ctx context.Context, iter *driver.Itera
 
 	// Determine next state and update run
 	runUpdates := map[string]any{
-		"input_tokens":                run.InputTokens + msg.Usage.InputTokens,
-		"output_tokens":               run.OutputTokens + msg.Usage.OutputTokens,
-		"cache_creation_input_tokens": run.CacheCreationInputTokens + msg.Usage.CacheCreationInputTokens,
-		"cache_read_input_tokens":     run.CacheReadInputTokens + msg.Usage.CacheReadInputTokens,
+		"input_tokens":                run.InputTokens + int(msg.Usage.InputTokens),
+		"output_tokens":               run.OutputTokens + int(msg.Usage.OutputTokens),
+		"cache_creation_input_tokens": run.CacheCreationInputTokens + int(msg.Usage.CacheCreationInputTokens),
+		"cache_read_input_tokens":     run.CacheReadInputTokens + int(msg.Usage.CacheReadInputTokens),
 		"iteration_count":             run.IterationCount + 1,
 	}
 
@@ -388,7 +819,7 @@ func (p *batchPoller[TTx]) processResult(ctx context.Context, iter *driver.Itera
 		// Run completed
 		nextState = RunStateCompleted
 		runUpdates["response_text"] = responseText
-		runUpdates["stop_reason"] = msg.StopReason
+		runUpdates["stop_reason"] = string(msg.StopReason)
 		runUpdates["finalized_at"] = now
 
 		if err := store.UpdateRunState(ctx, iter.RunID, driver.RunState(nextState), runUpdates); err != nil {
@@ -397,8 +828,8 @@ func (p *batchPoller[TTx]) processResult(ctx context.Context, iter *driver.Itera
 	}
 
 	// Auto-compaction: check if session needs compaction after run completes
-	if nextState == RunStateCompleted && p.client.config.AutoCompactionEnabled {
-		p.checkAndCompact(ctx, run.SessionID)
+	if nextState == RunStateCompleted && p.client.config.AutoCompactionEnabled && run.Depth == 0 {
+		p.checkAndCompact(ctx, run)
 	}
 
 	log.Info("processed batch result",
@@ -412,13 +843,7 @@ func (p *batchPoller[TTx]) processResult(ctx context.Context, iter *driver.Itera
 	return nil
 }
 
-func (p *batchPoller[TTx]) buildToolParams(ctx context.Context, iter *driver.Iteration, run *driver.Run, content []struct {
-	Type  string          `json:"type"`
-	Text  string          `json:"text,omitempty"`
-	ID    string          `json:"id,omitempty"`
-	Name  string          `json:"name,omitempty"`
-	Input json.RawMessage `json:"input,omitempty"`
-}) []driver.CreateToolExecutionParams {
+func (p *batchPoller[TTx]) buildToolParams(ctx context.Context, iter *driver.Iteration, run *driver.Run, content []anthropic.ContentBlockUnion) []driver.CreateToolExecutionParams {
 	params := make([]driver.CreateToolExecutionParams, 0, len(content))
 	for _, block := range content {
 		if block.Type != ContentTypeToolUse {
@@ -450,13 +875,11 @@ func (p *batchPoller[TTx]) buildToolParams(ctx context.Context, iter *driver.Ite
 }
 
 // checkAndCompact checks if the session needs compaction and performs it if needed.
-// This is called after a run completes when AutoCompactionEnabled is true.
+// This is called after a root run completes when AutoCompactionEnabled is true.
 // Errors are logged but do not fail the run.
-func (p *batchPoller[TTx]) checkAndCompact(ctx context.Context, sessionID uuid.UUID) {
-	compactor := p.client.getCompactor()
-	if compactor == nil {
-		return
-	}
+func (p *batchPoller[TTx]) checkAndCompact(ctx context.Context, run *driver.Run) {
+	sessionID := run.SessionID
+	compactor := p.client.getCompactor(ctx, run)
 
 	needsCompaction, err := compactor.NeedsCompaction(ctx, sessionID)
 	if err != nil {
@@ -476,6 +899,13 @@ func (p *batchPoller[TTx]) checkAndCompact(ctx context.Context, sessionID uuid.U
 	)
 
 	result, err := compactor.Compact(ctx, sessionID)
+	if errors.Is(err, driver.ErrSessionBusy) {
+		// Another run of the session is in progress; a later run retries
+		p.client.log().Debug("auto-compaction skipped, session busy",
+			"session_id", sessionID,
+		)
+		return
+	}
 	if err != nil {
 		p.client.log().Warn("auto-compaction failed",
 			"session_id", sessionID,
@@ -489,5 +919,6 @@ func (p *batchPoller[TTx]) checkAndCompact(ctx context.Context, sessionID uuid.U
 		"original_tokens", result.OriginalTokens,
 		"compacted_tokens", result.CompactedTokens,
 		"messages_removed", result.MessagesRemoved,
+		"strategy", result.Strategy,
 	)
 }
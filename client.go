@@ -6,14 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
-	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
 	"github.com/google/uuid"
 	"github.com/youssefsiam38/agentpg/compaction"
 	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/provider"
 	"github.com/youssefsiam38/agentpg/tool"
 )
 
@@ -21,9 +22,9 @@ import (
 // The TTx type parameter represents the native transaction type for the driver
 // (e.g., pgx.Tx for pgxv5, *sql.Tx for database/sql).
 type Client[TTx any] struct {
-	driver    driver.Driver[TTx]
-	config    *ClientConfig
-	anthropic anthropic.Client
+	driver   driver.Driver[TTx]
+	config   *ClientConfig
+	provider provider.Provider
 
 	instanceID string
 	started    bool
@@ -39,6 +40,7 @@ type Client[TTx any] struct {
 	toolWorker      *toolWorker[TTx]
 	batchPoller     *batchPoller[TTx]
 	rescuer         *rescuer[TTx]
+	scheduler       *scheduler[TTx]
 
 	// Compaction
 	compactor *compaction.Compactor[TTx]
@@ -72,12 +74,11 @@ func NewClient[TTx any](drv driver.Driver[TTx], config *ClientConfig) (*Client[T
 		return nil, err
 	}
 
-	// Create Anthropic client
-	var opts []option.RequestOption
-	if config.APIKey != "" {
-		opts = append(opts, option.WithAPIKey(config.APIKey))
+	// Use the Anthropic SDK unless a provider is configured
+	llm := config.Provider
+	if llm == nil {
+		llm = provider.NewAnthropic(option.WithAPIKey(config.APIKey))
 	}
-	anthropicClient := anthropic.NewClient(opts...)
 
 	// Generate instance ID if not provided
 	instanceID := config.ID
@@ -94,17 +95,32 @@ func NewClient[TTx any](drv driver.Driver[TTx], config *ClientConfig) (*Client[T
 	if config.Logger != nil {
 		compactorLogger = config.Logger
 	}
-	comp := compaction.New(drv.Store(), &anthropicClient, compactorConfig, compactorLogger)
+	comp := compaction.New(drv.Store(), llm, compactorConfig, compactorLogger)
+	for _, strategy := range config.CompactionStrategies {
+		if err := comp.RegisterStrategy(strategy); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+	if compactorConfig.Strategy != "" && !slices.Contains(comp.Strategies(), compactorConfig.Strategy) {
+		return nil, fmt.Errorf("%w: unknown compaction strategy %q", ErrInvalidConfig, compactorConfig.Strategy)
+	}
 
-	return &Client[TTx]{
+	c := &Client[TTx]{
 		driver:     drv,
 		config:     config,
-		anthropic:  anthropicClient,
+		provider:   llm,
 		instanceID: instanceID,
 		tools:      make(map[string]tool.Tool),
 		runWaiters: make(map[uuid.UUID][]chan *Run),
 		compactor:  comp,
-	}, nil
+	}
+
+	// Feed the rate limits reported by the API into the shared scheduler
+	if reporter, ok := llm.(provider.RateLimitReporter); ok && !c.rateLimitConfig().Disabled {
+		reporter.OnRateLimits(c.recordRateLimits)
+	}
+
+	return c, nil
 }
 
 // InstanceID returns the unique identifier for this client instance.
@@ -132,6 +148,10 @@ func (c *Client[TTx]) CreateAgent(ctx context.Context, def *AgentDefinition) (*A
 		return nil, fmt.Errorf("%w: agent model is required for agent %q", ErrInvalidConfig, def.Name)
 	}
 
+	if def.MaxConcurrentRuns < 0 {
+		return nil, fmt.Errorf("%w: max concurrent runs cannot be negative for agent %q", ErrInvalidConfig, def.Name)
+	}
+
 	driverDef := &driver.AgentDefinition{
 		Name:         def.Name,
 		Description:  def.Description,
@@ -145,6 +165,11 @@ func (c *Client[TTx]) CreateAgent(ctx context.Context, def *AgentDefinition) (*A
 		TopP:         def.TopP,
 		Metadata:     def.Metadata,
 		Config:       def.Config,
+
+		FallbackModels:          def.FallbackModels,
+		FallbackLatencyBudgetMs: durationToMs(def.FallbackLatencyBudget),
+
+		MaxConcurrentRuns: limitToPtr(def.MaxConcurrentRuns),
 	}
 
 	created, err := c.driver.Store().CreateAgent(ctx, driverDef)
@@ -161,6 +186,10 @@ func (c *Client[TTx]) UpdateAgent(ctx context.Context, def *AgentDefinition) err
 		return fmt.Errorf("%w: agent ID is required for update", ErrInvalidConfig)
 	}
 
+	if def.MaxConcurrentRuns < 0 {
+		return fmt.Errorf("%w: max concurrent runs cannot be negative for agent %q", ErrInvalidConfig, def.Name)
+	}
+
 	driverDef := &driver.AgentDefinition{
 		ID:           def.ID,
 		Name:         def.Name,
@@ -175,6 +204,11 @@ func (c *Client[TTx]) UpdateAgent(ctx context.Context, def *AgentDefinition) err
 		TopP:         def.TopP,
 		Metadata:     def.Metadata,
 		Config:       def.Config,
+
+		FallbackModels:          def.FallbackModels,
+		FallbackLatencyBudgetMs: durationToMs(def.FallbackLatencyBudget),
+
+		MaxConcurrentRuns: limitToPtr(def.MaxConcurrentRuns),
 	}
 
 	if err := c.driver.Store().UpdateAgent(ctx, driverDef); err != nil {
@@ -349,8 +383,9 @@ func (c *Client[TTx]) Start(ctx context.Context) error {
 	c.toolWorker = newToolWorker(c)
 	c.batchPoller = newBatchPoller(c)
 	c.rescuer = newRescuer(c)
+	c.scheduler = newScheduler(c)
 
-	c.wg.Add(5)
+	c.wg.Add(6)
 	go func() {
 		defer c.wg.Done()
 		c.runWorker.run(c.ctx)
@@ -371,6 +406,10 @@ func (c *Client[TTx]) Start(ctx context.Context) error {
 		defer c.wg.Done()
 		c.rescuer.run(c.ctx)
 	}()
+	go func() {
+		defer c.wg.Done()
+		c.scheduler.run(c.ctx)
+	}()
 
 	c.started = true
 	c.log().Info("client started", "instance_id", c.instanceID, "tools", len(c.tools))
@@ -474,6 +513,62 @@ func (c *Client[TTx]) NewSessionTx(ctx context.Context, tx TTx, parentSessionID
 	return session.ID, nil
 }
 
+// ForkSession creates a child session holding copies of the session's
+// messages up to and including atMessageID, and returns its ID. Running a
+// new prompt in the fork branches the conversation at that message while the
+// original session is left untouched, e.g. to edit and resend an earlier
+// prompt or to try another agent on the same history.
+//
+// Only messages of the root-level conversation are copied; messages of
+// nested agent runs sharing the session are not. The fork point cannot be an
+// assistant message with tool calls, whose results would be missing from the
+// fork. Returns ErrSessionNotFound or ErrInvalidForkPoint.
+func (c *Client[TTx]) ForkSession(ctx context.Context, sessionID, atMessageID uuid.UUID, metadata map[string]any) (uuid.UUID, error) {
+	c.mu.RLock()
+	started := c.started
+	c.mu.RUnlock()
+
+	if !started {
+		return uuid.Nil, ErrClientNotStarted
+	}
+
+	store := c.driver.Store()
+	session, err := store.GetSession(ctx, sessionID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	if session == nil {
+		return uuid.Nil, ErrSessionNotFound
+	}
+
+	msg, err := store.GetMessage(ctx, atMessageID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	if msg == nil || msg.SessionID != sessionID {
+		return uuid.Nil, fmt.Errorf("message %s is not in session %s: %w", atMessageID, sessionID, ErrInvalidForkPoint)
+	}
+	for _, block := range msg.Content {
+		if block.Type == ContentTypeToolUse {
+			return uuid.Nil, fmt.Errorf("message %s has tool calls: %w", atMessageID, ErrInvalidForkPoint)
+		}
+	}
+
+	fork, err := store.ForkSession(ctx, driver.ForkSessionParams{
+		SessionID:   sessionID,
+		AtMessageID: atMessageID,
+		Metadata:    metadata,
+	})
+	if errors.Is(err, driver.ErrForkPointNotFound) {
+		return uuid.Nil, fmt.Errorf("message %s belongs to a nested agent run: %w", atMessageID, ErrInvalidForkPoint)
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to fork session: %w", err)
+	}
+
+	return fork.ID, nil
+}
+
 // GetSession retrieves a session by ID.
 func (c *Client[TTx]) GetSession(ctx context.Context, id uuid.UUID) (*Session, error) {
 	session, err := c.driver.Store().GetSession(ctx, id)
@@ -484,21 +579,41 @@ func (c *Client[TTx]) GetSession(ctx context.Context, id uuid.UUID) (*Session, e
 		return nil, ErrSessionNotFound
 	}
 
-	return &Session{
-		ID:              session.ID,
-		ParentSessionID: session.ParentSessionID,
-		Depth:           session.Depth,
-		Metadata:        session.Metadata,
-		CompactionCount: session.CompactionCount,
-		CreatedAt:       session.CreatedAt,
-		UpdatedAt:       session.UpdatedAt,
-	}, nil
+	return convertSession(session), nil
+}
+
+// RunOption configures optional behavior of run creation.
+type RunOption func(*runOptions)
+
+type runOptions struct {
+	idempotencyKey string
+}
+
+// WithIdempotencyKey makes run creation idempotent. If a run with the same key
+// was created in the session within ClientConfig.IdempotencyKeyTTL, its ID is
+// returned and no new run is created. Reusing the key with a different agent,
+// prompt, run mode (e.g. RunAuto after Run) or variables fails with
+// driver.ErrIdempotencyConflict. With the Tx variants the key is reserved as
+// part of the caller's transaction.
+func WithIdempotencyKey(key string) RunOption {
+	return func(o *runOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+func applyRunOptions(opts []RunOption) runOptions {
+	var o runOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
 // Run creates a new asynchronous agent run and returns immediately.
 // Use WaitForRun to wait for completion.
 // The agentID must reference an agent that exists in the database.
-func (c *Client[TTx]) Run(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any) (uuid.UUID, error) {
+// Pass WithIdempotencyKey to make retried calls return the original run.
+func (c *Client[TTx]) Run(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (uuid.UUID, error) {
 	c.mu.RLock()
 	started := c.started
 	c.mu.RUnlock()
@@ -507,6 +622,8 @@ func (c *Client[TTx]) Run(ctx context.Context, sessionID uuid.UUID, agentID uuid
 		return uuid.Nil, ErrClientNotStarted
 	}
 
+	o := applyRunOptions(opts)
+
 	run, err := c.driver.Store().CreateRun(ctx, driver.CreateRunParams{
 		SessionID:           sessionID,
 		AgentID:             agentID,
@@ -514,6 +631,8 @@ func (c *Client[TTx]) Run(ctx context.Context, sessionID uuid.UUID, agentID uuid
 		Depth:               0,
 		CreatedByInstanceID: c.instanceID,
 		Metadata:            variables,
+		IdempotencyKey:      o.idempotencyKey,
+		IdempotencyTTL:      c.config.IdempotencyKeyTTL,
 	})
 	if err != nil {
 		return uuid.Nil, fmt.Errorf("failed to create run: %w", err)
@@ -526,7 +645,7 @@ func (c *Client[TTx]) Run(ctx context.Context, sessionID uuid.UUID, agentID uuid
 // The run won't be visible to workers until the transaction commits.
 // The agentID must reference an agent that exists in the database.
 // Variables are passed to tools via context during execution.
-func (c *Client[TTx]) RunTx(ctx context.Context, tx TTx, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any) (uuid.UUID, error) {
+func (c *Client[TTx]) RunTx(ctx context.Context, tx TTx, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (uuid.UUID, error) {
 	c.mu.RLock()
 	started := c.started
 	c.mu.RUnlock()
@@ -535,6 +654,8 @@ func (c *Client[TTx]) RunTx(ctx context.Context, tx TTx, sessionID uuid.UUID, ag
 		return uuid.Nil, ErrClientNotStarted
 	}
 
+	o := applyRunOptions(opts)
+
 	run, err := c.driver.Store().CreateRunTx(ctx, tx, driver.CreateRunParams{
 		SessionID:           sessionID,
 		AgentID:             agentID,
@@ -542,6 +663,8 @@ func (c *Client[TTx]) RunTx(ctx context.Context, tx TTx, sessionID uuid.UUID, ag
 		Depth:               0,
 		CreatedByInstanceID: c.instanceID,
 		Metadata:            variables,
+		IdempotencyKey:      o.idempotencyKey,
+		IdempotencyTTL:      c.config.IdempotencyKeyTTL,
 	})
 	if err != nil {
 		return uuid.Nil, fmt.Errorf("failed to create run: %w", err)
@@ -650,8 +773,8 @@ func (c *Client[TTx]) WaitForRun(ctx context.Context, runID uuid.UUID) (*Respons
 // around Run and WaitForRun.
 // Note: Do not use RunSync inside a transaction as it will deadlock.
 // Variables are passed to tools via context during execution.
-func (c *Client[TTx]) RunSync(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any) (*Response, error) {
-	runID, err := c.Run(ctx, sessionID, agentID, prompt, variables)
+func (c *Client[TTx]) RunSync(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (*Response, error) {
+	runID, err := c.Run(ctx, sessionID, agentID, prompt, variables, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -664,7 +787,7 @@ func (c *Client[TTx]) RunSync(ctx context.Context, sessionID uuid.UUID, agentID
 // Use WaitForRun to wait for completion.
 // The agentID must reference an agent that exists in the database.
 // Variables are passed to tools via context during execution.
-func (c *Client[TTx]) RunFast(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any) (uuid.UUID, error) {
+func (c *Client[TTx]) RunFast(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (uuid.UUID, error) {
 	c.mu.RLock()
 	started := c.started
 	c.mu.RUnlock()
@@ -673,6 +796,8 @@ func (c *Client[TTx]) RunFast(ctx context.Context, sessionID uuid.UUID, agentID
 		return uuid.Nil, ErrClientNotStarted
 	}
 
+	o := applyRunOptions(opts)
+
 	run, err := c.driver.Store().CreateRun(ctx, driver.CreateRunParams{
 		SessionID:           sessionID,
 		AgentID:             agentID,
@@ -681,6 +806,8 @@ func (c *Client[TTx]) RunFast(ctx context.Context, sessionID uuid.UUID, agentID
 		Depth:               0,
 		CreatedByInstanceID: c.instanceID,
 		Metadata:            variables,
+		IdempotencyKey:      o.idempotencyKey,
+		IdempotencyTTL:      c.config.IdempotencyKeyTTL,
 	})
 	if err != nil {
 		return uuid.Nil, fmt.Errorf("failed to create streaming run: %w", err)
@@ -693,7 +820,7 @@ func (c *Client[TTx]) RunFast(ctx context.Context, sessionID uuid.UUID, agentID
 // The run won't be visible to workers until the transaction commits.
 // The agentID must reference an agent that exists in the database.
 // Variables are passed to tools via context during execution.
-func (c *Client[TTx]) RunFastTx(ctx context.Context, tx TTx, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any) (uuid.UUID, error) {
+func (c *Client[TTx]) RunFastTx(ctx context.Context, tx TTx, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (uuid.UUID, error) {
 	c.mu.RLock()
 	started := c.started
 	c.mu.RUnlock()
@@ -702,6 +829,8 @@ func (c *Client[TTx]) RunFastTx(ctx context.Context, tx TTx, sessionID uuid.UUID
 		return uuid.Nil, ErrClientNotStarted
 	}
 
+	o := applyRunOptions(opts)
+
 	run, err := c.driver.Store().CreateRunTx(ctx, tx, driver.CreateRunParams{
 		SessionID:           sessionID,
 		AgentID:             agentID,
@@ -710,6 +839,8 @@ func (c *Client[TTx]) RunFastTx(ctx context.Context, tx TTx, sessionID uuid.UUID
 		Depth:               0,
 		CreatedByInstanceID: c.instanceID,
 		Metadata:            variables,
+		IdempotencyKey:      o.idempotencyKey,
+		IdempotencyTTL:      c.config.IdempotencyKeyTTL,
 	})
 	if err != nil {
 		return uuid.Nil, fmt.Errorf("failed to create streaming run: %w", err)
@@ -722,8 +853,90 @@ func (c *Client[TTx]) RunFastTx(ctx context.Context, tx TTx, sessionID uuid.UUID
 // This is a convenience wrapper around RunFast and WaitForRun.
 // Note: Do not use RunFastSync inside a transaction as it will deadlock.
 // Variables are passed to tools via context during execution.
-func (c *Client[TTx]) RunFastSync(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any) (*Response, error) {
-	runID, err := c.RunFast(ctx, sessionID, agentID, prompt, variables)
+func (c *Client[TTx]) RunFastSync(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (*Response, error) {
+	runID, err := c.RunFast(ctx, sessionID, agentID, prompt, variables, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.WaitForRun(ctx, runID)
+}
+
+// RunAuto creates a new asynchronous agent run that uses the Batch or the
+// Streaming API depending on the iteration (see RunModeAuto and
+// AutoRunModeConfig). Mark the session interactive with InteractiveSessionKey
+// to stream every iteration.
+// Use WaitForRun to wait for completion.
+// The agentID must reference an agent that exists in the database.
+// Variables are passed to tools via context during execution.
+func (c *Client[TTx]) RunAuto(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (uuid.UUID, error) {
+	c.mu.RLock()
+	started := c.started
+	c.mu.RUnlock()
+
+	if !started {
+		return uuid.Nil, ErrClientNotStarted
+	}
+
+	o := applyRunOptions(opts)
+
+	run, err := c.driver.Store().CreateRun(ctx, driver.CreateRunParams{
+		SessionID:           sessionID,
+		AgentID:             agentID,
+		Prompt:              prompt,
+		RunMode:             string(RunModeAuto),
+		Depth:               0,
+		CreatedByInstanceID: c.instanceID,
+		Metadata:            variables,
+		IdempotencyKey:      o.idempotencyKey,
+		IdempotencyTTL:      c.config.IdempotencyKeyTTL,
+	})
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to create auto run: %w", err)
+	}
+
+	return run.ID, nil
+}
+
+// RunAutoTx creates a new asynchronous auto mode agent run within a transaction.
+// The run won't be visible to workers until the transaction commits.
+// The agentID must reference an agent that exists in the database.
+// Variables are passed to tools via context during execution.
+func (c *Client[TTx]) RunAutoTx(ctx context.Context, tx TTx, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (uuid.UUID, error) {
+	c.mu.RLock()
+	started := c.started
+	c.mu.RUnlock()
+
+	if !started {
+		return uuid.Nil, ErrClientNotStarted
+	}
+
+	o := applyRunOptions(opts)
+
+	run, err := c.driver.Store().CreateRunTx(ctx, tx, driver.CreateRunParams{
+		SessionID:           sessionID,
+		AgentID:             agentID,
+		Prompt:              prompt,
+		RunMode:             string(RunModeAuto),
+		Depth:               0,
+		CreatedByInstanceID: c.instanceID,
+		Metadata:            variables,
+		IdempotencyKey:      o.idempotencyKey,
+		IdempotencyTTL:      c.config.IdempotencyKeyTTL,
+	})
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to create auto run: %w", err)
+	}
+
+	return run.ID, nil
+}
+
+// RunAutoSync creates an auto mode run and waits for completion.
+// This is a convenience wrapper around RunAuto and WaitForRun.
+// Note: Do not use RunAutoSync inside a transaction as it will deadlock.
+// Variables are passed to tools via context during execution.
+func (c *Client[TTx]) RunAutoSync(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...RunOption) (*Response, error) {
+	runID, err := c.RunAuto(ctx, sessionID, agentID, prompt, variables, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -759,13 +972,9 @@ func (c *Client[TTx]) CompactWithConfig(ctx context.Context, sessionID uuid.UUID
 		return nil, ErrClientNotStarted
 	}
 
-	// Create a temporary compactor with the custom config
-	compactorLogger := compaction.Logger(nil)
-	if c.config.Logger != nil {
-		compactorLogger = c.config.Logger
-	}
-	tempCompactor := compaction.New(c.driver.Store(), &c.anthropic, cfg, compactorLogger)
-	return tempCompactor.Compact(ctx, sessionID)
+	// Create a temporary compactor with the custom config and the
+	// registered strategies
+	return c.compactor.WithConfig(cfg).Compact(ctx, sessionID)
 }
 
 // NeedsCompaction checks if a session needs compaction based on token usage.
@@ -811,9 +1020,84 @@ func (c *Client[TTx]) CompactIfNeeded(ctx context.Context, sessionID uuid.UUID)
 	return c.compactor.CompactIfNeeded(ctx, sessionID)
 }
 
-// getCompactor returns the internal compactor for use by workers.
-func (c *Client[TTx]) getCompactor() *compaction.Compactor[TTx] {
-	return c.compactor
+// RestoreCompaction undoes a compaction, for example after a bad summary.
+// The messages archived by the compaction event are reinstated from
+// agentpg_message_archive with their original IDs and timestamps, and the
+// summary message is removed. Compactions of a session must be restored
+// newest first.
+//
+// Returns an error matching driver.ErrCompactionNotFound,
+// driver.ErrCompactionRestored, driver.ErrCompactionConflict (a later
+// compaction is still in effect), driver.ErrArchivePurged (a retention
+// policy deleted the archived messages) or driver.ErrSessionBusy (a run of
+// the session is in progress).
+func (c *Client[TTx]) RestoreCompaction(ctx context.Context, eventID uuid.UUID) (*compaction.RestoreResult, error) {
+	c.mu.RLock()
+	started := c.started
+	c.mu.RUnlock()
+
+	if !started {
+		return nil, ErrClientNotStarted
+	}
+
+	return c.compactor.Restore(ctx, eventID)
+}
+
+// getCompactor returns the compactor for run's agent, for use by workers.
+// Its thresholds follow the agent's context window.
+func (c *Client[TTx]) getCompactor(ctx context.Context, run *driver.Run) *compaction.Compactor[TTx] {
+	agent, err := c.driver.Store().GetAgent(ctx, run.AgentID)
+	if err != nil || agent == nil {
+		return c.compactor
+	}
+	return c.compactor.ForAgent(agent)
+}
+
+// compactBeforeIteration compacts the session of a run about to call the
+// Claude API if its context exceeds the threshold of the run's agent, so a
+// long run, or a session shared by agents with different context windows,
+// does not outgrow the window between iterations. Errors are logged and the
+// iteration proceeds with the uncompacted history.
+//
+// Nested runs (agent-as-tool) only send their own messages, so only root
+// runs compact the session.
+func (c *Client[TTx]) compactBeforeIteration(ctx context.Context, run *driver.Run) {
+	if !c.config.AutoCompactionEnabled || run.Depth > 0 {
+		return
+	}
+	compactor := c.getCompactor(ctx, run)
+
+	needsCompaction, err := compactor.NeedsCompaction(ctx, run.SessionID)
+	if err != nil {
+		c.log().Warn("pre-iteration compaction check failed",
+			"run_id", run.ID,
+			"session_id", run.SessionID,
+			"error", err,
+		)
+		return
+	}
+	if !needsCompaction {
+		return
+	}
+
+	result, err := compactor.CompactRun(ctx, run.SessionID, run.ID)
+	if err != nil {
+		c.log().Warn("pre-iteration compaction failed",
+			"run_id", run.ID,
+			"session_id", run.SessionID,
+			"error", err,
+		)
+		return
+	}
+
+	c.log().Info("pre-iteration compaction completed",
+		"run_id", run.ID,
+		"session_id", run.SessionID,
+		"original_tokens", result.OriginalTokens,
+		"compacted_tokens", result.CompactedTokens,
+		"messages_removed", result.MessagesRemoved,
+		"strategy", result.Strategy,
+	)
 }
 
 // GetRun retrieves a run by ID.
@@ -829,6 +1113,160 @@ func (c *Client[TTx]) GetRun(ctx context.Context, id uuid.UUID) (*Run, error) {
 	return convertRun(run), nil
 }
 
+// Schedule registers a recurring agent run fired by the elected leader.
+// Schedules are identified by name: calling Schedule again with the same name
+// updates the existing schedule, keeping its position in the cron cycle unless
+// the cron expression or timezone changed, and leaving it paused if it was paused.
+// This makes it safe to register schedules on every instance at startup.
+// Returns ErrAgentNotFound if the agent does not exist.
+func (c *Client[TTx]) Schedule(ctx context.Context, spec ScheduleSpec) (*Schedule, error) {
+	if spec.Name == "" {
+		return nil, fmt.Errorf("%w: schedule name is required", ErrInvalidConfig)
+	}
+	if spec.AgentID == uuid.Nil {
+		return nil, fmt.Errorf("%w: agent ID is required for schedule %q", ErrInvalidConfig, spec.Name)
+	}
+	if spec.Prompt == "" {
+		return nil, fmt.Errorf("%w: prompt is required for schedule %q", ErrInvalidConfig, spec.Name)
+	}
+
+	if spec.Timezone == "" {
+		spec.Timezone = "UTC"
+	}
+	if spec.RunMode == "" {
+		spec.RunMode = RunModeBatch
+	}
+	if spec.SessionPolicy == "" {
+		spec.SessionPolicy = SessionPolicyNew
+	}
+	if spec.CatchUp == "" {
+		spec.CatchUp = CatchUpOnce
+	}
+
+	switch spec.RunMode {
+	case RunModeBatch, RunModeStreaming, RunModeAuto:
+	default:
+		return nil, fmt.Errorf("%w: invalid run mode %q for schedule %q", ErrInvalidConfig, spec.RunMode, spec.Name)
+	}
+	switch spec.SessionPolicy {
+	case SessionPolicyNew, SessionPolicyReuse:
+	default:
+		return nil, fmt.Errorf("%w: invalid session policy %q for schedule %q", ErrInvalidConfig, spec.SessionPolicy, spec.Name)
+	}
+	switch spec.CatchUp {
+	case CatchUpSkip, CatchUpOnce, CatchUpAll:
+	default:
+		return nil, fmt.Errorf("%w: invalid catch-up policy %q for schedule %q", ErrInvalidConfig, spec.CatchUp, spec.Name)
+	}
+
+	// Fail now rather than on every tick
+	if _, err := c.GetAgentByID(ctx, spec.AgentID); err != nil {
+		return nil, fmt.Errorf("schedule %q: %w", spec.Name, err)
+	}
+
+	cron, err := parseCron(spec.Cron, spec.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	nextRunAt := cron.next(time.Now())
+	if nextRunAt.IsZero() {
+		return nil, fmt.Errorf("%w: cron expression %q never fires", ErrInvalidConfig, spec.Cron)
+	}
+
+	sched, err := c.driver.Store().UpsertSchedule(ctx, driver.UpsertScheduleParams{
+		Name:            spec.Name,
+		AgentID:         spec.AgentID,
+		CronExpression:  spec.Cron,
+		Timezone:        spec.Timezone,
+		CatchUpPolicy:   string(spec.CatchUp),
+		NextRunAt:       nextRunAt,
+		Prompt:          spec.Prompt,
+		Variables:       spec.Variables,
+		RunMode:         string(spec.RunMode),
+		SessionPolicy:   string(spec.SessionPolicy),
+		SessionID:       spec.SessionID,
+		SessionMetadata: spec.SessionMetadata,
+		Metadata:        spec.Metadata,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save schedule: %w", err)
+	}
+
+	return convertSchedule(sched), nil
+}
+
+// GetSchedule retrieves a schedule by ID.
+func (c *Client[TTx]) GetSchedule(ctx context.Context, id uuid.UUID) (*Schedule, error) {
+	sched, err := c.driver.Store().GetSchedule(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedule: %w", err)
+	}
+	if sched == nil {
+		return nil, ErrScheduleNotFound
+	}
+	return convertSchedule(sched), nil
+}
+
+// ListSchedules returns schedules with optional metadata filtering.
+func (c *Client[TTx]) ListSchedules(ctx context.Context, metadata map[string]any, limit, offset int) ([]*Schedule, int, error) {
+	schedules, total, err := c.driver.Store().ListSchedules(ctx, driver.ListSchedulesParams{
+		MetadataFilter: metadata,
+		Limit:          limit,
+		Offset:         offset,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list schedules: %w", err)
+	}
+
+	result := make([]*Schedule, len(schedules))
+	for i, s := range schedules {
+		result[i] = convertSchedule(s)
+	}
+	return result, total, nil
+}
+
+// PauseSchedule stops a schedule from firing until ResumeSchedule is called.
+func (c *Client[TTx]) PauseSchedule(ctx context.Context, id uuid.UUID) error {
+	if _, err := c.GetSchedule(ctx, id); err != nil {
+		return err
+	}
+	if err := c.driver.Store().UpdateSchedule(ctx, id, map[string]any{"paused": true}); err != nil {
+		return fmt.Errorf("failed to pause schedule: %w", err)
+	}
+	return nil
+}
+
+// ResumeSchedule re-enables a paused schedule.
+// Ticks that elapsed while paused are not fired; the schedule resumes at its
+// next tick after now.
+func (c *Client[TTx]) ResumeSchedule(ctx context.Context, id uuid.UUID) error {
+	sched, err := c.GetSchedule(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	cron, err := parseCron(sched.Cron, sched.Timezone)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if err := c.driver.Store().UpdateSchedule(ctx, id, map[string]any{
+		"paused":      false,
+		"next_run_at": cron.next(time.Now()),
+	}); err != nil {
+		return fmt.Errorf("failed to resume schedule: %w", err)
+	}
+	return nil
+}
+
+// DeleteSchedule removes a schedule. Runs it already created are not affected.
+func (c *Client[TTx]) DeleteSchedule(ctx context.Context, id uuid.UUID) error {
+	if err := c.driver.Store().DeleteSchedule(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	return nil
+}
+
 // Internal methods
 
 func (c *Client[TTx]) validateReferences() error {
@@ -865,11 +1303,17 @@ func (c *Client[TTx]) syncRegistrations(ctx context.Context) error {
 			"required":   schema.Required,
 		}
 
+		var maxConcurrency *int
+		if limiter, ok := t.(tool.ConcurrencyLimiter); ok {
+			maxConcurrency = limitToPtr(limiter.MaxConcurrency())
+		}
+
 		if err := store.UpsertTool(ctx, &driver.ToolDefinition{
-			Name:        name,
-			Description: t.Description(),
-			InputSchema: schemaMap,
-			IsAgentTool: false,
+			Name:           name,
+			Description:    t.Description(),
+			InputSchema:    schemaMap,
+			IsAgentTool:    false,
+			MaxConcurrency: maxConcurrency,
 		}); err != nil {
 			return fmt.Errorf("failed to upsert tool %q: %w", name, err)
 		}
@@ -960,6 +1404,11 @@ func (c *Client[TTx]) tryAcquireOrRefreshLeadership() {
 			c.isLeader = true
 			c.leaderMu.Unlock()
 			c.log().Info("acquired leadership", "instance_id", c.instanceID)
+
+			// Fire any schedule ticks missed while there was no leader
+			if c.scheduler != nil {
+				c.scheduler.trigger()
+			}
 		}
 	}
 }
@@ -973,7 +1422,8 @@ func (c *Client[TTx]) isLeaderInstance() bool {
 
 // cleanupLoop runs periodic cleanup jobs.
 // Only the elected leader runs cleanup to avoid duplicate work.
-// Jobs include deleting stale instances (no heartbeat for InstanceTTL).
+// Jobs include deleting stale instances (no heartbeat for InstanceTTL) and
+// applying retention policies.
 func (c *Client[TTx]) cleanupLoop() {
 	defer c.wg.Done()
 
@@ -1006,6 +1456,8 @@ func (c *Client[TTx]) runCleanupJobs() {
 	} else if deleted > 0 {
 		log.Info("cleaned up stale instances", "count", deleted)
 	}
+
+	c.runRetentionPolicies(ctx)
 }
 
 func (c *Client[TTx]) notificationLoop() {
@@ -1157,10 +1609,14 @@ func (c *Client[TTx]) buildResponse(ctx context.Context, run *driver.Run) (*Resp
 		}
 	}
 
-	// Get the final message
+	// Get the final message and the model that produced it
 	var message *Message
+	var model string
 	if run.CurrentIterationID != nil {
 		iter, err := c.driver.Store().GetIteration(ctx, *run.CurrentIterationID)
+		if err == nil && iter != nil {
+			model = Deref(iter.Model)
+		}
 		if err == nil && iter != nil && iter.ResponseMessageID != nil {
 			msg, err := c.driver.Store().GetMessage(ctx, *iter.ResponseMessageID)
 			if err == nil && msg != nil {
@@ -1195,6 +1651,7 @@ func (c *Client[TTx]) buildResponse(ctx context.Context, run *driver.Run) (*Resp
 		Message:        message,
 		IterationCount: run.IterationCount,
 		ToolIterations: run.ToolIterations,
+		Model:          model,
 	}, nil
 }
 
@@ -1219,6 +1676,22 @@ func isTerminalState(state RunState) bool {
 	return state == RunStateCompleted || state == RunStateFailed || state == RunStateCancelled
 }
 
+func convertSession(s *driver.Session) *Session {
+	if s == nil {
+		return nil
+	}
+	return &Session{
+		ID:                  s.ID,
+		ParentSessionID:     s.ParentSessionID,
+		Depth:               s.Depth,
+		Metadata:            s.Metadata,
+		CompactionCount:     s.CompactionCount,
+		CreatedAt:           s.CreatedAt,
+		UpdatedAt:           s.UpdatedAt,
+		ForkedFromMessageID: s.ForkedFromMessageID,
+	}
+}
+
 func convertRun(r *driver.Run) *Run {
 	if r == nil {
 		return nil
@@ -1249,6 +1722,10 @@ func convertRun(r *driver.Run) *Run {
 		CreatedByInstanceID:      r.CreatedByInstanceID,
 		ClaimedByInstanceID:      r.ClaimedByInstanceID,
 		ClaimedAt:                r.ClaimedAt,
+		RescueAttempts:           r.RescueAttempts,
+		LastRescueAt:             r.LastRescueAt,
+		IdempotencyKey:           r.IdempotencyKey,
+		ScheduledAt:              r.ScheduledAt,
 		Metadata:                 r.Metadata,
 		CreatedAt:                r.CreatedAt,
 		StartedAt:                r.StartedAt,
@@ -1256,6 +1733,81 @@ func convertRun(r *driver.Run) *Run {
 	}
 }
 
+func convertIteration(i *driver.Iteration) *Iteration {
+	if i == nil {
+		return nil
+	}
+	var attempts []APIAttempt
+	for _, a := range i.APIAttempts {
+		attempts = append(attempts, APIAttempt(a))
+	}
+	return &Iteration{
+		ID:                       i.ID,
+		RunID:                    i.RunID,
+		IterationNumber:          i.IterationNumber,
+		IsStreaming:              i.IsStreaming,
+		BatchID:                  i.BatchID,
+		BatchRequestID:           i.BatchRequestID,
+		BatchStatus:              (*BatchStatus)(i.BatchStatus),
+		BatchSubmittedAt:         i.BatchSubmittedAt,
+		BatchCompletedAt:         i.BatchCompletedAt,
+		BatchExpiresAt:           i.BatchExpiresAt,
+		BatchPollCount:           i.BatchPollCount,
+		BatchLastPollAt:          i.BatchLastPollAt,
+		BatchNextPollAt:          i.BatchNextPollAt,
+		StreamingStartedAt:       i.StreamingStartedAt,
+		StreamingCompletedAt:     i.StreamingCompletedAt,
+		TriggerType:              i.TriggerType,
+		RequestMessageIDs:        i.RequestMessageIDs,
+		StopReason:               i.StopReason,
+		ResponseMessageID:        i.ResponseMessageID,
+		HasToolUse:               i.HasToolUse,
+		ToolExecutionCount:       i.ToolExecutionCount,
+		InputTokens:              i.InputTokens,
+		OutputTokens:             i.OutputTokens,
+		CacheCreationInputTokens: i.CacheCreationInputTokens,
+		CacheReadInputTokens:     i.CacheReadInputTokens,
+		ErrorMessage:             i.ErrorMessage,
+		ErrorType:                i.ErrorType,
+		APIAttempts:              attempts,
+		Model:                    i.Model,
+		CreatedAt:                i.CreatedAt,
+		StartedAt:                i.StartedAt,
+		CompletedAt:              i.CompletedAt,
+	}
+}
+
+func convertToolExecution(e *driver.ToolExecution) *ToolExecution {
+	if e == nil {
+		return nil
+	}
+	return &ToolExecution{
+		ID:                  e.ID,
+		RunID:               e.RunID,
+		IterationID:         e.IterationID,
+		State:               ToolExecutionState(e.State),
+		ToolUseID:           e.ToolUseID,
+		ToolName:            e.ToolName,
+		ToolInput:           e.ToolInput,
+		IsAgentTool:         e.IsAgentTool,
+		AgentID:             e.AgentID,
+		ChildRunID:          e.ChildRunID,
+		ToolOutput:          e.ToolOutput,
+		IsError:             e.IsError,
+		ErrorMessage:        e.ErrorMessage,
+		ClaimedByInstanceID: e.ClaimedByInstanceID,
+		ClaimedAt:           e.ClaimedAt,
+		AttemptCount:        e.AttemptCount,
+		MaxAttempts:         e.MaxAttempts,
+		ScheduledAt:         e.ScheduledAt,
+		SnoozeCount:         e.SnoozeCount,
+		LastError:           e.LastError,
+		CreatedAt:           e.CreatedAt,
+		StartedAt:           e.StartedAt,
+		CompletedAt:         e.CompletedAt,
+	}
+}
+
 func convertMessage(m *driver.Message) *Message {
 	if m == nil {
 		return nil
@@ -1291,6 +1843,27 @@ func convertMessage(m *driver.Message) *Message {
 	}
 }
 
+func convertCompactionEvent(e *driver.CompactionEvent) *CompactionEvent {
+	if e == nil {
+		return nil
+	}
+	return &CompactionEvent{
+		ID:                  e.ID,
+		SessionID:           e.SessionID,
+		Strategy:            e.Strategy,
+		OriginalTokens:      e.OriginalTokens,
+		CompactedTokens:     e.CompactedTokens,
+		MessagesRemoved:     e.MessagesRemoved,
+		SummaryContent:      e.SummaryContent,
+		PreservedMessageIDs: e.PreservedMessageIDs,
+		ModelUsed:           e.ModelUsed,
+		DurationMS:          e.DurationMS,
+		SummaryMessageID:    e.SummaryMessageID,
+		RestoredAt:          e.RestoredAt,
+		CreatedAt:           e.CreatedAt,
+	}
+}
+
 func convertDriverAgent(a *driver.AgentDefinition) *AgentDefinition {
 	if a == nil {
 		return nil
@@ -1311,6 +1884,66 @@ func convertDriverAgent(a *driver.AgentDefinition) *AgentDefinition {
 		Config:       a.Config,
 		CreatedAt:    a.CreatedAt,
 		UpdatedAt:    a.UpdatedAt,
+
+		FallbackModels:        a.FallbackModels,
+		FallbackLatencyBudget: msToDuration(a.FallbackLatencyBudgetMs),
+
+		MaxConcurrentRuns: Deref(a.MaxConcurrentRuns),
+	}
+}
+
+// limitToPtr converts an optional concurrency limit for storage.
+// Returns nil (unlimited) for zero or negative limits.
+func limitToPtr(n int) *int {
+	if n <= 0 {
+		return nil
+	}
+	return &n
+}
+
+// durationToMs converts an optional duration to milliseconds for storage.
+// Returns nil for zero or negative durations.
+func durationToMs(d time.Duration) *int {
+	if d <= 0 {
+		return nil
+	}
+	ms := int(d.Milliseconds())
+	return &ms
+}
+
+// msToDuration converts optional stored milliseconds to a duration.
+func msToDuration(ms *int) time.Duration {
+	if ms == nil {
+		return 0
+	}
+	return time.Duration(*ms) * time.Millisecond
+}
+
+func convertSchedule(s *driver.Schedule) *Schedule {
+	if s == nil {
+		return nil
+	}
+	return &Schedule{
+		ID:              s.ID,
+		Name:            s.Name,
+		AgentID:         s.AgentID,
+		Cron:            s.CronExpression,
+		Timezone:        s.Timezone,
+		CatchUp:         CatchUpPolicy(s.CatchUpPolicy),
+		Paused:          s.Paused,
+		NextRunAt:       s.NextRunAt,
+		Prompt:          s.Prompt,
+		Variables:       s.Variables,
+		RunMode:         RunMode(s.RunMode),
+		SessionPolicy:   SessionPolicy(s.SessionPolicy),
+		SessionID:       s.SessionID,
+		SessionMetadata: s.SessionMetadata,
+		LastRunAt:       s.LastRunAt,
+		LastRunID:       s.LastRunID,
+		FireCount:       s.FireCount,
+		Metadata:        s.Metadata,
+		CreatedAt:       s.CreatedAt,
+		UpdatedAt:       s.UpdatedAt,
 	}
 }
 
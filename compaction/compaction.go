@@ -2,13 +2,13 @@ package compaction
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/google/uuid"
 	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/provider"
 )
 
 // Logger interface for compaction logging.
@@ -54,6 +54,21 @@ type Result struct {
 	Duration time.Duration
 }
 
+// RestoreResult contains the outcome of restoring a compaction.
+type RestoreResult struct {
+	// EventID is the ID of the restored compaction event.
+	EventID uuid.UUID
+
+	// SessionID is the session the messages were restored to.
+	SessionID uuid.UUID
+
+	// MessagesRestored is the number of archived messages reinstated.
+	MessagesRestored int
+
+	// RestoredAt is when the compaction was restored.
+	RestoredAt time.Time
+}
+
 // Stats contains statistics about a session's compaction state.
 type Stats struct {
 	// SessionID is the session being analyzed.
@@ -88,17 +103,19 @@ type Stats struct {
 // It uses the generic type parameter TTx to work with different database drivers.
 type Compactor[TTx any] struct {
 	store        driver.Store[TTx]
-	anthropic    *anthropic.Client
+	provider     provider.Provider
 	config       *Config
 	logger       Logger
-	strategy     StrategyExecutor
+	strategies   *StrategyFactory
 	partitioner  *Partitioner
 	tokenCounter *TokenCounter
+	agent        *driver.AgentDefinition // Set by ForAgent
 }
 
 // New creates a new Compactor with the given configuration.
+// The provider is used for summarization and token counting.
 // If config is nil, default configuration is used.
-func New[TTx any](store driver.Store[TTx], client *anthropic.Client, config *Config, logger Logger) *Compactor[TTx] {
+func New[TTx any](store driver.Store[TTx], p provider.Provider, config *Config, logger Logger) *Compactor[TTx] {
 	if config == nil {
 		config = DefaultConfig()
 	} else {
@@ -109,22 +126,58 @@ func New[TTx any](store driver.Store[TTx], client *anthropic.Client, config *Con
 		logger = noopLogger{}
 	}
 
-	tokenCounter := NewTokenCounter(client, config.SummarizerModel, config.UseTokenCountingAPI)
-	summarizer := NewSummarizer(client, config.SummarizerModel, config.SummarizerMaxTokens)
+	countingModel := config.TokenCountingModel
+	if countingModel == "" {
+		countingModel = config.SummarizerModel
+	}
+	tokenCounter := NewTokenCounter(p, countingModel, config.UseTokenCountingAPI)
+	summarizer := NewSummarizer(p, config.SummarizerModel, config.SummarizerMaxTokens)
 	partitioner := NewPartitioner(tokenCounter, config)
 	factory := NewStrategyFactory(config, tokenCounter, summarizer)
 
 	return &Compactor[TTx]{
 		store:        store,
-		anthropic:    client,
+		provider:     p,
 		config:       config,
 		logger:       logger,
-		strategy:     factory.Create(),
+		strategies:   factory,
 		partitioner:  partitioner,
 		tokenCounter: tokenCounter,
 	}
 }
 
+// RegisterStrategy registers a custom strategy under its Name so it can be
+// selected by Config.Strategy, per agent or per session (see StrategyKey).
+// Returns an error if the name is empty, built in, or already registered.
+func (c *Compactor[TTx]) RegisterStrategy(exec StrategyExecutor) error {
+	return c.strategies.Register(exec)
+}
+
+// Strategies returns the names of the built-in and registered strategies.
+func (c *Compactor[TTx]) Strategies() []Strategy {
+	return c.strategies.Strategies()
+}
+
+// WithConfig returns a Compactor that uses config and shares this
+// Compactor's store, provider, logger, agent and registered strategies.
+func (c *Compactor[TTx]) WithConfig(config *Config) *Compactor[TTx] {
+	other := New(c.store, c.provider, config, c.logger)
+	c.strategies.copyCustom(other.strategies)
+	other.agent = c.agent
+	return other
+}
+
+// ForAgent returns a Compactor for sessions run by agent. Its thresholds
+// are derived from the agent's context window (AgentDefinition.Config
+// under ContextWindowKey, else the model's, see Config.ForModel), tokens
+// are counted with the agent's model, and the agent's strategy is used
+// unless the session selects one.
+func (c *Compactor[TTx]) ForAgent(agent *driver.AgentDefinition) *Compactor[TTx] {
+	other := c.WithConfig(c.config.ForModel(agent.Model, contextWindowFrom(agent.Config)))
+	other.agent = agent
+	return other
+}
+
 // NeedsCompaction checks if a session needs compaction based on token usage.
 func (c *Compactor[TTx]) NeedsCompaction(ctx context.Context, sessionID uuid.UUID) (bool, error) {
 	stats, err := c.GetStats(ctx, sessionID)
@@ -174,11 +227,78 @@ func (c *Compactor[TTx]) GetStats(ctx context.Context, sessionID uuid.UUID) (*St
 	}, nil
 }
 
-// Compact performs compaction on the specified session.
+// Compact performs compaction on the specified session, using the strategy
+// selected in the session's metadata or else Config.Strategy.
 func (c *Compactor[TTx]) Compact(ctx context.Context, sessionID uuid.UUID) (*Result, error) {
+	return c.compact(ctx, sessionID, "", nil)
+}
+
+// CompactWithStrategy performs compaction on the specified session with the
+// named strategy, ignoring any per-session or per-agent selection.
+func (c *Compactor[TTx]) CompactWithStrategy(ctx context.Context, sessionID uuid.UUID, strategy Strategy) (*Result, error) {
+	return c.compact(ctx, sessionID, strategy, nil)
+}
+
+// CompactForAgent performs compaction on a session run by the given agent,
+// like ForAgent(agent).Compact.
+func (c *Compactor[TTx]) CompactForAgent(ctx context.Context, sessionID, agentID uuid.UUID) (*Result, error) {
+	agent, err := c.store.GetAgent(ctx, agentID)
+	if err != nil {
+		return nil, NewCompactionError("GetAgent", fmt.Errorf("%w: %v", ErrStorageError, err)).
+			WithSession(sessionID)
+	}
+	if agent == nil {
+		return c.Compact(ctx, sessionID)
+	}
+	return c.ForAgent(agent).Compact(ctx, sessionID)
+}
+
+// CompactRun performs compaction on the session of a run that is in
+// progress, between two of its iterations. Other runs of the session still
+// make it busy, but this one does not.
+func (c *Compactor[TTx]) CompactRun(ctx context.Context, sessionID, runID uuid.UUID) (*Result, error) {
+	return c.compact(ctx, sessionID, "", &runID)
+}
+
+// resolveStrategy returns the executor for an explicit strategy, or else the
+// one selected by the session, the agent (if set by ForAgent) or the config.
+func (c *Compactor[TTx]) resolveStrategy(ctx context.Context, sessionID uuid.UUID, strategy Strategy) (StrategyExecutor, error) {
+	if strategy == "" {
+		session, err := c.store.GetSession(ctx, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrStorageError, err)
+		}
+		if session == nil {
+			return nil, ErrSessionNotFound
+		}
+		strategy = strategyFrom(session.Metadata)
+	}
+	if strategy == "" && c.agent != nil {
+		strategy = strategyFrom(c.agent.Config)
+	}
+	if strategy == "" {
+		strategy = c.config.Strategy
+	}
+	return c.strategies.Lookup(strategy)
+}
+
+// strategyFrom returns the strategy selected under StrategyKey, if any.
+func strategyFrom(m map[string]any) Strategy {
+	name, _ := m[StrategyKey].(string)
+	return Strategy(name)
+}
+
+func (c *Compactor[TTx]) compact(ctx context.Context, sessionID uuid.UUID, strategy Strategy, runID *uuid.UUID) (*Result, error) {
 	start := time.Now()
 
-	c.logger.Info("starting compaction", "session_id", sessionID, "strategy", c.config.Strategy)
+	executor, err := c.resolveStrategy(ctx, sessionID, strategy)
+	if err != nil {
+		return nil, NewCompactionError("ResolveStrategy", err).
+			WithSession(sessionID)
+	}
+	strategy = executor.Name()
+
+	c.logger.Info("starting compaction", "session_id", sessionID, "strategy", strategy)
 
 	// Get all messages for the session
 	messages, err := c.store.GetMessages(ctx, sessionID, 0)
@@ -215,14 +335,14 @@ func (c *Compactor[TTx]) Compact(ctx context.Context, sessionID uuid.UUID) (*Res
 	)
 
 	// Execute the compaction strategy
-	strategyResult, err := c.strategy.Execute(ctx, partition)
+	strategyResult, err := executor.Execute(ctx, partition)
 	if err != nil {
 		return nil, NewCompactionError("ExecuteStrategy", err).
 			WithSession(sessionID).
-			WithContext("strategy", string(c.config.Strategy))
+			WithContext("strategy", string(strategy))
 	}
 
-	// Create the compaction event
+	// Compaction event details
 	var summaryContent *string
 	if strategyResult.SummaryText != "" {
 		summaryContent = &strategyResult.SummaryText
@@ -233,112 +353,67 @@ func (c *Compactor[TTx]) Compact(ctx context.Context, sessionID uuid.UUID) (*Res
 		modelUsed = &c.config.SummarizerModel
 	}
 
-	durationMS := strategyResult.Duration.Milliseconds()
-	event, err := c.store.CreateCompactionEvent(ctx, driver.CreateCompactionEventParams{
-		SessionID:           sessionID,
-		Strategy:            string(c.config.Strategy),
-		OriginalTokens:      partition.Stats.TotalTokens,
-		CompactedTokens:     strategyResult.TokensAfter,
-		MessagesRemoved:     len(strategyResult.ArchivedMessageIDs),
-		SummaryContent:      summaryContent,
-		PreservedMessageIDs: partition.AllPreservedIDs(),
-		ModelUsed:           modelUsed,
-		DurationMS:          &durationMS,
-	})
-	if err != nil {
-		return nil, NewCompactionError("CreateCompactionEvent", fmt.Errorf("%w: %v", ErrStorageError, err)).
-			WithSession(sessionID)
+	// Archive exactly the messages the strategy removes
+	archived := make([]*driver.Message, 0, len(strategyResult.ArchivedMessageIDs))
+	byID := make(map[uuid.UUID]*driver.Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
 	}
-
-	// Archive messages before deleting
-	for _, msg := range partition.Compactable {
-		originalJSON, err := json.Marshal(msg)
-		if err != nil {
-			c.logger.Warn("failed to marshal message for archive",
-				"message_id", msg.ID,
-				"error", err,
-			)
-			continue
-		}
-
-		var originalMap map[string]any
-		if err := json.Unmarshal(originalJSON, &originalMap); err != nil {
-			c.logger.Warn("failed to unmarshal message for archive",
-				"message_id", msg.ID,
-				"error", err,
-			)
-			continue
-		}
-
-		if err := c.store.ArchiveMessage(ctx, event.ID, msg.ID, sessionID, originalMap); err != nil {
-			c.logger.Warn("failed to archive message",
-				"message_id", msg.ID,
-				"error", err,
-			)
-			// Continue with other messages
+	for _, id := range strategyResult.ArchivedMessageIDs {
+		if msg, ok := byID[id]; ok {
+			archived = append(archived, msg)
 		}
 	}
 
-	// Delete archived messages
-	for _, msgID := range strategyResult.ArchivedMessageIDs {
-		if err := c.store.DeleteMessage(ctx, msgID); err != nil {
-			c.logger.Warn("failed to delete archived message",
-				"message_id", msgID,
-				"error", err,
-			)
-			// Continue with other deletions
-		}
+	var summary []driver.ContentBlock
+	if summaryContent != nil {
+		summary = []driver.ContentBlock{{Type: "text", Text: strategyResult.SummaryText}}
 	}
 
-	// Create summary message if one was generated
-	summaryCreated := false
-	if strategyResult.SummaryText != "" {
-		_, err := c.store.CreateMessage(ctx, driver.CreateMessageParams{
-			SessionID: sessionID,
-			Role:      "assistant",
-			Content: []driver.ContentBlock{
-				{
-					Type: "text",
-					Text: strategyResult.SummaryText,
-				},
-			},
-			IsSummary: true,
-		})
-		if err != nil {
-			c.logger.Warn("failed to create summary message",
-				"session_id", sessionID,
-				"error", err,
-			)
-			// Don't fail the whole operation for this
-		} else {
-			summaryCreated = true
+	// The summary was generated without holding any lock. The store now
+	// re-checks the session under its lock and applies everything in one
+	// transaction, so a crash or a conflicting change leaves history intact.
+	durationMS := strategyResult.Duration.Milliseconds()
+	event, err := c.store.ApplyCompaction(ctx, driver.ApplyCompactionParams{
+		Event: driver.CreateCompactionEventParams{
+			SessionID:           sessionID,
+			Strategy:            string(strategy),
+			OriginalTokens:      partition.Stats.TotalTokens,
+			CompactedTokens:     strategyResult.TokensAfter,
+			MessagesRemoved:     len(archived),
+			SummaryContent:      summaryContent,
+			PreservedMessageIDs: partition.AllPreservedIDs(),
+			ModelUsed:           modelUsed,
+			DurationMS:          &durationMS,
+		},
+		Messages: archived,
+		Summary:  summary,
+		RunID:    runID,
+	})
+	if err != nil {
+		if errors.Is(err, driver.ErrCompactionConflict) {
+			err = fmt.Errorf("%w: %w", ErrCompactionInProgress, err)
+		} else if !errors.Is(err, driver.ErrSessionBusy) {
+			err = fmt.Errorf("%w: %v", ErrStorageError, err)
 		}
-	}
-
-	// Update session compaction count
-	if err := c.store.UpdateSession(ctx, sessionID, map[string]any{
-		"compaction_count": 1, // This should increment, handled by SQL
-	}); err != nil {
-		c.logger.Warn("failed to update session compaction count",
-			"session_id", sessionID,
-			"error", err,
-		)
+		return nil, NewCompactionError("ApplyCompaction", err).
+			WithSession(sessionID)
 	}
 
 	result := &Result{
 		EventID:             event.ID,
-		Strategy:            c.config.Strategy,
+		Strategy:            strategy,
 		OriginalTokens:      partition.Stats.TotalTokens,
 		CompactedTokens:     strategyResult.TokensAfter,
-		MessagesRemoved:     len(strategyResult.ArchivedMessageIDs),
+		MessagesRemoved:     len(archived),
 		PreservedMessageIDs: partition.AllPreservedIDs(),
-		SummaryCreated:      summaryCreated,
+		SummaryCreated:      event.SummaryMessageID != nil,
 		Duration:            time.Since(start),
 	}
 
 	c.logger.Info("compaction complete",
 		"session_id", sessionID,
-		"strategy", c.config.Strategy,
+		"strategy", strategy,
 		"original_tokens", result.OriginalTokens,
 		"compacted_tokens", result.CompactedTokens,
 		"messages_removed", result.MessagesRemoved,
@@ -349,6 +424,34 @@ func (c *Compactor[TTx]) Compact(ctx context.Context, sessionID uuid.UUID) (*Res
 	return result, nil
 }
 
+// Restore undoes a compaction: the messages it archived are reinstated with
+// their original IDs and timestamps, and its summary message is removed.
+// Compactions of a session must be restored newest first.
+func (c *Compactor[TTx]) Restore(ctx context.Context, eventID uuid.UUID) (*RestoreResult, error) {
+	event, err := c.store.RestoreCompaction(ctx, eventID)
+	if err != nil {
+		if !errors.Is(err, driver.ErrCompactionNotFound) && !errors.Is(err, driver.ErrCompactionRestored) &&
+			!errors.Is(err, driver.ErrCompactionConflict) && !errors.Is(err, driver.ErrSessionBusy) {
+			err = fmt.Errorf("%w: %v", ErrStorageError, err)
+		}
+		return nil, NewCompactionError("RestoreCompaction", err).
+			WithContext("event_id", eventID)
+	}
+
+	c.logger.Info("compaction restored",
+		"session_id", event.SessionID,
+		"event_id", event.ID,
+		"messages_restored", event.MessagesRemoved,
+	)
+
+	return &RestoreResult{
+		EventID:          event.ID,
+		SessionID:        event.SessionID,
+		MessagesRestored: event.MessagesRemoved,
+		RestoredAt:       *event.RestoredAt,
+	}, nil
+}
+
 // CompactIfNeeded performs compaction only if the session exceeds the trigger threshold.
 // Returns nil result if compaction was not needed.
 func (c *Compactor[TTx]) CompactIfNeeded(ctx context.Context, sessionID uuid.UUID) (*Result, error) {
@@ -365,6 +468,11 @@ func (c *Compactor[TTx]) CompactIfNeeded(ctx context.Context, sessionID uuid.UUI
 	return c.Compact(ctx, sessionID)
 }
 
+// TokenCounter returns the compactor's token counter.
+func (c *Compactor[TTx]) TokenCounter() *TokenCounter {
+	return c.tokenCounter
+}
+
 // Config returns the compactor's configuration.
 func (c *Compactor[TTx]) Config() *Config {
 	return c.config
@@ -16,6 +16,12 @@ const (
 	StrategyHybrid Strategy = "hybrid"
 )
 
+// StrategyKey is the key that selects a strategy for one session (in the
+// session's metadata) or one agent (in AgentDefinition.Config), e.g.
+// {"compaction_strategy": "sliding_window"}. A session's choice takes
+// precedence over its agent's, which takes precedence over Config.Strategy.
+const StrategyKey = "compaction_strategy"
+
 // Default configuration values based on production patterns.
 const (
 	DefaultStrategy            = StrategyHybrid
@@ -32,7 +38,9 @@ const (
 
 // Config holds compaction configuration.
 type Config struct {
-	// Strategy is the compaction strategy to use.
+	// Strategy is the compaction strategy to use: a built-in strategy or the
+	// name of one registered with Compactor.RegisterStrategy.
+	// Can be overridden per agent or session, see StrategyKey.
 	// Default: StrategyHybrid
 	Strategy Strategy
 
@@ -66,10 +74,21 @@ type Config struct {
 	SummarizerMaxTokens int
 
 	// MaxTokensForModel is the maximum context window for the target model.
-	// Used to calculate context usage percentage.
+	// Used to calculate context usage percentage. Compactor.ForAgent replaces
+	// it with the agent's context window, see ContextWindow.
 	// Default: 200000 (Sonnet 4.5 context window)
 	MaxTokensForModel int
 
+	// ContextWindows overrides the built-in context window sizes, keyed by
+	// model name or model name prefix (e.g., "claude-sonnet-4": 1000000).
+	// The longest matching key wins.
+	ContextWindows map[string]int
+
+	// TokenCountingModel is the model whose tokenizer counts tokens.
+	// Compactor.ForAgent sets it to the agent's model.
+	// Default: SummarizerModel
+	TokenCountingModel string
+
 	// PreserveToolOutputs determines whether to keep tool outputs during hybrid compaction.
 	// If false, tool outputs outside the protected zone are replaced with "[TOOL OUTPUT PRUNED]" placeholder.
 	// Default: false
@@ -99,9 +118,10 @@ func DefaultConfig() *Config {
 
 // Validate validates the configuration and returns an error if invalid.
 func (c *Config) Validate() error {
-	if c.Strategy != StrategySummarization && c.Strategy != StrategyHybrid {
-		return fmt.Errorf("%w: unknown strategy %q, must be %q or %q",
-			ErrInvalidConfig, c.Strategy, StrategySummarization, StrategyHybrid)
+	// Custom strategies are registered on the Compactor, so only the
+	// presence of a name can be checked here.
+	if c.Strategy == "" {
+		return fmt.Errorf("%w: strategy is required", ErrInvalidConfig)
 	}
 
 	if c.Trigger <= 0 || c.Trigger > 1.0 {
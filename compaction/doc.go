@@ -20,7 +20,7 @@
 //
 // Create a Compactor with your configuration:
 //
-//	compactor := compaction.New(store, anthropicClient, &compaction.Config{
+//	compactor := compaction.New(store, provider.NewAnthropic(), &compaction.Config{
 //	    Strategy:        compaction.StrategyHybrid,
 //	    Trigger:         0.85,     // Trigger at 85% context usage
 //	    TargetTokens:    80000,    // Target after compaction
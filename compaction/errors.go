@@ -27,6 +27,10 @@ var (
 	// ErrSessionNotFound indicates the session was not found.
 	ErrSessionNotFound = errors.New("session not found")
 
+	// ErrUnknownStrategy indicates the selected strategy is neither built in
+	// nor registered.
+	ErrUnknownStrategy = errors.New("unknown compaction strategy")
+
 	// ErrStorageError indicates a database operation failed.
 	ErrStorageError = errors.New("storage operation failed")
 )
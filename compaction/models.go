@@ -0,0 +1,83 @@
+package compaction
+
+import (
+	"maps"
+	"strings"
+)
+
+// ContextWindowKey is the key in AgentDefinition.Config that sets the
+// agent's context window in tokens, overriding the model's, e.g.
+// {"context_window": 1000000} for a model with the 1M context beta.
+const ContextWindowKey = "context_window"
+
+// modelContextWindows maps model name prefixes to context window sizes.
+var modelContextWindows = map[string]int{
+	"claude-opus-4":     200000,
+	"claude-sonnet-4":   200000,
+	"claude-haiku-4":    200000,
+	"claude-3-7-sonnet": 200000,
+	"claude-3-5-sonnet": 200000,
+	"claude-3-5-haiku":  200000,
+	"claude-3-opus":     200000,
+	"claude-3-haiku":    200000,
+}
+
+// ContextWindow returns the context window of model in tokens: the longest
+// matching key of ContextWindows, else of the built-in table, else
+// MaxTokensForModel.
+func (c *Config) ContextWindow(model string) int {
+	if window, ok := lookupPrefix(c.ContextWindows, model); ok {
+		return window
+	}
+	if window, ok := lookupPrefix(modelContextWindows, model); ok {
+		return window
+	}
+	return c.MaxTokensForModel
+}
+
+// ForModel returns a copy of the configuration for a model with the given
+// context window (0 looks it up with ContextWindow). TargetTokens and
+// ProtectedTokens keep their proportion of the window, and tokens are
+// counted with the model's tokenizer.
+func (c *Config) ForModel(model string, contextWindow int) *Config {
+	cfg := *c
+	cfg.ContextWindows = maps.Clone(c.ContextWindows)
+	if contextWindow <= 0 {
+		contextWindow = c.ContextWindow(model)
+	}
+	if contextWindow != c.MaxTokensForModel && c.MaxTokensForModel > 0 {
+		scale := float64(contextWindow) / float64(c.MaxTokensForModel)
+		cfg.TargetTokens = int(float64(c.TargetTokens) * scale)
+		cfg.ProtectedTokens = int(float64(c.ProtectedTokens) * scale)
+		cfg.MaxTokensForModel = contextWindow
+	}
+	if model != "" {
+		cfg.TokenCountingModel = model
+	}
+	return &cfg
+}
+
+// lookupPrefix returns the value of the longest key in m that prefixes model.
+func lookupPrefix(m map[string]int, model string) (int, bool) {
+	best, value := -1, 0
+	for prefix, v := range m {
+		if strings.HasPrefix(model, prefix) && len(prefix) > best {
+			best, value = len(prefix), v
+		}
+	}
+	return value, best >= 0
+}
+
+// contextWindowFrom returns the context window set under ContextWindowKey,
+// if any. JSON numbers decode as float64.
+func contextWindowFrom(m map[string]any) int {
+	switch v := m[ContextWindowKey].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
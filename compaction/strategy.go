@@ -2,6 +2,9 @@ package compaction
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,8 +13,16 @@ import (
 
 // StrategyExecutor defines the interface for compaction strategy implementations.
 // Each strategy handles the actual compaction logic differently.
+//
+// Applications can implement their own strategies (sliding-window drop,
+// domain-specific summarizers, relevance pruning) and register them with
+// Compactor.RegisterStrategy or ClientConfig.CompactionStrategies. Execute
+// must only decide what to archive and what summary to insert; the Compactor
+// applies the result and records it in agentpg_compaction_events under Name.
+// Custom strategies that summarize can use NewSummarizer and NewTokenCounter.
 type StrategyExecutor interface {
 	// Name returns the strategy name (e.g., "summarization", "hybrid").
+	// It identifies the strategy in configuration and compaction events.
 	Name() Strategy
 
 	// Execute performs the compaction on the given messages.
@@ -42,10 +53,14 @@ type StrategyResult struct {
 }
 
 // StrategyFactory creates strategy executors based on configuration.
+// It holds the built-in strategies and a registry of custom ones.
 type StrategyFactory struct {
 	config       *Config
 	tokenCounter *TokenCounter
 	summarizer   *Summarizer
+
+	mu     sync.RWMutex
+	custom map[Strategy]StrategyExecutor
 }
 
 // NewStrategyFactory creates a new strategy factory.
@@ -54,19 +69,81 @@ func NewStrategyFactory(config *Config, tokenCounter *TokenCounter, summarizer *
 		config:       config,
 		tokenCounter: tokenCounter,
 		summarizer:   summarizer,
+		custom:       make(map[Strategy]StrategyExecutor),
+	}
+}
+
+// Register adds a custom strategy under its Name. Names must be unique and
+// cannot shadow the built-in strategies.
+func (f *StrategyFactory) Register(exec StrategyExecutor) error {
+	if exec == nil {
+		return fmt.Errorf("%w: strategy is nil", ErrInvalidConfig)
+	}
+	name := exec.Name()
+	if name == "" {
+		return fmt.Errorf("%w: strategy name is required", ErrInvalidConfig)
+	}
+	if name == StrategySummarization || name == StrategyHybrid {
+		return fmt.Errorf("%w: strategy %q is built in", ErrInvalidConfig, name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.custom[name]; exists {
+		return fmt.Errorf("%w: strategy %q already registered", ErrInvalidConfig, name)
+	}
+	f.custom[name] = exec
+	return nil
+}
+
+// Strategies returns the names of all available strategies, built-in first.
+func (f *StrategyFactory) Strategies() []Strategy {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	names := []Strategy{StrategyHybrid, StrategySummarization}
+	for name := range f.custom {
+		names = append(names, name)
 	}
+	slices.Sort(names[2:])
+	return names
 }
 
 // Create returns the appropriate strategy executor for the configured strategy.
+// It falls back to hybrid if the configured strategy is not available.
 func (f *StrategyFactory) Create() StrategyExecutor {
-	switch f.config.Strategy {
+	exec, err := f.Lookup(f.config.Strategy)
+	if err != nil {
+		return NewHybridStrategy(f.summarizer, f.tokenCounter, f.config)
+	}
+	return exec
+}
+
+// Lookup returns the executor for the named strategy, built-in or custom.
+// Returns an error matching ErrUnknownStrategy if no such strategy exists.
+func (f *StrategyFactory) Lookup(name Strategy) (StrategyExecutor, error) {
+	switch name {
 	case StrategySummarization:
-		return NewSummarizationStrategy(f.summarizer, f.tokenCounter)
+		return NewSummarizationStrategy(f.summarizer, f.tokenCounter), nil
 	case StrategyHybrid:
-		return NewHybridStrategy(f.summarizer, f.tokenCounter, f.config)
-	default:
-		// Default to hybrid if unknown
-		return NewHybridStrategy(f.summarizer, f.tokenCounter, f.config)
+		return NewHybridStrategy(f.summarizer, f.tokenCounter, f.config), nil
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if exec, ok := f.custom[name]; ok {
+		return exec, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownStrategy, name)
+}
+
+// copyCustom registers f's custom strategies with other.
+func (f *StrategyFactory) copyCustom(other *StrategyFactory) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	for name, exec := range f.custom {
+		other.custom[name] = exec
 	}
 }
 
@@ -8,19 +8,20 @@ import (
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/provider"
 )
 
 // Summarizer handles the creation of conversation summaries using Claude's streaming API.
 type Summarizer struct {
-	client    *anthropic.Client
+	provider  provider.Provider
 	model     string
 	maxTokens int
 }
 
-// NewSummarizer creates a new Summarizer with the given Anthropic client and configuration.
-func NewSummarizer(client *anthropic.Client, model string, maxTokens int) *Summarizer {
+// NewSummarizer creates a new Summarizer with the given provider and configuration.
+func NewSummarizer(p provider.Provider, model string, maxTokens int) *Summarizer {
 	return &Summarizer{
-		client:    client,
+		provider:  p,
 		model:     model,
 		maxTokens: maxTokens,
 	}
@@ -49,8 +50,8 @@ func (s *Summarizer) SummarizeWithContext(ctx context.Context, contextMsgs, toSu
 		userPrompt = BuildSummarizationUserPrompt(conversationText)
 	}
 
-	// Create the streaming request
-	stream := s.client.Messages.NewStreaming(ctx, anthropic.MessageNewParams{
+	// Stream the request and accumulate the response
+	message, err := s.provider.StreamMessage(ctx, anthropic.MessageNewParams{
 		Model:     anthropic.Model(s.model),
 		MaxTokens: int64(s.maxTokens),
 		System: []anthropic.TextBlockParam{
@@ -59,18 +60,8 @@ func (s *Summarizer) SummarizeWithContext(ctx context.Context, contextMsgs, toSu
 		Messages: []anthropic.MessageParam{
 			anthropic.NewUserMessage(anthropic.NewTextBlock(userPrompt)),
 		},
-	})
-
-	// Accumulate the streamed response
-	message := anthropic.Message{}
-	for stream.Next() {
-		event := stream.Current()
-		if err := message.Accumulate(event); err != nil {
-			return "", fmt.Errorf("%w: failed to accumulate stream: %v", ErrSummarizationFailed, err)
-		}
-	}
-
-	if err := stream.Err(); err != nil {
+	}, nil)
+	if err != nil {
 		return "", fmt.Errorf("%w: %v", ErrSummarizationFailed, err)
 	}
 
@@ -7,12 +7,13 @@ import (
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/provider"
 )
 
 // TokenCounter provides token counting for messages using the Claude API
 // with a character-based approximation fallback.
 type TokenCounter struct {
-	client   *anthropic.Client
+	provider provider.Provider
 	useAPI   bool
 	model    string
 	fallback bool // tracks if API failed and we're using fallback
@@ -32,13 +33,13 @@ type TokenCountResult struct {
 	PerMessage []int
 }
 
-// NewTokenCounter creates a new TokenCounter with the given Anthropic client.
+// NewTokenCounter creates a new TokenCounter with the given provider.
 // If useAPI is false, only character-based approximation will be used.
-func NewTokenCounter(client *anthropic.Client, model string, useAPI bool) *TokenCounter {
+func NewTokenCounter(p provider.Provider, model string, useAPI bool) *TokenCounter {
 	return &TokenCounter{
-		client: client,
-		model:  model,
-		useAPI: useAPI,
+		provider: p,
+		model:    model,
+		useAPI:   useAPI,
 	}
 }
 
@@ -47,7 +48,7 @@ func NewTokenCounter(client *anthropic.Client, model string, useAPI bool) *Token
 // falling back to character-based approximation if the API is unavailable
 // or if useAPI is false.
 func (tc *TokenCounter) CountTokens(ctx context.Context, messages []*driver.Message) (*TokenCountResult, error) {
-	if tc.useAPI && tc.client != nil && !tc.fallback {
+	if tc.useAPI && tc.provider != nil && !tc.fallback {
 		result, err := tc.countWithAPI(ctx, messages)
 		if err == nil {
 			return result, nil
@@ -61,7 +62,7 @@ func (tc *TokenCounter) CountTokens(ctx context.Context, messages []*driver.Mess
 
 // CountTokensForContent counts the tokens for a single text content.
 func (tc *TokenCounter) CountTokensForContent(ctx context.Context, text string) (int, error) {
-	if tc.useAPI && tc.client != nil && !tc.fallback {
+	if tc.useAPI && tc.provider != nil && !tc.fallback {
 		// Create a minimal message for counting
 		messages := []*driver.Message{
 			{
@@ -92,7 +93,7 @@ func (tc *TokenCounter) countWithAPI(ctx context.Context, messages []*driver.Mes
 		return nil, fmt.Errorf("failed to convert messages: %w", err)
 	}
 
-	result, err := tc.client.Messages.CountTokens(ctx, anthropic.MessageCountTokensParams{
+	inputTokens, err := tc.provider.CountTokens(ctx, anthropic.MessageCountTokensParams{
 		Model:    anthropic.Model(tc.model),
 		Messages: anthropicMessages,
 	})
@@ -101,7 +102,7 @@ func (tc *TokenCounter) countWithAPI(ctx context.Context, messages []*driver.Mes
 	}
 
 	return &TokenCountResult{
-		TotalTokens: int(result.InputTokens),
+		TotalTokens: int(inputTokens),
 		UsedAPI:     true,
 	}, nil
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/youssefsiam38/agentpg/compaction"
+	"github.com/youssefsiam38/agentpg/provider"
 )
 
 // Logger interface for structured logging.
@@ -21,10 +22,18 @@ type Logger interface {
 
 // ClientConfig holds all configuration options for a Client.
 type ClientConfig struct {
-	// APIKey is the Anthropic API key (required).
+	// APIKey is the Anthropic API key (required unless Provider is set).
 	// Falls back to ANTHROPIC_API_KEY environment variable if not set.
 	APIKey string
 
+	// Provider sends requests to the Claude API for runs, batches and
+	// compaction. Use it to target Amazon Bedrock or Vertex AI endpoints,
+	// add a recording proxy, or plug in a fake for tests. Bedrock and Vertex
+	// AI do not serve the Message Batches API, so only streaming runs work
+	// against them.
+	// If nil, provider.NewAnthropic with APIKey is used.
+	Provider provider.Provider
+
 	// Name identifies this service instance for logging and debugging.
 	// Defaults to hostname if not set.
 	Name string
@@ -47,10 +56,37 @@ type ClientConfig struct {
 	// Defaults to DefaultMaxConcurrentTools (50).
 	MaxConcurrentTools int
 
-	// BatchPollInterval is how often to poll Claude Batch API for status.
-	// Defaults to DefaultBatchPollInterval (30 seconds).
+	// MaxIterations caps the iterations (Claude API calls) of a run. A run
+	// that would start another iteration fails with ErrorTypeMaxIterations.
+	// Applies to the run and streaming workers and to Invoke.
+	// Defaults to DefaultMaxIterations (100).
+	MaxIterations int
+
+	// MaxAgentDepth caps how deeply agents delegate to other agents. A
+	// delegation that would go deeper is reported to Claude as a failed
+	// tool call. Applies to the tool worker and to Invoke.
+	// Defaults to DefaultMaxAgentDepth (10).
+	MaxAgentDepth int
+
+	// BatchPollInterval is how often the batch poller looks for batches due
+	// for a status poll. Each batch is polled on its own schedule (see
+	// BatchPollConfig); this bounds how late a poll can be.
+	// Defaults to DefaultBatchPollInterval (5 seconds).
 	BatchPollInterval time.Duration
 
+	// BatchCoalesceWindow is how long the run worker collects batch
+	// iterations before submitting them together in one Message Batch.
+	// Longer windows mean fewer batches to submit and poll, at the cost of
+	// added latency per iteration.
+	// Defaults to DefaultBatchCoalesceWindow (2 seconds).
+	BatchCoalesceWindow time.Duration
+
+	// BatchMaxRequests is the maximum number of iterations submitted in one
+	// Message Batch. Collected iterations are submitted as soon as this many
+	// are pending; set it to 1 to submit every iteration on its own.
+	// Defaults to DefaultBatchMaxRequests (1000). The API allows 100,000.
+	BatchMaxRequests int
+
 	// RunPollInterval is the polling fallback interval for new runs.
 	// Used when LISTEN/NOTIFY is unavailable.
 	// Defaults to DefaultRunPollInterval (1 second).
@@ -79,10 +115,28 @@ type ClientConfig struct {
 	// Defaults to DefaultInstanceTTL (2 minutes).
 	InstanceTTL time.Duration
 
-	// CleanupInterval is how often to run cleanup jobs (stale instances, etc.).
+	// CleanupInterval is how often to run cleanup jobs (stale instances,
+	// retention policies).
 	// Defaults to DefaultCleanupInterval (1 minute).
 	CleanupInterval time.Duration
 
+	// RetentionPolicies delete old sessions, runs and archived messages.
+	// The leader applies them on every cleanup run. By default nothing is
+	// deleted.
+	RetentionPolicies []RetentionPolicy
+
+	// ScheduleInterval is how often the leader checks for due schedules.
+	// Cron expressions have minute granularity, so this bounds how late a
+	// scheduled run can start.
+	// Defaults to DefaultScheduleInterval (10 seconds).
+	ScheduleInterval time.Duration
+
+	// IdempotencyKeyTTL is how long a run's idempotency key stays reserved.
+	// Reusing a key within this window returns the existing run instead of
+	// creating a new one; after it, the key may be used for a new run.
+	// Defaults to DefaultIdempotencyKeyTTL (24 hours).
+	IdempotencyKeyTTL time.Duration
+
 	// Logger for structured logging.
 	// If nil, logs are discarded.
 	Logger Logger
@@ -98,6 +152,14 @@ type ClientConfig struct {
 	// Only used if AutoCompactionEnabled is true or when calling Compact() manually.
 	CompactionConfig *compaction.Config
 
+	// CompactionStrategies are custom compaction strategies, registered by
+	// name alongside the built-in "hybrid" and "summarization". Select one
+	// with CompactionConfig.Strategy, per agent with
+	// AgentDefinition.Config["compaction_strategy"], or per session with the
+	// same key in the session's metadata. Every instance that may compact
+	// a session must register the strategies it selects.
+	CompactionStrategies []compaction.StrategyExecutor
+
 	// ToolRetryConfig configures tool execution retry behavior.
 	// If nil, default retry configuration is used.
 	ToolRetryConfig *ToolRetryConfig
@@ -105,6 +167,36 @@ type ClientConfig struct {
 	// RunRescueConfig configures run rescue behavior for stuck runs.
 	// If nil, default rescue configuration is used.
 	RunRescueConfig *RunRescueConfig
+
+	// APIRetryConfig configures retry of failed Claude API calls (rate limits,
+	// overloads, network errors) in the run and streaming workers.
+	// If nil, default API retry configuration is used.
+	APIRetryConfig *APIRetryConfig
+
+	// ContextOverflowConfig configures the check the run and streaming
+	// workers make before each iteration that the request fits the model's
+	// context window. If nil, default context overflow configuration is used.
+	ContextOverflowConfig *ContextOverflowConfig
+
+	// BatchRecoveryConfig configures how the batch poller handles batch
+	// requests that expired, errored or were canceled.
+	// If nil, default batch recovery configuration is used.
+	BatchRecoveryConfig *BatchRecoveryConfig
+
+	// BatchPollConfig configures how often each Message Batch is polled for
+	// status and caps the poll rate of the fleet.
+	// If nil, default batch poll configuration is used.
+	BatchPollConfig *BatchPollConfig
+
+	// AutoRunModeConfig configures how RunModeAuto runs choose between the
+	// Batch and Streaming API for each iteration.
+	// If nil, default auto run mode configuration is used.
+	AutoRunModeConfig *AutoRunModeConfig
+
+	// RateLimitConfig configures the rate-limit scheduler the streaming
+	// worker and Invoke consult before each Claude API call.
+	// If nil, default rate limit configuration is used.
+	RateLimitConfig *RateLimitConfig
 }
 
 // Default configuration values.
@@ -112,7 +204,12 @@ const (
 	DefaultMaxConcurrentRuns          = 10
 	DefaultMaxConcurrentStreamingRuns = 5 // Lower because streaming holds connections
 	DefaultMaxConcurrentTools         = 50
-	DefaultBatchPollInterval          = 30 * time.Second
+	DefaultMaxIterations              = 100
+	DefaultMaxAgentDepth              = 10
+	DefaultBatchPollInterval          = 5 * time.Second
+	DefaultBatchCoalesceWindow        = 2 * time.Second
+	DefaultBatchMaxRequests           = 1000
+	maxBatchRequests                  = 100000 // Message Batches API limit
 	DefaultRunPollInterval            = 1 * time.Second
 	DefaultToolPollInterval           = 500 * time.Millisecond
 	DefaultHeartbeatInterval          = 15 * time.Second
@@ -120,7 +217,10 @@ const (
 	DefaultStuckRunTimeout            = 5 * time.Minute
 	DefaultInstanceTTL                = 2 * time.Minute
 	DefaultCleanupInterval            = 1 * time.Minute
+	DefaultScheduleInterval           = 10 * time.Second
+	DefaultIdempotencyKeyTTL          = 24 * time.Hour
 	DefaultMaxToolRetries             = 3
+	DefaultRetentionBatchSize         = 500
 
 	// Default tool retry configuration
 	DefaultToolRetryMaxAttempts = 2   // Fast default: 2 attempts total (1 retry)
@@ -130,16 +230,44 @@ const (
 	DefaultRescueInterval    = 1 * time.Minute
 	DefaultRescueTimeout     = 5 * time.Minute // Should match StuckRunTimeout
 	DefaultMaxRescueAttempts = 3
+
+	// API retry defaults
+	DefaultAPIRetryMaxAttempts  = 5
+	DefaultAPIRetryInitialDelay = 2 * time.Second
+	DefaultAPIRetryMaxDelay     = 5 * time.Minute
+	DefaultAPIRetryJitter       = 0.2
+
+	// Context overflow defaults
+	DefaultContextOverflowPolicy       = ContextOverflowCompact
+	DefaultMaxToolOutputTokens         = 8000
+	DefaultMaxTokens             int64 = 4096 // Response max_tokens when the agent sets none
+
+	// Batch recovery defaults
+	DefaultBatchMaxResubmissions = 2
+	DefaultBatchExpiryWarning    = 1 * time.Hour
+
+	// Batch poll defaults
+	DefaultBatchPollInitialInterval = 10 * time.Second
+	DefaultBatchPollMaxInterval     = 5 * time.Minute
+	DefaultBatchPollMultiplier      = 2.0
+	DefaultBatchPollJitter          = 0.1
+	DefaultBatchMaxPollsPerMinute   = 300
+
+	// Auto run mode defaults
+	DefaultAutoRateLimitCooldown = 1 * time.Minute
+
+	// Rate limit scheduler defaults
+	DefaultRateLimitHeadroom = 0.05
 )
 
 // validate validates the configuration and sets defaults.
 // Returns an error if required fields are missing.
 func (c *ClientConfig) validate() error {
-	// API key is required
+	// API key is required for the default provider
 	if c.APIKey == "" {
 		c.APIKey = os.Getenv("ANTHROPIC_API_KEY")
 	}
-	if c.APIKey == "" {
+	if c.APIKey == "" && c.Provider == nil {
 		return NewAgentError("ValidateConfig", ErrInvalidConfig).
 			WithContext("field", "APIKey").
 			WithContext("reason", "API key is required, set via config or ANTHROPIC_API_KEY env var")
@@ -170,10 +298,31 @@ func (c *ClientConfig) validate() error {
 		c.MaxConcurrentTools = DefaultMaxConcurrentTools
 	}
 
+	if c.MaxIterations <= 0 {
+		c.MaxIterations = DefaultMaxIterations
+	}
+
+	if c.MaxAgentDepth <= 0 {
+		c.MaxAgentDepth = DefaultMaxAgentDepth
+	}
+
 	if c.BatchPollInterval <= 0 {
 		c.BatchPollInterval = DefaultBatchPollInterval
 	}
 
+	if c.BatchCoalesceWindow <= 0 {
+		c.BatchCoalesceWindow = DefaultBatchCoalesceWindow
+	}
+
+	if c.BatchMaxRequests <= 0 {
+		c.BatchMaxRequests = DefaultBatchMaxRequests
+	}
+	if c.BatchMaxRequests > maxBatchRequests {
+		return NewAgentError("ValidateConfig", ErrInvalidConfig).
+			WithContext("field", "BatchMaxRequests").
+			WithContext("reason", "exceeds the API limit of 100,000 requests per batch")
+	}
+
 	if c.RunPollInterval <= 0 {
 		c.RunPollInterval = DefaultRunPollInterval
 	}
@@ -202,6 +351,28 @@ func (c *ClientConfig) validate() error {
 		c.CleanupInterval = DefaultCleanupInterval
 	}
 
+	if c.ScheduleInterval <= 0 {
+		c.ScheduleInterval = DefaultScheduleInterval
+	}
+
+	if c.IdempotencyKeyTTL <= 0 {
+		c.IdempotencyKeyTTL = DefaultIdempotencyKeyTTL
+	}
+
+	for i := range c.RetentionPolicies {
+		if err := c.RetentionPolicies[i].validate(); err != nil {
+			return NewAgentError("ValidateConfig", ErrInvalidConfig).
+				WithContext("field", "RetentionPolicies").
+				WithContext("reason", err.Error())
+		}
+	}
+
+	if rc := c.RateLimitConfig; rc != nil && (rc.Headroom < 0 || rc.Headroom >= 1) {
+		return NewAgentError("ValidateConfig", ErrInvalidConfig).
+			WithContext("field", "RateLimitConfig.Headroom").
+			WithContext("reason", "must be at least 0 and less than 1")
+	}
+
 	return nil
 }
 
@@ -212,7 +383,11 @@ func DefaultConfig() *ClientConfig {
 		MaxConcurrentRuns:          DefaultMaxConcurrentRuns,
 		MaxConcurrentStreamingRuns: DefaultMaxConcurrentStreamingRuns,
 		MaxConcurrentTools:         DefaultMaxConcurrentTools,
+		MaxIterations:              DefaultMaxIterations,
+		MaxAgentDepth:              DefaultMaxAgentDepth,
 		BatchPollInterval:          DefaultBatchPollInterval,
+		BatchCoalesceWindow:        DefaultBatchCoalesceWindow,
+		BatchMaxRequests:           DefaultBatchMaxRequests,
 		RunPollInterval:            DefaultRunPollInterval,
 		ToolPollInterval:           DefaultToolPollInterval,
 		HeartbeatInterval:          DefaultHeartbeatInterval,
@@ -220,6 +395,8 @@ func DefaultConfig() *ClientConfig {
 		StuckRunTimeout:            DefaultStuckRunTimeout,
 		InstanceTTL:                DefaultInstanceTTL,
 		CleanupInterval:            DefaultCleanupInterval,
+		ScheduleInterval:           DefaultScheduleInterval,
+		IdempotencyKeyTTL:          DefaultIdempotencyKeyTTL,
 	}
 }
 
@@ -305,3 +482,290 @@ func DefaultRunRescueConfig() *RunRescueConfig {
 		MaxRescueAttempts: DefaultMaxRescueAttempts,
 	}
 }
+
+// APIRetryConfig configures retry behavior for failed Claude API calls.
+// When a batch submission or streaming request fails with a retryable error,
+// the run is put back to pending with a scheduled retry time instead of failing.
+// Attempts are recorded on the iteration.
+type APIRetryConfig struct {
+	// MaxAttempts is the maximum number of API call attempts per iteration.
+	// After this many attempts, the run is marked as failed.
+	// Set to 1 to disable retries.
+	// Default: 5
+	MaxAttempts int
+
+	// InitialDelay is the delay before the first retry.
+	// The delay doubles with each subsequent attempt.
+	// Default: 2 seconds
+	InitialDelay time.Duration
+
+	// MaxDelay caps the exponential backoff delay.
+	// A longer retry-after duration sent by the API is still respected.
+	// Default: 5 minutes
+	MaxDelay time.Duration
+
+	// Jitter adds randomness to prevent thundering herd.
+	// Range: 0.0 to 1.0 (proportion of delay to randomize).
+	// Default: 0.2 (20% jitter)
+	Jitter float64
+}
+
+// ContextOverflowConfig configures what the workers do when the request for
+// an iteration would exceed the model's context window (see
+// ContextOverflowPolicy). The request size is estimated with the compaction
+// token counter and compared against the agent's context window (see
+// compaction.Config.ForModel) minus the response's max tokens.
+type ContextOverflowConfig struct {
+	// Policy is applied when a request would not fit. Agents override it
+	// with AgentDefinition.Config["context_overflow"].
+	// Default: ContextOverflowCompact
+	Policy ContextOverflowPolicy
+
+	// MaxToolOutputTokens is the size tool outputs are truncated to when
+	// truncating. Only the request is truncated; stored messages are kept.
+	// Default: 8000
+	MaxToolOutputTokens int
+}
+
+// BatchRecoveryConfig configures what the batch poller does with requests
+// of an ended Message Batch that did not succeed.
+//
+// Requests that expired (the batch was not processed within 24 hours),
+// errored with a retryable error (overloaded, rate limited, server error) or
+// are missing from the results are resubmitted: the iteration is detached
+// from the batch and the run goes back to pending, to be submitted again.
+// Requests canceled because the batch was cancelled through the API cancel
+// their runs. Downloading the results is retried as set by APIRetryConfig.
+type BatchRecoveryConfig struct {
+	// MaxResubmissions is how many times an iteration is resubmitted before
+	// its run fails. Set to a negative value to fail without resubmitting.
+	// Default: 2
+	MaxResubmissions int
+
+	// ResubmitAsStreaming resubmits over the Streaming API instead of in a
+	// new batch, trading the batch discount for a prompt response. Only the
+	// resubmitted iteration is streamed: the run is in streaming mode until
+	// its response is stored, then goes back to batch mode.
+	// Default: false
+	ResubmitAsStreaming bool
+
+	// ExpiryWarning is how long before a batch expires a warning is logged
+	// if it is still processing.
+	// Default: 1 hour
+	ExpiryWarning time.Duration
+}
+
+// BatchPollConfig configures adaptive polling of Message Batches. A batch is
+// first polled InitialInterval after it is submitted; the interval then grows
+// by Multiplier with every poll up to MaxInterval. Small batches, which
+// usually end within minutes, are picked up quickly while batches that run
+// for hours cost few API calls.
+type BatchPollConfig struct {
+	// InitialInterval is the delay between submitting a batch and its first
+	// poll.
+	// Default: 10 seconds
+	InitialInterval time.Duration
+
+	// MaxInterval caps the interval between polls of a long-running batch.
+	// Default: 5 minutes
+	MaxInterval time.Duration
+
+	// Multiplier is the factor the interval grows by after each poll.
+	// Set to 1 to poll at InitialInterval for the lifetime of the batch.
+	// Default: 2
+	Multiplier float64
+
+	// Jitter adds randomness so batches submitted together by different
+	// instances are not polled in lockstep.
+	// Range: 0.0 to 1.0 (proportion of interval to randomize).
+	// Default: 0.1 (10% jitter)
+	Jitter float64
+
+	// MaxPollsPerMinute caps batch status polls across all instances. Each
+	// instance polls at most its share (the cap divided by the number of
+	// registered instances); batches over the cap are polled late. Set to a
+	// negative value to disable the cap.
+	// Default: 300
+	MaxPollsPerMinute int
+}
+
+// DefaultBatchPollConfig returns the default batch poll configuration.
+func DefaultBatchPollConfig() *BatchPollConfig {
+	return &BatchPollConfig{
+		InitialInterval:   DefaultBatchPollInitialInterval,
+		MaxInterval:       DefaultBatchPollMaxInterval,
+		Multiplier:        DefaultBatchPollMultiplier,
+		Jitter:            DefaultBatchPollJitter,
+		MaxPollsPerMinute: DefaultBatchMaxPollsPerMinute,
+	}
+}
+
+// NextPollInterval calculates the delay before the next poll of a batch that
+// was polled pollCount times. Uses InitialInterval * Multiplier^pollCount
+// capped at MaxInterval, with jitter.
+func (c *BatchPollConfig) NextPollInterval(pollCount int) time.Duration {
+	if pollCount < 0 {
+		pollCount = 0
+	}
+
+	initial := c.InitialInterval
+	if initial <= 0 {
+		initial = DefaultBatchPollInitialInterval
+	}
+	maxInterval := c.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = DefaultBatchPollMaxInterval
+	}
+	if maxInterval < initial {
+		maxInterval = initial
+	}
+	multiplier := c.Multiplier
+	if multiplier <= 0 {
+		multiplier = DefaultBatchPollMultiplier
+	}
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	interval := time.Duration(float64(initial) * math.Pow(multiplier, float64(pollCount)))
+	if interval > maxInterval || interval <= 0 {
+		interval = maxInterval
+	}
+
+	// Apply jitter (±jitter%)
+	if c.Jitter > 0 {
+		jitterRange := float64(interval) * c.Jitter
+		jitterOffset := (rand.Float64() * 2 * jitterRange) - jitterRange //nolint:gosec // G404: math/rand is fine for jitter, not security
+		interval = time.Duration(float64(interval) + jitterOffset)
+	}
+
+	return interval
+}
+
+// AutoRunModeConfig configures how the client picks the API for each
+// iteration of a RunModeAuto run. The first rule that applies wins:
+//
+//   - the Batch API while streaming calls of the instance are rate limited
+//   - the Streaming API for interactive sessions (see InteractiveSessionKey)
+//   - the Batch API for iterations after the first of other sessions, such
+//     as the tool-result continuations of background jobs
+//   - the Streaming API while the instance has streaming capacity
+//     (MaxConcurrentStreamingRuns), the Batch API otherwise
+type AutoRunModeConfig struct {
+	// RateLimitCooldown is how long auto runs use the Batch API after a
+	// streaming call of the instance was rate limited. A longer retry-after
+	// duration sent by the API is respected.
+	// Default: 1 minute
+	RateLimitCooldown time.Duration
+
+	// StreamContinuations streams the iterations after the first of
+	// non-interactive sessions too, while the instance has streaming
+	// capacity.
+	// Default: false
+	StreamContinuations bool
+}
+
+// DefaultAutoRunModeConfig returns the default auto run mode configuration.
+func DefaultAutoRunModeConfig() *AutoRunModeConfig {
+	return &AutoRunModeConfig{
+		RateLimitCooldown: DefaultAutoRateLimitCooldown,
+	}
+}
+
+// RateLimitConfig configures the rate-limit scheduler shared by all
+// instances. The rate limits reported by the Messages API are kept in
+// per-model token buckets in the database. Before each streaming iteration
+// the worker takes a request from the buckets of the iteration's model; if a
+// bucket is empty the run goes back to pending until it has refilled instead
+// of failing with a rate limit error. Invoke waits for the buckets instead.
+//
+// The provider must implement provider.RateLimitReporter (the default
+// Anthropic provider does); otherwise nothing is recorded and calls are never
+// held back.
+//
+// The buckets cover the Messages API only. Batch iterations neither take
+// from them nor wait for them, as the Message Batches API has its own
+// limits.
+type RateLimitConfig struct {
+	// Disabled turns the scheduler off: calls are made regardless of the
+	// recorded limits and rate limit errors are retried (see APIRetryConfig).
+	// Default: false
+	Disabled bool
+
+	// Headroom is the fraction of each limit kept in reserve for calls
+	// already in flight and other clients of the API key, e.g. 0.05 holds
+	// back calls when less than 5% of a limit remains.
+	// Default: 0.05
+	Headroom float64
+}
+
+// DefaultRateLimitConfig returns the default rate limit configuration.
+func DefaultRateLimitConfig() *RateLimitConfig {
+	return &RateLimitConfig{
+		Headroom: DefaultRateLimitHeadroom,
+	}
+}
+
+// DefaultBatchRecoveryConfig returns the default batch recovery configuration.
+func DefaultBatchRecoveryConfig() *BatchRecoveryConfig {
+	return &BatchRecoveryConfig{
+		MaxResubmissions: DefaultBatchMaxResubmissions,
+		ExpiryWarning:    DefaultBatchExpiryWarning,
+	}
+}
+
+// DefaultContextOverflowConfig returns the default context overflow configuration.
+func DefaultContextOverflowConfig() *ContextOverflowConfig {
+	return &ContextOverflowConfig{
+		Policy:              DefaultContextOverflowPolicy,
+		MaxToolOutputTokens: DefaultMaxToolOutputTokens,
+	}
+}
+
+// DefaultAPIRetryConfig returns the default API retry configuration.
+func DefaultAPIRetryConfig() *APIRetryConfig {
+	return &APIRetryConfig{
+		MaxAttempts:  DefaultAPIRetryMaxAttempts,
+		InitialDelay: DefaultAPIRetryInitialDelay,
+		MaxDelay:     DefaultAPIRetryMaxDelay,
+		Jitter:       DefaultAPIRetryJitter,
+	}
+}
+
+// NextRetryDelay calculates the delay before retrying after the given failed attempt.
+// Uses exponential backoff (InitialDelay * 2^(attempt-1)) capped at MaxDelay,
+// with jitter. If the API sent a retry-after duration longer than the backoff,
+// it is used instead.
+func (c *APIRetryConfig) NextRetryDelay(attemptCount int, retryAfter time.Duration) time.Duration {
+	if attemptCount <= 0 {
+		attemptCount = 1
+	}
+
+	initial := c.InitialDelay
+	if initial <= 0 {
+		initial = DefaultAPIRetryInitialDelay
+	}
+	maxDelay := c.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultAPIRetryMaxDelay
+	}
+
+	delay := time.Duration(float64(initial) * math.Pow(2, float64(attemptCount-1)))
+
+	// Apply jitter (±jitter%)
+	if c.Jitter > 0 {
+		jitterRange := float64(delay) * c.Jitter
+		jitterOffset := (rand.Float64() * 2 * jitterRange) - jitterRange //nolint:gosec // G404: math/rand is fine for jitter, not security
+		delay = time.Duration(float64(delay) + jitterOffset)
+	}
+
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+
+	return delay
+}
@@ -22,6 +22,11 @@ const (
 
 	// RunModeStreaming uses the Claude Streaming API (real-time, low latency).
 	RunModeStreaming RunMode = "streaming"
+
+	// RunModeAuto lets the client pick the Batch or Streaming API for each
+	// iteration (see AutoRunModeConfig). The API used is recorded on
+	// Iteration.IsStreaming.
+	RunModeAuto RunMode = "auto"
 )
 
 // String returns the string representation of the run mode.
@@ -153,6 +158,44 @@ func (s MessageRole) String() string {
 	return string(s)
 }
 
+// SessionPolicy controls which session a scheduled run uses (mirrors agentpg_schedule_session_policy enum).
+type SessionPolicy string
+
+const (
+	// SessionPolicyNew creates a fresh session for every firing.
+	SessionPolicyNew SessionPolicy = "new"
+
+	// SessionPolicyReuse runs every firing in the same session, so the agent
+	// sees the history of previous firings.
+	SessionPolicyReuse SessionPolicy = "reuse"
+)
+
+// String returns the string representation of the session policy.
+func (p SessionPolicy) String() string {
+	return string(p)
+}
+
+// CatchUpPolicy controls how a schedule handles ticks missed while no leader
+// was running (mirrors agentpg_schedule_catch_up enum).
+type CatchUpPolicy string
+
+const (
+	// CatchUpSkip drops missed ticks. A tick only fires if no later tick has
+	// already elapsed.
+	CatchUpSkip CatchUpPolicy = "skip"
+
+	// CatchUpOnce fires a single run for any number of missed ticks.
+	CatchUpOnce CatchUpPolicy = "once"
+
+	// CatchUpAll fires one run per missed tick.
+	CatchUpAll CatchUpPolicy = "all"
+)
+
+// String returns the string representation of the catch-up policy.
+func (p CatchUpPolicy) String() string {
+	return string(p)
+}
+
 // TriggerType constants for iteration triggers.
 const (
 	TriggerTypeUserPrompt   = "user_prompt"
@@ -0,0 +1,205 @@
+package agentpg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/youssefsiam38/agentpg/compaction"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// ContextOverflowPolicy decides what a worker does when the request for the
+// next iteration of a run would not fit the model's context window.
+type ContextOverflowPolicy string
+
+const (
+	// ContextOverflowCompact compacts the session in place, then truncates
+	// oversized tool outputs, and fails the run if the request still does
+	// not fit. Nested (agent-as-tool) runs skip compaction.
+	ContextOverflowCompact ContextOverflowPolicy = "compact"
+
+	// ContextOverflowTruncate truncates oversized tool outputs in the request
+	// and fails the run if it still does not fit.
+	ContextOverflowTruncate ContextOverflowPolicy = "truncate"
+
+	// ContextOverflowFail fails the run with ErrorTypeContextOverflow.
+	ContextOverflowFail ContextOverflowPolicy = "fail"
+
+	// ContextOverflowOff disables the check; an oversized request fails at
+	// the Claude API instead.
+	ContextOverflowOff ContextOverflowPolicy = "off"
+)
+
+// ContextOverflowKey is the key in AgentDefinition.Config that sets the
+// agent's ContextOverflowPolicy, e.g. {"context_overflow": "fail"}.
+const ContextOverflowKey = "context_overflow"
+
+// ErrorTypeContextOverflow is the error type of runs failed because their
+// request would not fit the model's context window.
+const ErrorTypeContextOverflow = "context_overflow"
+
+// charsPerToken matches the approximation of the compaction token counter.
+// It is used to size truncated tool outputs and the request overhead.
+const charsPerToken = 4
+
+// contextOverflowError fails a run whose next request does not fit the
+// model's context window.
+type contextOverflowError struct {
+	estimated int // Estimated request tokens
+	available int // Context window minus the response's max tokens
+}
+
+func (e *contextOverflowError) Error() string {
+	return fmt.Sprintf("%v: request of about %d tokens exceeds the %d tokens available",
+		ErrContextOverflow, e.estimated, e.available)
+}
+
+func (e *contextOverflowError) Unwrap() error { return ErrContextOverflow }
+
+// contextOverflowConfig returns the client's overflow configuration with
+// agent's policy applied.
+func (c *Client[TTx]) contextOverflowConfig(agent *AgentDefinition) ContextOverflowConfig {
+	config := DefaultContextOverflowConfig()
+	if c.config.ContextOverflowConfig != nil {
+		config = c.config.ContextOverflowConfig
+	}
+	result := *config
+	if result.Policy == "" {
+		result.Policy = DefaultContextOverflowPolicy
+	}
+	if result.MaxToolOutputTokens <= 0 {
+		result.MaxToolOutputTokens = DefaultMaxToolOutputTokens
+	}
+	if policy, ok := agent.Config[ContextOverflowKey].(string); ok && policy != "" {
+		result.Policy = ContextOverflowPolicy(policy)
+	}
+	return result
+}
+
+// checkContextOverflow estimates the size of the next request of run and
+// applies the agent's overflow policy if it would not fit the context
+// window. It returns the tool output limit in tokens to build the request
+// with (0 for none), or a *contextOverflowError if the run must fail.
+func (c *Client[TTx]) checkContextOverflow(ctx context.Context, run *driver.Run, agent *AgentDefinition, tools []anthropic.ToolUnionParam) (int, error) {
+	config := c.contextOverflowConfig(agent)
+	if config.Policy == ContextOverflowOff {
+		return 0, nil
+	}
+	log := c.log()
+
+	maxTokens := DefaultMaxTokens
+	if agent.MaxTokens != nil {
+		maxTokens = int64(*agent.MaxTokens)
+	}
+	compactor := c.getCompactor(ctx, run)
+	available := compactor.Config().MaxTokensForModel - int(maxTokens)
+
+	// The system prompt and tool definitions are part of every request
+	overhead := len(agent.SystemPrompt)
+	if len(tools) > 0 {
+		toolsJSON, _ := json.Marshal(tools)
+		overhead += len(toolsJSON)
+	}
+	overheadTokens := overhead / charsPerToken
+
+	// A character-based approximation rules out most requests without
+	// calling the token counting API; closer calls are counted precisely.
+	approximate := compaction.NewTokenCounter(nil, "", false)
+	estimate := func(toolOutputLimit int) (int, error) {
+		messages, err := c.driver.Store().GetMessagesForRunContext(ctx, run.ID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get messages: %w", err)
+		}
+		if toolOutputLimit > 0 {
+			messages = truncateToolOutputs(messages, toolOutputLimit)
+		}
+		result, _ := approximate.CountTokens(ctx, messages)
+		if result.TotalTokens+overheadTokens <= available*3/4 {
+			return result.TotalTokens + overheadTokens, nil
+		}
+		result, err = compactor.TokenCounter().CountTokens(ctx, messages)
+		if err != nil {
+			return 0, fmt.Errorf("failed to estimate request size: %w", err)
+		}
+		return result.TotalTokens + overheadTokens, nil
+	}
+
+	estimated, err := estimate(0)
+	if err != nil {
+		return 0, err
+	}
+	if estimated <= available {
+		return 0, nil
+	}
+
+	log.Warn("request exceeds context window",
+		"run_id", run.ID,
+		"estimated_tokens", estimated,
+		"available_tokens", available,
+		"policy", config.Policy,
+	)
+
+	if config.Policy == ContextOverflowCompact && run.Depth == 0 {
+		if _, err := compactor.CompactRun(ctx, run.SessionID, run.ID); err != nil {
+			log.Warn("context overflow compaction failed",
+				"run_id", run.ID,
+				"error", err,
+			)
+		} else if estimated, err = estimate(0); err != nil {
+			return 0, err
+		} else if estimated <= available {
+			return 0, nil
+		}
+	}
+
+	if config.Policy == ContextOverflowCompact || config.Policy == ContextOverflowTruncate {
+		if estimated, err = estimate(config.MaxToolOutputTokens); err != nil {
+			return 0, err
+		}
+		if estimated <= available {
+			log.Info("truncated tool outputs to fit context window",
+				"run_id", run.ID,
+				"max_tool_output_tokens", config.MaxToolOutputTokens,
+				"estimated_tokens", estimated,
+			)
+			return config.MaxToolOutputTokens, nil
+		}
+	}
+
+	return 0, &contextOverflowError{estimated: estimated, available: available}
+}
+
+// truncateToolOutputs returns messages with tool outputs longer than
+// maxTokens truncated. The input messages are not modified.
+func truncateToolOutputs(messages []*driver.Message, maxTokens int) []*driver.Message {
+	result := make([]*driver.Message, len(messages))
+	for i, msg := range messages {
+		copied := *msg
+		copied.Content = make([]driver.ContentBlock, len(msg.Content))
+		for j, block := range msg.Content {
+			if block.Type == ContentTypeToolResult {
+				block.ToolContent = truncateToolOutput(block.ToolContent, maxTokens)
+			}
+			copied.Content[j] = block
+		}
+		result[i] = &copied
+	}
+	return result
+}
+
+// truncateToolOutput shortens content to about maxTokens tokens, noting the
+// truncation for the model. A maxTokens of 0 means no limit.
+func truncateToolOutput(content string, maxTokens int) string {
+	maxChars := maxTokens * charsPerToken
+	if maxTokens <= 0 || len(content) <= maxChars {
+		return content
+	}
+	for maxChars > 0 && !utf8.RuneStart(content[maxChars]) {
+		maxChars--
+	}
+	return fmt.Sprintf("%s\n[TOOL OUTPUT TRUNCATED: %d of %d characters shown]",
+		content[:maxChars], maxChars, len(content))
+}
@@ -0,0 +1,300 @@
+package agentpg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression
+// (minute, hour, day of month, month, day of week).
+//
+// Each field is stored as a bitmask of allowed values. Supported syntax per
+// field: "*" (any value), "5" (single value), "1-5" (inclusive range),
+// "*/15" or "10-40/10" (steps), "1,15,30" (lists of any of the above), and
+// three-letter names such as "MON" or "JAN" for days of week and months.
+//
+// The descriptors @yearly (@annually), @monthly, @weekly, @daily (@midnight)
+// and @hourly are also accepted.
+//
+// As in Vixie cron, when both day of month and day of week are restricted,
+// a time matches if either field matches. A field starting with "*" (such as
+// "*/2") is not a restriction, so "0 0 */2 * MON" fires on Mondays that fall
+// on an odd day of the month.
+//
+// Daylight saving transitions are also handled as in Vixie cron. Schedules
+// with a fixed minute and hour fire once per matching day: a time skipped
+// when the clocks move forward fires at the transition, and a time repeated
+// when they move back fires only the first time. Schedules whose minute or
+// hour starts with "*" follow the clock, skipping nonexistent times and
+// firing again in a repeated hour.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+	wildcardTime                  bool
+	location                      *time.Location
+}
+
+// cronField describes the bounds and names for one cron field.
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// cronDescriptors maps the supported @-descriptors to their five-field form.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression evaluated in the given time zone.
+// An empty timezone means UTC.
+func parseCron(expr, timezone string) (*cronSchedule, error) {
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", timezone, err)
+		}
+	}
+
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@") {
+		expanded, ok := cronDescriptors[strings.ToLower(expr)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cron descriptor %q", expr)
+		}
+		expr = expanded
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &cronSchedule{location: loc}
+	var err error
+	if s.minute, err = parseCronField(fields[0], cronMinute); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], cronHour); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], cronDom); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], cronMonth); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], cronDow); err != nil {
+		return nil, err
+	}
+	// 7 is an alias for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.domStar = isCronStar(fields[2])
+	s.dowStar = isCronStar(fields[4])
+	s.wildcardTime = isCronStar(fields[0]) || isCronStar(fields[1])
+
+	return s, nil
+}
+
+// isCronStar reports whether a field is unrestricted in the Vixie cron sense:
+// it starts with "*" (or is "?").
+func isCronStar(field string) bool {
+	return strings.HasPrefix(field, "*") || field == "?"
+}
+
+// parseCronField parses a single comma-separated cron field into a bitmask.
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		if part == "" {
+			return 0, fmt.Errorf("empty value in %s field %q", f.name, field)
+		}
+
+		rangePart, step := part, 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			rangePart = part[:idx]
+			n, err := strconv.Atoi(part[idx+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+			}
+			step = n
+		}
+
+		var lo, hi int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			lo, hi = f.min, f.max
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], f); err != nil {
+				return 0, err
+			}
+			if hi, err = parseCronValue(bounds[1], f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+			}
+		default:
+			v, err := parseCronValue(rangePart, f)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+			// "5/15" means starting at 5, every 15
+			if step > 1 {
+				hi = f.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// parseCronValue parses a numeric or named value within a field's bounds.
+func parseCronValue(s string, f cronField) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q in %s field", s, f.name)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range [%d-%d] in %s field", v, f.min, f.max, f.name)
+	}
+	return v, nil
+}
+
+// next returns the first activation time strictly after t.
+// Returns the zero time if no activation exists within the next five years
+// (e.g. "0 0 30 2 *").
+func (s *cronSchedule) next(t time.Time) time.Time {
+	if s.wildcardTime {
+		return s.nextIn(t, s.location)
+	}
+
+	// Fixed times are searched on the wall clock, so a repeated hour does not
+	// match twice, then mapped to an instant
+	after := wallClock(t.In(s.location))
+	for {
+		w := s.nextIn(after, time.UTC)
+		if w.IsZero() {
+			return w
+		}
+		at := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, 0, s.location)
+		if local := wallClock(at); !local.Equal(w) {
+			// w was skipped by the clocks moving forward; fire at the transition
+			start, end := at.ZoneBounds()
+			if local.Before(w) {
+				at = end
+			} else {
+				at = start
+			}
+		}
+		if at.After(t) {
+			return at.In(t.Location())
+		}
+		after = w
+	}
+}
+
+// wallClock returns t's local date and time as the same reading in UTC.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// nextIn returns the first time strictly after t whose reading in loc
+// matches the schedule, or the zero time if there is none within five years.
+func (s *cronSchedule) nextIn(t time.Time, loc *time.Location) time.Time {
+	origLoc := t.Location()
+	t = t.In(loc).Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	limit := t.AddDate(5, 0, 0)
+
+wrap:
+	for t.Before(limit) {
+		for s.month&(1<<uint(t.Month())) == 0 {
+			t = cronDate(t.Year(), t.Month()+1, 1, 0, loc)
+			if t.Month() == time.January {
+				continue wrap
+			}
+		}
+
+		for !s.dayMatches(t) {
+			t = cronDate(t.Year(), t.Month(), t.Day()+1, 0, loc)
+			if t.Day() == 1 {
+				continue wrap
+			}
+		}
+
+		for s.hour&(1<<uint(t.Hour())) == 0 {
+			t = cronDate(t.Year(), t.Month(), t.Day(), t.Hour()+1, loc)
+			if t.Hour() == 0 {
+				continue wrap
+			}
+		}
+
+		for s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			if t.Minute() == 0 {
+				continue wrap
+			}
+		}
+
+		return t.In(origLoc)
+	}
+
+	return time.Time{}
+}
+
+// cronDate is time.Date on the hour, except that a time skipped by the
+// clocks moving forward resolves to the transition rather than to before it,
+// so the search always moves forward.
+func cronDate(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, 0, 0, 0, loc)
+	if wallClock(t).Before(time.Date(year, month, day, hour, 0, 0, 0, time.UTC)) {
+		_, end := t.ZoneBounds()
+		return end
+	}
+	return t
+}
+
+// dayMatches reports whether t's day satisfies the day-of-month and
+// day-of-week fields.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
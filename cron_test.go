@@ -0,0 +1,247 @@
+package agentpg
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // DST cases need America/New_York wherever the tests run
+)
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		timezone string
+		from     string
+		want     []string // successive activations, empty if there is none
+	}{
+		{
+			name: "step",
+			expr: "*/15 * * * *",
+			from: "2025-01-01T10:07:00Z",
+			want: []string{"2025-01-01T10:15:00Z", "2025-01-01T10:30:00Z", "2025-01-01T10:45:00Z", "2025-01-01T11:00:00Z"},
+		},
+		{
+			name: "step over a range",
+			expr: "10-40/10 * * * *",
+			from: "2025-01-01T10:30:00Z",
+			want: []string{"2025-01-01T10:40:00Z", "2025-01-01T11:10:00Z"},
+		},
+		{
+			name: "step from a value",
+			expr: "5/20 * * * *",
+			from: "2025-01-01T10:00:00Z",
+			want: []string{"2025-01-01T10:05:00Z", "2025-01-01T10:25:00Z", "2025-01-01T10:45:00Z", "2025-01-01T11:05:00Z"},
+		},
+		{
+			name: "strictly after",
+			expr: "0 * * * *",
+			from: "2025-01-01T10:00:00Z",
+			want: []string{"2025-01-01T11:00:00Z"},
+		},
+		{
+			name: "hour and weekday ranges",
+			expr: "0 9-17 * * MON-FRI",
+			from: "2025-01-03T17:30:00Z", // Friday
+			want: []string{"2025-01-06T09:00:00Z", "2025-01-06T10:00:00Z"},
+		},
+		{
+			name: "month names",
+			expr: "0 0 1 JAN,jul *",
+			from: "2025-03-01T00:00:00Z",
+			want: []string{"2025-07-01T00:00:00Z", "2026-01-01T00:00:00Z"},
+		},
+		{
+			name: "month name range",
+			expr: "0 0 1 feb-APR *",
+			from: "2025-03-01T00:00:00Z",
+			want: []string{"2025-04-01T00:00:00Z", "2026-02-01T00:00:00Z"},
+		},
+		{
+			name: "7 is Sunday",
+			expr: "0 12 * * 7",
+			from: "2025-01-06T00:00:00Z", // Monday
+			want: []string{"2025-01-12T12:00:00Z", "2025-01-19T12:00:00Z"},
+		},
+		{
+			name: "range ending at 7",
+			expr: "0 12 * * 5-7",
+			from: "2025-01-06T00:00:00Z",
+			want: []string{"2025-01-10T12:00:00Z", "2025-01-11T12:00:00Z", "2025-01-12T12:00:00Z", "2025-01-17T12:00:00Z"},
+		},
+		{
+			name: "day of month or day of week",
+			expr: "0 0 13 * FRI",
+			from: "2025-01-01T00:00:00Z",
+			want: []string{"2025-01-03T00:00:00Z", "2025-01-10T00:00:00Z", "2025-01-13T00:00:00Z", "2025-01-17T00:00:00Z"},
+		},
+		{
+			// */2 is unrestricted, so both fields must match: odd-day Mondays
+			name: "stepped day of month and day of week",
+			expr: "0 0 */2 * MON",
+			from: "2025-01-01T00:00:00Z",
+			want: []string{"2025-01-13T00:00:00Z", "2025-01-27T00:00:00Z", "2025-02-03T00:00:00Z", "2025-02-17T00:00:00Z"},
+		},
+		{
+			name: "day of month and stepped day of week",
+			expr: "0 0 1 * */3",
+			from: "2025-01-01T00:00:00Z",
+			want: []string{"2025-02-01T00:00:00Z", "2025-03-01T00:00:00Z", "2025-06-01T00:00:00Z"}, // Sun, Wed or Sat
+		},
+		{
+			name: "descriptor",
+			expr: "@weekly",
+			from: "2025-01-01T00:00:00Z",
+			want: []string{"2025-01-05T00:00:00Z", "2025-01-12T00:00:00Z"},
+		},
+		{
+			name: "leap day",
+			expr: "0 0 29 2 *",
+			from: "2025-01-01T00:00:00Z",
+			want: []string{"2028-02-29T00:00:00Z", "2032-02-29T00:00:00Z"},
+		},
+		{
+			name: "impossible date",
+			expr: "0 0 30 2 *",
+			from: "2025-01-01T00:00:00Z",
+		},
+		{
+			name: "day missing from every listed month",
+			expr: "0 0 31 4,6,9,11 *",
+			from: "2025-01-01T00:00:00Z",
+		},
+		{
+			name:     "time zone",
+			expr:     "0 9 * * *",
+			timezone: "America/New_York",
+			from:     "2025-01-01T00:00:00Z",
+			want:     []string{"2025-01-01T09:00:00-05:00", "2025-01-02T09:00:00-05:00"},
+		},
+		{
+			// 02:30 does not exist on 2025-03-09; it fires as the clocks move forward
+			name:     "fixed time in DST gap",
+			expr:     "30 2 * * *",
+			timezone: "America/New_York",
+			from:     "2025-03-08T03:00:00-05:00",
+			want:     []string{"2025-03-09T03:00:00-04:00", "2025-03-10T02:30:00-04:00"},
+		},
+		{
+			name:     "wildcard time across DST gap",
+			expr:     "*/30 * * * *",
+			timezone: "America/New_York",
+			from:     "2025-03-09T01:00:00-05:00",
+			want:     []string{"2025-03-09T01:30:00-05:00", "2025-03-09T03:00:00-04:00", "2025-03-09T03:30:00-04:00"},
+		},
+		{
+			name:     "wildcard hour across DST gap",
+			expr:     "30 * * * *",
+			timezone: "America/New_York",
+			from:     "2025-03-09T01:00:00-05:00",
+			want:     []string{"2025-03-09T01:30:00-05:00", "2025-03-09T03:30:00-04:00"},
+		},
+		{
+			// 01:30 happens twice on 2025-11-02; it fires the first time only
+			name:     "fixed time in DST overlap",
+			expr:     "30 1 * * *",
+			timezone: "America/New_York",
+			from:     "2025-11-02T00:00:00-04:00",
+			want:     []string{"2025-11-02T01:30:00-04:00", "2025-11-03T01:30:00-05:00"},
+		},
+		{
+			name:     "wildcard time across DST overlap",
+			expr:     "*/30 * * * *",
+			timezone: "America/New_York",
+			from:     "2025-11-02T01:00:00-04:00",
+			want: []string{
+				"2025-11-02T01:30:00-04:00",
+				"2025-11-02T01:00:00-05:00",
+				"2025-11-02T01:30:00-05:00",
+				"2025-11-02T02:00:00-05:00",
+			},
+		},
+		{
+			name:     "daily across both DST transitions",
+			expr:     "@daily",
+			timezone: "America/New_York",
+			from:     "2025-03-08T12:00:00-05:00",
+			want:     []string{"2025-03-09T00:00:00-05:00", "2025-03-10T00:00:00-04:00"},
+		},
+		{
+			// Midnight does not exist on 2024-09-08 in Santiago
+			name:     "daily in DST gap at midnight",
+			expr:     "@daily",
+			timezone: "America/Santiago",
+			from:     "2024-09-07T12:00:00-04:00",
+			want:     []string{"2024-09-08T01:00:00-03:00", "2024-09-09T00:00:00-03:00"},
+		},
+		{
+			name:     "wildcard hour in DST gap at midnight",
+			expr:     "0 */6 * * *",
+			timezone: "America/Santiago",
+			from:     "2024-09-07T20:00:00-04:00",
+			want:     []string{"2024-09-08T06:00:00-03:00", "2024-09-08T12:00:00-03:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr, tt.timezone)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+
+			at := mustParseTime(t, tt.from)
+			if len(tt.want) == 0 {
+				if next := s.next(at); !next.IsZero() {
+					t.Errorf("next = %v, want none", next)
+				}
+				return
+			}
+			for i, want := range tt.want {
+				next := s.next(at)
+				if !next.Equal(mustParseTime(t, want)) {
+					t.Fatalf("activation %d = %v, want %s", i+1, next, want)
+				}
+				at = next
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		timezone string
+	}{
+		{name: "too few fields", expr: "* * * *"},
+		{name: "too many fields", expr: "* * * * * *"},
+		{name: "minute out of range", expr: "60 * * * *"},
+		{name: "day of month zero", expr: "0 0 0 * *"},
+		{name: "month out of range", expr: "0 0 1 13 *"},
+		{name: "day of week out of range", expr: "0 0 * * 8"},
+		{name: "reversed range", expr: "5-1 * * * *"},
+		{name: "zero step", expr: "*/0 * * * *"},
+		{name: "empty list value", expr: "1,,2 * * * *"},
+		{name: "unknown name", expr: "0 0 * * FOO"},
+		{name: "month name in day of week", expr: "0 0 * * JAN"},
+		{name: "unknown descriptor", expr: "@every"},
+		{name: "unknown time zone", expr: "@daily", timezone: "Mars/Olympus"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseCron(tt.expr, tt.timezone); err == nil {
+				t.Errorf("parseCron(%q, %q) succeeded, want error", tt.expr, tt.timezone)
+			}
+		})
+	}
+}
+
+func mustParseTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	v, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -0,0 +1,25 @@
+package databasesql_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/youssefsiam38/agentpg/agentpgtest"
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/driver/databasesql"
+	"github.com/youssefsiam38/agentpg/driver/drivertest"
+)
+
+// TestConformance runs the store suite against PostgreSQL. It is skipped
+// unless AGENTPG_TEST_DATABASE_URL is set.
+func TestConformance(t *testing.T) {
+	drivertest.RunStoreSuite(t, func(t *testing.T) driver.Driver[*sql.Tx] {
+		connStr := agentpgtest.NewDatabaseURL(t)
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return databasesql.New(db, connStr)
+	})
+}
@@ -43,6 +43,30 @@ type Store[TTx any] interface {
 	// ListSessions returns sessions with optional filtering and pagination.
 	// Returns (sessions, totalCount, error). Used by admin UI for browsing all sessions.
 	ListSessions(ctx context.Context, params ListSessionsParams) ([]*Session, int, error)
+	// ForkSession creates a child session of params.SessionID holding copies
+	// of the session's root-level messages up to and including
+	// params.AtMessageID, in a single transaction. The copies get new IDs,
+	// keep their original timestamps and are detached from runs. Returns
+	// ErrForkPointNotFound if the message is not part of the session's
+	// root-level conversation.
+	ForkSession(ctx context.Context, params ForkSessionParams) (*Session, error)
+	// ImportSession inserts a session with its runs, messages, iterations,
+	// tool executions, compaction events and archived messages in a single
+	// transaction. Rows are stored as given, including IDs, states and
+	// timestamps, so the caller must supply fresh IDs and only reference
+	// agents that exist. Runs must be ordered parents first.
+	ImportSession(ctx context.Context, params ImportSessionParams) error
+	// ImportRuns inserts runs of an existing session with their messages,
+	// iterations and tool executions in a single transaction. Rows are stored
+	// as given, like ImportSession, and runs must be ordered parents first.
+	// Used to record runs executed in-process by Client.Invoke.
+	ImportRuns(ctx context.Context, params ImportRunsParams) error
+	// DeleteSession deletes a session with its child sessions and all of
+	// their runs, iterations, tool executions, messages, compaction events
+	// and archived messages in a single transaction, and returns the number
+	// of rows deleted. Returns nil counts if the session does not exist and
+	// ErrSessionBusy if a run of one of the sessions is in progress.
+	DeleteSession(ctx context.Context, id uuid.UUID) (*PurgeCounts, error)
 	// GetMetadataValues returns distinct values for a metadata key with session counts.
 	// Used by UI to populate filter dropdowns (e.g., list all tenant_id values).
 	GetMetadataValues(ctx context.Context, key string) ([]MetadataValue, error)
@@ -61,6 +85,12 @@ type Store[TTx any] interface {
 	DeleteAgent(ctx context.Context, id uuid.UUID) error
 	// ListAgents returns agents with optional filtering and pagination.
 	ListAgents(ctx context.Context, params ListAgentsParams) ([]*AgentDefinition, int, error)
+	// ListAgentVersions returns the recorded definitions of an agent, newest
+	// first. A version is recorded when an agent is created and whenever an
+	// update changes its definition.
+	ListAgentVersions(ctx context.Context, agentID uuid.UUID) ([]*AgentVersion, error)
+	// GetAgentVersion returns one version of an agent, or nil if it does not exist.
+	GetAgentVersion(ctx context.Context, agentID uuid.UUID, version int) (*AgentVersion, error)
 
 	// Tool operations
 	UpsertTool(ctx context.Context, tool *ToolDefinition) error
@@ -74,7 +104,8 @@ type Store[TTx any] interface {
 	GetRun(ctx context.Context, id uuid.UUID) (*Run, error)
 	UpdateRun(ctx context.Context, id uuid.UUID, updates map[string]any) error
 	UpdateRunState(ctx context.Context, id uuid.UUID, state RunState, updates map[string]any) error
-	// ClaimRuns claims pending runs for processing. runMode is optional ("batch", "streaming", or empty for any).
+	// ClaimRuns claims pending runs for processing. runMode is optional ("batch", "streaming", "auto", or empty for any).
+	// Auto runs are claimed into batch_submitting.
 	ClaimRuns(ctx context.Context, instanceID string, maxCount int, runMode string) ([]*Run, error)
 	GetRunsBySession(ctx context.Context, sessionID uuid.UUID, limit int) ([]*Run, error)
 	GetStuckPendingToolsRuns(ctx context.Context, limit int) ([]*Run, error)
@@ -86,8 +117,23 @@ type Store[TTx any] interface {
 	CreateIteration(ctx context.Context, params CreateIterationParams) (*Iteration, error)
 	GetIteration(ctx context.Context, id uuid.UUID) (*Iteration, error)
 	UpdateIteration(ctx context.Context, id uuid.UUID, updates map[string]any) error
-	GetIterationsForPoll(ctx context.Context, instanceID string, pollInterval time.Duration, maxCount int) ([]*Iteration, error)
+	// AddIterationAPIAttempt appends a failed API call attempt to the iteration's api_attempts.
+	AddIterationAPIAttempt(ctx context.Context, id uuid.UUID, attempt APIAttempt) error
+	// GetIterationsForPoll returns iterations of in-progress or canceling batches
+	// of runs claimed by the instance that are due for a poll (next poll time
+	// unset or reached), the most overdue first.
+	GetIterationsForPoll(ctx context.Context, instanceID string, maxCount int) ([]*Iteration, error)
 	GetIterationsByRun(ctx context.Context, runID uuid.UUID) ([]*Iteration, error)
+	// GetIterationsByBatch returns the iterations submitted in a Message Batch,
+	// ordered by creation. Iterations detached from the batch are not included.
+	GetIterationsByBatch(ctx context.Context, batchID string) ([]*Iteration, error)
+	// MarkBatchPolled increments the poll count, sets the last poll time and
+	// schedules the next poll of all iterations of a Message Batch that are in
+	// progress or canceling.
+	MarkBatchPolled(ctx context.Context, batchID string, nextPollAt time.Time) error
+	// ScheduleBatchPoll sets the next poll time of all iterations of a Message
+	// Batch that are in progress or canceling, without counting a poll.
+	ScheduleBatchPoll(ctx context.Context, batchID string, nextPollAt time.Time) error
 
 	// Tool execution operations
 	CreateToolExecution(ctx context.Context, params CreateToolExecutionParams) (*ToolExecution, error)
@@ -132,12 +178,52 @@ type Store[TTx any] interface {
 	// Increments rescue_attempts and sets last_rescue_at.
 	RescueRun(ctx context.Context, id uuid.UUID) error
 
+	// Run API retry operations
+	// RetryRun records a failed API call attempt on the iteration and atomically resets
+	// the run to pending with scheduled_at set to the retry time. The run's
+	// current_iteration_id is set to the iteration so the retry reuses it.
+	RetryRun(ctx context.Context, id, iterationID uuid.UUID, attempt APIAttempt, scheduledAt time.Time) error
+	// DeferRun puts a claimed run back to pending until scheduledAt without
+	// recording an API attempt, e.g. when the model's rate limits are
+	// exhausted. The run keeps its started_at and current iteration.
+	DeferRun(ctx context.Context, id uuid.UUID, scheduledAt time.Time) error
+
+	// Operator operations
+	// CancelRun cancels a run and its nested runs that are not finalized,
+	// skipping their pending and running tool executions. reason is stored
+	// as the error message of the cancelled runs. Returns the number of runs
+	// cancelled (0 if the run and its nested runs were all finalized).
+	CancelRun(ctx context.Context, id uuid.UUID, reason string) (int, error)
+	// RetryFailedRun puts a failed run back to work after its last
+	// successful iteration. If that iteration's tool calls were not answered
+	// yet, the run returns to pending_tools and the iteration's failed and
+	// skipped tool executions are requeued; otherwise the run returns to
+	// pending and continues with a new iteration. Returns false if the run
+	// is not failed.
+	RetryFailedRun(ctx context.Context, id uuid.UUID) (bool, error)
+	// RequeueToolExecution resets a failed tool execution to pending with a
+	// fresh attempt budget, keeping its error as last_error. Returns false
+	// if the execution is not failed.
+	RequeueToolExecution(ctx context.Context, id uuid.UUID) (bool, error)
+
+	// Audit log operations
+	CreateAuditEvent(ctx context.Context, params CreateAuditEventParams) (*AuditEvent, error)
+	// ListAuditEvents returns audit events, newest first, with the total
+	// count. With a metadata filter, only events of matching sessions are
+	// returned.
+	ListAuditEvents(ctx context.Context, params ListAuditEventsParams) ([]*AuditEvent, int, error)
+
 	// Message operations
 	CreateMessage(ctx context.Context, params CreateMessageParams) (*Message, error)
 	GetMessage(ctx context.Context, id uuid.UUID) (*Message, error)
 	GetMessages(ctx context.Context, sessionID uuid.UUID, limit int) ([]*Message, error)
 	GetMessagesByRun(ctx context.Context, runID uuid.UUID) ([]*Message, error)
 	GetMessagesForRunContext(ctx context.Context, runID uuid.UUID) ([]*Message, error)
+	// GetSessionContext returns the messages a new root run of the session
+	// sees: messages without a run and messages of root-level runs, ordered by
+	// created_at. Messages of child runs (agent-as-tool invocations) are
+	// excluded.
+	GetSessionContext(ctx context.Context, sessionID uuid.UUID) ([]*Message, error)
 	// GetMessagesWithRunInfo returns messages for a session with joined run information.
 	// This is an optimized query that returns messages with agent name, depth, parent run ID,
 	// and state in a single query, avoiding N+1 queries when building hierarchical views.
@@ -179,9 +265,76 @@ type Store[TTx any] interface {
 	// Compaction operations
 	CreateCompactionEvent(ctx context.Context, params CreateCompactionEventParams) (*CompactionEvent, error)
 	ArchiveMessage(ctx context.Context, compactionEventID, messageID, sessionID uuid.UUID, originalMessage map[string]any) error
+	// GetArchivedMessages returns the archived messages of a session, oldest first.
+	GetArchivedMessages(ctx context.Context, sessionID uuid.UUID) ([]*ArchivedMessage, error)
 	GetCompactionEvents(ctx context.Context, sessionID uuid.UUID, limit int) ([]*CompactionEvent, error)
+	GetCompactionEvent(ctx context.Context, id uuid.UUID) (*CompactionEvent, error)
+	// ApplyCompaction replaces compacted messages in a single transaction: it
+	// locks the session, archives and deletes params.Messages, creates the
+	// summary message and the compaction event, and increments the session's
+	// compaction count. While the session is locked, ClaimRuns skips its runs.
+	// Returns ErrSessionBusy if a run of the session other than params.RunID
+	// is in progress and ErrCompactionConflict if one of the messages no
+	// longer exists.
+	ApplyCompaction(ctx context.Context, params ApplyCompactionParams) (*CompactionEvent, error)
+	// RestoreCompaction undoes a compaction in a single transaction: it
+	// reinstates the archived messages with their original IDs and timestamps,
+	// deletes the summary message, and marks the event restored. Only the
+	// session's latest unrestored compaction can be restored; for an older one
+	// it returns ErrCompactionConflict, and for one whose archive was purged
+	// ErrArchivePurged.
+	RestoreCompaction(ctx context.Context, eventID uuid.UUID) (*CompactionEvent, error)
 	// GetCompactionStats returns aggregate statistics for all compaction events.
 	GetCompactionStats(ctx context.Context) (*CompactionStats, error)
+
+	// Schedule operations
+	// UpsertSchedule creates a schedule or updates the one with the same name.
+	// On update, next_run_at is only replaced when the cron expression or timezone
+	// changed, and the paused flag is left untouched.
+	UpsertSchedule(ctx context.Context, params UpsertScheduleParams) (*Schedule, error)
+	GetSchedule(ctx context.Context, id uuid.UUID) (*Schedule, error)
+	GetScheduleByName(ctx context.Context, name string) (*Schedule, error)
+	UpdateSchedule(ctx context.Context, id uuid.UUID, updates map[string]any) error
+	DeleteSchedule(ctx context.Context, id uuid.UUID) error
+	ListSchedules(ctx context.Context, params ListSchedulesParams) ([]*Schedule, int, error)
+	// GetDueSchedules returns unpaused schedules whose next_run_at has passed.
+	GetDueSchedules(ctx context.Context, limit int) ([]*Schedule, error)
+	// AdvanceScheduleTx moves a schedule to its next tick within a transaction.
+	// The update only applies if next_run_at still equals params.ExpectedNextRunAt
+	// and the schedule is not paused, so two instances firing the same tick cannot
+	// both commit. Returns false if the schedule was already advanced or paused.
+	AdvanceScheduleTx(ctx context.Context, tx TTx, params AdvanceScheduleParams) (bool, error)
+
+	// Rate limit operations
+	// AcquireRateLimit takes one request from the model's rate-limit buckets.
+	// Returns nil if the call may start, otherwise the time at which the
+	// buckets will have refilled (nothing is taken then). Models without
+	// recorded limits are never limited.
+	AcquireRateLimit(ctx context.Context, model string) (*time.Time, error)
+	// RecordRateLimit updates the model's rate-limit buckets from the limits
+	// reported by a response and takes the tokens the call used.
+	RecordRateLimit(ctx context.Context, params RecordRateLimitParams) error
+
+	// Retention operations
+	// Each purge deletes one batch of at most params.Limit rows of its
+	// target in a single transaction, skipping rows locked by others, and
+	// returns the number of rows deleted including dependent rows.
+	//
+	// PurgeSessions deletes sessions without activity since params.Before:
+	// sessions last updated before it whose runs were all finalized and
+	// whose messages were all updated before it. Sessions with child
+	// sessions are kept until their children are purged.
+	PurgeSessions(ctx context.Context, params PurgeParams) (*PurgeCounts, error)
+	// PurgeRuns deletes root runs finalized before params.Before, with their
+	// nested runs, iterations and tool executions. Messages of the root runs
+	// are kept in the session's conversation; messages of nested runs are
+	// deleted with them.
+	PurgeRuns(ctx context.Context, params PurgeParams) (*PurgeCounts, error)
+	// PurgeArchivedMessages deletes the archived messages of compaction
+	// events created before params.Before. params.Limit counts compaction
+	// events, whose archives are deleted whole. RestoreCompaction returns
+	// ErrArchivePurged for those events.
+	PurgeArchivedMessages(ctx context.Context, params PurgeParams) (*PurgeCounts, error)
 }
 
 // CompactionStats contains aggregate compaction statistics.
@@ -192,6 +345,18 @@ type CompactionStats struct {
 	AvgReductionPercent   float64
 }
 
+// PurgeCounts contains the number of rows removed by a delete or purge,
+// including rows removed by cascade.
+type PurgeCounts struct {
+	Sessions         int
+	Runs             int
+	Iterations       int
+	ToolExecutions   int
+	Messages         int
+	CompactionEvents int
+	ArchivedMessages int
+}
+
 // Listener provides LISTEN/NOTIFY functionality.
 type Listener interface {
 	// Listen starts listening for notifications on the specified channels.
@@ -219,17 +384,57 @@ type CreateSessionParams struct {
 	Metadata        map[string]any
 }
 
+// ForkSessionParams contains parameters for forking a session.
+type ForkSessionParams struct {
+	SessionID   uuid.UUID      // Session to fork
+	AtMessageID uuid.UUID      // Last message copied into the fork
+	Metadata    map[string]any // Metadata of the new session
+}
+
+// ImportSessionParams contains the rows of a session to import.
+type ImportSessionParams struct {
+	Session          *Session
+	Runs             []*Run // Parents before children
+	Messages         []*Message
+	Iterations       []*Iteration
+	ToolExecutions   []*ToolExecution
+	CompactionEvents []*CompactionEvent
+	ArchivedMessages []*ArchivedMessage
+}
+
+// ImportRunsParams contains the rows of runs to import.
+type ImportRunsParams struct {
+	Runs           []*Run
+	Messages       []*Message
+	Iterations     []*Iteration
+	ToolExecutions []*ToolExecution
+}
+
+// PurgeParams selects the rows deleted by a purge.
+type PurgeParams struct {
+	Before         time.Time      // Only rows older than this
+	MetadataFilter map[string]any // Only rows of sessions whose metadata contains these entries (uses @> operator)
+	States         []string       // PurgeRuns only: run states to delete, all terminal states if empty
+	Limit          int            // Maximum number of rows of the target to delete
+}
+
 // CreateRunParams contains parameters for creating a run.
 type CreateRunParams struct {
 	SessionID             uuid.UUID
 	AgentID               uuid.UUID // UUID of the agent to execute
 	Prompt                string
-	RunMode               string // "batch" or "streaming", defaults to "batch"
+	RunMode               string // "batch", "streaming" or "auto", defaults to "batch"
 	ParentRunID           *uuid.UUID
 	ParentToolExecutionID *uuid.UUID
 	Depth                 int
 	CreatedByInstanceID   string
 	Metadata              map[string]any
+	// IdempotencyKey deduplicates run creation. If a run with the same key was
+	// created in the session within IdempotencyTTL, that run is returned
+	// instead of a new one, or ErrIdempotencyConflict if its agent, prompt,
+	// run mode or metadata differ.
+	IdempotencyKey string
+	IdempotencyTTL time.Duration
 }
 
 // CreateIterationParams contains parameters for creating an iteration.
@@ -289,35 +494,114 @@ type CreateCompactionEventParams struct {
 	DurationMS          *int64
 }
 
+// ApplyCompactionParams contains parameters for applying a compaction.
+type ApplyCompactionParams struct {
+	Event    CreateCompactionEventParams
+	Messages []*Message     // Messages to archive and delete, as read before compaction
+	Summary  []ContentBlock // Content of the summary message (nil for no summary)
+	RunID    *uuid.UUID     // In-progress run compacting its own session, not counted as busy
+}
+
+// UpsertScheduleParams contains parameters for creating or updating a schedule.
+type UpsertScheduleParams struct {
+	Name            string
+	AgentID         uuid.UUID
+	CronExpression  string
+	Timezone        string
+	CatchUpPolicy   string // "skip", "once" or "all"
+	NextRunAt       time.Time
+	Prompt          string
+	Variables       map[string]any
+	RunMode         string // "batch", "streaming" or "auto"
+	SessionPolicy   string // "new" or "reuse"
+	SessionID       *uuid.UUID
+	SessionMetadata map[string]any
+	Metadata        map[string]any
+}
+
+// AdvanceScheduleParams contains parameters for advancing a schedule to its next tick.
+type AdvanceScheduleParams struct {
+	ID                uuid.UUID
+	ExpectedNextRunAt time.Time  // Current next_run_at (compare-and-swap guard)
+	NextRunAt         time.Time  // New next_run_at
+	RunID             *uuid.UUID // Run created for this tick (nil if the tick was skipped)
+	SessionID         *uuid.UUID // Session to remember for the reuse policy
+}
+
+// RecordRateLimitParams contains the rate limits reported by a Messages API
+// response. Limits and remaining amounts are nil if not reported.
+type RecordRateLimitParams struct {
+	Model                 string
+	RequestsLimit         *int
+	RequestsRemaining     *int
+	InputTokensLimit      *int
+	InputTokensRemaining  *int
+	OutputTokensLimit     *int
+	OutputTokensRemaining *int
+	InputTokensUsed       int        // Tokens used by the call, taken from the buckets
+	OutputTokensUsed      int        // Tokens used by the call, taken from the buckets
+	BlockedUntil          *time.Time // No calls before this time (from the retry-after of a 429)
+}
+
+// CreateAuditEventParams contains parameters for recording an operator action.
+type CreateAuditEventParams struct {
+	Action     string         // e.g. "run.cancel"
+	TargetType string         // "run", "tool_execution" or "leader"
+	TargetID   string         // ID of the target
+	SessionID  *uuid.UUID     // Session of the target (nil for fleet-wide actions)
+	Actor      string         // User who performed the action
+	Details    map[string]any // Action-specific details
+}
+
+// ListAuditEventsParams contains parameters for listing audit events with optional filtering.
+type ListAuditEventsParams struct {
+	MetadataFilter map[string]any // Only events of sessions matching these key-value pairs (uses @> operator)
+	TargetType     string         // Filter by target type
+	TargetID       string         // Filter by target ID
+	Actor          string         // Filter by actor
+	Limit          int            // Maximum number of results
+	Offset         int            // Offset for pagination
+}
+
+// ListSchedulesParams contains parameters for listing schedules with optional filtering.
+type ListSchedulesParams struct {
+	MetadataFilter map[string]any // Filter by metadata key-value pairs (uses @> operator)
+	AgentID        *uuid.UUID     // Filter by agent UUID
+	Limit          int            // Maximum number of results
+	Offset         int            // Offset for pagination
+}
+
 // ListRunsParams contains parameters for listing runs with optional filtering.
 type ListRunsParams struct {
 	MetadataFilter map[string]any // Filter sessions by metadata key-value pairs (uses @> operator)
 	SessionID      *uuid.UUID     // Filter by session
 	AgentID        *uuid.UUID     // Filter by agent UUID
 	State          string         // Filter by run state
-	RunMode        string         // Filter by run mode ("batch" or "streaming")
+	RunMode        string         // Filter by run mode ("batch", "streaming" or "auto")
 	Limit          int            // Maximum number of results
 	Offset         int            // Offset for pagination
 }
 
 // ListToolExecutionsParams contains parameters for listing tool executions with optional filtering.
 type ListToolExecutionsParams struct {
-	RunID       *uuid.UUID // Filter by run
-	IterationID *uuid.UUID // Filter by iteration
-	ToolName    string     // Filter by tool name
-	State       string     // Filter by execution state
-	IsAgentTool *bool      // Filter by agent tool flag
-	Limit       int        // Maximum number of results
-	Offset      int        // Offset for pagination
+	MetadataFilter map[string]any // Filter by the metadata of the run's session (uses @> operator)
+	RunID          *uuid.UUID     // Filter by run
+	IterationID    *uuid.UUID     // Filter by iteration
+	ToolName       string         // Filter by tool name
+	State          string         // Filter by execution state
+	IsAgentTool    *bool          // Filter by agent tool flag
+	Limit          int            // Maximum number of results
+	Offset         int            // Offset for pagination
 }
 
 // ListSessionsParams contains parameters for listing sessions with optional filtering.
 type ListSessionsParams struct {
-	MetadataFilter map[string]any // Filter by metadata key-value pairs (uses @> operator)
-	Limit          int            // Maximum number of results
-	Offset         int            // Offset for pagination
-	OrderBy        string         // Field to order by (created_at, updated_at)
-	OrderDir       string         // Order direction (asc, desc)
+	MetadataFilter  map[string]any // Filter by metadata key-value pairs (uses @> operator)
+	ParentSessionID *uuid.UUID     // Filter by parent session
+	Limit           int            // Maximum number of results
+	Offset          int            // Offset for pagination
+	OrderBy         string         // Field to order by (created_at, updated_at)
+	OrderDir        string         // Order direction (asc, desc)
 }
 
 // ListAgentsParams contains parameters for listing agents with optional filtering.
@@ -328,6 +612,24 @@ type ListAgentsParams struct {
 	Offset         int            // Offset for pagination
 }
 
+// APIAttempt records a failed Claude API call made for an iteration.
+// Stored as an element of the iteration's api_attempts JSON array.
+type APIAttempt struct {
+	Attempt    int        `json:"attempt"`               // 1-indexed attempt number within the iteration
+	ErrorType  string     `json:"error_type"`            // e.g. "rate_limit_error", "overloaded_error", "network_error"
+	StatusCode int        `json:"status_code,omitempty"` // HTTP status code, 0 for network errors
+	Message    string     `json:"message"`
+	Retryable  bool       `json:"retryable"`
+	RetryAt    *time.Time `json:"retry_at,omitempty"` // When the retry is scheduled (nil if not retried)
+	CreatedAt  time.Time  `json:"created_at"`
+	// Model fallback
+	Model         string `json:"model,omitempty"`          // Model the failed call was made with
+	FallbackModel string `json:"fallback_model,omitempty"` // Model the retry falls back to (empty for same-model retries)
+	// Batch recovery
+	BatchID         string `json:"batch_id,omitempty"`         // Batch whose request expired or errored, or whose results could not be downloaded
+	ResultsDownload bool   `json:"results_download,omitempty"` // The batch ended but downloading its results failed (the request was not resubmitted)
+}
+
 // MetadataValue contains a metadata value with its session count.
 // Used by GetMetadataValues to return distinct values for a metadata key.
 type MetadataValue struct {
@@ -345,6 +647,8 @@ type (
 		CompactionCount int
 		CreatedAt       time.Time
 		UpdatedAt       time.Time
+		// Message of the parent session this session was forked at (nil if not a fork)
+		ForkedFromMessageID *uuid.UUID
 	}
 
 	AgentDefinition = struct {
@@ -363,6 +667,20 @@ type (
 		Config       map[string]any // Additional configuration
 		CreatedAt    time.Time
 		UpdatedAt    time.Time
+		// Model fallback
+		FallbackModels          []string // Models tried in order when the primary model is unavailable
+		FallbackLatencyBudgetMs *int     // Streaming only: max wait for the first event before falling back
+		// Concurrency
+		MaxConcurrentRuns *int // Fleet-wide cap on runs in progress for this agent (nil = unlimited)
+	}
+
+	// AgentVersion is a recorded definition of an agent.
+	AgentVersion = struct {
+		ID        uuid.UUID
+		AgentID   uuid.UUID
+		Version   int              // 1 for the definition the agent was created with
+		Agent     *AgentDefinition // The definition as of this version; CreatedAt and UpdatedAt are the version's
+		CreatedAt time.Time
 	}
 
 	ToolDefinition = struct {
@@ -374,13 +692,15 @@ type (
 		Metadata    map[string]any
 		CreatedAt   time.Time
 		UpdatedAt   time.Time
+		// Concurrency
+		MaxConcurrency *int // Fleet-wide cap on running executions of this tool (nil = unlimited)
 	}
 
 	Run = struct {
 		ID                       uuid.UUID
 		SessionID                uuid.UUID
 		AgentID                  uuid.UUID // UUID of the agent executing this run
-		RunMode                  string    // "batch" or "streaming"
+		RunMode                  string    // "batch", "streaming" or "auto"
 		ParentRunID              *uuid.UUID
 		ParentToolExecutionID    *uuid.UUID
 		Depth                    int
@@ -409,6 +729,10 @@ type (
 		// Rescue tracking
 		RescueAttempts int
 		LastRescueAt   *time.Time
+		// Deduplication
+		IdempotencyKey *string
+		// API retry: earliest time the run may be claimed
+		ScheduledAt time.Time
 	}
 
 	RunState = string
@@ -426,6 +750,7 @@ type (
 		BatchExpiresAt           *time.Time
 		BatchPollCount           int
 		BatchLastPollAt          *time.Time
+		BatchNextPollAt          *time.Time // When the batch is next polled (nil: due now)
 		StreamingStartedAt       *time.Time // Only for streaming mode
 		StreamingCompletedAt     *time.Time // Only for streaming mode
 		TriggerType              string
@@ -443,10 +768,35 @@ type (
 		CreatedAt                time.Time
 		StartedAt                *time.Time
 		CompletedAt              *time.Time
+		APIAttempts              []APIAttempt // Failed API call attempts, oldest first
+		Model                    *string      // Model used for the API call (differs from the agent model on fallback)
 	}
 
 	BatchStatus = string
 
+	Schedule = struct {
+		ID              uuid.UUID
+		Name            string
+		AgentID         uuid.UUID
+		CronExpression  string
+		Timezone        string
+		CatchUpPolicy   string
+		Paused          bool
+		NextRunAt       time.Time
+		Prompt          string
+		Variables       map[string]any
+		RunMode         string
+		SessionPolicy   string
+		SessionID       *uuid.UUID
+		SessionMetadata map[string]any
+		LastRunAt       *time.Time
+		LastRunID       *uuid.UUID
+		FireCount       int64
+		Metadata        map[string]any
+		CreatedAt       time.Time
+		UpdatedAt       time.Time
+	}
+
 	ToolExecution = struct {
 		ID                  uuid.UUID
 		RunID               uuid.UUID
@@ -540,9 +890,33 @@ type (
 		PreservedMessageIDs []uuid.UUID
 		ModelUsed           *string
 		DurationMS          *int64
+		SummaryMessageID    *uuid.UUID
+		RestoredAt          *time.Time
 		CreatedAt           time.Time
 	}
 
+	// ArchivedMessage is a message removed by a compaction, kept so the
+	// compaction can be restored.
+	ArchivedMessage = struct {
+		ID                uuid.UUID // ID of the original message
+		CompactionEventID *uuid.UUID
+		SessionID         uuid.UUID
+		OriginalMessage   map[string]any // JSON encoding of the original Message
+		ArchivedAt        time.Time
+	}
+
+	// AuditEvent is an operator action recorded in the audit log.
+	AuditEvent = struct {
+		ID         uuid.UUID
+		Action     string
+		TargetType string
+		TargetID   string
+		SessionID  *uuid.UUID
+		Actor      string
+		Details    map[string]any
+		CreatedAt  time.Time
+	}
+
 	// MessageWithRunInfo contains a message with its associated run information.
 	// Used for efficiently fetching messages with run context in a single query,
 	// avoiding N+1 queries when building hierarchical conversation views.
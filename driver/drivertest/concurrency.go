@@ -0,0 +1,299 @@
+package drivertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+func testTransactions[TTx any](t *testing.T, h *harness[TTx]) {
+	agent := h.agent("agent")
+
+	// Committed: invisible until commit, visible after
+	tx := must(h.drv.BeginTx(h.ctx))(t)
+	session := must(h.store.CreateSessionTx(h.ctx, tx, driver.CreateSessionParams{Metadata: map[string]any{"tx": "commit"}}))(t)
+	run := must(h.store.CreateRunTx(h.ctx, tx, driver.CreateRunParams{SessionID: session.ID, AgentID: agent.ID, Prompt: "Hello"}))(t)
+	if got := must(h.store.GetSession(h.ctx, session.ID))(t); got != nil {
+		t.Fatalf("CreateSessionTx: session visible before commit")
+	}
+	if got := must(h.store.GetRun(h.ctx, run.ID))(t); got != nil {
+		t.Fatalf("CreateRunTx: run visible before commit")
+	}
+	if claimed := must(h.store.ClaimRuns(h.ctx, "worker", 10, ""))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimRuns: claimed %d uncommitted runs", len(claimed))
+	}
+	check(t, h.drv.CommitTx(h.ctx, tx))
+	if got := must(h.store.GetSession(h.ctx, session.ID))(t); got == nil || got.Metadata["tx"] != "commit" {
+		t.Fatalf("CreateSessionTx: got %+v after commit", got)
+	}
+	if got := h.getRun(run.ID); got.State != "pending" {
+		t.Fatalf("CreateRunTx: got state %s after commit", got.State)
+	}
+
+	// Rolled back: nothing remains
+	tx = must(h.drv.BeginTx(h.ctx))(t)
+	session = must(h.store.CreateSessionTx(h.ctx, tx, driver.CreateSessionParams{}))(t)
+	run = must(h.store.CreateRunTx(h.ctx, tx, driver.CreateRunParams{SessionID: session.ID, AgentID: agent.ID, Prompt: "Hello"}))(t)
+	check(t, h.drv.RollbackTx(h.ctx, tx))
+	if got := must(h.store.GetSession(h.ctx, session.ID))(t); got != nil {
+		t.Fatalf("CreateSessionTx: session exists after rollback")
+	}
+	if got := must(h.store.GetRun(h.ctx, run.ID))(t); got != nil {
+		t.Fatalf("CreateRunTx: run exists after rollback")
+	}
+	if _, total := must2(h.store.ListSessions(h.ctx, driver.ListSessionsParams{}))(t); total != 1 {
+		t.Fatalf("ListSessions after rollback: total %d, want 1", total)
+	}
+
+	// A rolled back schedule advance restores the tick
+	next := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	sched := must(h.store.UpsertSchedule(h.ctx, driver.UpsertScheduleParams{
+		Name: "nightly", AgentID: agent.ID, CronExpression: "0 0 * * *", Timezone: "UTC", CatchUpPolicy: "skip",
+		NextRunAt: next, Prompt: "Tick", RunMode: "batch", SessionPolicy: "new",
+	}))(t)
+	tx = must(h.drv.BeginTx(h.ctx))(t)
+	if ok := must(h.store.AdvanceScheduleTx(h.ctx, tx, driver.AdvanceScheduleParams{
+		ID: sched.ID, ExpectedNextRunAt: sched.NextRunAt, NextRunAt: next.Add(24 * time.Hour), RunID: &run.ID,
+	}))(t); !ok {
+		t.Fatalf("AdvanceScheduleTx: got false")
+	}
+	check(t, h.drv.RollbackTx(h.ctx, tx))
+	got := must(h.store.GetSchedule(h.ctx, sched.ID))(t)
+	if !sameTime(got.NextRunAt, next) || got.FireCount != 0 || got.LastRunID != nil {
+		t.Fatalf("AdvanceScheduleTx after rollback: got %+v", got)
+	}
+}
+
+func testNotifications[TTx any](t *testing.T, h *harness[TTx]) {
+	listener := h.drv.Listener()
+	if listener == nil {
+		t.Skip("driver does not support notifications")
+	}
+	check(t, listener.Listen(h.ctx,
+		"agentpg_run_created",
+		"agentpg_run_state",
+		"agentpg_run_finalized",
+		"agentpg_tool_pending",
+		"agentpg_tools_complete",
+	))
+	notifications := listener.Notifications()
+
+	h.instance("worker", "search")
+	session := h.session(nil)
+	agent := h.agent("agent", "search")
+	run := h.run(session.ID, agent.ID, "batch")
+	payload := waitFor(t, notifications, "agentpg_run_created", "run_id", run.ID.String())
+	if payload["session_id"] != session.ID.String() || payload["agent_id"] != agent.ID.String() || payload["run_mode"] != "batch" {
+		t.Fatalf("agentpg_run_created: got payload %v", payload)
+	}
+
+	iter := h.iteration(run.ID, 1)
+	check(t, h.store.UpdateRunState(h.ctx, run.ID, "pending_tools", map[string]any{"current_iteration_id": iter.ID}))
+	payload = waitFor(t, notifications, "agentpg_run_state", "run_id", run.ID.String())
+	if payload["state"] != "pending_tools" || payload["previous_state"] != "pending" {
+		t.Fatalf("agentpg_run_state: got payload %v", payload)
+	}
+
+	exec := h.toolExecution(run.ID, iter.ID, "search")
+	payload = waitFor(t, notifications, "agentpg_tool_pending", "execution_id", exec.ID.String())
+	if payload["run_id"] != run.ID.String() || payload["tool_name"] != "search" || payload["is_agent_tool"] != false {
+		t.Fatalf("agentpg_tool_pending: got payload %v", payload)
+	}
+
+	must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	check(t, h.store.CompleteToolExecution(h.ctx, exec.ID, "done", false, ""))
+	waitFor(t, notifications, "agentpg_tools_complete", "run_id", run.ID.String())
+
+	check(t, h.store.UpdateRunState(h.ctx, run.ID, "completed", map[string]any{"finalized_at": time.Now()}))
+	payload = waitFor(t, notifications, "agentpg_run_finalized", "run_id", run.ID.String())
+	if payload["state"] != "completed" || payload["session_id"] != session.ID.String() {
+		t.Fatalf("agentpg_run_finalized: got payload %v", payload)
+	}
+
+	// Notifications from a transaction are delivered on commit
+	tx := must(h.drv.BeginTx(h.ctx))(t)
+	txRun := must(h.store.CreateRunTx(h.ctx, tx, driver.CreateRunParams{SessionID: session.ID, AgentID: agent.ID, Prompt: "Hello"}))(t)
+	expectNone(t, notifications, "agentpg_run_created", "run_id", txRun.ID.String(), 100*time.Millisecond)
+	check(t, h.drv.CommitTx(h.ctx, tx))
+	waitFor(t, notifications, "agentpg_run_created", "run_id", txRun.ID.String())
+
+	// Rolled back transactions never notify
+	tx = must(h.drv.BeginTx(h.ctx))(t)
+	rolledBack := must(h.store.CreateRunTx(h.ctx, tx, driver.CreateRunParams{SessionID: session.ID, AgentID: agent.ID, Prompt: "Hello"}))(t)
+	check(t, h.drv.RollbackTx(h.ctx, tx))
+	expectNone(t, notifications, "agentpg_run_created", "run_id", rolledBack.ID.String(), 100*time.Millisecond)
+}
+
+// waitFor reads notifications until one on channel has key set to value,
+// failing the test after notificationTimeout. Other notifications are dropped.
+func waitFor(t *testing.T, notifications <-chan driver.Notification, channel, key, value string) map[string]any {
+	t.Helper()
+	timeout := time.After(notificationTimeout)
+	for {
+		select {
+		case n, ok := <-notifications:
+			if !ok {
+				t.Fatalf("notification channel closed while waiting for %s", channel)
+			}
+			if payload, match := matchNotification(t, n, channel, key, value); match {
+				return payload
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s with %s=%s", channel, key, value)
+		}
+	}
+}
+
+// expectNone fails the test if a matching notification arrives within wait.
+func expectNone(t *testing.T, notifications <-chan driver.Notification, channel, key, value string, wait time.Duration) {
+	t.Helper()
+	timeout := time.After(wait)
+	for {
+		select {
+		case n, ok := <-notifications:
+			if !ok {
+				return
+			}
+			if _, match := matchNotification(t, n, channel, key, value); match {
+				t.Fatalf("unexpected %s with %s=%s", channel, key, value)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func matchNotification(t *testing.T, n driver.Notification, channel, key, value string) (map[string]any, bool) {
+	t.Helper()
+	if n.Channel != channel {
+		return nil, false
+	}
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(n.Payload), &payload); err != nil {
+		t.Fatalf("invalid %s payload %q: %v", channel, n.Payload, err)
+	}
+	return payload, payload[key] == value
+}
+
+// contentionWorkers is the number of goroutines racing to claim rows.
+const contentionWorkers = 4
+
+func testClaimRunsContention[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(nil)
+	agent := h.agent("agent")
+	const total = 20
+	for range total {
+		h.run(session.ID, agent.ID, "batch")
+	}
+
+	claimed := claimConcurrently(t, total, func(instanceID string) ([]uuid.UUID, error) {
+		runs, err := h.store.ClaimRuns(h.ctx, instanceID, 3, "")
+		ids := make([]uuid.UUID, 0, len(runs))
+		for _, run := range runs {
+			if deref(run.ClaimedByInstanceID) != instanceID {
+				return nil, fmt.Errorf("run %s claimed by %q, want %q", run.ID, deref(run.ClaimedByInstanceID), instanceID)
+			}
+			ids = append(ids, run.ID)
+		}
+		return ids, err
+	}, func(id string) { h.instance(id) })
+
+	for id, instanceID := range claimed {
+		if got := h.getRun(id); deref(got.ClaimedByInstanceID) != instanceID {
+			t.Fatalf("run %s: stored claim %q, returned to %q", id, deref(got.ClaimedByInstanceID), instanceID)
+		}
+	}
+}
+
+func testClaimToolExecutionsContention[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("owner")
+	run, iter := h.runInState("owner", "pending_tools", time.Now())
+	h.tool("search")
+	const total = 20
+	for range total {
+		h.toolExecution(run.ID, iter.ID, "search")
+	}
+
+	claimed := claimConcurrently(t, total, func(instanceID string) ([]uuid.UUID, error) {
+		execs, err := h.store.ClaimToolExecutions(h.ctx, instanceID, 3)
+		ids := make([]uuid.UUID, 0, len(execs))
+		for _, exec := range execs {
+			if exec.AttemptCount != 1 {
+				return nil, fmt.Errorf("tool execution %s has attempt count %d, want 1", exec.ID, exec.AttemptCount)
+			}
+			ids = append(ids, exec.ID)
+		}
+		return ids, err
+	}, func(id string) { h.instance(id, "search") })
+
+	for id, instanceID := range claimed {
+		if got := h.getToolExecution(id); deref(got.ClaimedByInstanceID) != instanceID {
+			t.Fatalf("tool execution %s: stored claim %q, returned to %q", id, deref(got.ClaimedByInstanceID), instanceID)
+		}
+	}
+}
+
+// claimConcurrently registers contentionWorkers instances with register and
+// has each call claim in a loop until total rows are claimed. It fails the
+// test if a row is claimed twice or rows remain unclaimed, and returns the
+// instance that claimed each row.
+func claimConcurrently(t *testing.T, total int, claim func(instanceID string) ([]uuid.UUID, error), register func(instanceID string)) map[uuid.UUID]string {
+	t.Helper()
+
+	instanceIDs := make([]string, contentionWorkers)
+	for i := range instanceIDs {
+		instanceIDs[i] = fmt.Sprintf("claimer-%d", i)
+		register(instanceIDs[i])
+	}
+
+	var (
+		mu      sync.Mutex
+		claimed = make(map[uuid.UUID]string, total)
+		errs    []error
+		wg      sync.WaitGroup
+	)
+	deadline := time.Now().Add(10 * time.Second)
+	done := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(claimed) >= total || len(errs) > 0 || time.Now().After(deadline)
+	}
+
+	for _, instanceID := range instanceIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done() {
+				ids, err := claim(instanceID)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", instanceID, err))
+				}
+				for _, id := range ids {
+					if other, dup := claimed[id]; dup {
+						errs = append(errs, fmt.Errorf("row %s claimed by both %s and %s", id, other, instanceID))
+					}
+					claimed[id] = instanceID
+				}
+				mu.Unlock()
+				if len(ids) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		t.Error(err)
+	}
+	if len(claimed) != total {
+		t.Fatalf("claimed %d rows, want %d", len(claimed), total)
+	}
+	return claimed
+}
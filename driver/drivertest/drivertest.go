@@ -0,0 +1,237 @@
+// Package drivertest provides a conformance suite for driver.Driver
+// implementations.
+//
+// RunStoreSuite exercises every Store method together with the behavior the
+// PostgreSQL schema implements in functions and triggers: claiming, rescue,
+// API retry, child-run completion, tools-complete and instance cleanup. It
+// also checks notifications, the transactional variants, and that
+// ClaimRuns and ClaimToolExecutions never hand the same row to two callers.
+//
+// A driver runs the suite from its own tests, passing a factory that returns
+// a driver backed by an empty, migrated database:
+//
+//	func TestConformance(t *testing.T) {
+//	    drivertest.RunStoreSuite(t, func(t *testing.T) driver.Driver[pgx.Tx] {
+//	        return pgxv5.New(agentpgtest.NewPool(t))
+//	    })
+//	}
+//
+// The factory is called once per subtest so subtests never see each other's
+// data. Subtests do not call t.Parallel, but factories must still tolerate
+// other databases on the same server sending notifications: the suite only
+// looks at notifications about rows it created.
+package drivertest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// Factory returns a driver backed by an empty, migrated database. It should
+// register cleanup with t.Cleanup; the suite closes the driver itself.
+type Factory[TTx any] func(t *testing.T) driver.Driver[TTx]
+
+// notificationTimeout bounds how long the suite waits for a notification.
+const notificationTimeout = 5 * time.Second
+
+// RunStoreSuite runs the conformance suite against the drivers returned by newDriver.
+func RunStoreSuite[TTx any](t *testing.T, newDriver Factory[TTx]) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, h *harness[TTx])
+	}{
+		{"Sessions", testSessions[TTx]},
+		{"ForkSession", testForkSession[TTx]},
+		{"ImportSession", testImportSession[TTx]},
+		{"ImportRuns", testImportRuns[TTx]},
+		{"DeleteSession", testDeleteSession[TTx]},
+		{"Agents", testAgents[TTx]},
+		{"AgentVersions", testAgentVersions[TTx]},
+		{"Tools", testTools[TTx]},
+		{"Runs", testRuns[TTx]},
+		{"RunIdempotency", testRunIdempotency[TTx]},
+		{"ClaimRuns", testClaimRuns[TTx]},
+		{"ClaimRunsConcurrencyLimit", testClaimRunsConcurrencyLimit[TTx]},
+		{"Iterations", testIterations[TTx]},
+		{"ToolExecutions", testToolExecutions[TTx]},
+		{"ClaimToolExecutions", testClaimToolExecutions[TTx]},
+		{"ClaimToolExecutionsConcurrencyLimit", testClaimToolExecutionsConcurrencyLimit[TTx]},
+		{"ToolExecutionRetry", testToolExecutionRetry[TTx]},
+		{"CompleteToolsAndContinueRun", testCompleteToolsAndContinueRun[TTx]},
+		{"ChildRunComplete", testChildRunComplete[TTx]},
+		{"RescueAndRetry", testRescueAndRetry[TTx]},
+		{"CancelRun", testCancelRun[TTx]},
+		{"RetryFailedRun", testRetryFailedRun[TTx]},
+		{"RateLimits", testRateLimits[TTx]},
+		{"Messages", testMessages[TTx]},
+		{"Instances", testInstances[TTx]},
+		{"InstanceCleanup", testInstanceCleanup[TTx]},
+		{"Leader", testLeader[TTx]},
+		{"Compaction", testCompaction[TTx]},
+		{"ApplyCompaction", testApplyCompaction[TTx]},
+		{"RestoreCompaction", testRestoreCompaction[TTx]},
+		{"Purge", testPurge[TTx]},
+		{"Schedules", testSchedules[TTx]},
+		{"AuditLog", testAuditLog[TTx]},
+		{"Transactions", testTransactions[TTx]},
+		{"Notifications", testNotifications[TTx]},
+		{"ClaimRunsContention", testClaimRunsContention[TTx]},
+		{"ClaimToolExecutionsContention", testClaimToolExecutionsContention[TTx]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drv := newDriver(t)
+			t.Cleanup(func() { _ = drv.Close() })
+			tt.fn(t, &harness[TTx]{t: t, ctx: context.Background(), drv: drv, store: drv.Store()})
+		})
+	}
+}
+
+// harness bundles the driver under test with fixture helpers.
+type harness[TTx any] struct {
+	t     *testing.T
+	ctx   context.Context
+	drv   driver.Driver[TTx]
+	store driver.Store[TTx]
+}
+
+// must returns v, failing the test if err is not nil. It is called with a
+// call's results and then the test: must(store.GetRun(ctx, id))(t).
+func must[T any](v T, err error) func(t *testing.T) T {
+	return func(t *testing.T) T {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return v
+	}
+}
+
+// check fails the test if err is not nil.
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func (h *harness[TTx]) session(metadata map[string]any) *driver.Session {
+	h.t.Helper()
+	return must(h.store.CreateSession(h.ctx, driver.CreateSessionParams{Metadata: metadata}))(h.t)
+}
+
+func (h *harness[TTx]) agent(name string, toolNames ...string) *driver.AgentDefinition {
+	h.t.Helper()
+	return must(h.store.CreateAgent(h.ctx, &driver.AgentDefinition{
+		Name:      name,
+		Model:     "claude-test",
+		ToolNames: toolNames,
+	}))(h.t)
+}
+
+func (h *harness[TTx]) tool(name string) {
+	h.t.Helper()
+	check(h.t, h.store.UpsertTool(h.ctx, &driver.ToolDefinition{
+		Name:        name,
+		Description: "Test tool " + name,
+		InputSchema: map[string]any{"type": "object"},
+	}))
+}
+
+// instance registers an instance that has the given tools.
+func (h *harness[TTx]) instance(id string, toolNames ...string) {
+	h.t.Helper()
+	check(h.t, h.store.RegisterInstance(h.ctx, driver.RegisterInstanceParams{
+		ID:                 id,
+		Name:               id,
+		Hostname:           "localhost",
+		PID:                1,
+		Version:            "test",
+		MaxConcurrentRuns:  10,
+		MaxConcurrentTools: 10,
+	}))
+	for _, name := range toolNames {
+		h.tool(name)
+		check(h.t, h.store.RegisterInstanceTool(h.ctx, id, name))
+	}
+}
+
+func (h *harness[TTx]) run(sessionID, agentID uuid.UUID, runMode string) *driver.Run {
+	h.t.Helper()
+	return must(h.store.CreateRun(h.ctx, driver.CreateRunParams{
+		SessionID: sessionID,
+		AgentID:   agentID,
+		Prompt:    "Hello",
+		RunMode:   runMode,
+	}))(h.t)
+}
+
+func (h *harness[TTx]) getRun(id uuid.UUID) *driver.Run {
+	h.t.Helper()
+	run := must(h.store.GetRun(h.ctx, id))(h.t)
+	if run == nil {
+		h.t.Fatalf("run %s not found", id)
+	}
+	return run
+}
+
+func (h *harness[TTx]) iteration(runID uuid.UUID, number int) *driver.Iteration {
+	h.t.Helper()
+	return must(h.store.CreateIteration(h.ctx, driver.CreateIterationParams{
+		RunID:           runID,
+		IterationNumber: number,
+		TriggerType:     "user_prompt",
+	}))(h.t)
+}
+
+func (h *harness[TTx]) toolExecution(runID, iterationID uuid.UUID, toolName string) *driver.ToolExecution {
+	h.t.Helper()
+	return must(h.store.CreateToolExecution(h.ctx, driver.CreateToolExecutionParams{
+		RunID:       runID,
+		IterationID: iterationID,
+		ToolUseID:   "toolu_" + uuid.NewString(),
+		ToolName:    toolName,
+		ToolInput:   []byte(`{"q":"x"}`),
+	}))(h.t)
+}
+
+func (h *harness[TTx]) getToolExecution(id uuid.UUID) *driver.ToolExecution {
+	h.t.Helper()
+	exec := must(h.store.GetToolExecution(h.ctx, id))(h.t)
+	if exec == nil {
+		h.t.Fatalf("tool execution %s not found", id)
+	}
+	return exec
+}
+
+// runInState creates a run with an iteration, claimed by instanceID at
+// claimedAt, and moves it to state.
+func (h *harness[TTx]) runInState(instanceID string, state driver.RunState, claimedAt time.Time) (*driver.Run, *driver.Iteration) {
+	h.t.Helper()
+	session := h.session(nil)
+	agent := h.agent("agent-" + uuid.NewString())
+	run := h.run(session.ID, agent.ID, "batch")
+	iter := h.iteration(run.ID, 1)
+	check(h.t, h.store.UpdateRunState(h.ctx, run.ID, state, map[string]any{
+		"claimed_by_instance_id": instanceID,
+		"claimed_at":             claimedAt,
+		"current_iteration":      1,
+		"current_iteration_id":   iter.ID,
+	}))
+	return h.getRun(run.ID), iter
+}
+
+func deref[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
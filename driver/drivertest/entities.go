@@ -0,0 +1,1295 @@
+package drivertest
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+func testSessions[TTx any](t *testing.T, h *harness[TTx]) {
+	root := h.session(map[string]any{"tenant_id": "t1", "user_id": "u1"})
+	if root.ID == uuid.Nil || root.Depth != 0 || root.ParentSessionID != nil {
+		t.Fatalf("unexpected root session: %+v", root)
+	}
+
+	child := must(h.store.CreateSession(h.ctx, driver.CreateSessionParams{
+		ParentSessionID: &root.ID,
+		Metadata:        map[string]any{"tenant_id": "t1"},
+	}))(t)
+	if child.Depth != 1 || deref(child.ParentSessionID) != root.ID {
+		t.Fatalf("child session: got depth %d parent %v, want depth 1 parent %s", child.Depth, child.ParentSessionID, root.ID)
+	}
+	h.session(map[string]any{"tenant_id": "t2"})
+
+	got := must(h.store.GetSession(h.ctx, root.ID))(t)
+	if got == nil || got.Metadata["user_id"] != "u1" {
+		t.Fatalf("GetSession: got %+v", got)
+	}
+	if missing := must(h.store.GetSession(h.ctx, uuid.New()))(t); missing != nil {
+		t.Fatalf("GetSession of unknown ID: got %+v, want nil", missing)
+	}
+
+	check(t, h.store.UpdateSession(h.ctx, root.ID, map[string]any{
+		"metadata":         map[string]any{"tenant_id": "t1", "user_id": "u2"},
+		"compaction_count": 3,
+	}))
+	got = must(h.store.GetSession(h.ctx, root.ID))(t)
+	if got.Metadata["user_id"] != "u2" || got.CompactionCount != 3 {
+		t.Fatalf("UpdateSession: got metadata %v compaction count %d", got.Metadata, got.CompactionCount)
+	}
+	if got.UpdatedAt.Before(root.UpdatedAt) {
+		t.Fatalf("UpdateSession: updated_at moved backwards")
+	}
+
+	sessions, total := must2(h.store.ListSessions(h.ctx, driver.ListSessionsParams{
+		MetadataFilter: map[string]any{"tenant_id": "t1"},
+	}))(t)
+	if total != 2 || len(sessions) != 2 {
+		t.Fatalf("ListSessions by tenant: got %d sessions, total %d, want 2", len(sessions), total)
+	}
+	sessions, total = must2(h.store.ListSessions(h.ctx, driver.ListSessionsParams{Limit: 1, OrderDir: "asc"}))(t)
+	if total != 3 || len(sessions) != 1 || sessions[0].ID != root.ID {
+		t.Fatalf("ListSessions with limit 1 ascending: got %d sessions, total %d", len(sessions), total)
+	}
+	sessions, _ = must2(h.store.ListSessions(h.ctx, driver.ListSessionsParams{Limit: 10, Offset: 2, OrderDir: "asc"}))(t)
+	if len(sessions) != 1 {
+		t.Fatalf("ListSessions with offset 2: got %d sessions, want 1", len(sessions))
+	}
+
+	values := must(h.store.GetMetadataValues(h.ctx, "tenant_id"))(t)
+	want := []driver.MetadataValue{{Value: "t1", SessionCount: 2}, {Value: "t2", SessionCount: 1}}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("GetMetadataValues: got %+v, want %+v", values, want)
+	}
+}
+
+func testForkSession[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(map[string]any{"tenant_id": "t1"})
+	agent := h.agent("fork-agent")
+	root := h.run(session.ID, agent.ID, "batch")
+	child := must(h.store.CreateRun(h.ctx, driver.CreateRunParams{
+		SessionID:   session.ID,
+		AgentID:     agent.ID,
+		Prompt:      "Nested",
+		ParentRunID: &root.ID,
+		Depth:       1,
+	}))(t)
+
+	message := func(runID *uuid.UUID, role string, blocks ...driver.ContentBlock) *driver.Message {
+		t.Helper()
+		return must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+			SessionID: session.ID,
+			RunID:     runID,
+			Role:      role,
+			Content:   blocks,
+			Usage:     driver.Usage{InputTokens: 10, OutputTokens: 5},
+			Metadata:  map[string]any{"role": role},
+		}))(t)
+	}
+	prompt := message(&root.ID, "user", driver.ContentBlock{Type: "text", Text: "Weather in Paris?"})
+	toolUse := message(&root.ID, "assistant",
+		driver.ContentBlock{Type: "tool_use", ToolUseID: "toolu_1", ToolName: "weather", ToolInput: []byte(`{"city":"Paris"}`)},
+	)
+	nested := message(&child.ID, "user", driver.ContentBlock{Type: "text", Text: "Nested"})
+	toolResult := message(&root.ID, "user", driver.ContentBlock{Type: "tool_result", ToolResultForUseID: "toolu_1", ToolContent: "Sunny"})
+	message(&root.ID, "assistant", driver.ContentBlock{Type: "text", Text: "It is sunny."})
+
+	fork := must(h.store.ForkSession(h.ctx, driver.ForkSessionParams{
+		SessionID:   session.ID,
+		AtMessageID: toolResult.ID,
+		Metadata:    map[string]any{"tenant_id": "t1", "branch": "b1"},
+	}))(t)
+	if deref(fork.ParentSessionID) != session.ID || deref(fork.ForkedFromMessageID) != toolResult.ID ||
+		fork.Depth != 1 || fork.Metadata["branch"] != "b1" {
+		t.Fatalf("ForkSession: got %+v", fork)
+	}
+	if got := must(h.store.GetSession(h.ctx, fork.ID))(t); deref(got.ForkedFromMessageID) != toolResult.ID {
+		t.Fatalf("GetSession of fork: got fork point %v, want %s", got.ForkedFromMessageID, toolResult.ID)
+	}
+
+	// Root-level messages up to the fork point are copied, detached from runs
+	original := must(h.store.GetMessages(h.ctx, session.ID, 0))(t)
+	if ids := messageIDs(original); len(ids) != 5 || ids[0] != prompt.ID || ids[1] != toolUse.ID || ids[3] != toolResult.ID {
+		t.Fatalf("ForkSession: source session messages changed: %v", ids)
+	}
+	want := []*driver.Message{original[0], original[1], original[3]}
+	got := must(h.store.GetMessages(h.ctx, fork.ID, 0))(t)
+	if len(got) != len(want) {
+		t.Fatalf("ForkSession: got %d messages, want %d", len(got), len(want))
+	}
+	for i, msg := range got {
+		if msg.ID == want[i].ID || msg.SessionID != fork.ID || msg.RunID != nil || msg.Role != want[i].Role ||
+			!msg.CreatedAt.Equal(want[i].CreatedAt) || msg.Usage != want[i].Usage ||
+			!reflect.DeepEqual(msg.Metadata, want[i].Metadata) || !reflect.DeepEqual(msg.Content, want[i].Content) {
+			t.Fatalf("ForkSession message %d: got %+v, want a copy of %+v", i, msg, want[i])
+		}
+	}
+	sessions, total := must2(h.store.ListSessions(h.ctx, driver.ListSessionsParams{ParentSessionID: &session.ID}))(t)
+	if total != 1 || len(sessions) != 1 || sessions[0].ID != fork.ID {
+		t.Fatalf("ListSessions by parent: got %d sessions, total %d, want the fork", len(sessions), total)
+	}
+
+	if _, err := h.store.ForkSession(h.ctx, driver.ForkSessionParams{SessionID: session.ID, AtMessageID: nested.ID}); !errors.Is(err, driver.ErrForkPointNotFound) {
+		t.Fatalf("ForkSession at a child run's message: got %v, want ErrForkPointNotFound", err)
+	}
+	if _, err := h.store.ForkSession(h.ctx, driver.ForkSessionParams{SessionID: fork.ID, AtMessageID: prompt.ID}); !errors.Is(err, driver.ErrForkPointNotFound) {
+		t.Fatalf("ForkSession at another session's message: got %v, want ErrForkPointNotFound", err)
+	}
+
+	// Forks can be forked again
+	forkPrompt := got[0]
+	nestedFork := must(h.store.ForkSession(h.ctx, driver.ForkSessionParams{SessionID: fork.ID, AtMessageID: forkPrompt.ID}))(t)
+	if nestedFork.Depth != 2 || len(must(h.store.GetMessages(h.ctx, nestedFork.ID, 0))(t)) != 1 {
+		t.Fatalf("ForkSession of a fork: got %+v", nestedFork)
+	}
+
+	// The fork point reference is cleared when the message is deleted
+	check(t, h.store.DeleteMessage(h.ctx, toolResult.ID))
+	if got := must(h.store.GetSession(h.ctx, fork.ID))(t); got.ForkedFromMessageID != nil {
+		t.Fatalf("DeleteMessage of fork point: got fork point %v, want nil", got.ForkedFromMessageID)
+	}
+}
+
+func testAgents[TTx any](t *testing.T, h *harness[TTx]) {
+	maxTokens := 1024
+	maxRuns := 3
+	agent := must(h.store.CreateAgent(h.ctx, &driver.AgentDefinition{
+		Name:           "researcher",
+		Description:    "Researches things",
+		Model:          "claude-test",
+		SystemPrompt:   "You research.",
+		ToolNames:      []string{"search", "fetch"},
+		MaxTokens:      &maxTokens,
+		Metadata:       map[string]any{"tenant_id": "t1"},
+		Config:         map[string]any{"thinking": true},
+		FallbackModels: []string{"claude-fallback"},
+
+		MaxConcurrentRuns: &maxRuns,
+	}))(t)
+	if agent.ID == uuid.Nil {
+		t.Fatalf("CreateAgent did not assign an ID")
+	}
+
+	got := must(h.store.GetAgent(h.ctx, agent.ID))(t)
+	if got == nil || got.Name != "researcher" || !slices.Equal(got.ToolNames, []string{"search", "fetch"}) ||
+		deref(got.MaxTokens) != 1024 || got.Config["thinking"] != true || !slices.Equal(got.FallbackModels, []string{"claude-fallback"}) ||
+		deref(got.MaxConcurrentRuns) != 3 {
+		t.Fatalf("GetAgent: got %+v", got)
+	}
+	if missing := must(h.store.GetAgent(h.ctx, uuid.New()))(t); missing != nil {
+		t.Fatalf("GetAgent of unknown ID: got %+v, want nil", missing)
+	}
+
+	// Name and metadata together are unique
+	if _, err := h.store.CreateAgent(h.ctx, &driver.AgentDefinition{
+		Name: "researcher", Model: "claude-test", Metadata: map[string]any{"tenant_id": "t1"},
+	}); err == nil {
+		t.Fatalf("CreateAgent with duplicate name and metadata: expected error")
+	}
+	other := must(h.store.CreateAgent(h.ctx, &driver.AgentDefinition{
+		Name: "researcher", Model: "claude-test", Metadata: map[string]any{"tenant_id": "t2"},
+	}))(t)
+
+	byName := must(h.store.GetAgentByName(h.ctx, "researcher", map[string]any{"tenant_id": "t2"}))(t)
+	if byName == nil || byName.ID != other.ID {
+		t.Fatalf("GetAgentByName with metadata: got %+v, want %s", byName, other.ID)
+	}
+	if byName := must(h.store.GetAgentByName(h.ctx, "researcher", nil))(t); byName == nil {
+		t.Fatalf("GetAgentByName without metadata: got nil")
+	}
+	if byName := must(h.store.GetAgentByName(h.ctx, "nobody", nil))(t); byName != nil {
+		t.Fatalf("GetAgentByName of unknown name: got %+v, want nil", byName)
+	}
+
+	got.Description = "Researches more things"
+	got.ToolNames = []string{"search"}
+	got.MaxConcurrentRuns = nil
+	check(t, h.store.UpdateAgent(h.ctx, got))
+	updated := must(h.store.GetAgent(h.ctx, agent.ID))(t)
+	if updated.Description != "Researches more things" || !slices.Equal(updated.ToolNames, []string{"search"}) || updated.MaxConcurrentRuns != nil {
+		t.Fatalf("UpdateAgent: got %+v", updated)
+	}
+
+	h.agent("writer")
+	agents, total := must2(h.store.ListAgents(h.ctx, driver.ListAgentsParams{Name: "RESEARCH"}))(t)
+	if total != 2 || len(agents) != 2 {
+		t.Fatalf("ListAgents by name: got %d agents, total %d, want 2", len(agents), total)
+	}
+	agents, total = must2(h.store.ListAgents(h.ctx, driver.ListAgentsParams{MetadataFilter: map[string]any{"tenant_id": "t1"}}))(t)
+	if total != 1 || len(agents) != 1 || agents[0].ID != agent.ID {
+		t.Fatalf("ListAgents by metadata: got %d agents, total %d, want 1", len(agents), total)
+	}
+
+	check(t, h.store.DeleteAgent(h.ctx, other.ID))
+	if deleted := must(h.store.GetAgent(h.ctx, other.ID))(t); deleted != nil {
+		t.Fatalf("DeleteAgent: agent still exists")
+	}
+}
+
+func testAgentVersions[TTx any](t *testing.T, h *harness[TTx]) {
+	agent := must(h.store.CreateAgent(h.ctx, &driver.AgentDefinition{
+		Name:         "support",
+		Model:        "claude-test",
+		SystemPrompt: "Be helpful.",
+		ToolNames:    []string{"search"},
+		Metadata:     map[string]any{"tenant_id": "t1"},
+	}))(t)
+
+	versions := must(h.store.ListAgentVersions(h.ctx, agent.ID))(t)
+	if len(versions) != 1 || versions[0].Version != 1 || versions[0].Agent.SystemPrompt != "Be helpful." {
+		t.Fatalf("ListAgentVersions after create: got %+v, want version 1", versions)
+	}
+
+	// Updates that do not change the definition are not recorded
+	check(t, h.store.UpdateAgent(h.ctx, agent))
+	if versions := must(h.store.ListAgentVersions(h.ctx, agent.ID))(t); len(versions) != 1 {
+		t.Fatalf("ListAgentVersions after no-op update: got %d versions, want 1", len(versions))
+	}
+
+	temperature := 0.5
+	agent.SystemPrompt = "Be very helpful."
+	agent.ToolNames = []string{"search", "fetch"}
+	agent.Temperature = &temperature
+	check(t, h.store.UpdateAgent(h.ctx, agent))
+
+	versions = must(h.store.ListAgentVersions(h.ctx, agent.ID))(t)
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 1 {
+		t.Fatalf("ListAgentVersions after update: got %+v, want versions 2 and 1", versions)
+	}
+	latest := versions[0].Agent
+	if latest.ID != agent.ID || latest.SystemPrompt != "Be very helpful." || !slices.Equal(latest.ToolNames, []string{"search", "fetch"}) ||
+		deref(latest.Temperature) != 0.5 || latest.Metadata["tenant_id"] != "t1" {
+		t.Fatalf("ListAgentVersions: latest version is %+v", latest)
+	}
+
+	first := must(h.store.GetAgentVersion(h.ctx, agent.ID, 1))(t)
+	if first == nil || first.Agent.SystemPrompt != "Be helpful." || !slices.Equal(first.Agent.ToolNames, []string{"search"}) || first.Agent.Temperature != nil {
+		t.Fatalf("GetAgentVersion 1: got %+v", first)
+	}
+	if missing := must(h.store.GetAgentVersion(h.ctx, agent.ID, 3))(t); missing != nil {
+		t.Fatalf("GetAgentVersion of unknown version: got %+v, want nil", missing)
+	}
+
+	check(t, h.store.DeleteAgent(h.ctx, agent.ID))
+	if versions := must(h.store.ListAgentVersions(h.ctx, agent.ID))(t); len(versions) != 0 {
+		t.Fatalf("ListAgentVersions after delete: got %d versions, want 0", len(versions))
+	}
+}
+
+func testTools[TTx any](t *testing.T, h *harness[TTx]) {
+	h.tool("search")
+	h.tool("fetch")
+
+	got := must(h.store.GetTool(h.ctx, "search"))(t)
+	if got == nil || got.Description != "Test tool search" || got.InputSchema["type"] != "object" {
+		t.Fatalf("GetTool: got %+v", got)
+	}
+	if missing := must(h.store.GetTool(h.ctx, "missing"))(t); missing != nil {
+		t.Fatalf("GetTool of unknown name: got %+v, want nil", missing)
+	}
+
+	maxConcurrency := 2
+	check(t, h.store.UpsertTool(h.ctx, &driver.ToolDefinition{
+		Name:           "search",
+		Description:    "Search the web",
+		InputSchema:    map[string]any{"type": "object"},
+		MaxConcurrency: &maxConcurrency,
+	}))
+	updated := must(h.store.GetTool(h.ctx, "search"))(t)
+	if updated.Description != "Search the web" || !updated.CreatedAt.Equal(got.CreatedAt) || deref(updated.MaxConcurrency) != 2 {
+		t.Fatalf("UpsertTool update: got %+v", updated)
+	}
+
+	// Agent tools reference their agent
+	agent := h.agent("helper")
+	check(t, h.store.UpsertTool(h.ctx, &driver.ToolDefinition{
+		Name:        "helper",
+		Description: "Delegates to helper",
+		InputSchema: map[string]any{"type": "object"},
+		IsAgentTool: true,
+		AgentID:     &agent.ID,
+	}))
+	agentTool := must(h.store.GetTool(h.ctx, "helper"))(t)
+	if !agentTool.IsAgentTool || deref(agentTool.AgentID) != agent.ID {
+		t.Fatalf("UpsertTool agent tool: got %+v", agentTool)
+	}
+
+	tools := must(h.store.ListTools(h.ctx))(t)
+	var names []string
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+	}
+	if !slices.Equal(names, []string{"fetch", "helper", "search"}) {
+		t.Fatalf("ListTools: got %v, want sorted by name", names)
+	}
+
+	check(t, h.store.DeleteTool(h.ctx, "fetch"))
+	if deleted := must(h.store.GetTool(h.ctx, "fetch"))(t); deleted != nil {
+		t.Fatalf("DeleteTool: tool still exists")
+	}
+
+	// Deleting an agent cascades to its agent tool
+	check(t, h.store.DeleteAgent(h.ctx, agent.ID))
+	if deleted := must(h.store.GetTool(h.ctx, "helper"))(t); deleted != nil {
+		t.Fatalf("DeleteAgent: agent tool still exists")
+	}
+}
+
+func testMessages[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(nil)
+	agent := h.agent("agent")
+	root := h.run(session.ID, agent.ID, "batch")
+
+	user := must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+		SessionID: session.ID,
+		RunID:     &root.ID,
+		Role:      "user",
+		Content:   []driver.ContentBlock{{Type: "text", Text: "What is the weather?"}},
+	}))(t)
+	assistant := must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+		SessionID: session.ID,
+		RunID:     &root.ID,
+		Role:      "assistant",
+		Content: []driver.ContentBlock{
+			{Type: "text", Text: "Let me check."},
+			{Type: "tool_use", ToolUseID: "toolu_1", ToolName: "weather", ToolInput: []byte(`{"city":"Paris"}`)},
+		},
+		Usage: driver.Usage{InputTokens: 10, OutputTokens: 5},
+	}))(t)
+
+	got := must(h.store.GetMessage(h.ctx, assistant.ID))(t)
+	if got == nil || got.Role != "assistant" || got.Usage.OutputTokens != 5 || len(got.Content) != 2 {
+		t.Fatalf("GetMessage: got %+v", got)
+	}
+	block := got.Content[1]
+	if block.Type != "tool_use" || block.ToolUseID != "toolu_1" || block.ToolName != "weather" || !jsonEqual(block.ToolInput, []byte(`{"city":"Paris"}`)) {
+		t.Fatalf("GetMessage tool_use block: got %+v", block)
+	}
+	if missing := must(h.store.GetMessage(h.ctx, uuid.New()))(t); missing != nil {
+		t.Fatalf("GetMessage of unknown ID: got %+v, want nil", missing)
+	}
+
+	// A child run's messages are kept out of the root run's context
+	child := must(h.store.CreateRun(h.ctx, driver.CreateRunParams{
+		SessionID:   session.ID,
+		AgentID:     agent.ID,
+		Prompt:      "Nested",
+		ParentRunID: &root.ID,
+		Depth:       1,
+	}))(t)
+	childMsg := must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+		SessionID: session.ID,
+		RunID:     &child.ID,
+		Role:      "user",
+		Content:   []driver.ContentBlock{{Type: "text", Text: "Nested"}},
+	}))(t)
+
+	msgs := must(h.store.GetMessages(h.ctx, session.ID, 0))(t)
+	if ids := messageIDs(msgs); !reflect.DeepEqual(ids, []uuid.UUID{user.ID, assistant.ID, childMsg.ID}) {
+		t.Fatalf("GetMessages: got %v, want in creation order", ids)
+	}
+	if msgs := must(h.store.GetMessages(h.ctx, session.ID, 1))(t); len(msgs) != 1 || msgs[0].ID != user.ID {
+		t.Fatalf("GetMessages with limit 1: got %v", messageIDs(msgs))
+	}
+	if ids := messageIDs(must(h.store.GetMessagesByRun(h.ctx, child.ID))(t)); !reflect.DeepEqual(ids, []uuid.UUID{childMsg.ID}) {
+		t.Fatalf("GetMessagesByRun: got %v", ids)
+	}
+	if ids := messageIDs(must(h.store.GetMessagesForRunContext(h.ctx, root.ID))(t)); !reflect.DeepEqual(ids, []uuid.UUID{user.ID, assistant.ID}) {
+		t.Fatalf("GetMessagesForRunContext of root run: got %v", ids)
+	}
+	if ids := messageIDs(must(h.store.GetMessagesForRunContext(h.ctx, child.ID))(t)); !reflect.DeepEqual(ids, []uuid.UUID{childMsg.ID}) {
+		t.Fatalf("GetMessagesForRunContext of child run: got %v", ids)
+	}
+	if ids := messageIDs(must(h.store.GetSessionContext(h.ctx, session.ID))(t)); !reflect.DeepEqual(ids, []uuid.UUID{user.ID, assistant.ID}) {
+		t.Fatalf("GetSessionContext: got %v", ids)
+	}
+
+	withInfo := must(h.store.GetMessagesWithRunInfo(h.ctx, session.ID, 0))(t)
+	if len(withInfo) != 3 {
+		t.Fatalf("GetMessagesWithRunInfo: got %d messages, want 3", len(withInfo))
+	}
+	last := withInfo[2]
+	if last.ID != childMsg.ID || deref(last.RunDepth) != 1 || deref(last.ParentRunID) != root.ID || deref(last.RunAgentID) != agent.ID {
+		t.Fatalf("GetMessagesWithRunInfo run info: got %+v", last)
+	}
+
+	check(t, h.store.UpdateMessage(h.ctx, user.ID, map[string]any{"is_preserved": true}))
+	if got := must(h.store.GetMessage(h.ctx, user.ID))(t); !got.IsPreserved {
+		t.Fatalf("UpdateMessage: is_preserved not set")
+	}
+
+	// Content blocks can be attached to a message created without any
+	bare := must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{SessionID: session.ID, Role: "user"}))(t)
+	check(t, h.store.CreateContentBlocks(h.ctx, bare.ID, []driver.ContentBlock{
+		{Type: "tool_result", ToolResultForUseID: "toolu_1", ToolContent: "Sunny", IsError: false},
+	}))
+	blocks := must(h.store.GetContentBlocks(h.ctx, bare.ID))(t)
+	if len(blocks) != 1 || blocks[0].ToolResultForUseID != "toolu_1" || blocks[0].ToolContent != "Sunny" {
+		t.Fatalf("GetContentBlocks: got %+v", blocks)
+	}
+
+	check(t, h.store.DeleteMessage(h.ctx, bare.ID))
+	if deleted := must(h.store.GetMessage(h.ctx, bare.ID))(t); deleted != nil {
+		t.Fatalf("DeleteMessage: message still exists")
+	}
+}
+
+func testImportSession[TTx any](t *testing.T, h *harness[TTx]) {
+	parentAgent := h.agent("import-parent")
+	childAgent := h.agent("import-child")
+	at := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	ts := func(minutes int) *time.Time {
+		v := at.Add(time.Duration(minutes) * time.Minute)
+		return &v
+	}
+	str := func(s string) *string { return &s }
+
+	session := &driver.Session{
+		ID:              uuid.New(),
+		Metadata:        map[string]any{"tenant_id": "t1"},
+		CompactionCount: 1,
+		CreatedAt:       at,
+		UpdatedAt:       *ts(10),
+	}
+	root := &driver.Run{
+		ID:               uuid.New(),
+		SessionID:        session.ID,
+		AgentID:          parentAgent.ID,
+		RunMode:          "batch",
+		State:            "completed",
+		PreviousState:    str("pending_tools"),
+		Prompt:           "Delegate",
+		CurrentIteration: 2,
+		ResponseText:     str("Done"),
+		StopReason:       str("end_turn"),
+		InputTokens:      100,
+		OutputTokens:     20,
+		IterationCount:   2,
+		ToolIterations:   1,
+		Metadata:         map[string]any{"k": "v"},
+		CreatedAt:        at,
+		StartedAt:        ts(1),
+		FinalizedAt:      ts(9),
+		ScheduledAt:      at,
+	}
+	child := &driver.Run{
+		ID:               uuid.New(),
+		SessionID:        session.ID,
+		AgentID:          childAgent.ID,
+		RunMode:          "batch",
+		ParentRunID:      &root.ID,
+		Depth:            1,
+		State:            "completed",
+		Prompt:           "Work",
+		CurrentIteration: 1,
+		ResponseText:     str("Worked"),
+		IterationCount:   1,
+		CreatedAt:        *ts(3),
+		StartedAt:        ts(3),
+		FinalizedAt:      ts(5),
+		ScheduledAt:      *ts(3),
+	}
+	prompt := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		RunID:     &root.ID,
+		Role:      "user",
+		Content:   []driver.ContentBlock{{Type: "text", Text: "Delegate"}},
+		Metadata:  map[string]any{"n": float64(1)},
+		CreatedAt: at,
+		UpdatedAt: at,
+	}
+	toolUse := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		RunID:     &root.ID,
+		Role:      "assistant",
+		Content:   []driver.ContentBlock{{Type: "tool_use", ToolUseID: "toolu_1", ToolName: "import-child", ToolInput: []byte(`{"task":"work"}`)}},
+		Usage:     driver.Usage{InputTokens: 50, OutputTokens: 10},
+		CreatedAt: *ts(2),
+		UpdatedAt: *ts(2),
+	}
+	summary := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		Role:      "assistant",
+		IsSummary: true,
+		Content:   []driver.ContentBlock{{Type: "text", Text: "Summary"}},
+		CreatedAt: *ts(8),
+		UpdatedAt: *ts(8),
+	}
+	first := &driver.Iteration{
+		ID:                 uuid.New(),
+		RunID:              root.ID,
+		IterationNumber:    1,
+		TriggerType:        "user_prompt",
+		BatchID:            str("batch_1"),
+		BatchStatus:        str("ended"),
+		RequestMessageIDs:  []uuid.UUID{prompt.ID},
+		StopReason:         str("tool_use"),
+		ResponseMessageID:  &toolUse.ID,
+		HasToolUse:         true,
+		ToolExecutionCount: 1,
+		InputTokens:        50,
+		OutputTokens:       10,
+		CreatedAt:          *ts(1),
+		CompletedAt:        ts(2),
+		APIAttempts:        []driver.APIAttempt{{Attempt: 1, ErrorType: "overloaded_error", StatusCode: 529, Message: "Overloaded", Retryable: true, CreatedAt: *ts(1)}},
+		Model:              str("claude-test"),
+	}
+	second := &driver.Iteration{
+		ID:              uuid.New(),
+		RunID:           root.ID,
+		IterationNumber: 2,
+		TriggerType:     "tool_results",
+		CreatedAt:       *ts(6),
+		CompletedAt:     ts(7),
+	}
+	childIter := &driver.Iteration{
+		ID:              uuid.New(),
+		RunID:           child.ID,
+		IterationNumber: 1,
+		TriggerType:     "user_prompt",
+		CreatedAt:       *ts(3),
+		CompletedAt:     ts(4),
+	}
+	root.CurrentIterationID = &second.ID
+	child.CurrentIterationID = &childIter.ID
+	exec := &driver.ToolExecution{
+		ID:           uuid.New(),
+		RunID:        root.ID,
+		IterationID:  first.ID,
+		State:        "completed",
+		ToolUseID:    "toolu_1",
+		ToolName:     "import-child",
+		ToolInput:    []byte(`{"task":"work"}`),
+		IsAgentTool:  true,
+		AgentID:      &childAgent.ID,
+		ChildRunID:   &child.ID,
+		ToolOutput:   str("Worked"),
+		AttemptCount: 1,
+		MaxAttempts:  2,
+		ScheduledAt:  *ts(2),
+		CreatedAt:    *ts(2),
+		StartedAt:    ts(3),
+		CompletedAt:  ts(5),
+	}
+	child.ParentToolExecutionID = &exec.ID
+	event := &driver.CompactionEvent{
+		ID:                  uuid.New(),
+		SessionID:           session.ID,
+		Strategy:            "summarization",
+		OriginalTokens:      1000,
+		CompactedTokens:     100,
+		MessagesRemoved:     1,
+		SummaryContent:      str("Summary"),
+		PreservedMessageIDs: []uuid.UUID{prompt.ID},
+		SummaryMessageID:    &summary.ID,
+		CreatedAt:           *ts(8),
+	}
+	archived := &driver.ArchivedMessage{
+		ID:                uuid.New(),
+		CompactionEventID: &event.ID,
+		SessionID:         session.ID,
+		OriginalMessage:   map[string]any{"Role": "assistant", "IsSummary": false},
+		ArchivedAt:        *ts(8),
+	}
+
+	params := driver.ImportSessionParams{
+		Session:          session,
+		Runs:             []*driver.Run{root, child},
+		Messages:         []*driver.Message{prompt, toolUse, summary},
+		Iterations:       []*driver.Iteration{first, second, childIter},
+		ToolExecutions:   []*driver.ToolExecution{exec},
+		CompactionEvents: []*driver.CompactionEvent{event},
+		ArchivedMessages: []*driver.ArchivedMessage{archived},
+	}
+	check(t, h.store.ImportSession(h.ctx, params))
+
+	if got := must(h.store.GetSession(h.ctx, session.ID))(t); got == nil || got.CompactionCount != 1 ||
+		!got.CreatedAt.Equal(session.CreatedAt) || !got.UpdatedAt.Equal(session.UpdatedAt) || got.Metadata["tenant_id"] != "t1" {
+		t.Fatalf("ImportSession: got session %+v", got)
+	}
+	gotRoot := h.getRun(root.ID)
+	if gotRoot.State != "completed" || deref(gotRoot.PreviousState) != "pending_tools" || deref(gotRoot.CurrentIterationID) != second.ID ||
+		deref(gotRoot.ResponseText) != "Done" || gotRoot.IterationCount != 2 || gotRoot.InputTokens != 100 ||
+		!gotRoot.CreatedAt.Equal(at) || !deref(gotRoot.FinalizedAt).Equal(*root.FinalizedAt) || gotRoot.Metadata["k"] != "v" {
+		t.Fatalf("ImportSession: got root run %+v", gotRoot)
+	}
+	if gotChild := h.getRun(child.ID); deref(gotChild.ParentRunID) != root.ID || deref(gotChild.ParentToolExecutionID) != exec.ID ||
+		gotChild.Depth != 1 || gotChild.AgentID != childAgent.ID {
+		t.Fatalf("ImportSession: got child run %+v", gotChild)
+	}
+
+	iters := must(h.store.GetIterationsByRun(h.ctx, root.ID))(t)
+	if len(iters) != 2 || iters[0].ID != first.ID || iters[1].ID != second.ID {
+		t.Fatalf("ImportSession: got %d iterations of the root run", len(iters))
+	}
+	if got := iters[0]; deref(got.BatchID) != "batch_1" || deref(got.BatchStatus) != "ended" ||
+		!slices.Equal(got.RequestMessageIDs, first.RequestMessageIDs) || deref(got.ResponseMessageID) != toolUse.ID ||
+		!got.HasToolUse || len(got.APIAttempts) != 1 || got.APIAttempts[0].StatusCode != 529 || deref(got.Model) != "claude-test" {
+		t.Fatalf("ImportSession: got iteration %+v", got)
+	}
+
+	gotExec := h.getToolExecution(exec.ID)
+	if gotExec.State != "completed" || deref(gotExec.ChildRunID) != child.ID || deref(gotExec.AgentID) != childAgent.ID ||
+		deref(gotExec.ToolOutput) != "Worked" || !jsonEqual(gotExec.ToolInput, exec.ToolInput) || gotExec.AttemptCount != 1 {
+		t.Fatalf("ImportSession: got tool execution %+v", gotExec)
+	}
+
+	msgs := must(h.store.GetMessages(h.ctx, session.ID, 0))(t)
+	if !slices.Equal(messageIDs(msgs), []uuid.UUID{prompt.ID, toolUse.ID, summary.ID}) {
+		t.Fatalf("ImportSession: got messages %v", messageIDs(msgs))
+	}
+	if got := msgs[1]; deref(got.RunID) != root.ID || !got.CreatedAt.Equal(toolUse.CreatedAt) || got.Usage != toolUse.Usage ||
+		len(got.Content) != 1 || got.Content[0].ToolUseID != "toolu_1" || !jsonEqual(got.Content[0].ToolInput, toolUse.Content[0].ToolInput) {
+		t.Fatalf("ImportSession: got message %+v", got)
+	}
+
+	events := must(h.store.GetCompactionEvents(h.ctx, session.ID, 10))(t)
+	if len(events) != 1 || events[0].ID != event.ID || deref(events[0].SummaryMessageID) != summary.ID ||
+		!slices.Equal(events[0].PreservedMessageIDs, event.PreservedMessageIDs) || !events[0].CreatedAt.Equal(event.CreatedAt) {
+		t.Fatalf("ImportSession: got compaction events %+v", events)
+	}
+	gotArchive := must(h.store.GetArchivedMessages(h.ctx, session.ID))(t)
+	if len(gotArchive) != 1 || gotArchive[0].ID != archived.ID || deref(gotArchive[0].CompactionEventID) != event.ID ||
+		!gotArchive[0].ArchivedAt.Equal(archived.ArchivedAt) || !reflect.DeepEqual(gotArchive[0].OriginalMessage, archived.OriginalMessage) {
+		t.Fatalf("ImportSession: got archived messages %+v", gotArchive)
+	}
+
+	// A failed import leaves nothing behind
+	params.Session = &driver.Session{ID: uuid.New(), CreatedAt: at, UpdatedAt: at}
+	if err := h.store.ImportSession(h.ctx, params); err == nil {
+		t.Fatal("ImportSession with existing row IDs: got nil error")
+	}
+	if got := must(h.store.GetSession(h.ctx, params.Session.ID))(t); got != nil {
+		t.Fatalf("ImportSession: session of failed import exists: %+v", got)
+	}
+}
+
+func testImportRuns[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(nil)
+	agent := h.agent("import-run")
+	at := time.Now().UTC().Truncate(time.Second)
+	ts := func(seconds int) *time.Time {
+		v := at.Add(time.Duration(seconds) * time.Second)
+		return &v
+	}
+	str := func(s string) *string { return &s }
+
+	run := &driver.Run{
+		ID:               uuid.New(),
+		SessionID:        session.ID,
+		AgentID:          agent.ID,
+		RunMode:          "streaming",
+		State:            "completed",
+		Prompt:           "Weather?",
+		CurrentIteration: 2,
+		ResponseText:     str("Sunny"),
+		StopReason:       str("end_turn"),
+		InputTokens:      30,
+		OutputTokens:     6,
+		IterationCount:   2,
+		ToolIterations:   1,
+		CreatedAt:        at,
+		StartedAt:        &at,
+		FinalizedAt:      ts(3),
+		ScheduledAt:      at,
+	}
+	prompt := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		RunID:     &run.ID,
+		Role:      "user",
+		Content:   []driver.ContentBlock{{Type: "text", Text: "Weather?"}},
+		CreatedAt: at,
+		UpdatedAt: at,
+	}
+	toolUse := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		RunID:     &run.ID,
+		Role:      "assistant",
+		Content:   []driver.ContentBlock{{Type: "tool_use", ToolUseID: "toolu_1", ToolName: "weather", ToolInput: []byte(`{}`)}},
+		CreatedAt: *ts(1),
+		UpdatedAt: *ts(1),
+	}
+	toolResult := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		RunID:     &run.ID,
+		Role:      "user",
+		Content:   []driver.ContentBlock{{Type: "tool_result", ToolResultForUseID: "toolu_1", ToolContent: "Sunny"}},
+		CreatedAt: *ts(2),
+		UpdatedAt: *ts(2),
+	}
+	answer := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		RunID:     &run.ID,
+		Role:      "assistant",
+		Content:   []driver.ContentBlock{{Type: "text", Text: "Sunny"}},
+		CreatedAt: *ts(3),
+		UpdatedAt: *ts(3),
+	}
+	first := &driver.Iteration{
+		ID:                uuid.New(),
+		RunID:             run.ID,
+		IterationNumber:   1,
+		IsStreaming:       true,
+		TriggerType:       "user_prompt",
+		StopReason:        str("tool_use"),
+		ResponseMessageID: &toolUse.ID,
+		HasToolUse:        true,
+		CreatedAt:         at,
+		CompletedAt:       ts(1),
+	}
+	second := &driver.Iteration{
+		ID:                uuid.New(),
+		RunID:             run.ID,
+		IterationNumber:   2,
+		IsStreaming:       true,
+		TriggerType:       "tool_results",
+		StopReason:        str("end_turn"),
+		ResponseMessageID: &answer.ID,
+		CreatedAt:         *ts(2),
+		CompletedAt:       ts(3),
+	}
+	run.CurrentIterationID = &second.ID
+	exec := &driver.ToolExecution{
+		ID:           uuid.New(),
+		RunID:        run.ID,
+		IterationID:  first.ID,
+		State:        "completed",
+		ToolUseID:    "toolu_1",
+		ToolName:     "weather",
+		ToolInput:    []byte(`{}`),
+		ToolOutput:   str("Sunny"),
+		AttemptCount: 1,
+		MaxAttempts:  1,
+		ScheduledAt:  *ts(1),
+		CreatedAt:    *ts(1),
+		StartedAt:    ts(1),
+		CompletedAt:  ts(2),
+	}
+
+	// A delegated child run linked to an agent tool execution
+	delegate := h.agent("import-run-delegate")
+	child := &driver.Run{
+		ID:          uuid.New(),
+		SessionID:   session.ID,
+		AgentID:     delegate.ID,
+		RunMode:     "streaming",
+		ParentRunID: &run.ID,
+		Depth:       1,
+		State:       "completed",
+		Prompt:      "Forecast",
+		CreatedAt:   *ts(1),
+		ScheduledAt: *ts(1),
+	}
+	agentExec := &driver.ToolExecution{
+		ID:           uuid.New(),
+		RunID:        run.ID,
+		IterationID:  first.ID,
+		State:        "completed",
+		ToolUseID:    "toolu_2",
+		ToolName:     delegate.Name,
+		ToolInput:    []byte(`{"task":"Forecast"}`),
+		IsAgentTool:  true,
+		AgentID:      &delegate.ID,
+		ChildRunID:   &child.ID,
+		AttemptCount: 1,
+		MaxAttempts:  1,
+		ScheduledAt:  *ts(1),
+		CreatedAt:    *ts(1),
+	}
+	child.ParentToolExecutionID = &agentExec.ID
+	childMsg := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: session.ID,
+		RunID:     &child.ID,
+		Role:      "user",
+		Content:   []driver.ContentBlock{{Type: "text", Text: "Forecast"}},
+		CreatedAt: *ts(1),
+		UpdatedAt: *ts(1),
+	}
+
+	params := driver.ImportRunsParams{
+		Runs:           []*driver.Run{run, child},
+		Messages:       []*driver.Message{prompt, toolUse, childMsg, toolResult, answer},
+		Iterations:     []*driver.Iteration{first, second},
+		ToolExecutions: []*driver.ToolExecution{exec, agentExec},
+	}
+	check(t, h.store.ImportRuns(h.ctx, params))
+
+	if got := h.getRun(run.ID); got.State != "completed" || deref(got.CurrentIterationID) != second.ID ||
+		deref(got.ResponseText) != "Sunny" || got.IterationCount != 2 || !deref(got.FinalizedAt).Equal(*run.FinalizedAt) {
+		t.Fatalf("ImportRuns: got run %+v", got)
+	}
+	if iters := must(h.store.GetIterationsByRun(h.ctx, run.ID))(t); len(iters) != 2 || iters[0].ID != first.ID ||
+		!iters[0].IsStreaming || deref(iters[1].ResponseMessageID) != answer.ID {
+		t.Fatalf("ImportRuns: got iterations %+v", iters)
+	}
+	if got := h.getToolExecution(exec.ID); got.State != "completed" || got.IterationID != first.ID || deref(got.ToolOutput) != "Sunny" {
+		t.Fatalf("ImportRuns: got tool execution %+v", got)
+	}
+	if got := h.getRun(child.ID); deref(got.ParentRunID) != run.ID || deref(got.ParentToolExecutionID) != agentExec.ID || got.Depth != 1 {
+		t.Fatalf("ImportRuns: got child run %+v", got)
+	}
+	if got := h.getToolExecution(agentExec.ID); deref(got.ChildRunID) != child.ID {
+		t.Fatalf("ImportRuns: got agent tool execution %+v", got)
+	}
+	msgs := must(h.store.GetSessionContext(h.ctx, session.ID))(t)
+	if !slices.Equal(messageIDs(msgs), []uuid.UUID{prompt.ID, toolUse.ID, toolResult.ID, answer.ID}) {
+		t.Fatalf("ImportRuns: got messages %v", messageIDs(msgs))
+	}
+	if got := msgs[2]; len(got.Content) != 1 || got.Content[0].ToolResultForUseID != "toolu_1" || got.Content[0].ToolContent != "Sunny" {
+		t.Fatalf("ImportRuns: got tool result message %+v", got)
+	}
+
+	// A failed import leaves nothing behind
+	params.Runs = []*driver.Run{{ID: uuid.New(), SessionID: session.ID, AgentID: agent.ID, RunMode: "streaming",
+		State: "completed", CreatedAt: at, ScheduledAt: at}}
+	if err := h.store.ImportRuns(h.ctx, params); err == nil {
+		t.Fatal("ImportRuns with existing row IDs: got nil error")
+	}
+	if got := must(h.store.GetRun(h.ctx, params.Runs[0].ID))(t); got != nil {
+		t.Fatalf("ImportRuns: run of failed import exists: %+v", got)
+	}
+}
+
+func testCompaction[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(nil)
+	msg := must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+		SessionID: session.ID,
+		Role:      "user",
+		Content:   []driver.ContentBlock{{Type: "text", Text: "Old message"}},
+	}))(t)
+
+	summary := "Summary"
+	model := "claude-test"
+	duration := int64(1500)
+	event := must(h.store.CreateCompactionEvent(h.ctx, driver.CreateCompactionEventParams{
+		SessionID:           session.ID,
+		Strategy:            "hybrid",
+		OriginalTokens:      1000,
+		CompactedTokens:     250,
+		MessagesRemoved:     4,
+		SummaryContent:      &summary,
+		PreservedMessageIDs: []uuid.UUID{msg.ID},
+		ModelUsed:           &model,
+		DurationMS:          &duration,
+	}))(t)
+	if event.ID == uuid.Nil || event.Strategy != "hybrid" || deref(event.DurationMS) != 1500 {
+		t.Fatalf("CreateCompactionEvent: got %+v", event)
+	}
+	must(h.store.CreateCompactionEvent(h.ctx, driver.CreateCompactionEventParams{
+		SessionID:       session.ID,
+		Strategy:        "summarization",
+		OriginalTokens:  400,
+		CompactedTokens: 200,
+		MessagesRemoved: 2,
+	}))(t)
+
+	check(t, h.store.ArchiveMessage(h.ctx, event.ID, msg.ID, session.ID, map[string]any{
+		"role":    "user",
+		"content": []any{map[string]any{"type": "text", "text": "Old message"}},
+	}))
+
+	events := must(h.store.GetCompactionEvents(h.ctx, session.ID, 10))(t)
+	if len(events) != 2 || events[0].Strategy != "summarization" || events[1].ID != event.ID {
+		t.Fatalf("GetCompactionEvents: got %d events, want newest first", len(events))
+	}
+	if len(events[1].PreservedMessageIDs) != 1 || events[1].PreservedMessageIDs[0] != msg.ID || deref(events[1].SummaryContent) != summary {
+		t.Fatalf("GetCompactionEvents: got %+v", events[1])
+	}
+	if events := must(h.store.GetCompactionEvents(h.ctx, session.ID, 1))(t); len(events) != 1 {
+		t.Fatalf("GetCompactionEvents with limit 1: got %d events", len(events))
+	}
+
+	stats := must(h.store.GetCompactionStats(h.ctx))(t)
+	if stats.TotalCompactions != 2 || stats.TotalTokensSaved != 950 || stats.TotalMessagesArchived != 6 {
+		t.Fatalf("GetCompactionStats: got %+v", stats)
+	}
+	if stats.AvgReductionPercent < 0.624 || stats.AvgReductionPercent > 0.626 {
+		t.Fatalf("GetCompactionStats: got average reduction %f, want 0.625", stats.AvgReductionPercent)
+	}
+}
+
+func testApplyCompaction[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(nil)
+	var msgs []*driver.Message
+	for _, text := range []string{"First", "Second", "Third"} {
+		msgs = append(msgs, must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+			SessionID: session.ID,
+			Role:      "user",
+			Content:   []driver.ContentBlock{{Type: "text", Text: text}},
+		}))(t))
+	}
+
+	summary := "Summary of First and Second"
+	event := must(h.store.ApplyCompaction(h.ctx, driver.ApplyCompactionParams{
+		Event: driver.CreateCompactionEventParams{
+			SessionID:       session.ID,
+			Strategy:        "summarization",
+			OriginalTokens:  300,
+			CompactedTokens: 100,
+			MessagesRemoved: 2,
+			SummaryContent:  &summary,
+		},
+		Messages: msgs[:2],
+		Summary:  []driver.ContentBlock{{Type: "text", Text: summary}},
+	}))(t)
+	if event.SummaryMessageID == nil || event.RestoredAt != nil || event.MessagesRemoved != 2 {
+		t.Fatalf("ApplyCompaction: got %+v", event)
+	}
+
+	remaining := must(h.store.GetMessages(h.ctx, session.ID, 0))(t)
+	if len(remaining) != 2 || !slices.Contains(messageIDs(remaining), msgs[2].ID) || !slices.Contains(messageIDs(remaining), *event.SummaryMessageID) {
+		t.Fatalf("ApplyCompaction: got messages %v, want the summary and %s", messageIDs(remaining), msgs[2].ID)
+	}
+	summaryMsg := must(h.store.GetMessage(h.ctx, *event.SummaryMessageID))(t)
+	if summaryMsg == nil || !summaryMsg.IsSummary || len(summaryMsg.Content) != 1 || summaryMsg.Content[0].Text != summary {
+		t.Fatalf("ApplyCompaction summary message: got %+v", summaryMsg)
+	}
+	if got := must(h.store.GetSession(h.ctx, session.ID))(t); got.CompactionCount != 1 {
+		t.Fatalf("ApplyCompaction: got compaction count %d, want 1", got.CompactionCount)
+	}
+	if got := must(h.store.GetCompactionEvent(h.ctx, event.ID))(t); got == nil || got.ID != event.ID || deref(got.SummaryMessageID) != *event.SummaryMessageID {
+		t.Fatalf("GetCompactionEvent: got %+v", got)
+	}
+	if got := must(h.store.GetCompactionEvent(h.ctx, uuid.New()))(t); got != nil {
+		t.Fatalf("GetCompactionEvent unknown id: got %+v, want nil", got)
+	}
+
+	// A message deleted since it was read fails the whole compaction.
+	_, err := h.store.ApplyCompaction(h.ctx, driver.ApplyCompactionParams{
+		Event:    driver.CreateCompactionEventParams{SessionID: session.ID, Strategy: "hybrid", MessagesRemoved: 2},
+		Messages: []*driver.Message{msgs[2], msgs[0]},
+	})
+	if !errors.Is(err, driver.ErrCompactionConflict) {
+		t.Fatalf("ApplyCompaction with deleted message: got %v, want ErrCompactionConflict", err)
+	}
+	if got := must(h.store.GetMessage(h.ctx, msgs[2].ID))(t); got == nil {
+		t.Fatal("ApplyCompaction conflict: message deleted, want rollback")
+	}
+	if events := must(h.store.GetCompactionEvents(h.ctx, session.ID, 10))(t); len(events) != 1 {
+		t.Fatalf("ApplyCompaction conflict: got %d events, want 1", len(events))
+	}
+
+	// A session with a run in progress is busy.
+	agent := h.agent("compaction-agent")
+	run := h.run(session.ID, agent.ID, "streaming")
+	check(t, h.store.UpdateRunState(h.ctx, run.ID, "streaming", nil))
+	_, err = h.store.ApplyCompaction(h.ctx, driver.ApplyCompactionParams{
+		Event:    driver.CreateCompactionEventParams{SessionID: session.ID, Strategy: "hybrid", MessagesRemoved: 1},
+		Messages: msgs[2:],
+	})
+	if !errors.Is(err, driver.ErrSessionBusy) {
+		t.Fatalf("ApplyCompaction with streaming run: got %v, want ErrSessionBusy", err)
+	}
+
+	// The run in progress can compact its own session.
+	must(h.store.ApplyCompaction(h.ctx, driver.ApplyCompactionParams{
+		Event:    driver.CreateCompactionEventParams{SessionID: session.ID, Strategy: "hybrid", MessagesRemoved: 1},
+		Messages: msgs[2:],
+		RunID:    &run.ID,
+	}))(t)
+	if got := must(h.store.GetMessage(h.ctx, msgs[2].ID))(t); got != nil {
+		t.Fatalf("ApplyCompaction by the running run: message %s still present", msgs[2].ID)
+	}
+}
+
+func testRestoreCompaction[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(nil)
+	agent := h.agent("restore-agent")
+	run := h.run(session.ID, agent.ID, "batch")
+	check(t, h.store.UpdateRunState(h.ctx, run.ID, "completed", nil))
+
+	var msgs []*driver.Message
+	for _, text := range []string{"First", "Second", "Third", "Fourth"} {
+		msgs = append(msgs, must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+			SessionID: session.ID,
+			RunID:     &run.ID,
+			Role:      "assistant",
+			Content:   []driver.ContentBlock{{Type: "text", Text: text}},
+			Usage:     driver.Usage{InputTokens: 10, OutputTokens: 5},
+			Metadata:  map[string]any{"n": text},
+		}))(t))
+	}
+
+	apply := func(archive []*driver.Message) *driver.CompactionEvent {
+		t.Helper()
+		return must(h.store.ApplyCompaction(h.ctx, driver.ApplyCompactionParams{
+			Event:    driver.CreateCompactionEventParams{SessionID: session.ID, Strategy: "summarization", MessagesRemoved: len(archive)},
+			Messages: archive,
+			Summary:  []driver.ContentBlock{{Type: "text", Text: "Summary"}},
+		}))(t)
+	}
+	first := apply(msgs[:2])
+	second := apply(msgs[2:3])
+
+	// Archived messages keep the original message
+	archived := must(h.store.GetArchivedMessages(h.ctx, session.ID))(t)
+	if len(archived) != 3 || archived[0].SessionID != session.ID || deref(archived[0].CompactionEventID) != first.ID ||
+		archived[0].OriginalMessage["Role"] != "assistant" {
+		t.Fatalf("GetArchivedMessages: got %+v", archived)
+	}
+
+	if _, err := h.store.RestoreCompaction(h.ctx, first.ID); !errors.Is(err, driver.ErrCompactionConflict) {
+		t.Fatalf("RestoreCompaction of older event: got %v, want ErrCompactionConflict", err)
+	}
+	if _, err := h.store.RestoreCompaction(h.ctx, uuid.New()); !errors.Is(err, driver.ErrCompactionNotFound) {
+		t.Fatalf("RestoreCompaction unknown id: got %v, want ErrCompactionNotFound", err)
+	}
+
+	restored := must(h.store.RestoreCompaction(h.ctx, second.ID))(t)
+	if restored.RestoredAt == nil || restored.SummaryMessageID != nil {
+		t.Fatalf("RestoreCompaction: got %+v", restored)
+	}
+	if _, err := h.store.RestoreCompaction(h.ctx, second.ID); !errors.Is(err, driver.ErrCompactionRestored) {
+		t.Fatalf("RestoreCompaction twice: got %v, want ErrCompactionRestored", err)
+	}
+	if got := must(h.store.GetMessage(h.ctx, *second.SummaryMessageID))(t); got != nil {
+		t.Fatalf("RestoreCompaction: summary message still present: %+v", got)
+	}
+
+	must(h.store.RestoreCompaction(h.ctx, first.ID))(t)
+	got := must(h.store.GetMessages(h.ctx, session.ID, 0))(t)
+	if !slices.Equal(messageIDs(got), messageIDs(msgs)) {
+		t.Fatalf("RestoreCompaction: got messages %v, want %v", messageIDs(got), messageIDs(msgs))
+	}
+	for i, msg := range got {
+		want := msgs[i]
+		if !msg.CreatedAt.Equal(want.CreatedAt) || deref(msg.RunID) != run.ID || msg.Role != want.Role ||
+			msg.Usage != want.Usage || !reflect.DeepEqual(msg.Metadata, want.Metadata) ||
+			len(msg.Content) != 1 || msg.Content[0].Text != want.Content[0].Text {
+			t.Fatalf("RestoreCompaction message %d: got %+v, want %+v", i, msg, want)
+		}
+	}
+	if s := must(h.store.GetSession(h.ctx, session.ID))(t); s.CompactionCount != 2 {
+		t.Fatalf("RestoreCompaction: got compaction count %d, want 2", s.CompactionCount)
+	}
+}
+
+// finalized returns the updates that move a run to a terminal state.
+func finalized() map[string]any {
+	return map[string]any{"finalized_at": time.Now()}
+}
+
+func testDeleteSession[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(map[string]any{"tenant_id": "t1"})
+	child := must(h.store.CreateSession(h.ctx, driver.CreateSessionParams{ParentSessionID: &session.ID}))(t)
+	other := h.session(nil)
+	h.tool("search")
+	agent := h.agent("delete-agent", "search")
+
+	run := h.run(session.ID, agent.ID, "batch")
+	iter := h.iteration(run.ID, 1)
+	h.toolExecution(run.ID, iter.ID, "search")
+	check(t, h.store.UpdateRunState(h.ctx, run.ID, "completed", finalized()))
+	var msgs []*driver.Message
+	for _, text := range []string{"First", "Second"} {
+		msgs = append(msgs, must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+			SessionID: session.ID,
+			RunID:     &run.ID,
+			Role:      "user",
+			Content:   []driver.ContentBlock{{Type: "text", Text: text}},
+		}))(t))
+	}
+	must(h.store.ApplyCompaction(h.ctx, driver.ApplyCompactionParams{
+		Event:    driver.CreateCompactionEventParams{SessionID: session.ID, Strategy: "summarization", MessagesRemoved: 1},
+		Messages: msgs[:1],
+		Summary:  []driver.ContentBlock{{Type: "text", Text: "Summary"}},
+	}))(t)
+	childRun := h.run(child.ID, agent.ID, "streaming")
+	check(t, h.store.UpdateRunState(h.ctx, childRun.ID, "streaming", nil))
+	otherRun := h.run(other.ID, agent.ID, "batch")
+
+	// A run in progress in a child session makes the session busy
+	if _, err := h.store.DeleteSession(h.ctx, session.ID); !errors.Is(err, driver.ErrSessionBusy) {
+		t.Fatalf("DeleteSession with streaming run: got %v, want ErrSessionBusy", err)
+	}
+	if got := must(h.store.GetSession(h.ctx, child.ID))(t); got == nil {
+		t.Fatal("DeleteSession busy: child session deleted, want rollback")
+	}
+
+	check(t, h.store.UpdateRunState(h.ctx, childRun.ID, "cancelled", finalized()))
+	counts := must(h.store.DeleteSession(h.ctx, session.ID))(t)
+	want := driver.PurgeCounts{
+		Sessions:         2,
+		Runs:             2,
+		Iterations:       1,
+		ToolExecutions:   1,
+		Messages:         2,
+		CompactionEvents: 1,
+		ArchivedMessages: 1,
+	}
+	if counts == nil || *counts != want {
+		t.Fatalf("DeleteSession: got counts %+v, want %+v", counts, want)
+	}
+	for _, id := range []uuid.UUID{session.ID, child.ID} {
+		if got := must(h.store.GetSession(h.ctx, id))(t); got != nil {
+			t.Fatalf("DeleteSession: session %s still present", id)
+		}
+	}
+	if got := must(h.store.GetRun(h.ctx, run.ID))(t); got != nil {
+		t.Fatalf("DeleteSession: run %s still present", run.ID)
+	}
+	if got := must(h.store.GetMessage(h.ctx, msgs[1].ID))(t); got != nil {
+		t.Fatalf("DeleteSession: message %s still present", msgs[1].ID)
+	}
+	if archived := must(h.store.GetArchivedMessages(h.ctx, session.ID))(t); len(archived) != 0 {
+		t.Fatalf("DeleteSession: got %d archived messages, want 0", len(archived))
+	}
+	if got := must(h.store.GetSession(h.ctx, other.ID))(t); got == nil {
+		t.Fatal("DeleteSession: unrelated session deleted")
+	}
+	h.getRun(otherRun.ID)
+
+	if counts := must(h.store.DeleteSession(h.ctx, session.ID))(t); counts != nil {
+		t.Fatalf("DeleteSession unknown id: got %+v, want nil", counts)
+	}
+}
+
+func testPurge[TTx any](t *testing.T, h *harness[TTx]) {
+	tenant := map[string]any{"tenant_id": "t1"}
+	agent := h.agent("purge-agent")
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	// A finished session with a nested run and a compaction
+	session := h.session(tenant)
+	run := h.run(session.ID, agent.ID, "batch")
+	h.iteration(run.ID, 1)
+	nested := must(h.store.CreateRun(h.ctx, driver.CreateRunParams{
+		SessionID:   session.ID,
+		AgentID:     agent.ID,
+		Prompt:      "Nested",
+		ParentRunID: &run.ID,
+		Depth:       1,
+	}))(t)
+	check(t, h.store.UpdateRunState(h.ctx, nested.ID, "completed", finalized()))
+	check(t, h.store.UpdateRunState(h.ctx, run.ID, "completed", finalized()))
+	message := func(runID uuid.UUID, text string) *driver.Message {
+		t.Helper()
+		return must(h.store.CreateMessage(h.ctx, driver.CreateMessageParams{
+			SessionID: session.ID,
+			RunID:     &runID,
+			Role:      "user",
+			Content:   []driver.ContentBlock{{Type: "text", Text: text}},
+		}))(t)
+	}
+	archived := message(run.ID, "Archived")
+	rootMsg := message(run.ID, "Root")
+	nestedMsg := message(nested.ID, "Nested")
+	event := must(h.store.ApplyCompaction(h.ctx, driver.ApplyCompactionParams{
+		Event:    driver.CreateCompactionEventParams{SessionID: session.ID, Strategy: "hybrid", MessagesRemoved: 1},
+		Messages: []*driver.Message{archived},
+	}))(t)
+
+	// A session with a run in progress, and a parent with a child session
+	busy := h.session(tenant)
+	busyRun := h.run(busy.ID, agent.ID, "streaming")
+	check(t, h.store.UpdateRunState(h.ctx, busyRun.ID, "streaming", nil))
+	parent := h.session(tenant)
+	child := must(h.store.CreateSession(h.ctx, driver.CreateSessionParams{ParentSessionID: &parent.ID, Metadata: tenant}))(t)
+
+	// Archived messages
+	if counts := must(h.store.PurgeArchivedMessages(h.ctx, driver.PurgeParams{Before: past, Limit: 10}))(t); *counts != (driver.PurgeCounts{}) {
+		t.Fatalf("PurgeArchivedMessages before creation: got %+v, want none", counts)
+	}
+	if counts := must(h.store.PurgeArchivedMessages(h.ctx, driver.PurgeParams{
+		Before:         future,
+		MetadataFilter: map[string]any{"tenant_id": "t2"},
+		Limit:          10,
+	}))(t); *counts != (driver.PurgeCounts{}) {
+		t.Fatalf("PurgeArchivedMessages other tenant: got %+v, want none", counts)
+	}
+	counts := must(h.store.PurgeArchivedMessages(h.ctx, driver.PurgeParams{Before: future, MetadataFilter: tenant, Limit: 10}))(t)
+	if *counts != (driver.PurgeCounts{ArchivedMessages: 1}) {
+		t.Fatalf("PurgeArchivedMessages: got %+v, want 1 archived message", counts)
+	}
+	if _, err := h.store.RestoreCompaction(h.ctx, event.ID); !errors.Is(err, driver.ErrArchivePurged) {
+		t.Fatalf("RestoreCompaction after purge: got %v, want ErrArchivePurged", err)
+	}
+
+	// Runs
+	if counts := must(h.store.PurgeRuns(h.ctx, driver.PurgeParams{Before: future, States: []string{"failed"}, Limit: 10}))(t); *counts != (driver.PurgeCounts{}) {
+		t.Fatalf("PurgeRuns failed runs: got %+v, want none", counts)
+	}
+	counts = must(h.store.PurgeRuns(h.ctx, driver.PurgeParams{Before: future, Limit: 10}))(t)
+	if *counts != (driver.PurgeCounts{Runs: 2, Iterations: 1, Messages: 1}) {
+		t.Fatalf("PurgeRuns: got %+v, want 2 runs, 1 iteration and 1 message", counts)
+	}
+	if got := must(h.store.GetRun(h.ctx, nested.ID))(t); got != nil {
+		t.Fatalf("PurgeRuns: nested run still present: %+v", got)
+	}
+	if got := must(h.store.GetMessage(h.ctx, nestedMsg.ID))(t); got != nil {
+		t.Fatalf("PurgeRuns: message of nested run still present: %+v", got)
+	}
+	if got := must(h.store.GetMessage(h.ctx, rootMsg.ID))(t); got == nil || got.RunID != nil {
+		t.Fatalf("PurgeRuns: got root message %+v, want it kept without run", got)
+	}
+	h.getRun(busyRun.ID)
+
+	// Sessions
+	if counts := must(h.store.PurgeSessions(h.ctx, driver.PurgeParams{Before: past, Limit: 10}))(t); *counts != (driver.PurgeCounts{}) {
+		t.Fatalf("PurgeSessions before creation: got %+v, want none", counts)
+	}
+	counts = must(h.store.PurgeSessions(h.ctx, driver.PurgeParams{Before: future, MetadataFilter: tenant, Limit: 10}))(t)
+	if counts.Sessions != 2 || counts.Messages != 1 || counts.CompactionEvents != 1 {
+		t.Fatalf("PurgeSessions: got %+v, want 2 sessions, 1 message and 1 compaction event", counts)
+	}
+	for _, id := range []uuid.UUID{session.ID, child.ID} {
+		if got := must(h.store.GetSession(h.ctx, id))(t); got != nil {
+			t.Fatalf("PurgeSessions: session %s still present", id)
+		}
+	}
+	if got := must(h.store.GetSession(h.ctx, busy.ID))(t); got == nil {
+		t.Fatal("PurgeSessions: busy session deleted")
+	}
+
+	// The parent is purged once its child is gone
+	counts = must(h.store.PurgeSessions(h.ctx, driver.PurgeParams{Before: future, Limit: 10}))(t)
+	if *counts != (driver.PurgeCounts{Sessions: 1}) {
+		t.Fatalf("PurgeSessions parent: got %+v, want 1 session", counts)
+	}
+	if got := must(h.store.GetSession(h.ctx, busy.ID))(t); got == nil {
+		t.Fatal("PurgeSessions: busy session deleted")
+	}
+}
+
+func messageIDs(msgs []*driver.Message) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+// must2 is must for calls that also return a count.
+func must2[T any](v T, n int, err error) func(t *testing.T) (T, int) {
+	return func(t *testing.T) (T, int) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return v, n
+	}
+}
+
+// jsonEqual reports whether two JSON documents are equal, ignoring formatting.
+func jsonEqual(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
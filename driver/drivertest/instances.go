@@ -0,0 +1,340 @@
+package drivertest
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+func testInstances[TTx any](t *testing.T, h *harness[TTx]) {
+	check(t, h.store.RegisterInstance(h.ctx, driver.RegisterInstanceParams{
+		ID:                 "instance-a",
+		Name:               "worker-a",
+		Hostname:           "host-a",
+		PID:                1234,
+		Version:            "1.0.0",
+		MaxConcurrentRuns:  5,
+		MaxConcurrentTools: 20,
+		Metadata:           map[string]any{"region": "eu"},
+	}))
+	h.instance("instance-b")
+
+	inst := must(h.store.GetInstance(h.ctx, "instance-a"))(t)
+	if inst == nil || inst.Name != "worker-a" || deref(inst.Hostname) != "host-a" || deref(inst.PID) != 1234 ||
+		deref(inst.Version) != "1.0.0" || inst.MaxConcurrentRuns != 5 || inst.MaxConcurrentTools != 20 || inst.Metadata["region"] != "eu" {
+		t.Fatalf("GetInstance: got %+v", inst)
+	}
+	if missing := must(h.store.GetInstance(h.ctx, "missing"))(t); missing != nil {
+		t.Fatalf("GetInstance of unknown ID: got %+v, want nil", missing)
+	}
+
+	// Registering again updates the instance in place
+	check(t, h.store.RegisterInstance(h.ctx, driver.RegisterInstanceParams{ID: "instance-a", Name: "worker-a2", MaxConcurrentRuns: 7}))
+	if inst := must(h.store.GetInstance(h.ctx, "instance-a"))(t); inst.Name != "worker-a2" || inst.MaxConcurrentRuns != 7 {
+		t.Fatalf("RegisterInstance again: got %+v", inst)
+	}
+	if instances := must(h.store.ListInstances(h.ctx))(t); len(instances) != 2 {
+		t.Fatalf("ListInstances: got %d instances, want 2", len(instances))
+	}
+
+	if err := h.store.UpdateHeartbeat(h.ctx, "missing"); err == nil {
+		t.Fatalf("UpdateHeartbeat of unknown instance: expected error")
+	}
+	time.Sleep(100 * time.Millisecond)
+	check(t, h.store.UpdateHeartbeat(h.ctx, "instance-a"))
+	stale := must(h.store.GetStaleInstances(h.ctx, 50*time.Millisecond))(t)
+	if !slices.Equal(stale, []string{"instance-b"}) {
+		t.Fatalf("GetStaleInstances: got %v, want [instance-b]", stale)
+	}
+
+	// Instance tools
+	h.tool("search")
+	h.tool("fetch")
+	check(t, h.store.RegisterInstanceTool(h.ctx, "instance-a", "search"))
+	check(t, h.store.RegisterInstanceTool(h.ctx, "instance-a", "fetch"))
+	check(t, h.store.RegisterInstanceTool(h.ctx, "instance-a", "fetch"))
+	check(t, h.store.RegisterInstanceTool(h.ctx, "instance-b", "search"))
+	tools := must(h.store.GetInstanceTools(h.ctx, "instance-a"))(t)
+	slices.Sort(tools)
+	if !slices.Equal(tools, []string{"fetch", "search"}) {
+		t.Fatalf("GetInstanceTools: got %v", tools)
+	}
+
+	// The last registration of a tool removes the tool itself
+	check(t, h.store.UnregisterInstanceTool(h.ctx, "instance-a", "fetch"))
+	if tools := must(h.store.GetInstanceTools(h.ctx, "instance-a"))(t); !slices.Equal(tools, []string{"search"}) {
+		t.Fatalf("UnregisterInstanceTool: got %v", tools)
+	}
+	if tool := must(h.store.GetTool(h.ctx, "fetch"))(t); tool != nil {
+		t.Fatalf("UnregisterInstanceTool: orphaned tool still exists")
+	}
+	check(t, h.store.UnregisterInstanceTool(h.ctx, "instance-a", "search"))
+	if tool := must(h.store.GetTool(h.ctx, "search"))(t); tool == nil {
+		t.Fatalf("UnregisterInstanceTool: tool still registered elsewhere was deleted")
+	}
+
+	deleted := must(h.store.DeleteStaleInstances(h.ctx, 50*time.Millisecond))(t)
+	if deleted != 1 {
+		t.Fatalf("DeleteStaleInstances: deleted %d instances, want 1", deleted)
+	}
+	if inst := must(h.store.GetInstance(h.ctx, "instance-b"))(t); inst != nil {
+		t.Fatalf("DeleteStaleInstances: stale instance still exists")
+	}
+	if tools := must(h.store.GetInstanceTools(h.ctx, "instance-b"))(t); len(tools) != 0 {
+		t.Fatalf("DeleteStaleInstances: instance tools remain: %v", tools)
+	}
+
+	check(t, h.store.UnregisterInstance(h.ctx, "instance-a"))
+	if instances := must(h.store.ListInstances(h.ctx))(t); len(instances) != 0 {
+		t.Fatalf("UnregisterInstance: got %d instances, want 0", len(instances))
+	}
+}
+
+func testInstanceCleanup[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("doomed", "search")
+	h.instance("survivor", "search")
+
+	run, iter := h.runInState("doomed", "pending_tools", time.Now())
+	exec := h.toolExecution(run.ID, iter.ID, "search")
+	if claimed := must(h.store.ClaimToolExecutions(h.ctx, "doomed", 10))(t); len(claimed) != 1 {
+		t.Fatalf("ClaimToolExecutions: got %d executions, want 1", len(claimed))
+	}
+	finished, _ := h.runInState("doomed", "completed", time.Now())
+	other, _ := h.runInState("survivor", "streaming", time.Now())
+
+	check(t, h.store.UnregisterInstance(h.ctx, "doomed"))
+
+	got := h.getRun(run.ID)
+	if got.State != "failed" || deref(got.PreviousState) != "pending_tools" || deref(got.ErrorType) != "instance_disconnected" ||
+		deref(got.ErrorMessage) != "Instance disconnected: doomed" || got.FinalizedAt == nil {
+		t.Fatalf("UnregisterInstance: claimed run %+v", got)
+	}
+	gotExec := h.getToolExecution(exec.ID)
+	if gotExec.State != "failed" || deref(gotExec.ErrorMessage) != "Instance disconnected: doomed" || gotExec.CompletedAt == nil {
+		t.Fatalf("UnregisterInstance: claimed tool execution %+v", gotExec)
+	}
+	if got := h.getRun(finished.ID); got.State != "completed" {
+		t.Fatalf("UnregisterInstance: finished run moved to %s", got.State)
+	}
+	if got := h.getRun(other.ID); got.State != "streaming" {
+		t.Fatalf("UnregisterInstance: another instance's run moved to %s", got.State)
+	}
+}
+
+func testLeader[TTx any](t *testing.T, h *harness[TTx]) {
+	if leader := must(h.store.GetLeader(h.ctx))(t); leader != "" {
+		t.Fatalf("GetLeader with no leader: got %q", leader)
+	}
+
+	if ok := must(h.store.TryAcquireLeader(h.ctx, "a", time.Minute))(t); !ok {
+		t.Fatalf("TryAcquireLeader: first instance was not elected")
+	}
+	if ok := must(h.store.TryAcquireLeader(h.ctx, "b", time.Minute))(t); ok {
+		t.Fatalf("TryAcquireLeader: second instance was elected while the lease is held")
+	}
+	if leader := must(h.store.GetLeader(h.ctx))(t); leader != "a" {
+		t.Fatalf("GetLeader: got %q, want a", leader)
+	}
+	if ok := must(h.store.IsLeader(h.ctx, "a"))(t); !ok {
+		t.Fatalf("IsLeader(a): got false")
+	}
+	if ok := must(h.store.IsLeader(h.ctx, "b"))(t); ok {
+		t.Fatalf("IsLeader(b): got true")
+	}
+
+	check(t, h.store.RefreshLeader(h.ctx, "a", time.Minute))
+	if err := h.store.RefreshLeader(h.ctx, "b", time.Minute); err == nil {
+		t.Fatalf("RefreshLeader by non-leader: expected error")
+	}
+
+	check(t, h.store.ReleaseLeader(h.ctx, "b")) // Not the leader: no effect
+	if leader := must(h.store.GetLeader(h.ctx))(t); leader != "a" {
+		t.Fatalf("ReleaseLeader by non-leader: leader is %q", leader)
+	}
+	check(t, h.store.ReleaseLeader(h.ctx, "a"))
+	if leader := must(h.store.GetLeader(h.ctx))(t); leader != "" {
+		t.Fatalf("ReleaseLeader: leader is still %q", leader)
+	}
+
+	// An expired lease can be taken over
+	if ok := must(h.store.TryAcquireLeader(h.ctx, "b", 50*time.Millisecond))(t); !ok {
+		t.Fatalf("TryAcquireLeader after release: not elected")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if leader := must(h.store.GetLeader(h.ctx))(t); leader != "" {
+		t.Fatalf("GetLeader after expiry: got %q", leader)
+	}
+	if ok := must(h.store.TryAcquireLeader(h.ctx, "a", time.Minute))(t); !ok {
+		t.Fatalf("TryAcquireLeader after expiry: not elected")
+	}
+}
+
+func testSchedules[TTx any](t *testing.T, h *harness[TTx]) {
+	agent := h.agent("reporter")
+	other := h.agent("other")
+	next := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+
+	sched := must(h.store.UpsertSchedule(h.ctx, driver.UpsertScheduleParams{
+		Name:            "daily-report",
+		AgentID:         agent.ID,
+		CronExpression:  "0 9 * * *",
+		Timezone:        "UTC",
+		CatchUpPolicy:   "skip",
+		NextRunAt:       next,
+		Prompt:          "Write the report for {{date}}",
+		Variables:       map[string]any{"team": "core"},
+		RunMode:         "batch",
+		SessionPolicy:   "new",
+		SessionMetadata: map[string]any{"tenant_id": "t1"},
+		Metadata:        map[string]any{"owner": "ops"},
+	}))(t)
+	if sched.ID == uuid.Nil || sched.Paused || !sameTime(sched.NextRunAt, next) || sched.Variables["team"] != "core" || sched.FireCount != 0 {
+		t.Fatalf("UpsertSchedule: got %+v", sched)
+	}
+
+	// Same cron and timezone: the pending tick is kept
+	upserted := must(h.store.UpsertSchedule(h.ctx, driver.UpsertScheduleParams{
+		Name: "daily-report", AgentID: agent.ID, CronExpression: "0 9 * * *", Timezone: "UTC", CatchUpPolicy: "skip",
+		NextRunAt: next.Add(time.Hour), Prompt: "New prompt", RunMode: "batch", SessionPolicy: "new",
+	}))(t)
+	if upserted.ID != sched.ID || upserted.Prompt != "New prompt" || !sameTime(upserted.NextRunAt, next) {
+		t.Fatalf("UpsertSchedule with same cron: got %+v", upserted)
+	}
+
+	other2 := must(h.store.UpsertSchedule(h.ctx, driver.UpsertScheduleParams{
+		Name: "hourly", AgentID: other.ID, CronExpression: "0 * * * *", Timezone: "UTC", CatchUpPolicy: "skip",
+		NextRunAt: time.Now().Add(time.Hour), Prompt: "Tick", RunMode: "streaming", SessionPolicy: "reuse",
+	}))(t)
+
+	if got := must(h.store.GetSchedule(h.ctx, sched.ID))(t); got == nil || got.Name != "daily-report" {
+		t.Fatalf("GetSchedule: got %+v", got)
+	}
+	if got := must(h.store.GetScheduleByName(h.ctx, "hourly"))(t); got == nil || got.ID != other2.ID {
+		t.Fatalf("GetScheduleByName: got %+v", got)
+	}
+	if missing := must(h.store.GetSchedule(h.ctx, uuid.New()))(t); missing != nil {
+		t.Fatalf("GetSchedule of unknown ID: got %+v, want nil", missing)
+	}
+	if missing := must(h.store.GetScheduleByName(h.ctx, "missing"))(t); missing != nil {
+		t.Fatalf("GetScheduleByName of unknown name: got %+v, want nil", missing)
+	}
+
+	schedules, total := must2(h.store.ListSchedules(h.ctx, driver.ListSchedulesParams{}))(t)
+	if total != 2 || len(schedules) != 2 || schedules[0].Name != "daily-report" {
+		t.Fatalf("ListSchedules: got %d schedules, total %d, want 2 ordered by name", len(schedules), total)
+	}
+	if _, total := must2(h.store.ListSchedules(h.ctx, driver.ListSchedulesParams{AgentID: &other.ID}))(t); total != 1 {
+		t.Fatalf("ListSchedules by agent: total %d, want 1", total)
+	}
+
+	due := must(h.store.GetDueSchedules(h.ctx, 10))(t)
+	if len(due) != 1 || due[0].ID != sched.ID {
+		t.Fatalf("GetDueSchedules: got %d schedules, want %s", len(due), sched.ID)
+	}
+	check(t, h.store.UpdateSchedule(h.ctx, sched.ID, map[string]any{"paused": true}))
+	if due := must(h.store.GetDueSchedules(h.ctx, 10))(t); len(due) != 0 {
+		t.Fatalf("GetDueSchedules with paused schedule: got %d schedules", len(due))
+	}
+
+	// A paused schedule cannot be advanced
+	tx := must(h.drv.BeginTx(h.ctx))(t)
+	ok := must(h.store.AdvanceScheduleTx(h.ctx, tx, driver.AdvanceScheduleParams{
+		ID: sched.ID, ExpectedNextRunAt: next, NextRunAt: next.Add(24 * time.Hour),
+	}))(t)
+	check(t, h.drv.CommitTx(h.ctx, tx))
+	if ok {
+		t.Fatalf("AdvanceScheduleTx of paused schedule: got true")
+	}
+	check(t, h.store.UpdateSchedule(h.ctx, sched.ID, map[string]any{"paused": false}))
+
+	session := h.session(nil)
+	run := h.run(session.ID, agent.ID, "batch")
+	tx = must(h.drv.BeginTx(h.ctx))(t)
+	ok = must(h.store.AdvanceScheduleTx(h.ctx, tx, driver.AdvanceScheduleParams{
+		ID: sched.ID, ExpectedNextRunAt: next, NextRunAt: next.Add(24 * time.Hour), RunID: &run.ID, SessionID: &session.ID,
+	}))(t)
+	check(t, h.drv.CommitTx(h.ctx, tx))
+	if !ok {
+		t.Fatalf("AdvanceScheduleTx: got false")
+	}
+	got := must(h.store.GetSchedule(h.ctx, sched.ID))(t)
+	if !sameTime(got.NextRunAt, next.Add(24*time.Hour)) || got.FireCount != 1 || deref(got.LastRunID) != run.ID ||
+		got.LastRunAt == nil || deref(got.SessionID) != session.ID {
+		t.Fatalf("AdvanceScheduleTx: got %+v", got)
+	}
+
+	// A second instance firing the same tick loses
+	tx = must(h.drv.BeginTx(h.ctx))(t)
+	ok = must(h.store.AdvanceScheduleTx(h.ctx, tx, driver.AdvanceScheduleParams{
+		ID: sched.ID, ExpectedNextRunAt: next, NextRunAt: next.Add(24 * time.Hour), RunID: &run.ID,
+	}))(t)
+	check(t, h.drv.CommitTx(h.ctx, tx))
+	if ok {
+		t.Fatalf("AdvanceScheduleTx of an already advanced tick: got true")
+	}
+
+	// Changing the cron expression replaces the pending tick
+	replaced := must(h.store.UpsertSchedule(h.ctx, driver.UpsertScheduleParams{
+		Name: "daily-report", AgentID: agent.ID, CronExpression: "0 10 * * *", Timezone: "UTC", CatchUpPolicy: "skip",
+		NextRunAt: next.Add(time.Hour), Prompt: "New prompt", RunMode: "batch", SessionPolicy: "new",
+	}))(t)
+	if !sameTime(replaced.NextRunAt, next.Add(time.Hour)) || replaced.FireCount != 1 || deref(replaced.SessionID) != session.ID {
+		t.Fatalf("UpsertSchedule with new cron: got %+v", replaced)
+	}
+
+	check(t, h.store.DeleteSchedule(h.ctx, sched.ID))
+	if deleted := must(h.store.GetSchedule(h.ctx, sched.ID))(t); deleted != nil {
+		t.Fatalf("DeleteSchedule: schedule still exists")
+	}
+}
+
+func testAuditLog[TTx any](t *testing.T, h *harness[TTx]) {
+	acme := h.session(map[string]any{"tenant": "acme"})
+	other := h.session(map[string]any{"tenant": "other"})
+
+	first := must(h.store.CreateAuditEvent(h.ctx, driver.CreateAuditEventParams{
+		Action: "run.cancel", TargetType: "run", TargetID: "run-1", SessionID: &acme.ID, Actor: "alice",
+		Details: map[string]any{"reason": "stuck", "runs_cancelled": 2},
+	}))(t)
+	if first.ID == uuid.Nil || first.Action != "run.cancel" || deref(first.SessionID) != acme.ID || first.Actor != "alice" ||
+		first.Details["reason"] != "stuck" || first.CreatedAt.IsZero() {
+		t.Fatalf("CreateAuditEvent: got %+v", first)
+	}
+	must(h.store.CreateAuditEvent(h.ctx, driver.CreateAuditEventParams{
+		Action: "run.retry", TargetType: "run", TargetID: "run-2", SessionID: &other.ID, Actor: "bob",
+	}))(t)
+	last := must(h.store.CreateAuditEvent(h.ctx, driver.CreateAuditEventParams{
+		Action: "leader.release", TargetType: "leader", TargetID: "instance-1", Actor: "alice",
+	}))(t)
+	if last.Details == nil || len(last.Details) != 0 {
+		t.Fatalf("CreateAuditEvent without details: got %+v", last.Details)
+	}
+
+	events, total := must2(h.store.ListAuditEvents(h.ctx, driver.ListAuditEventsParams{}))(t)
+	if total != 3 || len(events) != 3 || events[0].ID != last.ID || events[2].ID != first.ID {
+		t.Fatalf("ListAuditEvents: got %d of %d, want newest first", len(events), total)
+	}
+	events, total = must2(h.store.ListAuditEvents(h.ctx, driver.ListAuditEventsParams{Limit: 1, Offset: 1}))(t)
+	if total != 3 || len(events) != 1 || events[0].Action != "run.retry" {
+		t.Fatalf("ListAuditEvents page: got %d of %d", len(events), total)
+	}
+	events, total = must2(h.store.ListAuditEvents(h.ctx, driver.ListAuditEventsParams{Actor: "alice", TargetType: "run"}))(t)
+	if total != 1 || events[0].ID != first.ID || events[0].Details["runs_cancelled"] != float64(2) {
+		t.Fatalf("ListAuditEvents by actor and target type: got %d events", total)
+	}
+	events, total = must2(h.store.ListAuditEvents(h.ctx, driver.ListAuditEventsParams{TargetID: "run-2"}))(t)
+	if total != 1 || events[0].Actor != "bob" {
+		t.Fatalf("ListAuditEvents by target: got %d events", total)
+	}
+
+	// Scoped lists only show events of matching sessions
+	events, total = must2(h.store.ListAuditEvents(h.ctx, driver.ListAuditEventsParams{
+		MetadataFilter: map[string]any{"tenant": "acme"},
+	}))(t)
+	if total != 1 || events[0].ID != first.ID {
+		t.Fatalf("ListAuditEvents with metadata filter: got %d events", total)
+	}
+}
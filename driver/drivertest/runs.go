@@ -0,0 +1,941 @@
+package drivertest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+func testRuns[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(map[string]any{"tenant_id": "t1"})
+	agent := h.agent("agent")
+
+	run := must(h.store.CreateRun(h.ctx, driver.CreateRunParams{
+		SessionID:           session.ID,
+		AgentID:             agent.ID,
+		Prompt:              "Hello",
+		CreatedByInstanceID: "instance-1",
+		Metadata:            map[string]any{"source": "test"},
+	}))(t)
+	if run.ID == uuid.Nil || run.State != "pending" || run.RunMode != "batch" || run.Prompt != "Hello" {
+		t.Fatalf("CreateRun: got %+v", run)
+	}
+	if deref(run.CreatedByInstanceID) != "instance-1" || run.Metadata["source"] != "test" || run.ScheduledAt.IsZero() {
+		t.Fatalf("CreateRun: got %+v", run)
+	}
+	if _, err := h.store.CreateRun(h.ctx, driver.CreateRunParams{SessionID: uuid.New(), AgentID: agent.ID, Prompt: "x"}); err == nil {
+		t.Fatalf("CreateRun with unknown session: expected error")
+	}
+
+	got := h.getRun(run.ID)
+	if got.SessionID != session.ID || got.AgentID != agent.ID || got.ClaimedByInstanceID != nil {
+		t.Fatalf("GetRun: got %+v", got)
+	}
+	if missing := must(h.store.GetRun(h.ctx, uuid.New()))(t); missing != nil {
+		t.Fatalf("GetRun of unknown ID: got %+v, want nil", missing)
+	}
+
+	check(t, h.store.UpdateRun(h.ctx, run.ID, map[string]any{
+		"input_tokens":  100,
+		"output_tokens": 50,
+		"response_text": "Hi there",
+	}))
+	check(t, h.store.UpdateRunState(h.ctx, run.ID, "completed", map[string]any{
+		"stop_reason":  "end_turn",
+		"finalized_at": time.Now(),
+	}))
+	got = h.getRun(run.ID)
+	if got.State != "completed" || got.InputTokens != 100 || got.OutputTokens != 50 ||
+		deref(got.ResponseText) != "Hi there" || deref(got.StopReason) != "end_turn" || got.FinalizedAt == nil {
+		t.Fatalf("UpdateRun and UpdateRunState: got %+v", got)
+	}
+
+	streaming := h.run(session.ID, agent.ID, "streaming")
+	other := h.run(h.session(map[string]any{"tenant_id": "t2"}).ID, agent.ID, "batch")
+
+	bySession := must(h.store.GetRunsBySession(h.ctx, session.ID, 10))(t)
+	if len(bySession) != 2 || bySession[0].ID != streaming.ID || bySession[1].ID != run.ID {
+		t.Fatalf("GetRunsBySession: got %d runs, want newest first", len(bySession))
+	}
+	if runs := must(h.store.GetRunsBySession(h.ctx, session.ID, 1))(t); len(runs) != 1 {
+		t.Fatalf("GetRunsBySession with limit 1: got %d runs", len(runs))
+	}
+
+	runs, total := must2(h.store.ListRuns(h.ctx, driver.ListRunsParams{}))(t)
+	if total != 3 || len(runs) != 3 || runs[0].ID != other.ID {
+		t.Fatalf("ListRuns: got %d runs, total %d, want 3 newest first", len(runs), total)
+	}
+	runs, total = must2(h.store.ListRuns(h.ctx, driver.ListRunsParams{MetadataFilter: map[string]any{"tenant_id": "t1"}}))(t)
+	if total != 2 || len(runs) != 2 {
+		t.Fatalf("ListRuns by session metadata: got %d runs, total %d, want 2", len(runs), total)
+	}
+	runs, total = must2(h.store.ListRuns(h.ctx, driver.ListRunsParams{State: "completed"}))(t)
+	if total != 1 || runs[0].ID != run.ID {
+		t.Fatalf("ListRuns by state: got %d runs, total %d, want 1", len(runs), total)
+	}
+	runs, total = must2(h.store.ListRuns(h.ctx, driver.ListRunsParams{RunMode: "streaming", SessionID: &session.ID, AgentID: &agent.ID}))(t)
+	if total != 1 || runs[0].ID != streaming.ID {
+		t.Fatalf("ListRuns by mode, session and agent: got %d runs, total %d, want 1", len(runs), total)
+	}
+	runs, total = must2(h.store.ListRuns(h.ctx, driver.ListRunsParams{Limit: 1, Offset: 1}))(t)
+	if total != 3 || len(runs) != 1 || runs[0].ID != streaming.ID {
+		t.Fatalf("ListRuns with offset: got %d runs, total %d", len(runs), total)
+	}
+}
+
+func testRunIdempotency[TTx any](t *testing.T, h *harness[TTx]) {
+	session := h.session(nil)
+	agent := h.agent("agent")
+
+	params := driver.CreateRunParams{
+		SessionID:      session.ID,
+		AgentID:        agent.ID,
+		Prompt:         "Charge the card",
+		Metadata:       map[string]any{"amount": 42, "card": map[string]any{"last4": "4242"}},
+		IdempotencyKey: "order-42",
+		IdempotencyTTL: time.Hour,
+	}
+	first := must(h.store.CreateRun(h.ctx, params))(t)
+	second := must(h.store.CreateRun(h.ctx, params))(t)
+	if second.ID != first.ID || deref(first.IdempotencyKey) != "order-42" {
+		t.Fatalf("CreateRun with reused idempotency key: got %s, want %s", second.ID, first.ID)
+	}
+
+	// The default run mode is batch
+	explicit := params
+	explicit.RunMode = "batch"
+	if run := must(h.store.CreateRun(h.ctx, explicit))(t); run.ID != first.ID {
+		t.Fatalf("CreateRun with reused idempotency key and explicit batch mode: got %s, want %s", run.ID, first.ID)
+	}
+
+	params.IdempotencyKey = "order-43"
+	if third := must(h.store.CreateRun(h.ctx, params))(t); third.ID == first.ID {
+		t.Fatalf("CreateRun with new idempotency key: got existing run")
+	}
+
+	// Keys are scoped to the session
+	other := params
+	other.SessionID = h.session(nil).ID
+	other.IdempotencyKey = "order-42"
+	if run := must(h.store.CreateRun(h.ctx, other))(t); run.ID == first.ID {
+		t.Fatalf("CreateRun with idempotency key of another session: got that session's run")
+	}
+
+	// Reusing a key for a different run is a conflict
+	conflicting := params
+	conflicting.IdempotencyKey = "order-42"
+	conflicting.Prompt = "Refund the card"
+	if _, err := h.store.CreateRun(h.ctx, conflicting); !errors.Is(err, driver.ErrIdempotencyConflict) {
+		t.Fatalf("CreateRun with reused idempotency key and different prompt: got %v, want ErrIdempotencyConflict", err)
+	}
+	conflicting.Prompt = params.Prompt
+	conflicting.AgentID = h.agent("other-agent").ID
+	if _, err := h.store.CreateRun(h.ctx, conflicting); !errors.Is(err, driver.ErrIdempotencyConflict) {
+		t.Fatalf("CreateRun with reused idempotency key and different agent: got %v, want ErrIdempotencyConflict", err)
+	}
+	conflicting.AgentID = params.AgentID
+	conflicting.RunMode = "streaming"
+	if _, err := h.store.CreateRun(h.ctx, conflicting); !errors.Is(err, driver.ErrIdempotencyConflict) {
+		t.Fatalf("CreateRun with reused idempotency key and different run mode: got %v, want ErrIdempotencyConflict", err)
+	}
+	conflicting.RunMode = ""
+	conflicting.Metadata = map[string]any{"amount": 43, "card": map[string]any{"last4": "4242"}}
+	if _, err := h.store.CreateRun(h.ctx, conflicting); !errors.Is(err, driver.ErrIdempotencyConflict) {
+		t.Fatalf("CreateRun with reused idempotency key and different metadata: got %v, want ErrIdempotencyConflict", err)
+	}
+	conflicting.Metadata = nil
+	if _, err := h.store.CreateRun(h.ctx, conflicting); !errors.Is(err, driver.ErrIdempotencyConflict) {
+		t.Fatalf("CreateRun with reused idempotency key and no metadata: got %v, want ErrIdempotencyConflict", err)
+	}
+
+	// An expired key is released and reused for a new run
+	time.Sleep(10 * time.Millisecond)
+	params.IdempotencyKey = "order-42"
+	params.IdempotencyTTL = time.Millisecond
+	fourth := must(h.store.CreateRun(h.ctx, params))(t)
+	if fourth.ID == first.ID || deref(fourth.IdempotencyKey) != "order-42" {
+		t.Fatalf("CreateRun with expired idempotency key: got %+v", fourth)
+	}
+	if old := h.getRun(first.ID); old.IdempotencyKey != nil {
+		t.Fatalf("CreateRun with expired idempotency key: old run kept key %q", *old.IdempotencyKey)
+	}
+}
+
+func testClaimRuns[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("generalist")
+	h.instance("specialist", "search")
+	session := h.session(nil)
+	plain := h.agent("plain")
+	searcher := h.agent("searcher", "search")
+
+	batch := h.run(session.ID, plain.ID, "batch")
+	streaming := h.run(session.ID, plain.ID, "streaming")
+	needsSearch := h.run(session.ID, searcher.ID, "batch")
+
+	// Run mode filter
+	claimed := must(h.store.ClaimRuns(h.ctx, "generalist", 10, "streaming"))(t)
+	if len(claimed) != 1 || claimed[0].ID != streaming.ID {
+		t.Fatalf("ClaimRuns streaming: got %d runs, want %s", len(claimed), streaming.ID)
+	}
+	if c := claimed[0]; c.State != "streaming" || deref(c.PreviousState) != "pending" ||
+		deref(c.ClaimedByInstanceID) != "generalist" || c.ClaimedAt == nil || c.StartedAt == nil {
+		t.Fatalf("ClaimRuns streaming: got %+v", c)
+	}
+
+	// Routing by tools: the generalist lacks the searcher's tool
+	claimed = must(h.store.ClaimRuns(h.ctx, "generalist", 10, ""))(t)
+	if len(claimed) != 1 || claimed[0].ID != batch.ID || claimed[0].State != "batch_submitting" {
+		t.Fatalf("ClaimRuns by generalist: got %d runs, want only %s", len(claimed), batch.ID)
+	}
+	claimed = must(h.store.ClaimRuns(h.ctx, "specialist", 10, ""))(t)
+	if len(claimed) != 1 || claimed[0].ID != needsSearch.ID {
+		t.Fatalf("ClaimRuns by specialist: got %d runs, want %s", len(claimed), needsSearch.ID)
+	}
+	if claimed := must(h.store.ClaimRuns(h.ctx, "specialist", 10, ""))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimRuns: claimed %d runs twice", len(claimed))
+	}
+
+	// Oldest first, up to maxCount
+	first := h.run(session.ID, plain.ID, "batch")
+	h.run(session.ID, plain.ID, "batch")
+	claimed = must(h.store.ClaimRuns(h.ctx, "generalist", 1, ""))(t)
+	if len(claimed) != 1 || claimed[0].ID != first.ID {
+		t.Fatalf("ClaimRuns with maxCount 1: got %d runs, want oldest %s", len(claimed), first.ID)
+	}
+
+	activeRuns, _ := must2(h.store.GetInstanceActiveCounts(h.ctx, "generalist"))(t)
+	if activeRuns != 3 {
+		t.Fatalf("GetInstanceActiveCounts: got %d active runs, want 3", activeRuns)
+	}
+}
+
+func testClaimRunsConcurrencyLimit[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker")
+	session := h.session(nil)
+	plain := h.agent("plain")
+	maxRuns := 2
+	capped := must(h.store.CreateAgent(h.ctx, &driver.AgentDefinition{
+		Name:              "capped",
+		Model:             "claude-test",
+		MaxConcurrentRuns: &maxRuns,
+	}))(t)
+
+	first := h.run(session.ID, capped.ID, "batch")
+	second := h.run(session.ID, capped.ID, "batch")
+	third := h.run(session.ID, capped.ID, "batch")
+	uncapped := h.run(session.ID, plain.ID, "batch")
+
+	claimed := must(h.store.ClaimRuns(h.ctx, "worker", 10, ""))(t)
+	ids := make([]uuid.UUID, 0, len(claimed))
+	for _, run := range claimed {
+		ids = append(ids, run.ID)
+	}
+	if len(ids) != 3 || !slices.Contains(ids, first.ID) || !slices.Contains(ids, second.ID) || !slices.Contains(ids, uncapped.ID) {
+		t.Fatalf("ClaimRuns with a cap of 2: got %v, want %s, %s and %s", ids, first.ID, second.ID, uncapped.ID)
+	}
+	if claimed := must(h.store.ClaimRuns(h.ctx, "worker", 10, ""))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimRuns over the cap: claimed %d runs", len(claimed))
+	}
+
+	// Continuations hold their slot and are claimed even when the cap is full
+	iter := h.iteration(second.ID, 1)
+	check(t, h.store.RetryRun(h.ctx, second.ID, iter.ID, driver.APIAttempt{
+		Attempt: 1, ErrorType: "overloaded_error", StatusCode: 529, CreatedAt: time.Now(),
+	}, time.Now()))
+	claimed = must(h.store.ClaimRuns(h.ctx, "worker", 10, ""))(t)
+	if len(claimed) != 1 || claimed[0].ID != second.ID {
+		t.Fatalf("ClaimRuns of a continuation: got %d runs, want %s", len(claimed), second.ID)
+	}
+
+	// Finalized runs free their slot
+	check(t, h.store.UpdateRunState(h.ctx, first.ID, "completed", map[string]any{"finalized_at": time.Now()}))
+	claimed = must(h.store.ClaimRuns(h.ctx, "worker", 10, ""))(t)
+	if len(claimed) != 1 || claimed[0].ID != third.ID {
+		t.Fatalf("ClaimRuns after a run finished: got %d runs, want %s", len(claimed), third.ID)
+	}
+}
+
+func testIterations[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("poller")
+	run, _ := h.runInState("poller", "batch_pending", time.Now())
+	iter := h.iteration(run.ID, 2)
+	if iter.ID == uuid.Nil || iter.IterationNumber != 2 || iter.TriggerType != "user_prompt" || len(iter.APIAttempts) != 0 {
+		t.Fatalf("CreateIteration: got %+v", iter)
+	}
+	if _, err := h.store.CreateIteration(h.ctx, driver.CreateIterationParams{RunID: run.ID, IterationNumber: 2, TriggerType: "tool_results"}); err == nil {
+		t.Fatalf("CreateIteration with duplicate number: expected error")
+	}
+	if missing := must(h.store.GetIteration(h.ctx, uuid.New()))(t); missing != nil {
+		t.Fatalf("GetIteration of unknown ID: got %+v, want nil", missing)
+	}
+
+	check(t, h.store.UpdateIteration(h.ctx, iter.ID, map[string]any{
+		"batch_id":           "batch_123",
+		"batch_status":       "in_progress",
+		"batch_submitted_at": time.Now(),
+		"input_tokens":       42,
+	}))
+	got := must(h.store.GetIteration(h.ctx, iter.ID))(t)
+	if deref(got.BatchID) != "batch_123" || deref(got.BatchStatus) != "in_progress" || got.BatchSubmittedAt == nil || got.InputTokens != 42 {
+		t.Fatalf("UpdateIteration: got %+v", got)
+	}
+
+	retryAt := time.Now().Add(time.Minute)
+	check(t, h.store.AddIterationAPIAttempt(h.ctx, iter.ID, driver.APIAttempt{
+		Attempt: 1, ErrorType: "overloaded_error", StatusCode: 529, Message: "Overloaded", Retryable: true, RetryAt: &retryAt, CreatedAt: time.Now(),
+	}))
+	check(t, h.store.AddIterationAPIAttempt(h.ctx, iter.ID, driver.APIAttempt{
+		Attempt: 2, ErrorType: "rate_limit_error", StatusCode: 429, Message: "Slow down", CreatedAt: time.Now(),
+	}))
+	got = must(h.store.GetIteration(h.ctx, iter.ID))(t)
+	if len(got.APIAttempts) != 2 || got.APIAttempts[0].ErrorType != "overloaded_error" || got.APIAttempts[1].StatusCode != 429 || got.APIAttempts[0].RetryAt == nil {
+		t.Fatalf("AddIterationAPIAttempt: got %+v", got.APIAttempts)
+	}
+
+	iters := must(h.store.GetIterationsByRun(h.ctx, run.ID))(t)
+	if len(iters) != 2 || iters[0].IterationNumber != 1 || iters[1].IterationNumber != 2 {
+		t.Fatalf("GetIterationsByRun: got %d iterations, want 2 in order", len(iters))
+	}
+
+	// Only in-progress batches of runs claimed by the instance that are due
+	polled := must(h.store.GetIterationsForPoll(h.ctx, "poller", 10))(t)
+	if len(polled) != 1 || polled[0].ID != iter.ID {
+		t.Fatalf("GetIterationsForPoll: got %d iterations, want %s", len(polled), iter.ID)
+	}
+	if polled := must(h.store.GetIterationsForPoll(h.ctx, "someone-else", 10))(t); len(polled) != 0 {
+		t.Fatalf("GetIterationsForPoll for another instance: got %d iterations", len(polled))
+	}
+
+	// Iterations submitted together share a batch; polling marks all in-progress ones
+	other := iters[0]
+	if other.ID == iter.ID {
+		other = iters[1]
+	}
+	check(t, h.store.UpdateIteration(h.ctx, other.ID, map[string]any{"batch_id": "batch_123", "batch_status": "ended"}))
+	members := must(h.store.GetIterationsByBatch(h.ctx, "batch_123"))(t)
+	if len(members) != 2 {
+		t.Fatalf("GetIterationsByBatch: got %d iterations, want 2", len(members))
+	}
+	if members := must(h.store.GetIterationsByBatch(h.ctx, "batch_unknown"))(t); len(members) != 0 {
+		t.Fatalf("GetIterationsByBatch of unknown batch: got %d iterations", len(members))
+	}
+	check(t, h.store.MarkBatchPolled(h.ctx, "batch_123", time.Now().Add(time.Hour)))
+	if got := must(h.store.GetIteration(h.ctx, iter.ID))(t); got.BatchPollCount != 1 || got.BatchLastPollAt == nil || got.BatchNextPollAt == nil {
+		t.Fatalf("MarkBatchPolled: got poll count %d, last poll %v, next poll %v", got.BatchPollCount, got.BatchLastPollAt, got.BatchNextPollAt)
+	}
+	if got := must(h.store.GetIteration(h.ctx, other.ID))(t); got.BatchPollCount != 0 {
+		t.Fatalf("MarkBatchPolled of an ended iteration: got poll count %d, want 0", got.BatchPollCount)
+	}
+	if polled := must(h.store.GetIterationsForPoll(h.ctx, "poller", 10))(t); len(polled) != 0 {
+		t.Fatalf("GetIterationsForPoll before the next poll: got %d iterations", len(polled))
+	}
+
+	// Rescheduling does not count a poll
+	check(t, h.store.ScheduleBatchPoll(h.ctx, "batch_123", time.Now().Add(-time.Second)))
+	if got := must(h.store.GetIteration(h.ctx, iter.ID))(t); got.BatchPollCount != 1 {
+		t.Fatalf("ScheduleBatchPoll: got poll count %d, want 1", got.BatchPollCount)
+	}
+	if polled := must(h.store.GetIterationsForPoll(h.ctx, "poller", 10))(t); len(polled) != 1 {
+		t.Fatalf("GetIterationsForPoll after the next poll time: got %d iterations, want 1", len(polled))
+	}
+
+	// Batches being cancelled are polled until they end
+	check(t, h.store.UpdateIteration(h.ctx, iter.ID, map[string]any{"batch_status": "canceling", "batch_next_poll_at": nil}))
+	if polled := must(h.store.GetIterationsForPoll(h.ctx, "poller", 10))(t); len(polled) != 1 {
+		t.Fatalf("GetIterationsForPoll of a canceling batch: got %d iterations, want 1", len(polled))
+	}
+	check(t, h.store.MarkBatchPolled(h.ctx, "batch_123", time.Now().Add(time.Hour)))
+	if got := must(h.store.GetIteration(h.ctx, iter.ID))(t); got.BatchPollCount != 2 {
+		t.Fatalf("MarkBatchPolled of a canceling iteration: got poll count %d, want 2", got.BatchPollCount)
+	}
+}
+
+func testToolExecutions[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker", "search", "fetch")
+	run, iter := h.runInState("worker", "batch_processing", time.Now())
+
+	exec := h.toolExecution(run.ID, iter.ID, "search")
+	if exec.ID == uuid.Nil || exec.State != "pending" || exec.MaxAttempts != 2 || exec.AttemptCount != 0 || exec.ScheduledAt.IsZero() {
+		t.Fatalf("CreateToolExecution: got %+v", exec)
+	}
+	if !jsonEqual(exec.ToolInput, []byte(`{"q":"x"}`)) {
+		t.Fatalf("CreateToolExecution: got input %s", exec.ToolInput)
+	}
+	if missing := must(h.store.GetToolExecution(h.ctx, uuid.New()))(t); missing != nil {
+		t.Fatalf("GetToolExecution of unknown ID: got %+v, want nil", missing)
+	}
+
+	batch := must(h.store.CreateToolExecutions(h.ctx, []driver.CreateToolExecutionParams{
+		{RunID: run.ID, IterationID: iter.ID, ToolUseID: "toolu_a", ToolName: "fetch", ToolInput: []byte(`{}`), MaxAttempts: 5},
+		{RunID: run.ID, IterationID: iter.ID, ToolUseID: "toolu_b", ToolName: "fetch", ToolInput: []byte(`{}`)},
+	}))(t)
+	if len(batch) != 2 || batch[0].MaxAttempts != 5 || batch[1].ToolUseID != "toolu_b" {
+		t.Fatalf("CreateToolExecutions: got %+v", batch)
+	}
+
+	check(t, h.store.UpdateToolExecution(h.ctx, batch[0].ID, map[string]any{"state": "running", "attempt_count": 1}))
+	if got := h.getToolExecution(batch[0].ID); got.State != "running" || got.AttemptCount != 1 {
+		t.Fatalf("UpdateToolExecution: got %+v", got)
+	}
+
+	check(t, h.store.CompleteToolExecution(h.ctx, exec.ID, "found it", false, ""))
+	check(t, h.store.CompleteToolExecution(h.ctx, batch[0].ID, "", true, "timeout"))
+	got := h.getToolExecution(exec.ID)
+	if got.State != "completed" || deref(got.ToolOutput) != "found it" || got.IsError || got.ErrorMessage != nil || got.CompletedAt == nil {
+		t.Fatalf("CompleteToolExecution success: got %+v", got)
+	}
+	got = h.getToolExecution(batch[0].ID)
+	if got.State != "failed" || !got.IsError || deref(got.ErrorMessage) != "timeout" {
+		t.Fatalf("CompleteToolExecution error: got %+v", got)
+	}
+
+	if execs := must(h.store.GetToolExecutionsByRun(h.ctx, run.ID))(t); len(execs) != 3 || execs[0].ID != exec.ID {
+		t.Fatalf("GetToolExecutionsByRun: got %d executions, want 3 oldest first", len(execs))
+	}
+	if execs := must(h.store.GetToolExecutionsByIteration(h.ctx, iter.ID))(t); len(execs) != 3 {
+		t.Fatalf("GetToolExecutionsByIteration: got %d executions, want 3", len(execs))
+	}
+	if pending := must(h.store.GetPendingToolExecutionsForRun(h.ctx, run.ID))(t); len(pending) != 1 || pending[0].ID != batch[1].ID {
+		t.Fatalf("GetPendingToolExecutionsForRun: got %d executions, want %s", len(pending), batch[1].ID)
+	}
+
+	execs, total := must2(h.store.ListToolExecutions(h.ctx, driver.ListToolExecutionsParams{ToolName: "fetch"}))(t)
+	if total != 2 || len(execs) != 2 || execs[0].ID != batch[1].ID {
+		t.Fatalf("ListToolExecutions by tool: got %d executions, total %d, want 2 newest first", len(execs), total)
+	}
+	notAgentTool := false
+	execs, total = must2(h.store.ListToolExecutions(h.ctx, driver.ListToolExecutionsParams{RunID: &run.ID, State: "failed", IsAgentTool: &notAgentTool}))(t)
+	if total != 1 || execs[0].ID != batch[0].ID {
+		t.Fatalf("ListToolExecutions by run, state and flag: got %d executions, total %d, want 1", len(execs), total)
+	}
+	check(t, h.store.UpdateSession(h.ctx, run.SessionID, map[string]any{"metadata": map[string]any{"tenant": "acme"}}))
+	execs, total = must2(h.store.ListToolExecutions(h.ctx, driver.ListToolExecutionsParams{MetadataFilter: map[string]any{"tenant": "acme"}}))(t)
+	if total != 3 || len(execs) != 3 {
+		t.Fatalf("ListToolExecutions by session metadata: got %d executions, total %d, want 3", len(execs), total)
+	}
+	if _, total = must2(h.store.ListToolExecutions(h.ctx, driver.ListToolExecutionsParams{MetadataFilter: map[string]any{"tenant": "other"}}))(t); total != 0 {
+		t.Fatalf("ListToolExecutions by other session metadata: got total %d, want 0", total)
+	}
+
+	// Tool executions and the run state change are written together
+	next := h.iteration(run.ID, 2)
+	created := must(h.store.CreateToolExecutionsAndUpdateRunState(h.ctx, []driver.CreateToolExecutionParams{
+		{RunID: run.ID, IterationID: next.ID, ToolUseID: "toolu_c", ToolName: "search", ToolInput: []byte(`{}`)},
+	}, run.ID, "pending_tools", map[string]any{
+		"tool_iterations": 2,
+		"input_tokens":    300,
+		"output_tokens":   80,
+	}))(t)
+	if len(created) != 1 || created[0].State != "pending" || created[0].MaxAttempts != 2 {
+		t.Fatalf("CreateToolExecutionsAndUpdateRunState: got %+v", created)
+	}
+	updated := h.getRun(run.ID)
+	if updated.State != "pending_tools" || deref(updated.PreviousState) != "batch_processing" ||
+		updated.ToolIterations != 2 || updated.InputTokens != 300 || updated.OutputTokens != 80 {
+		t.Fatalf("CreateToolExecutionsAndUpdateRunState run: got %+v", updated)
+	}
+}
+
+func testClaimToolExecutions[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker", "search")
+	h.instance("other", "fetch")
+	run, iter := h.runInState("worker", "pending_tools", time.Now())
+
+	search := h.toolExecution(run.ID, iter.ID, "search")
+	fetch := h.toolExecution(run.ID, iter.ID, "fetch")
+
+	// Agent tools route on the tools of the target agent
+	delegate := h.agent("delegate", "fetch")
+	agentTool := must(h.store.CreateToolExecution(h.ctx, driver.CreateToolExecutionParams{
+		RunID:       run.ID,
+		IterationID: iter.ID,
+		ToolUseID:   "toolu_agent",
+		ToolName:    "delegate",
+		ToolInput:   []byte(`{"task":"x"}`),
+		IsAgentTool: true,
+		AgentID:     &delegate.ID,
+	}))(t)
+
+	claimed := must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	if len(claimed) != 1 || claimed[0].ID != search.ID {
+		t.Fatalf("ClaimToolExecutions by worker: got %d executions, want %s", len(claimed), search.ID)
+	}
+	if c := claimed[0]; c.State != "running" || c.AttemptCount != 1 || deref(c.ClaimedByInstanceID) != "worker" || c.ClaimedAt == nil || c.StartedAt == nil {
+		t.Fatalf("ClaimToolExecutions: got %+v", c)
+	}
+
+	claimed = must(h.store.ClaimToolExecutions(h.ctx, "other", 1))(t)
+	if len(claimed) != 1 || claimed[0].ID != fetch.ID {
+		t.Fatalf("ClaimToolExecutions with maxCount 1: got %d executions, want oldest %s", len(claimed), fetch.ID)
+	}
+	claimed = must(h.store.ClaimToolExecutions(h.ctx, "other", 10))(t)
+	if len(claimed) != 1 || claimed[0].ID != agentTool.ID {
+		t.Fatalf("ClaimToolExecutions of agent tool: got %d executions, want %s", len(claimed), agentTool.ID)
+	}
+	if claimed := must(h.store.ClaimToolExecutions(h.ctx, "other", 10))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimToolExecutions: claimed %d executions twice", len(claimed))
+	}
+
+	_, activeTools := must2(h.store.GetInstanceActiveCounts(h.ctx, "other"))(t)
+	if activeTools != 2 {
+		t.Fatalf("GetInstanceActiveCounts: got %d active tools, want 2", activeTools)
+	}
+	all := must(h.store.GetAllInstanceActiveCounts(h.ctx))(t)
+	if all["worker"] != [2]int{1, 1} || all["other"][1] != 2 {
+		t.Fatalf("GetAllInstanceActiveCounts: got %v", all)
+	}
+}
+
+func testClaimToolExecutionsConcurrencyLimit[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker", "fetch", "search")
+	maxConcurrency := 1
+	check(t, h.store.UpsertTool(h.ctx, &driver.ToolDefinition{
+		Name:           "fetch",
+		Description:    "Fetch a page",
+		InputSchema:    map[string]any{"type": "object"},
+		MaxConcurrency: &maxConcurrency,
+	}))
+	run, iter := h.runInState("worker", "pending_tools", time.Now())
+
+	first := h.toolExecution(run.ID, iter.ID, "fetch")
+	second := h.toolExecution(run.ID, iter.ID, "fetch")
+	search := h.toolExecution(run.ID, iter.ID, "search")
+
+	claimed := must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	ids := make([]uuid.UUID, 0, len(claimed))
+	for _, exec := range claimed {
+		ids = append(ids, exec.ID)
+	}
+	if len(ids) != 2 || !slices.Contains(ids, first.ID) || !slices.Contains(ids, search.ID) {
+		t.Fatalf("ClaimToolExecutions with a cap of 1: got %v, want %s and %s", ids, first.ID, search.ID)
+	}
+	if claimed := must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimToolExecutions over the cap: claimed %d executions", len(claimed))
+	}
+
+	check(t, h.store.CompleteToolExecution(h.ctx, first.ID, "done", false, ""))
+	claimed = must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	if len(claimed) != 1 || claimed[0].ID != second.ID {
+		t.Fatalf("ClaimToolExecutions after an execution finished: got %d executions, want %s", len(claimed), second.ID)
+	}
+}
+
+func testToolExecutionRetry[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker", "search")
+	run, iter := h.runInState("worker", "pending_tools", time.Now())
+
+	retried := h.toolExecution(run.ID, iter.ID, "search")
+	must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+
+	// Retry: back to pending, not claimable until scheduled_at
+	later := time.Now().Add(time.Hour)
+	check(t, h.store.RetryToolExecution(h.ctx, retried.ID, later, "connection reset"))
+	got := h.getToolExecution(retried.ID)
+	if got.State != "pending" || got.ClaimedByInstanceID != nil || deref(got.LastError) != "connection reset" || got.AttemptCount != 1 || !sameTime(got.ScheduledAt, later) {
+		t.Fatalf("RetryToolExecution: got %+v", got)
+	}
+	if claimed := must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimToolExecutions before scheduled_at: got %d executions", len(claimed))
+	}
+
+	// Snooze: back to pending without consuming the attempt
+	snoozed := h.toolExecution(run.ID, iter.ID, "search")
+	must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	check(t, h.store.SnoozeToolExecution(h.ctx, snoozed.ID, time.Now().Add(-time.Second)))
+	got = h.getToolExecution(snoozed.ID)
+	if got.State != "pending" || got.AttemptCount != 0 || got.SnoozeCount != 1 || got.ClaimedByInstanceID != nil {
+		t.Fatalf("SnoozeToolExecution: got %+v", got)
+	}
+	claimed := must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	if len(claimed) != 1 || claimed[0].ID != snoozed.ID || claimed[0].AttemptCount != 1 {
+		t.Fatalf("ClaimToolExecutions after snooze: got %+v", claimed)
+	}
+
+	// Discard: permanently failed
+	check(t, h.store.DiscardToolExecution(h.ctx, snoozed.ID, "cancelled by tool"))
+	got = h.getToolExecution(snoozed.ID)
+	if got.State != "failed" || !got.IsError || deref(got.ErrorMessage) != "cancelled by tool" || got.CompletedAt == nil {
+		t.Fatalf("DiscardToolExecution: got %+v", got)
+	}
+}
+
+func testCompleteToolsAndContinueRun[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker")
+	run, _ := h.runInState("worker", "pending_tools", time.Now())
+
+	blocks := []driver.ContentBlock{
+		{Type: "tool_result", ToolResultForUseID: "toolu_1", ToolContent: "Sunny"},
+		{Type: "tool_result", ToolResultForUseID: "toolu_2", ToolContent: "boom", IsError: true},
+	}
+	msg := must(h.store.CompleteToolsAndContinueRun(h.ctx, run.SessionID, run.ID, blocks))(t)
+	if msg == nil || msg.Role != "user" || deref(msg.RunID) != run.ID || len(msg.Content) != 2 {
+		t.Fatalf("CompleteToolsAndContinueRun: got message %+v", msg)
+	}
+
+	stored := must(h.store.GetMessage(h.ctx, msg.ID))(t)
+	if len(stored.Content) != 2 || stored.Content[0].ToolResultForUseID != "toolu_1" || stored.Content[0].ToolContent != "Sunny" || !stored.Content[1].IsError {
+		t.Fatalf("CompleteToolsAndContinueRun: stored content %+v", stored.Content)
+	}
+
+	got := h.getRun(run.ID)
+	if got.State != "pending" || deref(got.PreviousState) != "pending_tools" || got.ClaimedByInstanceID != nil || got.ClaimedAt != nil {
+		t.Fatalf("CompleteToolsAndContinueRun: got run %+v", got)
+	}
+
+	// A second caller finds the run already continued
+	again, err := h.store.CompleteToolsAndContinueRun(h.ctx, run.SessionID, run.ID, blocks)
+	if err != nil || again != nil {
+		t.Fatalf("CompleteToolsAndContinueRun twice: got %+v, %v; want nil, nil", again, err)
+	}
+	if msgs := must(h.store.GetMessagesByRun(h.ctx, run.ID))(t); len(msgs) != 1 {
+		t.Fatalf("CompleteToolsAndContinueRun twice: got %d messages, want 1", len(msgs))
+	}
+}
+
+func testChildRunComplete[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker")
+	parent, iter := h.runInState("worker", "pending_tools", time.Now())
+	childAgent := h.agent("child")
+
+	completedExec := must(h.store.CreateToolExecution(h.ctx, driver.CreateToolExecutionParams{
+		RunID: parent.ID, IterationID: iter.ID, ToolUseID: "toolu_1", ToolName: "child", ToolInput: []byte(`{}`),
+		IsAgentTool: true, AgentID: &childAgent.ID,
+	}))(t)
+	failedExec := must(h.store.CreateToolExecution(h.ctx, driver.CreateToolExecutionParams{
+		RunID: parent.ID, IterationID: iter.ID, ToolUseID: "toolu_2", ToolName: "child", ToolInput: []byte(`{}`),
+		IsAgentTool: true, AgentID: &childAgent.ID,
+	}))(t)
+	if claimed := must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t); len(claimed) != 2 {
+		t.Fatalf("ClaimToolExecutions: got %d executions, want 2", len(claimed))
+	}
+
+	newChild := func(execID uuid.UUID) *driver.Run {
+		return must(h.store.CreateRun(h.ctx, driver.CreateRunParams{
+			SessionID:             parent.SessionID,
+			AgentID:               childAgent.ID,
+			Prompt:                "Do the subtask",
+			ParentRunID:           &parent.ID,
+			ParentToolExecutionID: &execID,
+			Depth:                 1,
+		}))(t)
+	}
+	okChild := newChild(completedExec.ID)
+	failedChild := newChild(failedExec.ID)
+	check(t, h.store.UpdateToolExecution(h.ctx, completedExec.ID, map[string]any{"child_run_id": okChild.ID}))
+
+	check(t, h.store.UpdateRunState(h.ctx, okChild.ID, "completed", map[string]any{"response_text": "Subtask done"}))
+	got := h.getToolExecution(completedExec.ID)
+	if got.State != "completed" || deref(got.ToolOutput) != "Subtask done" || got.IsError || got.CompletedAt == nil || deref(got.ChildRunID) != okChild.ID {
+		t.Fatalf("completed child run: parent tool execution %+v", got)
+	}
+
+	check(t, h.store.UpdateRunState(h.ctx, failedChild.ID, "failed", map[string]any{"error_message": "child blew up"}))
+	got = h.getToolExecution(failedExec.ID)
+	if got.State != "failed" || !got.IsError || deref(got.ErrorMessage) != "child blew up" {
+		t.Fatalf("failed child run: parent tool execution %+v", got)
+	}
+
+	// Only running executions are updated
+	check(t, h.store.UpdateRunState(h.ctx, okChild.ID, "cancelled", nil))
+	if got := h.getToolExecution(completedExec.ID); got.State != "completed" {
+		t.Fatalf("second terminal state of child run: parent tool execution moved to %s", got.State)
+	}
+}
+
+func testRescueAndRetry[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker")
+	stuck, _ := h.runInState("worker", "streaming", time.Now().Add(-time.Hour))
+	fresh, _ := h.runInState("worker", "streaming", time.Now())
+	waiting, waitingIter := h.runInState("worker", "pending_tools", time.Now().Add(-time.Hour))
+	h.toolExecution(waiting.ID, waitingIter.ID, "slow")
+
+	runs := must(h.store.GetStuckRuns(h.ctx, time.Minute, 3, 10))(t)
+	if len(runs) != 1 || runs[0].ID != stuck.ID {
+		t.Fatalf("GetStuckRuns: got %d runs, want only %s", len(runs), stuck.ID)
+	}
+	if runs := must(h.store.GetStuckRuns(h.ctx, time.Minute, 0, 10))(t); len(runs) != 0 {
+		t.Fatalf("GetStuckRuns with no rescue attempts left: got %d runs", len(runs))
+	}
+
+	check(t, h.store.RescueRun(h.ctx, stuck.ID))
+	got := h.getRun(stuck.ID)
+	if got.State != "pending" || got.ClaimedByInstanceID != nil || got.ClaimedAt != nil || got.RescueAttempts != 1 || got.LastRescueAt == nil {
+		t.Fatalf("RescueRun: got %+v", got)
+	}
+
+	// API retry: the run goes back to pending with a delayed scheduled_at
+	later := time.Now().Add(time.Hour)
+	iter := must(h.store.GetIteration(h.ctx, deref(fresh.CurrentIterationID)))(t)
+	check(t, h.store.RetryRun(h.ctx, fresh.ID, iter.ID, driver.APIAttempt{
+		Attempt: 1, ErrorType: "overloaded_error", StatusCode: 529, Retryable: true, RetryAt: &later, CreatedAt: time.Now(),
+	}, later))
+	got = h.getRun(fresh.ID)
+	if got.State != "pending" || deref(got.PreviousState) != "streaming" || got.ClaimedByInstanceID != nil ||
+		deref(got.CurrentIterationID) != iter.ID || !sameTime(got.ScheduledAt, later) {
+		t.Fatalf("RetryRun: got %+v", got)
+	}
+	if iter := must(h.store.GetIteration(h.ctx, iter.ID))(t); len(iter.APIAttempts) != 1 || iter.APIAttempts[0].StatusCode != 529 {
+		t.Fatalf("RetryRun: got attempts %+v", iter.APIAttempts)
+	}
+	claimed := must(h.store.ClaimRuns(h.ctx, "worker", 10, ""))(t)
+	if len(claimed) != 1 || claimed[0].ID != stuck.ID {
+		t.Fatalf("ClaimRuns before retry time: got %d runs, want only the rescued run", len(claimed))
+	}
+
+	// pending_tools runs whose current iteration has no open tool executions
+	if runs := must(h.store.GetStuckPendingToolsRuns(h.ctx, 10))(t); len(runs) != 0 {
+		t.Fatalf("GetStuckPendingToolsRuns with open executions: got %d runs", len(runs))
+	}
+	for _, exec := range must(h.store.GetToolExecutionsByRun(h.ctx, waiting.ID))(t) {
+		check(t, h.store.CompleteToolExecution(h.ctx, exec.ID, "done", false, ""))
+	}
+	if runs := must(h.store.GetStuckPendingToolsRuns(h.ctx, 10))(t); len(runs) != 1 || runs[0].ID != waiting.ID {
+		t.Fatalf("GetStuckPendingToolsRuns: got %d runs, want %s", len(runs), waiting.ID)
+	}
+}
+
+func testCancelRun[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker", "search")
+	parent, iter := h.runInState("worker", "pending_tools", time.Now())
+	childAgent := h.agent("child")
+
+	done := h.toolExecution(parent.ID, iter.ID, "search")
+	running := h.toolExecution(parent.ID, iter.ID, "search")
+	agentExec := must(h.store.CreateToolExecution(h.ctx, driver.CreateToolExecutionParams{
+		RunID: parent.ID, IterationID: iter.ID, ToolUseID: "toolu_child", ToolName: "child", ToolInput: []byte(`{}`),
+		IsAgentTool: true, AgentID: &childAgent.ID,
+	}))(t)
+	if claimed := must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t); len(claimed) != 3 {
+		t.Fatalf("ClaimToolExecutions: got %d executions, want 3", len(claimed))
+	}
+	check(t, h.store.CompleteToolExecution(h.ctx, done.ID, "done", false, ""))
+	child := must(h.store.CreateRun(h.ctx, driver.CreateRunParams{
+		SessionID:             parent.SessionID,
+		AgentID:               childAgent.ID,
+		Prompt:                "Do the subtask",
+		ParentRunID:           &parent.ID,
+		ParentToolExecutionID: &agentExec.ID,
+		Depth:                 1,
+	}))(t)
+
+	n := must(h.store.CancelRun(h.ctx, parent.ID, "stopped by operator"))(t)
+	if n != 2 {
+		t.Fatalf("CancelRun: got %d runs cancelled, want 2", n)
+	}
+	for _, id := range []uuid.UUID{parent.ID, child.ID} {
+		got := h.getRun(id)
+		if got.State != "cancelled" || deref(got.ErrorType) != "cancelled" || deref(got.ErrorMessage) != "stopped by operator" || got.FinalizedAt == nil {
+			t.Fatalf("CancelRun: got run %+v", got)
+		}
+	}
+	if got := h.getRun(parent.ID); deref(got.PreviousState) != "pending_tools" {
+		t.Fatalf("CancelRun: got previous state %q, want pending_tools", deref(got.PreviousState))
+	}
+
+	// Unfinished executions are skipped, also the one of the cancelled child run
+	for _, id := range []uuid.UUID{running.ID, agentExec.ID} {
+		if got := h.getToolExecution(id); got.State != "skipped" || got.CompletedAt == nil {
+			t.Fatalf("CancelRun: got tool execution %+v, want skipped", got)
+		}
+	}
+	if got := h.getToolExecution(done.ID); got.State != "completed" {
+		t.Fatalf("CancelRun: completed tool execution moved to %s", got.State)
+	}
+	if n := must(h.store.CancelRun(h.ctx, parent.ID, "again"))(t); n != 0 {
+		t.Fatalf("CancelRun of cancelled run: got %d runs cancelled, want 0", n)
+	}
+
+	// Workers still busy with the run cannot move it out of cancelled
+	check(t, h.store.UpdateRunState(h.ctx, parent.ID, "completed", map[string]any{"response_text": "late"}))
+	if got := h.getRun(parent.ID); got.State != "cancelled" || got.ResponseText != nil {
+		t.Fatalf("update of cancelled run: got %+v", got)
+	}
+	late := h.toolExecution(parent.ID, iter.ID, "search")
+	if late.State != "skipped" || late.CompletedAt == nil {
+		t.Fatalf("tool execution of cancelled run: got %+v, want skipped", late)
+	}
+	lateChild := must(h.store.CreateRun(h.ctx, driver.CreateRunParams{
+		SessionID:   parent.SessionID,
+		AgentID:     childAgent.ID,
+		Prompt:      "Too late",
+		ParentRunID: &parent.ID,
+		Depth:       1,
+	}))(t)
+	if lateChild.State != "cancelled" || lateChild.FinalizedAt == nil {
+		t.Fatalf("child run of cancelled run: got %+v, want cancelled", lateChild)
+	}
+	if claimed := must(h.store.ClaimRuns(h.ctx, "worker", 10, ""))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimRuns: got %d runs of a cancelled run", len(claimed))
+	}
+	if claimed := must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimToolExecutions: got %d executions of a cancelled run", len(claimed))
+	}
+}
+
+func testRetryFailedRun[TTx any](t *testing.T, h *harness[TTx]) {
+	h.instance("worker", "search")
+	failRun := func(id uuid.UUID) {
+		updates := finalized()
+		updates["error_type"] = "instance_lost"
+		updates["error_message"] = "instance went away"
+		check(t, h.store.UpdateRunState(h.ctx, id, "failed", updates))
+	}
+	completeIteration := func(id uuid.UUID, updates map[string]any) {
+		updates["completed_at"] = time.Now()
+		check(t, h.store.UpdateIteration(h.ctx, id, updates))
+	}
+
+	// Failed while its tool calls were executing: back to pending_tools
+	waiting, iter := h.runInState("worker", "pending_tools", time.Now())
+	completeIteration(iter.ID, map[string]any{"has_tool_use": true})
+	ok := h.toolExecution(waiting.ID, iter.ID, "search")
+	failed := h.toolExecution(waiting.ID, iter.ID, "search")
+	must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	check(t, h.store.CompleteToolExecution(h.ctx, ok.ID, "found", false, ""))
+	check(t, h.store.DiscardToolExecution(h.ctx, failed.ID, "search backend down"))
+	failRun(waiting.ID)
+
+	if retried := must(h.store.RetryFailedRun(h.ctx, waiting.ID))(t); !retried {
+		t.Fatal("RetryFailedRun: got false for a failed run")
+	}
+	got := h.getRun(waiting.ID)
+	if got.State != "pending_tools" || deref(got.PreviousState) != "failed" || deref(got.CurrentIterationID) != iter.ID || got.CurrentIteration != 1 ||
+		got.ErrorMessage != nil || got.ErrorType != nil || got.FinalizedAt != nil || got.ClaimedByInstanceID != nil {
+		t.Fatalf("RetryFailedRun: got run %+v", got)
+	}
+	gotExec := h.getToolExecution(failed.ID)
+	if gotExec.State != "pending" || gotExec.AttemptCount != 0 || gotExec.IsError || gotExec.ErrorMessage != nil ||
+		gotExec.CompletedAt != nil || deref(gotExec.LastError) != "search backend down" {
+		t.Fatalf("RetryFailedRun: got failed tool execution %+v", gotExec)
+	}
+	if gotExec := h.getToolExecution(ok.ID); gotExec.State != "completed" {
+		t.Fatalf("RetryFailedRun: completed tool execution moved to %s", gotExec.State)
+	}
+	if retried := must(h.store.RetryFailedRun(h.ctx, waiting.ID))(t); retried {
+		t.Fatal("RetryFailedRun: got true for a run that is not failed")
+	}
+
+	// Requeue: only failed executions, with a fresh attempt budget
+	if requeued := must(h.store.RequeueToolExecution(h.ctx, ok.ID))(t); requeued {
+		t.Fatal("RequeueToolExecution: got true for a completed execution")
+	}
+	must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	check(t, h.store.DiscardToolExecution(h.ctx, failed.ID, "still down"))
+	if requeued := must(h.store.RequeueToolExecution(h.ctx, failed.ID))(t); !requeued {
+		t.Fatal("RequeueToolExecution: got false for a failed execution")
+	}
+	gotExec = h.getToolExecution(failed.ID)
+	if gotExec.State != "pending" || gotExec.AttemptCount != 0 || gotExec.ClaimedByInstanceID != nil || deref(gotExec.LastError) != "still down" {
+		t.Fatalf("RequeueToolExecution: got %+v", gotExec)
+	}
+
+	// Failed in the iteration after the tool results: back to pending after the failed iteration
+	continued, first := h.runInState("worker", "pending_tools", time.Now())
+	completeIteration(first.ID, map[string]any{"has_tool_use": true})
+	exec := h.toolExecution(continued.ID, first.ID, "search")
+	must(h.store.ClaimToolExecutions(h.ctx, "worker", 10))(t)
+	check(t, h.store.CompleteToolExecution(h.ctx, exec.ID, "found", false, ""))
+	must(h.store.CompleteToolsAndContinueRun(h.ctx, continued.SessionID, continued.ID, []driver.ContentBlock{
+		{Type: "tool_result", ToolResultForUseID: exec.ToolUseID, ToolContent: "found"},
+	}))(t)
+	second := h.iteration(continued.ID, 2)
+	completeIteration(second.ID, map[string]any{"error_message": "overloaded", "error_type": "overloaded_error"})
+	failRun(continued.ID)
+
+	if retried := must(h.store.RetryFailedRun(h.ctx, continued.ID))(t); !retried {
+		t.Fatal("RetryFailedRun: got false for a failed run")
+	}
+	got = h.getRun(continued.ID)
+	if got.State != "pending" || got.CurrentIteration != 2 || got.CurrentIterationID != nil || got.FinalizedAt != nil {
+		t.Fatalf("RetryFailedRun after tool results: got run %+v", got)
+	}
+	claimed := must(h.store.ClaimRuns(h.ctx, "worker", 10, ""))(t)
+	if len(claimed) != 1 || claimed[0].ID != continued.ID {
+		t.Fatalf("ClaimRuns after RetryFailedRun: got %d runs, want %s", len(claimed), continued.ID)
+	}
+}
+
+func testRateLimits[TTx any](t *testing.T, h *harness[TTx]) {
+	intPtr := func(n int) *int { return &n }
+
+	// Models without recorded limits are never limited
+	if retryAt := must(h.store.AcquireRateLimit(h.ctx, "claude-unknown"))(t); retryAt != nil {
+		t.Fatalf("AcquireRateLimit of unknown model: got %v, want nil", retryAt)
+	}
+
+	// 60 requests per minute refill one per second: the last request is
+	// taken, then the next one waits for it to refill
+	check(t, h.store.RecordRateLimit(h.ctx, driver.RecordRateLimitParams{
+		Model:             "claude-requests",
+		RequestsLimit:     intPtr(60),
+		RequestsRemaining: intPtr(1),
+	}))
+	if retryAt := must(h.store.AcquireRateLimit(h.ctx, "claude-requests"))(t); retryAt != nil {
+		t.Fatalf("AcquireRateLimit with a request left: got %v, want nil", retryAt)
+	}
+	retryAt := must(h.store.AcquireRateLimit(h.ctx, "claude-requests"))(t)
+	if retryAt == nil || time.Until(*retryAt) <= 0 || time.Until(*retryAt) > 2*time.Second {
+		t.Fatalf("AcquireRateLimit without requests left: got %v, want about a second from now", retryAt)
+	}
+
+	// The usage of a call is taken from the tokens remaining: 600 remaining
+	// minus 1000 used leaves -400 of 600 per minute, 40s from 1 available
+	check(t, h.store.RecordRateLimit(h.ctx, driver.RecordRateLimitParams{
+		Model:                "claude-tokens",
+		InputTokensLimit:     intPtr(600),
+		InputTokensRemaining: intPtr(600),
+	}))
+	check(t, h.store.RecordRateLimit(h.ctx, driver.RecordRateLimitParams{
+		Model:           "claude-tokens",
+		InputTokensUsed: 1000,
+	}))
+	retryAt = must(h.store.AcquireRateLimit(h.ctx, "claude-tokens"))(t)
+	if retryAt == nil || time.Until(*retryAt) < 35*time.Second || time.Until(*retryAt) > 41*time.Second {
+		t.Fatalf("AcquireRateLimit without tokens left: got %v, want about 40s from now", retryAt)
+	}
+
+	// A 429's retry-after blocks the model even with requests left
+	blockedUntil := time.Now().Add(time.Hour)
+	check(t, h.store.RecordRateLimit(h.ctx, driver.RecordRateLimitParams{
+		Model:             "claude-blocked",
+		RequestsLimit:     intPtr(1000),
+		RequestsRemaining: intPtr(1000),
+		BlockedUntil:      &blockedUntil,
+	}))
+	retryAt = must(h.store.AcquireRateLimit(h.ctx, "claude-blocked"))(t)
+	if retryAt == nil || retryAt.Before(blockedUntil.Add(-time.Second)) {
+		t.Fatalf("AcquireRateLimit of blocked model: got %v, want %v", retryAt, blockedUntil)
+	}
+
+	// Deferred runs go back to pending without an API attempt and keep their
+	// started_at, but are not claimed before their scheduled time
+	h.instance("worker")
+	session := h.session(nil)
+	agent := h.agent("deferred")
+	run := h.run(session.ID, agent.ID, "streaming")
+	claimed := must(h.store.ClaimRuns(h.ctx, "worker", 1, ""))(t)
+	if len(claimed) != 1 || claimed[0].ID != run.ID {
+		t.Fatalf("ClaimRuns: got %d runs, want the run to defer", len(claimed))
+	}
+	later := time.Now().Add(time.Hour)
+	check(t, h.store.DeferRun(h.ctx, run.ID, later))
+	got := h.getRun(run.ID)
+	if got.State != "pending" || deref(got.PreviousState) != "streaming" || got.ClaimedByInstanceID != nil ||
+		got.ClaimedAt != nil || got.StartedAt == nil || !sameTime(got.ScheduledAt, later) {
+		t.Fatalf("DeferRun: got %+v", got)
+	}
+	if claimed := must(h.store.ClaimRuns(h.ctx, "worker", 1, ""))(t); len(claimed) != 0 {
+		t.Fatalf("ClaimRuns before deferred time: got %d runs", len(claimed))
+	}
+}
+
+// sameTime reports whether two times are equal at the microsecond precision
+// of PostgreSQL timestamps.
+func sameTime(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d > -time.Microsecond && d < time.Microsecond
+}
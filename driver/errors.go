@@ -0,0 +1,32 @@
+package driver
+
+import "errors"
+
+// Errors returned by Store implementations. Callers match them with errors.Is.
+var (
+	// ErrSessionBusy indicates the session has a run in progress.
+	ErrSessionBusy = errors.New("session has a run in progress")
+
+	// ErrCompactionConflict indicates a compaction no longer matches the
+	// session's messages, because another compaction or restore got there first.
+	ErrCompactionConflict = errors.New("compaction conflicts with a concurrent change")
+
+	// ErrCompactionNotFound indicates the compaction event does not exist.
+	ErrCompactionNotFound = errors.New("compaction event not found")
+
+	// ErrCompactionRestored indicates the compaction was already restored.
+	ErrCompactionRestored = errors.New("compaction already restored")
+
+	// ErrArchivePurged indicates the archived messages of a compaction were
+	// deleted by a retention policy, so it can no longer be restored.
+	ErrArchivePurged = errors.New("archived messages of compaction were purged")
+
+	// ErrIdempotencyConflict indicates the idempotency key is already in use
+	// in the session by a run with a different agent, prompt, run mode or
+	// metadata.
+	ErrIdempotencyConflict = errors.New("idempotency key reused with different run parameters")
+
+	// ErrForkPointNotFound indicates the message to fork at is not part of
+	// the session's root-level conversation.
+	ErrForkPointNotFound = errors.New("fork point message not found in session")
+)
@@ -0,0 +1,385 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// The Update* methods of driver.Store take column name -> value maps. The
+// functions below apply such maps to rows, accepting the same Go types the
+// SQL drivers would bind for each column.
+
+func applyRunUpdates(run *driver.Run, updates map[string]any) error {
+	for k, v := range updates {
+		var err error
+		switch k {
+		case "state":
+			var s *string
+			if s, err = toString(v); err == nil && s != nil {
+				run.State = *s
+			}
+		case "previous_state":
+			run.PreviousState, err = toString(v)
+		case "run_mode":
+			var s *string
+			if s, err = toString(v); err == nil && s != nil {
+				run.RunMode = *s
+			}
+		case "prompt":
+			var s *string
+			if s, err = toString(v); err == nil && s != nil {
+				run.Prompt = *s
+			}
+		case "current_iteration":
+			run.CurrentIteration, err = toInt(v)
+		case "current_iteration_id":
+			run.CurrentIterationID, err = toUUID(v)
+		case "response_text":
+			run.ResponseText, err = toString(v)
+		case "stop_reason":
+			run.StopReason, err = toString(v)
+		case "input_tokens":
+			run.InputTokens, err = toInt(v)
+		case "output_tokens":
+			run.OutputTokens, err = toInt(v)
+		case "cache_creation_input_tokens":
+			run.CacheCreationInputTokens, err = toInt(v)
+		case "cache_read_input_tokens":
+			run.CacheReadInputTokens, err = toInt(v)
+		case "iteration_count":
+			run.IterationCount, err = toInt(v)
+		case "tool_iterations":
+			run.ToolIterations, err = toInt(v)
+		case "error_message":
+			run.ErrorMessage, err = toString(v)
+		case "error_type":
+			run.ErrorType, err = toString(v)
+		case "claimed_by_instance_id":
+			run.ClaimedByInstanceID, err = toString(v)
+		case "claimed_at":
+			run.ClaimedAt, err = toTime(v)
+		case "metadata":
+			run.Metadata, err = toJSONMap(v)
+		case "started_at":
+			run.StartedAt, err = toTime(v)
+		case "finalized_at":
+			run.FinalizedAt, err = toTime(v)
+		case "rescue_attempts":
+			run.RescueAttempts, err = toInt(v)
+		case "last_rescue_at":
+			run.LastRescueAt, err = toTime(v)
+		case "idempotency_key":
+			run.IdempotencyKey, err = toString(v)
+		case "scheduled_at":
+			var t *time.Time
+			if t, err = toTime(v); err == nil && t != nil {
+				run.ScheduledAt = *t
+			}
+		default:
+			err = fmt.Errorf("unknown column")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update run column %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func applyIterationUpdates(iter *driver.Iteration, updates map[string]any) error {
+	for k, v := range updates {
+		var err error
+		switch k {
+		case "is_streaming":
+			iter.IsStreaming, err = toBool(v)
+		case "batch_id":
+			iter.BatchID, err = toString(v)
+		case "batch_request_id":
+			iter.BatchRequestID, err = toString(v)
+		case "batch_status":
+			iter.BatchStatus, err = toString(v)
+		case "batch_submitted_at":
+			iter.BatchSubmittedAt, err = toTime(v)
+		case "batch_completed_at":
+			iter.BatchCompletedAt, err = toTime(v)
+		case "batch_expires_at":
+			iter.BatchExpiresAt, err = toTime(v)
+		case "batch_poll_count":
+			iter.BatchPollCount, err = toInt(v)
+		case "batch_last_poll_at":
+			iter.BatchLastPollAt, err = toTime(v)
+		case "batch_next_poll_at":
+			iter.BatchNextPollAt, err = toTime(v)
+		case "streaming_started_at":
+			iter.StreamingStartedAt, err = toTime(v)
+		case "streaming_completed_at":
+			iter.StreamingCompletedAt, err = toTime(v)
+		case "trigger_type":
+			var s *string
+			if s, err = toString(v); err == nil && s != nil {
+				iter.TriggerType = *s
+			}
+		case "request_message_ids":
+			iter.RequestMessageIDs, err = toUUIDs(v)
+		case "stop_reason":
+			iter.StopReason, err = toString(v)
+		case "response_message_id":
+			iter.ResponseMessageID, err = toUUID(v)
+		case "has_tool_use":
+			iter.HasToolUse, err = toBool(v)
+		case "tool_execution_count":
+			iter.ToolExecutionCount, err = toInt(v)
+		case "input_tokens":
+			iter.InputTokens, err = toInt(v)
+		case "output_tokens":
+			iter.OutputTokens, err = toInt(v)
+		case "cache_creation_input_tokens":
+			iter.CacheCreationInputTokens, err = toInt(v)
+		case "cache_read_input_tokens":
+			iter.CacheReadInputTokens, err = toInt(v)
+		case "error_message":
+			iter.ErrorMessage, err = toString(v)
+		case "error_type":
+			iter.ErrorType, err = toString(v)
+		case "started_at":
+			iter.StartedAt, err = toTime(v)
+		case "completed_at":
+			iter.CompletedAt, err = toTime(v)
+		case "model":
+			iter.Model, err = toString(v)
+		default:
+			err = fmt.Errorf("unknown column")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update iteration column %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func applyToolExecutionUpdates(exec *driver.ToolExecution, updates map[string]any) error {
+	for k, v := range updates {
+		var err error
+		switch k {
+		case "state":
+			var s *string
+			if s, err = toString(v); err == nil && s != nil {
+				exec.State = *s
+			}
+		case "child_run_id":
+			exec.ChildRunID, err = toUUID(v)
+		case "tool_output":
+			exec.ToolOutput, err = toString(v)
+		case "is_error":
+			exec.IsError, err = toBool(v)
+		case "error_message":
+			exec.ErrorMessage, err = toString(v)
+		case "claimed_by_instance_id":
+			exec.ClaimedByInstanceID, err = toString(v)
+		case "claimed_at":
+			exec.ClaimedAt, err = toTime(v)
+		case "attempt_count":
+			exec.AttemptCount, err = toInt(v)
+		case "max_attempts":
+			exec.MaxAttempts, err = toInt(v)
+		case "scheduled_at":
+			var t *time.Time
+			if t, err = toTime(v); err == nil && t != nil {
+				exec.ScheduledAt = *t
+			}
+		case "snooze_count":
+			exec.SnoozeCount, err = toInt(v)
+		case "last_error":
+			exec.LastError, err = toString(v)
+		case "started_at":
+			exec.StartedAt, err = toTime(v)
+		case "completed_at":
+			exec.CompletedAt, err = toTime(v)
+		default:
+			err = fmt.Errorf("unknown column")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update tool execution column %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func applyMessageUpdates(msg *driver.Message, updates map[string]any) error {
+	for k, v := range updates {
+		var err error
+		switch k {
+		case "is_preserved":
+			msg.IsPreserved, err = toBool(v)
+		case "is_summary":
+			msg.IsSummary, err = toBool(v)
+		case "metadata":
+			msg.Metadata, err = toJSONMap(v)
+		case "role":
+			var s *string
+			if s, err = toString(v); err == nil && s != nil {
+				msg.Role = *s
+			}
+		default:
+			err = fmt.Errorf("unknown column")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update message column %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func applyScheduleUpdates(sched *driver.Schedule, updates map[string]any) error {
+	for k, v := range updates {
+		var err error
+		switch k {
+		case "paused":
+			sched.Paused, err = toBool(v)
+		case "next_run_at":
+			var t *time.Time
+			if t, err = toTime(v); err == nil && t != nil {
+				sched.NextRunAt = *t
+			}
+		case "prompt":
+			var s *string
+			if s, err = toString(v); err == nil && s != nil {
+				sched.Prompt = *s
+			}
+		case "variables":
+			sched.Variables, err = toJSONMap(v)
+		case "metadata":
+			sched.Metadata, err = toJSONMap(v)
+		case "session_metadata":
+			sched.SessionMetadata, err = toJSONMap(v)
+		case "session_id":
+			sched.SessionID, err = toUUID(v)
+		case "last_run_at":
+			sched.LastRunAt, err = toTime(v)
+		case "last_run_id":
+			sched.LastRunID, err = toUUID(v)
+		default:
+			err = fmt.Errorf("unknown column")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update schedule column %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// Value conversions
+
+func toString(v any) (*string, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return &val, nil
+	case *string:
+		return clonePtr(val), nil
+	}
+	// Named string types such as run states
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+		s := rv.String()
+		return &s, nil
+	}
+	return nil, fmt.Errorf("cannot use %T as text", v)
+}
+
+func toInt(v any) (int, error) {
+	switch val := v.(type) {
+	case int:
+		return val, nil
+	case int32:
+		return int(val), nil
+	case int64:
+		return int(val), nil
+	case float64:
+		return int(val), nil
+	case *int:
+		if val != nil {
+			return *val, nil
+		}
+		return 0, fmt.Errorf("cannot use NULL as integer")
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint()), nil
+	}
+	return 0, fmt.Errorf("cannot use %T as integer", v)
+}
+
+func toBool(v any) (bool, error) {
+	switch val := v.(type) {
+	case bool:
+		return val, nil
+	case *bool:
+		if val != nil {
+			return *val, nil
+		}
+	}
+	return false, fmt.Errorf("cannot use %T as boolean", v)
+}
+
+func toTime(v any) (*time.Time, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		return &val, nil
+	case *time.Time:
+		return clonePtr(val), nil
+	}
+	return nil, fmt.Errorf("cannot use %T as timestamp", v)
+}
+
+func toUUID(v any) (*uuid.UUID, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case uuid.UUID:
+		return &val, nil
+	case *uuid.UUID:
+		return clonePtr(val), nil
+	case string:
+		id, err := uuid.Parse(val)
+		if err != nil {
+			return nil, err
+		}
+		return &id, nil
+	}
+	return nil, fmt.Errorf("cannot use %T as uuid", v)
+}
+
+func toUUIDs(v any) ([]uuid.UUID, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case []uuid.UUID:
+		return append([]uuid.UUID(nil), val...), nil
+	}
+	return nil, fmt.Errorf("cannot use %T as uuid array", v)
+}
+
+func toJSONMap(v any) (map[string]any, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]any:
+		return cloneJSON(val), nil
+	case []byte:
+		var m map[string]any
+		if err := json.Unmarshal(val, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("cannot use %T as jsonb", v)
+}
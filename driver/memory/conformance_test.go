@@ -0,0 +1,15 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/driver/drivertest"
+	"github.com/youssefsiam38/agentpg/driver/memory"
+)
+
+func TestConformance(t *testing.T) {
+	drivertest.RunStoreSuite(t, func(t *testing.T) driver.Driver[*memory.Tx] {
+		return memory.New()
+	})
+}
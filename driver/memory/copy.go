@@ -0,0 +1,319 @@
+package memory
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// Rows are deep-copied whenever they cross the store boundary so callers can
+// neither observe nor cause later mutations.
+
+func copySession(session *driver.Session) *driver.Session {
+	c := *session
+	c.ParentSessionID = clonePtr(session.ParentSessionID)
+	c.Metadata = cloneJSON(session.Metadata)
+	c.ForkedFromMessageID = clonePtr(session.ForkedFromMessageID)
+	return &c
+}
+
+func copyAgent(agent *driver.AgentDefinition) *driver.AgentDefinition {
+	c := *agent
+	c.ToolNames = slices.Clone(agent.ToolNames)
+	c.AgentIDs = slices.Clone(agent.AgentIDs)
+	c.MaxTokens = clonePtr(agent.MaxTokens)
+	c.Temperature = clonePtr(agent.Temperature)
+	c.TopK = clonePtr(agent.TopK)
+	c.TopP = clonePtr(agent.TopP)
+	c.Metadata = cloneJSON(agent.Metadata)
+	c.Config = cloneJSON(agent.Config)
+	c.FallbackModels = slices.Clone(agent.FallbackModels)
+	c.FallbackLatencyBudgetMs = clonePtr(agent.FallbackLatencyBudgetMs)
+	c.MaxConcurrentRuns = clonePtr(agent.MaxConcurrentRuns)
+	return &c
+}
+
+func copyTool(tool *driver.ToolDefinition) *driver.ToolDefinition {
+	c := *tool
+	c.InputSchema = cloneJSON(tool.InputSchema)
+	c.AgentID = clonePtr(tool.AgentID)
+	c.Metadata = cloneJSON(tool.Metadata)
+	c.MaxConcurrency = clonePtr(tool.MaxConcurrency)
+	return &c
+}
+
+func copyRun(run *driver.Run) *driver.Run {
+	c := *run
+	c.ParentRunID = clonePtr(run.ParentRunID)
+	c.ParentToolExecutionID = clonePtr(run.ParentToolExecutionID)
+	c.PreviousState = clonePtr(run.PreviousState)
+	c.CurrentIterationID = clonePtr(run.CurrentIterationID)
+	c.ResponseText = clonePtr(run.ResponseText)
+	c.StopReason = clonePtr(run.StopReason)
+	c.ErrorMessage = clonePtr(run.ErrorMessage)
+	c.ErrorType = clonePtr(run.ErrorType)
+	c.CreatedByInstanceID = clonePtr(run.CreatedByInstanceID)
+	c.ClaimedByInstanceID = clonePtr(run.ClaimedByInstanceID)
+	c.ClaimedAt = clonePtr(run.ClaimedAt)
+	c.Metadata = cloneJSON(run.Metadata)
+	c.StartedAt = clonePtr(run.StartedAt)
+	c.FinalizedAt = clonePtr(run.FinalizedAt)
+	c.LastRescueAt = clonePtr(run.LastRescueAt)
+	c.IdempotencyKey = clonePtr(run.IdempotencyKey)
+	return &c
+}
+
+func copyRuns(runs []*driver.Run) []*driver.Run {
+	result := make([]*driver.Run, 0, len(runs))
+	for _, run := range runs {
+		result = append(result, copyRun(run))
+	}
+	return result
+}
+
+func copyIteration(iter *driver.Iteration) *driver.Iteration {
+	c := *iter
+	c.BatchID = clonePtr(iter.BatchID)
+	c.BatchRequestID = clonePtr(iter.BatchRequestID)
+	c.BatchStatus = clonePtr(iter.BatchStatus)
+	c.BatchSubmittedAt = clonePtr(iter.BatchSubmittedAt)
+	c.BatchCompletedAt = clonePtr(iter.BatchCompletedAt)
+	c.BatchExpiresAt = clonePtr(iter.BatchExpiresAt)
+	c.BatchLastPollAt = clonePtr(iter.BatchLastPollAt)
+	c.BatchNextPollAt = clonePtr(iter.BatchNextPollAt)
+	c.StreamingStartedAt = clonePtr(iter.StreamingStartedAt)
+	c.StreamingCompletedAt = clonePtr(iter.StreamingCompletedAt)
+	c.RequestMessageIDs = slices.Clone(iter.RequestMessageIDs)
+	c.StopReason = clonePtr(iter.StopReason)
+	c.ResponseMessageID = clonePtr(iter.ResponseMessageID)
+	c.ErrorMessage = clonePtr(iter.ErrorMessage)
+	c.ErrorType = clonePtr(iter.ErrorType)
+	c.StartedAt = clonePtr(iter.StartedAt)
+	c.CompletedAt = clonePtr(iter.CompletedAt)
+	if iter.APIAttempts != nil {
+		c.APIAttempts = make([]driver.APIAttempt, 0, len(iter.APIAttempts))
+		for _, attempt := range iter.APIAttempts {
+			c.APIAttempts = append(c.APIAttempts, cloneAPIAttempt(attempt))
+		}
+	}
+	c.Model = clonePtr(iter.Model)
+	return &c
+}
+
+func cloneAPIAttempt(attempt driver.APIAttempt) driver.APIAttempt {
+	attempt.RetryAt = clonePtr(attempt.RetryAt)
+	return attempt
+}
+
+func copyToolExecution(exec *driver.ToolExecution) *driver.ToolExecution {
+	c := *exec
+	c.ToolInput = slices.Clone(exec.ToolInput)
+	c.AgentID = clonePtr(exec.AgentID)
+	c.ChildRunID = clonePtr(exec.ChildRunID)
+	c.ToolOutput = clonePtr(exec.ToolOutput)
+	c.ErrorMessage = clonePtr(exec.ErrorMessage)
+	c.ClaimedByInstanceID = clonePtr(exec.ClaimedByInstanceID)
+	c.ClaimedAt = clonePtr(exec.ClaimedAt)
+	c.LastError = clonePtr(exec.LastError)
+	c.StartedAt = clonePtr(exec.StartedAt)
+	c.CompletedAt = clonePtr(exec.CompletedAt)
+	return &c
+}
+
+func copyToolExecutions(execs []*driver.ToolExecution) []*driver.ToolExecution {
+	result := make([]*driver.ToolExecution, 0, len(execs))
+	for _, exec := range execs {
+		result = append(result, copyToolExecution(exec))
+	}
+	return result
+}
+
+func copyMessage(msg *driver.Message) *driver.Message {
+	c := *msg
+	c.RunID = clonePtr(msg.RunID)
+	c.Content = cloneContentBlocks(msg.Content)
+	c.Metadata = cloneJSON(msg.Metadata)
+	return &c
+}
+
+func copyMessages(msgs []*driver.Message) []*driver.Message {
+	result := make([]*driver.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		result = append(result, copyMessage(msg))
+	}
+	return result
+}
+
+// cloneContentBlocks copies content blocks. Empty byte fields become nil,
+// matching the NULL columns the SQL drivers read back.
+func cloneContentBlocks(blocks []driver.ContentBlock) []driver.ContentBlock {
+	if blocks == nil {
+		return nil
+	}
+	result := make([]driver.ContentBlock, len(blocks))
+	for i, b := range blocks {
+		b.ToolInput = cloneBytes(b.ToolInput)
+		b.Source = cloneBytes(b.Source)
+		b.SearchResults = cloneBytes(b.SearchResults)
+		b.Metadata = cloneJSON(b.Metadata)
+		result[i] = b
+	}
+	return result
+}
+
+func cloneBytes(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return slices.Clone(b)
+}
+
+func copyInstance(inst *driver.Instance) *driver.Instance {
+	c := *inst
+	c.Hostname = clonePtr(inst.Hostname)
+	c.PID = clonePtr(inst.PID)
+	c.Version = clonePtr(inst.Version)
+	c.Metadata = cloneJSON(inst.Metadata)
+	return &c
+}
+
+func copyCompactionEvent(event *driver.CompactionEvent) *driver.CompactionEvent {
+	c := *event
+	c.SummaryContent = clonePtr(event.SummaryContent)
+	c.PreservedMessageIDs = slices.Clone(event.PreservedMessageIDs)
+	c.ModelUsed = clonePtr(event.ModelUsed)
+	c.DurationMS = clonePtr(event.DurationMS)
+	c.SummaryMessageID = clonePtr(event.SummaryMessageID)
+	c.RestoredAt = clonePtr(event.RestoredAt)
+	return &c
+}
+
+func copySchedule(sched *driver.Schedule) *driver.Schedule {
+	c := *sched
+	c.Variables = cloneJSON(sched.Variables)
+	c.SessionID = clonePtr(sched.SessionID)
+	c.SessionMetadata = cloneJSON(sched.SessionMetadata)
+	c.LastRunAt = clonePtr(sched.LastRunAt)
+	c.LastRunID = clonePtr(sched.LastRunID)
+	c.Metadata = cloneJSON(sched.Metadata)
+	return &c
+}
+
+func copyAgentVersion(version *driver.AgentVersion) *driver.AgentVersion {
+	c := *version
+	c.Agent = copyAgent(version.Agent)
+	return &c
+}
+
+func copyAuditEvent(event *driver.AuditEvent) *driver.AuditEvent {
+	c := *event
+	c.SessionID = clonePtr(event.SessionID)
+	c.Details = cloneJSON(event.Details)
+	return &c
+}
+
+// toArchiveJSON renders a message the way the SQL drivers store it in the
+// message archive.
+func toArchiveJSON(msg *driver.Message) map[string]any {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	var result map[string]any
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+	return result
+}
+
+func fromArchiveJSON(m map[string]any) (*driver.Message, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var msg driver.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// cloneJSON deep-copies a JSON object through a round trip, which also
+// normalizes values to what a JSONB column returns (numbers become float64,
+// structs become maps).
+func cloneJSON(m map[string]any) map[string]any {
+	if m == nil {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	var result map[string]any
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+	return result
+}
+
+// jsonContains reports whether doc contains sub, like the JSONB @> operator.
+// Both values must be normalized by cloneJSON.
+func jsonContains(doc, sub any) bool {
+	switch subVal := sub.(type) {
+	case map[string]any:
+		docMap, ok := doc.(map[string]any)
+		if !ok {
+			return false
+		}
+		for k, v := range subVal {
+			dv, ok := docMap[k]
+			if !ok || !jsonContains(dv, v) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		docArr, ok := doc.([]any)
+		if !ok {
+			return false
+		}
+		for _, v := range subVal {
+			if !slices.ContainsFunc(docArr, func(dv any) bool { return jsonContains(dv, v) }) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(doc, sub)
+	}
+}
+
+// jsonEqual reports whether two JSON objects are equal, treating nil as empty.
+func jsonEqual(a, b map[string]any) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(cloneJSON(a), cloneJSON(b))
+}
+
+// jsonText renders a JSON value like the ->> operator.
+func jsonText(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,136 @@
+// Package memory provides an in-memory driver implementation for AgentPG.
+//
+// The memory driver implements the full driver.Store, including the run and
+// tool claiming, rescue, child-run completion and tools-complete semantics
+// that the PostgreSQL drivers get from SQL functions and triggers. It needs
+// no database, which makes it suitable for fast unit tests and small
+// single-process deployments. All data is lost when the process exits.
+//
+//	drv := memory.New()
+//	client, err := agentpg.NewClient(drv, &agentpg.ClientConfig{APIKey: apiKey})
+//
+// Several clients in one process can share data by creating their drivers
+// from the same Store with NewWithStore.
+package memory
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// ErrTxClosed is returned when a committed or rolled back transaction is used.
+var ErrTxClosed = errors.New("memory: transaction is closed")
+
+// Driver implements driver.Driver in memory.
+type Driver struct {
+	store    *Store
+	listener *Listener
+}
+
+// New creates a driver backed by a new, empty Store.
+func New() *Driver {
+	return NewWithStore(NewStore())
+}
+
+// NewWithStore creates a driver backed by the given Store. Drivers sharing a
+// Store see the same data and receive the same notifications, like clients
+// connected to the same database.
+func NewWithStore(store *Store) *Driver {
+	return &Driver{store: store}
+}
+
+// Store returns the store interface for database operations.
+func (d *Driver) Store() driver.Store[*Tx] {
+	return d.store
+}
+
+// Listener returns the listener for notifications.
+// The listener is created lazily on first call.
+func (d *Driver) Listener() driver.Listener {
+	if d.listener == nil {
+		d.listener = newListener(d.store)
+	}
+	return d.listener
+}
+
+// BeginTx starts a new transaction.
+func (d *Driver) BeginTx(ctx context.Context) (*Tx, error) {
+	return &Tx{store: d.store}, nil
+}
+
+// CommitTx commits a transaction.
+func (d *Driver) CommitTx(ctx context.Context, tx *Tx) error {
+	return tx.Commit()
+}
+
+// RollbackTx rolls back a transaction.
+func (d *Driver) RollbackTx(ctx context.Context, tx *Tx) error {
+	return tx.Rollback()
+}
+
+// Close closes the driver and releases resources.
+func (d *Driver) Close() error {
+	if d.listener != nil {
+		return d.listener.Close()
+	}
+	return nil
+}
+
+// Tx is an in-memory transaction.
+//
+// Writes made through a transaction are applied immediately but rows it
+// creates stay invisible to other readers, and its notifications are held
+// back, until Commit. Rollback undoes the writes.
+type Tx struct {
+	store         *Store
+	undo          []func()
+	created       []uuid.UUID // Rows hidden until commit
+	notifications []driver.Notification
+	done          bool
+}
+
+// Commit makes the transaction's rows visible and delivers its notifications.
+func (tx *Tx) Commit() error {
+	s := tx.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tx.done {
+		return ErrTxClosed
+	}
+	tx.done = true
+
+	for _, key := range tx.created {
+		delete(s.uncommitted, key)
+	}
+	for _, n := range tx.notifications {
+		s.deliver(n)
+	}
+	return nil
+}
+
+// Rollback undoes the transaction's writes.
+func (tx *Tx) Rollback() error {
+	s := tx.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tx.done {
+		return ErrTxClosed
+	}
+	tx.done = true
+
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	for _, key := range tx.created {
+		delete(s.uncommitted, key)
+	}
+	return nil
+}
+
+// Compile-time check that Driver implements driver.Driver
+var _ driver.Driver[*Tx] = (*Driver)(nil)
@@ -0,0 +1,135 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// Listener implements driver.Listener for the notifications raised by a Store.
+//
+// Notifications are queued without bound and delivered in order, so store
+// operations never block on a slow consumer.
+type Listener struct {
+	store    *Store
+	notifCh  chan driver.Notification
+	wake     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+	channels map[string]bool
+	queue    []driver.Notification
+	started  bool
+	closed   bool
+}
+
+func newListener(store *Store) *Listener {
+	return &Listener{
+		store:    store,
+		notifCh:  make(chan driver.Notification, 100),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		channels: make(map[string]bool),
+	}
+}
+
+// Listen starts listening for notifications on the specified channels.
+func (l *Listener) Listen(ctx context.Context, channels ...string) error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	for _, channel := range channels {
+		l.channels[channel] = true
+	}
+	start := !l.started
+	l.started = true
+	l.mu.Unlock()
+
+	if start {
+		l.store.addListener(l)
+		go l.forwardLoop(ctx)
+	}
+
+	return nil
+}
+
+// enqueue queues a notification if the listener subscribed to its channel.
+// It is called by the store with its lock held and never blocks.
+func (l *Listener) enqueue(n driver.Notification) {
+	l.mu.Lock()
+	if l.closed || !l.channels[n.Channel] {
+		l.mu.Unlock()
+		return
+	}
+	l.queue = append(l.queue, n)
+	l.mu.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forwardLoop moves queued notifications to the notification channel.
+func (l *Listener) forwardLoop(ctx context.Context) {
+	// Only this goroutine sends on notifCh, so it is the one to close it
+	defer close(l.notifCh)
+
+	for {
+		l.mu.Lock()
+		queue := l.queue
+		l.queue = nil
+		l.mu.Unlock()
+
+		for _, n := range queue {
+			select {
+			case l.notifCh <- n:
+			case <-l.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-l.wake:
+		case <-l.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Notifications returns a channel for receiving notifications.
+func (l *Listener) Notifications() <-chan driver.Notification {
+	return l.notifCh
+}
+
+// Close stops listening and releases resources.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	started := l.started
+	l.mu.Unlock()
+
+	// Signal shutdown
+	close(l.done)
+
+	if started {
+		l.store.removeListener(l)
+	} else {
+		close(l.notifCh)
+	}
+
+	return nil
+}
+
+// Compile-time check
+var _ driver.Listener = (*Listener)(nil)
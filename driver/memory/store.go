@@ -0,0 +1,3430 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// Store implements driver.Store in memory.
+//
+// A single mutex serializes all operations, which gives every method the
+// atomicity the SQL drivers get from statements and stored procedures.
+// Rows are copied on the way in and out, so callers never share memory
+// with the store.
+type Store struct {
+	mu sync.Mutex
+
+	sessions         map[uuid.UUID]*driver.Session
+	agents           map[uuid.UUID]*driver.AgentDefinition
+	tools            map[string]*driver.ToolDefinition
+	runs             map[uuid.UUID]*driver.Run
+	iterations       map[uuid.UUID]*driver.Iteration
+	toolExecutions   map[uuid.UUID]*driver.ToolExecution
+	messages         map[uuid.UUID]*driver.Message
+	instances        map[string]*driver.Instance
+	instanceTools    map[string]map[string]time.Time // instance ID -> tool name -> registered at
+	leader           *leaderLease
+	compactionEvents map[uuid.UUID]*driver.CompactionEvent
+	archive          map[uuid.UUID]*archivedMessage
+	schedules        map[uuid.UUID]*driver.Schedule
+	rateLimits       map[string]*rateLimitRow             // model -> rate-limit buckets
+	auditLog         []*driver.AuditEvent                 // oldest first
+	agentVersions    map[uuid.UUID][]*driver.AgentVersion // agent ID -> versions, oldest first
+
+	// Rows created by open transactions, hidden from other readers
+	uncommitted map[uuid.UUID]*Tx
+
+	listeners []*Listener
+	clock     time.Time // Last timestamp handed out by now
+}
+
+type leaderLease struct {
+	leaderID  string
+	electedAt time.Time
+	expiresAt time.Time
+}
+
+// rateLimitRow holds the rate-limit buckets of a model.
+type rateLimitRow struct {
+	requests     rateLimitBucket
+	inputTokens  rateLimitBucket
+	outputTokens rateLimitBucket
+	blockedUntil *time.Time
+	refilledAt   time.Time
+}
+
+// rateLimitBucket is a token bucket refilled at limit per minute. A bucket
+// is unknown until a response reports it.
+type rateLimitBucket struct {
+	known     bool
+	limit     int
+	available float64
+}
+
+// refill adds what the bucket regained in elapsed, capped at the limit.
+func (b *rateLimitBucket) refill(elapsed time.Duration) {
+	if b.known {
+		b.available = min(float64(b.limit), b.available+float64(b.limit)*elapsed.Minutes())
+	}
+}
+
+// wait returns how long until the bucket has at least 1 available.
+func (b *rateLimitBucket) wait() time.Duration {
+	if !b.known || b.available >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.available) / float64(b.limit) * float64(time.Minute))
+}
+
+// record updates the refilled bucket from a response (see
+// agentpg_record_rate_limit).
+func (b *rateLimitBucket) record(limit, remaining *int, used int) {
+	if limit != nil && *limit > 0 {
+		b.limit = *limit
+	}
+	switch {
+	case !b.known:
+		if remaining != nil && b.limit > 0 {
+			b.known = true
+			b.available = float64(*remaining)
+		}
+	case remaining == nil:
+		b.available -= float64(used)
+	default:
+		b.available = min(b.available-float64(used), float64(*remaining))
+	}
+}
+
+type archivedMessage struct {
+	CompactionEventID uuid.UUID
+	SessionID         uuid.UUID
+	OriginalMessage   map[string]any
+	ArchivedAt        time.Time
+}
+
+// NewStore creates an empty Store.
+func NewStore() *Store {
+	return &Store{
+		sessions:         make(map[uuid.UUID]*driver.Session),
+		agents:           make(map[uuid.UUID]*driver.AgentDefinition),
+		tools:            make(map[string]*driver.ToolDefinition),
+		runs:             make(map[uuid.UUID]*driver.Run),
+		iterations:       make(map[uuid.UUID]*driver.Iteration),
+		toolExecutions:   make(map[uuid.UUID]*driver.ToolExecution),
+		messages:         make(map[uuid.UUID]*driver.Message),
+		instances:        make(map[string]*driver.Instance),
+		instanceTools:    make(map[string]map[string]time.Time),
+		compactionEvents: make(map[uuid.UUID]*driver.CompactionEvent),
+		archive:          make(map[uuid.UUID]*archivedMessage),
+		schedules:        make(map[uuid.UUID]*driver.Schedule),
+		rateLimits:       make(map[string]*rateLimitRow),
+		agentVersions:    make(map[uuid.UUID][]*driver.AgentVersion),
+		uncommitted:      make(map[uuid.UUID]*Tx),
+	}
+}
+
+// now returns the current time, strictly later than any time it returned
+// before. This keeps created_at ordering stable for rows created in the
+// same clock tick.
+func (s *Store) now() time.Time {
+	t := time.Now().Round(0)
+	if !t.After(s.clock) {
+		t = s.clock.Add(time.Microsecond)
+	}
+	s.clock = t
+	return t
+}
+
+// hidden reports whether a row was created by a transaction that has not
+// committed yet.
+func (s *Store) hidden(id uuid.UUID) bool {
+	_, ok := s.uncommitted[id]
+	return ok
+}
+
+// Session operations
+
+func (s *Store) CreateSession(ctx context.Context, params driver.CreateSessionParams) (*driver.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createSession(nil, params)
+}
+
+func (s *Store) CreateSessionTx(ctx context.Context, tx *Tx, params driver.CreateSessionParams) (*driver.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tx.done {
+		return nil, ErrTxClosed
+	}
+	return s.createSession(tx, params)
+}
+
+func (s *Store) createSession(tx *Tx, params driver.CreateSessionParams) (*driver.Session, error) {
+	var depth int
+	if params.ParentSessionID != nil {
+		parent, ok := s.sessions[*params.ParentSessionID]
+		if !ok {
+			return nil, fmt.Errorf("failed to get parent session depth: session %s not found", *params.ParentSessionID)
+		}
+		depth = parent.Depth + 1
+	}
+
+	now := s.now()
+	session := &driver.Session{
+		ID:              uuid.New(),
+		ParentSessionID: clonePtr(params.ParentSessionID),
+		Depth:           depth,
+		Metadata:        cloneJSON(params.Metadata),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	s.sessions[session.ID] = session
+
+	if tx != nil {
+		s.uncommitted[session.ID] = tx
+		tx.created = append(tx.created, session.ID)
+		tx.undo = append(tx.undo, func() {
+			delete(s.sessions, session.ID)
+		})
+	}
+
+	return copySession(session), nil
+}
+
+func (s *Store) GetSession(ctx context.Context, id uuid.UUID) (*driver.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || s.hidden(id) {
+		return nil, nil
+	}
+	return copySession(session), nil
+}
+
+func (s *Store) UpdateSession(ctx context.Context, id uuid.UUID, updates map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+
+	updated := copySession(session)
+	for k, v := range updates {
+		var err error
+		switch k {
+		case "metadata":
+			updated.Metadata, err = toJSONMap(v)
+		case "compaction_count":
+			updated.CompactionCount, err = toInt(v)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update session column %q: %w", k, err)
+		}
+	}
+	updated.UpdatedAt = s.now()
+	s.sessions[id] = updated
+	return nil
+}
+
+func (s *Store) ListSessions(ctx context.Context, params driver.ListSessionsParams) ([]*driver.Session, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(params.MetadataFilter)
+	var matched []*driver.Session
+	for id, session := range s.sessions {
+		if s.hidden(id) {
+			continue
+		}
+		if len(filter) > 0 && !jsonContains(session.Metadata, filter) {
+			continue
+		}
+		if params.ParentSessionID != nil && (session.ParentSessionID == nil || *session.ParentSessionID != *params.ParentSessionID) {
+			continue
+		}
+		matched = append(matched, session)
+	}
+
+	orderBy := func(session *driver.Session) time.Time { return session.CreatedAt }
+	if params.OrderBy == "updated_at" {
+		orderBy = func(session *driver.Session) time.Time { return session.UpdatedAt }
+	}
+	asc := params.OrderDir == "asc"
+	sort.SliceStable(matched, func(i, j int) bool {
+		if asc {
+			return orderBy(matched[i]).Before(orderBy(matched[j]))
+		}
+		return orderBy(matched[i]).After(orderBy(matched[j]))
+	})
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 25
+	}
+	page := paginate(matched, params.Offset, limit)
+
+	sessions := make([]*driver.Session, 0, len(page))
+	for _, session := range page {
+		sessions = append(sessions, copySession(session))
+	}
+	return sessions, len(matched), nil
+}
+
+func (s *Store) ForkSession(ctx context.Context, params driver.ForkSessionParams) (*driver.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The fork point must belong to the root-level conversation, not to a
+	// child run (agent-as-tool) sharing the session
+	inRootContext := func(msg *driver.Message) bool {
+		if msg.SessionID != params.SessionID {
+			return false
+		}
+		if msg.RunID == nil {
+			return true
+		}
+		owner, ok := s.runs[*msg.RunID]
+		return ok && owner.SessionID == params.SessionID && owner.Depth == 0
+	}
+	forkPoint, ok := s.messages[params.AtMessageID]
+	if !ok || !inRootContext(forkPoint) {
+		return nil, driver.ErrForkPointNotFound
+	}
+
+	session, err := s.createSession(nil, driver.CreateSessionParams{
+		ParentSessionID: &params.SessionID,
+		Metadata:        params.Metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+	session.ForkedFromMessageID = &params.AtMessageID
+	s.sessions[session.ID] = copySession(session)
+
+	// Copy each message with its content blocks, keeping the original
+	// timestamps so the fork orders its history like the source session
+	msgs := s.selectMessages(func(msg *driver.Message) bool {
+		return inRootContext(msg) && !msg.CreatedAt.After(forkPoint.CreatedAt)
+	})
+	for _, msg := range msgs {
+		c := copyMessage(msg)
+		c.ID = uuid.New()
+		c.SessionID = session.ID
+		c.RunID = nil
+		s.messages[c.ID] = c
+	}
+
+	return session, nil
+}
+
+func (s *Store) ImportSession(ctx context.Context, params driver.ImportSessionParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Validate everything first, like the foreign keys and primary keys the
+	// SQL drivers check in their transaction: nothing can be undone once
+	// rows change
+	session := params.Session
+	if _, ok := s.sessions[session.ID]; ok {
+		return fmt.Errorf("failed to import session: session %s already exists", session.ID)
+	}
+	if session.ParentSessionID != nil {
+		if _, ok := s.sessions[*session.ParentSessionID]; !ok {
+			return fmt.Errorf("failed to import session: parent session %s not found", *session.ParentSessionID)
+		}
+	}
+	if session.ForkedFromMessageID != nil {
+		if _, ok := s.messages[*session.ForkedFromMessageID]; !ok {
+			return fmt.Errorf("failed to import session: message %s not found", *session.ForkedFromMessageID)
+		}
+	}
+
+	messages, err := s.checkImportRuns(session.ID, params.Runs, params.Messages, params.Iterations, params.ToolExecutions)
+	if err != nil {
+		return err
+	}
+
+	events := make(map[uuid.UUID]bool, len(params.CompactionEvents))
+	for _, event := range params.CompactionEvents {
+		if _, ok := s.compactionEvents[event.ID]; ok || events[event.ID] {
+			return fmt.Errorf("failed to import compaction event: compaction event %s already exists", event.ID)
+		}
+		if event.SessionID != session.ID {
+			return fmt.Errorf("failed to import compaction event %s: session %s not found", event.ID, event.SessionID)
+		}
+		if event.SummaryMessageID != nil && !messages[*event.SummaryMessageID] {
+			return fmt.Errorf("failed to import compaction event %s: message %s not found", event.ID, *event.SummaryMessageID)
+		}
+		events[event.ID] = true
+	}
+
+	archived := make(map[uuid.UUID]bool, len(params.ArchivedMessages))
+	for _, msg := range params.ArchivedMessages {
+		if _, ok := s.archive[msg.ID]; ok || archived[msg.ID] {
+			return fmt.Errorf("failed to import archived message: message %s is already archived", msg.ID)
+		}
+		if msg.SessionID != session.ID {
+			return fmt.Errorf("failed to import archived message %s: session %s not found", msg.ID, msg.SessionID)
+		}
+		if msg.CompactionEventID == nil || !events[*msg.CompactionEventID] {
+			return fmt.Errorf("failed to import archived message %s: compaction event not found", msg.ID)
+		}
+		archived[msg.ID] = true
+	}
+
+	s.sessions[session.ID] = copySession(session)
+	s.insertImportedRuns(params.Runs, params.Messages, params.Iterations, params.ToolExecutions)
+	for _, event := range params.CompactionEvents {
+		s.compactionEvents[event.ID] = copyCompactionEvent(event)
+	}
+	for _, msg := range params.ArchivedMessages {
+		s.archive[msg.ID] = &archivedMessage{
+			CompactionEventID: *msg.CompactionEventID,
+			SessionID:         msg.SessionID,
+			OriginalMessage:   cloneJSON(msg.OriginalMessage),
+			ArchivedAt:        msg.ArchivedAt,
+		}
+	}
+	return nil
+}
+
+func (s *Store) ImportRuns(ctx context.Context, params driver.ImportRunsParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(params.Runs) == 0 {
+		return nil
+	}
+	sessionID := params.Runs[0].SessionID
+	if _, ok := s.sessions[sessionID]; !ok {
+		return fmt.Errorf("failed to import run %s: session %s not found", params.Runs[0].ID, sessionID)
+	}
+	if _, err := s.checkImportRuns(sessionID, params.Runs, params.Messages, params.Iterations, params.ToolExecutions); err != nil {
+		return err
+	}
+	s.insertImportedRuns(params.Runs, params.Messages, params.Iterations, params.ToolExecutions)
+	return nil
+}
+
+// checkImportRuns validates imported runs of a session with their messages,
+// iterations and tool executions, and returns the IDs of the messages.
+func (s *Store) checkImportRuns(sessionID uuid.UUID, runs []*driver.Run, messages []*driver.Message, iterations []*driver.Iteration, execs []*driver.ToolExecution) (map[uuid.UUID]bool, error) {
+	imported := make(map[uuid.UUID]bool, len(runs))
+	for _, run := range runs {
+		if _, ok := s.runs[run.ID]; ok || imported[run.ID] {
+			return nil, fmt.Errorf("failed to import run: run %s already exists", run.ID)
+		}
+		if run.SessionID != sessionID {
+			return nil, fmt.Errorf("failed to import run %s: session %s not found", run.ID, run.SessionID)
+		}
+		if _, ok := s.agents[run.AgentID]; !ok {
+			return nil, fmt.Errorf("failed to import run %s: agent %s not found", run.ID, run.AgentID)
+		}
+		if run.ParentRunID != nil && !imported[*run.ParentRunID] {
+			return nil, fmt.Errorf("failed to import run %s: parent run %s not found", run.ID, *run.ParentRunID)
+		}
+		if run.IdempotencyKey != nil {
+			for _, other := range s.runs {
+				if other.SessionID == run.SessionID && other.IdempotencyKey != nil && *other.IdempotencyKey == *run.IdempotencyKey {
+					return nil, fmt.Errorf("failed to import run %s: idempotency key %q already in use", run.ID, *run.IdempotencyKey)
+				}
+			}
+		}
+		imported[run.ID] = true
+	}
+
+	messageIDs := make(map[uuid.UUID]bool, len(messages))
+	for _, msg := range messages {
+		if _, ok := s.messages[msg.ID]; ok || messageIDs[msg.ID] {
+			return nil, fmt.Errorf("failed to import message: message %s already exists", msg.ID)
+		}
+		if msg.SessionID != sessionID {
+			return nil, fmt.Errorf("failed to import message %s: session %s not found", msg.ID, msg.SessionID)
+		}
+		messageIDs[msg.ID] = true
+	}
+
+	iterationIDs := make(map[uuid.UUID]bool, len(iterations))
+	numbers := make(map[uuid.UUID]map[int]bool)
+	for _, iter := range iterations {
+		if _, ok := s.iterations[iter.ID]; ok || iterationIDs[iter.ID] {
+			return nil, fmt.Errorf("failed to import iteration: iteration %s already exists", iter.ID)
+		}
+		if !imported[iter.RunID] {
+			return nil, fmt.Errorf("failed to import iteration %s: run %s not found", iter.ID, iter.RunID)
+		}
+		if numbers[iter.RunID] == nil {
+			numbers[iter.RunID] = make(map[int]bool)
+		}
+		if numbers[iter.RunID][iter.IterationNumber] {
+			return nil, fmt.Errorf("failed to import iteration %s: iteration %d of run %s already exists", iter.ID, iter.IterationNumber, iter.RunID)
+		}
+		numbers[iter.RunID][iter.IterationNumber] = true
+		if iter.ResponseMessageID != nil && !messageIDs[*iter.ResponseMessageID] {
+			return nil, fmt.Errorf("failed to import iteration %s: message %s not found", iter.ID, *iter.ResponseMessageID)
+		}
+		iterationIDs[iter.ID] = true
+	}
+
+	execIDs := make(map[uuid.UUID]bool, len(execs))
+	for _, exec := range execs {
+		if _, ok := s.toolExecutions[exec.ID]; ok || execIDs[exec.ID] {
+			return nil, fmt.Errorf("failed to import tool execution: tool execution %s already exists", exec.ID)
+		}
+		if !imported[exec.RunID] || !iterationIDs[exec.IterationID] {
+			return nil, fmt.Errorf("failed to import tool execution %s: run %s or iteration %s not found", exec.ID, exec.RunID, exec.IterationID)
+		}
+		if exec.AgentID != nil {
+			if _, ok := s.agents[*exec.AgentID]; !ok {
+				return nil, fmt.Errorf("failed to import tool execution %s: agent %s not found", exec.ID, *exec.AgentID)
+			}
+		}
+		if exec.ChildRunID != nil && !imported[*exec.ChildRunID] {
+			return nil, fmt.Errorf("failed to import tool execution %s: run %s not found", exec.ID, *exec.ChildRunID)
+		}
+		execIDs[exec.ID] = true
+	}
+	for _, run := range runs {
+		if run.CurrentIterationID != nil && !iterationIDs[*run.CurrentIterationID] {
+			return nil, fmt.Errorf("failed to link run %s: iteration %s not found", run.ID, *run.CurrentIterationID)
+		}
+		if run.ParentToolExecutionID != nil && !execIDs[*run.ParentToolExecutionID] {
+			return nil, fmt.Errorf("failed to link run %s: tool execution %s not found", run.ID, *run.ParentToolExecutionID)
+		}
+	}
+
+	return messageIDs, nil
+}
+
+// insertImportedRuns stores runs validated by checkImportRuns with their
+// messages, iterations and tool executions.
+func (s *Store) insertImportedRuns(runs []*driver.Run, messages []*driver.Message, iterations []*driver.Iteration, execs []*driver.ToolExecution) {
+	for _, run := range runs {
+		s.insertRun(nil, copyRun(run))
+	}
+	for _, msg := range messages {
+		c := copyMessage(msg)
+		if c.RunID != nil {
+			if _, ok := s.runs[*c.RunID]; !ok {
+				c.RunID = nil
+			}
+		}
+		s.messages[c.ID] = c
+	}
+	for _, iter := range iterations {
+		s.iterations[iter.ID] = copyIteration(iter)
+	}
+	for _, exec := range execs {
+		s.toolExecutions[exec.ID] = copyToolExecution(exec)
+		if exec.State == "pending" {
+			s.notify(nil, channelToolPending, map[string]any{
+				"execution_id":  exec.ID,
+				"run_id":        exec.RunID,
+				"tool_name":     exec.ToolName,
+				"is_agent_tool": exec.IsAgentTool,
+				"agent_id":      exec.AgentID,
+			})
+		}
+	}
+}
+
+func (s *Store) DeleteSession(ctx context.Context, id uuid.UUID) (*driver.PurgeCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[id]; !ok || s.hidden(id) {
+		return nil, nil
+	}
+	ids := []uuid.UUID{id}
+	for i := 0; i < len(ids); i++ {
+		for childID, child := range s.sessions {
+			if child.ParentSessionID != nil && *child.ParentSessionID == ids[i] {
+				ids = append(ids, childID)
+			}
+		}
+	}
+	for _, sessionID := range ids {
+		if err := s.checkSessionIdle(sessionID, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	counts := &driver.PurgeCounts{}
+	// Children first, like the cascade from the parent
+	for i := len(ids) - 1; i >= 0; i-- {
+		s.deleteSession(ids[i], counts)
+	}
+	return counts, nil
+}
+
+func (s *Store) GetMetadataValues(ctx context.Context, key string) ([]driver.MetadataValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for id, session := range s.sessions {
+		if s.hidden(id) {
+			continue
+		}
+		v, ok := session.Metadata[key]
+		if !ok || v == nil {
+			continue
+		}
+		counts[jsonText(v)]++
+	}
+
+	values := make([]driver.MetadataValue, 0, len(counts))
+	for value, count := range counts {
+		values = append(values, driver.MetadataValue{Value: value, SessionCount: count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].SessionCount != values[j].SessionCount {
+			return values[i].SessionCount > values[j].SessionCount
+		}
+		return values[i].Value < values[j].Value
+	})
+	return values, nil
+}
+
+// Agent operations
+
+func (s *Store) CreateAgent(ctx context.Context, agent *driver.AgentDefinition) (*driver.AgentDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	result := copyAgent(agent)
+	result.ID = uuid.New()
+	result.CreatedAt = now
+	result.UpdatedAt = now
+	normalizeAgent(result)
+
+	if s.agentNameTaken(result.ID, result.Name, result.Metadata) {
+		return nil, fmt.Errorf("failed to create agent: agent %q already exists with the same metadata", result.Name)
+	}
+
+	s.saveAgent(result)
+	return copyAgent(result), nil
+}
+
+func (s *Store) UpdateAgent(ctx context.Context, agent *driver.AgentDefinition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.agents[agent.ID]
+	if !ok {
+		return nil
+	}
+
+	updated := copyAgent(agent)
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = s.now()
+	normalizeAgent(updated)
+
+	if s.agentNameTaken(updated.ID, updated.Name, updated.Metadata) {
+		return fmt.Errorf("failed to update agent: agent %q already exists with the same metadata", updated.Name)
+	}
+
+	s.saveAgent(updated)
+	return nil
+}
+
+// agentNameTaken enforces the (name, metadata) unique constraint.
+func (s *Store) agentNameTaken(id uuid.UUID, name string, metadata map[string]any) bool {
+	for _, other := range s.agents {
+		if other.ID != id && other.Name == name && jsonEqual(other.Metadata, metadata) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAgent applies the NOT NULL defaults of the agents table.
+func normalizeAgent(agent *driver.AgentDefinition) {
+	if agent.ToolNames == nil {
+		agent.ToolNames = []string{}
+	}
+	if agent.AgentIDs == nil {
+		agent.AgentIDs = []uuid.UUID{}
+	}
+	if agent.FallbackModels == nil {
+		agent.FallbackModels = []string{}
+	}
+}
+
+func (s *Store) GetAgent(ctx context.Context, id uuid.UUID) (*driver.AgentDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, ok := s.agents[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyAgent(agent), nil
+}
+
+func (s *Store) GetAgentByName(ctx context.Context, name string, metadata map[string]any) (*driver.AgentDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(metadata)
+	var found *driver.AgentDefinition
+	for _, agent := range s.agents {
+		if agent.Name != name {
+			continue
+		}
+		if len(filter) > 0 && !jsonContains(agent.Metadata, filter) {
+			continue
+		}
+		// Pick the oldest match so repeated lookups are stable
+		if found == nil || agent.CreatedAt.Before(found.CreatedAt) {
+			found = agent
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	return copyAgent(found), nil
+}
+
+func (s *Store) DeleteAgent(ctx context.Context, id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.agents[id]; !ok {
+		return nil
+	}
+
+	// Runs and tool executions reference agents without ON DELETE
+	for _, run := range s.runs {
+		if run.AgentID == id {
+			return fmt.Errorf("failed to delete agent: agent %s is still referenced by runs", id)
+		}
+	}
+	for _, exec := range s.toolExecutions {
+		if exec.AgentID != nil && *exec.AgentID == id {
+			return fmt.Errorf("failed to delete agent: agent %s is still referenced by tool executions", id)
+		}
+	}
+
+	delete(s.agents, id)
+
+	// ON DELETE CASCADE
+	delete(s.agentVersions, id)
+	for name, tool := range s.tools {
+		if tool.AgentID != nil && *tool.AgentID == id {
+			s.deleteTool(name)
+		}
+	}
+	for schedID, sched := range s.schedules {
+		if sched.AgentID == id {
+			delete(s.schedules, schedID)
+		}
+	}
+	return nil
+}
+
+func (s *Store) ListAgents(ctx context.Context, params driver.ListAgentsParams) ([]*driver.AgentDefinition, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(params.MetadataFilter)
+	name := strings.ToLower(params.Name)
+	var matched []*driver.AgentDefinition
+	for _, agent := range s.agents {
+		if len(filter) > 0 && !jsonContains(agent.Metadata, filter) {
+			continue
+		}
+		if name != "" && !strings.Contains(strings.ToLower(agent.Name), name) {
+			continue
+		}
+		matched = append(matched, agent)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].Name != matched[j].Name {
+			return matched[i].Name < matched[j].Name
+		}
+		return matched[i].CreatedAt.Before(matched[j].CreatedAt)
+	})
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	page := paginate(matched, params.Offset, limit)
+
+	agents := make([]*driver.AgentDefinition, 0, len(page))
+	for _, agent := range page {
+		agents = append(agents, copyAgent(agent))
+	}
+	return agents, len(matched), nil
+}
+
+// Agent version operations
+
+func (s *Store) ListAgentVersions(ctx context.Context, agentID uuid.UUID) ([]*driver.AgentVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := s.agentVersions[agentID]
+	versions := make([]*driver.AgentVersion, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		versions = append(versions, copyAgentVersion(stored[i]))
+	}
+	return versions, nil
+}
+
+func (s *Store) GetAgentVersion(ctx context.Context, agentID uuid.UUID, version int) (*driver.AgentVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.agentVersions[agentID] {
+		if v.Version == version {
+			return copyAgentVersion(v), nil
+		}
+	}
+	return nil, nil
+}
+
+// Tool operations
+
+func (s *Store) UpsertTool(ctx context.Context, tool *driver.ToolDefinition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tool.AgentID != nil {
+		if _, ok := s.agents[*tool.AgentID]; !ok {
+			return fmt.Errorf("failed to upsert tool: agent %s not found", *tool.AgentID)
+		}
+	}
+
+	now := s.now()
+	updated := copyTool(tool)
+	updated.CreatedAt = now
+	updated.UpdatedAt = now
+	if existing, ok := s.tools[tool.Name]; ok {
+		updated.CreatedAt = existing.CreatedAt
+	}
+	s.tools[updated.Name] = updated
+	return nil
+}
+
+func (s *Store) GetTool(ctx context.Context, name string) (*driver.ToolDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tool, ok := s.tools[name]
+	if !ok {
+		return nil, nil
+	}
+	return copyTool(tool), nil
+}
+
+func (s *Store) DeleteTool(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteTool(name)
+	return nil
+}
+
+// deleteTool deletes a tool and, like ON DELETE CASCADE, its instance registrations.
+func (s *Store) deleteTool(name string) {
+	delete(s.tools, name)
+	for _, tools := range s.instanceTools {
+		delete(tools, name)
+	}
+}
+
+func (s *Store) ListTools(ctx context.Context) ([]*driver.ToolDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tools := make([]*driver.ToolDefinition, 0, len(s.tools))
+	for _, tool := range s.tools {
+		tools = append(tools, copyTool(tool))
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].Name < tools[j].Name })
+	return tools, nil
+}
+
+// Run operations
+
+func (s *Store) CreateRun(ctx context.Context, params driver.CreateRunParams) (*driver.Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createRun(nil, params)
+}
+
+func (s *Store) CreateRunTx(ctx context.Context, tx *Tx, params driver.CreateRunParams) (*driver.Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tx.done {
+		return nil, ErrTxClosed
+	}
+	return s.createRun(tx, params)
+}
+
+func (s *Store) createRun(tx *Tx, params driver.CreateRunParams) (*driver.Run, error) {
+	now := s.now()
+
+	// Default run_mode to "batch" if not specified
+	runMode := params.RunMode
+	if runMode == "" {
+		runMode = "batch"
+	}
+
+	var idempotencyKey *string
+	if params.IdempotencyKey != "" {
+		key := params.IdempotencyKey
+		idempotencyKey = &key
+
+		for _, run := range s.runs {
+			if run.SessionID != params.SessionID || run.IdempotencyKey == nil || *run.IdempotencyKey != key {
+				continue
+			}
+			// Release the key if its run is older than the retention window so it can be reused
+			if run.CreatedAt.Before(now.Add(-params.IdempotencyTTL)) {
+				run.IdempotencyKey = nil
+				if tx != nil {
+					released := run
+					tx.undo = append(tx.undo, func() {
+						released.IdempotencyKey = &key
+					})
+				}
+				continue
+			}
+			// Key already in use: return the existing run
+			if err := checkIdempotentRun(run, params); err != nil {
+				return nil, err
+			}
+			return copyRun(run), nil
+		}
+	}
+
+	if _, ok := s.sessions[params.SessionID]; !ok {
+		return nil, fmt.Errorf("failed to create run: session %s not found", params.SessionID)
+	}
+	if _, ok := s.agents[params.AgentID]; !ok {
+		return nil, fmt.Errorf("failed to create run: agent %s not found", params.AgentID)
+	}
+	if params.ParentRunID != nil {
+		if _, ok := s.runs[*params.ParentRunID]; !ok {
+			return nil, fmt.Errorf("failed to create run: parent run %s not found", *params.ParentRunID)
+		}
+	}
+	if params.ParentToolExecutionID != nil {
+		if _, ok := s.toolExecutions[*params.ParentToolExecutionID]; !ok {
+			return nil, fmt.Errorf("failed to create run: parent tool execution %s not found", *params.ParentToolExecutionID)
+		}
+	}
+
+	createdBy := params.CreatedByInstanceID
+	run := &driver.Run{
+		ID:                    uuid.New(),
+		SessionID:             params.SessionID,
+		AgentID:               params.AgentID,
+		RunMode:               runMode,
+		ParentRunID:           clonePtr(params.ParentRunID),
+		ParentToolExecutionID: clonePtr(params.ParentToolExecutionID),
+		Depth:                 params.Depth,
+		State:                 "pending",
+		Prompt:                params.Prompt,
+		CreatedByInstanceID:   &createdBy,
+		Metadata:              cloneJSON(params.Metadata),
+		CreatedAt:             now,
+		IdempotencyKey:        idempotencyKey,
+		ScheduledAt:           now,
+	}
+	s.insertRun(tx, run)
+
+	return copyRun(run), nil
+}
+
+// checkIdempotentRun returns ErrIdempotencyConflict if the run holding an
+// idempotency key was created for a different agent, prompt, run mode or
+// metadata (the run's variables).
+func checkIdempotentRun(run *driver.Run, params driver.CreateRunParams) error {
+	runMode := params.RunMode
+	if runMode == "" {
+		runMode = "batch"
+	}
+	if run.AgentID != params.AgentID || run.Prompt != params.Prompt || run.RunMode != runMode ||
+		!sameMetadata(run.Metadata, params.Metadata) {
+		return fmt.Errorf("failed to create run: %w: key %q belongs to run %s", driver.ErrIdempotencyConflict, params.IdempotencyKey, run.ID)
+	}
+	return nil
+}
+
+// sameMetadata reports whether two metadata maps hold the same values once
+// encoded as JSON, the form stored metadata was read back from. A nil and an
+// empty map are the same.
+func sameMetadata(a, b map[string]any) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+func (s *Store) GetRun(ctx context.Context, id uuid.UUID) (*driver.Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run, ok := s.runs[id]
+	if !ok || s.hidden(id) {
+		return nil, nil
+	}
+	return copyRun(run), nil
+}
+
+func (s *Store) UpdateRun(ctx context.Context, id uuid.UUID, updates map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateRun(id, updates)
+}
+
+func (s *Store) UpdateRunState(ctx context.Context, id uuid.UUID, state driver.RunState, updates map[string]any) error {
+	if updates == nil {
+		updates = make(map[string]any)
+	}
+	updates["state"] = state
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateRun(id, updates)
+}
+
+func (s *Store) updateRun(id uuid.UUID, updates map[string]any) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	old, ok := s.runs[id]
+	if !ok {
+		return nil
+	}
+
+	run := copyRun(old)
+	if err := applyRunUpdates(run, updates); err != nil {
+		return err
+	}
+	s.saveRun(nil, old, run)
+	return nil
+}
+
+func (s *Store) ClaimRuns(ctx context.Context, instanceID string, maxCount int, runMode string) ([]*driver.Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var claimable []*driver.Run
+	for id, run := range s.runs {
+		if s.hidden(id) {
+			continue
+		}
+		if run.State != "pending" || run.ClaimedByInstanceID != nil || run.ScheduledAt.After(now) {
+			continue
+		}
+		if runMode != "" && run.RunMode != runMode {
+			continue
+		}
+		agent, ok := s.agents[run.AgentID]
+		if !ok {
+			continue
+		}
+		// Only claim if instance has ALL tools required by this agent
+		if !s.instanceHasTools(instanceID, agent.ToolNames) {
+			continue
+		}
+		claimable = append(claimable, run)
+	}
+	sort.Slice(claimable, func(i, j int) bool {
+		return claimable[i].CreatedAt.Before(claimable[j].CreatedAt)
+	})
+	claimable = limitRows(s.withinRunCaps(claimable), maxCount)
+
+	claimed := make([]*driver.Run, 0, len(claimable))
+	for _, old := range claimable {
+		run := copyRun(old)
+		run.ClaimedByInstanceID = &instanceID
+		run.ClaimedAt = &now
+		// Transition to appropriate state based on run mode
+		switch run.RunMode {
+		case "batch":
+			run.State = "batch_submitting"
+		case "streaming":
+			run.State = "streaming"
+		case "auto":
+			run.State = "batch_submitting"
+		}
+		pending := "pending"
+		run.PreviousState = &pending
+		if run.StartedAt == nil {
+			run.StartedAt = &now
+		}
+		s.saveRun(nil, old, run)
+		claimed = append(claimed, copyRun(run))
+	}
+	return claimed, nil
+}
+
+// withinRunCaps drops runs that would exceed their agent's MaxConcurrentRuns.
+// A run holds a slot from its first claim until it is finalized or awaits
+// input, so continuations (pending runs already started) are always kept.
+// Runs must be sorted in claim order.
+func (s *Store) withinRunCaps(runs []*driver.Run) []*driver.Run {
+	inProgress := make(map[uuid.UUID]int)
+	for id, run := range s.runs {
+		if s.hidden(id) || run.StartedAt == nil {
+			continue
+		}
+		if runTerminal(run.State) || run.State == "awaiting_input" {
+			continue
+		}
+		inProgress[run.AgentID]++
+	}
+
+	allowed := runs[:0:0]
+	for _, run := range runs {
+		if run.StartedAt == nil {
+			agent := s.agents[run.AgentID]
+			if agent.MaxConcurrentRuns != nil && inProgress[run.AgentID] >= *agent.MaxConcurrentRuns {
+				continue
+			}
+			inProgress[run.AgentID]++
+		}
+		allowed = append(allowed, run)
+	}
+	return allowed
+}
+
+// instanceHasTools reports whether an instance registered every named tool.
+func (s *Store) instanceHasTools(instanceID string, toolNames []string) bool {
+	registered := s.instanceTools[instanceID]
+	for _, name := range toolNames {
+		if _, ok := registered[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) GetRunsBySession(ctx context.Context, sessionID uuid.UUID, limit int) ([]*driver.Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := s.selectRuns(func(run *driver.Run) bool { return run.SessionID == sessionID })
+	sort.Slice(runs, func(i, j int) bool { return runs[i].CreatedAt.After(runs[j].CreatedAt) })
+	return copyRuns(limitRows(runs, limit)), nil
+}
+
+func (s *Store) GetStuckPendingToolsRuns(ctx context.Context, limit int) ([]*driver.Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Find runs that are in pending_tools state but have no pending tool executions
+	// This catches runs where all tools completed but the notification was missed
+	runs := s.selectRuns(func(run *driver.Run) bool {
+		if run.State != "pending_tools" || run.CurrentIterationID == nil {
+			return false
+		}
+		for _, exec := range s.toolExecutions {
+			if exec.IterationID == *run.CurrentIterationID && !toolExecutionTerminal(exec.State) {
+				return false
+			}
+		}
+		return true
+	})
+	sort.Slice(runs, func(i, j int) bool { return runs[i].CreatedAt.Before(runs[j].CreatedAt) })
+	return copyRuns(limitRows(runs, limit)), nil
+}
+
+func (s *Store) ListRuns(ctx context.Context, params driver.ListRunsParams) ([]*driver.Run, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(params.MetadataFilter)
+	runs := s.selectRuns(func(run *driver.Run) bool {
+		if len(filter) > 0 {
+			session, ok := s.sessions[run.SessionID]
+			if !ok || !jsonContains(session.Metadata, filter) {
+				return false
+			}
+		}
+		if params.SessionID != nil && run.SessionID != *params.SessionID {
+			return false
+		}
+		if params.AgentID != nil && run.AgentID != *params.AgentID {
+			return false
+		}
+		if params.State != "" && run.State != params.State {
+			return false
+		}
+		if params.RunMode != "" && run.RunMode != params.RunMode {
+			return false
+		}
+		return true
+	})
+	sort.Slice(runs, func(i, j int) bool { return runs[i].CreatedAt.After(runs[j].CreatedAt) })
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 25
+	}
+	return copyRuns(paginate(runs, params.Offset, limit)), len(runs), nil
+}
+
+// selectRuns returns the committed runs matching keep, in no particular order.
+func (s *Store) selectRuns(keep func(*driver.Run) bool) []*driver.Run {
+	var runs []*driver.Run
+	for id, run := range s.runs {
+		if !s.hidden(id) && keep(run) {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// Iteration operations
+
+func (s *Store) CreateIteration(ctx context.Context, params driver.CreateIterationParams) (*driver.Iteration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.runs[params.RunID]; !ok {
+		return nil, fmt.Errorf("failed to create iteration: run %s not found", params.RunID)
+	}
+	for _, iter := range s.iterations {
+		if iter.RunID == params.RunID && iter.IterationNumber == params.IterationNumber {
+			return nil, fmt.Errorf("failed to create iteration: iteration %d already exists for run %s", params.IterationNumber, params.RunID)
+		}
+	}
+
+	iter := &driver.Iteration{
+		ID:              uuid.New(),
+		RunID:           params.RunID,
+		IterationNumber: params.IterationNumber,
+		IsStreaming:     params.IsStreaming,
+		TriggerType:     params.TriggerType,
+		CreatedAt:       s.now(),
+		APIAttempts:     []driver.APIAttempt{},
+	}
+	s.iterations[iter.ID] = iter
+	return copyIteration(iter), nil
+}
+
+func (s *Store) GetIteration(ctx context.Context, id uuid.UUID) (*driver.Iteration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	iter, ok := s.iterations[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyIteration(iter), nil
+}
+
+func (s *Store) UpdateIteration(ctx context.Context, id uuid.UUID, updates map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+	old, ok := s.iterations[id]
+	if !ok {
+		return nil
+	}
+
+	iter := copyIteration(old)
+	if err := applyIterationUpdates(iter, updates); err != nil {
+		return err
+	}
+	s.iterations[id] = iter
+	return nil
+}
+
+func (s *Store) AddIterationAPIAttempt(ctx context.Context, id uuid.UUID, attempt driver.APIAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.iterations[id]; ok {
+		iter := copyIteration(old)
+		iter.APIAttempts = append(iter.APIAttempts, cloneAPIAttempt(attempt))
+		s.iterations[id] = iter
+	}
+	return nil
+}
+
+func (s *Store) GetIterationsForPoll(ctx context.Context, instanceID string, maxCount int) ([]*driver.Iteration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var iterations []*driver.Iteration
+	for _, iter := range s.iterations {
+		if !batchPolled(iter.BatchStatus) {
+			continue
+		}
+		run, ok := s.runs[iter.RunID]
+		if !ok || run.ClaimedByInstanceID == nil || *run.ClaimedByInstanceID != instanceID {
+			continue
+		}
+		if iter.BatchNextPollAt != nil && iter.BatchNextPollAt.After(now) {
+			continue
+		}
+		iterations = append(iterations, iter)
+	}
+	// Unscheduled iterations first, then the most overdue; a batch's
+	// iterations are kept together
+	sort.Slice(iterations, func(i, j int) bool {
+		a, b := iterations[i].BatchNextPollAt, iterations[j].BatchNextPollAt
+		if (a == nil) != (b == nil) {
+			return a == nil
+		}
+		if a != nil && !a.Equal(*b) {
+			return a.Before(*b)
+		}
+		x, y := iterations[i].BatchID, iterations[j].BatchID
+		return x != nil && y != nil && *x < *y
+	})
+
+	result := make([]*driver.Iteration, 0, len(iterations))
+	for _, iter := range limitRows(iterations, maxCount) {
+		result = append(result, copyIteration(iter))
+	}
+	return result, nil
+}
+
+// batchPolled reports whether iterations with the batch status are polled.
+func batchPolled(status *string) bool {
+	return status != nil && (*status == "in_progress" || *status == "canceling")
+}
+
+func (s *Store) GetIterationsByRun(ctx context.Context, runID uuid.UUID) ([]*driver.Iteration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var iterations []*driver.Iteration
+	for _, iter := range s.iterations {
+		if iter.RunID == runID {
+			iterations = append(iterations, copyIteration(iter))
+		}
+	}
+	sort.Slice(iterations, func(i, j int) bool {
+		return iterations[i].IterationNumber < iterations[j].IterationNumber
+	})
+	return iterations, nil
+}
+
+func (s *Store) GetIterationsByBatch(ctx context.Context, batchID string) ([]*driver.Iteration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var iterations []*driver.Iteration
+	for _, iter := range s.iterations {
+		if iter.BatchID != nil && *iter.BatchID == batchID {
+			iterations = append(iterations, copyIteration(iter))
+		}
+	}
+	sort.Slice(iterations, func(i, j int) bool {
+		if !iterations[i].CreatedAt.Equal(iterations[j].CreatedAt) {
+			return iterations[i].CreatedAt.Before(iterations[j].CreatedAt)
+		}
+		return iterations[i].ID.String() < iterations[j].ID.String()
+	})
+	return iterations, nil
+}
+
+func (s *Store) MarkBatchPolled(ctx context.Context, batchID string, nextPollAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for id, old := range s.iterations {
+		if old.BatchID == nil || *old.BatchID != batchID || !batchPolled(old.BatchStatus) {
+			continue
+		}
+		iter := copyIteration(old)
+		iter.BatchPollCount++
+		iter.BatchLastPollAt = &now
+		iter.BatchNextPollAt = &nextPollAt
+		s.iterations[id] = iter
+	}
+	return nil
+}
+
+func (s *Store) ScheduleBatchPoll(ctx context.Context, batchID string, nextPollAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, old := range s.iterations {
+		if old.BatchID == nil || *old.BatchID != batchID || !batchPolled(old.BatchStatus) {
+			continue
+		}
+		iter := copyIteration(old)
+		iter.BatchNextPollAt = &nextPollAt
+		s.iterations[id] = iter
+	}
+	return nil
+}
+
+// Tool execution operations
+
+func (s *Store) CreateToolExecution(ctx context.Context, params driver.CreateToolExecutionParams) (*driver.ToolExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkToolExecutionParams(params); err != nil {
+		return nil, fmt.Errorf("failed to create tool execution: %w", err)
+	}
+	exec := s.insertToolExecution(params, s.now())
+	return copyToolExecution(exec), nil
+}
+
+func (s *Store) CreateToolExecutions(ctx context.Context, params []driver.CreateToolExecutionParams) ([]*driver.ToolExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range params {
+		if err := s.checkToolExecutionParams(p); err != nil {
+			return nil, fmt.Errorf("failed to create tool execution: %w", err)
+		}
+	}
+
+	execs := make([]*driver.ToolExecution, 0, len(params))
+	for _, p := range params {
+		execs = append(execs, copyToolExecution(s.insertToolExecution(p, s.now())))
+	}
+	return execs, nil
+}
+
+func (s *Store) CreateToolExecutionsAndUpdateRunState(ctx context.Context, params []driver.CreateToolExecutionParams, runID uuid.UUID, state driver.RunState, runUpdates map[string]any) ([]*driver.ToolExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range params {
+		if err := s.checkToolExecutionParams(p); err != nil {
+			return nil, fmt.Errorf("failed to create tool executions and update run: %w", err)
+		}
+	}
+
+	// Validate the run updates before writing anything so the operation stays atomic
+	old, runExists := s.runs[runID]
+	var run *driver.Run
+	if runExists {
+		run = copyRun(old)
+		if err := applyRunStateUpdates(run, state, runUpdates, s.now()); err != nil {
+			return nil, fmt.Errorf("failed to create tool executions and update run: %w", err)
+		}
+	}
+
+	execs := make([]*driver.ToolExecution, 0, len(params))
+	for _, p := range params {
+		execs = append(execs, copyToolExecution(s.insertToolExecution(p, s.now())))
+	}
+
+	if runExists {
+		s.saveRun(nil, old, run)
+	}
+	return execs, nil
+}
+
+// applyRunStateUpdates mirrors the run UPDATE in
+// agentpg_create_tool_executions_and_update_run: only a fixed set of keys is
+// honored and null values keep the current column value.
+func applyRunStateUpdates(run *driver.Run, state driver.RunState, updates map[string]any, now time.Time) error {
+	previous := run.State
+	run.State = state
+	run.PreviousState = &previous
+
+	counters := map[string]*int{
+		"tool_iterations":             &run.ToolIterations,
+		"input_tokens":                &run.InputTokens,
+		"output_tokens":               &run.OutputTokens,
+		"cache_creation_input_tokens": &run.CacheCreationInputTokens,
+		"cache_read_input_tokens":     &run.CacheReadInputTokens,
+		"iteration_count":             &run.IterationCount,
+	}
+	for k, field := range counters {
+		v, ok := updates[k]
+		if !ok || v == nil {
+			continue
+		}
+		n, err := toInt(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", k, err)
+		}
+		*field = n
+	}
+
+	var err error
+	if v, ok := updates["response_text"]; ok {
+		if run.ResponseText, err = toString(v); err != nil {
+			return fmt.Errorf("invalid response_text: %w", err)
+		}
+	}
+	if v, ok := updates["stop_reason"]; ok {
+		if run.StopReason, err = toString(v); err != nil {
+			return fmt.Errorf("invalid stop_reason: %w", err)
+		}
+	}
+
+	if runTerminal(state) {
+		finalizedAt := &now
+		if v, ok := updates["finalized_at"]; ok && v != nil {
+			if finalizedAt, err = toTime(v); err != nil {
+				return fmt.Errorf("invalid finalized_at: %w", err)
+			}
+		}
+		run.FinalizedAt = finalizedAt
+	}
+	return nil
+}
+
+// checkToolExecutionParams enforces the foreign keys of a new tool execution.
+func (s *Store) checkToolExecutionParams(params driver.CreateToolExecutionParams) error {
+	if _, ok := s.runs[params.RunID]; !ok {
+		return fmt.Errorf("run %s not found", params.RunID)
+	}
+	if _, ok := s.iterations[params.IterationID]; !ok {
+		return fmt.Errorf("iteration %s not found", params.IterationID)
+	}
+	if params.AgentID != nil {
+		if _, ok := s.agents[*params.AgentID]; !ok {
+			return fmt.Errorf("agent %s not found", *params.AgentID)
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetToolExecution(ctx context.Context, id uuid.UUID) (*driver.ToolExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exec, ok := s.toolExecutions[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyToolExecution(exec), nil
+}
+
+func (s *Store) UpdateToolExecution(ctx context.Context, id uuid.UUID, updates map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+	return s.modifyToolExecution(id, func(exec *driver.ToolExecution) error {
+		return applyToolExecutionUpdates(exec, updates)
+	})
+}
+
+func (s *Store) ClaimToolExecutions(ctx context.Context, instanceID string, maxCount int) ([]*driver.ToolExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var claimable []*driver.ToolExecution
+	for _, exec := range s.toolExecutions {
+		if exec.State != "pending" || exec.ClaimedByInstanceID != nil || exec.ScheduledAt.After(now) {
+			continue
+		}
+		if exec.IsAgentTool {
+			// Agent tools: check if instance has ALL tools required by the target agent
+			if exec.AgentID == nil {
+				continue
+			}
+			agent, ok := s.agents[*exec.AgentID]
+			if !ok || !s.instanceHasTools(instanceID, agent.ToolNames) {
+				continue
+			}
+		} else if !s.instanceHasTools(instanceID, []string{exec.ToolName}) {
+			continue
+		}
+		claimable = append(claimable, exec)
+	}
+	sort.Slice(claimable, func(i, j int) bool {
+		a, b := claimable[i], claimable[j]
+		if !a.ScheduledAt.Equal(b.ScheduledAt) {
+			return a.ScheduledAt.Before(b.ScheduledAt)
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+	claimable = limitRows(s.withinToolCaps(claimable), maxCount)
+
+	claimed := make([]*driver.ToolExecution, 0, len(claimable))
+	for _, old := range claimable {
+		exec := copyToolExecution(old)
+		exec.ClaimedByInstanceID = &instanceID
+		exec.ClaimedAt = &now
+		exec.State = "running"
+		exec.StartedAt = &now
+		exec.AttemptCount++
+		s.saveToolExecution(nil, old, exec)
+		claimed = append(claimed, copyToolExecution(exec))
+	}
+	return claimed, nil
+}
+
+// withinToolCaps drops executions that would exceed their tool's
+// MaxConcurrency. Agent tools are capped by the target agent's
+// MaxConcurrentRuns instead. Executions must be sorted in claim order.
+func (s *Store) withinToolCaps(execs []*driver.ToolExecution) []*driver.ToolExecution {
+	running := make(map[string]int)
+	for _, exec := range s.toolExecutions {
+		if exec.State == "running" && !exec.IsAgentTool {
+			running[exec.ToolName]++
+		}
+	}
+
+	allowed := execs[:0:0]
+	for _, exec := range execs {
+		if !exec.IsAgentTool {
+			if tool, ok := s.tools[exec.ToolName]; ok && tool.MaxConcurrency != nil {
+				if running[exec.ToolName] >= *tool.MaxConcurrency {
+					continue
+				}
+				running[exec.ToolName]++
+			}
+		}
+		allowed = append(allowed, exec)
+	}
+	return allowed
+}
+
+func (s *Store) CompleteToolExecution(ctx context.Context, id uuid.UUID, output string, isError bool, errorMsg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	return s.modifyToolExecution(id, func(exec *driver.ToolExecution) error {
+		exec.State = "completed"
+		if isError {
+			exec.State = "failed"
+		}
+		exec.ToolOutput = &output
+		exec.IsError = isError
+		exec.ErrorMessage = nil
+		if errorMsg != "" {
+			exec.ErrorMessage = &errorMsg
+		}
+		exec.CompletedAt = &now
+		return nil
+	})
+}
+
+func (s *Store) GetToolExecutionsByRun(ctx context.Context, runID uuid.UUID) ([]*driver.ToolExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	execs := s.selectToolExecutions(func(exec *driver.ToolExecution) bool { return exec.RunID == runID })
+	sort.Slice(execs, func(i, j int) bool { return execs[i].CreatedAt.Before(execs[j].CreatedAt) })
+	return copyToolExecutions(execs), nil
+}
+
+func (s *Store) GetToolExecutionsByIteration(ctx context.Context, iterationID uuid.UUID) ([]*driver.ToolExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	execs := s.selectToolExecutions(func(exec *driver.ToolExecution) bool { return exec.IterationID == iterationID })
+	sort.Slice(execs, func(i, j int) bool { return execs[i].CreatedAt.Before(execs[j].CreatedAt) })
+	return copyToolExecutions(execs), nil
+}
+
+func (s *Store) GetPendingToolExecutionsForRun(ctx context.Context, runID uuid.UUID) ([]*driver.ToolExecution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	execs := s.selectToolExecutions(func(exec *driver.ToolExecution) bool {
+		return exec.RunID == runID && !toolExecutionTerminal(exec.State)
+	})
+	sort.Slice(execs, func(i, j int) bool { return execs[i].CreatedAt.Before(execs[j].CreatedAt) })
+	return copyToolExecutions(execs), nil
+}
+
+func (s *Store) ListToolExecutions(ctx context.Context, params driver.ListToolExecutionsParams) ([]*driver.ToolExecution, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(params.MetadataFilter)
+	execs := s.selectToolExecutions(func(exec *driver.ToolExecution) bool {
+		if len(filter) > 0 {
+			run, ok := s.runs[exec.RunID]
+			if !ok {
+				return false
+			}
+			session, ok := s.sessions[run.SessionID]
+			if !ok || !jsonContains(session.Metadata, filter) {
+				return false
+			}
+		}
+		if params.RunID != nil && exec.RunID != *params.RunID {
+			return false
+		}
+		if params.IterationID != nil && exec.IterationID != *params.IterationID {
+			return false
+		}
+		if params.ToolName != "" && exec.ToolName != params.ToolName {
+			return false
+		}
+		if params.State != "" && exec.State != params.State {
+			return false
+		}
+		if params.IsAgentTool != nil && exec.IsAgentTool != *params.IsAgentTool {
+			return false
+		}
+		return true
+	})
+	sort.Slice(execs, func(i, j int) bool { return execs[i].CreatedAt.After(execs[j].CreatedAt) })
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 25
+	}
+	return copyToolExecutions(paginate(execs, params.Offset, limit)), len(execs), nil
+}
+
+func (s *Store) selectToolExecutions(keep func(*driver.ToolExecution) bool) []*driver.ToolExecution {
+	var execs []*driver.ToolExecution
+	for _, exec := range s.toolExecutions {
+		if keep(exec) {
+			execs = append(execs, exec)
+		}
+	}
+	return execs
+}
+
+// Tool execution retry operations
+
+func (s *Store) RetryToolExecution(ctx context.Context, id uuid.UUID, scheduledAt time.Time, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.modifyToolExecution(id, func(exec *driver.ToolExecution) error {
+		exec.State = "pending"
+		exec.ClaimedByInstanceID = nil
+		exec.ClaimedAt = nil
+		exec.StartedAt = nil
+		exec.ScheduledAt = scheduledAt
+		exec.LastError = &lastError
+		return nil
+	})
+}
+
+func (s *Store) SnoozeToolExecution(ctx context.Context, id uuid.UUID, scheduledAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.modifyToolExecution(id, func(exec *driver.ToolExecution) error {
+		exec.State = "pending"
+		exec.ClaimedByInstanceID = nil
+		exec.ClaimedAt = nil
+		exec.StartedAt = nil
+		exec.ScheduledAt = scheduledAt
+		exec.AttemptCount = max(0, exec.AttemptCount-1)
+		exec.SnoozeCount++
+		return nil
+	})
+}
+
+func (s *Store) DiscardToolExecution(ctx context.Context, id uuid.UUID, errorMsg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	return s.modifyToolExecution(id, func(exec *driver.ToolExecution) error {
+		exec.State = "failed"
+		exec.IsError = true
+		exec.ErrorMessage = &errorMsg
+		exec.CompletedAt = &now
+		return nil
+	})
+}
+
+func (s *Store) CompleteToolsAndContinueRun(ctx context.Context, sessionID, runID uuid.UUID, contentBlocks []driver.ContentBlock) (*driver.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.runs[runID]
+	if !ok {
+		return nil, fmt.Errorf("failed to complete tools and continue run: run %s not found", runID)
+	}
+
+	// If run is not in pending_tools state, another instance already processed it
+	if old.State != "pending_tools" {
+		return nil, nil
+	}
+	if _, ok := s.sessions[sessionID]; !ok {
+		return nil, fmt.Errorf("failed to complete tools and continue run: session %s not found", sessionID)
+	}
+
+	// Create the tool results message. Only the tool result columns are stored.
+	now := s.now()
+	blocks := make([]driver.ContentBlock, len(contentBlocks))
+	for i, b := range contentBlocks {
+		blocks[i] = driver.ContentBlock{
+			Type:               b.Type,
+			ToolResultForUseID: b.ToolResultForUseID,
+			ToolContent:        b.ToolContent,
+			IsError:            b.IsError,
+		}
+	}
+	msg := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: sessionID,
+		RunID:     &runID,
+		Role:      "user",
+		Content:   blocks,
+		Metadata:  map[string]any{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.messages[msg.ID] = msg
+
+	// Update run state back to pending for next iteration
+	run := copyRun(old)
+	previous := run.State
+	run.State = "pending"
+	run.PreviousState = &previous
+	run.ClaimedByInstanceID = nil
+	run.ClaimedAt = nil
+	s.saveRun(nil, old, run)
+
+	result := copyMessage(msg)
+	result.Content = contentBlocks
+	return result, nil
+}
+
+// Run rescue operations
+
+func (s *Store) GetStuckRuns(ctx context.Context, timeout time.Duration, maxRescueAttempts, limit int) ([]*driver.Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := s.now().Add(-timeout)
+	runs := s.selectRuns(func(run *driver.Run) bool {
+		switch run.State {
+		case "batch_submitting", "batch_pending", "batch_processing", "streaming", "pending_tools":
+		default:
+			return false
+		}
+		if run.ClaimedAt == nil || !run.ClaimedAt.Before(cutoff) || run.RescueAttempts >= maxRescueAttempts {
+			return false
+		}
+		// Don't rescue runs that have pending tool executions (e.g., scheduled for retry)
+		for _, exec := range s.toolExecutions {
+			if exec.RunID == run.ID && (exec.State == "pending" || exec.State == "running") {
+				return false
+			}
+		}
+		return true
+	})
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ClaimedAt.Before(*runs[j].ClaimedAt) })
+	return copyRuns(limitRows(runs, limit)), nil
+}
+
+func (s *Store) RescueRun(ctx context.Context, id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.runs[id]
+	if !ok {
+		return nil
+	}
+	now := s.now()
+	run := copyRun(old)
+	run.State = "pending"
+	run.ClaimedByInstanceID = nil
+	run.ClaimedAt = nil
+	run.StartedAt = nil
+	run.RescueAttempts++
+	run.LastRescueAt = &now
+	s.saveRun(nil, old, run)
+	return nil
+}
+
+func (s *Store) RetryRun(ctx context.Context, id, iterationID uuid.UUID, attempt driver.APIAttempt, scheduledAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.iterations[iterationID]; !ok {
+		return fmt.Errorf("failed to retry run: iteration %s not found", iterationID)
+	}
+
+	// Both updates happen together so the attempt is never recorded without the reschedule
+	iter := copyIteration(s.iterations[iterationID])
+	iter.APIAttempts = append(iter.APIAttempts, cloneAPIAttempt(attempt))
+	s.iterations[iterationID] = iter
+
+	old, ok := s.runs[id]
+	if !ok {
+		return nil
+	}
+	run := copyRun(old)
+	previous := run.State
+	run.State = "pending"
+	run.PreviousState = &previous
+	run.ClaimedByInstanceID = nil
+	run.ClaimedAt = nil
+	run.CurrentIterationID = &iterationID
+	run.ScheduledAt = scheduledAt
+	s.saveRun(nil, old, run)
+	return nil
+}
+
+func (s *Store) DeferRun(ctx context.Context, id uuid.UUID, scheduledAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.runs[id]
+	if !ok {
+		return nil
+	}
+	run := copyRun(old)
+	previous := run.State
+	run.State = "pending"
+	run.PreviousState = &previous
+	run.ClaimedByInstanceID = nil
+	run.ClaimedAt = nil
+	run.ScheduledAt = scheduledAt
+	s.saveRun(nil, old, run)
+	return nil
+}
+
+// Operator operations
+
+func (s *Store) CancelRun(ctx context.Context, id uuid.UUID, reason string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.runs[id]; !ok {
+		return 0, nil
+	}
+	tree := map[uuid.UUID]bool{id: true}
+	s.collectNestedRuns(id, tree)
+
+	var runs []*driver.Run
+	for runID := range tree {
+		if run := s.runs[runID]; !runTerminal(run.State) {
+			runs = append(runs, run)
+		}
+	}
+	if len(runs) == 0 {
+		return 0, nil
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Depth < runs[j].Depth })
+
+	// Skip the tool executions first, so that cancelling a child run does not
+	// report it to its parent's tool execution as failed
+	now := s.now()
+	var execIDs []uuid.UUID
+	for execID, exec := range s.toolExecutions {
+		if tree[exec.RunID] && !runTerminal(s.runs[exec.RunID].State) && (exec.State == "pending" || exec.State == "running") {
+			execIDs = append(execIDs, execID)
+		}
+	}
+	for _, execID := range execIDs {
+		s.modifyToolExecutionIf(execID, func(exec *driver.ToolExecution) bool {
+			exec.State = "skipped"
+			exec.ErrorMessage = &reason
+			exec.CompletedAt = &now
+			return true
+		})
+	}
+
+	for _, old := range runs {
+		run := copyRun(old)
+		previous := run.State
+		errorType := "cancelled"
+		run.State = "cancelled"
+		run.PreviousState = &previous
+		run.ErrorType = &errorType
+		run.ErrorMessage = &reason
+		run.FinalizedAt = &now
+		s.saveRun(nil, old, run)
+	}
+	return len(runs), nil
+}
+
+func (s *Store) RetryFailedRun(ctx context.Context, id uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.runs[id]
+	if !ok || old.State != "failed" {
+		return false, nil
+	}
+
+	// The next iteration is numbered after the failed ones, which are kept
+	lastNumber := 0
+	var last *driver.Iteration
+	for _, iter := range s.iterations {
+		if iter.RunID != id {
+			continue
+		}
+		lastNumber = max(lastNumber, iter.IterationNumber)
+		if iter.CompletedAt != nil && iter.ErrorMessage == nil && (last == nil || iter.IterationNumber > last.IterationNumber) {
+			last = iter
+		}
+	}
+
+	// Requeue the last successful iteration's tool calls if they are still
+	// unanswered (no tool_result message was created for them)
+	nextState := "pending"
+	var currentIterationID *uuid.UUID
+	if last != nil && last.HasToolUse {
+		toolUseIDs := make(map[string]bool)
+		var execIDs []uuid.UUID
+		for execID, exec := range s.toolExecutions {
+			if exec.IterationID == last.ID {
+				toolUseIDs[exec.ToolUseID] = true
+				if exec.State == "failed" || exec.State == "skipped" {
+					execIDs = append(execIDs, execID)
+				}
+			}
+		}
+		if len(toolUseIDs) > 0 && !s.toolResultsCreated(id, toolUseIDs) {
+			nextState = "pending_tools"
+			currentIterationID = &last.ID
+			now := s.now()
+			for _, execID := range execIDs {
+				s.modifyToolExecutionIf(execID, func(exec *driver.ToolExecution) bool {
+					requeueToolExecution(exec, now)
+					return true
+				})
+			}
+		}
+	}
+
+	run := copyRun(old)
+	previous := run.State
+	run.State = nextState
+	run.PreviousState = &previous
+	run.CurrentIteration = lastNumber
+	run.CurrentIterationID = currentIterationID
+	run.ResponseText = nil
+	run.StopReason = nil
+	run.ErrorMessage = nil
+	run.ErrorType = nil
+	run.ClaimedByInstanceID = nil
+	run.ClaimedAt = nil
+	run.FinalizedAt = nil
+	run.RescueAttempts = 0
+	run.ScheduledAt = s.now()
+	s.saveRun(nil, old, run)
+	return true, nil
+}
+
+// toolResultsCreated reports whether a message of the run answers one of
+// the tool calls.
+func (s *Store) toolResultsCreated(runID uuid.UUID, toolUseIDs map[string]bool) bool {
+	for _, msg := range s.messages {
+		if msg.RunID == nil || *msg.RunID != runID {
+			continue
+		}
+		for _, block := range msg.Content {
+			if block.ToolResultForUseID != "" && toolUseIDs[block.ToolResultForUseID] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Store) RequeueToolExecution(ctx context.Context, id uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requeued := false
+	now := s.now()
+	s.modifyToolExecutionIf(id, func(exec *driver.ToolExecution) bool {
+		if exec.State != "failed" {
+			return false
+		}
+		requeueToolExecution(exec, now)
+		requeued = true
+		return true
+	})
+	return requeued, nil
+}
+
+// requeueToolExecution resets a finished tool execution to pending with a
+// fresh attempt budget.
+func requeueToolExecution(exec *driver.ToolExecution, now time.Time) {
+	if exec.ErrorMessage != nil {
+		exec.LastError = exec.ErrorMessage
+	}
+	exec.State = "pending"
+	exec.ClaimedByInstanceID = nil
+	exec.ClaimedAt = nil
+	exec.StartedAt = nil
+	exec.CompletedAt = nil
+	exec.ToolOutput = nil
+	exec.IsError = false
+	exec.ErrorMessage = nil
+	exec.AttemptCount = 0
+	exec.ScheduledAt = now
+}
+
+// Audit log operations
+
+func (s *Store) CreateAuditEvent(ctx context.Context, params driver.CreateAuditEventParams) (*driver.AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if params.Action == "" {
+		return nil, fmt.Errorf("failed to create audit event: action is required")
+	}
+	details := cloneJSON(params.Details)
+	if details == nil {
+		details = map[string]any{}
+	}
+	event := &driver.AuditEvent{
+		ID:         uuid.New(),
+		Action:     params.Action,
+		TargetType: params.TargetType,
+		TargetID:   params.TargetID,
+		SessionID:  clonePtr(params.SessionID),
+		Actor:      params.Actor,
+		Details:    details,
+		CreatedAt:  s.now(),
+	}
+	s.auditLog = append(s.auditLog, event)
+	return copyAuditEvent(event), nil
+}
+
+func (s *Store) ListAuditEvents(ctx context.Context, params driver.ListAuditEventsParams) ([]*driver.AuditEvent, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(params.MetadataFilter)
+
+	var events []*driver.AuditEvent
+	for i := len(s.auditLog) - 1; i >= 0; i-- {
+		event := s.auditLog[i]
+		if len(filter) > 0 {
+			if event.SessionID == nil {
+				continue
+			}
+			session, ok := s.sessions[*event.SessionID]
+			if !ok || !jsonContains(session.Metadata, filter) {
+				continue
+			}
+		}
+		if params.TargetType != "" && event.TargetType != params.TargetType {
+			continue
+		}
+		if params.TargetID != "" && event.TargetID != params.TargetID {
+			continue
+		}
+		if params.Actor != "" && event.Actor != params.Actor {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	page := paginate(events, params.Offset, limit)
+	result := make([]*driver.AuditEvent, len(page))
+	for i, event := range page {
+		result[i] = copyAuditEvent(event)
+	}
+	return result, len(events), nil
+}
+
+// Message operations
+
+func (s *Store) CreateMessage(ctx context.Context, params driver.CreateMessageParams) (*driver.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[params.SessionID]; !ok {
+		return nil, fmt.Errorf("failed to create message: session %s not found", params.SessionID)
+	}
+	if params.RunID != nil {
+		if _, ok := s.runs[*params.RunID]; !ok {
+			return nil, fmt.Errorf("failed to create message: run %s not found", *params.RunID)
+		}
+	}
+
+	now := s.now()
+	msg := &driver.Message{
+		ID:          uuid.New(),
+		SessionID:   params.SessionID,
+		RunID:       clonePtr(params.RunID),
+		Role:        params.Role,
+		Content:     cloneContentBlocks(params.Content),
+		Usage:       params.Usage,
+		IsPreserved: params.IsPreserved,
+		IsSummary:   params.IsSummary,
+		Metadata:    cloneJSON(params.Metadata),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	s.messages[msg.ID] = msg
+
+	result := copyMessage(msg)
+	result.Content = params.Content
+	return result, nil
+}
+
+func (s *Store) GetMessage(ctx context.Context, id uuid.UUID) (*driver.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyMessage(msg), nil
+}
+
+func (s *Store) GetMessages(ctx context.Context, sessionID uuid.UUID, limit int) ([]*driver.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := s.selectMessages(func(msg *driver.Message) bool { return msg.SessionID == sessionID })
+	if limit > 0 {
+		msgs = limitRows(msgs, limit)
+	}
+	return copyMessages(msgs), nil
+}
+
+func (s *Store) GetMessagesWithRunInfo(ctx context.Context, sessionID uuid.UUID, limit int) ([]*driver.MessageWithRunInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := s.selectMessages(func(msg *driver.Message) bool { return msg.SessionID == sessionID })
+	if limit > 0 {
+		msgs = limitRows(msgs, limit)
+	}
+
+	var result []*driver.MessageWithRunInfo
+	for _, m := range msgs {
+		msg := copyMessage(m)
+		info := &driver.MessageWithRunInfo{
+			ID:          msg.ID,
+			SessionID:   msg.SessionID,
+			RunID:       msg.RunID,
+			Role:        msg.Role,
+			Content:     msg.Content,
+			Usage:       msg.Usage,
+			IsPreserved: msg.IsPreserved,
+			IsSummary:   msg.IsSummary,
+			Metadata:    msg.Metadata,
+			CreatedAt:   msg.CreatedAt,
+			UpdatedAt:   msg.UpdatedAt,
+		}
+		if msg.RunID != nil {
+			if run, ok := s.runs[*msg.RunID]; ok {
+				agentID := run.AgentID
+				depth := run.Depth
+				state := run.State
+				info.RunAgentID = &agentID
+				info.RunDepth = &depth
+				info.ParentRunID = clonePtr(run.ParentRunID)
+				info.RunState = &state
+			}
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (s *Store) GetMessagesByRun(ctx context.Context, runID uuid.UUID) ([]*driver.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := s.selectMessages(func(msg *driver.Message) bool {
+		return msg.RunID != nil && *msg.RunID == runID
+	})
+	return copyMessages(msgs), nil
+}
+
+func (s *Store) GetMessagesForRunContext(ctx context.Context, runID uuid.UUID) ([]*driver.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run, ok := s.runs[runID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get run: run %s not found", runID)
+	}
+
+	var msgs []*driver.Message
+	if run.Depth > 0 {
+		// Nested run: only this run's messages
+		msgs = s.selectMessages(func(msg *driver.Message) bool {
+			return msg.RunID != nil && *msg.RunID == runID
+		})
+	} else {
+		// Root run: get messages from all root-level runs in session
+		msgs = s.selectSessionContext(run.SessionID)
+	}
+	return copyMessages(msgs), nil
+}
+
+func (s *Store) GetSessionContext(ctx context.Context, sessionID uuid.UUID) ([]*driver.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copyMessages(s.selectSessionContext(sessionID)), nil
+}
+
+// selectSessionContext returns the messages of all root-level runs in the
+// session. This excludes messages from child runs (agent-as-tool
+// invocations).
+func (s *Store) selectSessionContext(sessionID uuid.UUID) []*driver.Message {
+	return s.selectMessages(func(msg *driver.Message) bool {
+		if msg.SessionID != sessionID {
+			return false
+		}
+		if msg.RunID == nil {
+			return true
+		}
+		owner, ok := s.runs[*msg.RunID]
+		return ok && owner.SessionID == sessionID && owner.Depth == 0
+	})
+}
+
+// selectMessages returns the messages matching keep, ordered by created_at.
+func (s *Store) selectMessages(keep func(*driver.Message) bool) []*driver.Message {
+	var msgs []*driver.Message
+	for _, msg := range s.messages {
+		if keep(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].CreatedAt.Before(msgs[j].CreatedAt) })
+	return msgs
+}
+
+func (s *Store) UpdateMessage(ctx context.Context, id uuid.UUID, updates map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.messages[id]
+	if !ok {
+		return nil
+	}
+
+	msg := copyMessage(old)
+	if err := applyMessageUpdates(msg, updates); err != nil {
+		return err
+	}
+	msg.UpdatedAt = s.now()
+	s.messages[id] = msg
+	return nil
+}
+
+func (s *Store) DeleteMessage(ctx context.Context, id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteMessage(id)
+	return nil
+}
+
+func (s *Store) deleteMessage(id uuid.UUID) {
+	if _, ok := s.messages[id]; !ok {
+		return
+	}
+	delete(s.messages, id)
+
+	// ON DELETE SET NULL
+	for iterID, iter := range s.iterations {
+		if iter.ResponseMessageID != nil && *iter.ResponseMessageID == id {
+			updated := copyIteration(iter)
+			updated.ResponseMessageID = nil
+			s.iterations[iterID] = updated
+		}
+	}
+	for eventID, event := range s.compactionEvents {
+		if event.SummaryMessageID != nil && *event.SummaryMessageID == id {
+			updated := copyCompactionEvent(event)
+			updated.SummaryMessageID = nil
+			s.compactionEvents[eventID] = updated
+		}
+	}
+	for sessionID, session := range s.sessions {
+		if session.ForkedFromMessageID != nil && *session.ForkedFromMessageID == id {
+			updated := copySession(session)
+			updated.ForkedFromMessageID = nil
+			s.sessions[sessionID] = updated
+		}
+	}
+}
+
+// Content block operations
+
+func (s *Store) CreateContentBlocks(ctx context.Context, messageID uuid.UUID, blocks []driver.ContentBlock) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(blocks) == 0 {
+		return nil
+	}
+	old, ok := s.messages[messageID]
+	if !ok {
+		return fmt.Errorf("failed to create content block: message %s not found", messageID)
+	}
+	// Block indexes start at zero, so they collide with existing blocks
+	if len(old.Content) > 0 {
+		return fmt.Errorf("failed to create content block: message %s already has content blocks", messageID)
+	}
+
+	msg := copyMessage(old)
+	msg.Content = cloneContentBlocks(blocks)
+	s.messages[messageID] = msg
+	return nil
+}
+
+func (s *Store) GetContentBlocks(ctx context.Context, messageID uuid.UUID) ([]driver.ContentBlock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[messageID]
+	if !ok {
+		return nil, nil
+	}
+	return cloneContentBlocks(msg.Content), nil
+}
+
+// Instance operations
+
+func (s *Store) RegisterInstance(ctx context.Context, params driver.RegisterInstanceParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	hostname := params.Hostname
+	pid := params.PID
+	version := params.Version
+	inst := &driver.Instance{
+		ID:                 params.ID,
+		Name:               params.Name,
+		Hostname:           &hostname,
+		PID:                &pid,
+		Version:            &version,
+		MaxConcurrentRuns:  params.MaxConcurrentRuns,
+		MaxConcurrentTools: params.MaxConcurrentTools,
+		Metadata:           cloneJSON(params.Metadata),
+		CreatedAt:          now,
+		LastHeartbeatAt:    now,
+	}
+	if existing, ok := s.instances[params.ID]; ok {
+		inst.CreatedAt = existing.CreatedAt
+	}
+	s.instances[params.ID] = inst
+	return nil
+}
+
+func (s *Store) UnregisterInstance(ctx context.Context, instanceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteInstance(instanceID)
+	return nil
+}
+
+func (s *Store) UpdateHeartbeat(ctx context.Context, instanceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.instances[instanceID]
+	if !ok {
+		return fmt.Errorf("instance not found: %s", instanceID)
+	}
+	inst := copyInstance(old)
+	inst.LastHeartbeatAt = s.now()
+	s.instances[instanceID] = inst
+	return nil
+}
+
+func (s *Store) GetInstance(ctx context.Context, instanceID string) (*driver.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.instances[instanceID]
+	if !ok {
+		return nil, nil
+	}
+	// ActiveRunCount and ActiveToolCount are calculated on-the-fly via GetInstanceActiveCounts
+	return copyInstance(inst), nil
+}
+
+func (s *Store) ListInstances(ctx context.Context) ([]*driver.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instances := make([]*driver.Instance, 0, len(s.instances))
+	for _, inst := range s.instances {
+		instances = append(instances, copyInstance(inst))
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].CreatedAt.Before(instances[j].CreatedAt) })
+	return instances, nil
+}
+
+func (s *Store) GetStaleInstances(ctx context.Context, ttl time.Duration) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.staleInstances(ttl), nil
+}
+
+func (s *Store) DeleteStaleInstances(ctx context.Context, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := s.staleInstances(ttl)
+	for _, id := range ids {
+		s.deleteInstance(id)
+	}
+	return len(ids), nil
+}
+
+func (s *Store) staleInstances(ttl time.Duration) []string {
+	cutoff := s.now().Add(-ttl)
+	var ids []string
+	for id, inst := range s.instances {
+		if inst.LastHeartbeatAt.Before(cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// GetInstanceActiveCounts returns the active run and tool counts for an instance.
+func (s *Store) GetInstanceActiveCounts(ctx context.Context, instanceID string) (activeRuns, activeTools int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := s.activeCounts()[instanceID]
+	return counts[0], counts[1], nil
+}
+
+// GetAllInstanceActiveCounts returns the active run and tool counts for all instances.
+// Returns a map of instance ID to [activeRuns, activeTools].
+func (s *Store) GetAllInstanceActiveCounts(ctx context.Context) (map[string][2]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activeCounts(), nil
+}
+
+func (s *Store) activeCounts() map[string][2]int {
+	result := make(map[string][2]int)
+	for _, run := range s.runs {
+		if run.ClaimedByInstanceID != nil && !runTerminal(run.State) {
+			counts := result[*run.ClaimedByInstanceID]
+			counts[0]++
+			result[*run.ClaimedByInstanceID] = counts
+		}
+	}
+	for _, exec := range s.toolExecutions {
+		if exec.ClaimedByInstanceID != nil && exec.State == "running" {
+			counts := result[*exec.ClaimedByInstanceID]
+			counts[1]++
+			result[*exec.ClaimedByInstanceID] = counts
+		}
+	}
+	return result
+}
+
+// Instance capability operations
+
+func (s *Store) RegisterInstanceTool(ctx context.Context, instanceID, toolName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.instances[instanceID]; !ok {
+		return fmt.Errorf("failed to register instance tool: instance %s not found", instanceID)
+	}
+	if _, ok := s.tools[toolName]; !ok {
+		return fmt.Errorf("failed to register instance tool: tool %q not found", toolName)
+	}
+
+	tools := s.instanceTools[instanceID]
+	if tools == nil {
+		tools = make(map[string]time.Time)
+		s.instanceTools[instanceID] = tools
+	}
+	if _, ok := tools[toolName]; !ok {
+		tools[toolName] = s.now()
+	}
+	return nil
+}
+
+func (s *Store) UnregisterInstanceTool(ctx context.Context, instanceID, toolName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteInstanceTool(instanceID, toolName)
+	return nil
+}
+
+func (s *Store) GetInstanceTools(ctx context.Context, instanceID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.instanceTools[instanceID] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Leader election
+
+func (s *Store) TryAcquireLeader(ctx context.Context, instanceID string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.leader != nil && !s.leader.expiresAt.Before(now) {
+		return false, nil
+	}
+	s.leader = &leaderLease{leaderID: instanceID, electedAt: now, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *Store) RefreshLeader(ctx context.Context, instanceID string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.leader == nil || s.leader.leaderID != instanceID {
+		return fmt.Errorf("not the leader")
+	}
+	s.leader.expiresAt = s.now().Add(ttl)
+	return nil
+}
+
+func (s *Store) GetLeader(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currentLeader(), nil
+}
+
+func (s *Store) IsLeader(ctx context.Context, instanceID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.currentLeader() == instanceID, nil
+}
+
+func (s *Store) currentLeader() string {
+	if s.leader == nil || !s.leader.expiresAt.After(s.now()) {
+		return ""
+	}
+	return s.leader.leaderID
+}
+
+func (s *Store) ReleaseLeader(ctx context.Context, instanceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.leader != nil && s.leader.leaderID == instanceID {
+		s.leader = nil
+	}
+	return nil
+}
+
+// Compaction operations
+
+func (s *Store) CreateCompactionEvent(ctx context.Context, params driver.CreateCompactionEventParams) (*driver.CompactionEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[params.SessionID]; !ok {
+		return nil, fmt.Errorf("failed to create compaction event: session %s not found", params.SessionID)
+	}
+	return copyCompactionEvent(s.insertCompactionEvent(params, nil)), nil
+}
+
+func (s *Store) insertCompactionEvent(params driver.CreateCompactionEventParams, summaryMessageID *uuid.UUID) *driver.CompactionEvent {
+	event := &driver.CompactionEvent{
+		ID:                  uuid.New(),
+		SessionID:           params.SessionID,
+		Strategy:            params.Strategy,
+		OriginalTokens:      params.OriginalTokens,
+		CompactedTokens:     params.CompactedTokens,
+		MessagesRemoved:     params.MessagesRemoved,
+		SummaryContent:      clonePtr(params.SummaryContent),
+		PreservedMessageIDs: append([]uuid.UUID(nil), params.PreservedMessageIDs...),
+		ModelUsed:           clonePtr(params.ModelUsed),
+		DurationMS:          clonePtr(params.DurationMS),
+		SummaryMessageID:    clonePtr(summaryMessageID),
+		CreatedAt:           s.now(),
+	}
+	s.compactionEvents[event.ID] = event
+	return event
+}
+
+func (s *Store) ArchiveMessage(ctx context.Context, compactionEventID, messageID, sessionID uuid.UUID, originalMessage map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.archive[messageID]; ok {
+		return fmt.Errorf("failed to archive message: message %s is already archived", messageID)
+	}
+	if _, ok := s.compactionEvents[compactionEventID]; !ok {
+		return fmt.Errorf("failed to archive message: compaction event %s not found", compactionEventID)
+	}
+	if _, ok := s.sessions[sessionID]; !ok {
+		return fmt.Errorf("failed to archive message: session %s not found", sessionID)
+	}
+
+	s.archive[messageID] = &archivedMessage{
+		CompactionEventID: compactionEventID,
+		SessionID:         sessionID,
+		OriginalMessage:   cloneJSON(originalMessage),
+		ArchivedAt:        s.now(),
+	}
+	return nil
+}
+
+func (s *Store) GetArchivedMessages(ctx context.Context, sessionID uuid.UUID) ([]*driver.ArchivedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []*driver.ArchivedMessage
+	for id, archived := range s.archive {
+		if archived.SessionID != sessionID {
+			continue
+		}
+		result = append(result, &driver.ArchivedMessage{
+			ID:                id,
+			CompactionEventID: clonePtr(&archived.CompactionEventID),
+			SessionID:         archived.SessionID,
+			OriginalMessage:   cloneJSON(archived.OriginalMessage),
+			ArchivedAt:        archived.ArchivedAt,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].ArchivedAt.Equal(result[j].ArchivedAt) {
+			return result[i].ArchivedAt.Before(result[j].ArchivedAt)
+		}
+		return result[i].ID.String() < result[j].ID.String()
+	})
+	return result, nil
+}
+
+func (s *Store) GetCompactionEvents(ctx context.Context, sessionID uuid.UUID, limit int) ([]*driver.CompactionEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []*driver.CompactionEvent
+	for _, event := range s.compactionEvents {
+		if event.SessionID == sessionID {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].CreatedAt.After(events[j].CreatedAt) })
+
+	result := make([]*driver.CompactionEvent, 0, len(events))
+	for _, event := range limitRows(events, limit) {
+		result = append(result, copyCompactionEvent(event))
+	}
+	return result, nil
+}
+
+func (s *Store) GetCompactionEvent(ctx context.Context, id uuid.UUID) (*driver.CompactionEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event, ok := s.compactionEvents[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyCompactionEvent(event), nil
+}
+
+func (s *Store) ApplyCompaction(ctx context.Context, params driver.ApplyCompactionParams) (*driver.CompactionEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessionID := params.Event.SessionID
+	if err := s.checkSessionIdle(sessionID, params.RunID); err != nil {
+		return nil, err
+	}
+	// Validate everything first: nothing can be undone once rows change
+	for _, msg := range params.Messages {
+		stored, ok := s.messages[msg.ID]
+		if !ok || stored.SessionID != sessionID {
+			return nil, fmt.Errorf("message %s: %w", msg.ID, driver.ErrCompactionConflict)
+		}
+		if _, ok := s.archive[msg.ID]; ok {
+			return nil, fmt.Errorf("failed to archive message %s: message is already archived", msg.ID)
+		}
+	}
+
+	now := s.now()
+	var summaryMessageID *uuid.UUID
+	if params.Summary != nil {
+		summary := &driver.Message{
+			ID:        uuid.New(),
+			SessionID: sessionID,
+			Role:      "assistant",
+			Content:   cloneContentBlocks(params.Summary),
+			IsSummary: true,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		s.messages[summary.ID] = summary
+		summaryMessageID = &summary.ID
+	}
+
+	event := s.insertCompactionEvent(params.Event, summaryMessageID)
+	for _, msg := range params.Messages {
+		s.archive[msg.ID] = &archivedMessage{
+			CompactionEventID: event.ID,
+			SessionID:         sessionID,
+			OriginalMessage:   toArchiveJSON(msg),
+			ArchivedAt:        now,
+		}
+		s.deleteMessage(msg.ID)
+	}
+
+	session := copySession(s.sessions[sessionID])
+	session.CompactionCount++
+	session.UpdatedAt = s.now()
+	s.sessions[sessionID] = session
+
+	return copyCompactionEvent(event), nil
+}
+
+func (s *Store) RestoreCompaction(ctx context.Context, eventID uuid.UUID) (*driver.CompactionEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event, ok := s.compactionEvents[eventID]
+	if !ok {
+		return nil, driver.ErrCompactionNotFound
+	}
+	if err := s.checkSessionIdle(event.SessionID, nil); err != nil {
+		return nil, err
+	}
+	if event.RestoredAt != nil {
+		return nil, driver.ErrCompactionRestored
+	}
+	for _, other := range s.compactionEvents {
+		if other.SessionID == event.SessionID && other.RestoredAt == nil && other.CreatedAt.After(event.CreatedAt) {
+			return nil, fmt.Errorf("a later compaction of session %s must be restored first: %w", event.SessionID, driver.ErrCompactionConflict)
+		}
+	}
+
+	var messages []*driver.Message
+	for id, archived := range s.archive {
+		if archived.CompactionEventID != eventID {
+			continue
+		}
+		msg, err := fromArchiveJSON(archived.OriginalMessage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal archived message %s: %w", id, err)
+		}
+		if _, ok := s.messages[msg.ID]; ok {
+			return nil, fmt.Errorf("failed to restore message %s: message already exists", msg.ID)
+		}
+		messages = append(messages, msg)
+	}
+	if len(messages) == 0 && event.MessagesRemoved > 0 {
+		return nil, driver.ErrArchivePurged
+	}
+
+	for _, msg := range messages {
+		if msg.RunID != nil {
+			if _, ok := s.runs[*msg.RunID]; !ok {
+				msg.RunID = nil
+			}
+		}
+		msg.Content = cloneContentBlocks(msg.Content)
+		s.messages[msg.ID] = msg
+		delete(s.archive, msg.ID)
+	}
+	if event.SummaryMessageID != nil {
+		s.deleteMessage(*event.SummaryMessageID)
+	}
+
+	restored := copyCompactionEvent(s.compactionEvents[eventID])
+	now := s.now()
+	restored.RestoredAt = &now
+	restored.SummaryMessageID = nil
+	s.compactionEvents[eventID] = restored
+	return copyCompactionEvent(restored), nil
+}
+
+// checkSessionIdle returns driver.ErrSessionBusy if a run of the session is
+// in progress, like the check under the session lock in the SQL drivers.
+func (s *Store) checkSessionIdle(sessionID uuid.UUID, exceptRunID *uuid.UUID) error {
+	if _, ok := s.sessions[sessionID]; !ok || s.hidden(sessionID) {
+		return fmt.Errorf("session not found: %s", sessionID)
+	}
+	for _, run := range s.runs {
+		if run.SessionID != sessionID || (exceptRunID != nil && run.ID == *exceptRunID) {
+			continue
+		}
+		switch run.State {
+		case "batch_submitting", "batch_pending", "batch_processing", "streaming", "pending_tools":
+			return driver.ErrSessionBusy
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetCompactionStats(ctx context.Context) (*driver.CompactionStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats driver.CompactionStats
+	var reductionSum float64
+	var reductionCount int
+	for _, event := range s.compactionEvents {
+		stats.TotalCompactions++
+		stats.TotalTokensSaved += event.OriginalTokens - event.CompactedTokens
+		stats.TotalMessagesArchived += event.MessagesRemoved
+		if event.OriginalTokens != 0 {
+			reductionSum += 1.0 - float64(event.CompactedTokens)/float64(event.OriginalTokens)
+			reductionCount++
+		}
+	}
+	if reductionCount > 0 {
+		stats.AvgReductionPercent = reductionSum / float64(reductionCount)
+	}
+	return &stats, nil
+}
+
+// Schedule operations
+
+func (s *Store) UpsertSchedule(ctx context.Context, params driver.UpsertScheduleParams) (*driver.Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.agents[params.AgentID]; !ok {
+		return nil, fmt.Errorf("failed to upsert schedule: agent %s not found", params.AgentID)
+	}
+	if params.SessionID != nil {
+		if _, ok := s.sessions[*params.SessionID]; !ok {
+			return nil, fmt.Errorf("failed to upsert schedule: session %s not found", *params.SessionID)
+		}
+	}
+
+	now := s.now()
+	sched := &driver.Schedule{
+		ID:              uuid.New(),
+		Name:            params.Name,
+		AgentID:         params.AgentID,
+		CronExpression:  params.CronExpression,
+		Timezone:        params.Timezone,
+		CatchUpPolicy:   params.CatchUpPolicy,
+		NextRunAt:       params.NextRunAt,
+		Prompt:          params.Prompt,
+		Variables:       cloneJSON(params.Variables),
+		RunMode:         params.RunMode,
+		SessionPolicy:   params.SessionPolicy,
+		SessionID:       clonePtr(params.SessionID),
+		SessionMetadata: cloneJSON(params.SessionMetadata),
+		Metadata:        cloneJSON(params.Metadata),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+
+	if existing := s.scheduleByName(params.Name); existing != nil {
+		sched.ID = existing.ID
+		sched.Paused = existing.Paused
+		sched.LastRunAt = clonePtr(existing.LastRunAt)
+		sched.LastRunID = clonePtr(existing.LastRunID)
+		sched.FireCount = existing.FireCount
+		sched.CreatedAt = existing.CreatedAt
+		// Keep the pending tick unless the cron expression or timezone changed
+		if existing.CronExpression == params.CronExpression && existing.Timezone == params.Timezone {
+			sched.NextRunAt = existing.NextRunAt
+		}
+		if sched.SessionID == nil {
+			sched.SessionID = clonePtr(existing.SessionID)
+		}
+	}
+
+	s.schedules[sched.ID] = sched
+	return copySchedule(sched), nil
+}
+
+func (s *Store) scheduleByName(name string) *driver.Schedule {
+	for _, sched := range s.schedules {
+		if sched.Name == name {
+			return sched
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetSchedule(ctx context.Context, id uuid.UUID) (*driver.Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched, ok := s.schedules[id]
+	if !ok {
+		return nil, nil
+	}
+	return copySchedule(sched), nil
+}
+
+func (s *Store) GetScheduleByName(ctx context.Context, name string) (*driver.Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched := s.scheduleByName(name)
+	if sched == nil {
+		return nil, nil
+	}
+	return copySchedule(sched), nil
+}
+
+func (s *Store) UpdateSchedule(ctx context.Context, id uuid.UUID, updates map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+	old, ok := s.schedules[id]
+	if !ok {
+		return nil
+	}
+
+	sched := copySchedule(old)
+	if err := applyScheduleUpdates(sched, updates); err != nil {
+		return err
+	}
+	sched.UpdatedAt = s.now()
+	s.schedules[id] = sched
+	return nil
+}
+
+func (s *Store) DeleteSchedule(ctx context.Context, id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *Store) ListSchedules(ctx context.Context, params driver.ListSchedulesParams) ([]*driver.Schedule, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(params.MetadataFilter)
+	var matched []*driver.Schedule
+	for _, sched := range s.schedules {
+		if len(filter) > 0 && !jsonContains(sched.Metadata, filter) {
+			continue
+		}
+		if params.AgentID != nil && sched.AgentID != *params.AgentID {
+			continue
+		}
+		matched = append(matched, sched)
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	page := paginate(matched, params.Offset, limit)
+
+	schedules := make([]*driver.Schedule, 0, len(page))
+	for _, sched := range page {
+		schedules = append(schedules, copySchedule(sched))
+	}
+	return schedules, len(matched), nil
+}
+
+func (s *Store) GetDueSchedules(ctx context.Context, limit int) ([]*driver.Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var due []*driver.Schedule
+	for _, sched := range s.schedules {
+		if !sched.Paused && !sched.NextRunAt.After(now) {
+			due = append(due, sched)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRunAt.Before(due[j].NextRunAt) })
+
+	result := make([]*driver.Schedule, 0, len(due))
+	for _, sched := range limitRows(due, limit) {
+		result = append(result, copySchedule(sched))
+	}
+	return result, nil
+}
+
+func (s *Store) AdvanceScheduleTx(ctx context.Context, tx *Tx, params driver.AdvanceScheduleParams) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tx.done {
+		return false, ErrTxClosed
+	}
+
+	old, ok := s.schedules[params.ID]
+	if !ok || !old.NextRunAt.Equal(params.ExpectedNextRunAt) || old.Paused {
+		return false, nil
+	}
+
+	now := s.now()
+	sched := copySchedule(old)
+	sched.NextRunAt = params.NextRunAt
+	if params.RunID != nil {
+		sched.LastRunAt = &now
+		sched.LastRunID = clonePtr(params.RunID)
+		sched.FireCount++
+	}
+	if params.SessionID != nil {
+		sched.SessionID = clonePtr(params.SessionID)
+	}
+	sched.UpdatedAt = now
+	s.schedules[params.ID] = sched
+
+	tx.undo = append(tx.undo, func() {
+		s.schedules[params.ID] = old
+	})
+	return true, nil
+}
+
+// Rate limit operations
+
+func (s *Store) AcquireRateLimit(ctx context.Context, model string) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rl, ok := s.rateLimits[model]
+	if !ok {
+		// Nothing reported for this model yet
+		return nil, nil
+	}
+	now := s.now()
+	s.refillRateLimit(rl, now)
+
+	wait := max(rl.requests.wait(), rl.inputTokens.wait(), rl.outputTokens.wait())
+	if rl.blockedUntil != nil {
+		wait = max(wait, rl.blockedUntil.Sub(now))
+	}
+	if wait > 0 {
+		retryAt := now.Add(wait)
+		return &retryAt, nil
+	}
+	rl.requests.available--
+	return nil, nil
+}
+
+func (s *Store) RecordRateLimit(ctx context.Context, params driver.RecordRateLimitParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	rl, ok := s.rateLimits[params.Model]
+	if !ok {
+		rl = &rateLimitRow{refilledAt: now}
+		s.rateLimits[params.Model] = rl
+	}
+	s.refillRateLimit(rl, now)
+
+	rl.requests.record(params.RequestsLimit, params.RequestsRemaining, 0)
+	rl.inputTokens.record(params.InputTokensLimit, params.InputTokensRemaining, params.InputTokensUsed)
+	rl.outputTokens.record(params.OutputTokensLimit, params.OutputTokensRemaining, params.OutputTokensUsed)
+	if params.BlockedUntil != nil && (rl.blockedUntil == nil || params.BlockedUntil.After(*rl.blockedUntil)) {
+		rl.blockedUntil = clonePtr(params.BlockedUntil)
+	}
+	return nil
+}
+
+// refillRateLimit refills the buckets of rl up to now.
+func (s *Store) refillRateLimit(rl *rateLimitRow, now time.Time) {
+	elapsed := max(now.Sub(rl.refilledAt), 0)
+	rl.requests.refill(elapsed)
+	rl.inputTokens.refill(elapsed)
+	rl.outputTokens.refill(elapsed)
+	rl.refilledAt = now
+}
+
+// Retention operations
+
+func (s *Store) PurgeSessions(ctx context.Context, params driver.PurgeParams) (*driver.PurgeCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(params.MetadataFilter)
+	var matched []*driver.Session
+	for id, session := range s.sessions {
+		if s.hidden(id) || !session.UpdatedAt.Before(params.Before) {
+			continue
+		}
+		if len(filter) > 0 && !jsonContains(session.Metadata, filter) {
+			continue
+		}
+		if s.sessionActiveSince(id, params.Before) {
+			continue
+		}
+		matched = append(matched, session)
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].UpdatedAt.Before(matched[j].UpdatedAt) })
+
+	counts := &driver.PurgeCounts{}
+	for _, session := range limitRows(matched, params.Limit) {
+		s.deleteSession(session.ID, counts)
+	}
+	return counts, nil
+}
+
+// sessionActiveSince reports whether a session has child sessions, or runs
+// or messages that changed at or after t.
+func (s *Store) sessionActiveSince(id uuid.UUID, t time.Time) bool {
+	for _, child := range s.sessions {
+		if child.ParentSessionID != nil && *child.ParentSessionID == id {
+			return true
+		}
+	}
+	for _, run := range s.runs {
+		if run.SessionID == id && (run.FinalizedAt == nil || !run.FinalizedAt.Before(t)) {
+			return true
+		}
+	}
+	for _, msg := range s.messages {
+		if msg.SessionID == id && !msg.UpdatedAt.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) PurgeRuns(ctx context.Context, params driver.PurgeParams) (*driver.PurgeCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter := cloneJSON(params.MetadataFilter)
+	runs := s.selectRuns(func(run *driver.Run) bool {
+		if run.ParentRunID != nil || run.FinalizedAt == nil || !run.FinalizedAt.Before(params.Before) {
+			return false
+		}
+		if len(params.States) > 0 && !slices.Contains(params.States, run.State) {
+			return false
+		}
+		if len(params.States) == 0 && !runTerminal(run.State) {
+			return false
+		}
+		session, ok := s.sessions[run.SessionID]
+		return ok && (len(filter) == 0 || jsonContains(session.Metadata, filter))
+	})
+	sort.Slice(runs, func(i, j int) bool { return runs[i].FinalizedAt.Before(*runs[j].FinalizedAt) })
+
+	counts := &driver.PurgeCounts{}
+	for _, run := range limitRows(runs, params.Limit) {
+		// Messages of nested runs would otherwise lose their run and show
+		// up in the session's root-level conversation
+		nested := map[uuid.UUID]bool{}
+		s.collectNestedRuns(run.ID, nested)
+		for msgID, msg := range s.messages {
+			if msg.RunID != nil && nested[*msg.RunID] {
+				s.deleteMessage(msgID)
+				counts.Messages++
+			}
+		}
+		s.deleteRun(run.ID, counts)
+	}
+	return counts, nil
+}
+
+// collectNestedRuns adds the IDs of the runs nested under a run to ids.
+func (s *Store) collectNestedRuns(id uuid.UUID, ids map[uuid.UUID]bool) {
+	for childID, child := range s.runs {
+		if child.ParentRunID != nil && *child.ParentRunID == id && !ids[childID] {
+			ids[childID] = true
+			s.collectNestedRuns(childID, ids)
+		}
+	}
+}
+
+func (s *Store) PurgeArchivedMessages(ctx context.Context, params driver.PurgeParams) (*driver.PurgeCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	archived := map[uuid.UUID]bool{}
+	for _, entry := range s.archive {
+		archived[entry.CompactionEventID] = true
+	}
+	filter := cloneJSON(params.MetadataFilter)
+	var events []*driver.CompactionEvent
+	for id, event := range s.compactionEvents {
+		if !archived[id] || !event.CreatedAt.Before(params.Before) {
+			continue
+		}
+		session, ok := s.sessions[event.SessionID]
+		if !ok || (len(filter) > 0 && !jsonContains(session.Metadata, filter)) {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].CreatedAt.Before(events[j].CreatedAt) })
+
+	counts := &driver.PurgeCounts{}
+	for _, event := range limitRows(events, params.Limit) {
+		for id, entry := range s.archive {
+			if entry.CompactionEventID == event.ID {
+				delete(s.archive, id)
+				counts.ArchivedMessages++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// deleteSession deletes a session and the rows referencing it, like the
+// foreign keys of the SQL schema. Child sessions must be deleted first.
+func (s *Store) deleteSession(id uuid.UUID, counts *driver.PurgeCounts) {
+	for runID, run := range s.runs {
+		if run.SessionID == id {
+			s.deleteRun(runID, counts)
+		}
+	}
+	for msgID, msg := range s.messages {
+		if msg.SessionID == id {
+			s.deleteMessage(msgID)
+			counts.Messages++
+		}
+	}
+	for eventID, event := range s.compactionEvents {
+		if event.SessionID == id {
+			delete(s.compactionEvents, eventID)
+			counts.CompactionEvents++
+		}
+	}
+	for msgID, entry := range s.archive {
+		if entry.SessionID == id {
+			delete(s.archive, msgID)
+			counts.ArchivedMessages++
+		}
+	}
+
+	// ON DELETE SET NULL
+	for schedID, sched := range s.schedules {
+		if sched.SessionID != nil && *sched.SessionID == id {
+			updated := copySchedule(sched)
+			updated.SessionID = nil
+			s.schedules[schedID] = updated
+		}
+	}
+
+	delete(s.sessions, id)
+	counts.Sessions++
+}
+
+// deleteRun deletes a run with its nested runs, iterations and tool
+// executions, like the foreign keys of the SQL schema.
+func (s *Store) deleteRun(id uuid.UUID, counts *driver.PurgeCounts) {
+	if _, ok := s.runs[id]; !ok {
+		return
+	}
+	delete(s.runs, id)
+	counts.Runs++
+
+	for childID, child := range s.runs {
+		if child.ParentRunID != nil && *child.ParentRunID == id {
+			s.deleteRun(childID, counts)
+		}
+	}
+	for iterID, iter := range s.iterations {
+		if iter.RunID == id {
+			delete(s.iterations, iterID)
+			counts.Iterations++
+		}
+	}
+	deletedExecs := map[uuid.UUID]bool{}
+	for execID, exec := range s.toolExecutions {
+		if exec.RunID == id {
+			delete(s.toolExecutions, execID)
+			deletedExecs[execID] = true
+			counts.ToolExecutions++
+		}
+	}
+
+	// ON DELETE SET NULL
+	for msgID, msg := range s.messages {
+		if msg.RunID != nil && *msg.RunID == id {
+			updated := copyMessage(msg)
+			updated.RunID = nil
+			s.messages[msgID] = updated
+		}
+	}
+	for execID, exec := range s.toolExecutions {
+		if exec.ChildRunID != nil && *exec.ChildRunID == id {
+			updated := copyToolExecution(exec)
+			updated.ChildRunID = nil
+			s.toolExecutions[execID] = updated
+		}
+	}
+	for runID, run := range s.runs {
+		if run.ParentToolExecutionID != nil && deletedExecs[*run.ParentToolExecutionID] {
+			updated := copyRun(run)
+			updated.ParentToolExecutionID = nil
+			s.runs[runID] = updated
+		}
+	}
+	for schedID, sched := range s.schedules {
+		if sched.LastRunID != nil && *sched.LastRunID == id {
+			updated := copySchedule(sched)
+			updated.LastRunID = nil
+			s.schedules[schedID] = updated
+		}
+	}
+}
+
+// Helper functions
+
+// paginate applies OFFSET and LIMIT to sorted rows.
+func paginate[T any](rows []T, offset, limit int) []T {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(rows) {
+		return nil
+	}
+	return limitRows(rows[offset:], limit)
+}
+
+// limitRows applies LIMIT to sorted rows.
+func limitRows[T any](rows []T, limit int) []T {
+	if limit < 0 {
+		limit = 0
+	}
+	if len(rows) > limit {
+		return rows[:limit]
+	}
+	return rows
+}
+
+func runTerminal(state string) bool {
+	return state == "completed" || state == "cancelled" || state == "failed"
+}
+
+func toolExecutionTerminal(state string) bool {
+	return state == "completed" || state == "failed" || state == "skipped"
+}
+
+// Compile-time check
+var _ driver.Store[*Tx] = (*Store)(nil)
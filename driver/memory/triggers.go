@@ -0,0 +1,346 @@
+package memory
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// Notification channels raised by the store. These mirror the channels the
+// PostgreSQL triggers notify on (see agentpg.ChannelRunCreated and friends).
+const (
+	channelRunCreated    = "agentpg_run_created"
+	channelRunState      = "agentpg_run_state"
+	channelRunFinalized  = "agentpg_run_finalized"
+	channelToolPending   = "agentpg_tool_pending"
+	channelToolsComplete = "agentpg_tools_complete"
+)
+
+// The functions in this file emulate the triggers of the PostgreSQL schema.
+// They are called with s.mu held.
+
+// saveAgent stores an agent and raises agentpg_trg_record_agent_version,
+// which records a version unless the definition is unchanged.
+func (s *Store) saveAgent(agent *driver.AgentDefinition) {
+	old, updated := s.agents[agent.ID]
+	s.agents[agent.ID] = agent
+	if updated && sameAgentDefinition(old, agent) {
+		return
+	}
+
+	versions := s.agentVersions[agent.ID]
+	now := s.now()
+	snapshot := copyAgent(agent)
+	snapshot.CreatedAt = now
+	snapshot.UpdatedAt = now
+	s.agentVersions[agent.ID] = append(versions, &driver.AgentVersion{
+		ID:        uuid.New(),
+		AgentID:   agent.ID,
+		Version:   len(versions) + 1,
+		Agent:     snapshot,
+		CreatedAt: now,
+	})
+}
+
+// sameAgentDefinition reports whether two agents differ only in their timestamps.
+func sameAgentDefinition(a, b *driver.AgentDefinition) bool {
+	if !jsonEqual(a.Metadata, b.Metadata) || !jsonEqual(a.Config, b.Config) {
+		return false
+	}
+	a, b = copyAgent(a), copyAgent(b)
+	for _, agent := range []*driver.AgentDefinition{a, b} {
+		agent.CreatedAt, agent.UpdatedAt = time.Time{}, time.Time{}
+		agent.Metadata, agent.Config = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// insertRun stores a new run and raises agentpg_trg_run_created.
+func (s *Store) insertRun(tx *Tx, run *driver.Run) {
+	// agentpg_trg_cancel_child_of_cancelled_run
+	if run.State == "pending" && run.ParentRunID != nil {
+		if parent, ok := s.runs[*run.ParentRunID]; ok && parent.State == "cancelled" {
+			now := s.now()
+			errorType, errorMessage := "cancelled", "parent run was cancelled"
+			run.State = "cancelled"
+			run.ErrorType = &errorType
+			run.ErrorMessage = &errorMessage
+			run.FinalizedAt = &now
+		}
+	}
+
+	s.runs[run.ID] = run
+
+	if tx != nil {
+		s.uncommitted[run.ID] = tx
+		tx.created = append(tx.created, run.ID)
+		tx.undo = append(tx.undo, func() {
+			delete(s.runs, run.ID)
+		})
+	}
+
+	if run.State == "pending" {
+		s.notify(tx, channelRunCreated, map[string]any{
+			"run_id":        run.ID,
+			"session_id":    run.SessionID,
+			"agent_id":      run.AgentID,
+			"run_mode":      run.RunMode,
+			"parent_run_id": run.ParentRunID,
+			"depth":         run.Depth,
+		})
+	}
+}
+
+// saveRun replaces a run with its updated copy and raises the run update
+// triggers in the order PostgreSQL fires them.
+func (s *Store) saveRun(tx *Tx, old, run *driver.Run) {
+	// agentpg_trg_keep_run_cancelled: the update is dropped
+	if old.State == "cancelled" && run.State != "cancelled" {
+		return
+	}
+
+	s.runs[run.ID] = run
+
+	// agentpg_trg_child_run_complete: report a finished child run to its parent tool execution
+	if runTerminal(run.State) && !runTerminal(old.State) && run.ParentToolExecutionID != nil {
+		s.modifyToolExecutionIf(*run.ParentToolExecutionID, func(exec *driver.ToolExecution) bool {
+			if exec.State != "running" {
+				return false
+			}
+			now := s.now()
+			exec.State = "failed"
+			if run.State == "completed" {
+				exec.State = "completed"
+			}
+			exec.ToolOutput = clonePtr(run.ResponseText)
+			exec.IsError = run.State != "completed"
+			exec.ErrorMessage = clonePtr(run.ErrorMessage)
+			exec.CompletedAt = &now
+			return true
+		})
+	}
+
+	// agentpg_trg_run_state_change
+	if old.State == run.State {
+		return
+	}
+	s.notify(tx, channelRunState, map[string]any{
+		"run_id":         run.ID,
+		"session_id":     run.SessionID,
+		"agent_id":       run.AgentID,
+		"state":          run.State,
+		"previous_state": old.State,
+		"parent_run_id":  run.ParentRunID,
+	})
+	if runTerminal(run.State) {
+		s.notify(tx, channelRunFinalized, map[string]any{
+			"run_id":                   run.ID,
+			"session_id":               run.SessionID,
+			"state":                    run.State,
+			"parent_run_id":            run.ParentRunID,
+			"parent_tool_execution_id": run.ParentToolExecutionID,
+		})
+	}
+}
+
+// insertToolExecution stores a new tool execution and raises agentpg_trg_tool_created.
+func (s *Store) insertToolExecution(params driver.CreateToolExecutionParams, now time.Time) *driver.ToolExecution {
+	maxAttempts := params.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 2 // Default: 2 attempts (1 retry) for snappy UX
+	}
+
+	exec := &driver.ToolExecution{
+		ID:          uuid.New(),
+		RunID:       params.RunID,
+		IterationID: params.IterationID,
+		State:       "pending",
+		ToolUseID:   params.ToolUseID,
+		ToolName:    params.ToolName,
+		ToolInput:   slices.Clone(params.ToolInput),
+		IsAgentTool: params.IsAgentTool,
+		AgentID:     clonePtr(params.AgentID),
+		MaxAttempts: maxAttempts,
+		ScheduledAt: now,
+		CreatedAt:   now,
+	}
+	// agentpg_trg_skip_tool_of_cancelled_run
+	if run, ok := s.runs[exec.RunID]; ok && run.State == "cancelled" {
+		exec.State = "skipped"
+		exec.CompletedAt = &now
+	}
+	s.toolExecutions[exec.ID] = exec
+
+	if exec.State != "pending" {
+		return exec
+	}
+	s.notify(nil, channelToolPending, map[string]any{
+		"execution_id":  exec.ID,
+		"run_id":        exec.RunID,
+		"tool_name":     exec.ToolName,
+		"is_agent_tool": exec.IsAgentTool,
+		"agent_id":      exec.AgentID,
+	})
+	return exec
+}
+
+// modifyToolExecution applies fn to a copy of a tool execution and saves it.
+// A missing execution is not an error, like an UPDATE matching no rows.
+func (s *Store) modifyToolExecution(id uuid.UUID, fn func(*driver.ToolExecution) error) error {
+	old, ok := s.toolExecutions[id]
+	if !ok {
+		return nil
+	}
+	exec := copyToolExecution(old)
+	if err := fn(exec); err != nil {
+		return err
+	}
+	s.saveToolExecution(nil, old, exec)
+	return nil
+}
+
+// modifyToolExecutionIf is modifyToolExecution for updates with a WHERE
+// guard: the execution is saved only if fn returns true.
+func (s *Store) modifyToolExecutionIf(id uuid.UUID, fn func(*driver.ToolExecution) bool) {
+	old, ok := s.toolExecutions[id]
+	if !ok {
+		return
+	}
+	exec := copyToolExecution(old)
+	if fn(exec) {
+		s.saveToolExecution(nil, old, exec)
+	}
+}
+
+// saveToolExecution replaces a tool execution with its updated copy and
+// raises agentpg_trg_tools_complete.
+func (s *Store) saveToolExecution(tx *Tx, old, exec *driver.ToolExecution) {
+	s.toolExecutions[exec.ID] = exec
+
+	if !toolExecutionTerminal(exec.State) || toolExecutionTerminal(old.State) {
+		return
+	}
+	for _, other := range s.toolExecutions {
+		if other.RunID == exec.RunID && !toolExecutionTerminal(other.State) {
+			return
+		}
+	}
+	s.notify(tx, channelToolsComplete, map[string]any{
+		"run_id": exec.RunID,
+	})
+}
+
+// deleteInstance deletes an instance, failing its claimed work like
+// agentpg_trg_cleanup_orphaned_work and dropping its tool registrations.
+func (s *Store) deleteInstance(instanceID string) {
+	if _, ok := s.instances[instanceID]; !ok {
+		return
+	}
+
+	errorMessage := "Instance disconnected: " + instanceID
+	errorType := "instance_disconnected"
+
+	// Mark claimed runs as failed
+	for _, old := range s.runs {
+		if old.ClaimedByInstanceID == nil || *old.ClaimedByInstanceID != instanceID || runTerminal(old.State) {
+			continue
+		}
+		now := s.now()
+		run := copyRun(old)
+		previous := run.State
+		run.State = "failed"
+		run.PreviousState = &previous
+		run.FinalizedAt = &now
+		run.ErrorMessage = &errorMessage
+		run.ErrorType = &errorType
+		s.saveRun(nil, old, run)
+	}
+
+	// Mark claimed tool executions as failed (may be retried)
+	for id, exec := range s.toolExecutions {
+		if exec.ClaimedByInstanceID == nil || *exec.ClaimedByInstanceID != instanceID {
+			continue
+		}
+		s.modifyToolExecutionIf(id, func(exec *driver.ToolExecution) bool {
+			if exec.State != "running" {
+				return false
+			}
+			now := s.now()
+			exec.State = "failed"
+			exec.CompletedAt = &now
+			exec.ErrorMessage = &errorMessage
+			return true
+		})
+	}
+
+	delete(s.instances, instanceID)
+
+	// ON DELETE CASCADE on agentpg_instance_tools
+	for toolName := range s.instanceTools[instanceID] {
+		s.deleteInstanceTool(instanceID, toolName)
+	}
+	delete(s.instanceTools, instanceID)
+}
+
+// deleteInstanceTool removes a tool registration and, like
+// agentpg_trg_cleanup_orphaned_tools, deletes the tool once nothing uses it.
+func (s *Store) deleteInstanceTool(instanceID, toolName string) {
+	tools, ok := s.instanceTools[instanceID]
+	if !ok {
+		return
+	}
+	if _, ok := tools[toolName]; !ok {
+		return
+	}
+	delete(tools, toolName)
+
+	for _, other := range s.instanceTools {
+		if _, ok := other[toolName]; ok {
+			return
+		}
+	}
+	for _, exec := range s.toolExecutions {
+		if exec.ToolName == toolName {
+			return
+		}
+	}
+	delete(s.tools, toolName)
+}
+
+// notify raises a notification. Notifications raised inside a transaction
+// are delivered when it commits, like pg_notify.
+func (s *Store) notify(tx *Tx, channel string, payload map[string]any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	n := driver.Notification{Channel: channel, Payload: string(data)}
+	if tx != nil {
+		tx.notifications = append(tx.notifications, n)
+		return
+	}
+	s.deliver(n)
+}
+
+// deliver hands a notification to every listener.
+func (s *Store) deliver(n driver.Notification) {
+	for _, l := range s.listeners {
+		l.enqueue(n)
+	}
+}
+
+func (s *Store) addListener(l *Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+func (s *Store) removeListener(l *Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = slices.DeleteFunc(s.listeners, func(other *Listener) bool { return other == l })
+}
@@ -0,0 +1,19 @@
+package pgxv5_test
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/youssefsiam38/agentpg/agentpgtest"
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/driver/drivertest"
+	"github.com/youssefsiam38/agentpg/driver/pgxv5"
+)
+
+// TestConformance runs the store suite against PostgreSQL. It is skipped
+// unless AGENTPG_TEST_DATABASE_URL is set.
+func TestConformance(t *testing.T) {
+	drivertest.RunStoreSuite(t, func(t *testing.T) driver.Driver[pgx.Tx] {
+		return pgxv5.New(agentpgtest.NewPool(t))
+	})
+}
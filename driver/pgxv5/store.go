@@ -1,6 +1,7 @@
 package pgxv5
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -55,10 +56,10 @@ func (s *Store) createSession(ctx context.Context, e executor, params driver.Cre
 	err = e.QueryRow(ctx, `
 		INSERT INTO agentpg_sessions (parent_session_id, depth, metadata)
 		VALUES ($1, $2, $3)
-		RETURNING id, parent_session_id, depth, metadata, compaction_count, created_at, updated_at
+		RETURNING id, parent_session_id, depth, metadata, compaction_count, created_at, updated_at, forked_from_message_id
 	`, params.ParentSessionID, depth, metadata).Scan(
 		&session.ID, &session.ParentSessionID,
-		&session.Depth, &metadata, &session.CompactionCount, &session.CreatedAt, &session.UpdatedAt,
+		&session.Depth, &metadata, &session.CompactionCount, &session.CreatedAt, &session.UpdatedAt, &session.ForkedFromMessageID,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %w", err)
@@ -75,11 +76,11 @@ func (s *Store) GetSession(ctx context.Context, id uuid.UUID) (*driver.Session,
 	var session driver.Session
 	var metadata []byte
 	err := s.pool.QueryRow(ctx, `
-		SELECT id, parent_session_id, depth, metadata, compaction_count, created_at, updated_at
+		SELECT id, parent_session_id, depth, metadata, compaction_count, created_at, updated_at, forked_from_message_id
 		FROM agentpg_sessions WHERE id = $1
 	`, id).Scan(
 		&session.ID, &session.ParentSessionID,
-		&session.Depth, &metadata, &session.CompactionCount, &session.CreatedAt, &session.UpdatedAt,
+		&session.Depth, &metadata, &session.CompactionCount, &session.CreatedAt, &session.UpdatedAt, &session.ForkedFromMessageID,
 	)
 	if err == pgx.ErrNoRows {
 		return nil, nil
@@ -124,7 +125,7 @@ func (s *Store) UpdateSession(ctx context.Context, id uuid.UUID, updates map[str
 func (s *Store) ListSessions(ctx context.Context, params driver.ListSessionsParams) ([]*driver.Session, int, error) {
 	// Build dynamic query with filters
 	baseQuery := `
-		SELECT id, parent_session_id, depth, metadata, compaction_count, created_at, updated_at
+		SELECT id, parent_session_id, depth, metadata, compaction_count, created_at, updated_at, forked_from_message_id
 		FROM agentpg_sessions`
 
 	countQuery := "SELECT COUNT(*) FROM agentpg_sessions"
@@ -144,6 +145,12 @@ func (s *Store) ListSessions(ctx context.Context, params driver.ListSessionsPara
 		argNum++
 	}
 
+	if params.ParentSessionID != nil {
+		whereClauses = append(whereClauses, fmt.Sprintf("parent_session_id = $%d", argNum))
+		args = append(args, *params.ParentSessionID)
+		argNum++
+	}
+
 	whereClause := ""
 	if len(whereClauses) > 0 {
 		whereClause = " WHERE " + whereClauses[0]
@@ -195,7 +202,7 @@ func (s *Store) ListSessions(ctx context.Context, params driver.ListSessionsPara
 		var metadata []byte
 		if err := rows.Scan(
 			&session.ID, &session.ParentSessionID,
-			&session.Depth, &metadata, &session.CompactionCount, &session.CreatedAt, &session.UpdatedAt,
+			&session.Depth, &metadata, &session.CompactionCount, &session.CreatedAt, &session.UpdatedAt, &session.ForkedFromMessageID,
 		); err != nil {
 			return nil, 0, fmt.Errorf("failed to scan session: %w", err)
 		}
@@ -212,6 +219,300 @@ func (s *Store) ListSessions(ctx context.Context, params driver.ListSessionsPara
 	return sessions, total, nil
 }
 
+func (s *Store) ForkSession(ctx context.Context, params driver.ForkSessionParams) (*driver.Session, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin fork: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// The fork point must belong to the root-level conversation, not to a
+	// child run (agent-as-tool) sharing the session
+	var forkedAt time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT m.created_at FROM agentpg_messages m
+		WHERE m.id = $1 AND m.session_id = $2
+		  AND (
+		      m.run_id IS NULL
+		      OR m.run_id IN (SELECT r.id FROM agentpg_runs r WHERE r.session_id = $2 AND r.depth = 0)
+		  )
+	`, params.AtMessageID, params.SessionID).Scan(&forkedAt)
+	if err == pgx.ErrNoRows {
+		return nil, driver.ErrForkPointNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fork point: %w", err)
+	}
+
+	session, err := s.createSession(ctx, tx, driver.CreateSessionParams{
+		ParentSessionID: &params.SessionID,
+		Metadata:        params.Metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE agentpg_sessions SET forked_from_message_id = $2 WHERE id = $1
+	`, session.ID, params.AtMessageID); err != nil {
+		return nil, fmt.Errorf("failed to set fork point: %w", err)
+	}
+	session.ForkedFromMessageID = &params.AtMessageID
+
+	rows, err := tx.Query(ctx, `
+		SELECT m.id FROM agentpg_messages m
+		WHERE m.session_id = $1 AND m.created_at <= $2
+		  AND (
+		      m.run_id IS NULL
+		      OR m.run_id IN (SELECT r.id FROM agentpg_runs r WHERE r.session_id = $1 AND r.depth = 0)
+		  )
+		ORDER BY m.created_at
+	`, params.SessionID, forkedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages to fork: %w", err)
+	}
+	var messageIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messageIDs = append(messageIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Copy each message with its content blocks, keeping the original
+	// timestamps so the fork orders its history like the source session
+	for _, id := range messageIDs {
+		var copyID uuid.UUID
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO agentpg_messages (session_id, role, usage, is_preserved, is_summary, metadata, created_at, updated_at)
+			SELECT $2, role, usage, is_preserved, is_summary, metadata, created_at, updated_at
+			FROM agentpg_messages WHERE id = $1
+			RETURNING id
+		`, id, session.ID).Scan(&copyID); err != nil {
+			return nil, fmt.Errorf("failed to copy message %s: %w", id, err)
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO agentpg_content_blocks (message_id, block_index, type, text, tool_use_id, tool_name, tool_input,
+				tool_result_for_use_id, tool_content, is_error, source, search_results, metadata)
+			SELECT $2, block_index, type, text, tool_use_id, tool_name, tool_input,
+				tool_result_for_use_id, tool_content, is_error, source, search_results, metadata
+			FROM agentpg_content_blocks WHERE message_id = $1
+		`, id, copyID); err != nil {
+			return nil, fmt.Errorf("failed to copy content blocks of message %s: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit fork: %w", err)
+	}
+	return session, nil
+}
+
+func (s *Store) ImportSession(ctx context.Context, params driver.ImportSessionParams) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin import: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	session := params.Session
+	metadata, err := json.Marshal(session.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO agentpg_sessions (id, parent_session_id, depth, metadata, compaction_count, created_at, updated_at, forked_from_message_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, session.ID, session.ParentSessionID, session.Depth, metadata, session.CompactionCount,
+		session.CreatedAt, session.UpdatedAt, session.ForkedFromMessageID); err != nil {
+		return fmt.Errorf("failed to import session: %w", err)
+	}
+
+	if err := importRuns(ctx, tx, params.Runs, params.Messages, params.Iterations, params.ToolExecutions); err != nil {
+		return err
+	}
+
+	for _, event := range params.CompactionEvents {
+		preservedIDs, _ := json.Marshal(event.PreservedMessageIDs)
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO agentpg_compaction_events (`+compactionEventColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		`, event.ID, event.SessionID, event.Strategy, event.OriginalTokens, event.CompactedTokens, event.MessagesRemoved,
+			event.SummaryContent, preservedIDs, event.ModelUsed, event.DurationMS, event.SummaryMessageID, event.RestoredAt, event.CreatedAt); err != nil {
+			return fmt.Errorf("failed to import compaction event %s: %w", event.ID, err)
+		}
+	}
+
+	for _, archived := range params.ArchivedMessages {
+		original, _ := json.Marshal(archived.OriginalMessage)
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO agentpg_message_archive (id, compaction_event_id, session_id, original_message, archived_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, archived.ID, archived.CompactionEventID, archived.SessionID, original, archived.ArchivedAt); err != nil {
+			return fmt.Errorf("failed to import archived message %s: %w", archived.ID, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit import: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) ImportRuns(ctx context.Context, params driver.ImportRunsParams) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin import: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err := importRuns(ctx, tx, params.Runs, params.Messages, params.Iterations, params.ToolExecutions); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit import: %w", err)
+	}
+	return nil
+}
+
+// importRuns inserts runs with their messages, iterations and tool
+// executions as given. Runs must be ordered parents first.
+func importRuns(ctx context.Context, e executor, runs []*driver.Run, messages []*driver.Message, iterations []*driver.Iteration, execs []*driver.ToolExecution) error {
+	// Runs reference iterations and tool executions that do not exist yet;
+	// those references are set once everything else is in place
+	for _, run := range runs {
+		metadata, _ := json.Marshal(run.Metadata)
+		if _, err := e.Exec(ctx, `
+			INSERT INTO agentpg_runs (id, session_id, agent_id, run_mode, parent_run_id, depth, state, previous_state,
+				prompt, current_iteration, response_text, stop_reason,
+				input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
+				iteration_count, tool_iterations, error_message, error_type,
+				created_by_instance_id, claimed_by_instance_id, claimed_at, metadata, created_at, started_at, finalized_at,
+				rescue_attempts, last_rescue_at, idempotency_key, scheduled_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16,
+				$17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32)
+		`, run.ID, run.SessionID, run.AgentID, run.RunMode, run.ParentRunID, run.Depth, run.State, run.PreviousState,
+			run.Prompt, run.CurrentIteration, run.ResponseText, run.StopReason,
+			run.InputTokens, run.OutputTokens, run.CacheCreationInputTokens, run.CacheReadInputTokens,
+			run.IterationCount, run.ToolIterations, run.ErrorMessage, run.ErrorType,
+			run.CreatedByInstanceID, run.ClaimedByInstanceID, run.ClaimedAt, metadata, run.CreatedAt, run.StartedAt, run.FinalizedAt,
+			run.RescueAttempts, run.LastRescueAt, run.IdempotencyKey, run.ScheduledAt); err != nil {
+			return fmt.Errorf("failed to import run %s: %w", run.ID, err)
+		}
+	}
+
+	for _, msg := range messages {
+		if err := restoreMessage(ctx, e, msg); err != nil {
+			return err
+		}
+	}
+
+	for _, iter := range iterations {
+		var requestMessageIDs []byte
+		if iter.RequestMessageIDs != nil {
+			requestMessageIDs, _ = json.Marshal(iter.RequestMessageIDs)
+		}
+		apiAttempts, _ := json.Marshal(iter.APIAttempts)
+		if iter.APIAttempts == nil {
+			apiAttempts = []byte("[]")
+		}
+		if _, err := e.Exec(ctx, `
+			INSERT INTO agentpg_iterations (id, run_id, iteration_number, is_streaming,
+				batch_id, batch_request_id, batch_status,
+				batch_submitted_at, batch_completed_at, batch_expires_at, batch_poll_count, batch_last_poll_at,
+				streaming_started_at, streaming_completed_at,
+				trigger_type, request_message_ids, stop_reason, response_message_id, has_tool_use, tool_execution_count,
+				input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
+				error_message, error_type, created_at, started_at, completed_at, api_attempts, model, batch_next_poll_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16,
+				$17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32)
+		`, iter.ID, iter.RunID, iter.IterationNumber, iter.IsStreaming,
+			iter.BatchID, iter.BatchRequestID, iter.BatchStatus,
+			iter.BatchSubmittedAt, iter.BatchCompletedAt, iter.BatchExpiresAt, iter.BatchPollCount, iter.BatchLastPollAt,
+			iter.StreamingStartedAt, iter.StreamingCompletedAt,
+			iter.TriggerType, requestMessageIDs, iter.StopReason, iter.ResponseMessageID, iter.HasToolUse, iter.ToolExecutionCount,
+			iter.InputTokens, iter.OutputTokens, iter.CacheCreationInputTokens, iter.CacheReadInputTokens,
+			iter.ErrorMessage, iter.ErrorType, iter.CreatedAt, iter.StartedAt, iter.CompletedAt, apiAttempts, iter.Model, iter.BatchNextPollAt); err != nil {
+			return fmt.Errorf("failed to import iteration %s: %w", iter.ID, err)
+		}
+	}
+
+	for _, exec := range execs {
+		if _, err := e.Exec(ctx, `
+			INSERT INTO agentpg_tool_executions (id, run_id, iteration_id, state, tool_use_id, tool_name, tool_input, is_agent_tool, agent_id, child_run_id,
+				tool_output, is_error, error_message, claimed_by_instance_id, claimed_at, attempt_count, max_attempts,
+				scheduled_at, snooze_count, last_error, created_at, started_at, completed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)
+		`, exec.ID, exec.RunID, exec.IterationID, exec.State, exec.ToolUseID, exec.ToolName, exec.ToolInput,
+			exec.IsAgentTool, exec.AgentID, exec.ChildRunID, exec.ToolOutput, exec.IsError, exec.ErrorMessage,
+			exec.ClaimedByInstanceID, exec.ClaimedAt, exec.AttemptCount, exec.MaxAttempts,
+			exec.ScheduledAt, exec.SnoozeCount, exec.LastError, exec.CreatedAt, exec.StartedAt, exec.CompletedAt); err != nil {
+			return fmt.Errorf("failed to import tool execution %s: %w", exec.ID, err)
+		}
+	}
+
+	for _, run := range runs {
+		if run.CurrentIterationID == nil && run.ParentToolExecutionID == nil {
+			continue
+		}
+		if _, err := e.Exec(ctx, `
+			UPDATE agentpg_runs SET current_iteration_id = $2, parent_tool_execution_id = $3 WHERE id = $1
+		`, run.ID, run.CurrentIterationID, run.ParentToolExecutionID); err != nil {
+			return fmt.Errorf("failed to link run %s: %w", run.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) DeleteSession(ctx context.Context, id uuid.UUID) (*driver.PurgeCounts, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin delete: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ids, err := collectIDs(tx.Query(ctx, `
+		WITH RECURSIVE tree AS (
+			SELECT id FROM agentpg_sessions WHERE id = $1
+			UNION ALL
+			SELECT s.id FROM agentpg_sessions s JOIN tree t ON s.parent_session_id = t.id
+		)
+		SELECT id FROM tree
+	`, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get child sessions: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	for _, sessionID := range ids {
+		if err := lockSessionForCompaction(ctx, tx, sessionID, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	counts, err := countSessionRows(ctx, tx, ids)
+	if err != nil {
+		return nil, err
+	}
+	// Child sessions, runs, messages and everything below them cascade
+	if _, err := tx.Exec(ctx, "DELETE FROM agentpg_sessions WHERE id = $1", id); err != nil {
+		return nil, fmt.Errorf("failed to delete session: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit delete: %w", err)
+	}
+	return counts, nil
+}
+
 func (s *Store) GetMetadataValues(ctx context.Context, key string) ([]driver.MetadataValue, error) {
 	rows, err := s.pool.Query(ctx, `
 		SELECT metadata->>$1 as value, COUNT(*) as session_count
@@ -256,19 +557,25 @@ func (s *Store) CreateAgent(ctx context.Context, agent *driver.AgentDefinition)
 	if agentIDs == nil {
 		agentIDs = []uuid.UUID{}
 	}
+	fallbackModels := agent.FallbackModels
+	if fallbackModels == nil {
+		fallbackModels = []string{}
+	}
 
 	var result driver.AgentDefinition
 	var configOut, metadataOut []byte
 	err := s.pool.QueryRow(ctx, `
-		INSERT INTO agentpg_agents (name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
-		RETURNING id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at
+		INSERT INTO agentpg_agents (name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, fallback_models, fallback_latency_budget_ms, max_concurrent_runs)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		RETURNING id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at, fallback_models, fallback_latency_budget_ms, max_concurrent_runs
 	`, agent.Name, agent.Description, agent.Model, agent.SystemPrompt,
 		agent.MaxTokens, agent.Temperature, agent.TopK, agent.TopP,
-		toolNames, agentIDs, metadata, config).Scan(
+		toolNames, agentIDs, metadata, config,
+		fallbackModels, agent.FallbackLatencyBudgetMs, agent.MaxConcurrentRuns).Scan(
 		&result.ID, &result.Name, &result.Description, &result.Model, &result.SystemPrompt,
 		&result.MaxTokens, &result.Temperature, &result.TopK, &result.TopP,
 		&result.ToolNames, &result.AgentIDs, &metadataOut, &configOut, &result.CreatedAt, &result.UpdatedAt,
+		&result.FallbackModels, &result.FallbackLatencyBudgetMs, &result.MaxConcurrentRuns,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create agent: %w", err)
@@ -291,6 +598,10 @@ func (s *Store) UpdateAgent(ctx context.Context, agent *driver.AgentDefinition)
 	if agentIDs == nil {
 		agentIDs = []uuid.UUID{}
 	}
+	fallbackModels := agent.FallbackModels
+	if fallbackModels == nil {
+		fallbackModels = []string{}
+	}
 
 	_, err := s.pool.Exec(ctx, `
 		UPDATE agentpg_agents SET
@@ -306,11 +617,15 @@ func (s *Store) UpdateAgent(ctx context.Context, agent *driver.AgentDefinition)
 			agent_ids = $11,
 			metadata = $12,
 			config = $13,
+			fallback_models = $14,
+			fallback_latency_budget_ms = $15,
+			max_concurrent_runs = $16,
 			updated_at = NOW()
 		WHERE id = $1
 	`, agent.ID, agent.Name, agent.Description, agent.Model, agent.SystemPrompt,
 		agent.MaxTokens, agent.Temperature, agent.TopK, agent.TopP,
-		toolNames, agentIDs, metadata, config)
+		toolNames, agentIDs, metadata, config,
+		fallbackModels, agent.FallbackLatencyBudgetMs, agent.MaxConcurrentRuns)
 	return err
 }
 
@@ -318,12 +633,13 @@ func (s *Store) GetAgent(ctx context.Context, id uuid.UUID) (*driver.AgentDefini
 	var agent driver.AgentDefinition
 	var config, metadata []byte
 	err := s.pool.QueryRow(ctx, `
-		SELECT id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at
+		SELECT id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at, fallback_models, fallback_latency_budget_ms, max_concurrent_runs
 		FROM agentpg_agents WHERE id = $1
 	`, id).Scan(
 		&agent.ID, &agent.Name, &agent.Description, &agent.Model, &agent.SystemPrompt,
 		&agent.MaxTokens, &agent.Temperature, &agent.TopK, &agent.TopP,
 		&agent.ToolNames, &agent.AgentIDs, &metadata, &config, &agent.CreatedAt, &agent.UpdatedAt,
+		&agent.FallbackModels, &agent.FallbackLatencyBudgetMs, &agent.MaxConcurrentRuns,
 	)
 	if err == pgx.ErrNoRows {
 		return nil, nil
@@ -345,22 +661,24 @@ func (s *Store) GetAgentByName(ctx context.Context, name string, metadata map[st
 		// Filter by name and metadata
 		metadataJSON, _ := json.Marshal(metadata)
 		err = s.pool.QueryRow(ctx, `
-			SELECT id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at
+			SELECT id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at, fallback_models, fallback_latency_budget_ms, max_concurrent_runs
 			FROM agentpg_agents WHERE name = $1 AND metadata @> $2
 		`, name, metadataJSON).Scan(
 			&agent.ID, &agent.Name, &agent.Description, &agent.Model, &agent.SystemPrompt,
 			&agent.MaxTokens, &agent.Temperature, &agent.TopK, &agent.TopP,
 			&agent.ToolNames, &agent.AgentIDs, &metadataOut, &config, &agent.CreatedAt, &agent.UpdatedAt,
+			&agent.FallbackModels, &agent.FallbackLatencyBudgetMs, &agent.MaxConcurrentRuns,
 		)
 	} else {
 		// Filter by name only - returns first match
 		err = s.pool.QueryRow(ctx, `
-			SELECT id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at
+			SELECT id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at, fallback_models, fallback_latency_budget_ms, max_concurrent_runs
 			FROM agentpg_agents WHERE name = $1 LIMIT 1
 		`, name).Scan(
 			&agent.ID, &agent.Name, &agent.Description, &agent.Model, &agent.SystemPrompt,
 			&agent.MaxTokens, &agent.Temperature, &agent.TopK, &agent.TopP,
 			&agent.ToolNames, &agent.AgentIDs, &metadataOut, &config, &agent.CreatedAt, &agent.UpdatedAt,
+			&agent.FallbackModels, &agent.FallbackLatencyBudgetMs, &agent.MaxConcurrentRuns,
 		)
 	}
 	if err == pgx.ErrNoRows {
@@ -382,7 +700,7 @@ func (s *Store) DeleteAgent(ctx context.Context, id uuid.UUID) error {
 func (s *Store) ListAgents(ctx context.Context, params driver.ListAgentsParams) ([]*driver.AgentDefinition, int, error) {
 	// Build dynamic query with filters
 	baseQuery := `
-		SELECT id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at
+		SELECT id, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p, tool_names, agent_ids, metadata, config, created_at, updated_at, fallback_models, fallback_latency_budget_ms, max_concurrent_runs
 		FROM agentpg_agents`
 
 	countQuery := "SELECT COUNT(*) FROM agentpg_agents"
@@ -451,6 +769,7 @@ func (s *Store) ListAgents(ctx context.Context, params driver.ListAgentsParams)
 			&agent.ID, &agent.Name, &agent.Description, &agent.Model, &agent.SystemPrompt,
 			&agent.MaxTokens, &agent.Temperature, &agent.TopK, &agent.TopP,
 			&agent.ToolNames, &agent.AgentIDs, &metadata, &config, &agent.CreatedAt, &agent.UpdatedAt,
+			&agent.FallbackModels, &agent.FallbackLatencyBudgetMs, &agent.MaxConcurrentRuns,
 		); err != nil {
 			return nil, 0, fmt.Errorf("failed to scan agent: %w", err)
 		}
@@ -461,22 +780,87 @@ func (s *Store) ListAgents(ctx context.Context, params driver.ListAgentsParams)
 	return agents, total, rows.Err()
 }
 
+// Agent version operations
+
+const agentVersionColumns = `id, agent_id, version, name, description, model, system_prompt, max_tokens, temperature, top_k, top_p,
+	tool_names, agent_ids, metadata, config, fallback_models, fallback_latency_budget_ms, max_concurrent_runs, created_at`
+
+func (s *Store) ListAgentVersions(ctx context.Context, agentID uuid.UUID) ([]*driver.AgentVersion, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+agentVersionColumns+`
+		FROM agentpg_agent_versions WHERE agent_id = $1
+		ORDER BY version DESC
+	`, agentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agent versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []*driver.AgentVersion
+	for rows.Next() {
+		version, err := scanAgentVersion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan agent version: %w", err)
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+func (s *Store) GetAgentVersion(ctx context.Context, agentID uuid.UUID, version int) (*driver.AgentVersion, error) {
+	v, err := scanAgentVersion(s.pool.QueryRow(ctx, `
+		SELECT `+agentVersionColumns+`
+		FROM agentpg_agent_versions WHERE agent_id = $1 AND version = $2
+	`, agentID, version))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// scanAgentVersion scans a row of agentVersionColumns.
+func scanAgentVersion(row interface{ Scan(dest ...any) error }) (*driver.AgentVersion, error) {
+	var version driver.AgentVersion
+	var agent driver.AgentDefinition
+	var config, metadata []byte
+	if err := row.Scan(
+		&version.ID, &version.AgentID, &version.Version, &agent.Name, &agent.Description, &agent.Model, &agent.SystemPrompt,
+		&agent.MaxTokens, &agent.Temperature, &agent.TopK, &agent.TopP,
+		&agent.ToolNames, &agent.AgentIDs, &metadata, &config,
+		&agent.FallbackModels, &agent.FallbackLatencyBudgetMs, &agent.MaxConcurrentRuns,
+		&version.CreatedAt,
+	); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal(config, &agent.Config)
+	_ = json.Unmarshal(metadata, &agent.Metadata)
+	agent.ID = version.AgentID
+	agent.CreatedAt = version.CreatedAt
+	agent.UpdatedAt = version.CreatedAt
+	version.Agent = &agent
+	return &version, nil
+}
+
 // Tool operations
 
 func (s *Store) UpsertTool(ctx context.Context, tool *driver.ToolDefinition) error {
 	inputSchema, _ := json.Marshal(tool.InputSchema)
 	metadata, _ := json.Marshal(tool.Metadata)
 	_, err := s.pool.Exec(ctx, `
-		INSERT INTO agentpg_tools (name, description, input_schema, is_agent_tool, agent_id, metadata, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		INSERT INTO agentpg_tools (name, description, input_schema, is_agent_tool, agent_id, metadata, max_concurrency, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
 		ON CONFLICT (name) DO UPDATE SET
 			description = EXCLUDED.description,
 			input_schema = EXCLUDED.input_schema,
 			is_agent_tool = EXCLUDED.is_agent_tool,
 			agent_id = EXCLUDED.agent_id,
 			metadata = EXCLUDED.metadata,
+			max_concurrency = EXCLUDED.max_concurrency,
 			updated_at = NOW()
-	`, tool.Name, tool.Description, inputSchema, tool.IsAgentTool, tool.AgentID, metadata)
+	`, tool.Name, tool.Description, inputSchema, tool.IsAgentTool, tool.AgentID, metadata, tool.MaxConcurrency)
 	return err
 }
 
@@ -484,11 +868,11 @@ func (s *Store) GetTool(ctx context.Context, name string) (*driver.ToolDefinitio
 	var tool driver.ToolDefinition
 	var inputSchema, metadata []byte
 	err := s.pool.QueryRow(ctx, `
-		SELECT name, description, input_schema, is_agent_tool, agent_id, metadata, created_at, updated_at
+		SELECT name, description, input_schema, is_agent_tool, agent_id, metadata, created_at, updated_at, max_concurrency
 		FROM agentpg_tools WHERE name = $1
 	`, name).Scan(
 		&tool.Name, &tool.Description, &inputSchema, &tool.IsAgentTool,
-		&tool.AgentID, &metadata, &tool.CreatedAt, &tool.UpdatedAt,
+		&tool.AgentID, &metadata, &tool.CreatedAt, &tool.UpdatedAt, &tool.MaxConcurrency,
 	)
 	if err == pgx.ErrNoRows {
 		return nil, nil
@@ -508,7 +892,7 @@ func (s *Store) DeleteTool(ctx context.Context, name string) error {
 
 func (s *Store) ListTools(ctx context.Context) ([]*driver.ToolDefinition, error) {
 	rows, err := s.pool.Query(ctx, `
-		SELECT name, description, input_schema, is_agent_tool, agent_id, metadata, created_at, updated_at
+		SELECT name, description, input_schema, is_agent_tool, agent_id, metadata, created_at, updated_at, max_concurrency
 		FROM agentpg_tools ORDER BY name
 	`)
 	if err != nil {
@@ -522,7 +906,7 @@ func (s *Store) ListTools(ctx context.Context) ([]*driver.ToolDefinition, error)
 		var inputSchema, metadata []byte
 		if err := rows.Scan(
 			&tool.Name, &tool.Description, &inputSchema, &tool.IsAgentTool,
-			&tool.AgentID, &metadata, &tool.CreatedAt, &tool.UpdatedAt,
+			&tool.AgentID, &metadata, &tool.CreatedAt, &tool.UpdatedAt, &tool.MaxConcurrency,
 		); err != nil {
 			return nil, err
 		}
@@ -553,25 +937,43 @@ func (s *Store) createRun(ctx context.Context, e executor, params driver.CreateR
 		runMode = "batch"
 	}
 
+	if params.IdempotencyKey != "" {
+		// Release the key if its run is older than the retention window so it can be reused
+		_, err := e.Exec(ctx, `
+			UPDATE agentpg_runs SET idempotency_key = NULL
+			WHERE session_id = $1 AND idempotency_key = $2 AND created_at < NOW() - make_interval(secs => $3)
+		`, params.SessionID, params.IdempotencyKey, params.IdempotencyTTL.Seconds())
+		if err != nil {
+			return nil, fmt.Errorf("failed to release expired idempotency key: %w", err)
+		}
+	}
+
+	// ON CONFLICT DO NOTHING (rather than catching a unique violation) keeps the
+	// caller's transaction usable when the key is already taken
 	err := e.QueryRow(ctx, `
-		INSERT INTO agentpg_runs (session_id, agent_id, prompt, run_mode, parent_run_id, parent_tool_execution_id, depth, created_by_instance_id, metadata)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO agentpg_runs (session_id, agent_id, prompt, run_mode, parent_run_id, parent_tool_execution_id, depth, created_by_instance_id, metadata, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (session_id, idempotency_key) WHERE idempotency_key IS NOT NULL DO NOTHING
 		RETURNING id, session_id, agent_id, run_mode, parent_run_id, parent_tool_execution_id, depth, state, previous_state,
 			prompt, current_iteration, current_iteration_id, response_text, stop_reason,
 			input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
 			iteration_count, tool_iterations, error_message, error_type,
 			created_by_instance_id, claimed_by_instance_id, claimed_at, metadata, created_at, started_at, finalized_at,
-			rescue_attempts, last_rescue_at
+			rescue_attempts, last_rescue_at, idempotency_key, scheduled_at
 	`, params.SessionID, params.AgentID, params.Prompt, runMode, params.ParentRunID,
-		params.ParentToolExecutionID, params.Depth, params.CreatedByInstanceID, metadata).Scan(
+		params.ParentToolExecutionID, params.Depth, params.CreatedByInstanceID, metadata, nullIfEmpty(params.IdempotencyKey)).Scan(
 		&run.ID, &run.SessionID, &run.AgentID, &run.RunMode, &run.ParentRunID, &run.ParentToolExecutionID, &run.Depth,
 		&run.State, &run.PreviousState, &run.Prompt, &run.CurrentIteration, &run.CurrentIterationID,
 		&run.ResponseText, &run.StopReason, &run.InputTokens, &run.OutputTokens,
 		&run.CacheCreationInputTokens, &run.CacheReadInputTokens, &run.IterationCount, &run.ToolIterations,
 		&run.ErrorMessage, &run.ErrorType, &run.CreatedByInstanceID, &run.ClaimedByInstanceID, &run.ClaimedAt,
 		&metadata, &run.CreatedAt, &run.StartedAt, &run.FinalizedAt,
-		&run.RescueAttempts, &run.LastRescueAt,
+		&run.RescueAttempts, &run.LastRescueAt, &run.IdempotencyKey, &run.ScheduledAt,
 	)
+	if err == pgx.ErrNoRows && params.IdempotencyKey != "" {
+		// Key already in use: return the existing run
+		return s.getRunByIdempotencyKey(ctx, e, params)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create run: %w", err)
 	}
@@ -579,6 +981,61 @@ func (s *Store) createRun(ctx context.Context, e executor, params driver.CreateR
 	return &run, nil
 }
 
+func (s *Store) getRunByIdempotencyKey(ctx context.Context, e executor, params driver.CreateRunParams) (*driver.Run, error) {
+	rows, err := e.Query(ctx, `
+		SELECT id, session_id, agent_id, run_mode, parent_run_id, parent_tool_execution_id, depth, state, previous_state,
+			prompt, current_iteration, current_iteration_id, response_text, stop_reason,
+			input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
+			iteration_count, tool_iterations, error_message, error_type,
+			created_by_instance_id, claimed_by_instance_id, claimed_at, metadata, created_at, started_at, finalized_at,
+			rescue_attempts, last_rescue_at, idempotency_key, scheduled_at
+		FROM agentpg_runs WHERE session_id = $1 AND idempotency_key = $2
+	`, params.SessionID, params.IdempotencyKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get run by idempotency key: %w", err)
+	}
+	defer rows.Close()
+
+	runs, err := collectRuns(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get run by idempotency key: %w", err)
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("failed to create run: idempotency key %q conflicted but no run was found", params.IdempotencyKey)
+	}
+	if err := checkIdempotentRun(runs[0], params); err != nil {
+		return nil, err
+	}
+	return runs[0], nil
+}
+
+// checkIdempotentRun returns ErrIdempotencyConflict if the run holding an
+// idempotency key was created for a different agent, prompt, run mode or
+// metadata (the run's variables).
+func checkIdempotentRun(run *driver.Run, params driver.CreateRunParams) error {
+	runMode := params.RunMode
+	if runMode == "" {
+		runMode = "batch"
+	}
+	if run.AgentID != params.AgentID || run.Prompt != params.Prompt || run.RunMode != runMode ||
+		!sameMetadata(run.Metadata, params.Metadata) {
+		return fmt.Errorf("failed to create run: %w: key %q belongs to run %s", driver.ErrIdempotencyConflict, params.IdempotencyKey, run.ID)
+	}
+	return nil
+}
+
+// sameMetadata reports whether two metadata maps hold the same values once
+// encoded as JSON, the form stored metadata was read back from. A nil and an
+// empty map are the same.
+func sameMetadata(a, b map[string]any) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
 func (s *Store) GetRun(ctx context.Context, id uuid.UUID) (*driver.Run, error) {
 	var run driver.Run
 	var metadata []byte
@@ -588,7 +1045,7 @@ func (s *Store) GetRun(ctx context.Context, id uuid.UUID) (*driver.Run, error) {
 			input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
 			iteration_count, tool_iterations, error_message, error_type,
 			created_by_instance_id, claimed_by_instance_id, claimed_at, metadata, created_at, started_at, finalized_at,
-			rescue_attempts, last_rescue_at
+			rescue_attempts, last_rescue_at, idempotency_key, scheduled_at
 		FROM agentpg_runs WHERE id = $1
 	`, id).Scan(
 		&run.ID, &run.SessionID, &run.AgentID, &run.RunMode, &run.ParentRunID, &run.ParentToolExecutionID, &run.Depth,
@@ -597,7 +1054,7 @@ func (s *Store) GetRun(ctx context.Context, id uuid.UUID) (*driver.Run, error) {
 		&run.CacheCreationInputTokens, &run.CacheReadInputTokens, &run.IterationCount, &run.ToolIterations,
 		&run.ErrorMessage, &run.ErrorType, &run.CreatedByInstanceID, &run.ClaimedByInstanceID, &run.ClaimedAt,
 		&metadata, &run.CreatedAt, &run.StartedAt, &run.FinalizedAt,
-		&run.RescueAttempts, &run.LastRescueAt,
+		&run.RescueAttempts, &run.LastRescueAt, &run.IdempotencyKey, &run.ScheduledAt,
 	)
 	if err == pgx.ErrNoRows {
 		return nil, nil
@@ -676,7 +1133,7 @@ func (s *Store) GetRunsBySession(ctx context.Context, sessionID uuid.UUID, limit
 			input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
 			iteration_count, tool_iterations, error_message, error_type,
 			created_by_instance_id, claimed_by_instance_id, claimed_at, metadata, created_at, started_at, finalized_at,
-			rescue_attempts, last_rescue_at
+			rescue_attempts, last_rescue_at, idempotency_key, scheduled_at
 		FROM agentpg_runs WHERE session_id = $1 ORDER BY created_at DESC LIMIT $2
 	`, sessionID, limit)
 	if err != nil {
@@ -696,7 +1153,7 @@ func (s *Store) GetStuckPendingToolsRuns(ctx context.Context, limit int) ([]*dri
 			r.input_tokens, r.output_tokens, r.cache_creation_input_tokens, r.cache_read_input_tokens,
 			r.iteration_count, r.tool_iterations, r.error_message, r.error_type,
 			r.created_by_instance_id, r.claimed_by_instance_id, r.claimed_at, r.metadata, r.created_at, r.started_at, r.finalized_at,
-			r.rescue_attempts, r.last_rescue_at
+			r.rescue_attempts, r.last_rescue_at, r.idempotency_key, r.scheduled_at
 		FROM agentpg_runs r
 		WHERE r.state = 'pending_tools'
 		  AND r.current_iteration_id IS NOT NULL
@@ -724,7 +1181,7 @@ func (s *Store) ListRuns(ctx context.Context, params driver.ListRunsParams) ([]*
 			r.input_tokens, r.output_tokens, r.cache_creation_input_tokens, r.cache_read_input_tokens,
 			r.iteration_count, r.tool_iterations, r.error_message, r.error_type,
 			r.created_by_instance_id, r.claimed_by_instance_id, r.claimed_at, r.metadata, r.created_at, r.started_at, r.finalized_at,
-			r.rescue_attempts, r.last_rescue_at
+			r.rescue_attempts, r.last_rescue_at, r.idempotency_key, r.scheduled_at
 		FROM agentpg_runs r`
 
 	countQuery := "SELECT COUNT(*) FROM agentpg_runs r"
@@ -821,6 +1278,7 @@ func (s *Store) ListRuns(ctx context.Context, params driver.ListRunsParams) ([]*
 
 func (s *Store) CreateIteration(ctx context.Context, params driver.CreateIterationParams) (*driver.Iteration, error) {
 	var iter driver.Iteration
+	var apiAttempts []byte
 	err := s.pool.QueryRow(ctx, `
 		INSERT INTO agentpg_iterations (run_id, iteration_number, is_streaming, trigger_type)
 		VALUES ($1, $2, $3, $4)
@@ -830,7 +1288,7 @@ func (s *Store) CreateIteration(ctx context.Context, params driver.CreateIterati
 			streaming_started_at, streaming_completed_at,
 			trigger_type, request_message_ids, stop_reason, response_message_id, has_tool_use, tool_execution_count,
 			input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
-			error_message, error_type, created_at, started_at, completed_at
+			error_message, error_type, created_at, started_at, completed_at, api_attempts, model, batch_next_poll_at
 	`, params.RunID, params.IterationNumber, params.IsStreaming, params.TriggerType).Scan(
 		&iter.ID, &iter.RunID, &iter.IterationNumber, &iter.IsStreaming,
 		&iter.BatchID, &iter.BatchRequestID, &iter.BatchStatus,
@@ -838,16 +1296,18 @@ func (s *Store) CreateIteration(ctx context.Context, params driver.CreateIterati
 		&iter.StreamingStartedAt, &iter.StreamingCompletedAt,
 		&iter.TriggerType, &iter.RequestMessageIDs, &iter.StopReason, &iter.ResponseMessageID, &iter.HasToolUse, &iter.ToolExecutionCount,
 		&iter.InputTokens, &iter.OutputTokens, &iter.CacheCreationInputTokens, &iter.CacheReadInputTokens,
-		&iter.ErrorMessage, &iter.ErrorType, &iter.CreatedAt, &iter.StartedAt, &iter.CompletedAt,
+		&iter.ErrorMessage, &iter.ErrorType, &iter.CreatedAt, &iter.StartedAt, &iter.CompletedAt, &apiAttempts, &iter.Model, &iter.BatchNextPollAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create iteration: %w", err)
 	}
+	_ = json.Unmarshal(apiAttempts, &iter.APIAttempts)
 	return &iter, nil
 }
 
 func (s *Store) GetIteration(ctx context.Context, id uuid.UUID) (*driver.Iteration, error) {
 	var iter driver.Iteration
+	var apiAttempts []byte
 	err := s.pool.QueryRow(ctx, `
 		SELECT id, run_id, iteration_number, is_streaming,
 			batch_id, batch_request_id, batch_status,
@@ -855,7 +1315,7 @@ func (s *Store) GetIteration(ctx context.Context, id uuid.UUID) (*driver.Iterati
 			streaming_started_at, streaming_completed_at,
 			trigger_type, request_message_ids, stop_reason, response_message_id, has_tool_use, tool_execution_count,
 			input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
-			error_message, error_type, created_at, started_at, completed_at
+			error_message, error_type, created_at, started_at, completed_at, api_attempts, model, batch_next_poll_at
 		FROM agentpg_iterations WHERE id = $1
 	`, id).Scan(
 		&iter.ID, &iter.RunID, &iter.IterationNumber, &iter.IsStreaming,
@@ -864,7 +1324,7 @@ func (s *Store) GetIteration(ctx context.Context, id uuid.UUID) (*driver.Iterati
 		&iter.StreamingStartedAt, &iter.StreamingCompletedAt,
 		&iter.TriggerType, &iter.RequestMessageIDs, &iter.StopReason, &iter.ResponseMessageID, &iter.HasToolUse, &iter.ToolExecutionCount,
 		&iter.InputTokens, &iter.OutputTokens, &iter.CacheCreationInputTokens, &iter.CacheReadInputTokens,
-		&iter.ErrorMessage, &iter.ErrorType, &iter.CreatedAt, &iter.StartedAt, &iter.CompletedAt,
+		&iter.ErrorMessage, &iter.ErrorType, &iter.CreatedAt, &iter.StartedAt, &iter.CompletedAt, &apiAttempts, &iter.Model, &iter.BatchNextPollAt,
 	)
 	if err == pgx.ErrNoRows {
 		return nil, nil
@@ -872,6 +1332,7 @@ func (s *Store) GetIteration(ctx context.Context, id uuid.UUID) (*driver.Iterati
 	if err != nil {
 		return nil, err
 	}
+	_ = json.Unmarshal(apiAttempts, &iter.APIAttempts)
 	return &iter, nil
 }
 
@@ -896,9 +1357,23 @@ func (s *Store) UpdateIteration(ctx context.Context, id uuid.UUID, updates map[s
 	return err
 }
 
-func (s *Store) GetIterationsForPoll(ctx context.Context, instanceID string, pollInterval time.Duration, maxCount int) ([]*driver.Iteration, error) {
-	rows, err := s.pool.Query(ctx, "SELECT * FROM agentpg_get_iterations_for_poll($1, $2, $3)",
-		instanceID, pollInterval.String(), maxCount)
+func (s *Store) AddIterationAPIAttempt(ctx context.Context, id uuid.UUID, attempt driver.APIAttempt) error {
+	data, err := json.Marshal([]driver.APIAttempt{attempt})
+	if err != nil {
+		return fmt.Errorf("failed to marshal api attempt: %w", err)
+	}
+	_, err = s.pool.Exec(ctx, `
+		UPDATE agentpg_iterations SET api_attempts = api_attempts || $2::jsonb WHERE id = $1
+	`, id, data)
+	if err != nil {
+		return fmt.Errorf("failed to add iteration api attempt: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) GetIterationsForPoll(ctx context.Context, instanceID string, maxCount int) ([]*driver.Iteration, error) {
+	rows, err := s.pool.Query(ctx, "SELECT * FROM agentpg_get_iterations_for_poll($1, $2)",
+		instanceID, maxCount)
 	if err != nil {
 		return nil, err
 	}
@@ -915,7 +1390,7 @@ func (s *Store) GetIterationsByRun(ctx context.Context, runID uuid.UUID) ([]*dri
 			streaming_started_at, streaming_completed_at,
 			trigger_type, request_message_ids, stop_reason, response_message_id, has_tool_use, tool_execution_count,
 			input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
-			error_message, error_type, created_at, started_at, completed_at
+			error_message, error_type, created_at, started_at, completed_at, api_attempts, model, batch_next_poll_at
 		FROM agentpg_iterations WHERE run_id = $1 ORDER BY iteration_number
 	`, runID)
 	if err != nil {
@@ -926,6 +1401,43 @@ func (s *Store) GetIterationsByRun(ctx context.Context, runID uuid.UUID) ([]*dri
 	return collectIterations(rows)
 }
 
+func (s *Store) GetIterationsByBatch(ctx context.Context, batchID string) ([]*driver.Iteration, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, run_id, iteration_number, is_streaming,
+			batch_id, batch_request_id, batch_status,
+			batch_submitted_at, batch_completed_at, batch_expires_at, batch_poll_count, batch_last_poll_at,
+			streaming_started_at, streaming_completed_at,
+			trigger_type, request_message_ids, stop_reason, response_message_id, has_tool_use, tool_execution_count,
+			input_tokens, output_tokens, cache_creation_input_tokens, cache_read_input_tokens,
+			error_message, error_type, created_at, started_at, completed_at, api_attempts, model, batch_next_poll_at
+		FROM agentpg_iterations WHERE batch_id = $1 ORDER BY created_at, id
+	`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return collectIterations(rows)
+}
+
+func (s *Store) MarkBatchPolled(ctx context.Context, batchID string, nextPollAt time.Time) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE agentpg_iterations
+		SET batch_poll_count = batch_poll_count + 1, batch_last_poll_at = NOW(), batch_next_poll_at = $2
+		WHERE batch_id = $1 AND batch_status IN ('in_progress', 'canceling')
+	`, batchID, nextPollAt)
+	return err
+}
+
+func (s *Store) ScheduleBatchPoll(ctx context.Context, batchID string, nextPollAt time.Time) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE agentpg_iterations
+		SET batch_next_poll_at = $2
+		WHERE batch_id = $1 AND batch_status IN ('in_progress', 'canceling')
+	`, batchID, nextPollAt)
+	return err
+}
+
 // Tool execution operations
 
 func (s *Store) CreateToolExecution(ctx context.Context, params driver.CreateToolExecutionParams) (*driver.ToolExecution, error) {
@@ -1178,6 +1690,19 @@ func (s *Store) ListToolExecutions(ctx context.Context, params driver.ListToolEx
 		argNum++
 	}
 
+	// Filter by the metadata of the run's session
+	if len(params.MetadataFilter) > 0 {
+		filterJSON, err := json.Marshal(params.MetadataFilter)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to marshal metadata filter: %w", err)
+		}
+		whereClauses = append(whereClauses, fmt.Sprintf(`run_id IN (
+			SELECT r.id FROM agentpg_runs r JOIN agentpg_sessions s ON r.session_id = s.id
+			WHERE s.metadata @> $%d)`, argNum))
+		args = append(args, filterJSON)
+		argNum++
+	}
+
 	whereClause := ""
 	if len(whereClauses) > 0 {
 		whereClause = " WHERE " + whereClauses[0]
@@ -1357,38 +1882,375 @@ func (s *Store) RescueRun(ctx context.Context, id uuid.UUID) error {
 	return err
 }
 
-// Message operations
-
-func (s *Store) CreateMessage(ctx context.Context, params driver.CreateMessageParams) (*driver.Message, error) {
-	var msg driver.Message
-	usage, _ := json.Marshal(params.Usage)
-	metadata, _ := json.Marshal(params.Metadata)
-
-	err := s.pool.QueryRow(ctx, `
-		INSERT INTO agentpg_messages (session_id, run_id, role, usage, is_preserved, is_summary, metadata)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, session_id, run_id, role, usage, is_preserved, is_summary, metadata, created_at, updated_at
-	`, params.SessionID, params.RunID, params.Role, usage, params.IsPreserved, params.IsSummary, metadata).Scan(
-		&msg.ID, &msg.SessionID, &msg.RunID, &msg.Role, &usage, &msg.IsPreserved, &msg.IsSummary, &metadata, &msg.CreatedAt, &msg.UpdatedAt,
-	)
+func (s *Store) RetryRun(ctx context.Context, id, iterationID uuid.UUID, attempt driver.APIAttempt, scheduledAt time.Time) error {
+	data, err := json.Marshal([]driver.APIAttempt{attempt})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create message: %w", err)
+		return fmt.Errorf("failed to marshal api attempt: %w", err)
 	}
-	_ = json.Unmarshal(usage, &msg.Usage)
-	_ = json.Unmarshal(metadata, &msg.Metadata)
-
-	// Create content blocks
-	if err := s.CreateContentBlocks(ctx, msg.ID, params.Content); err != nil {
-		return nil, err
+	// Both updates run in one statement so the attempt is never recorded without the reschedule
+	_, err = s.pool.Exec(ctx, `
+		WITH iter AS (
+			UPDATE agentpg_iterations SET api_attempts = api_attempts || $3::jsonb WHERE id = $2
+		)
+		UPDATE agentpg_runs
+		SET state = 'pending'::agentpg_run_state,
+			previous_state = state,
+			claimed_by_instance_id = NULL,
+			claimed_at = NULL,
+			current_iteration_id = $2,
+			scheduled_at = $4
+		WHERE id = $1
+	`, id, iterationID, data, scheduledAt)
+	if err != nil {
+		return fmt.Errorf("failed to retry run: %w", err)
 	}
-	msg.Content = params.Content
-
-	return &msg, nil
+	return nil
 }
 
-func (s *Store) GetMessage(ctx context.Context, id uuid.UUID) (*driver.Message, error) {
-	var msg driver.Message
-	var usage, metadata []byte
+// DeferRun puts a claimed run back to pending until scheduledAt without
+// recording an API attempt.
+func (s *Store) DeferRun(ctx context.Context, id uuid.UUID, scheduledAt time.Time) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE agentpg_runs
+		SET state = 'pending'::agentpg_run_state,
+			previous_state = state,
+			claimed_by_instance_id = NULL,
+			claimed_at = NULL,
+			scheduled_at = $2
+		WHERE id = $1
+	`, id, scheduledAt)
+	if err != nil {
+		return fmt.Errorf("failed to defer run: %w", err)
+	}
+	return nil
+}
+
+// Operator operations
+
+func (s *Store) CancelRun(ctx context.Context, id uuid.UUID, reason string) (int, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin cancel: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ids, err := collectIDs(tx.Query(ctx, `
+		WITH RECURSIVE tree AS (
+			SELECT id FROM agentpg_runs WHERE id = $1
+			UNION ALL
+			SELECT r.id FROM agentpg_runs r JOIN tree t ON r.parent_run_id = t.id
+		)
+		SELECT r.id FROM agentpg_runs r
+		WHERE r.id IN (SELECT id FROM tree)
+		  AND r.state NOT IN ('completed', 'cancelled', 'failed')
+		ORDER BY r.depth
+		FOR UPDATE OF r
+	`, id))
+	if err != nil {
+		return 0, fmt.Errorf("failed to select runs to cancel: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Skip the tool executions first, so that cancelling a child run does not
+	// report it to its parent's tool execution as failed
+	if _, err := tx.Exec(ctx, `
+		UPDATE agentpg_tool_executions
+		SET state = 'skipped'::agentpg_tool_execution_state,
+			error_message = $2,
+			completed_at = NOW()
+		WHERE run_id = ANY($1)
+		  AND state IN ('pending', 'running')
+	`, ids, reason); err != nil {
+		return 0, fmt.Errorf("failed to skip tool executions: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE agentpg_runs
+		SET state = 'cancelled'::agentpg_run_state,
+			previous_state = state,
+			error_type = 'cancelled',
+			error_message = $2,
+			finalized_at = NOW()
+		WHERE id = ANY($1)
+	`, ids, reason); err != nil {
+		return 0, fmt.Errorf("failed to cancel runs: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit cancel: %w", err)
+	}
+	return len(ids), nil
+}
+
+func (s *Store) RetryFailedRun(ctx context.Context, id uuid.UUID) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin retry: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var state string
+	err = tx.QueryRow(ctx, `SELECT state FROM agentpg_runs WHERE id = $1 FOR UPDATE`, id).Scan(&state)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get run: %w", err)
+	}
+	if state != "failed" {
+		return false, nil
+	}
+
+	// The next iteration is numbered after the failed ones, which are kept
+	var lastNumber int
+	if err := tx.QueryRow(ctx, `
+		SELECT COALESCE(MAX(iteration_number), 0) FROM agentpg_iterations WHERE run_id = $1
+	`, id).Scan(&lastNumber); err != nil {
+		return false, fmt.Errorf("failed to get last iteration: %w", err)
+	}
+
+	// The last successful iteration, and whether its tool calls are still
+	// unanswered (no tool_result message was created for them)
+	var iterationID uuid.UUID
+	var awaitingTools bool
+	err = tx.QueryRow(ctx, `
+		SELECT i.id,
+			i.has_tool_use
+			AND EXISTS (SELECT 1 FROM agentpg_tool_executions te WHERE te.iteration_id = i.id)
+			AND NOT EXISTS (
+				SELECT 1 FROM agentpg_tool_executions te
+				JOIN agentpg_content_blocks cb ON cb.tool_result_for_use_id = te.tool_use_id
+				JOIN agentpg_messages m ON m.id = cb.message_id
+				WHERE te.iteration_id = i.id AND m.run_id = i.run_id
+			)
+		FROM agentpg_iterations i
+		WHERE i.run_id = $1
+		  AND i.completed_at IS NOT NULL
+		  AND i.error_message IS NULL
+		ORDER BY i.iteration_number DESC
+		LIMIT 1
+	`, id).Scan(&iterationID, &awaitingTools)
+	if err != nil && err != pgx.ErrNoRows {
+		return false, fmt.Errorf("failed to get last successful iteration: %w", err)
+	}
+
+	nextState := "pending"
+	var currentIterationID *uuid.UUID
+	if awaitingTools {
+		nextState = "pending_tools"
+		currentIterationID = &iterationID
+		if _, err := tx.Exec(ctx, `
+			UPDATE agentpg_tool_executions
+			SET state = 'pending'::agentpg_tool_execution_state,
+				claimed_by_instance_id = NULL,
+				claimed_at = NULL,
+				started_at = NULL,
+				completed_at = NULL,
+				tool_output = NULL,
+				is_error = FALSE,
+				error_message = NULL,
+				last_error = COALESCE(error_message, last_error),
+				attempt_count = 0,
+				scheduled_at = NOW()
+			WHERE iteration_id = $1
+			  AND state IN ('failed', 'skipped')
+		`, iterationID); err != nil {
+			return false, fmt.Errorf("failed to requeue tool executions: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE agentpg_runs
+		SET state = $2::agentpg_run_state,
+			previous_state = state,
+			current_iteration = $3,
+			current_iteration_id = $4,
+			response_text = NULL,
+			stop_reason = NULL,
+			error_message = NULL,
+			error_type = NULL,
+			claimed_by_instance_id = NULL,
+			claimed_at = NULL,
+			finalized_at = NULL,
+			rescue_attempts = 0,
+			scheduled_at = NOW()
+		WHERE id = $1
+	`, id, nextState, lastNumber, currentIterationID); err != nil {
+		return false, fmt.Errorf("failed to retry run: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit retry: %w", err)
+	}
+	return true, nil
+}
+
+func (s *Store) RequeueToolExecution(ctx context.Context, id uuid.UUID) (bool, error) {
+	result, err := s.pool.Exec(ctx, `
+		UPDATE agentpg_tool_executions
+		SET state = 'pending'::agentpg_tool_execution_state,
+			claimed_by_instance_id = NULL,
+			claimed_at = NULL,
+			started_at = NULL,
+			completed_at = NULL,
+			tool_output = NULL,
+			is_error = FALSE,
+			error_message = NULL,
+			last_error = COALESCE(error_message, last_error),
+			attempt_count = 0,
+			scheduled_at = NOW()
+		WHERE id = $1
+		  AND state = 'failed'
+	`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to requeue tool execution: %w", err)
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// Audit log operations
+
+const auditEventColumns = `id, action, target_type, target_id, session_id, actor, details, created_at`
+
+func (s *Store) CreateAuditEvent(ctx context.Context, params driver.CreateAuditEventParams) (*driver.AuditEvent, error) {
+	details := params.Details
+	if details == nil {
+		details = map[string]any{}
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal audit details: %w", err)
+	}
+
+	rows, err := s.pool.Query(ctx, `
+		INSERT INTO agentpg_audit_log (action, target_type, target_id, session_id, actor, details)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+auditEventColumns,
+		params.Action, params.TargetType, params.TargetID, params.SessionID, params.Actor, detailsJSON,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit event: %w", err)
+	}
+	defer rows.Close()
+
+	events, err := collectAuditEvents(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit event: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("failed to create audit event: no row returned")
+	}
+	return events[0], nil
+}
+
+func (s *Store) ListAuditEvents(ctx context.Context, params driver.ListAuditEventsParams) ([]*driver.AuditEvent, int, error) {
+	var whereClauses []string
+	var args []any
+	argNum := 1
+
+	if len(params.MetadataFilter) > 0 {
+		filterJSON, err := json.Marshal(params.MetadataFilter)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to marshal metadata filter: %w", err)
+		}
+		whereClauses = append(whereClauses, fmt.Sprintf("session_id IN (SELECT id FROM agentpg_sessions WHERE metadata @> $%d)", argNum))
+		args = append(args, filterJSON)
+		argNum++
+	}
+
+	if params.TargetType != "" {
+		whereClauses = append(whereClauses, fmt.Sprintf("target_type = $%d", argNum))
+		args = append(args, params.TargetType)
+		argNum++
+	}
+
+	if params.TargetID != "" {
+		whereClauses = append(whereClauses, fmt.Sprintf("target_id = $%d", argNum))
+		args = append(args, params.TargetID)
+		argNum++
+	}
+
+	if params.Actor != "" {
+		whereClauses = append(whereClauses, fmt.Sprintf("actor = $%d", argNum))
+		args = append(args, params.Actor)
+		argNum++
+	}
+
+	whereClause := ""
+	if len(whereClauses) > 0 {
+		whereClause = " WHERE " + joinStrings(whereClauses, " AND ")
+	}
+
+	var total int
+	err := s.pool.QueryRow(ctx, "SELECT COUNT(*) FROM agentpg_audit_log"+whereClause, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count audit events: %w", err)
+	}
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	offset := params.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := "SELECT " + auditEventColumns + " FROM agentpg_audit_log" + whereClause +
+		fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d", argNum, argNum+1)
+	args = append(args, limit, offset)
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events, err := collectAuditEvents(rows)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to scan audit events: %w", err)
+	}
+	return events, total, nil
+}
+
+// Message operations
+
+func (s *Store) CreateMessage(ctx context.Context, params driver.CreateMessageParams) (*driver.Message, error) {
+	return createMessage(ctx, s.pool, params)
+}
+
+func createMessage(ctx context.Context, e executor, params driver.CreateMessageParams) (*driver.Message, error) {
+	var msg driver.Message
+	usage, _ := json.Marshal(params.Usage)
+	metadata, _ := json.Marshal(params.Metadata)
+
+	err := e.QueryRow(ctx, `
+		INSERT INTO agentpg_messages (session_id, run_id, role, usage, is_preserved, is_summary, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, session_id, run_id, role, usage, is_preserved, is_summary, metadata, created_at, updated_at
+	`, params.SessionID, params.RunID, params.Role, usage, params.IsPreserved, params.IsSummary, metadata).Scan(
+		&msg.ID, &msg.SessionID, &msg.RunID, &msg.Role, &usage, &msg.IsPreserved, &msg.IsSummary, &metadata, &msg.CreatedAt, &msg.UpdatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message: %w", err)
+	}
+	_ = json.Unmarshal(usage, &msg.Usage)
+	_ = json.Unmarshal(metadata, &msg.Metadata)
+
+	// Create content blocks
+	if err := createContentBlocks(ctx, e, msg.ID, params.Content); err != nil {
+		return nil, err
+	}
+	msg.Content = params.Content
+
+	return &msg, nil
+}
+
+func (s *Store) GetMessage(ctx context.Context, id uuid.UUID) (*driver.Message, error) {
+	var msg driver.Message
+	var usage, metadata []byte
 	err := s.pool.QueryRow(ctx, `
 		SELECT id, session_id, run_id, role, usage, is_preserved, is_summary, metadata, created_at, updated_at
 		FROM agentpg_messages WHERE id = $1
@@ -1551,7 +2413,12 @@ func (s *Store) GetMessagesForRunContext(ctx context.Context, runID uuid.UUID) (
 	}
 
 	// Root run: get messages from all root-level runs in session
-	// This excludes messages from child runs (agent-as-tool invocations)
+	return s.GetSessionContext(ctx, sessionID)
+}
+
+func (s *Store) GetSessionContext(ctx context.Context, sessionID uuid.UUID) ([]*driver.Message, error) {
+	// Messages of all root-level runs in session; this excludes messages
+	// from child runs (agent-as-tool invocations)
 	rows, err := s.pool.Query(ctx, `
 		SELECT m.id, m.session_id, m.run_id, m.role, m.usage,
 		       m.is_preserved, m.is_summary, m.metadata, m.created_at, m.updated_at
@@ -1627,9 +2494,13 @@ func (s *Store) DeleteMessage(ctx context.Context, id uuid.UUID) error {
 // Content block operations
 
 func (s *Store) CreateContentBlocks(ctx context.Context, messageID uuid.UUID, blocks []driver.ContentBlock) error {
+	return createContentBlocks(ctx, s.pool, messageID, blocks)
+}
+
+func createContentBlocks(ctx context.Context, e executor, messageID uuid.UUID, blocks []driver.ContentBlock) error {
 	for i, block := range blocks {
 		metadata, _ := json.Marshal(block.Metadata)
-		_, err := s.pool.Exec(ctx, `
+		_, err := e.Exec(ctx, `
 			INSERT INTO agentpg_content_blocks (message_id, block_index, type, text, tool_use_id, tool_name, tool_input,
 				tool_result_for_use_id, tool_content, is_error, source, search_results, metadata)
 			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
@@ -1990,38 +2861,80 @@ func (s *Store) ReleaseLeader(ctx context.Context, instanceID string) error {
 
 // Compaction operations
 
-func (s *Store) CreateCompactionEvent(ctx context.Context, params driver.CreateCompactionEventParams) (*driver.CompactionEvent, error) {
+const compactionEventColumns = `id, session_id, strategy, original_tokens, compacted_tokens, messages_removed,
+		summary_content, preserved_message_ids, model_used, duration_ms, summary_message_id, restored_at, created_at`
+
+func scanCompactionEvent(row pgx.Row) (*driver.CompactionEvent, error) {
 	var event driver.CompactionEvent
+	var preservedIDs []byte
+	if err := row.Scan(
+		&event.ID, &event.SessionID, &event.Strategy, &event.OriginalTokens, &event.CompactedTokens, &event.MessagesRemoved,
+		&event.SummaryContent, &preservedIDs, &event.ModelUsed, &event.DurationMS, &event.SummaryMessageID, &event.RestoredAt, &event.CreatedAt,
+	); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal(preservedIDs, &event.PreservedMessageIDs)
+	return &event, nil
+}
+
+func (s *Store) CreateCompactionEvent(ctx context.Context, params driver.CreateCompactionEventParams) (*driver.CompactionEvent, error) {
+	return createCompactionEvent(ctx, s.pool, params, nil)
+}
+
+func createCompactionEvent(ctx context.Context, e executor, params driver.CreateCompactionEventParams, summaryMessageID *uuid.UUID) (*driver.CompactionEvent, error) {
 	preservedIDs, _ := json.Marshal(params.PreservedMessageIDs)
 
-	err := s.pool.QueryRow(ctx, `
-		INSERT INTO agentpg_compaction_events (session_id, strategy, original_tokens, compacted_tokens, messages_removed, summary_content, preserved_message_ids, model_used, duration_ms)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		RETURNING id, session_id, strategy, original_tokens, compacted_tokens, messages_removed, summary_content, preserved_message_ids, model_used, duration_ms, created_at
-	`, params.SessionID, params.Strategy, params.OriginalTokens, params.CompactedTokens,
-		params.MessagesRemoved, params.SummaryContent, preservedIDs, params.ModelUsed, params.DurationMS).Scan(
-		&event.ID, &event.SessionID, &event.Strategy, &event.OriginalTokens, &event.CompactedTokens,
-		&event.MessagesRemoved, &event.SummaryContent, &preservedIDs, &event.ModelUsed, &event.DurationMS, &event.CreatedAt,
-	)
+	event, err := scanCompactionEvent(e.QueryRow(ctx, `
+		INSERT INTO agentpg_compaction_events (session_id, strategy, original_tokens, compacted_tokens, messages_removed, summary_content, preserved_message_ids, model_used, duration_ms, summary_message_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING `+compactionEventColumns,
+		params.SessionID, params.Strategy, params.OriginalTokens, params.CompactedTokens,
+		params.MessagesRemoved, params.SummaryContent, preservedIDs, params.ModelUsed, params.DurationMS, summaryMessageID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create compaction event: %w", err)
 	}
-	_ = json.Unmarshal(preservedIDs, &event.PreservedMessageIDs)
-	return &event, nil
+	return event, nil
 }
 
 func (s *Store) ArchiveMessage(ctx context.Context, compactionEventID, messageID, sessionID uuid.UUID, originalMessage map[string]any) error {
 	data, _ := json.Marshal(originalMessage)
-	_, err := s.pool.Exec(ctx, `
+	return archiveMessage(ctx, s.pool, compactionEventID, messageID, sessionID, data)
+}
+
+func archiveMessage(ctx context.Context, e executor, compactionEventID, messageID, sessionID uuid.UUID, originalMessage []byte) error {
+	_, err := e.Exec(ctx, `
 		INSERT INTO agentpg_message_archive (id, compaction_event_id, session_id, original_message)
 		VALUES ($1, $2, $3, $4)
-	`, messageID, compactionEventID, sessionID, data)
+	`, messageID, compactionEventID, sessionID, originalMessage)
 	return err
 }
 
+func (s *Store) GetArchivedMessages(ctx context.Context, sessionID uuid.UUID) ([]*driver.ArchivedMessage, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, compaction_event_id, session_id, original_message, archived_at
+		FROM agentpg_message_archive WHERE session_id = $1 ORDER BY archived_at, id
+	`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var archived []*driver.ArchivedMessage
+	for rows.Next() {
+		var msg driver.ArchivedMessage
+		var original []byte
+		if err := rows.Scan(&msg.ID, &msg.CompactionEventID, &msg.SessionID, &original, &msg.ArchivedAt); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal(original, &msg.OriginalMessage)
+		archived = append(archived, &msg)
+	}
+	return archived, rows.Err()
+}
+
 func (s *Store) GetCompactionEvents(ctx context.Context, sessionID uuid.UUID, limit int) ([]*driver.CompactionEvent, error) {
 	rows, err := s.pool.Query(ctx, `
-		SELECT id, session_id, strategy, original_tokens, compacted_tokens, messages_removed, summary_content, preserved_message_ids, model_used, duration_ms, created_at
+		SELECT `+compactionEventColumns+`
 		FROM agentpg_compaction_events WHERE session_id = $1 ORDER BY created_at DESC LIMIT $2
 	`, sessionID, limit)
 	if err != nil {
@@ -2031,69 +2944,718 @@ func (s *Store) GetCompactionEvents(ctx context.Context, sessionID uuid.UUID, li
 
 	var events []*driver.CompactionEvent
 	for rows.Next() {
-		var event driver.CompactionEvent
-		var preservedIDs []byte
-		if err := rows.Scan(
-			&event.ID, &event.SessionID, &event.Strategy, &event.OriginalTokens, &event.CompactedTokens,
-			&event.MessagesRemoved, &event.SummaryContent, &preservedIDs, &event.ModelUsed, &event.DurationMS, &event.CreatedAt,
-		); err != nil {
+		event, err := scanCompactionEvent(rows)
+		if err != nil {
 			return nil, err
 		}
-		_ = json.Unmarshal(preservedIDs, &event.PreservedMessageIDs)
-		events = append(events, &event)
+		events = append(events, event)
 	}
 	return events, rows.Err()
 }
 
-func (s *Store) GetCompactionStats(ctx context.Context) (*driver.CompactionStats, error) {
-	var stats driver.CompactionStats
+func (s *Store) GetCompactionEvent(ctx context.Context, id uuid.UUID) (*driver.CompactionEvent, error) {
+	event, err := scanCompactionEvent(s.pool.QueryRow(ctx, `
+		SELECT `+compactionEventColumns+` FROM agentpg_compaction_events WHERE id = $1
+	`, id))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get compaction event: %w", err)
+	}
+	return event, nil
+}
 
-	err := s.pool.QueryRow(ctx, `
-		SELECT
-			COUNT(*),
-			COALESCE(SUM(original_tokens - compacted_tokens), 0),
-			COALESCE(SUM(messages_removed), 0),
-			COALESCE(AVG(1.0 - (compacted_tokens::float / NULLIF(original_tokens, 0))), 0)
-		FROM agentpg_compaction_events
-	`).Scan(&stats.TotalCompactions, &stats.TotalTokensSaved, &stats.TotalMessagesArchived, &stats.AvgReductionPercent)
+func (s *Store) ApplyCompaction(ctx context.Context, params driver.ApplyCompactionParams) (*driver.CompactionEvent, error) {
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get compaction stats: %w", err)
+		return nil, fmt.Errorf("failed to begin compaction: %w", err)
 	}
+	defer func() { _ = tx.Rollback(ctx) }()
 
-	return &stats, nil
-}
+	sessionID := params.Event.SessionID
+	if err := lockSessionForCompaction(ctx, tx, sessionID, params.RunID); err != nil {
+		return nil, err
+	}
 
-// Helper functions
+	var summaryMessageID *uuid.UUID
+	if params.Summary != nil {
+		summary, err := createMessage(ctx, tx, driver.CreateMessageParams{
+			SessionID: sessionID,
+			Role:      "assistant",
+			Content:   params.Summary,
+			IsSummary: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		summaryMessageID = &summary.ID
+	}
 
-func joinStrings(strs []string, sep string) string {
-	if len(strs) == 0 {
-		return ""
+	event, err := createCompactionEvent(ctx, tx, params.Event, summaryMessageID)
+	if err != nil {
+		return nil, err
 	}
-	result := strs[0]
-	for _, s := range strs[1:] {
-		result += sep + s
+
+	for _, msg := range params.Messages {
+		original, err := json.Marshal(msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal message %s for archive: %w", msg.ID, err)
+		}
+		if err := archiveMessage(ctx, tx, event.ID, msg.ID, sessionID, original); err != nil {
+			return nil, fmt.Errorf("failed to archive message %s: %w", msg.ID, err)
+		}
+		tag, err := tx.Exec(ctx, "DELETE FROM agentpg_messages WHERE id = $1 AND session_id = $2", msg.ID, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete message %s: %w", msg.ID, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return nil, fmt.Errorf("message %s: %w", msg.ID, driver.ErrCompactionConflict)
+		}
 	}
-	return result
-}
 
-func nullIfEmpty[T comparable](v T) any {
-	var zero T
-	if v == zero {
-		return nil
+	if _, err := tx.Exec(ctx, `
+		UPDATE agentpg_sessions SET compaction_count = compaction_count + 1, updated_at = NOW() WHERE id = $1
+	`, sessionID); err != nil {
+		return nil, fmt.Errorf("failed to update compaction count: %w", err)
 	}
-	return v
-}
 
-func nullIfEmptyBytes(v []byte) any {
-	if len(v) == 0 {
-		return nil
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit compaction: %w", err)
 	}
-	return v
+	return event, nil
 }
 
-func collectRuns(rows pgx.Rows) ([]*driver.Run, error) {
-	var runs []*driver.Run
-	for rows.Next() {
+func (s *Store) RestoreCompaction(ctx context.Context, eventID uuid.UUID) (*driver.CompactionEvent, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin restore: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var sessionID uuid.UUID
+	err = tx.QueryRow(ctx, "SELECT session_id FROM agentpg_compaction_events WHERE id = $1", eventID).Scan(&sessionID)
+	if err == pgx.ErrNoRows {
+		return nil, driver.ErrCompactionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get compaction event: %w", err)
+	}
+	if err := lockSessionForCompaction(ctx, tx, sessionID, nil); err != nil {
+		return nil, err
+	}
+
+	// Read the event again under the session lock
+	event, err := scanCompactionEvent(tx.QueryRow(ctx, `
+		SELECT `+compactionEventColumns+` FROM agentpg_compaction_events WHERE id = $1
+	`, eventID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get compaction event: %w", err)
+	}
+	if event.RestoredAt != nil {
+		return nil, driver.ErrCompactionRestored
+	}
+	var later bool
+	if err := tx.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM agentpg_compaction_events
+			WHERE session_id = $1 AND restored_at IS NULL AND created_at > $2
+		)
+	`, sessionID, event.CreatedAt).Scan(&later); err != nil {
+		return nil, fmt.Errorf("failed to check later compactions: %w", err)
+	}
+	if later {
+		return nil, fmt.Errorf("a later compaction of session %s must be restored first: %w", sessionID, driver.ErrCompactionConflict)
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT original_message FROM agentpg_message_archive WHERE compaction_event_id = $1
+	`, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archived messages: %w", err)
+	}
+	var messages []*driver.Message
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var msg driver.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to unmarshal archived message: %w", err)
+		}
+		messages = append(messages, &msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 && event.MessagesRemoved > 0 {
+		return nil, driver.ErrArchivePurged
+	}
+
+	for _, msg := range messages {
+		if err := restoreMessage(ctx, tx, msg); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM agentpg_message_archive WHERE compaction_event_id = $1", eventID); err != nil {
+		return nil, fmt.Errorf("failed to delete archived messages: %w", err)
+	}
+	if event.SummaryMessageID != nil {
+		if _, err := tx.Exec(ctx, "DELETE FROM agentpg_messages WHERE id = $1", *event.SummaryMessageID); err != nil {
+			return nil, fmt.Errorf("failed to delete summary message: %w", err)
+		}
+	}
+
+	event, err = scanCompactionEvent(tx.QueryRow(ctx, `
+		UPDATE agentpg_compaction_events SET restored_at = NOW(), summary_message_id = NULL WHERE id = $1
+		RETURNING `+compactionEventColumns,
+		eventID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark compaction restored: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit restore: %w", err)
+	}
+	return event, nil
+}
+
+// lockSessionForCompaction locks the session row until the transaction ends,
+// which keeps agentpg_claim_runs away from the session's runs, and fails with
+// driver.ErrSessionBusy if one of them other than exceptRunID is already in
+// progress.
+func lockSessionForCompaction(ctx context.Context, tx pgx.Tx, sessionID uuid.UUID, exceptRunID *uuid.UUID) error {
+	var id uuid.UUID
+	err := tx.QueryRow(ctx, "SELECT id FROM agentpg_sessions WHERE id = $1 FOR UPDATE", sessionID).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("session not found: %s", sessionID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock session: %w", err)
+	}
+
+	var busy bool
+	if err := tx.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM agentpg_runs
+			WHERE session_id = $1
+			  AND state IN ('batch_submitting', 'batch_pending', 'batch_processing', 'streaming', 'pending_tools')
+			  AND ($2::uuid IS NULL OR id <> $2)
+		)
+	`, sessionID, exceptRunID).Scan(&busy); err != nil {
+		return fmt.Errorf("failed to check active runs: %w", err)
+	}
+	if busy {
+		return driver.ErrSessionBusy
+	}
+	return nil
+}
+
+// restoreMessage inserts an archived message with its original ID and
+// timestamps. The run reference is dropped if the run no longer exists.
+func restoreMessage(ctx context.Context, e executor, msg *driver.Message) error {
+	usage, _ := json.Marshal(msg.Usage)
+	metadata, _ := json.Marshal(msg.Metadata)
+	_, err := e.Exec(ctx, `
+		INSERT INTO agentpg_messages (id, session_id, run_id, role, usage, is_preserved, is_summary, metadata, created_at, updated_at)
+		VALUES ($1, $2, (SELECT id FROM agentpg_runs WHERE id = $3), $4, $5, $6, $7, $8, $9, $10)
+	`, msg.ID, msg.SessionID, msg.RunID, msg.Role, usage, msg.IsPreserved, msg.IsSummary, metadata, msg.CreatedAt, msg.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to restore message %s: %w", msg.ID, err)
+	}
+	return createContentBlocks(ctx, e, msg.ID, msg.Content)
+}
+
+func (s *Store) GetCompactionStats(ctx context.Context) (*driver.CompactionStats, error) {
+	var stats driver.CompactionStats
+
+	err := s.pool.QueryRow(ctx, `
+		SELECT
+			COUNT(*),
+			COALESCE(SUM(original_tokens - compacted_tokens), 0),
+			COALESCE(SUM(messages_removed), 0),
+			COALESCE(AVG(1.0 - (compacted_tokens::float / NULLIF(original_tokens, 0))), 0)
+		FROM agentpg_compaction_events
+	`).Scan(&stats.TotalCompactions, &stats.TotalTokensSaved, &stats.TotalMessagesArchived, &stats.AvgReductionPercent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get compaction stats: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// Schedule operations
+
+const scheduleColumns = `id, name, agent_id, cron_expression, timezone, catch_up_policy, paused, next_run_at,
+		prompt, variables, run_mode, session_policy, session_id, session_metadata,
+		last_run_at, last_run_id, fire_count, metadata, created_at, updated_at`
+
+func (s *Store) UpsertSchedule(ctx context.Context, params driver.UpsertScheduleParams) (*driver.Schedule, error) {
+	variables, _ := json.Marshal(params.Variables)
+	sessionMetadata, _ := json.Marshal(params.SessionMetadata)
+	metadata, _ := json.Marshal(params.Metadata)
+
+	rows, err := s.pool.Query(ctx, `
+		INSERT INTO agentpg_schedules (
+			name, agent_id, cron_expression, timezone, catch_up_policy, next_run_at,
+			prompt, variables, run_mode, session_policy, session_id, session_metadata, metadata
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (name) DO UPDATE SET
+			agent_id = EXCLUDED.agent_id,
+			next_run_at = CASE
+				WHEN agentpg_schedules.cron_expression IS DISTINCT FROM EXCLUDED.cron_expression
+					OR agentpg_schedules.timezone IS DISTINCT FROM EXCLUDED.timezone
+				THEN EXCLUDED.next_run_at
+				ELSE agentpg_schedules.next_run_at
+			END,
+			cron_expression = EXCLUDED.cron_expression,
+			timezone = EXCLUDED.timezone,
+			catch_up_policy = EXCLUDED.catch_up_policy,
+			prompt = EXCLUDED.prompt,
+			variables = EXCLUDED.variables,
+			run_mode = EXCLUDED.run_mode,
+			session_policy = EXCLUDED.session_policy,
+			session_id = COALESCE(EXCLUDED.session_id, agentpg_schedules.session_id),
+			session_metadata = EXCLUDED.session_metadata,
+			metadata = EXCLUDED.metadata,
+			updated_at = NOW()
+		RETURNING `+scheduleColumns,
+		params.Name, params.AgentID, params.CronExpression, params.Timezone, params.CatchUpPolicy, params.NextRunAt,
+		params.Prompt, variables, params.RunMode, params.SessionPolicy, params.SessionID, sessionMetadata, metadata,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert schedule: %w", err)
+	}
+	defer rows.Close()
+
+	schedules, err := collectSchedules(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert schedule: %w", err)
+	}
+	if len(schedules) == 0 {
+		return nil, fmt.Errorf("failed to upsert schedule: no row returned")
+	}
+	return schedules[0], nil
+}
+
+func (s *Store) GetSchedule(ctx context.Context, id uuid.UUID) (*driver.Schedule, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+scheduleColumns+` FROM agentpg_schedules WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules, err := collectSchedules(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(schedules) == 0 {
+		return nil, nil
+	}
+	return schedules[0], nil
+}
+
+func (s *Store) GetScheduleByName(ctx context.Context, name string) (*driver.Schedule, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+scheduleColumns+` FROM agentpg_schedules WHERE name = $1`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules, err := collectSchedules(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(schedules) == 0 {
+		return nil, nil
+	}
+	return schedules[0], nil
+}
+
+func (s *Store) UpdateSchedule(ctx context.Context, id uuid.UUID, updates map[string]any) error {
+	sets := make([]string, 0, len(updates)+1)
+	args := make([]any, 0, 1+len(updates))
+	args = append(args, id)
+	i := 2
+
+	for k, v := range updates {
+		sets = append(sets, fmt.Sprintf("%s = $%d", k, i))
+		switch val := v.(type) {
+		case map[string]any:
+			data, _ := json.Marshal(val)
+			args = append(args, data)
+		default:
+			args = append(args, v)
+		}
+		i++
+	}
+
+	if len(sets) == 0 {
+		return nil
+	}
+	sets = append(sets, "updated_at = NOW()")
+
+	query := fmt.Sprintf("UPDATE agentpg_schedules SET %s WHERE id = $1", joinStrings(sets, ", "))
+	_, err := s.pool.Exec(ctx, query, args...)
+	return err
+}
+
+func (s *Store) DeleteSchedule(ctx context.Context, id uuid.UUID) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM agentpg_schedules WHERE id = $1", id)
+	return err
+}
+
+func (s *Store) ListSchedules(ctx context.Context, params driver.ListSchedulesParams) ([]*driver.Schedule, int, error) {
+	var whereClauses []string
+	var args []any
+	argNum := 1
+
+	if len(params.MetadataFilter) > 0 {
+		filterJSON, err := json.Marshal(params.MetadataFilter)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to marshal metadata filter: %w", err)
+		}
+		whereClauses = append(whereClauses, fmt.Sprintf("metadata @> $%d", argNum))
+		args = append(args, filterJSON)
+		argNum++
+	}
+
+	if params.AgentID != nil {
+		whereClauses = append(whereClauses, fmt.Sprintf("agent_id = $%d", argNum))
+		args = append(args, *params.AgentID)
+		argNum++
+	}
+
+	whereClause := ""
+	if len(whereClauses) > 0 {
+		whereClause = " WHERE " + joinStrings(whereClauses, " AND ")
+	}
+
+	var total int
+	err := s.pool.QueryRow(ctx, "SELECT COUNT(*) FROM agentpg_schedules"+whereClause, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count schedules: %w", err)
+	}
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	offset := params.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := "SELECT " + scheduleColumns + " FROM agentpg_schedules" + whereClause +
+		fmt.Sprintf(" ORDER BY name ASC LIMIT $%d OFFSET $%d", argNum, argNum+1)
+	args = append(args, limit, offset)
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list schedules: %w", err)
+	}
+	defer rows.Close()
+
+	schedules, err := collectSchedules(rows)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to scan schedules: %w", err)
+	}
+	return schedules, total, nil
+}
+
+func (s *Store) GetDueSchedules(ctx context.Context, limit int) ([]*driver.Schedule, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+scheduleColumns+`
+		FROM agentpg_schedules
+		WHERE paused = FALSE AND next_run_at <= NOW()
+		ORDER BY next_run_at ASC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due schedules: %w", err)
+	}
+	defer rows.Close()
+	return collectSchedules(rows)
+}
+
+func (s *Store) AdvanceScheduleTx(ctx context.Context, tx pgx.Tx, params driver.AdvanceScheduleParams) (bool, error) {
+	tag, err := tx.Exec(ctx, `
+		UPDATE agentpg_schedules SET
+			next_run_at = $3,
+			last_run_at = CASE WHEN $4::uuid IS NOT NULL THEN NOW() ELSE last_run_at END,
+			last_run_id = COALESCE($4, last_run_id),
+			fire_count = fire_count + CASE WHEN $4::uuid IS NOT NULL THEN 1 ELSE 0 END,
+			session_id = COALESCE($5, session_id),
+			updated_at = NOW()
+		WHERE id = $1 AND next_run_at = $2 AND paused = FALSE
+	`, params.ID, params.ExpectedNextRunAt, params.NextRunAt, params.RunID, params.SessionID)
+	if err != nil {
+		return false, fmt.Errorf("failed to advance schedule: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// Rate limit operations
+
+func (s *Store) AcquireRateLimit(ctx context.Context, model string) (*time.Time, error) {
+	var retryAt *time.Time
+	if err := s.pool.QueryRow(ctx, "SELECT agentpg_acquire_rate_limit($1)", model).Scan(&retryAt); err != nil {
+		return nil, fmt.Errorf("failed to acquire rate limit: %w", err)
+	}
+	return retryAt, nil
+}
+
+func (s *Store) RecordRateLimit(ctx context.Context, params driver.RecordRateLimitParams) error {
+	_, err := s.pool.Exec(ctx, "SELECT agentpg_record_rate_limit($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		params.Model,
+		params.RequestsLimit, params.RequestsRemaining,
+		params.InputTokensLimit, params.InputTokensRemaining,
+		params.OutputTokensLimit, params.OutputTokensRemaining,
+		params.InputTokensUsed, params.OutputTokensUsed,
+		params.BlockedUntil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record rate limit: %w", err)
+	}
+	return nil
+}
+
+// Helper functions
+
+// Retention operations
+
+func (s *Store) PurgeSessions(ctx context.Context, params driver.PurgeParams) (*driver.PurgeCounts, error) {
+	filter, err := purgeMetadataFilter(params.MetadataFilter)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin purge: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ids, err := collectIDs(tx.Query(ctx, `
+		SELECT s.id FROM agentpg_sessions s
+		WHERE s.updated_at < $1
+		  AND ($2::jsonb IS NULL OR s.metadata @> $2::jsonb)
+		  AND NOT EXISTS (SELECT 1 FROM agentpg_sessions c WHERE c.parent_session_id = s.id)
+		  AND NOT EXISTS (
+		      SELECT 1 FROM agentpg_runs r
+		      WHERE r.session_id = s.id AND (r.finalized_at IS NULL OR r.finalized_at >= $1)
+		  )
+		  AND NOT EXISTS (
+		      SELECT 1 FROM agentpg_messages m
+		      WHERE m.session_id = s.id AND m.updated_at >= $1
+		  )
+		ORDER BY s.updated_at
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	`, params.Before, filter, params.Limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select sessions to purge: %w", err)
+	}
+	if len(ids) == 0 {
+		return &driver.PurgeCounts{}, nil
+	}
+
+	counts, err := countSessionRows(ctx, tx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM agentpg_sessions WHERE id = ANY($1)", ids); err != nil {
+		return nil, fmt.Errorf("failed to purge sessions: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit purge: %w", err)
+	}
+	return counts, nil
+}
+
+func (s *Store) PurgeRuns(ctx context.Context, params driver.PurgeParams) (*driver.PurgeCounts, error) {
+	filter, err := purgeMetadataFilter(params.MetadataFilter)
+	if err != nil {
+		return nil, err
+	}
+	states := params.States
+	if len(states) == 0 {
+		states = terminalRunStates
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin purge: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ids, err := collectIDs(tx.Query(ctx, `
+		SELECT r.id FROM agentpg_runs r
+		JOIN agentpg_sessions s ON s.id = r.session_id
+		WHERE r.parent_run_id IS NULL
+		  AND r.finalized_at < $1
+		  AND r.state::text = ANY($2)
+		  AND ($3::jsonb IS NULL OR s.metadata @> $3::jsonb)
+		ORDER BY r.finalized_at
+		LIMIT $4
+		FOR UPDATE OF r SKIP LOCKED
+	`, params.Before, states, filter, params.Limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select runs to purge: %w", err)
+	}
+	if len(ids) == 0 {
+		return &driver.PurgeCounts{}, nil
+	}
+
+	counts := &driver.PurgeCounts{}
+	if err := tx.QueryRow(ctx, `
+		WITH RECURSIVE tree AS (
+			SELECT id FROM agentpg_runs WHERE id = ANY($1)
+			UNION ALL
+			SELECT r.id FROM agentpg_runs r JOIN tree t ON r.parent_run_id = t.id
+		)
+		SELECT
+			(SELECT COUNT(*) FROM tree),
+			(SELECT COUNT(*) FROM agentpg_iterations WHERE run_id IN (SELECT id FROM tree)),
+			(SELECT COUNT(*) FROM agentpg_tool_executions WHERE run_id IN (SELECT id FROM tree))
+	`, ids).Scan(&counts.Runs, &counts.Iterations, &counts.ToolExecutions); err != nil {
+		return nil, fmt.Errorf("failed to count runs to purge: %w", err)
+	}
+
+	// Messages of nested runs would otherwise lose their run and show up in
+	// the session's root-level conversation
+	tag, err := tx.Exec(ctx, `
+		WITH RECURSIVE tree AS (
+			SELECT id FROM agentpg_runs WHERE parent_run_id = ANY($1)
+			UNION ALL
+			SELECT r.id FROM agentpg_runs r JOIN tree t ON r.parent_run_id = t.id
+		)
+		DELETE FROM agentpg_messages WHERE run_id IN (SELECT id FROM tree)
+	`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to purge messages of nested runs: %w", err)
+	}
+	counts.Messages = int(tag.RowsAffected())
+
+	if _, err := tx.Exec(ctx, "DELETE FROM agentpg_runs WHERE id = ANY($1)", ids); err != nil {
+		return nil, fmt.Errorf("failed to purge runs: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit purge: %w", err)
+	}
+	return counts, nil
+}
+
+func (s *Store) PurgeArchivedMessages(ctx context.Context, params driver.PurgeParams) (*driver.PurgeCounts, error) {
+	filter, err := purgeMetadataFilter(params.MetadataFilter)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := s.pool.Exec(ctx, `
+		DELETE FROM agentpg_message_archive
+		WHERE compaction_event_id IN (
+			SELECT e.id FROM agentpg_compaction_events e
+			JOIN agentpg_sessions s ON s.id = e.session_id
+			WHERE e.created_at < $1
+			  AND ($2::jsonb IS NULL OR s.metadata @> $2::jsonb)
+			  AND EXISTS (SELECT 1 FROM agentpg_message_archive a WHERE a.compaction_event_id = e.id)
+			ORDER BY e.created_at
+			LIMIT $3
+			FOR UPDATE OF e SKIP LOCKED
+		)
+	`, params.Before, filter, params.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to purge archived messages: %w", err)
+	}
+	return &driver.PurgeCounts{ArchivedMessages: int(tag.RowsAffected())}, nil
+}
+
+// terminalRunStates are the run states PurgeRuns deletes by default.
+var terminalRunStates = []string{"completed", "cancelled", "failed"}
+
+// purgeMetadataFilter encodes a purge's metadata filter, or returns nil for
+// no filter.
+func purgeMetadataFilter(filter map[string]any) ([]byte, error) {
+	if len(filter) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata filter: %w", err)
+	}
+	return data, nil
+}
+
+// countSessionRows counts the rows deleting the sessions removes.
+func countSessionRows(ctx context.Context, e executor, ids []uuid.UUID) (*driver.PurgeCounts, error) {
+	counts := &driver.PurgeCounts{Sessions: len(ids)}
+	if err := e.QueryRow(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM agentpg_runs WHERE session_id = ANY($1)),
+			(SELECT COUNT(*) FROM agentpg_iterations i JOIN agentpg_runs r ON r.id = i.run_id WHERE r.session_id = ANY($1)),
+			(SELECT COUNT(*) FROM agentpg_tool_executions t JOIN agentpg_runs r ON r.id = t.run_id WHERE r.session_id = ANY($1)),
+			(SELECT COUNT(*) FROM agentpg_messages WHERE session_id = ANY($1)),
+			(SELECT COUNT(*) FROM agentpg_compaction_events WHERE session_id = ANY($1)),
+			(SELECT COUNT(*) FROM agentpg_message_archive WHERE session_id = ANY($1))
+	`, ids).Scan(&counts.Runs, &counts.Iterations, &counts.ToolExecutions,
+		&counts.Messages, &counts.CompactionEvents, &counts.ArchivedMessages); err != nil {
+		return nil, fmt.Errorf("failed to count session rows: %w", err)
+	}
+	return counts, nil
+}
+
+// collectIDs reads a single UUID column from rows.
+func collectIDs(rows pgx.Rows, err error) ([]uuid.UUID, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func joinStrings(strs []string, sep string) string {
+	if len(strs) == 0 {
+		return ""
+	}
+	result := strs[0]
+	for _, s := range strs[1:] {
+		result += sep + s
+	}
+	return result
+}
+
+func nullIfEmpty[T comparable](v T) any {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return v
+}
+
+func nullIfEmptyBytes(v []byte) any {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+func collectRuns(rows pgx.Rows) ([]*driver.Run, error) {
+	var runs []*driver.Run
+	for rows.Next() {
 		var run driver.Run
 		var metadata []byte
 		if err := rows.Scan(
@@ -2103,7 +3665,7 @@ func collectRuns(rows pgx.Rows) ([]*driver.Run, error) {
 			&run.CacheCreationInputTokens, &run.CacheReadInputTokens, &run.IterationCount, &run.ToolIterations,
 			&run.ErrorMessage, &run.ErrorType, &run.CreatedByInstanceID, &run.ClaimedByInstanceID, &run.ClaimedAt,
 			&metadata, &run.CreatedAt, &run.StartedAt, &run.FinalizedAt,
-			&run.RescueAttempts, &run.LastRescueAt,
+			&run.RescueAttempts, &run.LastRescueAt, &run.IdempotencyKey, &run.ScheduledAt,
 		); err != nil {
 			return nil, err
 		}
@@ -2117,6 +3679,7 @@ func collectIterations(rows pgx.Rows) ([]*driver.Iteration, error) {
 	var iterations []*driver.Iteration
 	for rows.Next() {
 		var iter driver.Iteration
+		var apiAttempts []byte
 		if err := rows.Scan(
 			&iter.ID, &iter.RunID, &iter.IterationNumber, &iter.IsStreaming,
 			&iter.BatchID, &iter.BatchRequestID, &iter.BatchStatus,
@@ -2124,10 +3687,11 @@ func collectIterations(rows pgx.Rows) ([]*driver.Iteration, error) {
 			&iter.StreamingStartedAt, &iter.StreamingCompletedAt,
 			&iter.TriggerType, &iter.RequestMessageIDs, &iter.StopReason, &iter.ResponseMessageID, &iter.HasToolUse, &iter.ToolExecutionCount,
 			&iter.InputTokens, &iter.OutputTokens, &iter.CacheCreationInputTokens, &iter.CacheReadInputTokens,
-			&iter.ErrorMessage, &iter.ErrorType, &iter.CreatedAt, &iter.StartedAt, &iter.CompletedAt,
+			&iter.ErrorMessage, &iter.ErrorType, &iter.CreatedAt, &iter.StartedAt, &iter.CompletedAt, &apiAttempts, &iter.Model, &iter.BatchNextPollAt,
 		); err != nil {
 			return nil, err
 		}
+		_ = json.Unmarshal(apiAttempts, &iter.APIAttempts)
 		iterations = append(iterations, &iter)
 	}
 	return iterations, rows.Err()
@@ -2150,5 +3714,43 @@ func collectToolExecutions(rows pgx.Rows) ([]*driver.ToolExecution, error) {
 	return executions, rows.Err()
 }
 
+func collectSchedules(rows pgx.Rows) ([]*driver.Schedule, error) {
+	var schedules []*driver.Schedule
+	for rows.Next() {
+		var sched driver.Schedule
+		var variables, sessionMetadata, metadata []byte
+		if err := rows.Scan(
+			&sched.ID, &sched.Name, &sched.AgentID, &sched.CronExpression, &sched.Timezone,
+			&sched.CatchUpPolicy, &sched.Paused, &sched.NextRunAt,
+			&sched.Prompt, &variables, &sched.RunMode, &sched.SessionPolicy, &sched.SessionID, &sessionMetadata,
+			&sched.LastRunAt, &sched.LastRunID, &sched.FireCount, &metadata, &sched.CreatedAt, &sched.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal(variables, &sched.Variables)
+		_ = json.Unmarshal(sessionMetadata, &sched.SessionMetadata)
+		_ = json.Unmarshal(metadata, &sched.Metadata)
+		schedules = append(schedules, &sched)
+	}
+	return schedules, rows.Err()
+}
+
+func collectAuditEvents(rows pgx.Rows) ([]*driver.AuditEvent, error) {
+	var events []*driver.AuditEvent
+	for rows.Next() {
+		var event driver.AuditEvent
+		var details []byte
+		if err := rows.Scan(
+			&event.ID, &event.Action, &event.TargetType, &event.TargetID, &event.SessionID,
+			&event.Actor, &details, &event.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal(details, &event.Details)
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
 // Compile-time check
 var _ driver.Store[pgx.Tx] = (*Store)(nil)
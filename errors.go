@@ -17,6 +17,7 @@ var (
 	ErrToolNotFound          = errors.New("tool not found")
 	ErrIterationNotFound     = errors.New("iteration not found")
 	ErrToolExecutionNotFound = errors.New("tool execution not found")
+	ErrScheduleNotFound      = errors.New("schedule not found")
 
 	// Registration errors
 	ErrAgentNotRegistered = errors.New("agent not registered on this client")
@@ -50,6 +51,17 @@ var (
 
 	// Compaction errors
 	ErrCompactionFailed = errors.New("context compaction failed")
+	ErrContextOverflow  = errors.New("request exceeds the model's context window")
+
+	// Fork errors
+	ErrInvalidForkPoint = errors.New("invalid fork point")
+
+	// Export errors
+	ErrInvalidExport = errors.New("invalid session export")
+
+	// Run limit errors
+	ErrMaxIterations = errors.New("run reached the maximum number of iterations")
+	ErrMaxAgentDepth = errors.New("agent delegation reached the maximum depth")
 )
 
 // AgentError provides structured error context for AgentPG operations.
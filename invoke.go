@@ -0,0 +1,581 @@
+package agentpg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/tool"
+)
+
+// InvokeOption configures optional behavior of Invoke.
+type InvokeOption func(*invokeOptions)
+
+type invokeOptions struct {
+	asyncPersistence bool
+}
+
+// WithAsyncPersistence makes Invoke return as soon as the response is ready
+// and store the run in the background. Failures to store the run are logged.
+func WithAsyncPersistence() InvokeOption {
+	return func(o *invokeOptions) {
+		o.asyncPersistence = true
+	}
+}
+
+// invocation collects the rows of an in-process run and of the child runs
+// it delegated to until they are stored.
+type invocation struct {
+	runs       []*driver.Run
+	messages   []*driver.Message
+	iterations []*driver.Iteration
+	execs      []*driver.ToolExecution
+	last       time.Time
+}
+
+// now returns the current time, strictly after every time returned before,
+// so messages keep their order when sorted by created_at.
+func (inv *invocation) now() time.Time {
+	now := time.Now().UTC()
+	if !now.After(inv.last) {
+		now = inv.last.Add(time.Microsecond)
+	}
+	inv.last = now
+	return now
+}
+
+// addMessage records a message of the run and returns it.
+func (inv *invocation) addMessage(run *driver.Run, role MessageRole, content []driver.ContentBlock, usage driver.Usage) *driver.Message {
+	now := inv.now()
+	msg := &driver.Message{
+		ID:        uuid.New(),
+		SessionID: run.SessionID,
+		RunID:     &run.ID,
+		Role:      driver.MessageRole(role),
+		Content:   content,
+		Usage:     usage,
+		Metadata:  map[string]any{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	inv.messages = append(inv.messages, msg)
+	return msg
+}
+
+// Invoke runs an agent in-process on the caller's goroutine and returns its
+// response. Unlike RunFastSync, no run is queued: the Streaming API is called
+// directly, local tools are executed directly and delegate agents are invoked
+// the same way. The run, its messages, iterations, tool executions and child
+// runs are stored afterwards in a single transaction, so the session history
+// and the admin UI look the same as for a queued streaming run. Pass
+// WithAsyncPersistence to return before the run is stored.
+//
+// Invoke is meant for short, latency-sensitive calls, and skips the
+// safeguards of queued runs:
+//
+//   - API retry: APIRetryConfig does not apply. A failed call is not retried
+//     with backoff; it only falls back to the agent's next fallback model on
+//     overloaded, not-found and latency budget errors, and otherwise fails
+//     the run.
+//   - Rate-limit deferral: a run whose model has exhausted its rate limits is
+//     not put back to pending. Invoke blocks the caller until the buckets
+//     refill or ctx is done.
+//   - Tool retries and compaction: failed tools are reported to Claude
+//     without retries, and the session is not compacted.
+//   - Concurrency caps: the run is not claimed, so it neither counts toward
+//     nor waits for AgentDefinition.MaxConcurrentRuns, and its tools run
+//     regardless of tool.ConcurrencyLimiter caps. Nested agent runs are
+//     invoked in-process too and ignore their agent's cap.
+//   - Session lock: the history is read and the run stored without the
+//     session lock taken by compaction, RestoreCompaction and DeleteSession,
+//     which only see runs already stored. A compaction or queued run of the
+//     same session overlapping the call is not held off, and the run is
+//     stored after messages added meanwhile; callers serialize work on a
+//     session themselves.
+//
+// MaxIterations and MaxAgentDepth apply as for queued runs. Failed runs are
+// stored too and returned as an *AgentError.
+func (c *Client[TTx]) Invoke(ctx context.Context, sessionID uuid.UUID, agentID uuid.UUID, prompt string, variables map[string]any, opts ...InvokeOption) (*Response, error) {
+	c.mu.RLock()
+	started := c.started
+	c.mu.RUnlock()
+
+	if !started {
+		return nil, ErrClientNotStarted
+	}
+
+	var o invokeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	store := c.driver.Store()
+	session, err := store.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	if session == nil {
+		return nil, ErrSessionNotFound
+	}
+	agent, err := c.GetAgentByID(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+	history, err := store.GetSessionContext(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+
+	if variables == nil {
+		variables = map[string]any{}
+	}
+
+	inv := &invocation{}
+	run := c.newInvokedRun(inv, sessionID, agent, prompt, variables, nil, nil)
+
+	log := c.log()
+	log.Info("invoking agent in-process",
+		"run_id", run.ID,
+		"agent_id", agent.ID,
+		"session_id", sessionID,
+	)
+
+	runErr := c.invokeRun(ctx, inv, run, agent, history)
+
+	persist := func(ctx context.Context) error {
+		if err := store.ImportRuns(ctx, driver.ImportRunsParams{
+			Runs:           inv.runs,
+			Messages:       inv.messages,
+			Iterations:     inv.iterations,
+			ToolExecutions: inv.execs,
+		}); err != nil {
+			return fmt.Errorf("failed to store invoked run: %w", err)
+		}
+		return nil
+	}
+
+	if o.asyncPersistence {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			if err := persist(context.WithoutCancel(ctx)); err != nil {
+				log.Error("failed to store invoked run",
+					"run_id", run.ID,
+					"error", err,
+				)
+			}
+		}()
+	} else if err := persist(ctx); err != nil {
+		return nil, err
+	}
+
+	if runErr != nil {
+		log.Error("invoked run failed",
+			"run_id", run.ID,
+			"error", runErr,
+		)
+	}
+
+	return c.invokeResponse(inv, run)
+}
+
+// newInvokedRun records a running in-process run. Child runs are linked to
+// the parent run and the tool execution that delegated to them.
+func (c *Client[TTx]) newInvokedRun(inv *invocation, sessionID uuid.UUID, agent *AgentDefinition, prompt string, variables map[string]any, parent *driver.Run, parentExec *driver.ToolExecution) *driver.Run {
+	now := inv.now()
+	run := &driver.Run{
+		ID:                  uuid.New(),
+		SessionID:           sessionID,
+		AgentID:             agent.ID,
+		RunMode:             string(RunModeStreaming),
+		State:               driver.RunState(RunStateStreaming),
+		Prompt:              prompt,
+		CreatedByInstanceID: &c.instanceID,
+		ClaimedByInstanceID: &c.instanceID,
+		ClaimedAt:           &now,
+		Metadata:            variables,
+		CreatedAt:           now,
+		StartedAt:           &now,
+		ScheduledAt:         now,
+	}
+	if parent != nil {
+		run.ParentRunID = &parent.ID
+		run.ParentToolExecutionID = &parentExec.ID
+		run.Depth = parent.Depth + 1
+	}
+	inv.runs = append(inv.runs, run)
+	return run
+}
+
+// invokeRun executes the agent loop of an in-process run, starting from the
+// given context messages, and finalizes the run. Returns the error the run
+// failed with, if any.
+func (c *Client[TTx]) invokeRun(ctx context.Context, inv *invocation, run *driver.Run, agent *AgentDefinition, history []*driver.Message) error {
+	err := c.invokeLoop(ctx, inv, run, agent, history)
+
+	now := inv.now()
+	run.FinalizedAt = &now
+	run.ClaimedByInstanceID = nil
+	run.ClaimedAt = nil
+	if err != nil {
+		errorType := runErrorType(err, "streaming_error")
+		errorMessage := err.Error()
+		run.State = driver.RunState(RunStateFailed)
+		run.ErrorType = &errorType
+		run.ErrorMessage = &errorMessage
+		return err
+	}
+	run.State = driver.RunState(RunStateCompleted)
+	return nil
+}
+
+func (c *Client[TTx]) invokeLoop(ctx context.Context, inv *invocation, run *driver.Run, agent *AgentDefinition, history []*driver.Message) error {
+	tools, err := c.buildTools(ctx, agent)
+	if err != nil {
+		return fmt.Errorf("failed to build tools: %w", err)
+	}
+
+	// Delegate agents are exposed as tools named after the agent
+	delegates := make(map[string]*AgentDefinition, len(agent.AgentIDs))
+	for _, id := range agent.AgentIDs {
+		delegate, err := c.GetAgentByID(ctx, id)
+		if err != nil {
+			continue
+		}
+		delegates[delegate.Name] = delegate
+	}
+
+	contextMessages := append([]*driver.Message(nil), history...)
+	if run.Prompt != "" {
+		contextMessages = append(contextMessages, inv.addMessage(run, MessageRoleUser, []driver.ContentBlock{
+			{Type: ContentTypeText, Text: run.Prompt},
+		}, driver.Usage{}))
+	}
+
+	for {
+		if err := c.checkIterationLimit(run); err != nil {
+			return err
+		}
+
+		triggerType := "user_prompt"
+		if run.CurrentIteration > 0 {
+			triggerType = "tool_results"
+		}
+		now := inv.now()
+		iter := &driver.Iteration{
+			ID:                 uuid.New(),
+			RunID:              run.ID,
+			IterationNumber:    run.CurrentIteration + 1,
+			IsStreaming:        true,
+			TriggerType:        triggerType,
+			CreatedAt:          now,
+			StartedAt:          &now,
+			StreamingStartedAt: &now,
+		}
+		inv.iterations = append(inv.iterations, iter)
+		run.CurrentIteration = iter.IterationNumber
+		run.CurrentIterationID = &iter.ID
+
+		params := anthropic.MessageNewParams{
+			MaxTokens: DefaultMaxTokens,
+			Messages:  toMessageParams(contextMessages, 0),
+		}
+		if agent.SystemPrompt != "" {
+			params.System = []anthropic.TextBlockParam{{Text: agent.SystemPrompt}}
+		}
+		if agent.MaxTokens != nil {
+			params.MaxTokens = int64(*agent.MaxTokens)
+		}
+		if len(tools) > 0 {
+			params.Tools = tools
+		}
+		if agent.Temperature != nil {
+			params.Temperature = anthropic.Float(*agent.Temperature)
+		}
+		if agent.TopK != nil {
+			params.TopK = anthropic.Int(int64(*agent.TopK))
+		}
+		if agent.TopP != nil {
+			params.TopP = anthropic.Float(*agent.TopP)
+		}
+
+		msg, err := c.invokeModel(ctx, inv, agent, iter, params)
+		if err != nil {
+			now := inv.now()
+			errorMessage := err.Error()
+			errorType := classifyAPIError(err).errorType
+			iter.ErrorMessage = &errorMessage
+			iter.ErrorType = &errorType
+			iter.CompletedAt = &now
+			return err
+		}
+
+		// Record the assistant message
+		content := make([]driver.ContentBlock, 0, len(msg.Content))
+		var toolUses []anthropic.ToolUseBlock
+		var responseText string
+		for _, block := range msg.Content {
+			switch variant := block.AsAny().(type) {
+			case anthropic.TextBlock:
+				content = append(content, driver.ContentBlock{Type: ContentTypeText, Text: variant.Text})
+				responseText += variant.Text
+			case anthropic.ToolUseBlock:
+				input, _ := json.Marshal(variant.Input)
+				content = append(content, driver.ContentBlock{
+					Type:      ContentTypeToolUse,
+					ToolUseID: variant.ID,
+					ToolName:  variant.Name,
+					ToolInput: input,
+				})
+				toolUses = append(toolUses, variant)
+			}
+		}
+		usage := driver.Usage{
+			InputTokens:              int(msg.Usage.InputTokens),
+			OutputTokens:             int(msg.Usage.OutputTokens),
+			CacheCreationInputTokens: int(msg.Usage.CacheCreationInputTokens),
+			CacheReadInputTokens:     int(msg.Usage.CacheReadInputTokens),
+		}
+		response := inv.addMessage(run, MessageRoleAssistant, content, usage)
+		contextMessages = append(contextMessages, response)
+
+		now = inv.now()
+		stopReason := string(msg.StopReason)
+		iter.StopReason = &stopReason
+		iter.ResponseMessageID = &response.ID
+		iter.HasToolUse = len(toolUses) > 0
+		iter.ToolExecutionCount = len(toolUses)
+		iter.InputTokens = usage.InputTokens
+		iter.OutputTokens = usage.OutputTokens
+		iter.CacheCreationInputTokens = usage.CacheCreationInputTokens
+		iter.CacheReadInputTokens = usage.CacheReadInputTokens
+		iter.StreamingCompletedAt = &now
+		iter.CompletedAt = &now
+
+		run.InputTokens += usage.InputTokens
+		run.OutputTokens += usage.OutputTokens
+		run.CacheCreationInputTokens += usage.CacheCreationInputTokens
+		run.CacheReadInputTokens += usage.CacheReadInputTokens
+		run.IterationCount++
+
+		if len(toolUses) == 0 {
+			run.ResponseText = &responseText
+			run.StopReason = &stopReason
+			return nil
+		}
+		run.ToolIterations++
+
+		results := make([]driver.ContentBlock, 0, len(toolUses))
+		for _, toolUse := range toolUses {
+			exec := c.invokeTool(ctx, inv, run, iter, toolUse, delegates)
+			output := Deref(exec.ToolOutput)
+			if output == "" && exec.IsError {
+				output = Deref(exec.ErrorMessage)
+			}
+			results = append(results, driver.ContentBlock{
+				Type:               ContentTypeToolResult,
+				ToolResultForUseID: exec.ToolUseID,
+				ToolContent:        output,
+				IsError:            exec.IsError,
+			})
+		}
+		contextMessages = append(contextMessages, inv.addMessage(run, MessageRoleUser, results, driver.Usage{}))
+	}
+}
+
+// invokeModel calls the Streaming API for an iteration, falling back to the
+// next model of the agent's fallback chain on overloaded, not-found and
+// latency budget errors. Failed calls are recorded on the iteration. Each
+// call waits for the model's rate limits (see RateLimitConfig).
+func (c *Client[TTx]) invokeModel(ctx context.Context, inv *invocation, agent *AgentDefinition, iter *driver.Iteration, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+	model := agent.Model
+	for {
+		iter.Model = &model
+		params.Model = anthropic.Model(model)
+		nextModel := nextFallbackModel(agent, model)
+
+		// Wait while the model's rate limits are exhausted
+		if err := c.waitForRateLimit(ctx, model); err != nil {
+			return nil, err
+		}
+
+		streamCtx := ctx
+		var budgetTimer *time.Timer
+		var cancel context.CancelCauseFunc
+		if agent.FallbackLatencyBudget > 0 && nextModel != "" {
+			streamCtx, cancel = context.WithCancelCause(ctx)
+			budgetTimer = time.AfterFunc(agent.FallbackLatencyBudget, func() {
+				cancel(errLatencyBudgetExceeded)
+			})
+		}
+
+		msg, err := c.provider.StreamMessage(streamCtx, params, func(anthropic.MessageStreamEventUnion) {
+			if budgetTimer != nil {
+				budgetTimer.Stop()
+			}
+		})
+		if err != nil && errors.Is(context.Cause(streamCtx), errLatencyBudgetExceeded) {
+			err = fmt.Errorf("%w: no response from %s within %s", errLatencyBudgetExceeded, model, agent.FallbackLatencyBudget)
+		}
+		if cancel != nil {
+			budgetTimer.Stop()
+			cancel(nil)
+		}
+		if err == nil {
+			return msg, nil
+		}
+
+		err = fmt.Errorf("streaming error: %w", err)
+		info := classifyAPIError(err)
+		attempt := driver.APIAttempt{
+			Attempt:    len(iter.APIAttempts) + 1,
+			ErrorType:  info.errorType,
+			StatusCode: info.statusCode,
+			Message:    err.Error(),
+			Retryable:  info.retryable,
+			CreatedAt:  inv.now(),
+			Model:      model,
+		}
+		if !fallbackErrorTypes[info.errorType] || nextModel == "" {
+			iter.APIAttempts = append(iter.APIAttempts, attempt)
+			return nil, &apiCallError{iterationID: iter.ID, model: model, err: err}
+		}
+
+		attempt.FallbackModel = nextModel
+		attempt.RetryAt = &attempt.CreatedAt
+		iter.APIAttempts = append(iter.APIAttempts, attempt)
+		c.log().Warn("api call failed, falling back to next model",
+			"run_id", iter.RunID,
+			"iteration_id", iter.ID,
+			"model", model,
+			"fallback_model", nextModel,
+			"error_type", info.errorType,
+			"error", err,
+		)
+		model = nextModel
+	}
+}
+
+// invokeTool executes a tool call of an in-process run and returns the
+// completed tool execution. Delegate agents are invoked in-process as child
+// runs that only see their own messages.
+func (c *Client[TTx]) invokeTool(ctx context.Context, inv *invocation, run *driver.Run, iter *driver.Iteration, toolUse anthropic.ToolUseBlock, delegates map[string]*AgentDefinition) *driver.ToolExecution {
+	input, _ := json.Marshal(toolUse.Input)
+	now := inv.now()
+	exec := &driver.ToolExecution{
+		ID:           uuid.New(),
+		RunID:        run.ID,
+		IterationID:  iter.ID,
+		ToolUseID:    toolUse.ID,
+		ToolName:     toolUse.Name,
+		ToolInput:    input,
+		AttemptCount: 1,
+		MaxAttempts:  1,
+		ScheduledAt:  now,
+		CreatedAt:    now,
+		StartedAt:    &now,
+	}
+	inv.execs = append(inv.execs, exec)
+
+	complete := func(output string, isError bool, errorMessage string) *driver.ToolExecution {
+		now := inv.now()
+		exec.State = driver.ToolExecutionState(ToolStateCompleted)
+		if isError {
+			exec.State = driver.ToolExecutionState(ToolStateFailed)
+		}
+		exec.ToolOutput = &output
+		exec.IsError = isError
+		if errorMessage != "" {
+			exec.ErrorMessage = &errorMessage
+		}
+		exec.CompletedAt = &now
+		return exec
+	}
+
+	if delegate, ok := delegates[toolUse.Name]; ok {
+		exec.IsAgentTool = true
+		exec.AgentID = &delegate.ID
+
+		var taskInput struct {
+			Task string `json:"task"`
+		}
+		if err := json.Unmarshal(input, &taskInput); err != nil {
+			return complete("", true, fmt.Sprintf("invalid input: %v", err))
+		}
+
+		if err := c.checkDepthLimit(run.Depth + 1); err != nil {
+			return complete("", true, err.Error())
+		}
+
+		child := c.newInvokedRun(inv, run.SessionID, delegate, taskInput.Task, run.Metadata, run, exec)
+		exec.ChildRunID = &child.ID
+		if err := c.invokeRun(ctx, inv, child, delegate, nil); err != nil {
+			return complete(Deref(child.ResponseText), true, err.Error())
+		}
+		return complete(Deref(child.ResponseText), false, "")
+	}
+
+	t := c.GetTool(toolUse.Name)
+	if t == nil {
+		return complete("", true, fmt.Sprintf("tool not found: %s", toolUse.Name))
+	}
+
+	execCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	execCtx = tool.WithRunContext(execCtx, tool.RunContext{
+		RunID:     run.ID,
+		SessionID: run.SessionID,
+		Variables: run.Metadata,
+	})
+
+	output, err := t.Execute(execCtx, input)
+	if err != nil {
+		return complete(err.Error(), true, err.Error())
+	}
+	return complete(output, false, "")
+}
+
+// invokeResponse builds the response of a finalized in-process run.
+func (c *Client[TTx]) invokeResponse(inv *invocation, run *driver.Run) (*Response, error) {
+	if run.State == driver.RunState(RunStateFailed) {
+		return nil, &AgentError{
+			Op:        "invoke",
+			Err:       errors.New(Deref(run.ErrorMessage)),
+			RunID:     run.ID.String(),
+			SessionID: run.SessionID.String(),
+			Context: map[string]any{
+				"error_type": Deref(run.ErrorType),
+			},
+		}
+	}
+
+	response := &Response{
+		Text:       Deref(run.ResponseText),
+		StopReason: Deref(run.StopReason),
+		Usage: Usage{
+			InputTokens:              run.InputTokens,
+			OutputTokens:             run.OutputTokens,
+			CacheCreationInputTokens: run.CacheCreationInputTokens,
+			CacheReadInputTokens:     run.CacheReadInputTokens,
+		},
+		IterationCount: run.IterationCount,
+		ToolIterations: run.ToolIterations,
+	}
+	for _, iter := range inv.iterations {
+		if iter.ID != *run.CurrentIterationID {
+			continue
+		}
+		response.Model = Deref(iter.Model)
+		for _, msg := range inv.messages {
+			if iter.ResponseMessageID != nil && msg.ID == *iter.ResponseMessageID {
+				response.Message = convertMessage(msg)
+			}
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,62 @@
+package agentpg
+
+import (
+	"errors"
+
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// errLatencyBudgetExceeded is reported when a streaming request produces no
+// event within the agent's FallbackLatencyBudget.
+var errLatencyBudgetExceeded = errors.New("latency budget exceeded")
+
+// fallbackErrorTypes are error types for which the next fallback model is
+// tried instead of retrying the same model.
+var fallbackErrorTypes = map[string]bool{
+	"overloaded_error":        true,
+	"not_found_error":         true,
+	"latency_budget_exceeded": true,
+}
+
+// batchRequestError is the error of an individual request in an ended batch.
+type batchRequestError struct {
+	errorType string
+	message   string
+}
+
+func (e *batchRequestError) Error() string {
+	return "batch request errored: " + e.errorType + ": " + e.message
+}
+
+// iterationModel returns the model to call for an iteration. A retried
+// iteration continues with the model chosen by its last failed attempt;
+// otherwise the agent's primary model is used.
+func iterationModel(agent *AgentDefinition, iter *driver.Iteration) string {
+	if n := len(iter.APIAttempts); n > 0 {
+		last := iter.APIAttempts[n-1]
+		if last.FallbackModel != "" {
+			return last.FallbackModel
+		}
+		if last.Model != "" {
+			return last.Model
+		}
+	}
+	return agent.Model
+}
+
+// nextFallbackModel returns the model following model in the agent's
+// fallback chain, or "" if there is none.
+func nextFallbackModel(agent *AgentDefinition, model string) string {
+	if model == agent.Model {
+		if len(agent.FallbackModels) > 0 {
+			return agent.FallbackModels[0]
+		}
+		return ""
+	}
+	for i, m := range agent.FallbackModels {
+		if m == model && i+1 < len(agent.FallbackModels) {
+			return agent.FallbackModels[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// Anthropic is the default Provider, backed by the Anthropic Go SDK.
+type Anthropic struct {
+	client       anthropic.Client
+	onRateLimits atomic.Pointer[func(context.Context, RateLimits)]
+}
+
+// Compile-time checks that Anthropic implements Provider and RateLimitReporter.
+var (
+	_ Provider          = (*Anthropic)(nil)
+	_ RateLimitReporter = (*Anthropic)(nil)
+)
+
+// NewAnthropic creates a provider using the Anthropic SDK with the given
+// request options (API key, base URL, Bedrock or Vertex configuration, etc.).
+// Without options, the SDK reads ANTHROPIC_API_KEY from the environment.
+// With Bedrock or Vertex configuration only streaming runs work; see the
+// package documentation.
+func NewAnthropic(opts ...option.RequestOption) *Anthropic {
+	return &Anthropic{client: anthropic.NewClient(opts...)}
+}
+
+// OnRateLimits implements RateLimitReporter.
+func (p *Anthropic) OnRateLimits(fn func(ctx context.Context, limits RateLimits)) {
+	p.onRateLimits.Store(&fn)
+}
+
+// reportRateLimits passes the rate limits of a Messages API response and the
+// usage of its message (nil if the call failed) to the registered handler.
+func (p *Anthropic) reportRateLimits(ctx context.Context, model anthropic.Model, res *http.Response, message *anthropic.Message) {
+	fn := p.onRateLimits.Load()
+	if fn == nil || res == nil {
+		return
+	}
+	limits := ParseRateLimits(string(model), res.Header)
+	if message != nil {
+		limits.InputTokensUsed = message.Usage.InputTokens + message.Usage.CacheCreationInputTokens
+		limits.OutputTokensUsed = message.Usage.OutputTokens
+	}
+	(*fn)(ctx, limits)
+}
+
+// CreateMessage implements Provider.
+func (p *Anthropic) CreateMessage(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+	var res *http.Response
+	message, err := p.client.Messages.New(ctx, params, option.WithResponseInto(&res))
+	p.reportRateLimits(ctx, params.Model, res, message)
+	return message, err
+}
+
+// StreamMessage implements Provider.
+func (p *Anthropic) StreamMessage(ctx context.Context, params anthropic.MessageNewParams, onEvent func(anthropic.MessageStreamEventUnion)) (result *anthropic.Message, err error) {
+	var res *http.Response
+	stream := p.client.Messages.NewStreaming(ctx, params, option.WithResponseInto(&res))
+	defer func() { _ = stream.Close() }()
+	defer func() { p.reportRateLimits(ctx, params.Model, res, result) }()
+
+	var message anthropic.Message
+	for stream.Next() {
+		event := stream.Current()
+		if onEvent != nil {
+			onEvent(event)
+		}
+		if err := message.Accumulate(event); err != nil {
+			return nil, fmt.Errorf("failed to accumulate stream event: %w", err)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// CountTokens implements Provider.
+func (p *Anthropic) CountTokens(ctx context.Context, params anthropic.MessageCountTokensParams) (int64, error) {
+	result, err := p.client.Messages.CountTokens(ctx, params)
+	if err != nil {
+		return 0, err
+	}
+	return result.InputTokens, nil
+}
+
+// SubmitBatch implements Provider.
+func (p *Anthropic) SubmitBatch(ctx context.Context, params anthropic.MessageBatchNewParams) (*anthropic.MessageBatch, error) {
+	return p.client.Messages.Batches.New(ctx, params)
+}
+
+// GetBatch implements Provider.
+func (p *Anthropic) GetBatch(ctx context.Context, batchID string) (*anthropic.MessageBatch, error) {
+	return p.client.Messages.Batches.Get(ctx, batchID)
+}
+
+// GetBatchResults implements Provider.
+func (p *Anthropic) GetBatchResults(ctx context.Context, batchID string) ([]anthropic.MessageBatchIndividualResponse, error) {
+	stream := p.client.Messages.Batches.ResultsStreaming(ctx, batchID)
+	defer func() { _ = stream.Close() }()
+
+	var results []anthropic.MessageBatchIndividualResponse
+	for stream.Next() {
+		results = append(results, stream.Current())
+	}
+	if err := stream.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read batch results: %w", err)
+	}
+	return results, nil
+}
@@ -0,0 +1,51 @@
+// Package provider defines the interface AgentPG uses to call the Claude API.
+//
+// The default implementation, Anthropic, uses the Anthropic Go SDK. Because the
+// SDK supports Amazon Bedrock and Google Vertex AI through request options, the
+// same implementation can target those endpoints:
+//
+//	p := provider.NewAnthropic(bedrock.WithLoadDefaultConfig(ctx))
+//	client, err := agentpg.NewClient(drv, &agentpg.ClientConfig{Provider: p})
+//
+// Batch mode is Anthropic-only: Bedrock and Vertex AI do not serve the
+// Message Batches API, so SubmitBatch fails there. Agents on those endpoints
+// must use streaming runs (RunFast, Invoke). RunAuto is not suitable either,
+// as auto runs use the Batch API for background iterations.
+//
+// Custom implementations can wrap a provider (e.g. to record requests) or
+// replace it entirely (e.g. a deterministic fake for tests).
+package provider
+
+import (
+	"context"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Provider sends requests to a Claude-compatible Messages API.
+//
+// Requests and responses use the Anthropic SDK types. Implementations should
+// return *anthropic.Error for API errors so that AgentPG can classify them
+// for retries and model fallback.
+type Provider interface {
+	// CreateMessage sends a Messages API request and returns the complete response.
+	CreateMessage(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error)
+
+	// StreamMessage sends a streaming Messages API request and returns the
+	// accumulated message. If onEvent is non-nil, it is called for every
+	// stream event as it arrives.
+	StreamMessage(ctx context.Context, params anthropic.MessageNewParams, onEvent func(anthropic.MessageStreamEventUnion)) (*anthropic.Message, error)
+
+	// CountTokens returns the number of input tokens the request would use.
+	CountTokens(ctx context.Context, params anthropic.MessageCountTokensParams) (int64, error)
+
+	// SubmitBatch creates a Message Batch.
+	SubmitBatch(ctx context.Context, params anthropic.MessageBatchNewParams) (*anthropic.MessageBatch, error)
+
+	// GetBatch returns the current state of a Message Batch.
+	GetBatch(ctx context.Context, batchID string) (*anthropic.MessageBatch, error)
+
+	// GetBatchResults returns the results of all requests in an ended batch,
+	// read in a single results download.
+	GetBatchResults(ctx context.Context, batchID string) ([]anthropic.MessageBatchIndividualResponse, error)
+}
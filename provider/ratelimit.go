@@ -0,0 +1,97 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimitReporter is an optional interface for providers that report the
+// rate limits returned by the API. AgentPG registers a handler when the
+// client is created and feeds the reported limits into the rate-limit
+// scheduler shared by all instances.
+type RateLimitReporter interface {
+	// OnRateLimits registers fn to be called after every Messages API call
+	// (CreateMessage and StreamMessage) that received a response, including
+	// error responses such as 429s.
+	OnRateLimits(fn func(ctx context.Context, limits RateLimits))
+}
+
+// RateLimit is the state of one rate limit in the current window.
+type RateLimit struct {
+	Limit     int       // Maximum allowed per minute
+	Remaining int       // Remaining before the limit is reached
+	Reset     time.Time // When the limit is fully replenished, zero if not reported
+}
+
+// RateLimits contains the rate limits reported by a Messages API response
+// (the anthropic-ratelimit-* and retry-after headers) and the usage of the
+// call. Limits whose headers were absent are nil.
+type RateLimits struct {
+	Model        string
+	Requests     *RateLimit
+	InputTokens  *RateLimit
+	OutputTokens *RateLimit
+
+	// RetryAfter is the delay requested by a rate-limited (429) response.
+	RetryAfter time.Duration
+
+	// Tokens used by the call, 0 if it failed. InputTokensUsed includes
+	// cache creation tokens, which count toward the input tokens limit.
+	InputTokensUsed  int64
+	OutputTokensUsed int64
+}
+
+// ParseRateLimits reads the rate limits of a Messages API response from its
+// headers. Custom providers can use it to implement RateLimitReporter.
+func ParseRateLimits(model string, header http.Header) RateLimits {
+	return RateLimits{
+		Model:        model,
+		Requests:     parseRateLimit(header, "requests"),
+		InputTokens:  parseRateLimit(header, "input-tokens"),
+		OutputTokens: parseRateLimit(header, "output-tokens"),
+		RetryAfter:   ParseRetryAfter(header),
+	}
+}
+
+// parseRateLimit reads the anthropic-ratelimit-<name>-{limit,remaining,reset}
+// headers. Returns nil unless both the limit and the remaining are present.
+func parseRateLimit(header http.Header, name string) *RateLimit {
+	prefix := "Anthropic-Ratelimit-" + name + "-"
+	limit, err := strconv.Atoi(header.Get(prefix + "Limit"))
+	if err != nil {
+		return nil
+	}
+	remaining, err := strconv.Atoi(header.Get(prefix + "Remaining"))
+	if err != nil {
+		return nil
+	}
+	rl := &RateLimit{Limit: limit, Remaining: remaining}
+	if reset, err := time.Parse(time.RFC3339, header.Get(prefix+"Reset")); err == nil {
+		rl.Reset = reset
+	}
+	return rl
+}
+
+// ParseRetryAfter reads the retry-after-ms or retry-after response headers.
+// retry-after may be a number of seconds or an HTTP date. Returns 0 if
+// neither header holds a delay in the future.
+func ParseRetryAfter(header http.Header) time.Duration {
+	if v := header.Get("Retry-After-Ms"); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms > 0 {
+			return time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			return time.Duration(secs * float64(time.Second))
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+		}
+	}
+	return 0
+}
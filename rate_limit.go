@@ -0,0 +1,130 @@
+package agentpg
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/provider"
+)
+
+// rateLimitConfig returns the rate limit configuration with defaults applied.
+func (c *Client[TTx]) rateLimitConfig() RateLimitConfig {
+	config := *DefaultRateLimitConfig()
+	if rc := c.config.RateLimitConfig; rc != nil {
+		config.Disabled = rc.Disabled
+		if rc.Headroom > 0 {
+			config.Headroom = rc.Headroom
+		}
+	}
+	return config
+}
+
+// acquireRateLimit takes a request from the rate-limit buckets of model.
+// Returns nil if the call may start, otherwise when to try again. Errors are
+// logged and let the call start, as the API enforces the limits anyway.
+func (c *Client[TTx]) acquireRateLimit(ctx context.Context, model string) *time.Time {
+	if c.rateLimitConfig().Disabled {
+		return nil
+	}
+	retryAt, err := c.driver.Store().AcquireRateLimit(ctx, model)
+	if err != nil {
+		c.log().Warn("failed to acquire rate limit",
+			"model", model,
+			"error", err,
+		)
+		return nil
+	}
+	return retryAt
+}
+
+// deferRun puts a claimed run back to pending until the rate limits of model
+// have refilled. Auto runs use the Batch API meanwhile. Returns false if the
+// run could not be deferred, in which case the call is made anyway.
+func (c *Client[TTx]) deferRun(ctx context.Context, run *driver.Run, model string, retryAt time.Time) bool {
+	if err := c.driver.Store().DeferRun(ctx, run.ID, retryAt); err != nil {
+		c.log().Warn("failed to defer rate limited run",
+			"run_id", run.ID,
+			"error", err,
+		)
+		return false
+	}
+
+	c.log().Info("run deferred until rate limits refill",
+		"run_id", run.ID,
+		"model", model,
+		"retry_at", retryAt,
+	)
+	if run.RunMode == string(RunModeAuto) {
+		c.noteStreamingRateLimit(time.Until(retryAt))
+	}
+	return true
+}
+
+// waitForRateLimit blocks until a request for model can be taken from its
+// rate-limit buckets or ctx is done.
+func (c *Client[TTx]) waitForRateLimit(ctx context.Context, model string) error {
+	for {
+		retryAt := c.acquireRateLimit(ctx, model)
+		if retryAt == nil {
+			return nil
+		}
+		c.log().Debug("waiting for rate limit",
+			"model", model,
+			"retry_at", *retryAt,
+		)
+		timer := time.NewTimer(time.Until(*retryAt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// recordRateLimits stores the rate limits reported by a Messages API call in
+// the model's buckets, keeping Headroom of each limit in reserve. Registered
+// with providers that implement provider.RateLimitReporter.
+func (c *Client[TTx]) recordRateLimits(ctx context.Context, limits provider.RateLimits) {
+	if limits.Model == "" {
+		return
+	}
+	headroom := c.rateLimitConfig().Headroom
+	params := driver.RecordRateLimitParams{
+		Model:            limits.Model,
+		InputTokensUsed:  int(limits.InputTokensUsed),
+		OutputTokensUsed: int(limits.OutputTokensUsed),
+	}
+	params.RequestsLimit, params.RequestsRemaining = rateLimitParams(limits.Requests, headroom)
+	params.InputTokensLimit, params.InputTokensRemaining = rateLimitParams(limits.InputTokens, headroom)
+	params.OutputTokensLimit, params.OutputTokensRemaining = rateLimitParams(limits.OutputTokens, headroom)
+	if limits.RetryAfter > 0 {
+		blockedUntil := time.Now().Add(limits.RetryAfter)
+		params.BlockedUntil = &blockedUntil
+	}
+	if params.RequestsLimit == nil && params.InputTokensLimit == nil && params.OutputTokensLimit == nil && params.BlockedUntil == nil {
+		return
+	}
+
+	// Record even if the call's context was cancelled after the response
+	if err := c.driver.Store().RecordRateLimit(context.WithoutCancel(ctx), params); err != nil {
+		c.log().Warn("failed to record rate limits",
+			"model", limits.Model,
+			"error", err,
+		)
+	}
+}
+
+// rateLimitParams returns the limit and the remaining amount of rl less the
+// headroom, or nils if the limit was not reported.
+func rateLimitParams(rl *provider.RateLimit, headroom float64) (limit, remaining *int) {
+	if rl == nil || rl.Limit <= 0 {
+		return nil, nil
+	}
+	reserved := min(int(math.Ceil(float64(rl.Limit)*headroom)), rl.Limit-1)
+	limitValue := rl.Limit - reserved
+	remainingValue := rl.Remaining - reserved
+	return &limitValue, &remainingValue
+}
@@ -0,0 +1,236 @@
+package agentpg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// RetentionTarget is the data a RetentionPolicy deletes.
+type RetentionTarget string
+
+const (
+	// RetentionSessions deletes whole sessions with everything in them once
+	// they have been inactive for MaxAge: the session was last updated, its
+	// runs finalized and its messages written more than MaxAge ago. Sessions
+	// with a run in progress are never deleted, and a parent session is kept
+	// until its child sessions are deleted.
+	RetentionSessions RetentionTarget = "sessions"
+
+	// RetentionRuns deletes root runs finalized more than MaxAge ago, with
+	// their nested runs, iterations and tool executions. The messages of
+	// root runs stay in the session's conversation; the messages of nested
+	// runs are deleted with them.
+	RetentionRuns RetentionTarget = "runs"
+
+	// RetentionArchivedMessages deletes the messages archived by
+	// compactions made more than MaxAge ago. Those compactions can no longer
+	// be restored.
+	RetentionArchivedMessages RetentionTarget = "archived_messages"
+)
+
+// RetentionPolicy deletes data older than MaxAge. The leader applies the
+// policies in ClientConfig.RetentionPolicies on every cleanup run
+// (CleanupInterval), deleting BatchSize rows per transaction, and logs the
+// number of rows deleted.
+type RetentionPolicy struct {
+	// Name identifies the policy in logs.
+	// Defaults to the target.
+	Name string
+
+	// Target is the data the policy deletes (required).
+	Target RetentionTarget
+
+	// MaxAge is how long data is kept (required).
+	MaxAge time.Duration
+
+	// SessionMetadata restricts the policy to sessions whose metadata
+	// contains these entries, e.g. {"tenant_id": "acme"}.
+	SessionMetadata map[string]any
+
+	// RunStates restricts a RetentionRuns policy to runs in these terminal
+	// states, e.g. to keep failed runs longer than completed ones.
+	// Defaults to all terminal states.
+	RunStates []RunState
+
+	// BatchSize is the maximum number of rows of the target deleted per
+	// transaction. For RetentionArchivedMessages it counts compactions.
+	// Default: DefaultRetentionBatchSize (500)
+	BatchSize int
+}
+
+// PurgeCounts contains the number of rows deleted by DeleteSession or a
+// retention policy, including dependent rows.
+type PurgeCounts struct {
+	Sessions         int `json:"sessions"`
+	Runs             int `json:"runs"`
+	Iterations       int `json:"iterations"`
+	ToolExecutions   int `json:"tool_executions"`
+	Messages         int `json:"messages"`
+	CompactionEvents int `json:"compaction_events"`
+	ArchivedMessages int `json:"archived_messages"`
+}
+
+// retentionBatchesPerCleanup bounds the batches a policy deletes per cleanup
+// run, so a large backlog is worked off over several runs instead of holding
+// up the cleanup loop.
+const retentionBatchesPerCleanup = 10
+
+// validate checks the policy and sets defaults.
+func (p *RetentionPolicy) validate() error {
+	switch p.Target {
+	case RetentionSessions, RetentionArchivedMessages:
+		if len(p.RunStates) > 0 {
+			return fmt.Errorf("retention policy %q: RunStates only applies to %q", p.Name, RetentionRuns)
+		}
+	case RetentionRuns:
+		for _, state := range p.RunStates {
+			if !state.IsTerminal() {
+				return fmt.Errorf("retention policy %q: run state %q is not terminal", p.Name, state)
+			}
+		}
+	default:
+		return fmt.Errorf("retention policy %q: unknown target %q", p.Name, p.Target)
+	}
+	if p.MaxAge <= 0 {
+		return fmt.Errorf("retention policy %q: MaxAge must be positive", p.Name)
+	}
+	if p.Name == "" {
+		p.Name = string(p.Target)
+	}
+	if p.BatchSize <= 0 {
+		p.BatchSize = DefaultRetentionBatchSize
+	}
+	return nil
+}
+
+// DeleteSession permanently deletes a session, for example to honor an
+// erasure request. Its child sessions (including forks) and all of their
+// runs, iterations, tool executions, messages, compaction events and
+// archived messages are deleted with it in a single transaction.
+//
+// Returns the number of rows deleted, ErrSessionNotFound, or an error
+// matching driver.ErrSessionBusy if a run of one of the sessions is in
+// progress; cancel the runs and try again.
+func (c *Client[TTx]) DeleteSession(ctx context.Context, sessionID uuid.UUID) (*PurgeCounts, error) {
+	c.mu.RLock()
+	started := c.started
+	c.mu.RUnlock()
+
+	if !started {
+		return nil, ErrClientNotStarted
+	}
+
+	counts, err := c.driver.Store().DeleteSession(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete session: %w", err)
+	}
+	if counts == nil {
+		return nil, ErrSessionNotFound
+	}
+
+	result := PurgeCounts(*counts)
+	c.log().Info("deleted session", append([]any{"session_id", sessionID}, result.logArgs()...)...)
+	return &result, nil
+}
+
+// runRetentionPolicies applies the configured retention policies. Only the
+// leader calls it, from the cleanup loop.
+func (c *Client[TTx]) runRetentionPolicies(ctx context.Context) {
+	for _, policy := range c.config.RetentionPolicies {
+		var total PurgeCounts
+		for range retentionBatchesPerCleanup {
+			if ctx.Err() != nil || !c.isLeaderInstance() {
+				break
+			}
+			counts, deleted, err := c.purgeBatch(ctx, policy)
+			if err != nil {
+				c.log().Error("failed to apply retention policy",
+					"policy", policy.Name,
+					"target", policy.Target,
+					"error", err)
+				break
+			}
+			total.add(counts)
+			if deleted < policy.BatchSize {
+				break
+			}
+		}
+		if total != (PurgeCounts{}) {
+			c.log().Info("retention policy deleted rows",
+				append([]any{"policy", policy.Name, "target", policy.Target}, total.logArgs()...)...)
+		}
+	}
+}
+
+// purgeBatch deletes one batch of the policy's target. Returns the rows
+// deleted and how many of them were rows of the target.
+func (c *Client[TTx]) purgeBatch(ctx context.Context, policy RetentionPolicy) (PurgeCounts, int, error) {
+	store := c.driver.Store()
+	params := driver.PurgeParams{
+		Before:         time.Now().Add(-policy.MaxAge),
+		MetadataFilter: policy.SessionMetadata,
+		Limit:          policy.BatchSize,
+	}
+
+	var counts *driver.PurgeCounts
+	var err error
+	switch policy.Target {
+	case RetentionSessions:
+		counts, err = store.PurgeSessions(ctx, params)
+	case RetentionRuns:
+		for _, state := range policy.RunStates {
+			params.States = append(params.States, string(state))
+		}
+		counts, err = store.PurgeRuns(ctx, params)
+	case RetentionArchivedMessages:
+		counts, err = store.PurgeArchivedMessages(ctx, params)
+	default:
+		return PurgeCounts{}, 0, fmt.Errorf("unknown target %q", policy.Target)
+	}
+	if err != nil {
+		return PurgeCounts{}, 0, err
+	}
+
+	result := PurgeCounts(*counts)
+	switch policy.Target {
+	case RetentionSessions:
+		return result, result.Sessions, nil
+	case RetentionRuns:
+		// Nested runs are deleted with their root run
+		return result, min(result.Runs, policy.BatchSize), nil
+	default:
+		// Archives are deleted per compaction, so a full batch cannot be
+		// told from the counts: keep going while anything was deleted
+		if result.ArchivedMessages > 0 {
+			return result, policy.BatchSize, nil
+		}
+		return result, 0, nil
+	}
+}
+
+func (p *PurgeCounts) add(other PurgeCounts) {
+	p.Sessions += other.Sessions
+	p.Runs += other.Runs
+	p.Iterations += other.Iterations
+	p.ToolExecutions += other.ToolExecutions
+	p.Messages += other.Messages
+	p.CompactionEvents += other.CompactionEvents
+	p.ArchivedMessages += other.ArchivedMessages
+}
+
+// logArgs returns the counts as structured log arguments.
+func (p PurgeCounts) logArgs() []any {
+	return []any{
+		"sessions", p.Sessions,
+		"runs", p.Runs,
+		"iterations", p.Iterations,
+		"tool_executions", p.ToolExecutions,
+		"messages", p.Messages,
+		"compaction_events", p.CompactionEvents,
+		"archived_messages", p.ArchivedMessages,
+	}
+}
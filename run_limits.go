@@ -0,0 +1,47 @@
+package agentpg
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// ErrorTypeMaxIterations is the error type of runs failed because they
+// reached ClientConfig.MaxIterations.
+const ErrorTypeMaxIterations = "max_iterations"
+
+// checkIterationLimit returns ErrMaxIterations if the run may not start
+// another iteration. The run and streaming workers and Invoke check it before
+// every new iteration, so a model that keeps calling tools cannot loop
+// forever.
+func (c *Client[TTx]) checkIterationLimit(run *driver.Run) error {
+	if limit := c.config.MaxIterations; run.CurrentIteration >= limit {
+		return fmt.Errorf("%w (%d)", ErrMaxIterations, limit)
+	}
+	return nil
+}
+
+// checkDepthLimit returns ErrMaxAgentDepth if a child run at depth may not be
+// created. Agent tools check it before delegating, so agents that delegate to
+// each other cannot recurse forever.
+func (c *Client[TTx]) checkDepthLimit(depth int) error {
+	if limit := c.config.MaxAgentDepth; depth > limit {
+		return fmt.Errorf("%w (%d)", ErrMaxAgentDepth, limit)
+	}
+	return nil
+}
+
+// runErrorType returns the error type a run failed with err is recorded
+// with, or fallback for errors without a dedicated type.
+func runErrorType(err error, fallback string) string {
+	var overflowErr *contextOverflowError
+	switch {
+	case errors.As(err, &overflowErr):
+		return ErrorTypeContextOverflow
+	case errors.Is(err, ErrMaxIterations):
+		return ErrorTypeMaxIterations
+	default:
+		return fallback
+	}
+}
@@ -0,0 +1,93 @@
+package agentpg
+
+import (
+	"context"
+	"time"
+
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// InteractiveSessionKey is the session metadata key that marks a session as
+// interactive, e.g. {"interactive": true}. RunModeAuto runs of interactive
+// sessions use the Streaming API unless it is rate limited.
+const InteractiveSessionKey = "interactive"
+
+// autoRunModeConfig returns the auto run mode configuration with defaults
+// applied.
+func (c *Client[TTx]) autoRunModeConfig() AutoRunModeConfig {
+	config := *DefaultAutoRunModeConfig()
+	if ac := c.config.AutoRunModeConfig; ac != nil {
+		config.StreamContinuations = ac.StreamContinuations
+		if ac.RateLimitCooldown > 0 {
+			config.RateLimitCooldown = ac.RateLimitCooldown
+		}
+	}
+	return config
+}
+
+// autoRunMode picks the API for the next iteration of a RunModeAuto run (see
+// AutoRunModeConfig).
+func (c *Client[TTx]) autoRunMode(ctx context.Context, run *driver.Run) RunMode {
+	streaming := c.streamingWorker
+	if streaming == nil || streaming.rateLimited() {
+		return RunModeBatch
+	}
+
+	session, err := c.driver.Store().GetSession(ctx, run.SessionID)
+	if err != nil {
+		c.log().Warn("failed to get session for auto run mode",
+			"run_id", run.ID,
+			"error", err,
+		)
+	}
+	if session != nil {
+		if interactive, _ := session.Metadata[InteractiveSessionKey].(bool); interactive {
+			return RunModeStreaming
+		}
+	}
+
+	if run.CurrentIteration > 0 && !c.autoRunModeConfig().StreamContinuations {
+		return RunModeBatch
+	}
+	if streaming.hasCapacity() {
+		return RunModeStreaming
+	}
+	return RunModeBatch
+}
+
+// dispatchAutoRun routes a RunModeAuto run claimed by the run worker. Returns
+// true if the run was handed over to the streaming worker; otherwise the run
+// worker submits it in a batch.
+func (c *Client[TTx]) dispatchAutoRun(ctx context.Context, run *driver.Run) (bool, error) {
+	mode := c.autoRunMode(ctx, run)
+
+	c.log().Debug("auto run mode",
+		"run_id", run.ID,
+		"iteration", run.CurrentIteration+1,
+		"mode", mode,
+	)
+
+	if mode != RunModeStreaming {
+		return false, nil
+	}
+
+	if err := c.driver.Store().UpdateRunState(ctx, run.ID, driver.RunState(RunStateStreaming), nil); err != nil {
+		return false, err
+	}
+	run.State = string(RunStateStreaming)
+	c.streamingWorker.enqueue(run)
+	return true, nil
+}
+
+// noteStreamingRateLimit makes auto runs use the Batch API for a while after a
+// streaming call was rate limited.
+func (c *Client[TTx]) noteStreamingRateLimit(retryAfter time.Duration) {
+	if c.streamingWorker == nil {
+		return
+	}
+	cooldown := max(c.autoRunModeConfig().RateLimitCooldown, retryAfter)
+	c.streamingWorker.setRateLimited(time.Now().Add(cooldown))
+	c.log().Info("streaming rate limited, auto runs use the Batch API",
+		"cooldown", cooldown,
+	)
+}
@@ -3,6 +3,7 @@ package agentpg
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,12 +14,33 @@ import (
 )
 
 // runWorker processes pending batch runs by claiming them, building messages,
-// and submitting to Claude Batch API. Only claims runs with run_mode='batch'.
+// and submitting to Claude Batch API. Claims runs with run_mode='batch', and
+// runs with run_mode='auto' whose next iteration it routes to either API.
+//
+// Requests are not submitted one batch per iteration: they are collected for
+// BatchCoalesceWindow, or until BatchMaxRequests are pending, and submitted
+// together in one Message Batch.
 type runWorker[TTx any] struct {
 	client    *Client[TTx]
 	triggerCh chan struct{}
+
+	// pending holds prepared requests waiting to be submitted. Only the
+	// worker goroutine accesses it.
+	pending []*batchRequest
+}
+
+// batchRequest is a prepared iteration request waiting to be submitted.
+type batchRequest struct {
+	run       *driver.Run
+	iteration *driver.Iteration
+	model     string
+	nextModel string
+	params    anthropic.MessageBatchNewParamsRequestParams
 }
 
+// batchFlushTimeout bounds the submission of pending requests on shutdown.
+const batchFlushTimeout = 10 * time.Second
+
 func newRunWorker[TTx any](c *Client[TTx]) *runWorker[TTx] {
 	return &runWorker[TTx]{
 		client:    c,
@@ -37,14 +59,38 @@ func (w *runWorker[TTx]) run(ctx context.Context) {
 	ticker := time.NewTicker(w.client.config.RunPollInterval)
 	defer ticker.Stop()
 
+	// Armed while requests are pending
+	var flushTimer *time.Timer
+	var flushCh <-chan time.Time
+
 	for {
 		select {
 		case <-ctx.Done():
+			if flushTimer != nil {
+				flushTimer.Stop()
+			}
+			// Submit what was collected so the claimed runs are not failed
+			// when the instance unregisters
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), batchFlushTimeout)
+			w.flush(flushCtx)
+			cancel()
 			return
 		case <-w.triggerCh:
 			w.processRuns(ctx)
 		case <-ticker.C:
 			w.processRuns(ctx)
+		case <-flushCh:
+			flushTimer, flushCh = nil, nil
+			w.flush(ctx)
+		}
+
+		switch {
+		case len(w.pending) == 0 && flushTimer != nil:
+			flushTimer.Stop()
+			flushTimer, flushCh = nil, nil
+		case len(w.pending) > 0 && flushTimer == nil:
+			flushTimer = time.NewTimer(w.client.config.BatchCoalesceWindow)
+			flushCh = flushTimer.C
 		}
 	}
 }
@@ -59,19 +105,58 @@ func (w *runWorker[TTx]) processRuns(ctx context.Context) {
 		return
 	}
 
+	// Auto runs go to the streaming worker or into the batch. Both modes
+	// share MaxConcurrentRuns, so only the capacity left is claimed.
+	var autoRuns []*driver.Run
+	if limit := w.client.config.MaxConcurrentRuns - len(runs); limit > 0 {
+		autoRuns, err = store.ClaimRuns(ctx, w.client.instanceID, limit, string(RunModeAuto))
+		if err != nil {
+			w.client.log().Error("failed to claim auto runs", "error", err)
+		}
+	}
+	for _, run := range autoRuns {
+		streamed, err := w.client.dispatchAutoRun(ctx, run)
+		if err != nil {
+			w.handleRunError(ctx, run, fmt.Errorf("failed to dispatch auto run: %w", err))
+			continue
+		}
+		if !streamed {
+			runs = append(runs, run)
+		}
+	}
+
 	for _, run := range runs {
-		if err := w.processRun(ctx, run); err != nil {
-			w.client.log().Error("failed to process run",
-				"run_id", run.ID,
-				"error", err,
-			)
-			// Mark run as failed
-			w.failRun(ctx, run.ID, "processing_error", err.Error())
+		req, err := w.prepareRun(ctx, run)
+		if err != nil {
+			w.handleRunError(ctx, run, err)
+			continue
 		}
+		w.pending = append(w.pending, req)
+	}
+
+	if len(w.pending) >= w.client.config.BatchMaxRequests {
+		w.flush(ctx)
 	}
 }
 
-func (w *runWorker[TTx]) processRun(ctx context.Context, run *driver.Run) error {
+// handleRunError retries transient API failures and fails the run otherwise.
+func (w *runWorker[TTx]) handleRunError(ctx context.Context, run *driver.Run, err error) {
+	// Transient API failures are retried instead of failing the run
+	var callErr *apiCallError
+	if errors.As(err, &callErr) && w.client.retryAPICall(ctx, run, callErr) {
+		return
+	}
+
+	w.client.log().Error("failed to process run",
+		"run_id", run.ID,
+		"error", err,
+	)
+	// Mark run as failed
+	w.failRun(ctx, run.ID, runErrorType(err, "processing_error"), err.Error())
+}
+
+// prepareRun creates the run's next iteration and builds its batch request.
+func (w *runWorker[TTx]) prepareRun(ctx context.Context, run *driver.Run) (*batchRequest, error) {
 	store := w.client.driver.Store()
 	log := w.client.log()
 
@@ -84,54 +169,77 @@ func (w *runWorker[TTx]) processRun(ctx context.Context, run *driver.Run) error
 	// Get agent definition from database
 	agent, err := w.client.GetAgentByID(ctx, run.AgentID)
 	if err != nil {
-		return fmt.Errorf("agent not found: %w", err)
+		return nil, fmt.Errorf("agent not found: %w", err)
 	}
 
-	// Determine trigger type
-	triggerType := "user_prompt"
-	if run.CurrentIteration > 0 {
-		triggerType = "tool_results"
+	// Resume the iteration of a failed API call that is being retried
+	iteration, err := w.client.retryIteration(ctx, run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get retry iteration: %w", err)
 	}
+	if iteration == nil {
+		if err := w.client.checkIterationLimit(run); err != nil {
+			return nil, err
+		}
+
+		// Determine trigger type
+		triggerType := "user_prompt"
+		if run.CurrentIteration > 0 {
+			triggerType = "tool_results"
+		}
 
-	// For first iteration, create the user message with the prompt
-	if run.CurrentIteration == 0 && run.Prompt != "" {
-		_, err := store.CreateMessage(ctx, driver.CreateMessageParams{
-			SessionID: run.SessionID,
-			RunID:     &run.ID,
-			Role:      driver.MessageRole(MessageRoleUser),
-			Content: []driver.ContentBlock{
-				{
-					Type: ContentTypeText,
-					Text: run.Prompt,
+		// For first iteration, create the user message with the prompt
+		if run.CurrentIteration == 0 && run.Prompt != "" {
+			_, err := store.CreateMessage(ctx, driver.CreateMessageParams{
+				SessionID: run.SessionID,
+				RunID:     &run.ID,
+				Role:      driver.MessageRole(MessageRoleUser),
+				Content: []driver.ContentBlock{
+					{
+						Type: ContentTypeText,
+						Text: run.Prompt,
+					},
 				},
-			},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create user message: %w", err)
+			}
+		}
+
+		// Create iteration
+		iteration, err = store.CreateIteration(ctx, driver.CreateIterationParams{
+			RunID:           run.ID,
+			IterationNumber: run.CurrentIteration + 1,
+			TriggerType:     triggerType,
 		})
 		if err != nil {
-			return fmt.Errorf("failed to create user message: %w", err)
+			return nil, fmt.Errorf("failed to create iteration: %w", err)
 		}
 	}
 
-	// Create iteration
-	iterationNumber := run.CurrentIteration + 1
-	iteration, err := store.CreateIteration(ctx, driver.CreateIterationParams{
-		RunID:           run.ID,
-		IterationNumber: iterationNumber,
-		TriggerType:     triggerType,
-	})
+	// Use the fallback model chosen by a previous failed attempt, if any
+	model := iterationModel(agent, iteration)
+	nextModel := nextFallbackModel(agent, model)
+
+	// Compact first if the history outgrew the agent's context window
+	w.client.compactBeforeIteration(ctx, run)
+
+	// Build tools for Claude API
+	tools, err := w.client.buildTools(ctx, agent)
 	if err != nil {
-		return fmt.Errorf("failed to create iteration: %w", err)
+		return nil, fmt.Errorf("failed to build tools: %w", err)
 	}
 
-	// Build messages for Claude API
-	messages, err := w.buildMessages(ctx, run)
+	// Make sure the request fits the context window
+	toolOutputLimit, err := w.client.checkContextOverflow(ctx, run, agent, tools)
 	if err != nil {
-		return fmt.Errorf("failed to build messages: %w", err)
+		return nil, err
 	}
 
-	// Build tools for Claude API
-	tools, err := w.buildTools(ctx, agent)
+	// Build messages for Claude API
+	messages, err := w.buildMessages(ctx, run, toolOutputLimit)
 	if err != nil {
-		return fmt.Errorf("failed to build tools: %w", err)
+		return nil, fmt.Errorf("failed to build messages: %w", err)
 	}
 
 	// Build system prompt
@@ -143,72 +251,138 @@ func (w *runWorker[TTx]) processRun(ctx context.Context, run *driver.Run) error
 	}
 
 	// Build batch request
-	maxTokens := int64(4096)
+	maxTokens := DefaultMaxTokens
 	if agent.MaxTokens != nil {
 		maxTokens = int64(*agent.MaxTokens)
 	}
 
-	batchParams := anthropic.MessageBatchNewParams{
-		Requests: []anthropic.MessageBatchNewParamsRequest{
-			{
-				CustomID: iteration.ID.String(),
-				Params: anthropic.MessageBatchNewParamsRequestParams{
-					Model:     anthropic.Model(agent.Model),
-					MaxTokens: maxTokens,
-					Messages:  messages,
-					System:    system,
-				},
-			},
-		},
+	params := anthropic.MessageBatchNewParamsRequestParams{
+		Model:     anthropic.Model(model),
+		MaxTokens: maxTokens,
+		Messages:  messages,
+		System:    system,
 	}
 
 	// Add tools if any
 	if len(tools) > 0 {
-		batchParams.Requests[0].Params.Tools = tools
+		params.Tools = tools
 	}
 
 	// Add optional parameters
 	if agent.Temperature != nil {
-		batchParams.Requests[0].Params.Temperature = anthropic.Float(*agent.Temperature)
+		params.Temperature = anthropic.Float(*agent.Temperature)
 	}
 	if agent.TopK != nil {
-		batchParams.Requests[0].Params.TopK = anthropic.Int(int64(*agent.TopK))
+		params.TopK = anthropic.Int(int64(*agent.TopK))
 	}
 	if agent.TopP != nil {
-		batchParams.Requests[0].Params.TopP = anthropic.Float(*agent.TopP)
+		params.TopP = anthropic.Float(*agent.TopP)
+	}
+
+	return &batchRequest{
+		run:       run,
+		iteration: iteration,
+		model:     model,
+		nextModel: nextModel,
+		params:    params,
+	}, nil
+}
+
+// flush submits the pending requests, in Message Batches of at most
+// BatchMaxRequests requests.
+func (w *runWorker[TTx]) flush(ctx context.Context) {
+	for len(w.pending) > 0 {
+		n := min(len(w.pending), w.client.config.BatchMaxRequests)
+		reqs := w.pending[:n]
+		w.pending = w.pending[n:]
+		w.submitBatch(ctx, reqs)
+	}
+	w.pending = nil
+}
+
+// submitBatch submits requests in one Message Batch. Each request's custom
+// ID is its iteration ID, which the batch poller uses to route results.
+func (w *runWorker[TTx]) submitBatch(ctx context.Context, reqs []*batchRequest) {
+	log := w.client.log()
+
+	batchParams := anthropic.MessageBatchNewParams{
+		Requests: make([]anthropic.MessageBatchNewParamsRequest, 0, len(reqs)),
+	}
+	for _, req := range reqs {
+		batchParams.Requests = append(batchParams.Requests, anthropic.MessageBatchNewParamsRequest{
+			CustomID: req.iteration.ID.String(),
+			Params:   req.params,
+		})
 	}
 
 	// Submit batch
-	batch, err := w.client.anthropic.Messages.Batches.New(ctx, batchParams)
+	batch, err := w.client.provider.SubmitBatch(ctx, batchParams)
 	if err != nil {
-		return fmt.Errorf("failed to submit batch: %w", err)
+		// The submission failed as a whole; every request is retried or failed
+		for _, req := range reqs {
+			w.handleRunError(ctx, req.run, &apiCallError{
+				iterationID: req.iteration.ID,
+				model:       req.model,
+				nextModel:   req.nextModel,
+				err:         fmt.Errorf("failed to submit batch: %w", err),
+			})
+		}
+		return
 	}
 
 	log.Info("batch submitted",
-		"run_id", run.ID,
 		"batch_id", batch.ID,
-		"iteration_id", iteration.ID,
+		"requests", len(reqs),
 	)
 
-	// Update iteration with batch info
-	batchStatus := BatchStatusInProgress
 	now := time.Now()
-	expiresAt := now.Add(24 * time.Hour)
-	if err := store.UpdateIteration(ctx, iteration.ID, map[string]any{
+	for _, req := range reqs {
+		if err := w.markSubmitted(ctx, req, batch, now); err != nil {
+			w.handleRunError(ctx, req.run, err)
+		}
+	}
+}
+
+// markSubmitted records the batch on the request's iteration and moves the
+// run to batch_pending.
+func (w *runWorker[TTx]) markSubmitted(ctx context.Context, req *batchRequest, batch *anthropic.MessageBatch, now time.Time) error {
+	store := w.client.driver.Store()
+
+	w.client.log().Debug("iteration submitted",
+		"run_id", req.run.ID,
+		"batch_id", batch.ID,
+		"iteration_id", req.iteration.ID,
+		"model", req.model,
+	)
+
+	// Update iteration with batch info. The poll schedule starts over for a
+	// resubmitted iteration, and a retried iteration of an auto run may have
+	// been streamed before.
+	batchStatus := BatchStatusInProgress
+	expiresAt := batch.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(24 * time.Hour)
+	}
+	if err := store.UpdateIteration(ctx, req.iteration.ID, map[string]any{
+		"is_streaming":       false,
 		"batch_id":           batch.ID,
-		"batch_request_id":   iteration.ID.String(),
+		"batch_request_id":   req.iteration.ID.String(),
 		"batch_status":       string(batchStatus),
 		"batch_submitted_at": now,
 		"batch_expires_at":   expiresAt,
+		"batch_poll_count":   0,
+		"batch_last_poll_at": nil,
+		"batch_next_poll_at": now.Add(w.client.batchPollConfig().NextPollInterval(0)),
 		"started_at":         now,
+		"model":              req.model,
 	}); err != nil {
 		return fmt.Errorf("failed to update iteration: %w", err)
 	}
 
 	// Update run state
-	if err := store.UpdateRunState(ctx, run.ID, driver.RunState(RunStateBatchPending), map[string]any{
-		"current_iteration":    iterationNumber,
-		"current_iteration_id": iteration.ID,
+	if err := store.UpdateRunState(ctx, req.run.ID, driver.RunState(RunStateBatchPending), map[string]any{
+		"current_iteration":    req.iteration.IterationNumber,
+		"current_iteration_id": req.iteration.ID,
 		"started_at":           now,
 	}); err != nil {
 		return fmt.Errorf("failed to update run state: %w", err)
@@ -217,7 +391,9 @@ func (w *runWorker[TTx]) processRun(ctx context.Context, run *driver.Run) error
 	return nil
 }
 
-func (w *runWorker[TTx]) buildMessages(ctx context.Context, run *driver.Run) ([]anthropic.MessageParam, error) {
+// buildMessages converts the run's context to API messages. Tool outputs
+// are truncated to toolOutputLimit tokens (0 for no limit).
+func (w *runWorker[TTx]) buildMessages(ctx context.Context, run *driver.Run, toolOutputLimit int) ([]anthropic.MessageParam, error) {
 	store := w.client.driver.Store()
 
 	// Get messages for this run's context
@@ -228,53 +404,27 @@ func (w *runWorker[TTx]) buildMessages(ctx context.Context, run *driver.Run) ([]
 		return nil, fmt.Errorf("failed to get messages: %w", err)
 	}
 
-	messages := make([]anthropic.MessageParam, 0, len(sessionMessages))
-
-	// Add existing messages from database
-	// IMPORTANT: Claude API requires alternating user/assistant roles.
-	// Consecutive messages with the same role must be merged into one message.
-	for _, msg := range sessionMessages {
-		role := anthropic.MessageParamRoleUser
-		if msg.Role == string(MessageRoleAssistant) {
-			role = anthropic.MessageParamRoleAssistant
-		}
-
-		content := make([]anthropic.ContentBlockParamUnion, 0, len(msg.Content))
-		for _, block := range msg.Content {
-			switch block.Type {
-			case ContentTypeText:
-				content = append(content, anthropic.NewTextBlock(block.Text))
-			case ContentTypeToolUse:
-				var input any
-				if len(block.ToolInput) > 0 {
-					_ = json.Unmarshal(block.ToolInput, &input)
-				}
-				content = append(content, anthropic.NewToolUseBlock(block.ToolUseID, input, block.ToolName))
-			case ContentTypeToolResult:
-				content = append(content, anthropic.NewToolResultBlock(block.ToolResultForUseID, block.ToolContent, block.IsError))
-			}
-		}
-
-		if len(content) == 0 {
-			continue
-		}
+	return toMessageParams(sessionMessages, toolOutputLimit), nil
+}
 
-		// Check if we can merge with the previous message (same role)
-		if len(messages) > 0 && messages[len(messages)-1].Role == role {
-			// Merge content blocks into the previous message
-			messages[len(messages)-1].Content = append(messages[len(messages)-1].Content, content...)
-		} else {
-			messages = append(messages, anthropic.MessageParam{
-				Role:    role,
-				Content: content,
-			})
-		}
+func (w *runWorker[TTx]) failRun(ctx context.Context, runID uuid.UUID, errorType, errorMessage string) {
+	store := w.client.driver.Store()
+	now := time.Now()
+	if err := store.UpdateRunState(ctx, runID, driver.RunState(RunStateFailed), map[string]any{
+		"error_type":    errorType,
+		"error_message": errorMessage,
+		"finalized_at":  now,
+	}); err != nil {
+		w.client.log().Error("failed to mark run as failed",
+			"run_id", runID,
+			"error", err,
+		)
 	}
-
-	return messages, nil
 }
 
-func (w *runWorker[TTx]) buildTools(ctx context.Context, agent *AgentDefinition) ([]anthropic.ToolUnionParam, error) {
+// buildTools returns the API tool definitions of the agent's tools and
+// delegate agents.
+func (c *Client[TTx]) buildTools(ctx context.Context, agent *AgentDefinition) ([]anthropic.ToolUnionParam, error) {
 	if len(agent.Tools) == 0 && len(agent.AgentIDs) == 0 {
 		return nil, nil
 	}
@@ -283,7 +433,7 @@ func (w *runWorker[TTx]) buildTools(ctx context.Context, agent *AgentDefinition)
 
 	// Add regular tools
 	for _, toolName := range agent.Tools {
-		t := w.client.GetTool(toolName)
+		t := c.GetTool(toolName)
 		if t == nil {
 			continue
 		}
@@ -307,7 +457,7 @@ func (w *runWorker[TTx]) buildTools(ctx context.Context, agent *AgentDefinition)
 
 	// Add agent-as-tool entries
 	for _, delegateID := range agent.AgentIDs {
-		delegateAgent, err := w.client.GetAgentByID(ctx, delegateID)
+		delegateAgent, err := c.GetAgentByID(ctx, delegateID)
 		if err != nil || delegateAgent == nil {
 			continue
 		}
@@ -334,19 +484,53 @@ func (w *runWorker[TTx]) buildTools(ctx context.Context, agent *AgentDefinition)
 	return tools, nil
 }
 
-func (w *runWorker[TTx]) failRun(ctx context.Context, runID uuid.UUID, errorType, errorMessage string) {
-	store := w.client.driver.Store()
-	now := time.Now()
-	if err := store.UpdateRunState(ctx, runID, driver.RunState(RunStateFailed), map[string]any{
-		"error_type":    errorType,
-		"error_message": errorMessage,
-		"finalized_at":  now,
-	}); err != nil {
-		w.client.log().Error("failed to mark run as failed",
-			"run_id", runID,
-			"error", err,
-		)
+// toMessageParams converts stored messages to API messages. Tool outputs are
+// truncated to toolOutputLimit tokens (0 for no limit).
+func toMessageParams(sessionMessages []*driver.Message, toolOutputLimit int) []anthropic.MessageParam {
+	messages := make([]anthropic.MessageParam, 0, len(sessionMessages))
+
+	// Add existing messages from database
+	// IMPORTANT: Claude API requires alternating user/assistant roles.
+	// Consecutive messages with the same role must be merged into one message.
+	for _, msg := range sessionMessages {
+		role := anthropic.MessageParamRoleUser
+		if msg.Role == string(MessageRoleAssistant) {
+			role = anthropic.MessageParamRoleAssistant
+		}
+
+		content := make([]anthropic.ContentBlockParamUnion, 0, len(msg.Content))
+		for _, block := range msg.Content {
+			switch block.Type {
+			case ContentTypeText:
+				content = append(content, anthropic.NewTextBlock(block.Text))
+			case ContentTypeToolUse:
+				var input any
+				if len(block.ToolInput) > 0 {
+					_ = json.Unmarshal(block.ToolInput, &input)
+				}
+				content = append(content, anthropic.NewToolUseBlock(block.ToolUseID, input, block.ToolName))
+			case ContentTypeToolResult:
+				content = append(content, anthropic.NewToolResultBlock(block.ToolResultForUseID, truncateToolOutput(block.ToolContent, toolOutputLimit), block.IsError))
+			}
+		}
+
+		if len(content) == 0 {
+			continue
+		}
+
+		// Check if we can merge with the previous message (same role)
+		if len(messages) > 0 && messages[len(messages)-1].Role == role {
+			// Merge content blocks into the previous message
+			messages[len(messages)-1].Content = append(messages[len(messages)-1].Content, content...)
+		} else {
+			messages = append(messages, anthropic.MessageParam{
+				Role:    role,
+				Content: content,
+			})
+		}
 	}
+
+	return messages
 }
 
 // schemaPropertiesToMap converts tool schema properties to the format expected by Anthropic API
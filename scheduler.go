@@ -0,0 +1,242 @@
+package agentpg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// maxScheduleTicksPerPass bounds how many missed ticks a single schedule with
+// CatchUpAll replays in one scheduler pass. Remaining ticks are replayed on
+// subsequent passes.
+const maxScheduleTicksPerPass = 100
+
+// scheduler fires due schedules by creating runs.
+// It runs only on the leader instance; leadership is tracked by leaderLoop,
+// which also triggers the scheduler as soon as leadership is acquired so that
+// ticks missed during a failover are handled immediately.
+type scheduler[TTx any] struct {
+	client    *Client[TTx]
+	triggerCh chan struct{}
+}
+
+func newScheduler[TTx any](c *Client[TTx]) *scheduler[TTx] {
+	return &scheduler[TTx]{
+		client:    c,
+		triggerCh: make(chan struct{}, 1),
+	}
+}
+
+func (s *scheduler[TTx]) trigger() {
+	select {
+	case s.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler[TTx]) run(ctx context.Context) {
+	ticker := time.NewTicker(s.client.config.ScheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.triggerCh:
+			s.fireDueSchedules(ctx)
+		case <-ticker.C:
+			s.fireDueSchedules(ctx)
+		}
+	}
+}
+
+func (s *scheduler[TTx]) fireDueSchedules(ctx context.Context) {
+	if !s.client.isLeaderInstance() {
+		return
+	}
+
+	log := s.client.log()
+
+	schedules, err := s.client.driver.Store().GetDueSchedules(ctx, 100)
+	if err != nil {
+		log.Error("failed to get due schedules", "error", err)
+		return
+	}
+
+	for _, sched := range schedules {
+		if err := s.fireSchedule(ctx, sched); err != nil {
+			log.Error("failed to fire schedule",
+				"schedule_id", sched.ID,
+				"schedule_name", sched.Name,
+				"error", err,
+			)
+		}
+	}
+}
+
+// fireSchedule handles one due schedule according to its catch-up policy.
+func (s *scheduler[TTx]) fireSchedule(ctx context.Context, sched *driver.Schedule) error {
+	cron, err := parseCron(sched.CronExpression, sched.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression: %w", err)
+	}
+
+	for i := 0; i < maxScheduleTicksPerPass; i++ {
+		now := time.Now()
+		tick := sched.NextRunAt
+		following := cron.next(tick)
+
+		fire := true
+		next := following
+		// A tick is missed when a later tick has already elapsed
+		if !following.After(now) {
+			switch CatchUpPolicy(sched.CatchUpPolicy) {
+			case CatchUpSkip:
+				fire = false
+				next = cron.next(now)
+			case CatchUpAll:
+				// Fire this tick and leave next at the following (also due) tick
+			default:
+				next = cron.next(now)
+			}
+		}
+		if next.IsZero() {
+			return fmt.Errorf("cron expression %q has no future activation", sched.CronExpression)
+		}
+
+		advanced, err := s.advance(ctx, sched, tick, next, fire)
+		if err != nil {
+			return err
+		}
+		if !advanced {
+			// Another instance fired this tick, or the schedule was paused
+			return nil
+		}
+
+		if !fire {
+			s.client.log().Info("skipped missed schedule ticks",
+				"schedule_id", sched.ID,
+				"schedule_name", sched.Name,
+				"missed_tick", tick,
+				"next_run_at", next,
+			)
+		}
+
+		sched.NextRunAt = next
+		if next.After(now) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// advance moves the schedule from tick to next in a single transaction,
+// creating the session (if needed) and run for the tick when fire is true.
+// Returns false without creating anything if the tick was already handled.
+func (s *scheduler[TTx]) advance(ctx context.Context, sched *driver.Schedule, tick, next time.Time, fire bool) (bool, error) {
+	drv := s.client.driver
+	store := drv.Store()
+
+	tx, err := drv.BeginTx(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = drv.RollbackTx(ctx, tx)
+		}
+	}()
+
+	params := driver.AdvanceScheduleParams{
+		ID:                sched.ID,
+		ExpectedNextRunAt: tick,
+		NextRunAt:         next,
+	}
+
+	var runID uuid.UUID
+	if fire {
+		sessionID, created, err := s.sessionForTick(ctx, tx, sched)
+		if err != nil {
+			return false, err
+		}
+		if created && SessionPolicy(sched.SessionPolicy) == SessionPolicyReuse {
+			params.SessionID = &sessionID
+		}
+
+		variables := make(map[string]any, len(sched.Variables)+2)
+		for k, v := range sched.Variables {
+			variables[k] = v
+		}
+		variables["schedule_id"] = sched.ID.String()
+		variables["scheduled_at"] = tick.UTC().Format(time.RFC3339)
+
+		run, err := store.CreateRunTx(ctx, tx, driver.CreateRunParams{
+			SessionID:           sessionID,
+			AgentID:             sched.AgentID,
+			Prompt:              sched.Prompt,
+			RunMode:             sched.RunMode,
+			Depth:               0,
+			CreatedByInstanceID: s.client.instanceID,
+			Metadata:            variables,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to create run: %w", err)
+		}
+		runID = run.ID
+		params.RunID = &runID
+	}
+
+	advanced, err := store.AdvanceScheduleTx(ctx, tx, params)
+	if err != nil {
+		return false, err
+	}
+	if !advanced {
+		return false, nil
+	}
+
+	if err := drv.CommitTx(ctx, tx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	committed = true
+
+	if fire {
+		s.client.log().Info("fired schedule",
+			"schedule_id", sched.ID,
+			"schedule_name", sched.Name,
+			"run_id", runID,
+			"scheduled_at", tick,
+			"next_run_at", next,
+		)
+		if params.SessionID != nil {
+			sched.SessionID = params.SessionID
+		}
+	}
+
+	return true, nil
+}
+
+// sessionForTick returns the session for a firing, creating one when the
+// policy requires it. created reports whether a new session was created.
+func (s *scheduler[TTx]) sessionForTick(ctx context.Context, tx TTx, sched *driver.Schedule) (id uuid.UUID, created bool, err error) {
+	if SessionPolicy(sched.SessionPolicy) == SessionPolicyReuse && sched.SessionID != nil {
+		return *sched.SessionID, false, nil
+	}
+
+	metadata := make(map[string]any, len(sched.SessionMetadata))
+	for k, v := range sched.SessionMetadata {
+		metadata[k] = v
+	}
+
+	session, err := s.client.driver.Store().CreateSessionTx(ctx, tx, driver.CreateSessionParams{
+		Metadata: metadata,
+	})
+	if err != nil {
+		return uuid.Nil, false, fmt.Errorf("failed to create session: %w", err)
+	}
+	return session.ID, true, nil
+}
@@ -0,0 +1,780 @@
+package agentpg
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// Session export format.
+//
+// An export is a JSON Lines document: a header line followed by one record
+// per line. Records carry the public types (Session, AgentDefinition, Run,
+// Iteration, ToolExecution, Message, CompactionEvent) in their JSON encoding:
+//
+//	{"format":"agentpg.session","version":1,"exported_at":"...","session_id":"..."}
+//	{"type":"session","data":{...}}
+//	{"type":"agent","data":{...}}
+//	{"type":"run","data":{...}}
+//	...
+//	{"type":"archived_message","data":{"compaction_event_id":"...","archived_at":"...","message":{...}}}
+const (
+	SessionExportFormat  = "agentpg.session"
+	SessionExportVersion = 1
+)
+
+// Record types of a session export.
+const (
+	exportRecordSession         = "session"
+	exportRecordAgent           = "agent"
+	exportRecordRun             = "run"
+	exportRecordIteration       = "iteration"
+	exportRecordToolExecution   = "tool_execution"
+	exportRecordMessage         = "message"
+	exportRecordCompactionEvent = "compaction_event"
+	exportRecordArchivedMessage = "archived_message"
+)
+
+// exportAll is the limit passed to store reads that must return every row.
+const exportAll = math.MaxInt32
+
+// importedRunError is recorded on runs that were still in progress when
+// their session was exported.
+const importedRunError = "run was in progress when the session was exported"
+
+type sessionExportHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	SessionID  uuid.UUID `json:"session_id"`
+}
+
+type sessionExportRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// exportedArchivedMessage is a message removed by a compaction.
+type exportedArchivedMessage struct {
+	CompactionEventID *uuid.UUID `json:"compaction_event_id,omitempty"`
+	ArchivedAt        time.Time  `json:"archived_at"`
+	Message           *Message   `json:"message"`
+}
+
+// ExportSession writes a session to w in the portable session export format:
+// the session, the agents its runs use, and all of its runs, iterations,
+// tool executions, messages, compaction events and archived messages.
+//
+// The export is read with several queries, so export a session while none
+// of its runs is in progress to get a consistent snapshot.
+func (c *Client[TTx]) ExportSession(ctx context.Context, sessionID uuid.UUID, w io.Writer) error {
+	store := c.driver.Store()
+	session, err := store.GetSession(ctx, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get session: %w", err)
+	}
+	if session == nil {
+		return ErrSessionNotFound
+	}
+
+	runs, err := store.GetRunsBySession(ctx, sessionID, exportAll)
+	if err != nil {
+		return fmt.Errorf("failed to get runs: %w", err)
+	}
+	sortRunsParentsFirst(runs)
+
+	var iterations []*driver.Iteration
+	var toolExecutions []*driver.ToolExecution
+	var agentIDs []uuid.UUID
+	for _, run := range runs {
+		agentIDs = append(agentIDs, run.AgentID)
+		iters, err := store.GetIterationsByRun(ctx, run.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get iterations of run %s: %w", run.ID, err)
+		}
+		iterations = append(iterations, iters...)
+		execs, err := store.GetToolExecutionsByRun(ctx, run.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get tool executions of run %s: %w", run.ID, err)
+		}
+		for _, exec := range execs {
+			if exec.AgentID != nil {
+				agentIDs = append(agentIDs, *exec.AgentID)
+			}
+		}
+		toolExecutions = append(toolExecutions, execs...)
+	}
+
+	// Export the agents the runs used along with the agents they can
+	// delegate to, so the importer can recreate them
+	var agents []*driver.AgentDefinition
+	seen := make(map[uuid.UUID]bool)
+	for len(agentIDs) > 0 {
+		id := agentIDs[0]
+		agentIDs = agentIDs[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		agent, err := store.GetAgent(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to get agent %s: %w", id, err)
+		}
+		if agent == nil {
+			continue
+		}
+		agents = append(agents, agent)
+		agentIDs = append(agentIDs, agent.AgentIDs...)
+	}
+
+	messages, err := store.GetMessages(ctx, sessionID, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get messages: %w", err)
+	}
+	events, err := store.GetCompactionEvents(ctx, sessionID, exportAll)
+	if err != nil {
+		return fmt.Errorf("failed to get compaction events: %w", err)
+	}
+	slices.Reverse(events)
+	archived, err := store.GetArchivedMessages(ctx, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get archived messages: %w", err)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(sessionExportHeader{
+		Format:     SessionExportFormat,
+		Version:    SessionExportVersion,
+		ExportedAt: time.Now(),
+		SessionID:  sessionID,
+	}); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	write := func(recordType string, data any) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s record: %w", recordType, err)
+		}
+		if err := enc.Encode(sessionExportRecord{Type: recordType, Data: raw}); err != nil {
+			return fmt.Errorf("failed to write export: %w", err)
+		}
+		return nil
+	}
+
+	if err := write(exportRecordSession, convertSession(session)); err != nil {
+		return err
+	}
+	for _, agent := range agents {
+		if err := write(exportRecordAgent, convertDriverAgent(agent)); err != nil {
+			return err
+		}
+	}
+	for _, run := range runs {
+		if err := write(exportRecordRun, convertRun(run)); err != nil {
+			return err
+		}
+	}
+	for _, iter := range iterations {
+		if err := write(exportRecordIteration, convertIteration(iter)); err != nil {
+			return err
+		}
+	}
+	for _, exec := range toolExecutions {
+		if err := write(exportRecordToolExecution, convertToolExecution(exec)); err != nil {
+			return err
+		}
+	}
+	for _, msg := range messages {
+		if err := write(exportRecordMessage, convertMessage(msg)); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		if err := write(exportRecordCompactionEvent, convertCompactionEvent(event)); err != nil {
+			return err
+		}
+	}
+	for _, a := range archived {
+		msg, err := decodeArchivedMessage(a)
+		if err != nil {
+			return err
+		}
+		if err := write(exportRecordArchivedMessage, exportedArchivedMessage{
+			CompactionEventID: a.CompactionEventID,
+			ArchivedAt:        a.ArchivedAt,
+			Message:           convertMessage(msg),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportSession reads a session written by ExportSession and stores it as a
+// new root session. Every session, run, iteration, tool execution, message
+// and compaction event gets a new ID, with references between them
+// re-mapped, so an export can be imported any number of times, into the
+// same database or another one.
+//
+// Agents are matched by ID, then by name and metadata; agents that exist
+// under neither are created from their exported definitions. Runs and tool
+// executions that were still in progress are imported as cancelled and
+// skipped, so no worker picks them up. Returns the ID of the new session,
+// or an error wrapping ErrInvalidExport if r is not a valid export.
+func (c *Client[TTx]) ImportSession(ctx context.Context, r io.Reader) (uuid.UUID, error) {
+	c.mu.RLock()
+	started := c.started
+	c.mu.RUnlock()
+
+	if !started {
+		return uuid.Nil, ErrClientNotStarted
+	}
+
+	export, err := readSessionExport(r)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	agentIDs, err := c.resolveImportedAgents(ctx, export.agents)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	params, err := export.remap(agentIDs, time.Now())
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := c.driver.Store().ImportSession(ctx, params); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to import session: %w", err)
+	}
+	return params.Session.ID, nil
+}
+
+// sessionExport holds the decoded records of a session export.
+type sessionExport struct {
+	session          *Session
+	agents           []*AgentDefinition
+	runs             []*Run
+	iterations       []*Iteration
+	toolExecutions   []*ToolExecution
+	messages         []*Message
+	compactionEvents []*CompactionEvent
+	archivedMessages []*exportedArchivedMessage
+}
+
+func readSessionExport(r io.Reader) (*sessionExport, error) {
+	dec := json.NewDecoder(r)
+	var header sessionExportHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("%w: failed to read header: %v", ErrInvalidExport, err)
+	}
+	if header.Format != SessionExportFormat {
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidExport, header.Format)
+	}
+	if header.Version != SessionExportVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidExport, header.Version)
+	}
+
+	export := &sessionExport{}
+	for {
+		var record sessionExportRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read record: %v", ErrInvalidExport, err)
+		}
+
+		var target any
+		switch record.Type {
+		case exportRecordSession:
+			if export.session != nil {
+				return nil, fmt.Errorf("%w: more than one session record", ErrInvalidExport)
+			}
+			export.session = &Session{}
+			target = export.session
+		case exportRecordAgent:
+			target = appendRecord(&export.agents)
+		case exportRecordRun:
+			target = appendRecord(&export.runs)
+		case exportRecordIteration:
+			target = appendRecord(&export.iterations)
+		case exportRecordToolExecution:
+			target = appendRecord(&export.toolExecutions)
+		case exportRecordMessage:
+			target = appendRecord(&export.messages)
+		case exportRecordCompactionEvent:
+			target = appendRecord(&export.compactionEvents)
+		case exportRecordArchivedMessage:
+			target = appendRecord(&export.archivedMessages)
+		default:
+			return nil, fmt.Errorf("%w: unknown record type %q", ErrInvalidExport, record.Type)
+		}
+		if err := json.Unmarshal(record.Data, target); err != nil {
+			return nil, fmt.Errorf("%w: failed to decode %s record: %v", ErrInvalidExport, record.Type, err)
+		}
+	}
+
+	if export.session == nil {
+		return nil, fmt.Errorf("%w: missing session record", ErrInvalidExport)
+	}
+	for _, a := range export.archivedMessages {
+		if a.Message == nil {
+			return nil, fmt.Errorf("%w: archived message record without message", ErrInvalidExport)
+		}
+	}
+	return export, nil
+}
+
+// appendRecord appends a new zero value to records and returns it.
+func appendRecord[T any](records *[]*T) *T {
+	v := new(T)
+	*records = append(*records, v)
+	return v
+}
+
+// resolveImportedAgents maps the exported agent IDs to agents of this
+// database, creating the agents that do not exist.
+func (c *Client[TTx]) resolveImportedAgents(ctx context.Context, agents []*AgentDefinition) (map[uuid.UUID]uuid.UUID, error) {
+	store := c.driver.Store()
+	ids := make(map[uuid.UUID]uuid.UUID, len(agents))
+	var created []*AgentDefinition
+	for _, def := range agents {
+		existing, err := store.GetAgent(ctx, def.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get agent %s: %w", def.ID, err)
+		}
+		if existing == nil {
+			existing, err = store.GetAgentByName(ctx, def.Name, def.Metadata)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get agent %q: %w", def.Name, err)
+			}
+		}
+		if existing != nil {
+			ids[def.ID] = existing.ID
+			continue
+		}
+
+		// Delegate agents are linked once every agent has been resolved
+		agent := *def
+		agent.AgentIDs = nil
+		agent.ID = uuid.Nil
+		newAgent, err := c.CreateAgent(ctx, &agent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create agent %q: %w", def.Name, err)
+		}
+		ids[def.ID] = newAgent.ID
+		if len(def.AgentIDs) > 0 {
+			newAgent.AgentIDs = def.AgentIDs
+			created = append(created, newAgent)
+		}
+	}
+
+	for _, agent := range created {
+		var agentIDs []uuid.UUID
+		for _, id := range agent.AgentIDs {
+			if newID, ok := ids[id]; ok {
+				agentIDs = append(agentIDs, newID)
+			}
+		}
+		agent.AgentIDs = agentIDs
+		if err := c.UpdateAgent(ctx, agent); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// remap converts the export to store rows with new IDs. agentIDs maps the
+// exported agent IDs to existing agents.
+func (e *sessionExport) remap(agentIDs map[uuid.UUID]uuid.UUID, now time.Time) (driver.ImportSessionParams, error) {
+	// Allocate new IDs for every exported row first, so references can be
+	// re-mapped regardless of record order
+	ids := make(map[uuid.UUID]uuid.UUID)
+	alloc := func(id uuid.UUID) {
+		ids[id] = uuid.New()
+	}
+	for _, run := range e.runs {
+		alloc(run.ID)
+	}
+	for _, iter := range e.iterations {
+		alloc(iter.ID)
+	}
+	for _, exec := range e.toolExecutions {
+		alloc(exec.ID)
+	}
+	for _, msg := range e.messages {
+		alloc(msg.ID)
+	}
+	for _, event := range e.compactionEvents {
+		alloc(event.ID)
+	}
+	for _, a := range e.archivedMessages {
+		alloc(a.Message.ID)
+	}
+
+	// ref re-maps an optional reference, dropping references to rows that
+	// are not part of the export
+	ref := func(id *uuid.UUID) *uuid.UUID {
+		if id == nil {
+			return nil
+		}
+		newID, ok := ids[*id]
+		if !ok {
+			return nil
+		}
+		return &newID
+	}
+	refs := func(list []uuid.UUID) []uuid.UUID {
+		var result []uuid.UUID
+		for _, id := range list {
+			if newID, ok := ids[id]; ok {
+				result = append(result, newID)
+			}
+		}
+		return result
+	}
+	required := func(kind string, id uuid.UUID) (uuid.UUID, error) {
+		newID, ok := ids[id]
+		if !ok {
+			return uuid.Nil, fmt.Errorf("%w: %s %s not found", ErrInvalidExport, kind, id)
+		}
+		return newID, nil
+	}
+	agent := func(id uuid.UUID) (uuid.UUID, error) {
+		newID, ok := agentIDs[id]
+		if !ok {
+			return uuid.Nil, fmt.Errorf("%w: agent %s not found", ErrInvalidExport, id)
+		}
+		return newID, nil
+	}
+
+	// The imported session is a root session: its parent and fork point
+	// belong to the source database
+	session := &driver.Session{
+		ID:              uuid.New(),
+		Metadata:        e.session.Metadata,
+		CompactionCount: e.session.CompactionCount,
+		CreatedAt:       e.session.CreatedAt,
+		UpdatedAt:       e.session.UpdatedAt,
+	}
+	params := driver.ImportSessionParams{Session: session}
+
+	runs := slices.Clone(e.runs)
+	slices.SortStableFunc(runs, func(a, b *Run) int {
+		return cmp.Or(cmp.Compare(a.Depth, b.Depth), a.CreatedAt.Compare(b.CreatedAt))
+	})
+	for _, r := range runs {
+		run := toDriverRun(r)
+		run.ID = ids[r.ID]
+		run.SessionID = session.ID
+		var err error
+		if run.AgentID, err = agent(r.AgentID); err != nil {
+			return params, err
+		}
+		if r.ParentRunID != nil {
+			parentID, err := required("run", *r.ParentRunID)
+			if err != nil {
+				return params, err
+			}
+			run.ParentRunID = &parentID
+		}
+		run.ParentToolExecutionID = ref(r.ParentToolExecutionID)
+		run.CurrentIterationID = ref(r.CurrentIterationID)
+		run.ClaimedByInstanceID = nil
+		run.ClaimedAt = nil
+		// Idempotency keys stay with the original run
+		run.IdempotencyKey = nil
+		if !r.State.IsTerminal() {
+			previous := run.State
+			errorMessage := importedRunError
+			run.PreviousState = &previous
+			run.State = string(RunStateCancelled)
+			run.ErrorMessage = &errorMessage
+			run.FinalizedAt = &now
+		}
+		params.Runs = append(params.Runs, run)
+	}
+
+	for _, m := range e.messages {
+		msg := toDriverMessage(m)
+		msg.ID = ids[m.ID]
+		msg.SessionID = session.ID
+		msg.RunID = ref(m.RunID)
+		params.Messages = append(params.Messages, msg)
+	}
+
+	for _, i := range e.iterations {
+		iter := toDriverIteration(i)
+		iter.ID = ids[i.ID]
+		var err error
+		if iter.RunID, err = required("run", i.RunID); err != nil {
+			return params, err
+		}
+		iter.RequestMessageIDs = refs(i.RequestMessageIDs)
+		iter.ResponseMessageID = ref(i.ResponseMessageID)
+		params.Iterations = append(params.Iterations, iter)
+	}
+
+	for _, x := range e.toolExecutions {
+		exec := toDriverToolExecution(x)
+		exec.ID = ids[x.ID]
+		var err error
+		if exec.RunID, err = required("run", x.RunID); err != nil {
+			return params, err
+		}
+		if exec.IterationID, err = required("iteration", x.IterationID); err != nil {
+			return params, err
+		}
+		if x.AgentID != nil {
+			agentID, err := agent(*x.AgentID)
+			if err != nil {
+				return params, err
+			}
+			exec.AgentID = &agentID
+		}
+		exec.ChildRunID = ref(x.ChildRunID)
+		exec.ClaimedByInstanceID = nil
+		exec.ClaimedAt = nil
+		if !x.State.IsTerminal() {
+			exec.State = string(ToolStateSkipped)
+			exec.CompletedAt = &now
+		}
+		params.ToolExecutions = append(params.ToolExecutions, exec)
+	}
+
+	for _, ev := range e.compactionEvents {
+		event := toDriverCompactionEvent(ev)
+		event.ID = ids[ev.ID]
+		event.SessionID = session.ID
+		event.PreservedMessageIDs = refs(ev.PreservedMessageIDs)
+		event.SummaryMessageID = ref(ev.SummaryMessageID)
+		params.CompactionEvents = append(params.CompactionEvents, event)
+	}
+
+	for _, a := range e.archivedMessages {
+		msg := toDriverMessage(a.Message)
+		msg.ID = ids[a.Message.ID]
+		msg.SessionID = session.ID
+		msg.RunID = ref(a.Message.RunID)
+		eventID := ref(a.CompactionEventID)
+		if eventID == nil {
+			return params, fmt.Errorf("%w: archived message %s has no compaction event", ErrInvalidExport, a.Message.ID)
+		}
+		original, err := encodeArchivedMessage(msg)
+		if err != nil {
+			return params, err
+		}
+		params.ArchivedMessages = append(params.ArchivedMessages, &driver.ArchivedMessage{
+			ID:                msg.ID,
+			CompactionEventID: eventID,
+			SessionID:         session.ID,
+			OriginalMessage:   original,
+			ArchivedAt:        a.ArchivedAt,
+		})
+	}
+
+	return params, nil
+}
+
+// sortRunsParentsFirst orders runs by depth, then by creation time.
+func sortRunsParentsFirst(runs []*driver.Run) {
+	slices.SortStableFunc(runs, func(a, b *driver.Run) int {
+		return cmp.Or(cmp.Compare(a.Depth, b.Depth), a.CreatedAt.Compare(b.CreatedAt))
+	})
+}
+
+// decodeArchivedMessage decodes the original message of an archive entry,
+// which the drivers store as the JSON encoding of a driver.Message.
+func decodeArchivedMessage(a *driver.ArchivedMessage) (*driver.Message, error) {
+	data, err := json.Marshal(a.OriginalMessage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode archived message %s: %w", a.ID, err)
+	}
+	var msg driver.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("failed to decode archived message %s: %w", a.ID, err)
+	}
+	msg.ID = a.ID
+	msg.SessionID = a.SessionID
+	return &msg, nil
+}
+
+func encodeArchivedMessage(msg *driver.Message) (map[string]any, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode archived message %s: %w", msg.ID, err)
+	}
+	var original map[string]any
+	if err := json.Unmarshal(data, &original); err != nil {
+		return nil, fmt.Errorf("failed to encode archived message %s: %w", msg.ID, err)
+	}
+	return original, nil
+}
+
+func toDriverRun(r *Run) *driver.Run {
+	return &driver.Run{
+		ID:                       r.ID,
+		SessionID:                r.SessionID,
+		AgentID:                  r.AgentID,
+		RunMode:                  string(r.RunMode),
+		ParentRunID:              r.ParentRunID,
+		ParentToolExecutionID:    r.ParentToolExecutionID,
+		Depth:                    r.Depth,
+		State:                    string(r.State),
+		PreviousState:            (*string)(r.PreviousState),
+		Prompt:                   r.Prompt,
+		CurrentIteration:         r.CurrentIteration,
+		CurrentIterationID:       r.CurrentIterationID,
+		ResponseText:             r.ResponseText,
+		StopReason:               r.StopReason,
+		InputTokens:              r.InputTokens,
+		OutputTokens:             r.OutputTokens,
+		CacheCreationInputTokens: r.CacheCreationInputTokens,
+		CacheReadInputTokens:     r.CacheReadInputTokens,
+		IterationCount:           r.IterationCount,
+		ToolIterations:           r.ToolIterations,
+		ErrorMessage:             r.ErrorMessage,
+		ErrorType:                r.ErrorType,
+		CreatedByInstanceID:      r.CreatedByInstanceID,
+		ClaimedByInstanceID:      r.ClaimedByInstanceID,
+		ClaimedAt:                r.ClaimedAt,
+		Metadata:                 r.Metadata,
+		CreatedAt:                r.CreatedAt,
+		StartedAt:                r.StartedAt,
+		FinalizedAt:              r.FinalizedAt,
+		RescueAttempts:           r.RescueAttempts,
+		LastRescueAt:             r.LastRescueAt,
+		IdempotencyKey:           r.IdempotencyKey,
+		ScheduledAt:              r.ScheduledAt,
+	}
+}
+
+func toDriverIteration(i *Iteration) *driver.Iteration {
+	var attempts []driver.APIAttempt
+	for _, a := range i.APIAttempts {
+		attempts = append(attempts, driver.APIAttempt(a))
+	}
+	return &driver.Iteration{
+		ID:                       i.ID,
+		RunID:                    i.RunID,
+		IterationNumber:          i.IterationNumber,
+		IsStreaming:              i.IsStreaming,
+		BatchID:                  i.BatchID,
+		BatchRequestID:           i.BatchRequestID,
+		BatchStatus:              (*string)(i.BatchStatus),
+		BatchSubmittedAt:         i.BatchSubmittedAt,
+		BatchCompletedAt:         i.BatchCompletedAt,
+		BatchExpiresAt:           i.BatchExpiresAt,
+		BatchPollCount:           i.BatchPollCount,
+		BatchLastPollAt:          i.BatchLastPollAt,
+		BatchNextPollAt:          i.BatchNextPollAt,
+		StreamingStartedAt:       i.StreamingStartedAt,
+		StreamingCompletedAt:     i.StreamingCompletedAt,
+		TriggerType:              i.TriggerType,
+		RequestMessageIDs:        i.RequestMessageIDs,
+		StopReason:               i.StopReason,
+		ResponseMessageID:        i.ResponseMessageID,
+		HasToolUse:               i.HasToolUse,
+		ToolExecutionCount:       i.ToolExecutionCount,
+		InputTokens:              i.InputTokens,
+		OutputTokens:             i.OutputTokens,
+		CacheCreationInputTokens: i.CacheCreationInputTokens,
+		CacheReadInputTokens:     i.CacheReadInputTokens,
+		ErrorMessage:             i.ErrorMessage,
+		ErrorType:                i.ErrorType,
+		CreatedAt:                i.CreatedAt,
+		StartedAt:                i.StartedAt,
+		CompletedAt:              i.CompletedAt,
+		APIAttempts:              attempts,
+		Model:                    i.Model,
+	}
+}
+
+func toDriverToolExecution(e *ToolExecution) *driver.ToolExecution {
+	return &driver.ToolExecution{
+		ID:                  e.ID,
+		RunID:               e.RunID,
+		IterationID:         e.IterationID,
+		State:               string(e.State),
+		ToolUseID:           e.ToolUseID,
+		ToolName:            e.ToolName,
+		ToolInput:           e.ToolInput,
+		IsAgentTool:         e.IsAgentTool,
+		AgentID:             e.AgentID,
+		ChildRunID:          e.ChildRunID,
+		ToolOutput:          e.ToolOutput,
+		IsError:             e.IsError,
+		ErrorMessage:        e.ErrorMessage,
+		ClaimedByInstanceID: e.ClaimedByInstanceID,
+		ClaimedAt:           e.ClaimedAt,
+		AttemptCount:        e.AttemptCount,
+		MaxAttempts:         e.MaxAttempts,
+		ScheduledAt:         e.ScheduledAt,
+		SnoozeCount:         e.SnoozeCount,
+		LastError:           e.LastError,
+		CreatedAt:           e.CreatedAt,
+		StartedAt:           e.StartedAt,
+		CompletedAt:         e.CompletedAt,
+	}
+}
+
+func toDriverMessage(m *Message) *driver.Message {
+	content := make([]driver.ContentBlock, len(m.Content))
+	for i, c := range m.Content {
+		content[i] = driver.ContentBlock{
+			Type:               c.Type,
+			Text:               c.Text,
+			ToolUseID:          c.ToolUseID,
+			ToolName:           c.ToolName,
+			ToolInput:          c.ToolInput,
+			ToolResultForUseID: c.ToolResultForUseID,
+			ToolContent:        c.ToolContent,
+			IsError:            c.IsError,
+			Source:             c.Source,
+			SearchResults:      c.SearchResults,
+			Metadata:           c.Metadata,
+		}
+	}
+	return &driver.Message{
+		ID:          m.ID,
+		SessionID:   m.SessionID,
+		RunID:       m.RunID,
+		Role:        string(m.Role),
+		Content:     content,
+		Usage:       driver.Usage(m.Usage),
+		IsPreserved: m.IsPreserved,
+		IsSummary:   m.IsSummary,
+		Metadata:    m.Metadata,
+		CreatedAt:   m.CreatedAt,
+		UpdatedAt:   m.UpdatedAt,
+	}
+}
+
+func toDriverCompactionEvent(e *CompactionEvent) *driver.CompactionEvent {
+	return &driver.CompactionEvent{
+		ID:                  e.ID,
+		SessionID:           e.SessionID,
+		Strategy:            e.Strategy,
+		OriginalTokens:      e.OriginalTokens,
+		CompactedTokens:     e.CompactedTokens,
+		MessagesRemoved:     e.MessagesRemoved,
+		SummaryContent:      e.SummaryContent,
+		PreservedMessageIDs: e.PreservedMessageIDs,
+		ModelUsed:           e.ModelUsed,
+		DurationMS:          e.DurationMS,
+		SummaryMessageID:    e.SummaryMessageID,
+		RestoredAt:          e.RestoredAt,
+		CreatedAt:           e.CreatedAt,
+	}
+}
@@ -0,0 +1,11 @@
+-- =============================================================================
+-- AGENTPG SCHEDULES - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 002_agentpg_migration.up.sql
+-- =============================================================================
+
+DROP TABLE IF EXISTS agentpg_schedules;
+
+DROP TYPE IF EXISTS agentpg_schedule_catch_up;
+
+DROP TYPE IF EXISTS agentpg_schedule_session_policy;
@@ -0,0 +1,128 @@
+-- =============================================================================
+-- AGENTPG SCHEDULES
+-- =============================================================================
+-- Recurring agent runs driven by cron expressions.
+--
+-- Schedules are fired by the elected leader only. Each firing advances
+-- next_run_at with a compare-and-swap in the same transaction that creates
+-- the run, so a tick produces exactly one run even if two instances briefly
+-- believe they are leader (e.g. during a rolling deploy).
+-- =============================================================================
+
+-- -----------------------------------------------------------------------------
+-- Session Policy
+-- -----------------------------------------------------------------------------
+-- How a schedule chooses the session for each run.
+-- - new: Create a fresh session for every firing
+-- - reuse: Create one session on first firing and reuse it afterwards
+-- -----------------------------------------------------------------------------
+CREATE TYPE agentpg_schedule_session_policy AS ENUM(
+    'new',                  -- Fresh session per firing
+    'reuse'                 -- One long-lived session for all firings
+);
+
+-- -----------------------------------------------------------------------------
+-- Catch-Up Policy
+-- -----------------------------------------------------------------------------
+-- What to do with ticks missed while no leader was running.
+-- - skip: Drop missed ticks, only fire when the due tick is the latest one
+-- - once: Fire a single run for all missed ticks
+-- - all: Fire one run per missed tick
+-- -----------------------------------------------------------------------------
+CREATE TYPE agentpg_schedule_catch_up AS ENUM(
+    'skip',                 -- Drop missed ticks
+    'once',                 -- Coalesce missed ticks into one run
+    'all'                   -- Replay every missed tick
+);
+
+-- =============================================================================
+-- TABLE: agentpg_schedules
+-- =============================================================================
+CREATE TABLE agentpg_schedules (
+    -- Primary key
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+
+-- Unique schedule name (re-registering the same name updates the schedule)
+name TEXT NOT NULL,
+
+-- Agent to run on each tick
+agent_id UUID NOT NULL REFERENCES agentpg_agents (id) ON DELETE CASCADE,
+
+-- ==========================================================================
+-- TIMING
+-- ==========================================================================
+
+-- Five-field cron expression or @descriptor (e.g., "0 * * * *", "@daily")
+cron_expression TEXT NOT NULL,
+
+-- IANA time zone the cron expression is evaluated in
+timezone TEXT NOT NULL DEFAULT 'UTC',
+
+-- Missed tick handling
+catch_up_policy agentpg_schedule_catch_up NOT NULL DEFAULT 'once',
+
+-- Paused schedules are never fired
+paused BOOLEAN NOT NULL DEFAULT FALSE,
+
+-- Next tick to fire (compare-and-swap target for exactly-once firing)
+next_run_at TIMESTAMPTZ NOT NULL,
+
+-- ==========================================================================
+-- RUN TEMPLATE
+-- ==========================================================================
+
+-- Prompt sent to the agent on each tick
+prompt TEXT NOT NULL,
+
+-- Variables passed to tools via run metadata
+variables JSONB NOT NULL DEFAULT '{}',
+
+-- API mode for created runs
+run_mode agentpg_run_mode NOT NULL DEFAULT 'batch',
+
+-- Session selection
+session_policy agentpg_schedule_session_policy NOT NULL DEFAULT 'new',
+
+-- Session used by the 'reuse' policy (created lazily on first firing)
+session_id UUID REFERENCES agentpg_sessions (id) ON DELETE SET NULL,
+
+-- Metadata for sessions created by this schedule
+session_metadata JSONB NOT NULL DEFAULT '{}',
+
+-- ==========================================================================
+-- FIRING HISTORY
+-- ==========================================================================
+last_run_at TIMESTAMPTZ,
+last_run_id UUID REFERENCES agentpg_runs (id) ON DELETE SET NULL,
+fire_count BIGINT NOT NULL DEFAULT 0,
+
+-- Flexible metadata for multi-tenancy and app-specific organization
+metadata JSONB NOT NULL DEFAULT '{}',
+
+-- Timestamps
+created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+-- Constraints
+CONSTRAINT schedule_name_valid CHECK (char_length(name) > 0 AND char_length(name) < 256),
+CONSTRAINT schedule_unique_name UNIQUE (name)
+);
+
+COMMENT ON TABLE agentpg_schedules IS 'Cron-based recurring agent runs, fired by the elected leader.';
+
+COMMENT ON COLUMN agentpg_schedules.next_run_at IS 'Next tick to fire. Advanced with compare-and-swap in the same transaction that creates the run.';
+
+COMMENT ON COLUMN agentpg_schedules.catch_up_policy IS 'How ticks missed while no leader was running are handled: skip, once, or all.';
+
+COMMENT ON COLUMN agentpg_schedules.session_id IS 'Session reused by every firing when session_policy is reuse.';
+
+-- Index for the leader's due-schedule scan
+CREATE INDEX agentpg_idx_schedules_due ON agentpg_schedules (next_run_at)
+WHERE
+    paused = FALSE;
+
+-- Index for listing schedules by agent
+CREATE INDEX agentpg_idx_schedules_agent ON agentpg_schedules (agent_id);
+
+-- Index for metadata filtering
+CREATE INDEX agentpg_idx_schedules_metadata ON agentpg_schedules USING GIN (metadata);
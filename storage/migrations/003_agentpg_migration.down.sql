@@ -0,0 +1,9 @@
+-- =============================================================================
+-- AGENTPG RUN IDEMPOTENCY KEYS - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 003_agentpg_migration.up.sql
+-- =============================================================================
+
+DROP INDEX IF EXISTS agentpg_idx_runs_idempotency_key;
+
+ALTER TABLE agentpg_runs DROP COLUMN IF EXISTS idempotency_key;
@@ -0,0 +1,20 @@
+-- =============================================================================
+-- AGENTPG RUN IDEMPOTENCY KEYS
+-- =============================================================================
+-- Optional caller-supplied key on run creation. Creating a run with a key that
+-- is already in use in the same session returns the existing run instead of
+-- creating a duplicate. Keys are scoped to the session, so callers in
+-- different sessions cannot collide on, or observe, each other's keys.
+--
+-- Keys are released (set to NULL) once they are older than the client's
+-- retention window, so the unique index only covers keys still in use.
+-- =============================================================================
+
+ALTER TABLE agentpg_runs ADD COLUMN idempotency_key TEXT;
+
+COMMENT ON COLUMN agentpg_runs.idempotency_key IS 'Caller-supplied deduplication key. Unique per session while set; released after the retention window.';
+
+-- Enforces one run per key in a session and serves the lookup on conflict
+CREATE UNIQUE INDEX agentpg_idx_runs_idempotency_key ON agentpg_runs (session_id, idempotency_key)
+WHERE
+    idempotency_key IS NOT NULL;
@@ -0,0 +1,66 @@
+-- =============================================================================
+-- AGENTPG API RETRIES - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 004_agentpg_migration.up.sql
+-- =============================================================================
+
+-- Restore the claim function from 001 (without the scheduled_at filter)
+CREATE OR REPLACE FUNCTION agentpg_claim_runs(
+    p_instance_id TEXT,
+    p_max_count INTEGER DEFAULT 1,
+    p_run_mode agentpg_run_mode DEFAULT NULL
+) RETURNS SETOF agentpg_runs AS $$
+BEGIN
+    RETURN QUERY
+    WITH claimable AS (
+        SELECT r.id
+        FROM agentpg_runs r
+        JOIN agentpg_agents a ON a.id = r.agent_id
+        WHERE r.state = 'pending'
+          AND r.claimed_by_instance_id IS NULL
+          -- Filter by run mode if specified
+          AND (p_run_mode IS NULL OR r.run_mode = p_run_mode)
+          -- Only claim if instance has ALL tools required by this agent
+          -- Agents with no tools (empty array) can be processed by any instance
+          AND (
+              a.tool_names = '{}'
+              OR NOT EXISTS (
+                  -- Find any tool required by agent that instance doesn't have
+                  SELECT 1 FROM unnest(a.tool_names) AS required_tool
+                  WHERE NOT EXISTS (
+                      SELECT 1 FROM agentpg_instance_tools it
+                      WHERE it.instance_id = p_instance_id
+                        AND it.tool_name = required_tool
+                  )
+              )
+          )
+        ORDER BY r.created_at ASC
+        LIMIT p_max_count
+        FOR UPDATE OF r SKIP LOCKED
+    ),
+    claimed AS (
+        UPDATE agentpg_runs r
+        SET claimed_by_instance_id = p_instance_id,
+            claimed_at = NOW(),
+            -- Transition to appropriate state based on run mode
+            state = CASE
+                WHEN r.run_mode = 'batch' THEN 'batch_submitting'::agentpg_run_state
+                WHEN r.run_mode = 'streaming' THEN 'streaming'::agentpg_run_state
+            END,
+            previous_state = 'pending',
+            started_at = COALESCE(started_at, NOW())
+        FROM claimable c
+        WHERE r.id = c.id
+        RETURNING r.*
+    )
+    SELECT * FROM claimed;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_claim_runs IS 'Race-safe run claiming based on tool availability. Instance must have ALL tools required by the agent.';
+
+DROP INDEX IF EXISTS agentpg_idx_runs_pending_scheduled;
+
+ALTER TABLE agentpg_iterations DROP COLUMN IF EXISTS api_attempts;
+
+ALTER TABLE agentpg_runs DROP COLUMN IF EXISTS scheduled_at;
@@ -0,0 +1,11 @@
+-- =============================================================================
+-- AGENTPG MODEL FALLBACK CHAINS - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 005_agentpg_migration.up.sql
+-- =============================================================================
+
+ALTER TABLE agentpg_iterations DROP COLUMN IF EXISTS model;
+
+ALTER TABLE agentpg_agents DROP COLUMN IF EXISTS fallback_latency_budget_ms;
+
+ALTER TABLE agentpg_agents DROP COLUMN IF EXISTS fallback_models;
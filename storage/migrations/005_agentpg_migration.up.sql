@@ -0,0 +1,22 @@
+-- =============================================================================
+-- AGENTPG MODEL FALLBACK CHAINS
+-- =============================================================================
+-- Agents can list fallback models that are used, in order, when the primary
+-- model is overloaded, not found (e.g. retired), or exceeds a latency budget.
+-- The model actually used is recorded on each iteration.
+-- =============================================================================
+
+-- Ordered fallback models tried after the primary model
+ALTER TABLE agentpg_agents ADD COLUMN fallback_models TEXT[] NOT NULL DEFAULT '{}';
+
+-- Streaming only: maximum time to wait for the first event before falling back
+ALTER TABLE agentpg_agents ADD COLUMN fallback_latency_budget_ms INTEGER;
+
+COMMENT ON COLUMN agentpg_agents.fallback_models IS 'Models tried in order when the primary model is overloaded, not found, or exceeds the latency budget.';
+
+COMMENT ON COLUMN agentpg_agents.fallback_latency_budget_ms IS 'Streaming only: milliseconds to wait for the first response event before falling back to the next model. NULL disables the budget.';
+
+-- Model used for the iteration's API call (as reported by the API on success)
+ALTER TABLE agentpg_iterations ADD COLUMN model TEXT;
+
+COMMENT ON COLUMN agentpg_iterations.model IS 'Claude model used for this iteration. Differs from the agent model when a fallback model was used.';
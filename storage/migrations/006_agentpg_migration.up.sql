@@ -0,0 +1,88 @@
+-- =============================================================================
+-- AGENTPG TRANSACTIONAL COMPACTION
+-- =============================================================================
+-- Compaction archives messages, deletes them and inserts the summary in one
+-- transaction that holds the session row lock (FOR UPDATE). Runs are not
+-- claimed while their session is locked, and compaction refuses sessions with
+-- a run in progress, so a run never sends history that is being rewritten.
+--
+-- Compaction events remember their summary message so a compaction can be
+-- restored: the archived messages are reinstated and the summary removed.
+-- =============================================================================
+
+-- Summary message created by the compaction (NULL for prune-only compactions)
+ALTER TABLE agentpg_compaction_events
+    ADD COLUMN summary_message_id UUID REFERENCES agentpg_messages (id) ON DELETE SET NULL;
+
+-- When the compaction was undone
+ALTER TABLE agentpg_compaction_events ADD COLUMN restored_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN agentpg_compaction_events.summary_message_id IS 'Summary message created by this compaction. Deleted when the compaction is restored.';
+
+COMMENT ON COLUMN agentpg_compaction_events.restored_at IS 'When the archived messages were reinstated. NULL while the compaction is in effect.';
+
+-- -----------------------------------------------------------------------------
+-- Claim pending runs (race-safe with SKIP LOCKED)
+-- -----------------------------------------------------------------------------
+-- Same as 004, but also skips runs whose session is locked by a compaction.
+-- FOR KEY SHARE only conflicts with FOR UPDATE, so ordinary session updates
+-- do not hold up claiming.
+-- -----------------------------------------------------------------------------
+CREATE OR REPLACE FUNCTION agentpg_claim_runs(
+    p_instance_id TEXT,
+    p_max_count INTEGER DEFAULT 1,
+    p_run_mode agentpg_run_mode DEFAULT NULL
+) RETURNS SETOF agentpg_runs AS $$
+BEGIN
+    RETURN QUERY
+    WITH claimable AS (
+        SELECT r.id
+        FROM agentpg_runs r
+        JOIN agentpg_agents a ON a.id = r.agent_id
+        JOIN agentpg_sessions s ON s.id = r.session_id
+        WHERE r.state = 'pending'
+          AND r.claimed_by_instance_id IS NULL
+          -- Only claim if scheduled time has passed (for API retry delays)
+          AND r.scheduled_at <= NOW()
+          -- Filter by run mode if specified
+          AND (p_run_mode IS NULL OR r.run_mode = p_run_mode)
+          -- Only claim if instance has ALL tools required by this agent
+          -- Agents with no tools (empty array) can be processed by any instance
+          AND (
+              a.tool_names = '{}'
+              OR NOT EXISTS (
+                  -- Find any tool required by agent that instance doesn't have
+                  SELECT 1 FROM unnest(a.tool_names) AS required_tool
+                  WHERE NOT EXISTS (
+                      SELECT 1 FROM agentpg_instance_tools it
+                      WHERE it.instance_id = p_instance_id
+                        AND it.tool_name = required_tool
+                  )
+              )
+          )
+        ORDER BY r.created_at ASC
+        LIMIT p_max_count
+        FOR UPDATE OF r SKIP LOCKED
+        -- Skip sessions being compacted
+        FOR KEY SHARE OF s SKIP LOCKED
+    ),
+    claimed AS (
+        UPDATE agentpg_runs r
+        SET claimed_by_instance_id = p_instance_id,
+            claimed_at = NOW(),
+            -- Transition to appropriate state based on run mode
+            state = CASE
+                WHEN r.run_mode = 'batch' THEN 'batch_submitting'::agentpg_run_state
+                WHEN r.run_mode = 'streaming' THEN 'streaming'::agentpg_run_state
+            END,
+            previous_state = 'pending',
+            started_at = COALESCE(started_at, NOW())
+        FROM claimable c
+        WHERE r.id = c.id
+        RETURNING r.*
+    )
+    SELECT * FROM claimed;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_claim_runs IS 'Race-safe run claiming based on tool availability. Instance must have ALL tools required by the agent. Respects scheduled_at for API retry delays and skips sessions locked by compaction.';
@@ -0,0 +1,7 @@
+-- =============================================================================
+-- AGENTPG SESSION FORKS - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 007_agentpg_migration.up.sql
+-- =============================================================================
+
+ALTER TABLE agentpg_sessions DROP COLUMN IF EXISTS forked_from_message_id;
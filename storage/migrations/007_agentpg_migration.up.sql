@@ -0,0 +1,14 @@
+-- =============================================================================
+-- AGENTPG SESSION FORKS
+-- =============================================================================
+-- A session can be forked at one of its messages: the fork is a child session
+-- (parent_session_id) holding copies of the messages up to and including the
+-- fork point. forked_from_message_id records that message, which tells forks
+-- apart from other child sessions and lets the UI draw the fork tree.
+-- =============================================================================
+
+-- Message of the parent session the fork was taken at (NULL for ordinary sessions)
+ALTER TABLE agentpg_sessions
+    ADD COLUMN forked_from_message_id UUID REFERENCES agentpg_messages (id) ON DELETE SET NULL;
+
+COMMENT ON COLUMN agentpg_sessions.forked_from_message_id IS 'Message of the parent session this session was forked at. NULL if the session is not a fork or the message was later compacted away.';
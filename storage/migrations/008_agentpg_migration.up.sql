@@ -0,0 +1,42 @@
+-- =============================================================================
+-- AGENTPG BATCH RECOVERY
+-- =============================================================================
+-- A batch cancelled through the API goes through 'canceling' before it ends.
+-- Its iterations keep being polled so the results of the requests that were
+-- still processing (canceled) and of those that had finished are picked up.
+-- =============================================================================
+
+-- -----------------------------------------------------------------------------
+-- Get iterations needing batch polling
+-- -----------------------------------------------------------------------------
+-- Same as 001, but also returns iterations of batches being cancelled.
+-- -----------------------------------------------------------------------------
+CREATE OR REPLACE FUNCTION agentpg_get_iterations_for_poll(
+    p_instance_id TEXT,
+    p_poll_interval INTERVAL DEFAULT '30 seconds',
+    p_max_count INTEGER DEFAULT 10
+) RETURNS SETOF agentpg_iterations AS $$
+BEGIN
+    RETURN QUERY
+    SELECT i.*
+    FROM agentpg_iterations i
+    JOIN agentpg_runs r ON r.id = i.run_id
+    WHERE i.batch_status IN ('in_progress', 'canceling')
+      AND r.claimed_by_instance_id = p_instance_id
+      AND (i.batch_last_poll_at IS NULL
+           OR i.batch_last_poll_at < NOW() - p_poll_interval)
+    ORDER BY i.batch_last_poll_at NULLS FIRST
+    LIMIT p_max_count;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_get_iterations_for_poll IS 'Returns iterations owned by instance that need batch status polling, including batches being cancelled.';
+
+DROP INDEX IF EXISTS agentpg_idx_iterations_polling;
+
+CREATE INDEX agentpg_idx_iterations_polling ON agentpg_iterations (
+    batch_status,
+    batch_last_poll_at NULLS FIRST
+)
+WHERE
+    batch_status IN ('in_progress', 'canceling');
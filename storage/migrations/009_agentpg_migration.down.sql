@@ -0,0 +1,40 @@
+-- =============================================================================
+-- AGENTPG ADAPTIVE BATCH POLLING - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 009_agentpg_migration.up.sql
+-- =============================================================================
+
+DROP INDEX IF EXISTS agentpg_idx_iterations_polling;
+
+CREATE INDEX agentpg_idx_iterations_polling ON agentpg_iterations (
+    batch_status,
+    batch_last_poll_at NULLS FIRST
+)
+WHERE
+    batch_status IN ('in_progress', 'canceling');
+
+DROP FUNCTION IF EXISTS agentpg_get_iterations_for_poll(TEXT, INTEGER);
+
+ALTER TABLE agentpg_iterations DROP COLUMN IF EXISTS batch_next_poll_at;
+
+-- Restore the poll function from 008 (fixed poll interval)
+CREATE FUNCTION agentpg_get_iterations_for_poll(
+    p_instance_id TEXT,
+    p_poll_interval INTERVAL DEFAULT '30 seconds',
+    p_max_count INTEGER DEFAULT 10
+) RETURNS SETOF agentpg_iterations AS $$
+BEGIN
+    RETURN QUERY
+    SELECT i.*
+    FROM agentpg_iterations i
+    JOIN agentpg_runs r ON r.id = i.run_id
+    WHERE i.batch_status IN ('in_progress', 'canceling')
+      AND r.claimed_by_instance_id = p_instance_id
+      AND (i.batch_last_poll_at IS NULL
+           OR i.batch_last_poll_at < NOW() - p_poll_interval)
+    ORDER BY i.batch_last_poll_at NULLS FIRST
+    LIMIT p_max_count;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_get_iterations_for_poll IS 'Returns iterations owned by instance that need batch status polling, including batches being cancelled.';
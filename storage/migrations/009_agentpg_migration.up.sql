@@ -0,0 +1,49 @@
+-- =============================================================================
+-- AGENTPG ADAPTIVE BATCH POLLING
+-- =============================================================================
+-- Each batch is polled on its own schedule instead of a fixed interval: soon
+-- after submission, then less and less often while it keeps processing. The
+-- next poll time is stored on the batch's iterations.
+-- =============================================================================
+
+-- When the batch is next polled (NULL: due now)
+ALTER TABLE agentpg_iterations ADD COLUMN batch_next_poll_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN agentpg_iterations.batch_next_poll_at IS '[Batch only] When the batch is next polled for status. Grows with each poll of a long-running batch. NULL means due now.';
+
+-- -----------------------------------------------------------------------------
+-- Get iterations needing batch polling
+-- -----------------------------------------------------------------------------
+-- Returns the iterations of in-progress or canceling batches of runs claimed
+-- by the instance that are due for a poll, the most overdue first. Replaces
+-- the fixed poll interval parameter of 001/008.
+-- -----------------------------------------------------------------------------
+DROP FUNCTION IF EXISTS agentpg_get_iterations_for_poll(TEXT, INTERVAL, INTEGER);
+
+CREATE FUNCTION agentpg_get_iterations_for_poll(
+    p_instance_id TEXT,
+    p_max_count INTEGER DEFAULT 10
+) RETURNS SETOF agentpg_iterations AS $$
+BEGIN
+    RETURN QUERY
+    SELECT i.*
+    FROM agentpg_iterations i
+    JOIN agentpg_runs r ON r.id = i.run_id
+    WHERE i.batch_status IN ('in_progress', 'canceling')
+      AND r.claimed_by_instance_id = p_instance_id
+      AND (i.batch_next_poll_at IS NULL
+           OR i.batch_next_poll_at <= NOW())
+    ORDER BY i.batch_next_poll_at NULLS FIRST, i.batch_id
+    LIMIT p_max_count;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_get_iterations_for_poll IS 'Returns iterations owned by instance whose batch is due for status polling, including batches being cancelled.';
+
+DROP INDEX IF EXISTS agentpg_idx_iterations_polling;
+
+CREATE INDEX agentpg_idx_iterations_polling ON agentpg_iterations (
+    batch_next_poll_at NULLS FIRST
+)
+WHERE
+    batch_status IN ('in_progress', 'canceling');
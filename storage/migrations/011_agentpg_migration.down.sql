@@ -0,0 +1,132 @@
+-- =============================================================================
+-- AGENTPG FLEET-WIDE CONCURRENCY LIMITS - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 011_agentpg_migration.up.sql
+-- =============================================================================
+
+-- Restore the claim function from 010
+CREATE OR REPLACE FUNCTION agentpg_claim_runs(
+    p_instance_id TEXT,
+    p_max_count INTEGER DEFAULT 1,
+    p_run_mode agentpg_run_mode DEFAULT NULL
+) RETURNS SETOF agentpg_runs AS $$
+BEGIN
+    RETURN QUERY
+    WITH claimable AS (
+        SELECT r.id
+        FROM agentpg_runs r
+        JOIN agentpg_agents a ON a.id = r.agent_id
+        JOIN agentpg_sessions s ON s.id = r.session_id
+        WHERE r.state = 'pending'
+          AND r.claimed_by_instance_id IS NULL
+          -- Only claim if scheduled time has passed (for API retry delays)
+          AND r.scheduled_at <= NOW()
+          -- Filter by run mode if specified
+          AND (p_run_mode IS NULL OR r.run_mode = p_run_mode)
+          -- Only claim if instance has ALL tools required by this agent
+          -- Agents with no tools (empty array) can be processed by any instance
+          AND (
+              a.tool_names = '{}'
+              OR NOT EXISTS (
+                  -- Find any tool required by agent that instance doesn't have
+                  SELECT 1 FROM unnest(a.tool_names) AS required_tool
+                  WHERE NOT EXISTS (
+                      SELECT 1 FROM agentpg_instance_tools it
+                      WHERE it.instance_id = p_instance_id
+                        AND it.tool_name = required_tool
+                  )
+              )
+          )
+        ORDER BY r.created_at ASC
+        LIMIT p_max_count
+        FOR UPDATE OF r SKIP LOCKED
+        -- Skip sessions being compacted
+        FOR KEY SHARE OF s SKIP LOCKED
+    ),
+    claimed AS (
+        UPDATE agentpg_runs r
+        SET claimed_by_instance_id = p_instance_id,
+            claimed_at = NOW(),
+            -- Transition to appropriate state based on run mode
+            state = CASE
+                WHEN r.run_mode = 'batch' THEN 'batch_submitting'::agentpg_run_state
+                WHEN r.run_mode = 'streaming' THEN 'streaming'::agentpg_run_state
+                -- The run worker claims auto runs and hands those it streams
+                -- over to the streaming worker
+                WHEN r.run_mode = 'auto' THEN 'batch_submitting'::agentpg_run_state
+            END,
+            previous_state = 'pending',
+            started_at = COALESCE(started_at, NOW())
+        FROM claimable c
+        WHERE r.id = c.id
+        RETURNING r.*
+    )
+    SELECT * FROM claimed;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_claim_runs IS 'Race-safe run claiming based on tool availability. Instance must have ALL tools required by the agent. Respects scheduled_at for API retry delays and skips sessions locked by compaction. Auto runs are claimed into batch_submitting.';
+
+-- Restore the claim function from 001
+CREATE OR REPLACE FUNCTION agentpg_claim_tool_executions(
+    p_instance_id TEXT,
+    p_max_count INTEGER DEFAULT 10
+) RETURNS SETOF agentpg_tool_executions AS $$
+BEGIN
+    RETURN QUERY
+    WITH claimable AS (
+        SELECT te.id
+        FROM agentpg_tool_executions te
+        LEFT JOIN agentpg_agents a ON te.is_agent_tool = TRUE AND a.id = te.agent_id
+        WHERE te.state = 'pending'
+          AND te.claimed_by_instance_id IS NULL
+          -- Only claim if scheduled time has passed (for retry delays and snoozing)
+          AND te.scheduled_at <= NOW()
+          -- Only claim if instance has capability for this tool
+          AND (
+              -- Regular tools: check instance_tools
+              (te.is_agent_tool = FALSE AND EXISTS (
+                  SELECT 1 FROM agentpg_instance_tools it
+                  WHERE it.instance_id = p_instance_id
+                    AND it.tool_name = te.tool_name
+              ))
+              OR
+              -- Agent tools: check if instance has ALL tools required by the target agent
+              (te.is_agent_tool = TRUE AND (
+                  a.tool_names = '{}'
+                  OR NOT EXISTS (
+                      -- Find any tool required by target agent that instance doesn't have
+                      SELECT 1 FROM unnest(a.tool_names) AS required_tool
+                      WHERE NOT EXISTS (
+                          SELECT 1 FROM agentpg_instance_tools it
+                          WHERE it.instance_id = p_instance_id
+                            AND it.tool_name = required_tool
+                      )
+                  )
+              ))
+          )
+        ORDER BY te.scheduled_at ASC, te.created_at ASC
+        LIMIT p_max_count
+        FOR UPDATE OF te SKIP LOCKED
+    )
+    UPDATE agentpg_tool_executions te
+    SET claimed_by_instance_id = p_instance_id,
+        claimed_at = NOW(),
+        state = 'running',
+        started_at = NOW(),
+        attempt_count = attempt_count + 1
+    FROM claimable c
+    WHERE te.id = c.id
+    RETURNING te.*;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_claim_tool_executions IS 'Race-safe tool claiming. Routes agent-tools based on target agent tool requirements. Respects scheduled_at for retry delays.';
+
+DROP INDEX IF EXISTS agentpg_idx_tool_exec_running_by_tool;
+
+DROP INDEX IF EXISTS agentpg_idx_runs_in_progress;
+
+ALTER TABLE agentpg_tools DROP COLUMN IF EXISTS max_concurrency;
+
+ALTER TABLE agentpg_agents DROP COLUMN IF EXISTS max_concurrent_runs;
@@ -0,0 +1,266 @@
+-- =============================================================================
+-- AGENTPG FLEET-WIDE CONCURRENCY LIMITS
+-- =============================================================================
+-- Agents can cap their runs in progress (max_concurrent_runs) and tools their
+-- running executions (max_concurrency) across all instances. The caps are
+-- enforced by the claim functions: work over a cap stays pending until a slot
+-- frees up.
+--
+-- A run holds a slot from its first claim (started_at) until it is finalized
+-- or awaits input, so continuations of started runs are always claimable.
+-- A tool execution holds a slot while it is running.
+--
+-- Claimers lock the capped agent and tool rows they may claim for, so
+-- concurrent claims from different instances cannot both fill the last slot.
+--
+-- NOTE: an agent that delegates to itself (directly or through other agents)
+-- with a cap can deadlock when every slot is held by a parent waiting for its
+-- child run.
+-- =============================================================================
+
+ALTER TABLE agentpg_agents ADD COLUMN max_concurrent_runs INTEGER
+    CHECK (max_concurrent_runs > 0);
+
+COMMENT ON COLUMN agentpg_agents.max_concurrent_runs IS 'Fleet-wide cap on runs in progress for this agent. NULL means unlimited.';
+
+ALTER TABLE agentpg_tools ADD COLUMN max_concurrency INTEGER
+    CHECK (max_concurrency > 0);
+
+COMMENT ON COLUMN agentpg_tools.max_concurrency IS 'Fleet-wide cap on running executions of this tool. NULL means unlimited.';
+
+-- Index for counting runs in progress per agent
+CREATE INDEX agentpg_idx_runs_in_progress ON agentpg_runs (agent_id)
+WHERE
+    started_at IS NOT NULL
+    AND state NOT IN ('completed', 'cancelled', 'failed', 'awaiting_input');
+
+-- Index for counting running executions per tool
+CREATE INDEX agentpg_idx_tool_exec_running_by_tool ON agentpg_tool_executions (tool_name)
+WHERE
+    state = 'running';
+
+-- -----------------------------------------------------------------------------
+-- Claim pending runs (race-safe with SKIP LOCKED)
+-- -----------------------------------------------------------------------------
+-- Same as 010, but new runs of capped agents are only claimed while the agent
+-- has free slots.
+-- -----------------------------------------------------------------------------
+CREATE OR REPLACE FUNCTION agentpg_claim_runs(
+    p_instance_id TEXT,
+    p_max_count INTEGER DEFAULT 1,
+    p_run_mode agentpg_run_mode DEFAULT NULL
+) RETURNS SETOF agentpg_runs AS $$
+BEGIN
+    -- Serialize claimers of capped agents with new runs waiting. The lock is
+    -- held until the claim commits, and the query below takes a new snapshot,
+    -- so it sees the runs claimed by the previous holder.
+    PERFORM 1
+    FROM agentpg_agents a
+    WHERE a.max_concurrent_runs IS NOT NULL
+      AND EXISTS (
+          SELECT 1 FROM agentpg_runs r
+          WHERE r.agent_id = a.id
+            AND r.state = 'pending'
+            AND r.claimed_by_instance_id IS NULL
+            AND r.started_at IS NULL
+            AND r.scheduled_at <= NOW()
+            AND (p_run_mode IS NULL OR r.run_mode = p_run_mode)
+      )
+    ORDER BY a.id
+    FOR NO KEY UPDATE OF a;
+
+    RETURN QUERY
+    WITH candidates AS (
+        SELECT r.id, r.agent_id, r.created_at, r.started_at, a.max_concurrent_runs
+        FROM agentpg_runs r
+        JOIN agentpg_agents a ON a.id = r.agent_id
+        WHERE r.state = 'pending'
+          AND r.claimed_by_instance_id IS NULL
+          -- Only claim if scheduled time has passed (for API retry delays)
+          AND r.scheduled_at <= NOW()
+          -- Filter by run mode if specified
+          AND (p_run_mode IS NULL OR r.run_mode = p_run_mode)
+          -- Only claim if instance has ALL tools required by this agent
+          -- Agents with no tools (empty array) can be processed by any instance
+          AND (
+              a.tool_names = '{}'
+              OR NOT EXISTS (
+                  -- Find any tool required by agent that instance doesn't have
+                  SELECT 1 FROM unnest(a.tool_names) AS required_tool
+                  WHERE NOT EXISTS (
+                      SELECT 1 FROM agentpg_instance_tools it
+                      WHERE it.instance_id = p_instance_id
+                        AND it.tool_name = required_tool
+                  )
+              )
+          )
+    ),
+    in_progress AS (
+        SELECT r.agent_id, COUNT(*) AS run_count
+        FROM agentpg_runs r
+        WHERE r.agent_id IN (SELECT agent_id FROM candidates WHERE max_concurrent_runs IS NOT NULL)
+          AND r.started_at IS NOT NULL
+          AND r.state NOT IN ('completed', 'cancelled', 'failed', 'awaiting_input')
+        GROUP BY r.agent_id
+    ),
+    ranked AS (
+        SELECT c.id, c.started_at, c.max_concurrent_runs,
+               COALESCE(ip.run_count, 0) AS run_count,
+               ROW_NUMBER() OVER (
+                   PARTITION BY c.agent_id, c.started_at IS NULL
+                   ORDER BY c.created_at ASC
+               ) AS slot
+        FROM candidates c
+        LEFT JOIN in_progress ip ON ip.agent_id = c.agent_id
+    ),
+    allowed AS (
+        SELECT id FROM ranked
+        -- Continuations already hold a slot; new runs need a free one
+        WHERE started_at IS NOT NULL
+           OR max_concurrent_runs IS NULL
+           OR slot <= max_concurrent_runs - run_count
+    ),
+    claimable AS (
+        SELECT r.id
+        FROM agentpg_runs r
+        JOIN agentpg_sessions s ON s.id = r.session_id
+        WHERE r.id IN (SELECT id FROM allowed)
+          AND r.state = 'pending'
+          AND r.claimed_by_instance_id IS NULL
+        ORDER BY r.created_at ASC
+        LIMIT p_max_count
+        FOR UPDATE OF r SKIP LOCKED
+        -- Skip sessions being compacted
+        FOR KEY SHARE OF s SKIP LOCKED
+    ),
+    claimed AS (
+        UPDATE agentpg_runs r
+        SET claimed_by_instance_id = p_instance_id,
+            claimed_at = NOW(),
+            -- Transition to appropriate state based on run mode
+            state = CASE
+                WHEN r.run_mode = 'batch' THEN 'batch_submitting'::agentpg_run_state
+                WHEN r.run_mode = 'streaming' THEN 'streaming'::agentpg_run_state
+                -- The run worker claims auto runs and hands those it streams
+                -- over to the streaming worker
+                WHEN r.run_mode = 'auto' THEN 'batch_submitting'::agentpg_run_state
+            END,
+            previous_state = 'pending',
+            started_at = COALESCE(started_at, NOW())
+        FROM claimable c
+        WHERE r.id = c.id
+        RETURNING r.*
+    )
+    SELECT * FROM claimed;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_claim_runs IS 'Race-safe run claiming based on tool availability. Instance must have ALL tools required by the agent. Respects scheduled_at for API retry delays, agent max_concurrent_runs, and skips sessions locked by compaction. Auto runs are claimed into batch_submitting.';
+
+-- -----------------------------------------------------------------------------
+-- Claim pending tool executions (race-safe with SKIP LOCKED)
+-- -----------------------------------------------------------------------------
+-- Same as 001, but executions of capped tools are only claimed while the tool
+-- has free slots. Agent tools are capped by the target agent's runs instead.
+-- -----------------------------------------------------------------------------
+CREATE OR REPLACE FUNCTION agentpg_claim_tool_executions(
+    p_instance_id TEXT,
+    p_max_count INTEGER DEFAULT 10
+) RETURNS SETOF agentpg_tool_executions AS $$
+BEGIN
+    -- Serialize claimers of capped tools with executions waiting (see
+    -- agentpg_claim_runs)
+    PERFORM 1
+    FROM agentpg_tools t
+    WHERE t.max_concurrency IS NOT NULL
+      AND EXISTS (
+          SELECT 1 FROM agentpg_tool_executions te
+          WHERE te.tool_name = t.name
+            AND te.is_agent_tool = FALSE
+            AND te.state = 'pending'
+            AND te.claimed_by_instance_id IS NULL
+            AND te.scheduled_at <= NOW()
+      )
+    ORDER BY t.name
+    FOR NO KEY UPDATE OF t;
+
+    RETURN QUERY
+    WITH candidates AS (
+        SELECT te.id, te.tool_name, te.is_agent_tool, te.scheduled_at, te.created_at,
+               t.max_concurrency
+        FROM agentpg_tool_executions te
+        LEFT JOIN agentpg_agents a ON te.is_agent_tool = TRUE AND a.id = te.agent_id
+        LEFT JOIN agentpg_tools t ON te.is_agent_tool = FALSE AND t.name = te.tool_name
+        WHERE te.state = 'pending'
+          AND te.claimed_by_instance_id IS NULL
+          -- Only claim if scheduled time has passed (for retry delays and snoozing)
+          AND te.scheduled_at <= NOW()
+          -- Only claim if instance has capability for this tool
+          AND (
+              -- Regular tools: check instance_tools
+              (te.is_agent_tool = FALSE AND EXISTS (
+                  SELECT 1 FROM agentpg_instance_tools it
+                  WHERE it.instance_id = p_instance_id
+                    AND it.tool_name = te.tool_name
+              ))
+              OR
+              -- Agent tools: check if instance has ALL tools required by the target agent
+              (te.is_agent_tool = TRUE AND (
+                  a.tool_names = '{}'
+                  OR NOT EXISTS (
+                      -- Find any tool required by target agent that instance doesn't have
+                      SELECT 1 FROM unnest(a.tool_names) AS required_tool
+                      WHERE NOT EXISTS (
+                          SELECT 1 FROM agentpg_instance_tools it
+                          WHERE it.instance_id = p_instance_id
+                            AND it.tool_name = required_tool
+                      )
+                  )
+              ))
+          )
+    ),
+    running AS (
+        SELECT te.tool_name, COUNT(*) AS exec_count
+        FROM agentpg_tool_executions te
+        WHERE te.tool_name IN (SELECT tool_name FROM candidates WHERE max_concurrency IS NOT NULL)
+          AND te.is_agent_tool = FALSE
+          AND te.state = 'running'
+        GROUP BY te.tool_name
+    ),
+    ranked AS (
+        SELECT c.id, c.max_concurrency,
+               COALESCE(rn.exec_count, 0) AS exec_count,
+               ROW_NUMBER() OVER (
+                   PARTITION BY c.tool_name, c.is_agent_tool
+                   ORDER BY c.scheduled_at ASC, c.created_at ASC
+               ) AS slot
+        FROM candidates c
+        LEFT JOIN running rn ON rn.tool_name = c.tool_name
+    ),
+    claimable AS (
+        SELECT te.id
+        FROM agentpg_tool_executions te
+        WHERE te.id IN (
+                SELECT id FROM ranked
+                WHERE max_concurrency IS NULL
+                   OR slot <= max_concurrency - exec_count
+            )
+          AND te.state = 'pending'
+          AND te.claimed_by_instance_id IS NULL
+        ORDER BY te.scheduled_at ASC, te.created_at ASC
+        LIMIT p_max_count
+        FOR UPDATE OF te SKIP LOCKED
+    )
+    UPDATE agentpg_tool_executions te
+    SET claimed_by_instance_id = p_instance_id,
+        claimed_at = NOW(),
+        state = 'running',
+        started_at = NOW(),
+        attempt_count = attempt_count + 1
+    FROM claimable c
+    WHERE te.id = c.id
+    RETURNING te.*;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_claim_tool_executions IS 'Race-safe tool claiming. Routes agent-tools based on target agent tool requirements. Respects scheduled_at for retry delays and tool max_concurrency.';
@@ -0,0 +1,13 @@
+-- =============================================================================
+-- AGENTPG RATE LIMIT SCHEDULER - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 012_agentpg_migration.up.sql
+-- =============================================================================
+
+DROP FUNCTION IF EXISTS agentpg_record_rate_limit(TEXT, INTEGER, INTEGER, INTEGER, INTEGER, INTEGER, INTEGER, INTEGER, INTEGER, TIMESTAMPTZ);
+
+DROP FUNCTION IF EXISTS agentpg_acquire_rate_limit(TEXT);
+
+DROP FUNCTION IF EXISTS agentpg_refill_rate_limit(DOUBLE PRECISION, INTEGER, DOUBLE PRECISION);
+
+DROP TABLE IF EXISTS agentpg_rate_limits;
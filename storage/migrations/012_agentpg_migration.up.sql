@@ -0,0 +1,179 @@
+-- =============================================================================
+-- AGENTPG RATE LIMIT SCHEDULER
+-- =============================================================================
+-- Instances share one token bucket per model and limit (requests, input
+-- tokens, output tokens), fed by the rate-limit headers returned by the
+-- Messages API. Workers acquire a request from the buckets before starting
+-- an iteration; when a bucket is empty the run goes back to pending until
+-- the bucket has refilled, instead of failing on a 429.
+--
+-- Buckets refill continuously at their per-minute limit, like the API's.
+-- Tokens are taken when the response reports the call's usage, requests when
+-- the call is started. A bucket is unknown (NULL) until the API reports it.
+-- =============================================================================
+
+-- =============================================================================
+-- TABLE: agentpg_rate_limits
+-- =============================================================================
+CREATE TABLE agentpg_rate_limits (
+    -- Claude model the limits apply to
+    model TEXT PRIMARY KEY,
+
+-- Per-minute limits and what is left of them (may be negative after a call
+-- used more tokens than were available)
+requests_limit INTEGER CHECK (requests_limit > 0),
+requests_available DOUBLE PRECISION,
+input_tokens_limit INTEGER CHECK (input_tokens_limit > 0),
+input_tokens_available DOUBLE PRECISION,
+output_tokens_limit INTEGER CHECK (output_tokens_limit > 0),
+output_tokens_available DOUBLE PRECISION,
+
+-- No calls before this time (set from the retry-after of 429 responses)
+blocked_until TIMESTAMPTZ,
+
+-- When the available amounts were last refilled
+refilled_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+-- Timestamps
+created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE agentpg_rate_limits IS 'Token buckets shared by all instances, one row per model, fed by the rate-limit headers of Messages API responses.';
+
+COMMENT ON COLUMN agentpg_rate_limits.blocked_until IS 'No calls to the model are started before this time. Set when the API answered with a 429 and a retry-after.';
+
+COMMENT ON COLUMN agentpg_rate_limits.refilled_at IS 'When the *_available columns were last refilled at their per-minute limit.';
+
+-- -----------------------------------------------------------------------------
+-- Refill a bucket
+-- -----------------------------------------------------------------------------
+-- Returns the amount available after p_elapsed seconds of refilling at
+-- p_limit per minute, capped at the limit. NULL for unknown buckets.
+-- -----------------------------------------------------------------------------
+CREATE FUNCTION agentpg_refill_rate_limit(
+    p_available DOUBLE PRECISION,
+    p_limit INTEGER,
+    p_elapsed DOUBLE PRECISION
+) RETURNS DOUBLE PRECISION AS $$
+    -- LEAST ignores NULLs, so check the bucket is known first
+    SELECT CASE
+        WHEN p_available IS NOT NULL THEN LEAST(p_limit, p_available + p_limit * p_elapsed / 60)
+    END;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- -----------------------------------------------------------------------------
+-- Acquire a request
+-- -----------------------------------------------------------------------------
+-- Takes one request from the model's buckets if every known bucket has at
+-- least one request or token available and the model is not blocked.
+-- Returns NULL if the call may start, otherwise the time at which the
+-- buckets will have refilled.
+-- -----------------------------------------------------------------------------
+CREATE FUNCTION agentpg_acquire_rate_limit(
+    p_model TEXT
+) RETURNS TIMESTAMPTZ AS $$
+DECLARE
+    rl agentpg_rate_limits%ROWTYPE;
+    v_elapsed DOUBLE PRECISION;
+    v_wait DOUBLE PRECISION;
+BEGIN
+    SELECT * INTO rl FROM agentpg_rate_limits WHERE model = p_model FOR UPDATE;
+    IF NOT FOUND THEN
+        -- Nothing reported for this model yet
+        RETURN NULL;
+    END IF;
+
+    v_elapsed := GREATEST(EXTRACT(EPOCH FROM NOW() - rl.refilled_at), 0);
+    rl.requests_available := agentpg_refill_rate_limit(rl.requests_available, rl.requests_limit, v_elapsed);
+    rl.input_tokens_available := agentpg_refill_rate_limit(rl.input_tokens_available, rl.input_tokens_limit, v_elapsed);
+    rl.output_tokens_available := agentpg_refill_rate_limit(rl.output_tokens_available, rl.output_tokens_limit, v_elapsed);
+
+    -- Seconds until every bucket has at least 1 available (GREATEST ignores
+    -- the NULLs of buckets that have enough or are unknown)
+    v_wait := GREATEST(
+        0,
+        CASE WHEN rl.requests_available < 1 THEN (1 - rl.requests_available) * 60 / rl.requests_limit END,
+        CASE WHEN rl.input_tokens_available < 1 THEN (1 - rl.input_tokens_available) * 60 / rl.input_tokens_limit END,
+        CASE WHEN rl.output_tokens_available < 1 THEN (1 - rl.output_tokens_available) * 60 / rl.output_tokens_limit END,
+        EXTRACT(EPOCH FROM rl.blocked_until - NOW())
+    );
+
+    IF v_wait = 0 THEN
+        rl.requests_available := rl.requests_available - 1;
+    END IF;
+
+    UPDATE agentpg_rate_limits
+    SET requests_available = rl.requests_available,
+        input_tokens_available = rl.input_tokens_available,
+        output_tokens_available = rl.output_tokens_available,
+        refilled_at = NOW()
+    WHERE model = p_model;
+
+    IF v_wait > 0 THEN
+        RETURN NOW() + v_wait * INTERVAL '1 second';
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_acquire_rate_limit IS 'Takes one request from the model''s rate-limit buckets. Returns NULL if the call may start, otherwise when to try again.';
+
+-- -----------------------------------------------------------------------------
+-- Record the rate limits of a response
+-- -----------------------------------------------------------------------------
+-- Updates the model's buckets from the limits and remaining amounts reported
+-- by a response (NULL if not reported) and takes the tokens the call used.
+-- The remaining amounts reported by concurrent calls can arrive out of order,
+-- so a bucket never grows past the local count minus the usage.
+-- -----------------------------------------------------------------------------
+CREATE FUNCTION agentpg_record_rate_limit(
+    p_model TEXT,
+    p_requests_limit INTEGER,
+    p_requests_remaining INTEGER,
+    p_input_tokens_limit INTEGER,
+    p_input_tokens_remaining INTEGER,
+    p_output_tokens_limit INTEGER,
+    p_output_tokens_remaining INTEGER,
+    p_input_tokens_used INTEGER,
+    p_output_tokens_used INTEGER,
+    p_blocked_until TIMESTAMPTZ
+) RETURNS VOID AS $$
+DECLARE
+    rl agentpg_rate_limits%ROWTYPE;
+    v_elapsed DOUBLE PRECISION;
+BEGIN
+    INSERT INTO agentpg_rate_limits (model) VALUES (p_model)
+    ON CONFLICT (model) DO NOTHING;
+
+    SELECT * INTO rl FROM agentpg_rate_limits WHERE model = p_model FOR UPDATE;
+
+    v_elapsed := GREATEST(EXTRACT(EPOCH FROM NOW() - rl.refilled_at), 0);
+
+    UPDATE agentpg_rate_limits
+    SET requests_limit = COALESCE(NULLIF(p_requests_limit, 0), rl.requests_limit),
+        requests_available = CASE
+            WHEN rl.requests_available IS NULL THEN p_requests_remaining
+            WHEN p_requests_remaining IS NULL THEN agentpg_refill_rate_limit(rl.requests_available, rl.requests_limit, v_elapsed)
+            ELSE LEAST(agentpg_refill_rate_limit(rl.requests_available, rl.requests_limit, v_elapsed), p_requests_remaining)
+        END,
+        input_tokens_limit = COALESCE(NULLIF(p_input_tokens_limit, 0), rl.input_tokens_limit),
+        input_tokens_available = CASE
+            WHEN rl.input_tokens_available IS NULL THEN p_input_tokens_remaining
+            WHEN p_input_tokens_remaining IS NULL THEN agentpg_refill_rate_limit(rl.input_tokens_available, rl.input_tokens_limit, v_elapsed) - p_input_tokens_used
+            ELSE LEAST(agentpg_refill_rate_limit(rl.input_tokens_available, rl.input_tokens_limit, v_elapsed) - p_input_tokens_used, p_input_tokens_remaining)
+        END,
+        output_tokens_limit = COALESCE(NULLIF(p_output_tokens_limit, 0), rl.output_tokens_limit),
+        output_tokens_available = CASE
+            WHEN rl.output_tokens_available IS NULL THEN p_output_tokens_remaining
+            WHEN p_output_tokens_remaining IS NULL THEN agentpg_refill_rate_limit(rl.output_tokens_available, rl.output_tokens_limit, v_elapsed) - p_output_tokens_used
+            ELSE LEAST(agentpg_refill_rate_limit(rl.output_tokens_available, rl.output_tokens_limit, v_elapsed) - p_output_tokens_used, p_output_tokens_remaining)
+        END,
+        blocked_until = GREATEST(rl.blocked_until, p_blocked_until),
+        refilled_at = NOW(),
+        updated_at = NOW()
+    WHERE model = p_model;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION agentpg_record_rate_limit IS 'Updates the model''s rate-limit buckets from the headers of a Messages API response and takes the tokens the call used.';
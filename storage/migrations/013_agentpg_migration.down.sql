@@ -0,0 +1,19 @@
+-- =============================================================================
+-- AGENTPG OPERATOR ACTIONS - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 013_agentpg_migration.up.sql
+-- =============================================================================
+
+DROP TRIGGER IF EXISTS agentpg_trg_skip_tool_of_cancelled_run ON agentpg_tool_executions;
+
+DROP FUNCTION IF EXISTS agentpg_skip_tool_of_cancelled_run();
+
+DROP TRIGGER IF EXISTS agentpg_trg_cancel_child_of_cancelled_run ON agentpg_runs;
+
+DROP FUNCTION IF EXISTS agentpg_cancel_child_of_cancelled_run();
+
+DROP TRIGGER IF EXISTS agentpg_trg_keep_run_cancelled ON agentpg_runs;
+
+DROP FUNCTION IF EXISTS agentpg_keep_run_cancelled();
+
+DROP TABLE IF EXISTS agentpg_audit_log;
@@ -0,0 +1,122 @@
+-- =============================================================================
+-- AGENTPG OPERATOR ACTIONS
+-- =============================================================================
+-- Operators can cancel, retry and rescue runs, requeue or discard tool
+-- executions and force a new leader election from the admin UI. Every action
+-- is recorded in agentpg_audit_log.
+--
+-- A run may be cancelled while an instance is still working on it. The
+-- triggers below keep cancelled runs cancelled: the worker's later state
+-- updates are dropped, and tool executions and nested runs it creates for
+-- the run afterwards start out skipped and cancelled, so nothing picks them up.
+-- =============================================================================
+
+-- =============================================================================
+-- TABLE: agentpg_audit_log
+-- =============================================================================
+CREATE TABLE agentpg_audit_log (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+
+-- What was done, e.g. 'run.cancel' or 'leader.release'
+action TEXT NOT NULL CHECK (char_length(action) > 0),
+
+-- What it was done to ('run', 'tool_execution' or 'leader') and its ID
+target_type TEXT NOT NULL,
+target_id TEXT NOT NULL,
+
+-- Session of the target, used to scope the log to tenants. Not a foreign key
+-- so that events outlive purged sessions.
+session_id UUID,
+
+-- Who did it (the UI user, or 'anonymous' without authentication)
+actor TEXT NOT NULL,
+
+-- Action-specific details (reason, previous state, counts)
+details JSONB NOT NULL DEFAULT '{}',
+
+created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE agentpg_audit_log IS 'Operator actions performed through the admin UI, newest last.';
+
+COMMENT ON COLUMN agentpg_audit_log.session_id IS 'Session of the target (NULL for fleet-wide actions). Events of sessions outside a metadata filter are hidden from scoped users.';
+
+CREATE INDEX agentpg_idx_audit_log_created ON agentpg_audit_log (created_at DESC);
+
+CREATE INDEX agentpg_idx_audit_log_target ON agentpg_audit_log (target_type, target_id, created_at DESC);
+
+-- -----------------------------------------------------------------------------
+-- Keep cancelled runs cancelled
+-- -----------------------------------------------------------------------------
+-- Drops updates that would move a cancelled run to another state, such as a
+-- worker finishing the iteration it was processing when the run was cancelled.
+-- -----------------------------------------------------------------------------
+CREATE FUNCTION agentpg_keep_run_cancelled()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF OLD.state = 'cancelled' AND NEW.state <> 'cancelled' THEN
+        RETURN NULL;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER agentpg_trg_keep_run_cancelled
+    BEFORE UPDATE OF state ON agentpg_runs
+    FOR EACH ROW
+    EXECUTE FUNCTION agentpg_keep_run_cancelled();
+
+-- -----------------------------------------------------------------------------
+-- Cancel nested runs of cancelled runs
+-- -----------------------------------------------------------------------------
+-- A tool worker that was already running an agent tool may create the child
+-- run after its parent was cancelled; the child is created cancelled.
+-- -----------------------------------------------------------------------------
+CREATE FUNCTION agentpg_cancel_child_of_cancelled_run()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.state = 'pending'
+       AND NEW.parent_run_id IS NOT NULL
+       AND EXISTS (
+           SELECT 1 FROM agentpg_runs
+           WHERE id = NEW.parent_run_id AND state = 'cancelled'
+       ) THEN
+        NEW.state := 'cancelled';
+        NEW.error_type := 'cancelled';
+        NEW.error_message := 'parent run was cancelled';
+        NEW.finalized_at := NOW();
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER agentpg_trg_cancel_child_of_cancelled_run
+    BEFORE INSERT ON agentpg_runs
+    FOR EACH ROW
+    EXECUTE FUNCTION agentpg_cancel_child_of_cancelled_run();
+
+-- -----------------------------------------------------------------------------
+-- Skip tool executions of cancelled runs
+-- -----------------------------------------------------------------------------
+-- A worker that was waiting for a response when the run was cancelled may
+-- still create the tool executions of the response; they are created skipped.
+-- -----------------------------------------------------------------------------
+CREATE FUNCTION agentpg_skip_tool_of_cancelled_run()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.state = 'pending'
+       AND EXISTS (
+           SELECT 1 FROM agentpg_runs
+           WHERE id = NEW.run_id AND state = 'cancelled'
+       ) THEN
+        NEW.state := 'skipped';
+        NEW.completed_at := NOW();
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER agentpg_trg_skip_tool_of_cancelled_run
+    BEFORE INSERT ON agentpg_tool_executions
+    FOR EACH ROW
+    EXECUTE FUNCTION agentpg_skip_tool_of_cancelled_run();
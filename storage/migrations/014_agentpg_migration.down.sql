@@ -0,0 +1,11 @@
+-- =============================================================================
+-- AGENTPG AGENT VERSIONS - DOWN MIGRATION
+-- =============================================================================
+-- Reverses all changes from 014_agentpg_migration.up.sql
+-- =============================================================================
+
+DROP TRIGGER IF EXISTS agentpg_trg_record_agent_version ON agentpg_agents;
+
+DROP FUNCTION IF EXISTS agentpg_record_agent_version();
+
+DROP TABLE IF EXISTS agentpg_agent_versions;
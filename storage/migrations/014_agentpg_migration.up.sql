@@ -0,0 +1,103 @@
+-- =============================================================================
+-- AGENTPG AGENT VERSIONS
+-- =============================================================================
+-- Every change to an agent definition is kept as a numbered version so that
+-- the admin UI can show its history, diff two versions and restore an older
+-- one. Versions are recorded by a trigger, so changes made through
+-- Client.UpdateAgent, the admin UI or plain SQL all appear in the history.
+-- =============================================================================
+
+-- =============================================================================
+-- TABLE: agentpg_agent_versions
+-- =============================================================================
+CREATE TABLE agentpg_agent_versions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+
+agent_id UUID NOT NULL REFERENCES agentpg_agents (id) ON DELETE CASCADE,
+
+-- 1 for the definition the agent was created with
+version INTEGER NOT NULL CHECK (version > 0),
+
+-- The definition as of this version (same columns as agentpg_agents)
+name TEXT NOT NULL,
+description TEXT,
+model TEXT NOT NULL,
+system_prompt TEXT,
+max_tokens INTEGER,
+temperature REAL,
+top_k INTEGER,
+top_p REAL,
+tool_names TEXT [] NOT NULL DEFAULT '{}',
+agent_ids UUID [] NOT NULL DEFAULT '{}',
+metadata JSONB NOT NULL DEFAULT '{}',
+config JSONB NOT NULL DEFAULT '{}',
+fallback_models TEXT [] NOT NULL DEFAULT '{}',
+fallback_latency_budget_ms INTEGER,
+max_concurrent_runs INTEGER,
+
+created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+CONSTRAINT agent_version_unique UNIQUE (agent_id, version)
+);
+
+COMMENT ON TABLE agentpg_agent_versions IS 'History of agent definitions, one row per change.';
+
+-- Existing agents start with their current definition as version 1
+INSERT INTO agentpg_agent_versions (
+    agent_id, version, name, description, model, system_prompt,
+    max_tokens, temperature, top_k, top_p, tool_names, agent_ids,
+    metadata, config, fallback_models, fallback_latency_budget_ms,
+    max_concurrent_runs, created_at
+)
+SELECT
+    id, 1, name, description, model, system_prompt,
+    max_tokens, temperature, top_k, top_p, tool_names, agent_ids,
+    metadata, config, fallback_models, fallback_latency_budget_ms,
+    max_concurrent_runs, updated_at
+FROM agentpg_agents;
+
+-- -----------------------------------------------------------------------------
+-- Record agent versions
+-- -----------------------------------------------------------------------------
+-- Updates that leave the definition unchanged (only updated_at moves) do not
+-- create a version.
+-- -----------------------------------------------------------------------------
+CREATE FUNCTION agentpg_record_agent_version()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND (
+        OLD.name, OLD.description, OLD.model, OLD.system_prompt,
+        OLD.max_tokens, OLD.temperature, OLD.top_k, OLD.top_p,
+        OLD.tool_names, OLD.agent_ids, OLD.metadata, OLD.config,
+        OLD.fallback_models, OLD.fallback_latency_budget_ms, OLD.max_concurrent_runs
+    ) IS NOT DISTINCT FROM (
+        NEW.name, NEW.description, NEW.model, NEW.system_prompt,
+        NEW.max_tokens, NEW.temperature, NEW.top_k, NEW.top_p,
+        NEW.tool_names, NEW.agent_ids, NEW.metadata, NEW.config,
+        NEW.fallback_models, NEW.fallback_latency_budget_ms, NEW.max_concurrent_runs
+    ) THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO agentpg_agent_versions (
+        agent_id, version, name, description, model, system_prompt,
+        max_tokens, temperature, top_k, top_p, tool_names, agent_ids,
+        metadata, config, fallback_models, fallback_latency_budget_ms,
+        max_concurrent_runs
+    )
+    SELECT
+        NEW.id, COALESCE(MAX(v.version), 0) + 1, NEW.name, NEW.description, NEW.model, NEW.system_prompt,
+        NEW.max_tokens, NEW.temperature, NEW.top_k, NEW.top_p, NEW.tool_names, NEW.agent_ids,
+        NEW.metadata, NEW.config, NEW.fallback_models, NEW.fallback_latency_budget_ms,
+        NEW.max_concurrent_runs
+    FROM agentpg_agent_versions v
+    WHERE v.agent_id = NEW.id;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER agentpg_trg_record_agent_version
+    AFTER INSERT OR UPDATE ON agentpg_agents
+    FOR EACH ROW
+    EXECUTE FUNCTION agentpg_record_agent_version();
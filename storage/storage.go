@@ -0,0 +1,14 @@
+// Package storage embeds the AgentPG PostgreSQL schema migrations.
+//
+// Migration files are named {NNN}_agentpg_migration.{up|down}.sql and must
+// be applied in order. They can be run with psql or any migration tool; the
+// embedded copy lets Go programs (and the agentpgtest package) apply them
+// without access to the source tree.
+package storage
+
+import "embed"
+
+// Migrations contains the migration files under "migrations/".
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
@@ -3,7 +3,10 @@ package agentpg
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
@@ -12,10 +15,17 @@ import (
 )
 
 // streamingWorker processes pending streaming runs by claiming them, building messages,
-// and using the Claude Streaming API for real-time responses.
+// and using the Claude Streaming API for real-time responses. It also processes
+// RunModeAuto runs the run worker hands over (see dispatchAutoRun).
 type streamingWorker[TTx any] struct {
 	client    *Client[TTx]
 	triggerCh chan struct{}
+
+	mu     sync.Mutex
+	queued []*driver.Run // Auto runs handed over by the run worker
+
+	active           atomic.Int64 // Runs claimed or queued and not processed yet
+	rateLimitedUntil atomic.Int64 // Unix nanoseconds, 0 if never rate limited
 }
 
 func newStreamingWorker[TTx any](c *Client[TTx]) *streamingWorker[TTx] {
@@ -32,6 +42,32 @@ func (w *streamingWorker[TTx]) trigger() {
 	}
 }
 
+// enqueue hands over a claimed run to be processed on the next round.
+func (w *streamingWorker[TTx]) enqueue(run *driver.Run) {
+	w.mu.Lock()
+	w.queued = append(w.queued, run)
+	w.mu.Unlock()
+	w.active.Add(1)
+	w.trigger()
+}
+
+// hasCapacity reports whether fewer than MaxConcurrentStreamingRuns runs are
+// waiting for or being processed by the worker.
+func (w *streamingWorker[TTx]) hasCapacity() bool {
+	return w.active.Load() < int64(w.client.config.MaxConcurrentStreamingRuns)
+}
+
+// setRateLimited records that streaming calls are rate limited until the
+// given time.
+func (w *streamingWorker[TTx]) setRateLimited(until time.Time) {
+	w.rateLimitedUntil.Store(until.UnixNano())
+}
+
+// rateLimited reports whether a recent streaming call was rate limited.
+func (w *streamingWorker[TTx]) rateLimited() bool {
+	return time.Now().UnixNano() < w.rateLimitedUntil.Load()
+}
+
 func (w *streamingWorker[TTx]) run(ctx context.Context) {
 	ticker := time.NewTicker(w.client.config.RunPollInterval)
 	defer ticker.Stop()
@@ -51,21 +87,43 @@ func (w *streamingWorker[TTx]) run(ctx context.Context) {
 func (w *streamingWorker[TTx]) processRuns(ctx context.Context) {
 	store := w.client.driver.Store()
 
+	// Auto runs handed over by the run worker are already claimed
+	w.mu.Lock()
+	runs := w.queued
+	w.queued = nil
+	w.mu.Unlock()
+
 	// Claim pending streaming runs only
-	runs, err := store.ClaimRuns(ctx, w.client.instanceID, w.client.config.MaxConcurrentStreamingRuns, "streaming")
-	if err != nil {
-		w.client.log().Error("failed to claim streaming runs", "error", err)
-		return
+	if limit := w.client.config.MaxConcurrentStreamingRuns - len(runs); limit > 0 {
+		claimed, err := store.ClaimRuns(ctx, w.client.instanceID, limit, "streaming")
+		if err != nil {
+			w.client.log().Error("failed to claim streaming runs", "error", err)
+		}
+		w.active.Add(int64(len(claimed)))
+		runs = append(runs, claimed...)
 	}
 
 	for _, run := range runs {
-		if err := w.processRun(ctx, run); err != nil {
+		err := w.processRun(ctx, run)
+		w.active.Add(-1)
+		if err != nil {
+			// Transient API failures are retried instead of failing the run
+			var callErr *apiCallError
+			if errors.As(err, &callErr) {
+				if info := classifyAPIError(callErr.err); info.errorType == "rate_limit_error" {
+					w.client.noteStreamingRateLimit(info.retryAfter)
+				}
+				if w.client.retryAPICall(ctx, run, callErr) {
+					continue
+				}
+			}
+
 			w.client.log().Error("failed to process streaming run",
 				"run_id", run.ID,
 				"error", err,
 			)
 			// Mark run as failed
-			w.failRun(ctx, run.ID, "streaming_error", err.Error())
+			w.failRun(ctx, run.ID, runErrorType(err, "streaming_error"), err.Error())
 		}
 	}
 }
@@ -86,47 +144,76 @@ func (w *streamingWorker[TTx]) processRun(ctx context.Context, run *driver.Run)
 		return fmt.Errorf("agent not found: %w", err)
 	}
 
-	// Determine trigger type
-	triggerType := "user_prompt"
-	if run.CurrentIteration > 0 {
-		triggerType = "tool_results"
+	// Resume the iteration of a failed API call that is being retried
+	iteration, err := w.client.retryIteration(ctx, run)
+	if err != nil {
+		return fmt.Errorf("failed to get retry iteration: %w", err)
+	}
+	if iteration == nil {
+		if err := w.client.checkIterationLimit(run); err != nil {
+			return err
+		}
 	}
 
-	// For first iteration, create the user message with the prompt
-	if run.CurrentIteration == 0 && run.Prompt != "" {
-		_, err := store.CreateMessage(ctx, driver.CreateMessageParams{
-			SessionID: run.SessionID,
-			RunID:     &run.ID,
-			Role:      driver.MessageRole(MessageRoleUser),
-			Content: []driver.ContentBlock{
-				{
-					Type: ContentTypeText,
-					Text: run.Prompt,
+	// Use the fallback model chosen by a previous failed attempt, if any
+	model := agent.Model
+	if iteration != nil {
+		model = iterationModel(agent, iteration)
+	}
+
+	// Leave the run pending while the model's rate limits are exhausted
+	if retryAt := w.client.acquireRateLimit(ctx, model); retryAt != nil && w.client.deferRun(ctx, run, model, *retryAt) {
+		return nil
+	}
+
+	if iteration == nil {
+		// Determine trigger type
+		triggerType := "user_prompt"
+		if run.CurrentIteration > 0 {
+			triggerType = "tool_results"
+		}
+
+		// For first iteration, create the user message with the prompt
+		if run.CurrentIteration == 0 && run.Prompt != "" {
+			_, err := store.CreateMessage(ctx, driver.CreateMessageParams{
+				SessionID: run.SessionID,
+				RunID:     &run.ID,
+				Role:      driver.MessageRole(MessageRoleUser),
+				Content: []driver.ContentBlock{
+					{
+						Type: ContentTypeText,
+						Text: run.Prompt,
+					},
 				},
-			},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create user message: %w", err)
+			}
+		}
+
+		// Create iteration with is_streaming=true
+		iteration, err = store.CreateIteration(ctx, driver.CreateIterationParams{
+			RunID:           run.ID,
+			IterationNumber: run.CurrentIteration + 1,
+			TriggerType:     triggerType,
+			IsStreaming:     true,
 		})
 		if err != nil {
-			return fmt.Errorf("failed to create user message: %w", err)
+			return fmt.Errorf("failed to create iteration: %w", err)
 		}
 	}
+	iterationNumber := iteration.IterationNumber
 
-	// Create iteration with is_streaming=true
-	iterationNumber := run.CurrentIteration + 1
-	iteration, err := store.CreateIteration(ctx, driver.CreateIterationParams{
-		RunID:           run.ID,
-		IterationNumber: iterationNumber,
-		TriggerType:     triggerType,
-		IsStreaming:     true,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create iteration: %w", err)
-	}
+	nextModel := nextFallbackModel(agent, model)
 
-	// Update iteration with streaming start time
+	// Update iteration with streaming start time. A retried iteration of an
+	// auto run may have been made with the Batch API before.
 	now := time.Now()
 	if updateIterErr := store.UpdateIteration(ctx, iteration.ID, map[string]any{
+		"is_streaming":         true,
 		"streaming_started_at": now,
 		"started_at":           now,
+		"model":                model,
 	}); updateIterErr != nil {
 		return fmt.Errorf("failed to update iteration start time: %w", updateIterErr)
 	}
@@ -140,16 +227,25 @@ func (w *streamingWorker[TTx]) processRun(ctx context.Context, run *driver.Run)
 		return fmt.Errorf("failed to update run: %w", updateRunErr)
 	}
 
-	// Build messages for Claude API (reuse logic from runWorker)
-	messages, err := w.buildMessages(ctx, run)
+	// Compact first if the history outgrew the agent's context window
+	w.client.compactBeforeIteration(ctx, run)
+
+	// Build tools for Claude API
+	tools, err := w.client.buildTools(ctx, agent)
 	if err != nil {
-		return fmt.Errorf("failed to build messages: %w", err)
+		return fmt.Errorf("failed to build tools: %w", err)
 	}
 
-	// Build tools for Claude API (reuse logic from runWorker)
-	tools, err := w.buildTools(ctx, agent)
+	// Make sure the request fits the context window
+	toolOutputLimit, err := w.client.checkContextOverflow(ctx, run, agent, tools)
 	if err != nil {
-		return fmt.Errorf("failed to build tools: %w", err)
+		return err
+	}
+
+	// Build messages for Claude API (reuse logic from runWorker)
+	messages, err := w.buildMessages(ctx, run, toolOutputLimit)
+	if err != nil {
+		return fmt.Errorf("failed to build messages: %w", err)
 	}
 
 	// Build system prompt
@@ -161,13 +257,13 @@ func (w *streamingWorker[TTx]) processRun(ctx context.Context, run *driver.Run)
 	}
 
 	// Build streaming request parameters
-	maxTokens := int64(4096)
+	maxTokens := DefaultMaxTokens
 	if agent.MaxTokens != nil {
 		maxTokens = int64(*agent.MaxTokens)
 	}
 
 	streamParams := anthropic.MessageNewParams{
-		Model:     anthropic.Model(agent.Model),
+		Model:     anthropic.Model(model),
 		MaxTokens: maxTokens,
 		Messages:  messages,
 		System:    system,
@@ -192,20 +288,38 @@ func (w *streamingWorker[TTx]) processRun(ctx context.Context, run *driver.Run)
 	log.Debug("starting streaming request",
 		"run_id", run.ID,
 		"iteration_id", iteration.ID,
+		"model", model,
 	)
 
-	// Call streaming API
-	stream := w.client.anthropic.Messages.NewStreaming(ctx, streamParams)
-
-	// Accumulate the response using SDK's Accumulate method
-	var message anthropic.Message
-	for stream.Next() {
-		event := stream.Current()
-		_ = message.Accumulate(event)
+	// Fall back to the next model if the first event does not arrive within
+	// the agent's latency budget
+	streamCtx := ctx
+	var budgetTimer *time.Timer
+	if agent.FallbackLatencyBudget > 0 && nextModel != "" {
+		var cancel context.CancelCauseFunc
+		streamCtx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		budgetTimer = time.AfterFunc(agent.FallbackLatencyBudget, func() {
+			cancel(errLatencyBudgetExceeded)
+		})
 	}
 
-	if err := stream.Err(); err != nil {
-		return fmt.Errorf("streaming error: %w", err)
+	// Call streaming API; the provider accumulates the response
+	message, err := w.client.provider.StreamMessage(streamCtx, streamParams, func(anthropic.MessageStreamEventUnion) {
+		if budgetTimer != nil {
+			budgetTimer.Stop()
+		}
+	})
+	if err != nil {
+		if errors.Is(context.Cause(streamCtx), errLatencyBudgetExceeded) {
+			err = fmt.Errorf("%w: no response from %s within %s", errLatencyBudgetExceeded, model, agent.FallbackLatencyBudget)
+		}
+		return &apiCallError{
+			iterationID: iteration.ID,
+			model:       model,
+			nextModel:   nextModel,
+			err:         fmt.Errorf("streaming error: %w", err),
+		}
 	}
 
 	log.Info("streaming completed",
@@ -215,7 +329,7 @@ func (w *streamingWorker[TTx]) processRun(ctx context.Context, run *driver.Run)
 	)
 
 	// Process the accumulated response
-	return w.processResult(ctx, iteration, run, &message)
+	return w.processResult(ctx, iteration, run, message)
 }
 
 func (w *streamingWorker[TTx]) processResult(ctx context.Context, iter *driver.Iteration, run *driver.Run, msg *anthropic.Message) error {
@@ -303,6 +417,16 @@ func (w *streamingWorker[TTx]) processResult(ctx context.Context, iter *driver.I
 		return fmt.Errorf("failed to update iteration: %w", err)
 	}
 
+	// A batch request resubmitted over the Streaming API only switched this
+	// iteration; the next one goes back to the Batch API. The state updates
+	// below honor a fixed set of columns, and the mode must be reset before
+	// the run leaves this worker.
+	if resubmittedAsStreaming(run, iter) {
+		if err := store.UpdateRun(ctx, run.ID, map[string]any{"run_mode": string(RunModeBatch)}); err != nil {
+			return fmt.Errorf("failed to reset run mode: %w", err)
+		}
+	}
+
 	// Determine next state and update run
 	runUpdates := map[string]any{
 		"input_tokens":                run.InputTokens + int(msg.Usage.InputTokens),
@@ -344,8 +468,8 @@ func (w *streamingWorker[TTx]) processResult(ctx context.Context, iter *driver.I
 	}
 
 	// Auto-compaction: check if session needs compaction after run completes
-	if nextState == RunStateCompleted && w.client.config.AutoCompactionEnabled {
-		w.checkAndCompact(ctx, run.SessionID)
+	if nextState == RunStateCompleted && w.client.config.AutoCompactionEnabled && run.Depth == 0 {
+		w.checkAndCompact(ctx, run)
 	}
 
 	log.Info("processed streaming result",
@@ -394,7 +518,9 @@ func (w *streamingWorker[TTx]) buildToolParams(ctx context.Context, iter *driver
 	return params
 }
 
-func (w *streamingWorker[TTx]) buildMessages(ctx context.Context, run *driver.Run) ([]anthropic.MessageParam, error) {
+// buildMessages converts the run's context to API messages. Tool outputs
+// are truncated to toolOutputLimit tokens (0 for no limit).
+func (w *streamingWorker[TTx]) buildMessages(ctx context.Context, run *driver.Run, toolOutputLimit int) ([]anthropic.MessageParam, error) {
 	store := w.client.driver.Store()
 
 	// Get messages for this run's context
@@ -405,110 +531,7 @@ func (w *streamingWorker[TTx]) buildMessages(ctx context.Context, run *driver.Ru
 		return nil, fmt.Errorf("failed to get messages: %w", err)
 	}
 
-	messages := make([]anthropic.MessageParam, 0, len(sessionMessages))
-
-	// Add existing messages from database
-	// IMPORTANT: Claude API requires alternating user/assistant roles.
-	// Consecutive messages with the same role must be merged into one message.
-	for _, msg := range sessionMessages {
-		role := anthropic.MessageParamRoleUser
-		if msg.Role == string(MessageRoleAssistant) {
-			role = anthropic.MessageParamRoleAssistant
-		}
-
-		content := make([]anthropic.ContentBlockParamUnion, 0, len(msg.Content))
-		for _, block := range msg.Content {
-			switch block.Type {
-			case ContentTypeText:
-				content = append(content, anthropic.NewTextBlock(block.Text))
-			case ContentTypeToolUse:
-				var input any
-				if len(block.ToolInput) > 0 {
-					_ = json.Unmarshal(block.ToolInput, &input)
-				}
-				content = append(content, anthropic.NewToolUseBlock(block.ToolUseID, input, block.ToolName))
-			case ContentTypeToolResult:
-				content = append(content, anthropic.NewToolResultBlock(block.ToolResultForUseID, block.ToolContent, block.IsError))
-			}
-		}
-
-		if len(content) == 0 {
-			continue
-		}
-
-		// Check if we can merge with the previous message (same role)
-		if len(messages) > 0 && messages[len(messages)-1].Role == role {
-			// Merge content blocks into the previous message
-			messages[len(messages)-1].Content = append(messages[len(messages)-1].Content, content...)
-		} else {
-			messages = append(messages, anthropic.MessageParam{
-				Role:    role,
-				Content: content,
-			})
-		}
-	}
-
-	return messages, nil
-}
-
-func (w *streamingWorker[TTx]) buildTools(ctx context.Context, agent *AgentDefinition) ([]anthropic.ToolUnionParam, error) {
-	if len(agent.Tools) == 0 && len(agent.AgentIDs) == 0 {
-		return nil, nil
-	}
-
-	tools := make([]anthropic.ToolUnionParam, 0, len(agent.Tools)+len(agent.AgentIDs))
-
-	// Add regular tools
-	for _, toolName := range agent.Tools {
-		t := w.client.GetTool(toolName)
-		if t == nil {
-			continue
-		}
-
-		schema := t.InputSchema()
-		inputSchema := anthropic.ToolInputSchemaParam{
-			Type:       "object",
-			Properties: schemaPropertiesToMap(schema.Properties),
-		}
-		if len(schema.Required) > 0 {
-			inputSchema.Required = schema.Required
-		}
-
-		toolParam := anthropic.ToolParam{
-			Name:        t.Name(),
-			Description: anthropic.String(t.Description()),
-			InputSchema: inputSchema,
-		}
-		tools = append(tools, anthropic.ToolUnionParam{OfTool: &toolParam})
-	}
-
-	// Add agent-as-tool entries
-	for _, delegateID := range agent.AgentIDs {
-		delegateAgent, err := w.client.GetAgentByID(ctx, delegateID)
-		if err != nil || delegateAgent == nil {
-			continue
-		}
-
-		inputSchema := anthropic.ToolInputSchemaParam{
-			Type: "object",
-			Properties: map[string]any{
-				"task": map[string]any{
-					"type":        "string",
-					"description": "The task to delegate to this agent",
-				},
-			},
-			Required: []string{"task"},
-		}
-
-		toolParam := anthropic.ToolParam{
-			Name:        delegateAgent.Name,
-			Description: anthropic.String(delegateAgent.Description),
-			InputSchema: inputSchema,
-		}
-		tools = append(tools, anthropic.ToolUnionParam{OfTool: &toolParam})
-	}
-
-	return tools, nil
+	return toMessageParams(sessionMessages, toolOutputLimit), nil
 }
 
 func (w *streamingWorker[TTx]) failRun(ctx context.Context, runID uuid.UUID, errorType, errorMessage string) {
@@ -527,13 +550,11 @@ func (w *streamingWorker[TTx]) failRun(ctx context.Context, runID uuid.UUID, err
 }
 
 // checkAndCompact checks if the session needs compaction and performs it if needed.
-// This is called after a run completes when AutoCompactionEnabled is true.
+// This is called after a root run completes when AutoCompactionEnabled is true.
 // Errors are logged but do not fail the run.
-func (w *streamingWorker[TTx]) checkAndCompact(ctx context.Context, sessionID uuid.UUID) {
-	compactor := w.client.getCompactor()
-	if compactor == nil {
-		return
-	}
+func (w *streamingWorker[TTx]) checkAndCompact(ctx context.Context, run *driver.Run) {
+	sessionID := run.SessionID
+	compactor := w.client.getCompactor(ctx, run)
 
 	needsCompaction, err := compactor.NeedsCompaction(ctx, sessionID)
 	if err != nil {
@@ -553,6 +574,13 @@ func (w *streamingWorker[TTx]) checkAndCompact(ctx context.Context, sessionID uu
 	)
 
 	result, err := compactor.Compact(ctx, sessionID)
+	if errors.Is(err, driver.ErrSessionBusy) {
+		// Another run of the session is in progress; a later run retries
+		w.client.log().Debug("auto-compaction skipped, session busy",
+			"session_id", sessionID,
+		)
+		return
+	}
 	if err != nil {
 		w.client.log().Warn("auto-compaction failed",
 			"session_id", sessionID,
@@ -566,5 +594,6 @@ func (w *streamingWorker[TTx]) checkAndCompact(ctx context.Context, sessionID uu
 		"original_tokens", result.OriginalTokens,
 		"compacted_tokens", result.CompactedTokens,
 		"messages_removed", result.MessagesRemoved,
+		"strategy", result.Strategy,
 	)
 }
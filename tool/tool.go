@@ -29,6 +29,17 @@ type Tool interface {
 	Execute(ctx context.Context, input json.RawMessage) (string, error)
 }
 
+// ConcurrencyLimiter is an optional interface for tools that cap how many of
+// their executions may run at once across all instances, e.g. to protect a
+// fragile downstream API. Executions over the cap stay pending until a
+// running one finishes. Tools called by runs made with Client.Invoke run
+// in-process and ignore the cap.
+type ConcurrencyLimiter interface {
+	// MaxConcurrency returns the fleet-wide cap on running executions.
+	// Zero means unlimited.
+	MaxConcurrency() int
+}
+
 // ToolSchema represents a JSON Schema for tool input.
 // The schema defines what parameters the tool accepts.
 type ToolSchema struct {
@@ -190,6 +201,8 @@ type FuncTool struct {
 	description string
 	schema      ToolSchema
 	execute     func(ctx context.Context, input json.RawMessage) (string, error)
+
+	maxConcurrency int
 }
 
 // NewFuncTool creates a new FuncTool with the given parameters.
@@ -222,6 +235,18 @@ func (t *FuncTool) InputSchema() ToolSchema {
 	return t.schema
 }
 
+// WithMaxConcurrency sets the fleet-wide cap on running executions of the
+// tool (zero means unlimited) and returns the tool.
+func (t *FuncTool) WithMaxConcurrency(n int) *FuncTool {
+	t.maxConcurrency = n
+	return t
+}
+
+// MaxConcurrency returns the fleet-wide cap on running executions.
+func (t *FuncTool) MaxConcurrency() int {
+	return t.maxConcurrency
+}
+
 // Execute runs the tool with the given input.
 func (t *FuncTool) Execute(ctx context.Context, input json.RawMessage) (string, error) {
 	return t.execute(ctx, input)
@@ -167,6 +167,9 @@ func (w *toolWorker[TTx]) executeAgentTool(ctx context.Context, exec *driver.Too
 	if err != nil {
 		return fmt.Errorf("failed to get parent run: %w", err)
 	}
+	if err := w.client.checkDepthLimit(parentRun.Depth + 1); err != nil {
+		return w.completeToolExecution(ctx, exec.ID, "", true, err.Error())
+	}
 
 	// Create child run (inherit run mode and variables from parent for consistent behavior)
 	childRun, err := store.CreateRun(ctx, driver.CreateRunParams{
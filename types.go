@@ -26,6 +26,10 @@ type Response struct {
 
 	// ToolIterations is the number of iterations that involved tool_use.
 	ToolIterations int
+
+	// Model is the Claude model that produced the final response.
+	// Differs from the agent's model when a fallback model was used.
+	Model string
 }
 
 // Usage contains token usage statistics from Claude API.
@@ -102,7 +106,7 @@ type Run struct {
 	SessionID uuid.UUID `json:"session_id"`
 	AgentID   uuid.UUID `json:"agent_id"`
 
-	// Run mode (batch or streaming API)
+	// Run mode (batch or streaming API, or auto to choose per iteration)
 	RunMode RunMode `json:"run_mode"`
 
 	// Hierarchical run support
@@ -148,6 +152,13 @@ type Run struct {
 	RescueAttempts int        `json:"rescue_attempts"`
 	LastRescueAt   *time.Time `json:"last_rescue_at,omitempty"`
 
+	// Deduplication (set via WithIdempotencyKey)
+	IdempotencyKey *string `json:"idempotency_key,omitempty"`
+
+	// API retry: earliest time the run may be claimed (later than CreatedAt when
+	// a failed API call is scheduled for retry)
+	ScheduledAt time.Time `json:"scheduled_at"`
+
 	// Metadata
 	Metadata map[string]any `json:"metadata,omitempty"`
 
@@ -177,6 +188,10 @@ type Session struct {
 	CompactionCount int            `json:"compaction_count"`
 	CreatedAt       time.Time      `json:"created_at"`
 	UpdatedAt       time.Time      `json:"updated_at"`
+
+	// ForkedFromMessageID is the message of the parent session this session
+	// was forked at. Nil if the session is not a fork.
+	ForkedFromMessageID *uuid.UUID `json:"forked_from_message_id,omitempty"`
 }
 
 // AgentDefinition defines an agent's configuration.
@@ -224,6 +239,25 @@ type AgentDefinition struct {
 	// Config holds additional settings as JSON.
 	Config map[string]any `json:"config,omitempty"`
 
+	// FallbackModels are tried in order when the primary model returns an
+	// overloaded or not-found error, or exceeds FallbackLatencyBudget,
+	// e.g. []string{"claude-haiku-4-5"} as a fallback for a Sonnet agent.
+	// The model actually used is recorded on each iteration and in Response.Model.
+	FallbackModels []string `json:"fallback_models,omitempty"`
+
+	// FallbackLatencyBudget is the maximum time to wait for the first
+	// streaming event before falling back to the next model (streaming only).
+	// Zero disables the latency budget.
+	FallbackLatencyBudget time.Duration `json:"fallback_latency_budget,omitempty"`
+
+	// MaxConcurrentRuns caps the runs of this agent in progress across all
+	// instances, e.g. to protect a fragile downstream API or an expensive model.
+	// Runs over the cap stay pending until a slot frees up. A run holds its
+	// slot from its first claim until it is finalized or awaits input.
+	// Runs made with Client.Invoke are not claimed and ignore the cap.
+	// Zero means unlimited.
+	MaxConcurrentRuns int `json:"max_concurrent_runs,omitempty"`
+
 	// Timestamps (populated from database)
 	CreatedAt time.Time `json:"created_at,omitempty"`
 	UpdatedAt time.Time `json:"updated_at,omitempty"`
@@ -258,6 +292,7 @@ type Iteration struct {
 	BatchExpiresAt   *time.Time   `json:"batch_expires_at,omitempty"`
 	BatchPollCount   int          `json:"batch_poll_count"`
 	BatchLastPollAt  *time.Time   `json:"batch_last_poll_at,omitempty"`
+	BatchNextPollAt  *time.Time   `json:"batch_next_poll_at,omitempty"`
 
 	// Streaming API tracking (only populated when IsStreaming = true)
 	StreamingStartedAt   *time.Time `json:"streaming_started_at,omitempty"`
@@ -283,12 +318,36 @@ type Iteration struct {
 	ErrorMessage *string `json:"error_message,omitempty"`
 	ErrorType    *string `json:"error_type,omitempty"`
 
+	// API retry tracking (failed API call attempts, oldest first)
+	APIAttempts []APIAttempt `json:"api_attempts,omitempty"`
+
+	// Model used for the API call (differs from the agent model on fallback)
+	Model *string `json:"model,omitempty"`
+
 	// Timestamps
 	CreatedAt   time.Time  `json:"created_at"`
 	StartedAt   *time.Time `json:"started_at,omitempty"`
 	CompletedAt *time.Time `json:"completed_at,omitempty"`
 }
 
+// APIAttempt records a failed Claude API call made for an iteration.
+// See APIRetryConfig.
+type APIAttempt struct {
+	Attempt    int        `json:"attempt"`               // 1-indexed attempt number within the iteration
+	ErrorType  string     `json:"error_type"`            // e.g. "rate_limit_error", "overloaded_error", "network_error"
+	StatusCode int        `json:"status_code,omitempty"` // HTTP status code, 0 for network errors
+	Message    string     `json:"message"`
+	Retryable  bool       `json:"retryable"`
+	RetryAt    *time.Time `json:"retry_at,omitempty"` // When the retry is scheduled (nil if not retried)
+	CreatedAt  time.Time  `json:"created_at"`
+	// Model fallback
+	Model         string `json:"model,omitempty"`          // Model the failed call was made with
+	FallbackModel string `json:"fallback_model,omitempty"` // Model the retry falls back to (empty for same-model retries)
+	// Batch recovery
+	BatchID         string `json:"batch_id,omitempty"`         // Batch whose request expired or errored, or whose results could not be downloaded
+	ResultsDownload bool   `json:"results_download,omitempty"` // The batch ended but downloading its results failed (the request was not resubmitted)
+}
+
 // Usage returns the token usage for this iteration.
 func (i *Iteration) Usage() Usage {
 	return Usage{
@@ -380,9 +439,82 @@ type CompactionEvent struct {
 	PreservedMessageIDs []uuid.UUID `json:"preserved_message_ids,omitempty"`
 	ModelUsed           *string     `json:"model_used,omitempty"`
 	DurationMS          *int64      `json:"duration_ms,omitempty"`
+	SummaryMessageID    *uuid.UUID  `json:"summary_message_id,omitempty"` // Message holding the summary (nil once restored)
+	RestoredAt          *time.Time  `json:"restored_at,omitempty"`        // When the compaction was undone
 	CreatedAt           time.Time   `json:"created_at"`
 }
 
+// ScheduleSpec describes a recurring agent run registered with Client.Schedule.
+type ScheduleSpec struct {
+	// Name uniquely identifies the schedule (required).
+	// Registering a spec with an existing name updates that schedule.
+	Name string `json:"name"`
+
+	// Cron is a five-field cron expression (minute hour day-of-month month day-of-week)
+	// or a descriptor such as "@hourly" or "@daily" (required).
+	Cron string `json:"cron"`
+
+	// Timezone is the IANA time zone the cron expression is evaluated in.
+	// Defaults to "UTC".
+	Timezone string `json:"timezone,omitempty"`
+
+	// AgentID is the agent to run on each tick (required).
+	AgentID uuid.UUID `json:"agent_id"`
+
+	// Prompt is the user prompt sent on each tick (required).
+	Prompt string `json:"prompt"`
+
+	// Variables are passed to tools via run metadata, like Run's variables.
+	// The keys "schedule_id" and "scheduled_at" are added to every run.
+	Variables map[string]any `json:"variables,omitempty"`
+
+	// RunMode selects the Batch or Streaming API for created runs, or
+	// RunModeAuto to choose per iteration. Defaults to RunModeBatch.
+	RunMode RunMode `json:"run_mode,omitempty"`
+
+	// SessionPolicy controls which session each run uses.
+	// Defaults to SessionPolicyNew.
+	SessionPolicy SessionPolicy `json:"session_policy,omitempty"`
+
+	// SessionID pins the session used by SessionPolicyReuse.
+	// If nil, a session is created on the first firing and reused afterwards.
+	SessionID *uuid.UUID `json:"session_id,omitempty"`
+
+	// SessionMetadata is attached to sessions created by the schedule.
+	SessionMetadata map[string]any `json:"session_metadata,omitempty"`
+
+	// CatchUp controls how ticks missed while no leader was running are handled.
+	// Defaults to CatchUpOnce.
+	CatchUp CatchUpPolicy `json:"catch_up,omitempty"`
+
+	// Metadata for multi-tenancy and filtering (tenant_id, etc.).
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// Schedule represents a registered recurring agent run.
+type Schedule struct {
+	ID              uuid.UUID      `json:"id"`
+	Name            string         `json:"name"`
+	AgentID         uuid.UUID      `json:"agent_id"`
+	Cron            string         `json:"cron"`
+	Timezone        string         `json:"timezone"`
+	CatchUp         CatchUpPolicy  `json:"catch_up"`
+	Paused          bool           `json:"paused"`
+	NextRunAt       time.Time      `json:"next_run_at"`
+	Prompt          string         `json:"prompt"`
+	Variables       map[string]any `json:"variables,omitempty"`
+	RunMode         RunMode        `json:"run_mode"`
+	SessionPolicy   SessionPolicy  `json:"session_policy"`
+	SessionID       *uuid.UUID     `json:"session_id,omitempty"`
+	SessionMetadata map[string]any `json:"session_metadata,omitempty"`
+	LastRunAt       *time.Time     `json:"last_run_at,omitempty"`
+	LastRunID       *uuid.UUID     `json:"last_run_id,omitempty"`
+	FireCount       int64          `json:"fire_count"`
+	Metadata        map[string]any `json:"metadata,omitempty"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+}
+
 // Helper functions for working with pointers
 
 // Ptr returns a pointer to the given value.
@@ -0,0 +1,197 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/youssefsiam38/agentpg/ui/frontend"
+)
+
+// Role determines which actions a user may perform in the UI.
+// Each role includes the permissions of the roles below it.
+type Role int
+
+const (
+	// RoleViewer can browse every page but cannot change anything.
+	RoleViewer Role = iota
+
+	// RoleOperator can also chat with agents, which creates sessions and runs.
+	RoleOperator
+
+	// RoleAdmin can also perform management actions such as cancelling and
+	// retrying runs and pausing or resuming schedules.
+	RoleAdmin
+)
+
+// String returns the lowercase role name.
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+}
+
+// valid reports whether r is a known role.
+func (r Role) valid() bool {
+	return r >= RoleViewer && r <= RoleAdmin
+}
+
+// ParseRole parses a role name ("viewer", "operator" or "admin"), ignoring case.
+func ParseRole(s string) (Role, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return 0, fmt.Errorf("ui: unknown role %q", s)
+	}
+}
+
+// Identity is the authenticated user behind a request.
+type Identity struct {
+	// Subject is a stable identifier for the user.
+	Subject string
+
+	// Name is shown in the UI. Defaults to Subject.
+	Name string
+
+	// Role determines which actions the user may perform.
+	Role Role
+
+	// MetadataFilter restricts the user to sessions whose metadata contains
+	// these key-value pairs, e.g. map[string]any{"tenant_id": "acme"}.
+	// It is merged with Config.MetadataFilter; conflicting values deny access.
+	MetadataFilter map[string]any
+}
+
+// Authenticator identifies the user behind a request.
+//
+// Authenticate returns ErrUnauthenticated (possibly wrapped) when the request
+// carries no valid credentials, and ErrForbidden when the user is known but
+// not allowed to use the UI. Any other error is also treated as a failed
+// authentication.
+//
+// Built-in implementations are BasicAuth, JWTAuth and ProxyAuth.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Challenger is implemented by authenticators that can ask the client for
+// credentials, e.g. by setting a WWW-Authenticate header on 401 responses.
+type Challenger interface {
+	Challenge(w http.ResponseWriter, r *http.Request)
+}
+
+// resolveRole picks the highest role that values map to.
+// If roles is nil, values are parsed as role names.
+// Without a match, defaultRole is used unless requireRole is set.
+func resolveRole(values []string, roles map[string]Role, defaultRole Role, requireRole bool) (Role, error) {
+	best, found := Role(0), false
+	for _, v := range values {
+		var role Role
+		var ok bool
+		if roles != nil {
+			role, ok = roles[v]
+		} else {
+			var err error
+			role, err = ParseRole(v)
+			ok = err == nil
+		}
+		if ok && (!found || role > best) {
+			best, found = role, true
+		}
+	}
+	if found {
+		return best, nil
+	}
+	if requireRole {
+		return 0, fmt.Errorf("%w: no role granted", ErrForbidden)
+	}
+	return defaultRole, nil
+}
+
+// mergeMetadataFilter combines the configured filter with the identity's scope.
+// A key present in both with different values is an error.
+func mergeMetadataFilter(base, scope map[string]any) (map[string]any, error) {
+	if len(scope) == 0 {
+		return base, nil
+	}
+	merged := make(map[string]any, len(base)+len(scope))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range scope {
+		if existing, ok := merged[k]; ok && !reflect.DeepEqual(existing, v) {
+			return nil, fmt.Errorf("%w: metadata %q is outside the configured filter", ErrForbidden, k)
+		}
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// authMiddleware authenticates every request and attaches the resulting
+// access to the request context for the frontend.
+func authMiddleware(next http.Handler, auth Authenticator, cfg *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := auth.Authenticate(r)
+		if err == nil && identity == nil {
+			err = ErrUnauthenticated
+		}
+		if err == nil && !identity.Role.valid() {
+			err = fmt.Errorf("%w: invalid role %s", ErrForbidden, identity.Role)
+		}
+
+		var filter map[string]any
+		if err == nil {
+			filter, err = mergeMetadataFilter(cfg.MetadataFilter, identity.MetadataFilter)
+		}
+
+		if err != nil {
+			if cfg.Logger != nil {
+				cfg.Logger.Debug("ui authentication failed", "error", err.Error(), "path", r.URL.Path)
+			}
+			if errors.Is(err, ErrForbidden) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if challenger, ok := auth.(Challenger); ok {
+				challenger.Challenge(w, r)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		name := identity.Name
+		if name == "" {
+			name = identity.Subject
+		}
+		access := &frontend.Access{
+			User:           name,
+			Role:           identity.Role.String(),
+			CanChat:        identity.Role >= RoleOperator,
+			CanManage:      identity.Role >= RoleAdmin,
+			MetadataFilter: filter,
+		}
+		next.ServeHTTP(w, r.WithContext(frontend.WithAccess(r.Context(), access)))
+	})
+}
+
+// stringOrDefault returns s, or def if s is empty.
+func stringOrDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
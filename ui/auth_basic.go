@@ -0,0 +1,97 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultBasicAuthRealm is the realm sent in WWW-Authenticate challenges.
+const DefaultBasicAuthRealm = "AgentPG"
+
+// BasicAuth authenticates requests with HTTP basic authentication.
+//
+// Users are looked up in Users first; unknown usernames are passed to
+// Validate when it is set. Browsers prompt for credentials on their own,
+// so no login page is needed.
+//
+//	auth := &ui.BasicAuth{
+//	    Users: map[string]ui.BasicAuthUser{
+//	        "alice": {PasswordHash: "$2a$10$...", Role: ui.RoleAdmin},
+//	        "bob":   {PasswordHash: "$2a$10$...", Role: ui.RoleViewer,
+//	            MetadataFilter: map[string]any{"tenant_id": "acme"}},
+//	    },
+//	}
+type BasicAuth struct {
+	// Realm is sent in the WWW-Authenticate challenge.
+	// Defaults to "AgentPG".
+	Realm string
+
+	// Users maps usernames to their credentials and permissions.
+	Users map[string]BasicAuthUser
+
+	// Validate checks credentials for usernames not found in Users.
+	// It returns ErrUnauthenticated for invalid credentials.
+	Validate func(ctx context.Context, username, password string) (*Identity, error)
+}
+
+// BasicAuthUser is a statically configured basic auth user.
+type BasicAuthUser struct {
+	// PasswordHash is the bcrypt hash of the user's password.
+	PasswordHash string
+
+	// Role determines which actions the user may perform.
+	Role Role
+
+	// MetadataFilter restricts the user to matching sessions.
+	MetadataFilter map[string]any
+}
+
+var _ Challenger = (*BasicAuth)(nil)
+
+// dummyPasswordHash is compared against for unknown users so that response
+// times do not reveal which usernames exist.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("agentpg"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Authenticate implements Authenticator.
+func (a *BasicAuth) Authenticate(r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	user, ok := a.Users[username]
+	if !ok {
+		if a.Validate != nil {
+			return a.Validate(r.Context(), username, password)
+		}
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, fmt.Errorf("%w: unknown user %q", ErrUnauthenticated, username)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, fmt.Errorf("%w: invalid password for %q", ErrUnauthenticated, username)
+	}
+
+	return &Identity{
+		Subject:        username,
+		Role:           user.Role,
+		MetadataFilter: user.MetadataFilter,
+	}, nil
+}
+
+// Challenge implements Challenger.
+func (a *BasicAuth) Challenge(w http.ResponseWriter, _ *http.Request) {
+	realm := a.Realm
+	if realm == "" {
+		realm = DefaultBasicAuthRealm
+	}
+	w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(realm)+`, charset="UTF-8"`)
+}
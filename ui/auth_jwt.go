@@ -0,0 +1,562 @@
+package ui
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// JWTAuth defaults.
+const (
+	DefaultJWTLeeway           = time.Minute
+	DefaultJWKSRefreshInterval = time.Hour
+	DefaultJWTRoleClaim        = "roles"
+
+	// jwksMinRefetchInterval limits refetches triggered by unknown key IDs.
+	jwksMinRefetchInterval = time.Minute
+
+	// jwksFetchTimeout bounds a key set fetch, which is shared by every
+	// request waiting on it and so does not use any one request's context.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// JWTAuth authenticates requests carrying a signed JWT, such as an OIDC ID
+// token or access token forwarded by a gateway.
+//
+// Signatures are verified with keys from JWKSURL, from the JWKS advertised by
+// Issuer's OpenID discovery document, or with Secret for HMAC-signed tokens.
+// RS*, PS* and ES* algorithms are accepted with JWKS keys; HS* only with Secret.
+// Audience is required, so that tokens issued to other applications by the
+// same issuer are not accepted.
+//
+// Verification uses only the standard library's crypto packages, keeping the
+// ui package free of JOSE dependencies. It is deliberately narrow: compact
+// JWS only (no JWE, no embedded or URL-referenced keys in the header), a
+// fixed allow-list of algorithms that never includes "none", and HMAC and
+// public-key algorithms are never accepted by the same configuration.
+//
+//	auth := &ui.JWTAuth{
+//	    Issuer:       "https://accounts.example.com",
+//	    Audience:     "agentpg-admin",
+//	    Roles:        map[string]ui.Role{"agentpg-admins": ui.RoleAdmin},
+//	    TenantClaims: map[string]string{"tenant_id": "org_id"},
+//	}
+type JWTAuth struct {
+	// Header carries the token. Defaults to "Authorization", which must use
+	// the "Bearer" scheme. Other headers carry the raw token.
+	Header string
+
+	// Issuer is the expected "iss" claim. When JWKSURL and Secret are empty,
+	// keys are discovered from Issuer + "/.well-known/openid-configuration".
+	Issuer string
+
+	// Audience is the expected "aud" claim. Required.
+	Audience string
+
+	// JWKSURL is the URL of the JSON Web Key Set used to verify signatures.
+	JWKSURL string
+
+	// Secret verifies HMAC-signed (HS256/HS384/HS512) tokens.
+	Secret []byte
+
+	// SubjectClaim identifies the user. Defaults to "sub".
+	SubjectClaim string
+
+	// NameClaim is shown in the UI. Defaults to "email", then the subject.
+	NameClaim string
+
+	// RoleClaim holds a role name or a list of group names.
+	// Defaults to "roles".
+	RoleClaim string
+
+	// Roles maps RoleClaim values to roles; the highest matching role wins.
+	// If nil, values are parsed as role names ("viewer", "operator", "admin").
+	Roles map[string]Role
+
+	// DefaultRole is used when no claim value maps to a role.
+	DefaultRole Role
+
+	// RequireRole rejects tokens whose claims map to no role instead of
+	// falling back to DefaultRole.
+	RequireRole bool
+
+	// TenantClaims maps session metadata keys to the claims carrying their
+	// values. Each claim must be present; its value becomes part of the
+	// user's MetadataFilter.
+	TenantClaims map[string]string
+
+	// Leeway allows for clock skew when checking exp and nbf.
+	// Defaults to 1 minute.
+	Leeway time.Duration
+
+	// JWKSRefreshInterval controls how long fetched keys are cached.
+	// Defaults to 1 hour.
+	JWKSRefreshInterval time.Duration
+
+	// HTTPClient fetches discovery documents and key sets.
+	// Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	jwksURL   string
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	fetches   singleflight.Group
+}
+
+var _ Challenger = (*JWTAuth)(nil)
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Authenticate implements Authenticator.
+func (a *JWTAuth) Authenticate(r *http.Request) (*Identity, error) {
+	token, err := a.token(r)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := a.verify(r.Context(), token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	subject := claimString(claims, stringOrDefault(a.SubjectClaim, "sub"))
+	if subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+	name := claimString(claims, stringOrDefault(a.NameClaim, "email"))
+
+	role, err := resolveRole(claimStrings(claims, stringOrDefault(a.RoleClaim, DefaultJWTRoleClaim)), a.Roles, a.DefaultRole, a.RequireRole)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter map[string]any
+	if len(a.TenantClaims) > 0 {
+		filter = make(map[string]any, len(a.TenantClaims))
+		for key, claim := range a.TenantClaims {
+			value, ok := claims[claim]
+			if !ok || value == nil || value == "" {
+				return nil, fmt.Errorf("%w: missing tenant claim %s", ErrForbidden, claim)
+			}
+			filter[key] = value
+		}
+	}
+
+	return &Identity{
+		Subject:        subject,
+		Name:           name,
+		Role:           role,
+		MetadataFilter: filter,
+	}, nil
+}
+
+// Challenge implements Challenger.
+func (a *JWTAuth) Challenge(w http.ResponseWriter, _ *http.Request) {
+	if a.Header == "" || strings.EqualFold(a.Header, "Authorization") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+}
+
+// token extracts the raw token from the request.
+func (a *JWTAuth) token(r *http.Request) (string, error) {
+	if a.Header != "" && !strings.EqualFold(a.Header, "Authorization") {
+		if token := strings.TrimSpace(r.Header.Get(a.Header)); token != "" {
+			return token, nil
+		}
+		return "", ErrUnauthenticated
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", ErrUnauthenticated
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// verify checks the token's signature and standard claims and returns its claims.
+func (a *JWTAuth) verify(ctx context.Context, token string) (map[string]any, error) {
+	if a.Audience == "" {
+		return nil, errors.New("no Audience configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	if err := a.verifySignature(ctx, header, signed, signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if err := a.validateClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature checks the signature with the key for the header's algorithm.
+func (a *JWTAuth) verifySignature(ctx context.Context, header jwtHeader, signed, signature []byte) error {
+	if len(header.Alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	hash, ok := jwtHashes[header.Alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	// HMAC and public-key algorithms never share keys, which rules out
+	// algorithm confusion attacks.
+	if strings.HasPrefix(header.Alg, "HS") {
+		if len(a.Secret) == 0 {
+			return fmt.Errorf("algorithm %s requires a secret", header.Alg)
+		}
+		mac := hmac.New(hash.New, a.Secret)
+		mac.Write(signed)
+		if subtle.ConstantTimeCompare(mac.Sum(nil), signature) != 1 {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	if len(a.Secret) > 0 {
+		return fmt.Errorf("algorithm %s not allowed with a secret", header.Alg)
+	}
+
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch header.Alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %q is not an RSA key", header.Kid)
+		}
+		if header.Alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return errors.New("invalid signature")
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %q is not an EC key", header.Kid)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	return nil
+}
+
+// jwtHashes maps algorithm suffixes to hash functions.
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// validateClaims checks the time, issuer and audience claims.
+func (a *JWTAuth) validateClaims(claims map[string]any, now time.Time) error {
+	leeway := a.Leeway
+	if leeway == 0 {
+		leeway = DefaultJWTLeeway
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+
+	if a.Issuer != "" && claimString(claims, "iss") != a.Issuer {
+		return fmt.Errorf("unexpected issuer %q", claimString(claims, "iss"))
+	}
+	for _, aud := range claimStrings(claims, "aud") {
+		if aud == a.Audience {
+			return nil
+		}
+	}
+	return errors.New("token not issued for this audience")
+}
+
+// key returns the verification key with the given ID, fetching the key set
+// when the cache is empty, stale, or does not know the key.
+func (a *JWTAuth) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	refresh := a.JWKSRefreshInterval
+	if refresh == 0 {
+		refresh = DefaultJWKSRefreshInterval
+	}
+
+	a.mu.Lock()
+	cached := a.keys != nil
+	age := time.Since(a.fetchedAt)
+	a.mu.Unlock()
+
+	if !cached || age > refresh {
+		// Keep using stale keys if the issuer is temporarily unreachable
+		if err := a.fetchKeys(ctx); err != nil && !cached {
+			return nil, err
+		}
+	}
+
+	key, ok, age := a.lookupKey(kid)
+	if !ok && age > jwksMinRefetchInterval {
+		// The issuer may have rotated its keys
+		if err := a.fetchKeys(ctx); err != nil {
+			return nil, err
+		}
+		key, ok, _ = a.lookupKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// lookupKey finds a cached key and reports the age of the cache. Tokens
+// without a key ID match a sole key.
+func (a *JWTAuth) lookupKey(kid string) (crypto.PublicKey, bool, time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	age := time.Since(a.fetchedAt)
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true, age
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok, age
+}
+
+// fetchKeys downloads and parses the key set. Concurrent callers share one
+// fetch, and a.mu is not held while it talks to the issuer.
+func (a *JWTAuth) fetchKeys(ctx context.Context) error {
+	_, err, _ := a.fetches.Do("jwks", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+		defer cancel()
+
+		a.mu.Lock()
+		jwksURL := a.jwksURL
+		a.mu.Unlock()
+
+		if jwksURL == "" {
+			jwksURL = a.JWKSURL
+		}
+		if jwksURL == "" {
+			if a.Issuer == "" {
+				return nil, errors.New("no JWKSURL, Issuer or Secret configured")
+			}
+			var discovery struct {
+				JWKSURI string `json:"jwks_uri"`
+			}
+			if err := a.getJSON(ctx, strings.TrimSuffix(a.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+				return nil, fmt.Errorf("openid discovery: %w", err)
+			}
+			if discovery.JWKSURI == "" {
+				return nil, errors.New("openid discovery: no jwks_uri")
+			}
+			jwksURL = discovery.JWKSURI
+		}
+
+		var set struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		if err := a.getJSON(ctx, jwksURL, &set); err != nil {
+			return nil, fmt.Errorf("fetch jwks: %w", err)
+		}
+
+		keys := make(map[string]crypto.PublicKey, len(set.Keys))
+		for _, jwk := range set.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			key, err := jwk.publicKey()
+			if err != nil {
+				continue // Skip key types we cannot use
+			}
+			keys[jwk.Kid] = key
+		}
+
+		a.mu.Lock()
+		a.jwksURL = jwksURL
+		a.keys = keys
+		a.fetchedAt = time.Now()
+		a.mu.Unlock()
+		return nil, nil
+	})
+	return err
+}
+
+// getJSON fetches url and decodes the JSON response into v.
+func (a *JWTAuth) getJSON(ctx context.Context, url string, v any) error {
+	client := a.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is a public key from a JWKS document.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey converts the JWK into an RSA or ECDSA public key.
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC point")
+		}
+		// Reject points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// decodeSegment decodes a base64url JSON segment of a token.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimString returns a string claim, or "" if missing or not a string.
+func claimString(claims map[string]any, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// claimStrings returns a claim that is a string or a list of strings.
+func claimStrings(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
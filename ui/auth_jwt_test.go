@@ -0,0 +1,243 @@
+package ui
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "agentpg-admin"
+	testKeyID    = "key-1"
+)
+
+// testIssuerServer serves a JWKS with one RSA key and counts fetches.
+type testIssuerServer struct {
+	key     *rsa.PrivateKey
+	fetches atomic.Int32
+	server  *httptest.Server
+}
+
+func newTestIssuerServer(t *testing.T) *testIssuerServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	s := &testIssuerServer{key: key}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		time.Sleep(10 * time.Millisecond) // Let concurrent callers pile up
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": testKeyID,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *testIssuerServer) auth() *JWTAuth {
+	return &JWTAuth{Issuer: testIssuer, Audience: testAudience, JWKSURL: s.server.URL}
+}
+
+// validClaims returns claims that pass validation.
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"sub":   "user-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": "admin",
+	}
+}
+
+// encodeToken returns the unsigned "header.claims" part of a token.
+func encodeToken(t *testing.T, header, claims map[string]any) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	signed := encodeToken(t, map[string]any{"alg": "RS256", "kid": kid, "typ": "JWT"}, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signHS256(t *testing.T, secret []byte, claims map[string]any) string {
+	t.Helper()
+	signed := encodeToken(t, map[string]any{"alg": "HS256", "kid": testKeyID, "typ": "JWT"}, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func authenticate(auth *JWTAuth, token string) (*Identity, error) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return auth.Authenticate(r)
+}
+
+func TestJWTAuthValidToken(t *testing.T) {
+	issuer := newTestIssuerServer(t)
+	identity, err := authenticate(issuer.auth(), signRS256(t, issuer.key, testKeyID, validClaims()))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if identity.Subject != "user-1" || identity.Role != RoleAdmin {
+		t.Errorf("identity = %+v, want user-1 as admin", identity)
+	}
+}
+
+func TestJWTAuthRejects(t *testing.T) {
+	issuer := newTestIssuerServer(t)
+	publicKey, err := x509.MarshalPKIXPublicKey(&issuer.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(key string, value any) map[string]any {
+		claims := validClaims()
+		claims[key] = value
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		auth  func() *JWTAuth
+		token string
+	}{
+		{
+			name:  "alg none",
+			auth:  issuer.auth,
+			token: encodeToken(t, map[string]any{"alg": "none", "typ": "JWT"}, validClaims()) + ".",
+		},
+		{
+			// An HMAC token keyed with the issuer's public key must not be
+			// verified against that key.
+			name:  "alg confusion",
+			auth:  issuer.auth,
+			token: signHS256(t, publicKey, validClaims()),
+		},
+		{
+			name: "RS256 with a secret configured",
+			auth: func() *JWTAuth {
+				auth := issuer.auth()
+				auth.Secret = []byte("secret")
+				return auth
+			},
+			token: signRS256(t, issuer.key, testKeyID, validClaims()),
+		},
+		{
+			name:  "expired",
+			auth:  issuer.auth,
+			token: signRS256(t, issuer.key, testKeyID, with("exp", time.Now().Add(-time.Hour).Unix())),
+		},
+		{
+			name:  "no expiry",
+			auth:  issuer.auth,
+			token: signRS256(t, issuer.key, testKeyID, with("exp", nil)),
+		},
+		{
+			name:  "not yet valid",
+			auth:  issuer.auth,
+			token: signRS256(t, issuer.key, testKeyID, with("nbf", time.Now().Add(time.Hour).Unix())),
+		},
+		{
+			name:  "wrong issuer",
+			auth:  issuer.auth,
+			token: signRS256(t, issuer.key, testKeyID, with("iss", "https://evil.example.com")),
+		},
+		{
+			name:  "wrong audience",
+			auth:  issuer.auth,
+			token: signRS256(t, issuer.key, testKeyID, with("aud", "another-app")),
+		},
+		{
+			name: "no audience configured",
+			auth: func() *JWTAuth {
+				auth := issuer.auth()
+				auth.Audience = ""
+				return auth
+			},
+			token: signRS256(t, issuer.key, testKeyID, validClaims()),
+		},
+		{
+			name:  "unknown kid",
+			auth:  issuer.auth,
+			token: signRS256(t, issuer.key, "key-2", validClaims()),
+		},
+		{
+			name: "bad signature",
+			auth: issuer.auth,
+			token: func() string {
+				other, err := rsa.GenerateKey(rand.Reader, 2048)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signRS256(t, other, testKeyID, validClaims())
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := authenticate(tt.auth(), tt.token)
+			if !errors.Is(err, ErrUnauthenticated) {
+				t.Errorf("Authenticate error = %v, want ErrUnauthenticated", err)
+			}
+		})
+	}
+}
+
+func TestJWTAuthSharesKeyFetches(t *testing.T) {
+	issuer := newTestIssuerServer(t)
+	auth := issuer.auth()
+	token := signRS256(t, issuer.key, testKeyID, validClaims())
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := authenticate(auth, token); err != nil {
+				t.Errorf("Authenticate: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := issuer.fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+}
@@ -0,0 +1,111 @@
+package ui
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Default trusted-proxy header names.
+const (
+	DefaultProxyUserHeader   = "X-Forwarded-User"
+	DefaultProxyGroupsHeader = "X-Forwarded-Groups"
+)
+
+// ProxyAuth trusts identity headers set by an authenticating reverse proxy,
+// such as oauth2-proxy, Pomerium or an identity-aware load balancer.
+//
+// The proxy must strip these headers from client requests. Set
+// TrustedProxies so that requests reaching the UI directly are rejected.
+//
+//	auth := &ui.ProxyAuth{
+//	    TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+//	    Roles:          map[string]ui.Role{"sre": ui.RoleAdmin, "support": ui.RoleOperator},
+//	    TenantHeaders:  map[string]string{"tenant_id": "X-Forwarded-Tenant"},
+//	}
+type ProxyAuth struct {
+	// UserHeader carries the authenticated username.
+	// Defaults to "X-Forwarded-User".
+	UserHeader string
+
+	// GroupsHeader carries a comma-separated list of the user's groups.
+	// Defaults to "X-Forwarded-Groups".
+	GroupsHeader string
+
+	// Roles maps group names to roles; the highest matching role wins.
+	// If nil, group names are parsed as role names ("viewer", "operator", "admin").
+	Roles map[string]Role
+
+	// DefaultRole is used when no group maps to a role.
+	DefaultRole Role
+
+	// RequireRole rejects users whose groups map to no role instead of
+	// falling back to DefaultRole.
+	RequireRole bool
+
+	// TenantHeaders maps session metadata keys to the headers carrying their
+	// values. Each header must be present and non-empty; its value becomes
+	// part of the user's MetadataFilter.
+	TenantHeaders map[string]string
+
+	// TrustedProxies lists the networks the proxy connects from.
+	// If empty, requests from any address are accepted.
+	TrustedProxies []netip.Prefix
+}
+
+// Authenticate implements Authenticator.
+func (a *ProxyAuth) Authenticate(r *http.Request) (*Identity, error) {
+	if len(a.TrustedProxies) > 0 && !a.trusted(r.RemoteAddr) {
+		return nil, fmt.Errorf("%w: request from untrusted address %s", ErrUnauthenticated, r.RemoteAddr)
+	}
+
+	user := strings.TrimSpace(r.Header.Get(stringOrDefault(a.UserHeader, DefaultProxyUserHeader)))
+	if user == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	var groups []string
+	for _, g := range strings.Split(r.Header.Get(stringOrDefault(a.GroupsHeader, DefaultProxyGroupsHeader)), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	role, err := resolveRole(groups, a.Roles, a.DefaultRole, a.RequireRole)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter map[string]any
+	if len(a.TenantHeaders) > 0 {
+		filter = make(map[string]any, len(a.TenantHeaders))
+		for key, header := range a.TenantHeaders {
+			value := strings.TrimSpace(r.Header.Get(header))
+			if value == "" {
+				return nil, fmt.Errorf("%w: missing tenant header %s", ErrForbidden, header)
+			}
+			filter[key] = value
+		}
+	}
+
+	return &Identity{
+		Subject:        user,
+		Role:           role,
+		MetadataFilter: filter,
+	}, nil
+}
+
+// trusted reports whether the connection comes from a trusted proxy.
+func (a *ProxyAuth) trusted(remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range a.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
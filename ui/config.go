@@ -35,6 +35,12 @@ type Config struct {
 	// Useful for monitoring-only deployments.
 	ReadOnly bool
 
+	// Authenticator identifies the user behind each request.
+	// The user's role gates chat and management actions, and their
+	// MetadataFilter is merged into the filter above.
+	// If nil, every request has full access (subject to ReadOnly).
+	Authenticator Authenticator
+
 	// Logger for structured logging.
 	// If nil, logging is disabled.
 	Logger Logger
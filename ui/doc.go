@@ -35,6 +35,28 @@
 //	    PageSize:        25,
 //	}
 //
+// # Authentication
+//
+// Set Config.Authenticator to authenticate every request. Built-in
+// implementations cover HTTP basic auth (BasicAuth), signed OIDC/JWT tokens
+// (JWTAuth) and identity headers from a trusted proxy (ProxyAuth):
+//
+//	cfg := &ui.Config{
+//	    Authenticator: &ui.JWTAuth{
+//	        Issuer:       "https://accounts.example.com",
+//	        Audience:     "agentpg-admin",
+//	        TenantClaims: map[string]string{"tenant_id": "org_id"},
+//	    },
+//	}
+//
+// Each Identity carries a Role: RoleViewer can browse, RoleOperator can also
+// chat, and RoleAdmin can also cancel or retry runs and pause schedules. The
+// identity's MetadataFilter scopes the user to matching sessions on top of
+// Config.MetadataFilter.
+//
+// All POST routes are protected against CSRF with a double-submit cookie,
+// whether or not an Authenticator is configured.
+//
 // # Framework Integration
 //
 // The handler returns standard http.Handler, compatible with any Go framework:
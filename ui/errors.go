@@ -18,4 +18,10 @@ var (
 
 	// ErrClientRequired indicates a client is required for the operation.
 	ErrClientRequired = errors.New("ui: client required for chat operations")
+
+	// ErrUnauthenticated indicates the request carries no valid credentials.
+	ErrUnauthenticated = errors.New("ui: unauthenticated")
+
+	// ErrForbidden indicates the user is authenticated but not allowed to use the UI.
+	ErrForbidden = errors.New("ui: forbidden")
 )
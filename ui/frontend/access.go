@@ -0,0 +1,111 @@
+package frontend
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/ui/service"
+)
+
+// Access describes what the current request may see and do.
+// The ui package attaches it to the request context after authentication.
+// Requests without Access are treated as fully privileged, scoped by
+// Config.MetadataFilter and limited by Config.ReadOnly.
+type Access struct {
+	// User is the display name of the authenticated user.
+	User string
+
+	// Role is the role name shown in the sidebar.
+	Role string
+
+	// CanChat allows creating sessions and sending messages.
+	CanChat bool
+
+	// CanManage allows management actions such as pausing schedules.
+	CanManage bool
+
+	// MetadataFilter is the effective tenant scope for this request.
+	// It replaces Config.MetadataFilter.
+	MetadataFilter map[string]any
+}
+
+type accessContextKey struct{}
+
+// WithAccess returns a copy of ctx carrying the request's access.
+func WithAccess(ctx context.Context, access *Access) context.Context {
+	return context.WithValue(ctx, accessContextKey{}, access)
+}
+
+// accessFromContext returns the access stored in ctx, or nil.
+func accessFromContext(ctx context.Context) *Access {
+	access, _ := ctx.Value(accessContextKey{}).(*Access)
+	return access
+}
+
+// access returns the access for the request, defaulting to full access
+// scoped by the configured metadata filter.
+func (rt *router[TTx]) access(r *http.Request) *Access {
+	if access := accessFromContext(r.Context()); access != nil {
+		return access
+	}
+	return &Access{
+		CanChat:        true,
+		CanManage:      true,
+		MetadataFilter: rt.config.MetadataFilter,
+	}
+}
+
+// metadataFilter returns the tenant scope for the request.
+func (rt *router[TTx]) metadataFilter(r *http.Request) map[string]any {
+	return rt.access(r).MetadataFilter
+}
+
+// canChat reports whether the request may create sessions and send messages.
+func (rt *router[TTx]) canChat(r *http.Request) bool {
+	return !rt.config.ReadOnly && rt.client != nil && rt.access(r).CanChat
+}
+
+// canManage reports whether the request may perform management actions.
+func (rt *router[TTx]) canManage(r *http.Request) bool {
+	return !rt.config.ReadOnly && rt.client != nil && rt.access(r).CanManage
+}
+
+// canManageFleet reports whether the request may perform management actions
+// that affect all tenants, such as releasing leadership.
+func (rt *router[TTx]) canManageFleet(r *http.Request) bool {
+	return rt.canManage(r) && len(rt.metadataFilter(r)) == 0
+}
+
+// sessionInScope reports whether the session is visible to the request.
+// Sessions outside the tenant scope are reported as not found so that their
+// existence is not revealed.
+func (rt *router[TTx]) sessionInScope(w http.ResponseWriter, r *http.Request, sessionID uuid.UUID) bool {
+	ok, err := rt.svc.SessionMatchesMetadata(r.Context(), sessionID, rt.metadataFilter(r))
+	if err != nil || !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// scheduleInScope reports whether the schedule is visible to the request.
+func (rt *router[TTx]) scheduleInScope(r *http.Request, id uuid.UUID) bool {
+	filter := rt.metadataFilter(r)
+	if len(filter) == 0 {
+		return true
+	}
+	schedule, err := rt.svc.Store().GetSchedule(r.Context(), id)
+	if err != nil {
+		return false
+	}
+	return service.MatchesMetadata(schedule.Metadata, filter)
+}
+
+// agentInScope reports whether the agent may be edited by the request.
+// Agents are listed for everyone, but tenant-scoped users only manage the
+// agents whose metadata matches their scope.
+func (rt *router[TTx]) agentInScope(r *http.Request, agent *driver.AgentDefinition) bool {
+	return service.MatchesMetadata(agent.Metadata, rt.metadataFilter(r))
+}
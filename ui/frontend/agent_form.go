@@ -0,0 +1,145 @@
+package frontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/youssefsiam38/agentpg/driver"
+	"github.com/youssefsiam38/agentpg/ui/service"
+)
+
+// agentForm holds the values of the agent form as entered, so that the form
+// can be shown again with its problems.
+type agentForm struct {
+	Name         string
+	Description  string
+	Model        string
+	SystemPrompt string
+	Tools        map[string]bool
+	AgentIDs     map[string]bool
+	MaxTokens    string
+	Temperature  string
+	TopK         string
+	TopP         string
+	Metadata     string
+}
+
+// newAgentForm returns the form values for an existing agent.
+func newAgentForm(agent *driver.AgentDefinition) *agentForm {
+	form := &agentForm{
+		Name:         agent.Name,
+		Description:  agent.Description,
+		Model:        agent.Model,
+		SystemPrompt: agent.SystemPrompt,
+		Tools:        make(map[string]bool, len(agent.ToolNames)),
+		AgentIDs:     make(map[string]bool, len(agent.AgentIDs)),
+	}
+	for _, name := range agent.ToolNames {
+		form.Tools[name] = true
+	}
+	for _, id := range agent.AgentIDs {
+		form.AgentIDs[id.String()] = true
+	}
+	if agent.MaxTokens != nil {
+		form.MaxTokens = strconv.Itoa(*agent.MaxTokens)
+	}
+	if agent.Temperature != nil {
+		form.Temperature = strconv.FormatFloat(*agent.Temperature, 'g', -1, 64)
+	}
+	if agent.TopK != nil {
+		form.TopK = strconv.Itoa(*agent.TopK)
+	}
+	if agent.TopP != nil {
+		form.TopP = strconv.FormatFloat(*agent.TopP, 'g', -1, 64)
+	}
+	if len(agent.Metadata) > 0 {
+		if data, err := json.MarshalIndent(agent.Metadata, "", "  "); err == nil {
+			form.Metadata = string(data)
+		}
+	}
+	return form
+}
+
+// parseAgentForm reads the submitted agent form. Values that cannot be
+// parsed are reported as problems.
+func parseAgentForm(r *http.Request) (*agentForm, service.AgentInput, []string) {
+	form := &agentForm{
+		Name:         r.PostFormValue("name"),
+		Description:  r.PostFormValue("description"),
+		Model:        r.PostFormValue("model"),
+		SystemPrompt: strings.ReplaceAll(r.PostFormValue("system_prompt"), "\r\n", "\n"),
+		Tools:        make(map[string]bool),
+		AgentIDs:     make(map[string]bool),
+		MaxTokens:    strings.TrimSpace(r.PostFormValue("max_tokens")),
+		Temperature:  strings.TrimSpace(r.PostFormValue("temperature")),
+		TopK:         strings.TrimSpace(r.PostFormValue("top_k")),
+		TopP:         strings.TrimSpace(r.PostFormValue("top_p")),
+		Metadata:     strings.TrimSpace(r.PostFormValue("metadata")),
+	}
+	input := service.AgentInput{
+		Name:         form.Name,
+		Description:  form.Description,
+		Model:        form.Model,
+		SystemPrompt: form.SystemPrompt,
+	}
+	var problems []string
+
+	for _, name := range r.PostForm["tools"] {
+		form.Tools[name] = true
+		input.ToolNames = append(input.ToolNames, name)
+	}
+	for _, value := range r.PostForm["agent_ids"] {
+		form.AgentIDs[value] = true
+		id, err := parseUUID(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid delegate agent ID %q", value))
+			continue
+		}
+		input.AgentIDs = append(input.AgentIDs, id)
+	}
+
+	var err error
+	if input.MaxTokens, err = parseOptionalInt(form.MaxTokens); err != nil {
+		problems = append(problems, "max tokens must be a whole number")
+	}
+	if input.Temperature, err = parseOptionalFloat(form.Temperature); err != nil {
+		problems = append(problems, "temperature must be a number")
+	}
+	if input.TopK, err = parseOptionalInt(form.TopK); err != nil {
+		problems = append(problems, "top_k must be a whole number")
+	}
+	if input.TopP, err = parseOptionalFloat(form.TopP); err != nil {
+		problems = append(problems, "top_p must be a number")
+	}
+	if form.Metadata != "" {
+		if err := json.Unmarshal([]byte(form.Metadata), &input.Metadata); err != nil {
+			problems = append(problems, "metadata must be a JSON object")
+		}
+	}
+	return form, input, problems
+}
+
+func parseOptionalInt(s string) (*int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func parseOptionalFloat(s string) (*float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
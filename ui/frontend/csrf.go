@@ -0,0 +1,91 @@
+package frontend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// CSRF protection uses the double-submit cookie pattern: every response
+// carries a random token in a cookie, pages embed the same token, and
+// state-changing requests must echo it back in a header or form field.
+const (
+	csrfCookieName = "agentpg_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+	csrfTokenBytes = 32
+)
+
+type csrfContextKey struct{}
+
+// csrfMiddleware issues CSRF tokens and rejects unsafe requests without a matching one.
+func csrfMiddleware(next http.Handler, basePath string) http.Handler {
+	cookiePath := basePath + "/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && validCSRFToken(cookie.Value) {
+			token = cookie.Value
+		}
+		if token == "" {
+			token = newCSRFToken()
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     cookiePath,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		if !isSafeMethod(r.Method) {
+			// Browsers that send Fetch Metadata tell us outright about cross-site requests
+			if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+				http.Error(w, "Cross-site request rejected", http.StatusForbidden)
+				return
+			}
+			sent := r.Header.Get(csrfHeaderName)
+			if sent == "" {
+				sent = r.PostFormValue(csrfFormField)
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token)))
+	})
+}
+
+// csrfToken returns the CSRF token issued for the request.
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey{}).(string)
+	return token
+}
+
+// newCSRFToken generates a random URL-safe token.
+func newCSRFToken() string {
+	b := make([]byte, csrfTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic("ui: failed to generate CSRF token: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// validCSRFToken reports whether a cookie value looks like a token we issued.
+func validCSRFToken(token string) bool {
+	return len(token) == base64.RawURLEncoding.EncodedLen(csrfTokenBytes)
+}
+
+// isSafeMethod reports whether the HTTP method is read-only.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
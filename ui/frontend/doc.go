@@ -18,6 +18,7 @@
 //   - GET /agents - Agents registry
 //   - GET /instances - Instances monitoring
 //   - GET /compaction - Compaction events
+//   - GET /audit - Audit log of operator actions
 //
 // Chat Interface:
 //   - GET /chat - Chat interface
@@ -25,6 +26,30 @@
 //   - POST /chat/send - Send message (HTMX)
 //   - GET /chat/poll/{runId} - Poll for response (HTMX)
 //
+// Schedules:
+//   - GET /schedules - Schedules list
+//   - POST /schedules/{id}/pause - Pause a schedule
+//   - POST /schedules/{id}/resume - Resume a schedule
+//
+// Operator Actions:
+//   - POST /runs/{id}/cancel - Cancel a run and its nested runs
+//   - POST /runs/{id}/retry - Retry a failed run
+//   - POST /runs/{id}/rescue - Reset a stuck run to pending
+//   - POST /tool-executions/{id}/requeue - Requeue a failed tool execution
+//   - POST /tool-executions/{id}/discard - Discard a pending tool execution
+//   - POST /instances/leader/release - Force a new leader election
+//
+// Agent Management:
+//   - GET /agents/new - New agent form
+//   - POST /agents - Create an agent
+//   - GET /agents/{id}/edit - Edit agent form
+//   - POST /agents/{id} - Update an agent
+//   - GET /agents/{id}/history - Agent versions and diffs
+//   - POST /agents/{id}/versions/{version}/restore - Restore an agent version
+//
+// POST routes require the CSRF token issued in the agentpg_csrf cookie, sent
+// back in the X-CSRF-Token header or the csrf_token form field.
+//
 // HTMX Fragments:
 //   - GET /fragments/* - Partial HTML fragments for HTMX updates
 //
@@ -0,0 +1,55 @@
+package frontend
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Flash messages survive the redirect after a POST in a short-lived cookie
+// that is cleared when the next page renders it.
+const flashCookieName = "agentpg_flash"
+
+// setFlash stores a flash message for the next rendered page.
+func (rt *router[TTx]) setFlash(w http.ResponseWriter, r *http.Request, typ, message string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Value:    typ + "." + base64.RawURLEncoding.EncodeToString([]byte(message)),
+		Path:     rt.config.BasePath + "/",
+		MaxAge:   60,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// popFlash returns the pending flash message, if any, and clears it.
+func popFlash(w http.ResponseWriter, r *http.Request, basePath string) *FlashMessage {
+	cookie, err := r.Cookie(flashCookieName)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Path:     basePath + "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	typ, encoded, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return nil
+	}
+	switch typ {
+	case "success", "error", "warning", "info":
+	default:
+		return nil
+	}
+	message, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(message) == 0 {
+		return nil
+	}
+	return &FlashMessage{Type: typ, Message: string(message)}
+}
@@ -1,12 +1,20 @@
 package frontend
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg"
+	"github.com/youssefsiam38/agentpg/driver"
 	"github.com/youssefsiam38/agentpg/ui/service"
 )
 
@@ -94,7 +102,7 @@ func (rt *router[TTx]) handleRedirectToDashboard(w http.ResponseWriter, r *http.
 }
 
 func (rt *router[TTx]) handleDashboard(w http.ResponseWriter, r *http.Request) {
-	stats, err := rt.svc.GetDashboardStats(r.Context(), rt.config.MetadataFilter, rt.config.MetadataFilterKeys)
+	stats, err := rt.svc.GetDashboardStats(r.Context(), rt.metadataFilter(r), rt.config.MetadataFilterKeys)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -113,12 +121,12 @@ func (rt *router[TTx]) handleDashboard(w http.ResponseWriter, r *http.Request) {
 func (rt *router[TTx]) handleSessions(w http.ResponseWriter, r *http.Request) {
 	// Start with configured metadata filter
 	metadataFilter := make(map[string]any)
-	for k, v := range rt.config.MetadataFilter {
+	for k, v := range rt.metadataFilter(r) {
 		metadataFilter[k] = v
 	}
 
 	// Allow overriding filter keys from query params (only when MetadataFilter is not pre-configured)
-	if len(rt.config.MetadataFilter) == 0 {
+	if len(rt.metadataFilter(r)) == 0 {
 		for _, key := range rt.config.MetadataFilterKeys {
 			if val := r.URL.Query().Get(key); val != "" {
 				metadataFilter[key] = val
@@ -142,7 +150,7 @@ func (rt *router[TTx]) handleSessions(w http.ResponseWriter, r *http.Request) {
 
 	// Get metadata filter options for dropdowns (only when MetadataFilter is not pre-configured)
 	filterOptions := make(map[string][]*service.MetadataFilterOption)
-	if len(rt.config.MetadataFilter) == 0 {
+	if len(rt.metadataFilter(r)) == 0 {
 		for _, key := range rt.config.MetadataFilterKeys {
 			options, err := rt.svc.GetMetadataValues(r.Context(), key)
 			if err != nil {
@@ -178,6 +186,9 @@ func (rt *router[TTx]) handleSessionDetail(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "Invalid session ID", http.StatusBadRequest)
 		return
 	}
+	if !rt.sessionInScope(w, r, id) {
+		return
+	}
 
 	detail, err := rt.svc.GetSessionDetail(r.Context(), id)
 	if err != nil {
@@ -198,12 +209,12 @@ func (rt *router[TTx]) handleSessionDetail(w http.ResponseWriter, r *http.Reques
 func (rt *router[TTx]) handleRuns(w http.ResponseWriter, r *http.Request) {
 	// Start with configured metadata filter
 	metadataFilter := make(map[string]any)
-	for k, v := range rt.config.MetadataFilter {
+	for k, v := range rt.metadataFilter(r) {
 		metadataFilter[k] = v
 	}
 
 	// Allow overriding filter keys from query params (only when MetadataFilter is not pre-configured)
-	if len(rt.config.MetadataFilter) == 0 {
+	if len(rt.metadataFilter(r)) == 0 {
 		for _, key := range rt.config.MetadataFilterKeys {
 			if val := r.URL.Query().Get(key); val != "" {
 				metadataFilter[key] = val
@@ -272,6 +283,9 @@ func (rt *router[TTx]) handleRunDetail(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Run not found", http.StatusNotFound)
 		return
 	}
+	if !rt.sessionInScope(w, r, detail.Run.SessionID) {
+		return
+	}
 
 	// Get hierarchy if this is a root run
 	var hierarchy *service.RunHierarchy
@@ -287,6 +301,7 @@ func (rt *router[TTx]) handleRunDetail(w http.ResponseWriter, r *http.Request) {
 		"Title":     "Run: " + id.String()[:8],
 		"Run":       detail,
 		"Hierarchy": hierarchy,
+		"CanManage": rt.canManage(r),
 	}
 
 	if err := rt.renderer.render(w, r, "runs/detail.html", data); err != nil {
@@ -307,6 +322,9 @@ func (rt *router[TTx]) handleConversation(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Run not found", http.StatusNotFound)
 		return
 	}
+	if !rt.sessionInScope(w, r, runDetail.Run.SessionID) {
+		return
+	}
 
 	// Get conversation
 	conversation, err := rt.svc.GetConversation(r.Context(), runDetail.Run.SessionID, 100)
@@ -332,6 +350,9 @@ func (rt *router[TTx]) handleSessionConversation(w http.ResponseWriter, r *http.
 		http.Error(w, "Invalid session ID", http.StatusBadRequest)
 		return
 	}
+	if !rt.sessionInScope(w, r, sessionID) {
+		return
+	}
 
 	conversation, err := rt.svc.GetConversation(r.Context(), sessionID, 100)
 	if err != nil {
@@ -351,10 +372,11 @@ func (rt *router[TTx]) handleSessionConversation(w http.ResponseWriter, r *http.
 
 func (rt *router[TTx]) handleToolExecutions(w http.ResponseWriter, r *http.Request) {
 	params := service.ToolExecutionListParams{
-		ToolName: r.URL.Query().Get("tool_name"),
-		State:    r.URL.Query().Get("state"),
-		Limit:    parseInt(r, "limit", rt.config.PageSize),
-		Offset:   parseOffset(r, "offset", 0),
+		MetadataFilter: rt.metadataFilter(r),
+		ToolName:       r.URL.Query().Get("tool_name"),
+		State:          r.URL.Query().Get("state"),
+		Limit:          parseInt(r, "limit", rt.config.PageSize),
+		Offset:         parseOffset(r, "offset", 0),
 	}
 	if runID := r.URL.Query().Get("run_id"); runID != "" {
 		if id, err := parseUUID(runID); err == nil {
@@ -404,6 +426,14 @@ func (rt *router[TTx]) handleToolExecutionDetail(w http.ResponseWriter, r *http.
 		http.Error(w, "Tool execution not found", http.StatusNotFound)
 		return
 	}
+	if detail.Run != nil {
+		if !rt.sessionInScope(w, r, detail.Run.SessionID) {
+			return
+		}
+	} else if len(rt.metadataFilter(r)) > 0 {
+		http.Error(w, "Tool execution not found", http.StatusNotFound)
+		return
+	}
 
 	// Flatten the data structure for easier template access
 	data := map[string]any{
@@ -411,6 +441,7 @@ func (rt *router[TTx]) handleToolExecutionDetail(w http.ResponseWriter, r *http.
 		"Execution": detail.Execution, // The actual ToolExecution
 		"Run":       detail.Run,
 		"ChildRun":  detail.ChildRun,
+		"CanManage": rt.canManage(r),
 	}
 
 	if err := rt.renderer.render(w, r, "tools/detail.html", data); err != nil {
@@ -431,10 +462,19 @@ func (rt *router[TTx]) handleAgents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Tenant-scoped users see all agents but only manage those in their scope
+	canManage := rt.canManage(r)
+	editable := make(map[uuid.UUID]bool, len(agents))
+	for _, agent := range agents {
+		editable[agent.Agent.ID] = canManage && rt.agentInScope(r, agent.Agent)
+	}
+
 	data := map[string]any{
-		"Title":  "Agents & Tools",
-		"Agents": agents,
-		"Tools":  tools,
+		"Title":     "Agents & Tools",
+		"Agents":    agents,
+		"Tools":     tools,
+		"CanManage": canManage,
+		"Editable":  editable,
 	}
 
 	if err := rt.renderer.render(w, r, "agents/list.html", data); err != nil {
@@ -456,9 +496,10 @@ func (rt *router[TTx]) handleInstances(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := map[string]any{
-		"Title":     "Instances",
-		"Instances": instances,
-		"Leader":    leader,
+		"Title":          "Instances",
+		"Instances":      instances,
+		"Leader":         leader,
+		"CanManageFleet": rt.canManageFleet(r),
 	}
 
 	if err := rt.renderer.render(w, r, "instances/list.html", data); err != nil {
@@ -473,6 +514,9 @@ func (rt *router[TTx]) handleCompaction(w http.ResponseWriter, r *http.Request)
 			sessionID = &id
 		}
 	}
+	if sessionID != nil && !rt.sessionInScope(w, r, *sessionID) {
+		return
+	}
 
 	params := service.CompactionEventListParams{
 		SessionID: sessionID,
@@ -496,13 +540,466 @@ func (rt *router[TTx]) handleCompaction(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func (rt *router[TTx]) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules, err := rt.svc.ListSchedules(r.Context(), rt.metadataFilter(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]any{
+		"Title":     "Schedules",
+		"Schedules": schedules,
+		"CanManage": rt.canManage(r),
+	}
+
+	if err := rt.renderer.render(w, r, "schedules/list.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (rt *router[TTx]) handleSchedulePause(w http.ResponseWriter, r *http.Request) {
+	rt.handleScheduleAction(w, r, rt.client.PauseSchedule)
+}
+
+func (rt *router[TTx]) handleScheduleResume(w http.ResponseWriter, r *http.Request) {
+	rt.handleScheduleAction(w, r, rt.client.ResumeSchedule)
+}
+
+// handleScheduleAction applies a pause/resume action and redirects back to the schedules page.
+func (rt *router[TTx]) handleScheduleAction(w http.ResponseWriter, r *http.Request, action func(context.Context, uuid.UUID) error) {
+	if !rt.canManage(r) {
+		http.Error(w, "Schedule management is disabled", http.StatusForbidden)
+		return
+	}
+
+	id, err := parseUUID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+	if !rt.scheduleInScope(r, id) {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+
+	if err := action(r.Context(), id); err != nil {
+		if errors.Is(err, agentpg.ErrScheduleNotFound) {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to update schedule: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, rt.config.BasePath+"/schedules", http.StatusSeeOther)
+}
+
+// Operator action handlers
+
+func (rt *router[TTx]) handleRunCancel(w http.ResponseWriter, r *http.Request) {
+	rt.handleRunAction(w, r, func(ctx context.Context, id uuid.UUID, actor string) (*service.ActionResult, error) {
+		return rt.svc.CancelRun(ctx, id, actor, strings.TrimSpace(r.PostFormValue("reason")))
+	})
+}
+
+func (rt *router[TTx]) handleRunRetry(w http.ResponseWriter, r *http.Request) {
+	rt.handleRunAction(w, r, rt.svc.RetryRun)
+}
+
+func (rt *router[TTx]) handleRunRescue(w http.ResponseWriter, r *http.Request) {
+	rt.handleRunAction(w, r, rt.svc.RescueRun)
+}
+
+// handleRunAction performs an operator action on a run and redirects back to the run.
+func (rt *router[TTx]) handleRunAction(w http.ResponseWriter, r *http.Request, action func(context.Context, uuid.UUID, string) (*service.ActionResult, error)) {
+	if !rt.canManage(r) {
+		http.Error(w, "Run management is disabled", http.StatusForbidden)
+		return
+	}
+
+	id, err := parseUUID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid run ID", http.StatusBadRequest)
+		return
+	}
+	run, err := rt.svc.GetRun(r.Context(), id)
+	if err != nil || run == nil {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	if !rt.sessionInScope(w, r, run.SessionID) {
+		return
+	}
+
+	result, err := action(r.Context(), id, rt.access(r).User)
+	rt.finishAction(w, r, result, err, rt.config.BasePath+"/runs/"+id.String())
+}
+
+func (rt *router[TTx]) handleToolExecutionRequeue(w http.ResponseWriter, r *http.Request) {
+	rt.handleToolExecutionAction(w, r, rt.svc.RequeueToolExecution)
+}
+
+func (rt *router[TTx]) handleToolExecutionDiscard(w http.ResponseWriter, r *http.Request) {
+	rt.handleToolExecutionAction(w, r, func(ctx context.Context, id uuid.UUID, actor string) (*service.ActionResult, error) {
+		return rt.svc.DiscardToolExecution(ctx, id, actor, strings.TrimSpace(r.PostFormValue("reason")))
+	})
+}
+
+// handleToolExecutionAction performs an operator action on a tool execution
+// and redirects back to the tool execution.
+func (rt *router[TTx]) handleToolExecutionAction(w http.ResponseWriter, r *http.Request, action func(context.Context, uuid.UUID, string) (*service.ActionResult, error)) {
+	if !rt.canManage(r) {
+		http.Error(w, "Tool execution management is disabled", http.StatusForbidden)
+		return
+	}
+
+	id, err := parseUUID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid tool execution ID", http.StatusBadRequest)
+		return
+	}
+	exec, err := rt.svc.GetToolExecution(r.Context(), id)
+	if err != nil || exec == nil {
+		http.Error(w, "Tool execution not found", http.StatusNotFound)
+		return
+	}
+	run, err := rt.svc.GetRun(r.Context(), exec.RunID)
+	if err != nil || run == nil {
+		http.Error(w, "Tool execution not found", http.StatusNotFound)
+		return
+	}
+	if !rt.sessionInScope(w, r, run.SessionID) {
+		return
+	}
+
+	result, err := action(r.Context(), id, rt.access(r).User)
+	rt.finishAction(w, r, result, err, rt.config.BasePath+"/tool-executions/"+id.String())
+}
+
+// handleLeaderRelease forces a new leader election. Leadership is fleet-wide,
+// so tenant-scoped users cannot release it.
+func (rt *router[TTx]) handleLeaderRelease(w http.ResponseWriter, r *http.Request) {
+	if !rt.canManageFleet(r) {
+		http.Error(w, "Leader management is disabled", http.StatusForbidden)
+		return
+	}
+
+	result, err := rt.svc.ReleaseLeadership(r.Context(), rt.access(r).User)
+	rt.finishAction(w, r, result, err, rt.config.BasePath+"/instances")
+}
+
+// finishAction reports the outcome of an operator action in a flash message
+// and redirects to the given page.
+func (rt *router[TTx]) finishAction(w http.ResponseWriter, r *http.Request, result *service.ActionResult, err error, redirect string) {
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case err != nil:
+		var validationErr *service.ValidationError
+		if !errors.Is(err, service.ErrInvalidState) && !errors.As(err, &validationErr) {
+			rt.logError("operator action failed", err)
+		}
+		rt.setFlash(w, r, "error", err.Error())
+	default:
+		rt.setFlash(w, r, "success", result.Message)
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+func (rt *router[TTx]) handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	params := service.AuditEventListParams{
+		MetadataFilter: rt.metadataFilter(r),
+		TargetType:     r.URL.Query().Get("target_type"),
+		TargetID:       r.URL.Query().Get("target_id"),
+		Actor:          r.URL.Query().Get("actor"),
+		Limit:          parseInt(r, "limit", rt.config.PageSize),
+		Offset:         parseOffset(r, "offset", 0),
+	}
+
+	list, err := rt.svc.ListAuditEvents(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"target_type": params.TargetType,
+		"target_id":   params.TargetID,
+		"actor":       params.Actor,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	data := map[string]any{
+		"Title":             "Audit Log",
+		"Events":            list.Events,
+		"TotalCount":        list.TotalCount,
+		"HasMore":           list.HasMore,
+		"Limit":             params.Limit,
+		"Offset":            params.Offset,
+		"CurrentTargetType": params.TargetType,
+		"CurrentTargetID":   params.TargetID,
+		"CurrentActor":      params.Actor,
+		"TargetTypes":       []string{"run", "tool_execution", "leader", "agent"},
+		"QueryParams":       query.Encode(),
+		"CurrentPage":       params.Offset/params.Limit + 1,
+		"TotalPages":        (list.TotalCount + params.Limit - 1) / params.Limit,
+	}
+
+	if err := rt.renderer.render(w, r, "audit/list.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Agent management handlers
+
+func (rt *router[TTx]) handleAgentNew(w http.ResponseWriter, r *http.Request) {
+	if !rt.canManage(r) {
+		http.Error(w, "Agent management is disabled", http.StatusForbidden)
+		return
+	}
+
+	form := &agentForm{Tools: map[string]bool{}, AgentIDs: map[string]bool{}}
+	rt.renderAgentForm(w, r, nil, form, nil)
+}
+
+func (rt *router[TTx]) handleAgentCreate(w http.ResponseWriter, r *http.Request) {
+	if !rt.canManage(r) {
+		http.Error(w, "Agent management is disabled", http.StatusForbidden)
+		return
+	}
+
+	form, input, problems := parseAgentForm(r)
+	input.Metadata = scopeMetadata(input.Metadata, rt.metadataFilter(r))
+	if len(problems) > 0 {
+		rt.renderAgentForm(w, r, nil, form, rt.agentProblems(r, uuid.Nil, input, problems))
+		return
+	}
+
+	agent, err := rt.svc.CreateAgent(r.Context(), input, rt.access(r).User)
+	if err != nil {
+		rt.agentFormError(w, r, nil, form, err)
+		return
+	}
+	rt.setFlash(w, r, "success", fmt.Sprintf("Created agent %s", agent.Name))
+	http.Redirect(w, r, rt.config.BasePath+"/agents/"+agent.ID.String()+"/history", http.StatusSeeOther)
+}
+
+func (rt *router[TTx]) handleAgentEdit(w http.ResponseWriter, r *http.Request) {
+	agent, ok := rt.managedAgent(w, r)
+	if !ok {
+		return
+	}
+	rt.renderAgentForm(w, r, agent, newAgentForm(agent), nil)
+}
+
+func (rt *router[TTx]) handleAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	agent, ok := rt.managedAgent(w, r)
+	if !ok {
+		return
+	}
+
+	form, input, problems := parseAgentForm(r)
+	input.Metadata = scopeMetadata(input.Metadata, rt.metadataFilter(r))
+	if len(problems) > 0 {
+		rt.renderAgentForm(w, r, agent, form, rt.agentProblems(r, agent.ID, input, problems))
+		return
+	}
+
+	result, err := rt.svc.UpdateAgent(r.Context(), agent.ID, input, rt.access(r).User)
+	if err != nil {
+		rt.agentFormError(w, r, agent, form, err)
+		return
+	}
+	rt.setFlash(w, r, "success", result.Message)
+	http.Redirect(w, r, rt.config.BasePath+"/agents/"+agent.ID.String()+"/history", http.StatusSeeOther)
+}
+
+func (rt *router[TTx]) handleAgentHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUUID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid agent ID", http.StatusBadRequest)
+		return
+	}
+
+	history, err := rt.svc.GetAgentHistory(r.Context(), id)
+	if errors.Is(err, service.ErrNotFound) {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Compare the latest version with the one before it unless asked otherwise
+	var diff *service.AgentDiff
+	if len(history.Versions) > 0 {
+		to := parseVersion(r.URL.Query().Get("to"), history.Versions[0].Version.Version)
+		from := parseVersion(r.URL.Query().Get("from"), to-1)
+		if from > 0 && from != to {
+			diff, err = rt.svc.DiffAgentVersions(r.Context(), id, from, to)
+			if err != nil && !errors.Is(err, service.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	data := map[string]any{
+		"Title":     history.Agent.Name + " History",
+		"Agent":     history.Agent,
+		"Versions":  history.Versions,
+		"Diff":      diff,
+		"CanManage": rt.canManage(r) && rt.agentInScope(r, history.Agent),
+	}
+
+	if err := rt.renderer.render(w, r, "agents/history.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (rt *router[TTx]) handleAgentRestore(w http.ResponseWriter, r *http.Request) {
+	agent, ok := rt.managedAgent(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version <= 0 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	result, err := rt.svc.RestoreAgentVersion(r.Context(), agent.ID, version, rt.access(r).User)
+	rt.finishAction(w, r, result, err, rt.config.BasePath+"/agents/"+agent.ID.String()+"/history")
+}
+
+// managedAgent returns the agent named in the path if the request may manage
+// it, and writes an error response otherwise.
+func (rt *router[TTx]) managedAgent(w http.ResponseWriter, r *http.Request) (*driver.AgentDefinition, bool) {
+	if !rt.canManage(r) {
+		http.Error(w, "Agent management is disabled", http.StatusForbidden)
+		return nil, false
+	}
+
+	id, err := parseUUID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid agent ID", http.StatusBadRequest)
+		return nil, false
+	}
+	agent, err := rt.svc.Store().GetAgent(r.Context(), id)
+	if err != nil || agent == nil || !rt.agentInScope(r, agent) {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return nil, false
+	}
+	return agent, true
+}
+
+// agentFormError shows the form again for validation errors and fails the
+// request otherwise.
+func (rt *router[TTx]) agentFormError(w http.ResponseWriter, r *http.Request, agent *driver.AgentDefinition, form *agentForm, err error) {
+	var validationErr *service.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		rt.renderAgentForm(w, r, agent, form, validationErr.Problems)
+	case errors.Is(err, service.ErrNotFound):
+		http.Error(w, "Agent not found", http.StatusNotFound)
+	default:
+		rt.logError("failed to save agent", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// agentProblems adds the problems the service finds in an agent to those
+// found while reading the form.
+func (rt *router[TTx]) agentProblems(r *http.Request, id uuid.UUID, input service.AgentInput, problems []string) []string {
+	var validationErr *service.ValidationError
+	if err := rt.svc.ValidateAgent(r.Context(), id, input); errors.As(err, &validationErr) {
+		problems = append(problems, validationErr.Problems...)
+	}
+	return problems
+}
+
+// renderAgentForm renders the form for creating an agent, or for editing
+// agent when it is not nil.
+func (rt *router[TTx]) renderAgentForm(w http.ResponseWriter, r *http.Request, agent *driver.AgentDefinition, form *agentForm, problems []string) {
+	options, err := rt.svc.GetAgentFormOptions(r.Context(), rt.metadataFilter(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Keep selected tools that are no longer registered visible, so that
+	// saving the form does not drop them unnoticed
+	var missingTools []string
+	for name := range form.Tools {
+		if !slices.ContainsFunc(options.Tools, func(tool *driver.ToolDefinition) bool { return tool.Name == name }) {
+			missingTools = append(missingTools, name)
+		}
+	}
+	slices.Sort(missingTools)
+
+	// An agent cannot delegate to itself
+	delegates := options.Agents
+	if agent != nil {
+		delegates = slices.DeleteFunc(slices.Clone(delegates), func(a *driver.AgentDefinition) bool { return a.ID == agent.ID })
+	}
+
+	title := "New Agent"
+	if agent != nil {
+		title = "Edit " + agent.Name
+	}
+	data := map[string]any{
+		"Title":          title,
+		"Agent":          agent,
+		"Form":           form,
+		"Problems":       problems,
+		"Tools":          options.Tools,
+		"MissingTools":   missingTools,
+		"Delegates":      delegates,
+		"Models":         options.Models,
+		"MetadataFilter": rt.metadataFilter(r),
+	}
+
+	if err := rt.renderer.render(w, r, "agents/form.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// scopeMetadata sets the tenant scope's key-value pairs on agent metadata,
+// so that scoped users cannot create agents outside their scope.
+func scopeMetadata(metadata, filter map[string]any) map[string]any {
+	if len(filter) == 0 {
+		return metadata
+	}
+	scoped := make(map[string]any, len(metadata)+len(filter))
+	maps.Copy(scoped, metadata)
+	maps.Copy(scoped, filter)
+	return scoped
+}
+
+// parseVersion parses an agent version number, returning defaultVal when it
+// is missing or invalid.
+func parseVersion(s string, defaultVal int) int {
+	v, err := strconv.Atoi(s)
+	if err != nil || v <= 0 {
+		return defaultVal
+	}
+	return v
+}
+
 // Chat handlers
 
 func (rt *router[TTx]) handleChat(w http.ResponseWriter, r *http.Request) {
 	// Get recent sessions for sidebar
 	var sessionList []*service.SessionSummary
 	sessions, err := rt.svc.ListSessions(r.Context(), service.SessionListParams{
-		MetadataFilter: rt.config.MetadataFilter,
+		MetadataFilter: rt.metadataFilter(r),
 		Limit:          10,
 		OrderBy:        "updated_at",
 		OrderDir:       "desc",
@@ -537,7 +1034,7 @@ func (rt *router[TTx]) handleChatNew(w http.ResponseWriter, r *http.Request) {
 
 	// Get metadata filter options for dropdowns (only when MetadataFilter is not pre-configured)
 	filterOptions := make(map[string][]*service.MetadataFilterOption)
-	if len(rt.config.MetadataFilter) == 0 {
+	if len(rt.metadataFilter(r)) == 0 {
 		for _, key := range rt.config.MetadataFilterKeys {
 			options, err := rt.svc.GetMetadataValues(r.Context(), key)
 			if err != nil {
@@ -551,7 +1048,7 @@ func (rt *router[TTx]) handleChatNew(w http.ResponseWriter, r *http.Request) {
 	data := map[string]any{
 		"Title":              "New Chat",
 		"Agents":             agents,
-		"MetadataFilter":     rt.config.MetadataFilter,
+		"MetadataFilter":     rt.metadataFilter(r),
 		"FilterOptions":      filterOptions,
 		"MetadataFilterKeys": rt.config.MetadataFilterKeys,
 	}
@@ -562,7 +1059,7 @@ func (rt *router[TTx]) handleChatNew(w http.ResponseWriter, r *http.Request) {
 }
 
 func (rt *router[TTx]) handleChatSend(w http.ResponseWriter, r *http.Request) {
-	if rt.config.ReadOnly || rt.client == nil {
+	if !rt.canChat(r) {
 		http.Error(w, "Chat is disabled", http.StatusForbidden)
 		return
 	}
@@ -599,7 +1096,7 @@ func (rt *router[TTx]) handleChatSend(w http.ResponseWriter, r *http.Request) {
 		// Collect metadata from config filter and form values
 		metadata := make(map[string]any)
 		// Start with pre-configured metadata filter
-		for k, v := range rt.config.MetadataFilter {
+		for k, v := range rt.metadataFilter(r) {
 			metadata[k] = v
 		}
 		// Add metadata from filter keys
@@ -616,6 +1113,10 @@ func (rt *router[TTx]) handleChatSend(w http.ResponseWriter, r *http.Request) {
 				metadata[key] = value
 			}
 		}
+		// The tenant scope always wins so the session stays visible to its creator
+		for k, v := range rt.metadataFilter(r) {
+			metadata[k] = v
+		}
 
 		sessionID, err = rt.client.NewSession(r.Context(), nil, metadata)
 		if err != nil {
@@ -633,6 +1134,9 @@ func (rt *router[TTx]) handleChatSend(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid session ID", http.StatusBadRequest)
 			return
 		}
+		if !rt.sessionInScope(w, r, sessionID) {
+			return
+		}
 
 		// For existing sessions, get agent from the session's first run if not provided
 		if agentName == "" {
@@ -710,6 +1214,9 @@ func (rt *router[TTx]) handleChatPoll(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Run not found", http.StatusNotFound)
 		return
 	}
+	if !rt.sessionInScope(w, r, run.SessionID) {
+		return
+	}
 
 	// Get tool executions for this run
 	toolExecs, toolErr := rt.svc.GetRunToolExecutions(r.Context(), runID)
@@ -767,6 +1274,9 @@ func (rt *router[TTx]) handleChatMessages(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Invalid session ID", http.StatusBadRequest)
 		return
 	}
+	if !rt.sessionInScope(w, r, sessionID) {
+		return
+	}
 
 	// Get view mode from query param (default: top-level)
 	viewMode := r.URL.Query().Get("view")
@@ -816,6 +1326,9 @@ func (rt *router[TTx]) handleChatSession(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Invalid session ID", http.StatusBadRequest)
 		return
 	}
+	if !rt.sessionInScope(w, r, sessionID) {
+		return
+	}
 
 	// Get session details
 	session, err := rt.svc.GetSessionDetail(r.Context(), sessionID)
@@ -855,7 +1368,7 @@ func (rt *router[TTx]) handleChatSession(w http.ResponseWriter, r *http.Request)
 
 	// Get recent sessions for sidebar
 	sessions, sessionsErr := rt.svc.ListSessions(r.Context(), service.SessionListParams{
-		MetadataFilter: rt.config.MetadataFilter,
+		MetadataFilter: rt.metadataFilter(r),
 		Limit:          10,
 		OrderBy:        "updated_at",
 		OrderDir:       "desc",
@@ -937,7 +1450,7 @@ func (rt *router[TTx]) handleChatSession(w http.ResponseWriter, r *http.Request)
 // Fragment handlers for HTMX
 
 func (rt *router[TTx]) handleFragmentDashboardStats(w http.ResponseWriter, r *http.Request) {
-	stats, err := rt.svc.GetDashboardStats(r.Context(), rt.config.MetadataFilter, rt.config.MetadataFilterKeys)
+	stats, err := rt.svc.GetDashboardStats(r.Context(), rt.metadataFilter(r), rt.config.MetadataFilterKeys)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -950,7 +1463,7 @@ func (rt *router[TTx]) handleFragmentDashboardStats(w http.ResponseWriter, r *ht
 
 func (rt *router[TTx]) handleFragmentRunList(w http.ResponseWriter, r *http.Request) {
 	params := service.RunListParams{
-		MetadataFilter: rt.config.MetadataFilter,
+		MetadataFilter: rt.metadataFilter(r),
 		AgentName:      r.URL.Query().Get("agent_name"),
 		State:          r.URL.Query().Get("state"),
 		Limit:          parseInt(r, "limit", 10),
@@ -977,12 +1490,12 @@ func (rt *router[TTx]) handleFragmentRunList(w http.ResponseWriter, r *http.Requ
 func (rt *router[TTx]) handleFragmentSessionList(w http.ResponseWriter, r *http.Request) {
 	// Start with configured metadata filter
 	metadataFilter := make(map[string]any)
-	for k, v := range rt.config.MetadataFilter {
+	for k, v := range rt.metadataFilter(r) {
 		metadataFilter[k] = v
 	}
 
 	// Allow overriding filter keys from query params (only when MetadataFilter is not pre-configured)
-	if len(rt.config.MetadataFilter) == 0 {
+	if len(rt.metadataFilter(r)) == 0 {
 		for _, key := range rt.config.MetadataFilterKeys {
 			if val := r.URL.Query().Get(key); val != "" {
 				metadataFilter[key] = val
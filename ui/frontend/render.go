@@ -41,7 +41,10 @@ type PageData struct {
 	CurrentPath     string
 	MetadataFilter  map[string]any // Active metadata filter (for showing filter status)
 	ReadOnly        bool
-	RefreshInterval int // in seconds
+	User            string // Authenticated user, empty without authentication
+	Role            string // Role of the authenticated user
+	CSRFToken       string // Token to echo back on POST requests
+	RefreshInterval int    // in seconds
 	Flash           *FlashMessage
 	Data            any
 }
@@ -61,9 +64,17 @@ func (r *renderer) render(w http.ResponseWriter, req *http.Request, name string,
 		CurrentPath:     req.URL.Path,
 		MetadataFilter:  r.config.MetadataFilter,
 		ReadOnly:        r.config.ReadOnly,
+		CSRFToken:       csrfToken(req),
 		RefreshInterval: int(r.config.RefreshInterval.Seconds()),
+		Flash:           popFlash(w, req, r.config.BasePath),
 		Data:            data,
 	}
+	if access := accessFromContext(req.Context()); access != nil {
+		pageData.MetadataFilter = access.MetadataFilter
+		pageData.ReadOnly = pageData.ReadOnly || !access.CanChat
+		pageData.User = access.User
+		pageData.Role = access.Role
+	}
 
 	// Clone the base template to avoid conflicts between page "content" blocks
 	tmpl, err := r.baseTemplate.Clone()
@@ -37,6 +37,7 @@ type Config struct {
 	MetadataFilterKeys []string
 
 	// ReadOnly disables write operations (chat, session creation).
+	// Per-request restrictions come from Access (see WithAccess).
 	ReadOnly bool
 
 	// PageSize for pagination.
@@ -121,10 +122,30 @@ func NewRouter[TTx any](svc *service.Service[TTx], client *agentpg.Client[TTx],
 	mux.HandleFunc("GET /tool-executions", r.handleToolExecutions)
 	mux.HandleFunc("GET /tool-executions/{id}", r.handleToolExecutionDetail)
 	mux.HandleFunc("GET /agents", r.handleAgents)
+	mux.HandleFunc("GET /agents/new", r.handleAgentNew)
+	mux.HandleFunc("GET /agents/{id}/edit", r.handleAgentEdit)
+	mux.HandleFunc("GET /agents/{id}/history", r.handleAgentHistory)
 	mux.HandleFunc("GET /instances", r.handleInstances)
 	mux.HandleFunc("GET /compaction", r.handleCompaction)
+	mux.HandleFunc("GET /schedules", r.handleSchedules)
+	mux.HandleFunc("POST /schedules/{id}/pause", r.handleSchedulePause)
+	mux.HandleFunc("POST /schedules/{id}/resume", r.handleScheduleResume)
+	mux.HandleFunc("GET /audit", r.handleAuditLog)
 	mux.HandleFunc("GET /messages/session/{sessionId}", r.handleSessionConversation)
 
+	// Operator actions
+	mux.HandleFunc("POST /runs/{id}/cancel", r.handleRunCancel)
+	mux.HandleFunc("POST /runs/{id}/retry", r.handleRunRetry)
+	mux.HandleFunc("POST /runs/{id}/rescue", r.handleRunRescue)
+	mux.HandleFunc("POST /tool-executions/{id}/requeue", r.handleToolExecutionRequeue)
+	mux.HandleFunc("POST /tool-executions/{id}/discard", r.handleToolExecutionDiscard)
+	mux.HandleFunc("POST /instances/leader/release", r.handleLeaderRelease)
+
+	// Agent management
+	mux.HandleFunc("POST /agents", r.handleAgentCreate)
+	mux.HandleFunc("POST /agents/{id}", r.handleAgentUpdate)
+	mux.HandleFunc("POST /agents/{id}/versions/{version}/restore", r.handleAgentRestore)
+
 	// Chat interface
 	mux.HandleFunc("GET /chat", r.handleChat)
 	mux.HandleFunc("GET /chat/new", r.handleChatNew)
@@ -143,6 +164,7 @@ func NewRouter[TTx any](svc *service.Service[TTx], client *agentpg.Client[TTx],
 
 // withFrontendMiddleware wraps the handler with frontend-specific middleware.
 func withFrontendMiddleware(handler http.Handler, cfg *Config) http.Handler {
+	handler = csrfMiddleware(handler, cfg.BasePath)
 	handler = frontendRecoveryMiddleware(handler, cfg.Logger)
 	return handler
 }
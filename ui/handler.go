@@ -15,6 +15,9 @@ import (
 // The client parameter is required for chat functionality. If nil, chat
 // features will be disabled (equivalent to ReadOnly mode for chat).
 //
+// If cfg.Authenticator is set, every request is authenticated first and the
+// user's role and tenant scope apply to all pages and actions.
+//
 // Usage:
 //
 //	http.Handle("/ui/", http.StripPrefix("/ui", ui.UIHandler(store, client, cfg)))
@@ -43,5 +46,9 @@ func UIHandler[TTx any](store driver.Store[TTx], client *agentpg.Client[TTx], cf
 		Logger:              cfg.Logger,
 	})
 
+	if cfg.Authenticator != nil {
+		handler = authMiddleware(handler, cfg.Authenticator, cfg)
+	}
+
 	return handler
 }
@@ -0,0 +1,299 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// Audit log actions recorded by the operator actions.
+const (
+	ActionRunCancel            = "run.cancel"
+	ActionRunRetry             = "run.retry"
+	ActionRunRescue            = "run.rescue"
+	ActionToolExecutionRequeue = "tool_execution.requeue"
+	ActionToolExecutionDiscard = "tool_execution.discard"
+	ActionLeaderRelease        = "leader.release"
+)
+
+const (
+	defaultCancelReason  = "cancelled by operator"
+	defaultDiscardReason = "discarded by operator"
+	anonymousActor       = "anonymous"
+)
+
+// CancelRun cancels a run that is not finalized, together with its nested
+// runs. An empty reason is replaced by a default message.
+func (s *Service[TTx]) CancelRun(ctx context.Context, id uuid.UUID, actor, reason string) (*ActionResult, error) {
+	run, err := s.getRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if isRunFinalized(run.State) {
+		return nil, fmt.Errorf("%w: run is %s", ErrInvalidState, run.State)
+	}
+
+	if reason == "" {
+		reason = defaultCancelReason
+	}
+	count, err := s.store.CancelRun(ctx, id, reason)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("%w: run was finalized", ErrInvalidState)
+	}
+
+	if err := s.audit(ctx, ActionRunCancel, "run", id.String(), &run.SessionID, actor, map[string]any{
+		"previous_state": run.State,
+		"reason":         reason,
+		"runs_cancelled": count,
+	}); err != nil {
+		return nil, err
+	}
+	return &ActionResult{Message: fmt.Sprintf("Cancelled %d run(s)", count)}, nil
+}
+
+// RetryRun puts a failed root run back to work after its last successful
+// iteration. Nested runs are retried through their root run.
+func (s *Service[TTx]) RetryRun(ctx context.Context, id uuid.UUID, actor string) (*ActionResult, error) {
+	run, err := s.getRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if run.State != "failed" {
+		return nil, fmt.Errorf("%w: only failed runs can be retried, run is %s", ErrInvalidState, run.State)
+	}
+	if run.ParentRunID != nil {
+		return nil, fmt.Errorf("%w: nested runs are retried by retrying their root run", ErrInvalidState)
+	}
+
+	ok, err := s.store.RetryFailedRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: run is no longer failed", ErrInvalidState)
+	}
+
+	details := map[string]any{
+		"iteration": run.CurrentIteration,
+	}
+	if run.ErrorMessage != nil {
+		details["error_message"] = *run.ErrorMessage
+	}
+	if err := s.audit(ctx, ActionRunRetry, "run", id.String(), &run.SessionID, actor, details); err != nil {
+		return nil, err
+	}
+	return &ActionResult{Message: "Run queued for retry"}, nil
+}
+
+// RescueRun resets a run stuck in a processing state to pending, as the
+// leader's rescuer does for runs that exceed the rescue timeout.
+func (s *Service[TTx]) RescueRun(ctx context.Context, id uuid.UUID, actor string) (*ActionResult, error) {
+	run, err := s.getRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	switch run.State {
+	case "batch_submitting", "batch_pending", "batch_processing", "streaming", "pending_tools":
+	default:
+		return nil, fmt.Errorf("%w: only runs in a processing state can be rescued, run is %s", ErrInvalidState, run.State)
+	}
+	if run.State == "pending_tools" {
+		// The run continues on its own once its tools finish.
+		execs, err := s.store.GetToolExecutionsByRun(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, exec := range execs {
+			if run.CurrentIterationID != nil && exec.IterationID == *run.CurrentIterationID &&
+				(exec.State == "pending" || exec.State == "running") {
+				return nil, fmt.Errorf("%w: run is waiting for tool executions", ErrInvalidState)
+			}
+		}
+	}
+
+	if err := s.store.RescueRun(ctx, id); err != nil {
+		return nil, err
+	}
+
+	details := map[string]any{
+		"previous_state": run.State,
+	}
+	if run.ClaimedByInstanceID != nil {
+		details["claimed_by"] = *run.ClaimedByInstanceID
+	}
+	if err := s.audit(ctx, ActionRunRescue, "run", id.String(), &run.SessionID, actor, details); err != nil {
+		return nil, err
+	}
+	return &ActionResult{Message: "Run reset to pending"}, nil
+}
+
+// RequeueToolExecution resets a failed tool execution of a run that is still
+// waiting for its tools to pending with a fresh attempt budget.
+func (s *Service[TTx]) RequeueToolExecution(ctx context.Context, id uuid.UUID, actor string) (*ActionResult, error) {
+	exec, run, err := s.getToolExecutionWithRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if exec.State != "failed" {
+		return nil, fmt.Errorf("%w: only failed tool executions can be requeued, execution is %s", ErrInvalidState, exec.State)
+	}
+	if run.State != "pending_tools" {
+		return nil, fmt.Errorf("%w: run is %s; retry the run instead", ErrInvalidState, run.State)
+	}
+
+	ok, err := s.store.RequeueToolExecution(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: tool execution is no longer failed", ErrInvalidState)
+	}
+
+	details := map[string]any{
+		"tool_name": exec.ToolName,
+		"run_id":    exec.RunID.String(),
+	}
+	if exec.ErrorMessage != nil {
+		details["error_message"] = *exec.ErrorMessage
+	}
+	if err := s.audit(ctx, ActionToolExecutionRequeue, "tool_execution", id.String(), &run.SessionID, actor, details); err != nil {
+		return nil, err
+	}
+	return &ActionResult{Message: "Tool execution requeued"}, nil
+}
+
+// DiscardToolExecution marks a tool execution waiting for a retry as
+// permanently failed. An empty reason is replaced by a default message.
+func (s *Service[TTx]) DiscardToolExecution(ctx context.Context, id uuid.UUID, actor, reason string) (*ActionResult, error) {
+	exec, run, err := s.getToolExecutionWithRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if exec.State != "pending" {
+		return nil, fmt.Errorf("%w: only pending tool executions can be discarded, execution is %s", ErrInvalidState, exec.State)
+	}
+
+	if reason == "" {
+		reason = defaultDiscardReason
+	}
+	if err := s.store.DiscardToolExecution(ctx, id, reason); err != nil {
+		return nil, err
+	}
+
+	if err := s.audit(ctx, ActionToolExecutionDiscard, "tool_execution", id.String(), &run.SessionID, actor, map[string]any{
+		"tool_name":     exec.ToolName,
+		"run_id":        exec.RunID.String(),
+		"attempt_count": exec.AttemptCount,
+		"reason":        reason,
+	}); err != nil {
+		return nil, err
+	}
+	return &ActionResult{Message: "Tool execution discarded"}, nil
+}
+
+// ReleaseLeadership releases the current leader's lease so that the next
+// instance to try acquires it. The previous leader steps down when its next
+// refresh fails.
+func (s *Service[TTx]) ReleaseLeadership(ctx context.Context, actor string) (*ActionResult, error) {
+	leaderID, err := s.store.GetLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leaderID == "" {
+		return nil, fmt.Errorf("%w: there is no leader", ErrInvalidState)
+	}
+
+	if err := s.store.ReleaseLeader(ctx, leaderID); err != nil {
+		return nil, err
+	}
+
+	if err := s.audit(ctx, ActionLeaderRelease, "leader", leaderID, nil, actor, nil); err != nil {
+		return nil, err
+	}
+	return &ActionResult{Message: fmt.Sprintf("Released leadership of %s", leaderID)}, nil
+}
+
+// ListAuditEvents returns a page of the audit log, newest first.
+func (s *Service[TTx]) ListAuditEvents(ctx context.Context, params AuditEventListParams) (*AuditEventList, error) {
+	if params.Limit <= 0 {
+		params.Limit = 50
+	}
+	params.Limit = ValidateLimit(params.Limit)
+	params.Offset = ValidateOffset(params.Offset)
+
+	events, total, err := s.store.ListAuditEvents(ctx, driver.ListAuditEventsParams{
+		MetadataFilter: params.MetadataFilter,
+		TargetType:     params.TargetType,
+		TargetID:       params.TargetID,
+		Actor:          params.Actor,
+		Limit:          params.Limit,
+		Offset:         params.Offset,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditEventList{
+		Events:     events,
+		TotalCount: total,
+		HasMore:    params.Offset+len(events) < total,
+	}, nil
+}
+
+// getRun returns a run, or ErrNotFound.
+func (s *Service[TTx]) getRun(ctx context.Context, id uuid.UUID) (*driver.Run, error) {
+	run, err := s.store.GetRun(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, ErrNotFound
+	}
+	return run, nil
+}
+
+// getToolExecutionWithRun returns a tool execution and its run, or ErrNotFound.
+func (s *Service[TTx]) getToolExecutionWithRun(ctx context.Context, id uuid.UUID) (*driver.ToolExecution, *driver.Run, error) {
+	exec, err := s.store.GetToolExecution(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exec == nil {
+		return nil, nil, ErrNotFound
+	}
+	run, err := s.getRun(ctx, exec.RunID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return exec, run, nil
+}
+
+// audit records an operator action. The action has already been performed
+// when recording fails, which the returned error says.
+func (s *Service[TTx]) audit(ctx context.Context, action, targetType, targetID string, sessionID *uuid.UUID, actor string, details map[string]any) error {
+	if actor == "" {
+		actor = anonymousActor
+	}
+	_, err := s.store.CreateAuditEvent(ctx, driver.CreateAuditEventParams{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		SessionID:  sessionID,
+		Actor:      actor,
+		Details:    details,
+	})
+	if err != nil {
+		return fmt.Errorf("%s was performed but recording it in the audit log failed: %w", action, err)
+	}
+	return nil
+}
+
+// isRunFinalized reports whether a run is in a terminal state.
+func isRunFinalized(state string) bool {
+	return state == "completed" || state == "failed" || state == "cancelled"
+}
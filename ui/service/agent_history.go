@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// maxDiffCells bounds the size of the table computed for a line diff.
+// Larger prompts are shown as entirely removed and added.
+const maxDiffCells = 4_000_000
+
+// GetAgentHistory returns an agent with its versions, newest first. Versions
+// saved through the UI are attributed to the actor recorded in the audit log.
+func (s *Service[TTx]) GetAgentHistory(ctx context.Context, id uuid.UUID) (*AgentHistory, error) {
+	agent, err := s.getAgent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.store.ListAgentVersions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	events, _, err := s.store.ListAuditEvents(ctx, driver.ListAuditEventsParams{
+		TargetType: "agent",
+		TargetID:   id.String(),
+		Limit:      MaxPageLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Events are newest first, so the latest event for a version wins
+	byVersion := make(map[int]*driver.AuditEvent, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		if version, ok := detailInt(events[i].Details, "version"); ok {
+			byVersion[version] = events[i]
+		}
+	}
+
+	history := &AgentHistory{Agent: agent}
+	for i, version := range versions {
+		entry := &AgentVersionEntry{
+			Version:   version,
+			IsCurrent: i == 0,
+		}
+		if event := byVersion[version.Version]; event != nil {
+			entry.Action = event.Action
+			entry.Actor = event.Actor
+			if restored, ok := detailInt(event.Details, "restored_version"); ok {
+				entry.Restored = &restored
+			}
+		}
+		history.Versions = append(history.Versions, entry)
+	}
+	return history, nil
+}
+
+// DiffAgentVersions compares two versions of an agent.
+func (s *Service[TTx]) DiffAgentVersions(ctx context.Context, id uuid.UUID, from, to int) (*AgentDiff, error) {
+	fromVersion, err := s.store.GetAgentVersion(ctx, id, from)
+	if err != nil {
+		return nil, err
+	}
+	toVersion, err := s.store.GetAgentVersion(ctx, id, to)
+	if err != nil {
+		return nil, err
+	}
+	if fromVersion == nil || toVersion == nil {
+		return nil, ErrNotFound
+	}
+
+	diff := &AgentDiff{From: fromVersion, To: toVersion}
+	a, b := fromVersion.Agent, toVersion.Agent
+	fields := []struct {
+		name     string
+		from, to string
+	}{
+		{"Name", a.Name, b.Name},
+		{"Description", a.Description, b.Description},
+		{"Model", a.Model, b.Model},
+		{"Tools", strings.Join(a.ToolNames, ", "), strings.Join(b.ToolNames, ", ")},
+		{"Delegate agents", joinUUIDs(a.AgentIDs), joinUUIDs(b.AgentIDs)},
+		{"Max tokens", formatIntPtr(a.MaxTokens), formatIntPtr(b.MaxTokens)},
+		{"Temperature", formatFloatPtr(a.Temperature), formatFloatPtr(b.Temperature)},
+		{"Top K", formatIntPtr(a.TopK), formatIntPtr(b.TopK)},
+		{"Top P", formatFloatPtr(a.TopP), formatFloatPtr(b.TopP)},
+		{"Metadata", formatJSON(a.Metadata), formatJSON(b.Metadata)},
+		{"Config", formatJSON(a.Config), formatJSON(b.Config)},
+		{"Fallback models", strings.Join(a.FallbackModels, ", "), strings.Join(b.FallbackModels, ", ")},
+		{"Fallback latency budget (ms)", formatIntPtr(a.FallbackLatencyBudgetMs), formatIntPtr(b.FallbackLatencyBudgetMs)},
+		{"Max concurrent runs", formatIntPtr(a.MaxConcurrentRuns), formatIntPtr(b.MaxConcurrentRuns)},
+	}
+	for _, field := range fields {
+		if field.from != field.to {
+			diff.Changes = append(diff.Changes, FieldChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+	if a.SystemPrompt != b.SystemPrompt {
+		diff.SystemPrompt = diffLines(a.SystemPrompt, b.SystemPrompt)
+	}
+	return diff, nil
+}
+
+// diffLines returns a line diff of two texts, using the longest common
+// subsequence of their lines.
+func diffLines(a, b string) []DiffLine {
+	x, y := splitLines(a), splitLines(b)
+	n, m := len(x), len(y)
+
+	var lines []DiffLine
+	if (n+1)*(m+1) > maxDiffCells {
+		for _, line := range x {
+			lines = append(lines, DiffLine{Op: "-", Text: line})
+		}
+		for _, line := range y {
+			lines = append(lines, DiffLine{Op: "+", Text: line})
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case x[i] == y[j]:
+			lines = append(lines, DiffLine{Op: "=", Text: x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{Op: "-", Text: x[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{Op: "+", Text: y[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		lines = append(lines, DiffLine{Op: "-", Text: x[i]})
+	}
+	for ; j < m; j++ {
+		lines = append(lines, DiffLine{Op: "+", Text: y[j]})
+	}
+	return lines
+}
+
+// splitLines splits text into lines. An empty text has no lines.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+}
+
+// detailInt reads an integer from audit event details, which hold JSON
+// numbers once they have been stored.
+func detailInt(details map[string]any, key string) (int, bool) {
+	switch v := details[key].(type) {
+	case int:
+		return v, true
+	case float64:
+		return int(v), true
+	case json.Number:
+		n, err := v.Int64()
+		return int(n), err == nil
+	}
+	return 0, false
+}
+
+func joinUUIDs(ids []uuid.UUID) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = id.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatIntPtr(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
+
+func formatFloatPtr(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'g', -1, 64)
+}
+
+func formatJSON(v map[string]any) string {
+	if len(v) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// Audit log actions recorded by agent management.
+const (
+	ActionAgentCreate  = "agent.create"
+	ActionAgentUpdate  = "agent.update"
+	ActionAgentRestore = "agent.restore"
+)
+
+// maxAgentNameLength mirrors the agent_name_valid constraint.
+const maxAgentNameLength = 255
+
+// CreateAgent validates and creates an agent definition.
+func (s *Service[TTx]) CreateAgent(ctx context.Context, input AgentInput, actor string) (*driver.AgentDefinition, error) {
+	input = input.normalize()
+	if err := s.ValidateAgent(ctx, uuid.Nil, input); err != nil {
+		return nil, err
+	}
+
+	agent := &driver.AgentDefinition{}
+	input.apply(agent)
+	created, err := s.store.CreateAgent(ctx, agent)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.audit(ctx, ActionAgentCreate, "agent", created.ID.String(), nil, actor, map[string]any{
+		"name":    created.Name,
+		"version": 1,
+	}); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// UpdateAgent validates the input and applies it to an agent. Fields that
+// AgentInput does not cover, such as Config and the fallback models, keep
+// their values.
+func (s *Service[TTx]) UpdateAgent(ctx context.Context, id uuid.UUID, input AgentInput, actor string) (*ActionResult, error) {
+	agent, err := s.getAgent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	input = input.normalize()
+	if err := s.ValidateAgent(ctx, id, input); err != nil {
+		return nil, err
+	}
+
+	input.apply(agent)
+	version, err := s.saveAgentVersion(ctx, agent, ActionAgentUpdate, actor, nil)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return &ActionResult{Message: "No changes to save"}, nil
+	}
+	return &ActionResult{Message: fmt.Sprintf("Saved %s as version %d", agent.Name, version)}, nil
+}
+
+// RestoreAgentVersion makes an earlier version the current definition of an
+// agent, recording it as a new version.
+func (s *Service[TTx]) RestoreAgentVersion(ctx context.Context, id uuid.UUID, version int, actor string) (*ActionResult, error) {
+	agent, err := s.getAgent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	restored, err := s.store.GetAgentVersion(ctx, id, version)
+	if err != nil {
+		return nil, err
+	}
+	if restored == nil {
+		return nil, ErrNotFound
+	}
+
+	// Tools and delegates may have gone away since the version was recorded
+	input := AgentInputFromDefinition(restored.Agent)
+	if err := s.ValidateAgent(ctx, id, input); err != nil {
+		return nil, err
+	}
+
+	definition := *restored.Agent
+	definition.ID = agent.ID
+	definition.CreatedAt = agent.CreatedAt
+	definition.UpdatedAt = agent.UpdatedAt
+	saved, err := s.saveAgentVersion(ctx, &definition, ActionAgentRestore, actor, map[string]any{
+		"restored_version": version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if saved == 0 {
+		return nil, fmt.Errorf("%w: version %d is the current definition", ErrInvalidState, version)
+	}
+	return &ActionResult{Message: fmt.Sprintf("Restored version %d as version %d", version, saved)}, nil
+}
+
+// saveAgentVersion updates an agent and audits the version the update
+// recorded. It returns the new version, or 0 if the definition did not change.
+func (s *Service[TTx]) saveAgentVersion(ctx context.Context, agent *driver.AgentDefinition, action, actor string, details map[string]any) (int, error) {
+	before, err := s.store.ListAgentVersions(ctx, agent.ID)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.store.UpdateAgent(ctx, agent); err != nil {
+		return 0, err
+	}
+	after, err := s.store.ListAgentVersions(ctx, agent.ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(after) == 0 || (len(before) > 0 && after[0].Version == before[0].Version) {
+		return 0, nil
+	}
+
+	version := after[0].Version
+	if details == nil {
+		details = map[string]any{}
+	}
+	details["name"] = agent.Name
+	details["version"] = version
+	if err := s.audit(ctx, action, "agent", agent.ID.String(), nil, actor, details); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// GetAgentFormOptions returns the choices offered when editing an agent:
+// registered tools, agents that can be delegated to, and models in use.
+func (s *Service[TTx]) GetAgentFormOptions(ctx context.Context, metadataFilter map[string]any) (*AgentFormOptions, error) {
+	tools, err := s.store.ListTools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	agents, _, err := s.store.ListAgents(ctx, driver.ListAgentsParams{
+		MetadataFilter: metadataFilter,
+		Limit:          MaxPageLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	options := &AgentFormOptions{Agents: agents}
+	for _, tool := range tools {
+		if !tool.IsAgentTool {
+			options.Tools = append(options.Tools, tool)
+		}
+	}
+	slices.SortFunc(options.Tools, func(a, b *driver.ToolDefinition) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, agent := range agents {
+		if !slices.Contains(options.Models, agent.Model) {
+			options.Models = append(options.Models, agent.Model)
+		}
+	}
+	slices.Sort(options.Models)
+	return options, nil
+}
+
+// ValidateAgent checks an agent definition before it is saved: required
+// fields, sampling parameter ranges, that tools are registered, that
+// delegate agents exist without forming a delegation cycle, and that no
+// other agent has the same name and metadata. id is uuid.Nil for new agents.
+// Problems are reported together in a *ValidationError.
+func (s *Service[TTx]) ValidateAgent(ctx context.Context, id uuid.UUID, input AgentInput) error {
+	input = input.normalize()
+	var problems []string
+
+	switch {
+	case input.Name == "":
+		problems = append(problems, "name is required")
+	case utf8.RuneCountInString(input.Name) > maxAgentNameLength:
+		problems = append(problems, fmt.Sprintf("name must be at most %d characters", maxAgentNameLength))
+	}
+	if input.Model == "" {
+		problems = append(problems, "model is required")
+	}
+	if input.MaxTokens != nil && *input.MaxTokens <= 0 {
+		problems = append(problems, "max tokens must be positive")
+	}
+	if input.Temperature != nil && (*input.Temperature < 0 || *input.Temperature > 1) {
+		problems = append(problems, "temperature must be between 0 and 1")
+	}
+	if input.TopK != nil && *input.TopK <= 0 {
+		problems = append(problems, "top_k must be positive")
+	}
+	if input.TopP != nil && (*input.TopP < 0 || *input.TopP > 1) {
+		problems = append(problems, "top_p must be between 0 and 1")
+	}
+
+	// Tools must be registered by an instance
+	if len(input.ToolNames) > 0 {
+		tools, err := s.store.ListTools(ctx)
+		if err != nil {
+			return err
+		}
+		registered := make(map[string]bool, len(tools))
+		for _, tool := range tools {
+			if !tool.IsAgentTool {
+				registered[tool.Name] = true
+			}
+		}
+		for _, name := range input.ToolNames {
+			if !registered[name] {
+				problems = append(problems, fmt.Sprintf("tool %q is not registered", name))
+			}
+		}
+	}
+
+	// Delegates must exist and must not delegate back to this agent
+	for _, delegateID := range input.AgentIDs {
+		if delegateID == id {
+			problems = append(problems, "an agent cannot delegate to itself")
+			continue
+		}
+		delegate, err := s.store.GetAgent(ctx, delegateID)
+		if err != nil {
+			return err
+		}
+		if delegate == nil {
+			problems = append(problems, fmt.Sprintf("delegate agent %s does not exist", delegateID))
+			continue
+		}
+		if id != uuid.Nil {
+			cycle, err := s.delegatesTo(ctx, delegate, id)
+			if err != nil {
+				return err
+			}
+			if cycle {
+				problems = append(problems, fmt.Sprintf("delegating to %q would create a delegation cycle", delegate.Name))
+			}
+		}
+	}
+
+	// Name and metadata together are unique
+	if input.Name != "" {
+		agents, _, err := s.store.ListAgents(ctx, driver.ListAgentsParams{Name: input.Name, Limit: 1000})
+		if err != nil {
+			return err
+		}
+		for _, other := range agents {
+			if other.ID != id && other.Name == input.Name &&
+				reflect.DeepEqual(normalizeJSON(other.Metadata), normalizeJSON(input.Metadata)) {
+				problems = append(problems, fmt.Sprintf("an agent named %q with the same metadata already exists", input.Name))
+				break
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// delegatesTo reports whether agent delegates to target, directly or through
+// other agents.
+func (s *Service[TTx]) delegatesTo(ctx context.Context, agent *driver.AgentDefinition, target uuid.UUID) (bool, error) {
+	visited := map[uuid.UUID]bool{agent.ID: true}
+	queue := slices.Clone(agent.AgentIDs)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == target {
+			return true, nil
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+
+		next, err := s.store.GetAgent(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if next != nil {
+			queue = append(queue, next.AgentIDs...)
+		}
+	}
+	return false, nil
+}
+
+// getAgent returns an agent, or ErrNotFound.
+func (s *Service[TTx]) getAgent(ctx context.Context, id uuid.UUID) (*driver.AgentDefinition, error) {
+	agent, err := s.store.GetAgent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if agent == nil {
+		return nil, ErrNotFound
+	}
+	return agent, nil
+}
+
+// AgentInputFromDefinition returns the editable fields of an agent.
+func AgentInputFromDefinition(agent *driver.AgentDefinition) AgentInput {
+	return AgentInput{
+		Name:         agent.Name,
+		Description:  agent.Description,
+		Model:        agent.Model,
+		SystemPrompt: agent.SystemPrompt,
+		ToolNames:    slices.Clone(agent.ToolNames),
+		AgentIDs:     slices.Clone(agent.AgentIDs),
+		MaxTokens:    agent.MaxTokens,
+		Temperature:  agent.Temperature,
+		TopK:         agent.TopK,
+		TopP:         agent.TopP,
+		Metadata:     agent.Metadata,
+	}
+}
+
+// normalize trims the text fields and removes duplicate tools and delegates.
+func (in AgentInput) normalize() AgentInput {
+	in.Name = strings.TrimSpace(in.Name)
+	in.Description = strings.TrimSpace(in.Description)
+	in.Model = strings.TrimSpace(in.Model)
+
+	var tools []string
+	for _, name := range in.ToolNames {
+		if name = strings.TrimSpace(name); name != "" && !slices.Contains(tools, name) {
+			tools = append(tools, name)
+		}
+	}
+	in.ToolNames = tools
+
+	var delegates []uuid.UUID
+	for _, id := range in.AgentIDs {
+		if !slices.Contains(delegates, id) {
+			delegates = append(delegates, id)
+		}
+	}
+	in.AgentIDs = delegates
+	return in
+}
+
+// apply copies the input onto an agent definition.
+func (in AgentInput) apply(agent *driver.AgentDefinition) {
+	agent.Name = in.Name
+	agent.Description = in.Description
+	agent.Model = in.Model
+	agent.SystemPrompt = in.SystemPrompt
+	agent.ToolNames = in.ToolNames
+	agent.AgentIDs = in.AgentIDs
+	agent.MaxTokens = in.MaxTokens
+	agent.Temperature = in.Temperature
+	agent.TopK = in.TopK
+	agent.TopP = in.TopP
+	agent.Metadata = in.Metadata
+}
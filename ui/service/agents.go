@@ -38,6 +38,12 @@ func (s *Service[TTx]) ListAgents(ctx context.Context, metadataFilter map[string
 				switch run.State {
 				case "pending", "batch_submitting", "batch_pending", "batch_processing", "streaming", "pending_tools":
 					stats.ActiveRuns++
+					// Runs hold a concurrency slot from their first claim
+					if run.StartedAt != nil {
+						stats.RunningRuns++
+					} else {
+						stats.WaitingRuns++
+					}
 				case "completed":
 					stats.CompletedRuns++
 				case "failed":
@@ -188,6 +194,8 @@ func (s *Service[TTx]) ListTools(ctx context.Context) ([]*ToolWithStats, error)
 				switch exec.State {
 				case "pending":
 					stats.PendingCount++
+				case "running":
+					stats.RunningCount++
 				case "completed":
 					stats.CompletedCount++
 				case "failed":
@@ -1,9 +1,25 @@
 package service
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 // Service package errors.
 var (
 	// ErrNotFound indicates a resource was not found.
 	ErrNotFound = errors.New("service: not found")
+
+	// ErrInvalidState indicates an operator action does not apply to the
+	// current state of its target.
+	ErrInvalidState = errors.New("service: invalid state")
 )
+
+// ValidationError lists the problems found in an agent definition.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "service: invalid agent: " + strings.Join(e.Problems, "; ")
+}
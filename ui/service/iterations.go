@@ -35,6 +35,8 @@ func (s *Service[TTx]) ListIterations(ctx context.Context, runID uuid.UUID) ([]*
 			OutputTokens:    iter.OutputTokens,
 			Duration:        duration,
 			ErrorMessage:    iter.ErrorMessage,
+			APIAttempts:     iter.APIAttempts,
+			Model:           iter.Model,
 			CreatedAt:       iter.CreatedAt,
 			CompletedAt:     iter.CompletedAt,
 		})
@@ -153,6 +155,8 @@ func (s *Service[TTx]) GetIterationTimeline(ctx context.Context, runID uuid.UUID
 				OutputTokens:    iter.OutputTokens,
 				Duration:        duration,
 				ErrorMessage:    iter.ErrorMessage,
+				APIAttempts:     iter.APIAttempts,
+				Model:           iter.Model,
 				CreatedAt:       iter.CreatedAt,
 				CompletedAt:     iter.CompletedAt,
 			},
@@ -147,6 +147,11 @@ func (s *Service[TTx]) GetRunDetail(ctx context.Context, id uuid.UUID) (*RunDeta
 		HierarchyDepth: run.Depth,
 	}
 
+	if run.State == "pending" && run.ScheduledAt.After(time.Now()) {
+		retryAt := run.ScheduledAt
+		detail.RetryAt = &retryAt
+	}
+
 	// Get session summary
 	session, err := s.store.GetSession(ctx, run.SessionID)
 	if err == nil {
@@ -181,6 +186,8 @@ func (s *Service[TTx]) GetRunDetail(ctx context.Context, id uuid.UUID) (*RunDeta
 				OutputTokens:    iter.OutputTokens,
 				Duration:        duration,
 				ErrorMessage:    iter.ErrorMessage,
+				APIAttempts:     iter.APIAttempts,
+				Model:           iter.Model,
 				CreatedAt:       iter.CreatedAt,
 				CompletedAt:     iter.CompletedAt,
 			})
@@ -333,6 +340,8 @@ func (s *Service[TTx]) GetRunIterations(ctx context.Context, runID uuid.UUID) ([
 			OutputTokens:    iter.OutputTokens,
 			Duration:        duration,
 			ErrorMessage:    iter.ErrorMessage,
+			APIAttempts:     iter.APIAttempts,
+			Model:           iter.Model,
 			CreatedAt:       iter.CreatedAt,
 			CompletedAt:     iter.CompletedAt,
 		})
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+
+	"github.com/youssefsiam38/agentpg/driver"
+)
+
+// ListSchedules returns all schedules with their agent names.
+func (s *Service[TTx]) ListSchedules(ctx context.Context, metadataFilter map[string]any) ([]*ScheduleWithAgent, error) {
+	schedules, _, err := s.store.ListSchedules(ctx, driver.ListSchedulesParams{
+		MetadataFilter: metadataFilter,
+		Limit:          1000, // Get all schedules
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve agent names once per agent
+	agentNames := make(map[string]string)
+	results := make([]*ScheduleWithAgent, 0, len(schedules))
+	for _, sched := range schedules {
+		key := sched.AgentID.String()
+		name, ok := agentNames[key]
+		if !ok {
+			if agent, err := s.store.GetAgent(ctx, sched.AgentID); err == nil && agent != nil {
+				name = agent.Name
+			}
+			agentNames[key] = name
+		}
+
+		results = append(results, &ScheduleWithAgent{
+			Schedule:  sched,
+			AgentName: name,
+		})
+	}
+
+	return results, nil
+}
@@ -2,6 +2,9 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -35,12 +38,13 @@ func (s *Service[TTx]) ListSessions(ctx context.Context, params SessionListParam
 	summaries := make([]*SessionSummary, 0, len(driverSessions))
 	for _, session := range driverSessions {
 		summary := &SessionSummary{
-			ID:              session.ID,
-			Metadata:        session.Metadata,
-			Depth:           session.Depth,
-			CompactionCount: session.CompactionCount,
-			CreatedAt:       session.CreatedAt,
-			LastActivityAt:  session.UpdatedAt, // Use UpdatedAt as last activity
+			ID:                  session.ID,
+			Metadata:            session.Metadata,
+			Depth:               session.Depth,
+			CompactionCount:     session.CompactionCount,
+			CreatedAt:           session.CreatedAt,
+			LastActivityAt:      session.UpdatedAt, // Use UpdatedAt as last activity
+			ForkedFromMessageID: session.ForkedFromMessageID,
 		}
 
 		// Get run count for this session
@@ -204,13 +208,25 @@ func (s *Service[TTx]) GetSessionDetail(ctx context.Context, id uuid.UUID) (*Ses
 	if session.ParentSessionID != nil {
 		parent, parentErr := s.store.GetSession(ctx, *session.ParentSessionID)
 		if parentErr == nil {
-			detail.ParentSession = &SessionSummary{
-				ID:              parent.ID,
-				Metadata:        parent.Metadata,
-				Depth:           parent.Depth,
-				CompactionCount: parent.CompactionCount,
-				CreatedAt:       parent.CreatedAt,
-			}
+			detail.ParentSession = newSessionSummary(parent)
+		}
+	}
+
+	// Get child sessions and the tree the session belongs to
+	children, _, err := s.store.ListSessions(ctx, driver.ListSessionsParams{
+		ParentSessionID: &id,
+		Limit:           100,
+		OrderDir:        "asc",
+	})
+	if err == nil {
+		for _, child := range children {
+			detail.ChildSessions = append(detail.ChildSessions, newSessionSummary(child))
+		}
+	}
+	if session.ParentSessionID != nil || len(children) > 0 {
+		tree, treeErr := s.GetSessionTree(ctx, id)
+		if treeErr == nil {
+			detail.ForkTree = tree
 		}
 	}
 
@@ -223,6 +239,103 @@ func (s *Service[TTx]) GetSessionDetail(ctx context.Context, id uuid.UUID) (*Ses
 	return detail, nil
 }
 
+// maxSessionTreeSize caps the number of sessions loaded into a session tree.
+const maxSessionTreeSize = 100
+
+// GetSessionTree returns the tree of sessions the session belongs to, rooted
+// at its top-level ancestor. Forks carry a preview of the message they were
+// forked at. Children are ordered by creation time, and the tree is cut off
+// after maxSessionTreeSize sessions.
+func (s *Service[TTx]) GetSessionTree(ctx context.Context, id uuid.UUID) (*SessionTreeNode, error) {
+	session, err := s.store.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrNotFound
+	}
+
+	// Walk up to the root
+	root := session
+	for root.ParentSessionID != nil {
+		parent, err := s.store.GetSession(ctx, *root.ParentSessionID)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			break
+		}
+		root = parent
+	}
+
+	// Walk down breadth-first
+	tree := s.newSessionTreeNode(ctx, root, id)
+	queue := []*SessionTreeNode{tree}
+	size := 1
+	for len(queue) > 0 && size < maxSessionTreeSize {
+		node := queue[0]
+		queue = queue[1:]
+
+		children, _, err := s.store.ListSessions(ctx, driver.ListSessionsParams{
+			ParentSessionID: &node.Session.ID,
+			Limit:           maxSessionTreeSize - size,
+			OrderDir:        "asc",
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			childNode := s.newSessionTreeNode(ctx, child, id)
+			node.Children = append(node.Children, childNode)
+			queue = append(queue, childNode)
+		}
+		size += len(children)
+	}
+
+	return tree, nil
+}
+
+// newSessionTreeNode creates a tree node for a session, looking up the
+// preview of its fork point.
+func (s *Service[TTx]) newSessionTreeNode(ctx context.Context, session *driver.Session, currentID uuid.UUID) *SessionTreeNode {
+	node := &SessionTreeNode{
+		Session: newSessionSummary(session),
+		Current: session.ID == currentID,
+	}
+	if session.ForkedFromMessageID != nil {
+		blocks, err := s.store.GetContentBlocks(ctx, *session.ForkedFromMessageID)
+		if err == nil {
+			for _, block := range blocks {
+				if block.Type == "text" || block.Type == "tool_result" {
+					preview := block.Text
+					if block.Type == "tool_result" {
+						preview = block.ToolContent
+					}
+					if len(preview) > 100 {
+						preview = preview[:100] + "..."
+					}
+					node.ForkPointPreview = preview
+					break
+				}
+			}
+		}
+	}
+	return node
+}
+
+// newSessionSummary converts a session without the computed counts.
+func newSessionSummary(session *driver.Session) *SessionSummary {
+	return &SessionSummary{
+		ID:                  session.ID,
+		Metadata:            session.Metadata,
+		Depth:               session.Depth,
+		CompactionCount:     session.CompactionCount,
+		CreatedAt:           session.CreatedAt,
+		LastActivityAt:      session.UpdatedAt,
+		ForkedFromMessageID: session.ForkedFromMessageID,
+	}
+}
+
 // CreateSession creates a new session.
 func (s *Service[TTx]) CreateSession(ctx context.Context, req CreateSessionRequest) (*driver.Session, error) {
 	return s.store.CreateSession(ctx, driver.CreateSessionParams{
@@ -248,3 +361,71 @@ func (s *Service[TTx]) GetMetadataValues(ctx context.Context, key string) ([]*Me
 
 	return options, nil
 }
+
+// SessionMatchesMetadata reports whether the session's metadata contains every
+// key-value pair of filter. An empty filter matches every session.
+// Used to keep detail pages within the caller's tenant scope.
+func (s *Service[TTx]) SessionMatchesMetadata(ctx context.Context, id uuid.UUID, filter map[string]any) (bool, error) {
+	if len(filter) == 0 {
+		return true, nil
+	}
+	session, err := s.store.GetSession(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	return MatchesMetadata(session.Metadata, filter), nil
+}
+
+// MatchesMetadata reports whether metadata contains filter, with the same
+// semantics as the JSONB @> operator the drivers use for list filtering.
+func MatchesMetadata(metadata, filter map[string]any) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	return jsonContains(normalizeJSON(metadata), normalizeJSON(filter))
+}
+
+// normalizeJSON round-trips v through encoding/json so that numbers and
+// nested values compare the same way they would after storage.
+func normalizeJSON(v map[string]any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var result any
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+	return result
+}
+
+// jsonContains reports whether doc contains sub, like the JSONB @> operator.
+func jsonContains(doc, sub any) bool {
+	switch subVal := sub.(type) {
+	case map[string]any:
+		docMap, ok := doc.(map[string]any)
+		if !ok {
+			return false
+		}
+		for k, v := range subVal {
+			dv, ok := docMap[k]
+			if !ok || !jsonContains(dv, v) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		docArr, ok := doc.([]any)
+		if !ok {
+			return false
+		}
+		for _, v := range subVal {
+			if !slices.ContainsFunc(docArr, func(dv any) bool { return jsonContains(dv, v) }) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(doc, sub)
+	}
+}
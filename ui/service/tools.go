@@ -16,13 +16,14 @@ func (s *Service[TTx]) ListToolExecutions(ctx context.Context, params ToolExecut
 
 	// Use the driver's ListToolExecutions method with filtering and pagination
 	executions, _, err := s.store.ListToolExecutions(ctx, driver.ListToolExecutionsParams{
-		RunID:       params.RunID,
-		IterationID: params.IterationID,
-		ToolName:    params.ToolName,
-		State:       params.State,
-		IsAgentTool: params.IsAgentTool,
-		Limit:       params.Limit,
-		Offset:      params.Offset,
+		MetadataFilter: params.MetadataFilter,
+		RunID:          params.RunID,
+		IterationID:    params.IterationID,
+		ToolName:       params.ToolName,
+		State:          params.State,
+		IsAgentTool:    params.IsAgentTool,
+		Limit:          params.Limit,
+		Offset:         params.Offset,
 	})
 	if err != nil {
 		return nil, err
@@ -127,6 +128,8 @@ func (s *Service[TTx]) GetToolExecutionDetail(ctx context.Context, id uuid.UUID)
 			InputTokens:     iter.InputTokens,
 			OutputTokens:    iter.OutputTokens,
 			Duration:        duration,
+			APIAttempts:     iter.APIAttempts,
+			Model:           iter.Model,
 			CreatedAt:       iter.CreatedAt,
 		}
 	}
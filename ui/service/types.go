@@ -176,6 +176,8 @@ type SessionSummary struct {
 	CompactionCount int            `json:"compaction_count"`
 	LastActivityAt  time.Time      `json:"last_activity_at"`
 	CreatedAt       time.Time      `json:"created_at"`
+	// Set for sessions forked from a message of their parent session
+	ForkedFromMessageID *uuid.UUID `json:"forked_from_message_id,omitempty"`
 }
 
 // SessionDetail contains detailed information about a session.
@@ -183,6 +185,7 @@ type SessionDetail struct {
 	Session        *driver.Session   `json:"session"`
 	ParentSession  *SessionSummary   `json:"parent_session,omitempty"`
 	ChildSessions  []*SessionSummary `json:"child_sessions,omitempty"`
+	ForkTree       *SessionTreeNode  `json:"fork_tree,omitempty"` // Set when the session has a parent or children
 	RunCount       int               `json:"run_count"`
 	MessageCount   int               `json:"message_count"`
 	TokenUsage     TokenUsageSummary `json:"token_usage"`
@@ -191,13 +194,23 @@ type SessionDetail struct {
 	Conversation   *ConversationView `json:"conversation,omitempty"`
 }
 
+// SessionTreeNode is a session in the tree of sessions descending from a
+// root session. Forks carry a preview of the parent message they were
+// forked at.
+type SessionTreeNode struct {
+	Session          *SessionSummary    `json:"session"`
+	ForkPointPreview string             `json:"fork_point_preview,omitempty"`
+	Current          bool               `json:"current"` // The session the tree was built for
+	Children         []*SessionTreeNode `json:"children,omitempty"`
+}
+
 // RunListParams contains parameters for listing runs.
 type RunListParams struct {
 	SessionID      *uuid.UUID
 	MetadataFilter map[string]any // Filter sessions by metadata key-value pairs
 	AgentName      string
 	State          string
-	RunMode        string // "batch", "streaming"
+	RunMode        string // "batch", "streaming", "auto"
 	Limit          int
 	Offset         int
 	OrderBy        string // "created_at", "finalized_at"
@@ -238,6 +251,9 @@ type RunDetail struct {
 	ToolExecutions []*ToolExecutionSummary `json:"tool_executions"`
 	Messages       []*MessageSummary       `json:"messages"`
 
+	// RetryAt is set while the run is waiting to retry a failed API call
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+
 	// Hierarchy info
 	ParentRun      *RunSummary   `json:"parent_run,omitempty"`
 	ChildRuns      []*RunSummary `json:"child_runs,omitempty"`
@@ -263,21 +279,24 @@ type IterationListParams struct {
 }
 
 // IterationSummary contains summary information about an iteration.
+
 type IterationSummary struct {
-	ID              uuid.UUID      `json:"id"`
-	RunID           uuid.UUID      `json:"run_id"`
-	IterationNumber int            `json:"iteration_number"`
-	IsStreaming     bool           `json:"is_streaming"`
-	TriggerType     string         `json:"trigger_type"`
-	StopReason      *string        `json:"stop_reason,omitempty"`
-	HasToolUse      bool           `json:"has_tool_use"`
-	ToolCount       int            `json:"tool_count"`
-	InputTokens     int            `json:"input_tokens"`
-	OutputTokens    int            `json:"output_tokens"`
-	Duration        *time.Duration `json:"duration,omitempty"`
-	ErrorMessage    *string        `json:"error_message,omitempty"`
-	CreatedAt       time.Time      `json:"created_at"`
-	CompletedAt     *time.Time     `json:"completed_at,omitempty"`
+	ID              uuid.UUID           `json:"id"`
+	RunID           uuid.UUID           `json:"run_id"`
+	IterationNumber int                 `json:"iteration_number"`
+	IsStreaming     bool                `json:"is_streaming"`
+	TriggerType     string              `json:"trigger_type"`
+	StopReason      *string             `json:"stop_reason,omitempty"`
+	HasToolUse      bool                `json:"has_tool_use"`
+	ToolCount       int                 `json:"tool_count"`
+	InputTokens     int                 `json:"input_tokens"`
+	OutputTokens    int                 `json:"output_tokens"`
+	Duration        *time.Duration      `json:"duration,omitempty"`
+	ErrorMessage    *string             `json:"error_message,omitempty"`
+	APIAttempts     []driver.APIAttempt `json:"api_attempts,omitempty"`
+	Model           *string             `json:"model,omitempty"`
+	CreatedAt       time.Time           `json:"created_at"`
+	CompletedAt     *time.Time          `json:"completed_at,omitempty"`
 }
 
 // IterationDetail contains detailed information about an iteration.
@@ -291,13 +310,14 @@ type IterationDetail struct {
 
 // ToolExecutionListParams contains parameters for listing tool executions.
 type ToolExecutionListParams struct {
-	RunID       *uuid.UUID
-	IterationID *uuid.UUID
-	ToolName    string
-	State       string
-	IsAgentTool *bool
-	Limit       int
-	Offset      int
+	MetadataFilter map[string]any
+	RunID          *uuid.UUID
+	IterationID    *uuid.UUID
+	ToolName       string
+	State          string
+	IsAgentTool    *bool
+	Limit          int
+	Offset         int
 }
 
 // ToolExecutionSummary contains summary information about a tool execution.
@@ -396,6 +416,8 @@ type AgentWithStats struct {
 	Agent             *driver.AgentDefinition `json:"agent"`
 	TotalRuns         int                     `json:"total_runs"`
 	ActiveRuns        int                     `json:"active_runs"`
+	RunningRuns       int                     `json:"running_runs"` // runs holding a concurrency slot
+	WaitingRuns       int                     `json:"waiting_runs"` // pending runs not started yet
 	CompletedRuns     int                     `json:"completed_runs"`
 	FailedRuns        int                     `json:"failed_runs"`
 	AvgTokensPerRun   int                     `json:"avg_tokens_per_run"`
@@ -408,6 +430,7 @@ type ToolWithStats struct {
 	Tool            *driver.ToolDefinition `json:"tool"`
 	TotalExecutions int                    `json:"total_executions"`
 	PendingCount    int                    `json:"pending_count"`
+	RunningCount    int                    `json:"running_count"`
 	CompletedCount  int                    `json:"completed_count"`
 	FailedCount     int                    `json:"failed_count"`
 	AvgDuration     *time.Duration         `json:"avg_duration,omitempty"`
@@ -534,3 +557,90 @@ type CompactionStats struct {
 	TotalMessagesArchived int     `json:"total_messages_archived"`
 	AvgReductionPercent   float64 `json:"avg_reduction_percent"`
 }
+
+// ScheduleWithAgent contains a schedule with its agent name resolved.
+type ScheduleWithAgent struct {
+	Schedule  *driver.Schedule `json:"schedule"`
+	AgentName string           `json:"agent_name"`
+}
+
+// ActionResult describes the outcome of an operator action.
+type ActionResult struct {
+	Message string `json:"message"`
+}
+
+// AuditEventListParams contains parameters for listing audit events.
+type AuditEventListParams struct {
+	MetadataFilter map[string]any // Only events of sessions matching these key-value pairs
+	TargetType     string         // "run", "tool_execution" or "leader"
+	TargetID       string
+	Actor          string
+	Limit          int
+	Offset         int
+}
+
+// AuditEventList contains a page of audit events.
+type AuditEventList struct {
+	Events     []*driver.AuditEvent `json:"events"`
+	TotalCount int                  `json:"total_count"`
+	HasMore    bool                 `json:"has_more"`
+}
+
+// AgentInput contains the editable fields of an agent definition.
+type AgentInput struct {
+	Name         string
+	Description  string
+	Model        string
+	SystemPrompt string
+	ToolNames    []string
+	AgentIDs     []uuid.UUID
+	MaxTokens    *int
+	Temperature  *float64
+	TopK         *int
+	TopP         *float64
+	Metadata     map[string]any
+}
+
+// AgentFormOptions contains the choices offered when editing an agent.
+type AgentFormOptions struct {
+	Tools  []*driver.ToolDefinition  `json:"tools"`  // Registered tools, excluding agent tools
+	Agents []*driver.AgentDefinition `json:"agents"` // Agents that can be delegated to
+	Models []string                  `json:"models"` // Models used by existing agents
+}
+
+// AgentHistory contains an agent with its recorded versions.
+type AgentHistory struct {
+	Agent    *driver.AgentDefinition `json:"agent"`
+	Versions []*AgentVersionEntry    `json:"versions"`
+}
+
+// AgentVersionEntry is a version of an agent with the audit event that
+// recorded it. Action and Actor are empty for changes made through the API.
+type AgentVersionEntry struct {
+	Version   *driver.AgentVersion `json:"version"`
+	Action    string               `json:"action,omitempty"`
+	Actor     string               `json:"actor,omitempty"`
+	Restored  *int                 `json:"restored,omitempty"` // Version restored by an agent.restore action
+	IsCurrent bool                 `json:"is_current"`
+}
+
+// AgentDiff contains the differences between two versions of an agent.
+type AgentDiff struct {
+	From         *driver.AgentVersion `json:"from"`
+	To           *driver.AgentVersion `json:"to"`
+	Changes      []FieldChange        `json:"changes"`
+	SystemPrompt []DiffLine           `json:"system_prompt,omitempty"` // Line diff, set when the prompt changed
+}
+
+// FieldChange describes a changed field of an agent definition.
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// DiffLine is a line of a line diff. Op is "=", "-" or "+".
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}